@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/auth/ldap"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains personal access tokens: named, long-lived tokens used for
+// automation, e.g. by CI pipelines. Unlike JWTs, they don't expire; they're
+// accepted as long as their record exists. Their value is
+// "pat_<id>_<secret>", of which only a hash is stored. Only the user is
+// recorded: like with client certificates, the principals are looked up
+// whenever the token is used, so that an LDAP user's token follows the
+// user's current groups and stops working once the user is removed.
+
+const (
+	// accessTokenPrefix starts the value of all personal access tokens
+	accessTokenPrefix = "pat_"
+
+	// accessTokenIDLength and accessTokenSecretLength are the number of random
+	// bytes in the ID and secret part of a personal access token
+	accessTokenIDLength     = 8
+	accessTokenSecretLength = 32
+)
+
+// IsAccessToken checks whether the given string looks like a personal access
+// token rather than a JWT; it's not validated.
+// params:
+//  tokenStr: token sent with a request
+// return values:
+//  bool: true if tokenStr has the format of a personal access token
+func IsAccessToken(tokenStr string) bool {
+	_, _, ok := splitAccessToken(tokenStr)
+	return ok
+}
+
+// splitAccessToken splits a personal access token into its ID and secret.
+// params:
+//  tokenStr: token sent with a request
+// return values:
+//  string: the token's ID
+//  string: the token's secret
+//  bool: false if tokenStr isn't a well-formed personal access token
+func splitAccessToken(tokenStr string) (string, string, bool) {
+	if !strings.HasPrefix(tokenStr, accessTokenPrefix) {
+		return "", "", false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(tokenStr, accessTokenPrefix), "_")
+	if len(parts) != 2 || len(parts[0]) != 2*accessTokenIDLength || len(parts[1]) != 2*accessTokenSecretLength {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// hashAccessToken returns the hash of a personal access token which is stored
+// in place of its value
+func hashAccessToken(tokenStr string) string {
+	sum := sha256.Sum256([]byte(tokenStr))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// NewAccessToken creates a personal access token for the user of the given
+// token; it's granted the user's role and tenants at the time it's used.
+// params:
+//  name: name of the new token
+//  authZ: the creating user's token
+//  now: creation time
+// return values:
+//  *types.AccessToken: the stored record of the new token
+//  string: the token's value; it can't be recovered later on
+//  error: as returned by consecutive func calls
+func NewAccessToken(name string, authZ *Token, now time.Time) (*types.AccessToken, string, error) {
+	id, err := randomHex(accessTokenIDLength)
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := randomHex(accessTokenSecretLength)
+	if err != nil {
+		return nil, "", err
+	}
+
+	tokenStr := accessTokenPrefix + id + "_" + secret
+
+	record := &types.AccessToken{
+		ID:        id,
+		Name:      name,
+		Username:  authZ.GetClaim(UsernameClaimKey),
+		Prefix:    accessTokenPrefix + id,
+		Hash:      hashAccessToken(tokenStr),
+		CreatedAt: now.Unix(),
+	}
+
+	if err := db.AddAccessToken(record); err != nil {
+		return nil, "", err
+	}
+
+	log.Infof("Created access token %q (%q) for user %q", record.ID, name, record.Username)
+
+	return record, tokenStr, nil
+}
+
+// AuthenticateAccessToken validates a personal access token against its stored
+// record and returns an (unsigned) token carrying the record's user and the
+// user's current principals. Its ID is the record's ID and it was issued when
+// the record was created, so revoking the tokens of its user or principals
+// revokes it as well.
+// params:
+//  tokenStr: personal access token sent with a request
+// return values:
+//  *Token: token object carrying the access token's user and principals
+//  error: auth_errors.ErrAccessDenied if the token is unknown or was deleted,
+//         or its user no longer exists or is disabled, otherwise as returned
+//         by consecutive func calls, e.g. auth_errors.ErrLDAPConnectionFailed
+//         if the directory couldn't be reached
+func AuthenticateAccessToken(tokenStr string) (*Token, error) {
+	id, _, ok := splitAccessToken(tokenStr)
+	if !ok {
+		return nil, auth_errors.ErrAccessDenied
+	}
+
+	record, err := db.GetAccessToken(id)
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil, auth_errors.ErrAccessDenied
+		}
+
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAccessToken(tokenStr)), []byte(record.Hash)) != 1 {
+		return nil, auth_errors.ErrAccessDenied
+	}
+
+	principals, err := accessTokenPrincipals(record.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	authZ, err := NewTokenWithClaims(principals)
+	if err != nil {
+		return nil, err
+	}
+
+	authZ.AddClaim(UsernameClaimKey, record.Username)
+	authZ.AddClaim(IDClaimKey, record.ID)
+	authZ.AddClaim(IssuedAtClaimKey, record.CreatedAt)
+	authZ.AddClaim(AccessTokenClaimKey, true)
+
+	return authZ, nil
+}
+
+// accessTokenPrincipals looks up the current principals of the user a personal
+// access token was created by: the local user, or else the LDAP/AD user and
+// its groups. The principals recorded by earlier versions are ignored.
+// params:
+//  username: the local username or the AD DN, as in tokens issued at login
+// return values:
+//  []string: the user's principals
+//  error: as documented for AuthenticateAccessToken
+func accessTokenPrincipals(username string) ([]string, error) {
+	user, err := db.GetLocalUser(username)
+	switch {
+	case err == nil && user.DeletedAt == 0:
+		if user.Disable {
+			log.Debugf("Local user %q is disabled", username)
+			return nil, auth_errors.ErrAccessDenied
+		}
+
+		return []string{user.Username}, nil
+	case err != nil && err != auth_errors.ErrKeyNotFound:
+		return nil, err
+	}
+
+	groups, err := ldap.LookupDN(username)
+	switch err {
+	case nil:
+		return groups, nil
+	case auth_errors.ErrKeyNotFound, auth_errors.ErrLDAPConfigurationNotFound, auth_errors.ErrUserNotFound,
+		auth_errors.ErrUserDisabled, auth_errors.ErrLDAPGroupsNotFound:
+		log.Debugf("Access token user %q no longer exists or is disabled: %v", username, err)
+		return nil, auth_errors.ErrAccessDenied
+	default:
+		return nil, err
+	}
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"encoding/json"
+
+	log "github.com/Sirupsen/logrus"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/contivmodel/client"
+)
+
+// This file contains the filters of netmaster's aggregated inspect endpoints,
+// whose oper state summarizes the objects of all tenants. The summaries are
+// recomputed from the objects of the caller's tenants, which netmaster lists
+// separately (e.g. GET /api/v1/networks/). Unlike the list filters, these fail
+// closed: responses whose shape isn't known are never returned, since they may
+// carry data of other tenants.
+
+// AggregateFilter filters the response of an aggregated inspect endpoint.
+// params:
+//  t: token of the caller
+//  body: response of the inspect endpoint
+//  entries: netmaster's list of the summarized objects of all tenants
+// return values:
+//  []byte: filtered response
+//  error: nil if successful, auth_errors.ErrUnknownResponseShape if either
+//    response isn't in the expected shape
+type AggregateFilter func(t *Token, body, entries []byte) ([]byte, error)
+
+// tenantChecker returns a function which tells whether the token is authorized
+// for a tenant; results are cached since many objects share a tenant.
+func tenantChecker(t *Token) func(string) bool {
+	checked := map[string]bool{}
+
+	return func(tenant string) bool {
+		authorized, found := checked[tenant]
+		if !found {
+			authorized = t.CheckClaims(types.Tenant(tenant), types.Guest) == nil
+			checked[tenant] = authorized
+		}
+
+		return authorized
+	}
+}
+
+// checkFields checks that `data` is a JSON object which has no fields other than `known`.
+func checkFields(data []byte, known ...string) (map[string]json.RawMessage, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return nil, auth_errors.ErrUnknownResponseShape
+	}
+
+	for name := range fields {
+		found := false
+		for _, k := range known {
+			found = found || name == k
+		}
+
+		if !found {
+			log.Warnf("Unknown field %q in response", name)
+			return nil, auth_errors.ErrUnknownResponseShape
+		}
+	}
+
+	return fields, nil
+}
+
+// checkInspectShape checks that `body` is an inspect response whose oper state
+// has no fields other than `operFields`. The config isn't checked since it's
+// returned as is.
+func checkInspectShape(body []byte, operFields ...string) error {
+	fields, err := checkFields(body, "Config", "Oper")
+	if err != nil {
+		return err
+	}
+
+	if _, found := fields["Config"]; !found {
+		return auth_errors.ErrUnknownResponseShape
+	}
+
+	oper, found := fields["Oper"]
+	if !found {
+		return auth_errors.ErrUnknownResponseShape
+	}
+
+	_, err = checkFields(oper, operFields...)
+	return err
+}
+
+// FilterGlobalInspect filters the response from GET /api/v1/inspect/globals/{name}/
+// given the response from GET /api/v1/networks/.
+func FilterGlobalInspect(t *Token, body, networks []byte) ([]byte, error) {
+	return filterGlobalInspect(tenantChecker(t), body, networks)
+}
+
+// filterGlobalInspect only counts the networks of authorized tenants. Which
+// VLANs and VXLANs are in use is only known for the whole fabric, so it's
+// left out.
+func filterGlobalInspect(authorized func(string) bool, body, networks []byte) ([]byte, error) {
+	err := checkInspectShape(body, "defaultNetwork", "freeVXLANsStart", "numNetworks", "vlansInUse", "vxlansInUse")
+	if err != nil {
+		return nil, err
+	}
+
+	inspect := client.GlobalInspect{}
+	if err := json.Unmarshal(body, &inspect); err != nil {
+		log.Errorf("Failed to unmarshal global inspect %s: %#v", body, err)
+		return nil, auth_errors.ErrUnknownResponseShape
+	}
+
+	allNetworks := []client.Network{}
+	if err := json.Unmarshal(networks, &allNetworks); err != nil {
+		log.Errorf("Failed to unmarshal networks %s: %#v", networks, err)
+		return nil, auth_errors.ErrUnknownResponseShape
+	}
+
+	oper := client.GlobalOper{}
+	for _, network := range allNetworks {
+		if !authorized(network.TenantName) {
+			continue
+		}
+
+		oper.NumNetworks++
+		if network.NetworkName == inspect.Oper.DefaultNetwork {
+			oper.DefaultNetwork = network.NetworkName
+		}
+	}
+
+	inspect.Oper = oper
+	return json.Marshal(inspect)
+}
+
+// FilterAciGwInspect filters the response from GET /api/v1/inspect/aciGws/{name}/
+// given the response from GET /api/v1/appProfiles/.
+func FilterAciGwInspect(t *Token, body, appProfiles []byte) ([]byte, error) {
+	return filterAciGwInspect(tenantChecker(t), body, appProfiles)
+}
+
+// filterAciGwInspect only counts the app. profiles of authorized tenants.
+func filterAciGwInspect(authorized func(string) bool, body, appProfiles []byte) ([]byte, error) {
+	if err := checkInspectShape(body, "numAppProfiles"); err != nil {
+		return nil, err
+	}
+
+	inspect := client.AciGwInspect{}
+	if err := json.Unmarshal(body, &inspect); err != nil {
+		log.Errorf("Failed to unmarshal ACI gateway inspect %s: %#v", body, err)
+		return nil, auth_errors.ErrUnknownResponseShape
+	}
+
+	allAppProfiles := []client.AppProfile{}
+	if err := json.Unmarshal(appProfiles, &allAppProfiles); err != nil {
+		log.Errorf("Failed to unmarshal app. profiles %s: %#v", appProfiles, err)
+		return nil, auth_errors.ErrUnknownResponseShape
+	}
+
+	oper := client.AciGwOper{}
+	for _, ap := range allAppProfiles {
+		if authorized(ap.TenantName) {
+			oper.NumAppProfiles++
+		}
+	}
+
+	inspect.Oper = oper
+	return json.Marshal(inspect)
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/contivmodel/client"
+)
+
+// readTestdata returns the contents of a file in testdata/
+func readTestdata(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", name, err)
+	}
+
+	return data
+}
+
+// authorizedFor returns a tenant check which passes for the given tenants
+func authorizedFor(tenants ...string) func(string) bool {
+	return func(tenant string) bool {
+		for _, t := range tenants {
+			if t == tenant {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// TestFilterGlobalInspect tests that the global summary only counts the networks of authorized tenants
+func TestFilterGlobalInspect(t *testing.T) {
+	body := readTestdata(t, "globals_inspect.json")
+	networks := readTestdata(t, "networks.json")
+
+	testCases := []struct {
+		description string
+		tenants     []string
+		networks    []byte
+		expected    client.GlobalOper
+	}{
+		{"no tenants", nil, networks, client.GlobalOper{}},
+		{"no networks", []string{"t1"}, []byte("[]"), client.GlobalOper{}},
+		{"one tenant", []string{"t1"}, networks, client.GlobalOper{NumNetworks: 2}},
+		{"several tenants", []string{"t1", "t2"}, networks, client.GlobalOper{NumNetworks: 3}},
+		{"default network", []string{"default", "t2"}, networks, client.GlobalOper{NumNetworks: 3, DefaultNetwork: "contiv-net"}},
+	}
+
+	for _, tc := range testCases {
+		filtered, err := filterGlobalInspect(authorizedFor(tc.tenants...), body, tc.networks)
+		if err != nil {
+			t.Errorf("%s: failed to filter: %s", tc.description, err)
+			continue
+		}
+
+		inspect := client.GlobalInspect{}
+		if err := json.Unmarshal(filtered, &inspect); err != nil {
+			t.Errorf("%s: failed to unmarshal %s: %s", tc.description, filtered, err)
+			continue
+		}
+
+		if inspect.Oper != tc.expected {
+			t.Errorf("%s: expected %#v, got %#v", tc.description, tc.expected, inspect.Oper)
+		}
+
+		if inspect.Config.Vxlans != "1-10000" || inspect.Config.FwdMode != "bridge" {
+			t.Errorf("%s: expected the config to be kept, got %#v", tc.description, inspect.Config)
+		}
+	}
+}
+
+// TestFilterAciGwInspect tests that the ACI gateway summary only counts the app. profiles of authorized tenants
+func TestFilterAciGwInspect(t *testing.T) {
+	body := readTestdata(t, "aciGws_inspect.json")
+	appProfiles := readTestdata(t, "appProfiles.json")
+
+	testCases := []struct {
+		tenants  []string
+		expected int
+	}{
+		{nil, 0},
+		{[]string{"t1"}, 1},
+		{[]string{"t1", "t3", "t4"}, 2},
+		{[]string{"t1", "t2", "t3"}, 3},
+	}
+
+	for _, tc := range testCases {
+		filtered, err := filterAciGwInspect(authorizedFor(tc.tenants...), body, appProfiles)
+		if err != nil {
+			t.Errorf("%v: failed to filter: %s", tc.tenants, err)
+			continue
+		}
+
+		inspect := client.AciGwInspect{}
+		if err := json.Unmarshal(filtered, &inspect); err != nil {
+			t.Errorf("%v: failed to unmarshal %s: %s", tc.tenants, filtered, err)
+			continue
+		}
+
+		if inspect.Oper.NumAppProfiles != tc.expected || inspect.Config.PhysicalDomain != "allVlans" {
+			t.Errorf("%v: expected %d app. profiles, got %#v", tc.tenants, tc.expected, inspect)
+		}
+	}
+}
+
+// TestAggregateFiltersFailClosed tests that responses of unknown shapes aren't returned
+func TestAggregateFiltersFailClosed(t *testing.T) {
+	body := readTestdata(t, "globals_inspect.json")
+	networks := readTestdata(t, "networks.json")
+	all := authorizedFor("default", "t1", "t2")
+
+	testCases := []struct {
+		description string
+		body        []byte
+		networks    []byte
+	}{
+		{"unknown oper field", []byte(`{"Config":{},"Oper":{"numNetworks":5,"networksByTenant":{"t2":1}}}`), networks},
+		{"unknown field", []byte(`{"Config":{},"Oper":{},"Tenants":["t1","t2"]}`), networks},
+		{"no oper", []byte(`{"Config":{}}`), networks},
+		{"no config", []byte(`{"Oper":{}}`), networks},
+		{"list", []byte(`[]`), networks},
+		{"null", []byte(`null`), networks},
+		{"not JSON", []byte(`404 page not found`), networks},
+		{"networks not a list", body, []byte(`{"networks":[]}`)},
+		{"networks not JSON", body, []byte(`<html></html>`)},
+	}
+
+	for _, tc := range testCases {
+		if filtered, err := filterGlobalInspect(all, tc.body, tc.networks); err != auth_errors.ErrUnknownResponseShape {
+			t.Errorf("%s: expected %v, got %s (%v)", tc.description, auth_errors.ErrUnknownResponseShape, filtered, err)
+		}
+	}
+
+	if _, err := filterAciGwInspect(all, body, []byte("[]")); err != auth_errors.ErrUnknownResponseShape {
+		t.Errorf("expected the global inspect to be rejected as an ACI gateway inspect, got %v", err)
+	}
+}
@@ -1,6 +1,11 @@
 package auth
 
 import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/contiv/auth_proxy/auth/kubernetes"
 	"github.com/contiv/auth_proxy/auth/ldap"
 	"github.com/contiv/auth_proxy/auth/local"
 	"github.com/contiv/auth_proxy/common"
@@ -13,38 +18,149 @@ import (
 	uuid "github.com/satori/go.uuid"
 )
 
+// LoginInfo tells how a user who logged in was authenticated
+type LoginInfo struct {
+	// PasswordChange is true if the local user has to change the password
+	// because it expired or has to be reset; the token can then only be used
+	// to change the password (see Token.PasswordChangeOnly())
+	PasswordChange bool
+
+	// CachedAuth is true if LDAP/AD couldn't be reached and the user was
+	// authenticated using their cached login (see Token.CachedAuth())
+	CachedAuth bool
+}
+
 // Authenticate authenticates the user against local DB or AD using the given credentials
 // it returns a token which carries the role, capabilities, etc.
 // params:
-//    username: local or AD username of the user
+//    username: local or AD username of the user; its case is ignored if usernames are
+//              normalized (see common.NormalizeUsername())
 //    password: password of the user
+//    otp: one-time password of local users with MFA enabled; empty otherwise
 // return values:
 //    `Token` string on successful authentication otherwise ErrADConfigNotFound or any relevant error.
-func Authenticate(username, password string) (string, error) {
-	userPrincipals, err := local.Authenticate(username, password)
+//    LoginInfo: how the user was authenticated
+func Authenticate(username, password, otp string) (string, LoginInfo, error) {
+	userPrincipals, passwordChange, err := local.Authenticate(username, password, otp)
 	if err == nil {
-		return generateToken(userPrincipals, username) // local authentication succeeded!
+		// the local user's name as stored, which may differ in case if usernames are normalized
+		localUsername := userPrincipals[0]
+
+		if passwordChange {
+			log.Infof("local user %q has to change their password", localUsername)
+
+			tokenStr, err := generatePasswordChangeToken(localUsername)
+			return tokenStr, LoginInfo{PasswordChange: true}, err
+		}
+
+		tokenStr, err := generateToken(userPrincipals, localUsername, nil) // local authentication succeeded!
+		return tokenStr, LoginInfo{}, err
 	}
 
 	// Same username can be there in both local setup and LDAP.
 	// So, we try LDAP if `access is denied` from local authentication; coz, the same user(name) could also be part of LDAP.
-	if err == auth_errors.ErrUserNotFound || err == auth_errors.ErrAccessDenied {
-		fqdn, userPrincipals, err := ldap.Authenticate(username, password)
+	// A disabled local user doesn't disable the LDAP user of the same name; if LDAP doesn't
+	// authenticate the user either, the local error is returned.
+	if err == auth_errors.ErrUserNotFound || err == auth_errors.ErrAccessDenied || err == auth_errors.ErrUserDisabled {
+		username = common.NormalizeUsername(username)
+
+		fqdn, userPrincipals, attributes, err := ldap.Authenticate(username, password)
 		// fqdn represents fully qualified domain name of the given `username`
 		if err == nil {
-			return generateToken(userPrincipals, fqdn) // ldap authentication succeeded!
+			recordLdapLogin(fqdn, time.Now())
+
+			tokenStr, err := generateToken(userPrincipals, fqdn, attributes) // ldap authentication succeeded!
+			return tokenStr, LoginInfo{}, err
 		}
+
+		// the directory couldn't be reached; fall back to the user's cached login if any
+		if err == auth_errors.ErrLDAPConnectionFailed {
+			if login, cacheErr := ldap.AuthenticateFromCache(username, password); cacheErr == nil {
+				log.Warnf("LDAP/AD unreachable; authenticated %q using the login cached at %s",
+					login.DN, time.Unix(login.CachedAt, 0).UTC().Format(time.RFC3339))
+				recordLdapLogin(login.DN, time.Now())
+
+				tokenStr, err := generateCachedAuthToken(login)
+				return tokenStr, LoginInfo{CachedAuth: true}, err
+			}
+		}
+	}
+	return "", LoginInfo{}, err // error from authentication
+}
+
+// ldapLoginResolution is how often the last login of an LDAP user is recorded at most
+const ldapLoginResolution = time.Minute
+
+// recordLdapLogin records the time of an LDAP user's login unless the last one
+// was recorded less than ldapLoginResolution ago; local users record theirs in
+// local.Authenticate(). Failures are only logged, as the login mustn't fail
+// because of them.
+// params:
+//    dn: DN of the user who just logged in
+//    now: time of the login
+func recordLdapLogin(dn string, now time.Time) {
+	if last, err := db.GetPrincipalLogin(dn); err == nil && now.Sub(time.Unix(last.LastLogin, 0)) < ldapLoginResolution {
+		return
+	}
+
+	if err := db.RecordPrincipalLogin(dn, now.Unix()); err != nil {
+		log.Warnf("Failed to record the last login of LDAP user %q: %#v", dn, err)
 	}
-	return "", err // error from authentication
+}
+
+// AuthenticateServiceAccount authenticates a Kubernetes ServiceAccount token using
+// the TokenReview API and returns an (unsigned) token for the ServiceAccount. Its
+// principal is the full ServiceAccount username, so it's authorized by adding
+// authorizations for e.g. "system:serviceaccount:default:my-controller".
+// params:
+//    tokenStr: bearer token of a Kubernetes ServiceAccount
+// return values:
+//    *Token: token object carrying the ServiceAccount's principal and username
+//    error: as returned by kubernetes.Authenticate() or NewTokenWithClaims()
+func AuthenticateServiceAccount(tokenStr string) (*Token, error) {
+	username, err := kubernetes.Authenticate(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	authZ, err := NewTokenWithClaims([]string{username})
+	if err != nil {
+		return nil, err
+	}
+
+	authZ.AddClaim(UsernameClaimKey, username)
+
+	return authZ, nil
+}
+
+// RefreshToken issues a new token for the user and principals of a valid token
+// which is within its refresh window (see common.TokenRefreshWindowKey). The
+// principals' roles are looked up again, just like when the user logs in.
+// Tokens which can only be used to change the password and tokens issued using
+// a cached LDAP login can't be refreshed; the user has to log in again.
+// Personal access tokens don't expire and client certificates are presented
+// with every request, so there's nothing to refresh.
+// params:
+//    authZ: token which passed validation, i.e. it's neither expired nor revoked
+// return values:
+//    `Token` string on success, ErrTokenRefreshNotAllowed if the token can't be
+//    refreshed (yet), otherwise any relevant error from the subsequent function
+func RefreshToken(authZ *Token) (string, error) {
+	if authZ.PasswordChangeOnly() || authZ.CachedAuth() || authZ.AccessToken() || authZ.ClientCertificate() || !authZ.refreshable(time.Now().Unix()) {
+		return "", auth_errors.ErrTokenRefreshNotAllowed
+	}
+
+	return generateToken(authZ.Principals(), authZ.GetClaim(UsernameClaimKey), authZ.Attributes())
 }
 
 // generateToken generates JWT(JSON Web Token) with the given user principals
 // params:
 //  principals: user principals; []string containing LDAP groups or username based on the authentication type(LDAP/Local)
 //  username: local or AD username of the user
+//  attributes: attributes of LDAP users (see ldap.UserAttributes()); nil for local users
 // return values:
 //    `Token` string on successful creation of JWT otherwise any relevant error from the subsequent function
-func generateToken(principals []string, username string) (string, error) {
+func generateToken(principals []string, username string, attributes map[string]string) (string, error) {
 	log.Debugf("generating token for user %q", username)
 
 	authZ, err := NewTokenWithClaims(principals) // create a new token with default `expiry` claim
@@ -54,6 +170,46 @@ func generateToken(principals []string, username string) (string, error) {
 
 	// finally, add username to the token
 	authZ.AddClaim(UsernameClaimKey, username)
+	authZ.AddAttributesClaim(attributes)
+
+	return authZ.Stringify()
+}
+
+// generatePasswordChangeToken generates a JWT which carries no principals and
+// is only accepted for changing the user's password.
+// params:
+//  username: local username of the user
+// return values:
+//    `Token` string on successful creation of JWT otherwise any relevant error from the subsequent function
+func generatePasswordChangeToken(username string) (string, error) {
+	log.Debugf("generating password change token for user %q", username)
+
+	authZ := NewToken()
+	authZ.AddClaim(UsernameClaimKey, username)
+	authZ.AddClaim(PasswordChangeOnlyClaimKey, true)
+
+	return authZ.Stringify()
+}
+
+// generateCachedAuthToken generates a JWT for a user authenticated using their
+// cached LDAP login. It's marked with CachedAuthClaimKey and expires no later
+// than the cached login.
+// params:
+//  login: cached login of the user
+// return values:
+//    `Token` string on successful creation of JWT otherwise any relevant error from the subsequent function
+func generateCachedAuthToken(login *types.LdapCachedLogin) (string, error) {
+	log.Debugf("generating token for user %q from the LDAP login cache", login.DN)
+
+	authZ, err := NewTokenWithClaims(login.Groups)
+	if err != nil {
+		return "", err
+	}
+
+	authZ.AddClaim(UsernameClaimKey, login.DN)
+	authZ.AddAttributesClaim(login.Attributes)
+	authZ.AddClaim(CachedAuthClaimKey, true)
+	authZ.capExpiry(login.ExpiresAt)
 
 	return authZ.Stringify()
 }
@@ -106,6 +262,9 @@ func checkAccessClaim(granted types.RoleType, desired interface{}) error {
 //  principalName: Name of user for whom the authorization is to be added,
 //            Can either be a local user or an LDAP group.
 //  isLocal: true if the named principal is a local user, false if ldap group.
+//  expiresAt: time (in seconds since the epoch) at which the authorization
+//            expires; 0 if it never expires
+//  grantedBy: user making the grant; recorded in the authorization
 //
 // Return values:
 //  types.Authorization: new authorization that was added
@@ -114,9 +273,10 @@ func checkAccessClaim(granted types.RoleType, desired interface{}) error {
 //      local admin user.
 //
 func AddAuthorization(tenantName string, role types.RoleType, principalName string,
-	isLocal bool) (types.Authorization, error) {
+	isLocal bool, expiresAt int64, grantedBy string) (types.Authorization, error) {
 
 	defer common.Untrace(common.Trace())
+	defer InvalidateAuthorizationCache()
 	var authz types.Authorization
 	var err error
 
@@ -132,12 +292,12 @@ func AddAuthorization(tenantName string, role types.RoleType, principalName stri
 	// Short circuit to just adding/updating role claim since we don't care
 	// about tenant specific info for admins
 	case types.Admin:
-		authz, err = addUpdateRoleAuthorization(role, principalName, isLocal)
+		authz, err = addUpdateRoleAuthorization(role, principalName, isLocal, expiresAt, grantedBy)
 	default:
-		authz, err = addTenantAuthorization(tenantName, role, principalName, isLocal)
+		authz, err = addTenantAuthorization(tenantName, role, principalName, isLocal, expiresAt, grantedBy)
 		if err == nil {
 			// Ignore role authorization claim
-			_, err = addUpdateRoleAuthorization(role, principalName, isLocal)
+			_, err = addUpdateRoleAuthorization(role, principalName, isLocal, expiresAt, grantedBy)
 		}
 	}
 
@@ -156,6 +316,8 @@ func AddAuthorization(tenantName string, role types.RoleType, principalName stri
 //  principalName: Name of user for whom the authorization is to be added,
 //            Can either be a local user or an LDAP group.
 //  isLocal: true if the named principal is a local user, false if ldap group.
+//  expiresAt: expiry time of the authorization; 0 if it never expires
+//  grantedBy: user making the grant
 //
 // Return values:
 //    TODO: errors.NonExistentLocalUserError: if a local user doesn't exist
@@ -163,7 +325,7 @@ func AddAuthorization(tenantName string, role types.RoleType, principalName stri
 //    : error from db.InsertAuthorization if adding a tenant authorization
 //      fails.
 func addTenantAuthorization(tenantName string, role types.RoleType, principalName string,
-	isLocal bool) (types.Authorization, error) {
+	isLocal bool, expiresAt int64, grantedBy string) (types.Authorization, error) {
 
 	claimStr, err := GenerateClaimKey(types.Tenant(tenantName))
 	if err != nil {
@@ -176,6 +338,7 @@ func addTenantAuthorization(tenantName string, role types.RoleType, principalNam
 	if err != nil {
 		return types.Authorization{}, err
 	}
+	now := time.Now().Unix()
 	tenantAuthz := types.Authorization{
 		CommonState: types.CommonState{
 			StateDriver: sd,
@@ -186,6 +349,10 @@ func addTenantAuthorization(tenantName string, role types.RoleType, principalNam
 		Local:         isLocal,
 		ClaimKey:      claimStr,
 		ClaimValue:    role.String(),
+		ExpiresAt:     expiresAt,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		GrantedBy:     grantedBy,
 	}
 
 	// insert tenant authorization
@@ -199,17 +366,25 @@ func addTenantAuthorization(tenantName string, role types.RoleType, principalNam
 }
 
 // addUpdaterRoleAuthorization adds/updates authorization claim for a specific
-// named principal's role. This claim "caches" the highest privilege role claim
-// for the principal. This authorization is used by APIs that only need to
-// check for role claim (e.g., admin role claim for global object).  Update is
-// only perfomed if role specified is higher privilege than existing role claim
-// for the principal.
+// named principal's role. These claims "cache" the highest privilege role
+// claim for the principal. They are used by APIs that only need to check for
+// role claim (e.g., admin role claim for global object); see highestRole().
+//
+// A principal has at most one permanent role claim, which is only updated by
+// permanent grants of a higher privilege role. Temporary grants leave it alone
+// and get role claims of their own, which are extended by later grants of the
+// same role, so that the principal falls back to its permanent role once they
+// expire. No role claim is added if an existing one already grants at least
+// the role for at least as long.
 //
 // Parameters:
 //  role: type of role that specifies permissions associated with tenant
 //  principalName: Name of user for whom the authorization is to be added,
 //            Can either be a local user or an LDAP group.
 //  isLocal: true if the named principal is a local user, false if ldap group.
+//  expiresAt: expiry time of the authorization the role claim is added for;
+//            0 if it never expires
+//  grantedBy: user making the grant the role claim is added for
 //
 // Return values:
 //    TODO: errors.NonExistentLocalUserError: if a local user doesn't exist
@@ -219,54 +394,123 @@ func addTenantAuthorization(tenantName string, role types.RoleType, principalNam
 //    : error from db.ListAuthorizationsByClaimAndPrincipal if listing authorizations
 //      fails.
 func addUpdateRoleAuthorization(role types.RoleType, principalName string,
-	isLocal bool) (types.Authorization, error) {
+	isLocal bool, expiresAt int64, grantedBy string) (types.Authorization, error) {
 
-	authz, err := db.ListAuthorizationsByClaimAndPrincipal(types.RoleClaimKey, principalName)
+	authzs, err := db.ListAuthorizationsByClaimAndPrincipal(types.RoleClaimKey, principalName)
 	if err != nil {
 		log.Error("failed in listing role claim for principal ",
 			principalName, ", error:", err)
 		return types.Authorization{}, err
 	}
 
-	l := len(authz)
-	switch {
-	case l == 0:
-		// A role authz doesn't exist, add one
-		return addRoleAuthorization(principalName, isLocal, role)
-
-	case l == 1:
-		roleAuthz := authz[0]
+	var permanent, extendable *types.Authorization
+	for i := range authzs {
+		roleAuthz := &authzs[i]
 		grantedRole, err := types.Role(roleAuthz.ClaimValue)
 		// Invalid claim in authorizations db
 		if err != nil {
-			log.Errorf("illegal role in authorization %#v", roleAuthz)
+			log.Errorf("illegal role in authorization %#v", *roleAuthz)
 			return types.Authorization{}, err
 		}
 
-		// Need to update if role < grantedRole
-		if role < grantedRole {
-			roleAuthz.ClaimValue = role.String()
-			// Inserting an existing authz updates it
-			if err := db.InsertAuthorization(&roleAuthz); err != nil {
-				log.Error("failed in updating role claim:", err)
-				return types.Authorization{}, err
-			}
+		switch {
+		case roleAuthz.ExpiresAt == 0 && permanent != nil:
+			// There should only be one permanent role authz claim, so return error
+			log.Error("multiple permanent role authorizations found for principal ", principalName)
+			return types.Authorization{}, auth_errors.ErrInternal
+		case roleAuthz.ExpiresAt == 0:
+			permanent = roleAuthz
+		case grantedRole == role:
+			extendable = roleAuthz
+		}
 
-			log.Info("updated role claim for principal ", principalName,
-				", previous:", grantedRole.String(), ", updated:", role.String())
-			return roleAuthz, nil
+		// A temporary grant is covered by any role claim granting at least the
+		// role for at least as long
+		if expiresAt != 0 && grantedRole <= role && !extendsExpiry(roleAuthz.ExpiresAt, expiresAt) {
+			log.Info("not updating role claim for principal ", principalName,
+				", previous:", grantedRole.String(), ", requested:", role.String())
+			return *roleAuthz, nil
 		}
+	}
 
-		log.Info("not updating role claim for principal ", principalName,
-			", previous:", grantedRole.String(), ", requested:", role.String())
-		return roleAuthz, nil
+	switch {
+	case expiresAt != 0 && extendable != nil:
+		// A temporary role claim lasts as long as the longest authorization it was added for
+		extendable.ExpiresAt = expiresAt
+		extendable.UpdatedAt = time.Now().Unix()
+		if err := db.InsertAuthorization(extendable); err != nil {
+			log.Error("failed in extending role claim:", err)
+			return types.Authorization{}, err
+		}
 
-	default:
-		// There should only be one role authz claim, so return error
-		log.Error("multiple role authorizations found, expected 1, found ", l)
-		return types.Authorization{}, auth_errors.ErrInternal
+		log.Info("extended role claim for principal ", principalName, " until ", expiresAt)
+		return *extendable, nil
 
+	case expiresAt != 0 || permanent == nil:
+		// A (temporary) role authz doesn't exist, add one
+		return addRoleAuthorization(principalName, isLocal, role, expiresAt, grantedBy)
 	}
+
+	grantedRole, _ := types.Role(permanent.ClaimValue)
+
+	// Need to update if role < grantedRole
+	if role < grantedRole {
+		permanent.ClaimValue = role.String()
+		permanent.UpdatedAt = time.Now().Unix()
+		permanent.GrantedBy = grantedBy
+		// Inserting an existing authz updates it
+		if err := db.InsertAuthorization(permanent); err != nil {
+			log.Error("failed in updating role claim:", err)
+			return types.Authorization{}, err
+		}
+
+		log.Info("updated role claim for principal ", principalName,
+			", previous:", grantedRole.String(), ", updated:", role.String())
+		return *permanent, nil
+	}
+
+	log.Info("not updating role claim for principal ", principalName,
+		", previous:", grantedRole.String(), ", requested:", role.String())
+	return *permanent, nil
+}
+
+// extendsExpiry returns true if an authorization expiring at `requested`
+// outlasts one expiring at `current` (0 meaning never).
+func extendsExpiry(current, requested int64) bool {
+	return current != 0 && (requested == 0 || requested > current)
+}
+
+// highestRole returns the role claim granting the highest privilege role among
+// the given role claims of a principal, and the longest lasting one among
+// those granting the same role. Role claims with an invalid role are skipped.
+//
+// Parameters:
+//  authzs: unexpired role claims of a principal
+//
+// Return values:
+//  types.Authorization: the role claim granting the highest role
+//  types.RoleType: the role it grants
+//  bool: false if there's no valid role claim
+func highestRole(authzs []types.Authorization) (types.Authorization, types.RoleType, bool) {
+	var (
+		highest types.Authorization
+		role    types.RoleType
+		found   bool
+	)
+
+	for _, authz := range authzs {
+		granted, err := types.Role(authz.ClaimValue)
+		if err != nil {
+			log.Error("invalid role claim found for principal ", authz.PrincipalName)
+			continue
+		}
+
+		if !found || granted < role || (granted == role && extendsExpiry(highest.ExpiresAt, authz.ExpiresAt)) {
+			highest, role, found = authz, granted, true
+		}
+	}
+
+	return highest, role, found
 }
 
 //
@@ -287,6 +531,7 @@ func addUpdateRoleAuthorization(role types.RoleType, principalName string,
 func DeleteAuthorization(authUUID string) error {
 
 	defer common.Untrace(common.Trace())
+	defer InvalidateAuthorizationCache()
 
 	// Return error if authorization doesn't exist
 	authorization, err := db.GetAuthorization(authUUID)
@@ -311,6 +556,136 @@ func DeleteAuthorization(authUUID string) error {
 	return nil
 }
 
+//
+// UpdateAuthorizationExpiry changes the expiry time of an authorization. The
+// role claim of the principal is extended along with tenant authorizations.
+//
+// Parameters:
+//  authUUID: UUID of the authorization object
+//  expiresAt: new expiry time (in seconds since the epoch); 0 if it never expires
+//
+// Return values:
+//  types.Authorization: the updated authorization
+//  error: nil if successful, else
+//    auth_errors.ErrIllegalOperation: if attempting to update authorization for
+//      built-in admin user.
+//    : error from db.GetAuthorization or db.InsertAuthorization if reading or
+//      updating the authorization fails
+//
+func UpdateAuthorizationExpiry(authUUID string, expiresAt int64) (types.Authorization, error) {
+
+	defer common.Untrace(common.Trace())
+	defer InvalidateAuthorizationCache()
+
+	authz, err := db.GetAuthorization(authUUID)
+	if err != nil {
+		log.Warn("failed to get authorization, err: ", err)
+		return types.Authorization{}, err
+	}
+
+	if authz.BelongsToBuiltInAdmin() {
+		log.Warn("can't update authorizations on built-in admin user")
+		return types.Authorization{}, auth_errors.ErrIllegalOperation
+	}
+
+	authz.ExpiresAt = expiresAt
+	authz.UpdatedAt = time.Now().Unix()
+	if err := db.InsertAuthorization(&authz); err != nil {
+		log.Warn("failed to update authorization, err: ", err)
+		return types.Authorization{}, err
+	}
+
+	if strings.HasPrefix(authz.ClaimKey, types.TenantClaimKey) {
+		role, err := types.Role(authz.ClaimValue)
+		if err != nil {
+			log.Errorf("illegal role in authorization %#v", authz)
+			return types.Authorization{}, err
+		}
+
+		if _, err := addUpdateRoleAuthorization(role, authz.PrincipalName, authz.Local, expiresAt, authz.GrantedBy); err != nil {
+			return types.Authorization{}, err
+		}
+	}
+
+	log.Infof("updated expiry of authorization %s to %d", authUUID, expiresAt)
+	return authz, nil
+}
+
+// authzUpdateMutex serializes the read-modify-write cycles of UpdateAuthorization()
+// within this proxy; the state drivers offer no compare-and-swap.
+var authzUpdateMutex sync.Mutex
+
+//
+// UpdateAuthorization changes the role, tenant and expiry time of a tenant
+// authorization in place; its UUID is kept. The state drivers don't support
+// compare-and-swap, so the authorization is read again before being written:
+// if it changed since the caller read it, nothing is written.
+//
+// Parameters:
+//  read: the authorization as read by the caller
+//  tenantName: tenant the authorization is moved to; may be the same
+//  role: role on the tenant; not admin
+//  expiresAt: new expiry time (in seconds since the epoch); 0 if it never expires
+//  grantedBy: user making the update, who grants the new role
+//
+// Return values:
+//  types.Authorization: the updated authorization
+//  error: nil if successful, else
+//    auth_errors.ErrIllegalOperation: if the authorization isn't a tenant
+//      authorization, belongs to the built-in admin user or `role` is admin
+//    auth_errors.ErrConcurrentUpdate: if the authorization changed since `read`
+//    : error from db.GetAuthorization or db.InsertAuthorization if reading or
+//      updating the authorization fails
+//
+func UpdateAuthorization(read types.Authorization, tenantName string, role types.RoleType,
+	expiresAt int64, grantedBy string) (types.Authorization, error) {
+
+	defer common.Untrace(common.Trace())
+	defer InvalidateAuthorizationCache()
+
+	if read.BelongsToBuiltInAdmin() || !strings.HasPrefix(read.ClaimKey, types.TenantClaimKey) || role == types.Admin {
+		log.Warn("only the role and tenant of tenant authorizations can be updated")
+		return types.Authorization{}, auth_errors.ErrIllegalOperation
+	}
+
+	claimKey, err := GenerateClaimKey(types.Tenant(tenantName))
+	if err != nil {
+		log.Error("failed in generating claim:", err)
+		return types.Authorization{}, err
+	}
+
+	authzUpdateMutex.Lock()
+	defer authzUpdateMutex.Unlock()
+
+	authz, err := db.GetAuthorization(read.UUID)
+	if err != nil {
+		log.Warn("failed to get authorization, err: ", err)
+		return types.Authorization{}, err
+	}
+
+	if authz.ClaimKey != read.ClaimKey || authz.ClaimValue != read.ClaimValue || authz.ExpiresAt != read.ExpiresAt {
+		log.Warnf("authorization %s changed while being updated", read.UUID)
+		return types.Authorization{}, auth_errors.ErrConcurrentUpdate
+	}
+
+	authz.ClaimKey = claimKey
+	authz.ClaimValue = role.String()
+	authz.ExpiresAt = expiresAt
+	authz.UpdatedAt = time.Now().Unix()
+	authz.GrantedBy = grantedBy
+	if err := db.InsertAuthorization(&authz); err != nil {
+		log.Warn("failed to update authorization, err: ", err)
+		return types.Authorization{}, err
+	}
+
+	if _, err := addUpdateRoleAuthorization(role, authz.PrincipalName, authz.Local, expiresAt, grantedBy); err != nil {
+		return types.Authorization{}, err
+	}
+
+	log.Infof("updated authorization %s: %s on %q until %d", authz.UUID, role.String(), tenantName, expiresAt)
+	return authz, nil
+}
+
 //
 // GetAuthorization returns a specific authorization
 // identified by the authzUUID
@@ -371,6 +746,8 @@ func ListAuthorizations() ([]types.Authorization, error) {
 //            Can either be a local user or an LDAP group.
 //  isLocal: true if the named principal is a local user, false if ldap group.
 //  role: role that needs to be added as claim value
+//  expiresAt: expiry time of the authorization; 0 if it never expires
+//  grantedBy: user making the grant; empty for the built-in admin's authorization
 //
 // Return values:
 //  types.Authorization: new authorization that was added
@@ -381,7 +758,7 @@ func ListAuthorizations() ([]types.Authorization, error) {
 //      fails.
 //
 func addRoleAuthorization(principalName string,
-	isLocal bool, role types.RoleType) (types.Authorization, error) {
+	isLocal bool, role types.RoleType, expiresAt int64, grantedBy string) (types.Authorization, error) {
 
 	defer common.Untrace(common.Trace())
 
@@ -390,6 +767,7 @@ func addRoleAuthorization(principalName string,
 	if err != nil {
 		return types.Authorization{}, err
 	}
+	now := time.Now().Unix()
 	roleAuthz := types.Authorization{
 		CommonState: types.CommonState{
 			StateDriver: sd,
@@ -400,6 +778,10 @@ func addRoleAuthorization(principalName string,
 		Local:         isLocal,
 		ClaimKey:      types.RoleClaimKey,
 		ClaimValue:    role.String(),
+		ExpiresAt:     expiresAt,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		GrantedBy:     grantedBy,
 	}
 
 	// insert authorization
@@ -430,9 +812,15 @@ func AddDefaultUsers() error {
 		if err == auth_errors.ErrKeyExists {
 			continue
 		} else if err == nil {
+			// the default users are exempt from the password policy, but they
+			// should get a password that follows it
+			if violations := common.PasswordPolicyViolations(localUser.Username, localUser.Password); len(violations) > 0 {
+				log.Warnf("The password of local user %q doesn't follow the password policy; change it", localUser.Username)
+			}
+
 			if user.String() == types.Admin.String() {
 				// Add admin role claim for admin user.
-				addRoleAuthorization(types.Admin.String(), true, types.Admin)
+				addRoleAuthorization(types.Admin.String(), true, types.Admin, 0, "")
 			}
 
 			continue
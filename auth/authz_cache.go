@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains the cache of the principals' authorizations, which saves
+// the data store reads made by the policy checks of every proxied request.
+// Authorizations are cached for common.AuthzCacheTTLKey seconds. Changes made
+// through this proxy invalidate the cache right away (see
+// InvalidateAuthorizationCache()); changes made through other proxies are only
+// seen once the cached entries expire, so the cache should be disabled if
+// several proxies share the data store and that isn't acceptable.
+
+// maxAuthzCacheEntries bounds the cache; expired entries are dropped once it's reached
+const maxAuthzCacheEntries = 1000
+
+// authzCacheEntry holds the authorizations of a principal
+type authzCacheEntry struct {
+	authzs  []types.Authorization
+	expires time.Time
+}
+
+var (
+	authzCacheMutex sync.Mutex
+	authzCache      = map[string]authzCacheEntry{} // by normalized principal name
+
+	// authzCacheGeneration is bumped by every invalidation, so that lookups
+	// which read the data store concurrently don't cache what they read
+	authzCacheGeneration uint64
+
+	authzCacheNow = time.Now // replaced by tests
+)
+
+// authzCacheTTL returns the time for which authorizations are cached; 0 if caching is disabled.
+func authzCacheTTL() time.Duration {
+	value, err := common.Global().Get(common.AuthzCacheTTLKey)
+	if err != nil {
+		return 0
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// InvalidateAuthorizationCache drops all cached authorizations. It must be
+// called whenever authorizations are added, changed or deleted.
+func InvalidateAuthorizationCache() {
+	authzCacheMutex.Lock()
+	defer authzCacheMutex.Unlock()
+
+	authzCache = map[string]authzCacheEntry{}
+	authzCacheGeneration++
+}
+
+// principalAuthorizations returns the unexpired authorizations of a principal,
+// from the cache if possible.
+// params:
+//  principal: name of the principal, e.g. a username or LDAP group
+// return values:
+//  []types.Authorization: authorizations of the principal; callers mustn't modify them
+//  error: as returned by db.ListAuthorizationsByPrincipal()
+func principalAuthorizations(principal string) ([]types.Authorization, error) {
+	ttl := authzCacheTTL()
+	if ttl == 0 {
+		return db.ListAuthorizationsByPrincipal(principal)
+	}
+
+	key := common.NormalizeUsername(principal)
+	authzs, generation, found := cachedAuthorizations(key)
+	if found {
+		return authzs, nil
+	}
+
+	authzs, err := db.ListAuthorizationsByPrincipal(principal)
+	if err != nil {
+		return nil, err
+	}
+
+	storeAuthorizations(key, generation, authzCacheEntry{authzs: authzs, expires: authzCacheNow().Add(ttl)})
+	return authzs, nil
+}
+
+// principalClaims returns the unexpired authorizations of a principal for the
+// given claim, in the order db.ListAuthorizationsByClaimAndPrincipal() would.
+// params:
+//  claimKey: claim to look for, e.g. types.RoleClaimKey
+//  principal: name of the principal
+// return values:
+//  []types.Authorization: matching authorizations
+//  error: as returned by principalAuthorizations()
+func principalClaims(claimKey, principal string) ([]types.Authorization, error) {
+	authzs, err := principalAuthorizations(principal)
+	if err != nil {
+		return nil, err
+	}
+
+	match := []types.Authorization{}
+	for _, authz := range authzs {
+		if authz.ClaimKey == claimKey {
+			match = append(match, authz)
+		}
+	}
+
+	return match, nil
+}
+
+// cachedAuthorizations returns the cached authorizations of a principal which
+// haven't expired since they were cached, along with the current generation.
+func cachedAuthorizations(key string) ([]types.Authorization, uint64, bool) {
+	authzCacheMutex.Lock()
+	defer authzCacheMutex.Unlock()
+
+	now := authzCacheNow()
+	entry, found := authzCache[key]
+	if !found || now.After(entry.expires) {
+		return nil, authzCacheGeneration, false
+	}
+
+	unexpired := []types.Authorization{}
+	for _, authz := range entry.authzs {
+		if !authz.Expired(now.Unix()) {
+			unexpired = append(unexpired, authz)
+		}
+	}
+
+	return unexpired, authzCacheGeneration, true
+}
+
+// storeAuthorizations caches the authorizations of a principal unless the
+// cache was invalidated since they were read.
+func storeAuthorizations(key string, generation uint64, entry authzCacheEntry) {
+	authzCacheMutex.Lock()
+	defer authzCacheMutex.Unlock()
+
+	if generation != authzCacheGeneration {
+		return
+	}
+
+	if len(authzCache) >= maxAuthzCacheEntries {
+		now := authzCacheNow()
+		for k, e := range authzCache {
+			if now.After(e.expires) {
+				delete(authzCache, k)
+			}
+		}
+
+		// still full; start over rather than grow without bounds
+		if len(authzCache) >= maxAuthzCacheEntries {
+			authzCache = map[string]authzCacheEntry{}
+		}
+	}
+
+	authzCache[key] = entry
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestAuthorizationCache tests that cached authorizations expire along with
+// their entry or themselves, and are dropped by invalidations
+func TestAuthorizationCache(t *testing.T) {
+	current := time.Now()
+	authzCacheNow = func() time.Time { return current }
+	defer func() {
+		authzCacheNow = time.Now
+		InvalidateAuthorizationCache()
+	}()
+
+	authzs := []types.Authorization{
+		{UUID: "permanent", ClaimKey: types.RoleClaimKey, ClaimValue: types.Ops.String()},
+		{UUID: "temporary", ClaimKey: types.TenantClaimKey + "t1", ClaimValue: types.Ops.String(),
+			ExpiresAt: current.Add(2 * time.Second).Unix()},
+	}
+
+	_, generation, found := cachedAuthorizations("user")
+	if found {
+		t.Fatal("expected an empty cache")
+	}
+
+	storeAuthorizations("user", generation, authzCacheEntry{authzs: authzs, expires: current.Add(5 * time.Second)})
+
+	if cached, _, found := cachedAuthorizations("user"); !found || len(cached) != 2 {
+		t.Errorf("expected both authorizations to be cached, got %v", cached)
+	}
+
+	// expired authorizations are left out before their entry expires
+	current = current.Add(3 * time.Second)
+	if cached, _, found := cachedAuthorizations("user"); !found || len(cached) != 1 || cached[0].UUID != "permanent" {
+		t.Errorf("expected only the permanent authorization, got %v", cached)
+	}
+
+	current = current.Add(3 * time.Second)
+	if _, _, found := cachedAuthorizations("user"); found {
+		t.Error("expected the entry to have expired")
+	}
+
+	// invalidations drop the entries, and what was read before them isn't cached
+	_, generation, _ = cachedAuthorizations("user")
+	storeAuthorizations("user", generation, authzCacheEntry{authzs: authzs, expires: current.Add(5 * time.Second)})
+	InvalidateAuthorizationCache()
+
+	if _, _, found := cachedAuthorizations("user"); found {
+		t.Error("expected the entry to have been invalidated")
+	}
+
+	storeAuthorizations("user", generation, authzCacheEntry{authzs: authzs, expires: current.Add(5 * time.Second)})
+	if _, _, found := cachedAuthorizations("user"); found {
+		t.Error("expected authorizations read before the invalidation not to be cached")
+	}
+}
+
+// TestAuthorizationCacheBound tests that the cache doesn't grow without bounds
+func TestAuthorizationCacheBound(t *testing.T) {
+	defer InvalidateAuthorizationCache()
+
+	expires := time.Now().Add(time.Minute)
+	for i := 0; i < 2*maxAuthzCacheEntries; i++ {
+		_, generation, _ := cachedAuthorizations("")
+		storeAuthorizations(fmt.Sprintf("user%d", i), generation, authzCacheEntry{expires: expires})
+
+		if len(authzCache) > maxAuthzCacheEntries {
+			t.Fatalf("expected at most %d entries, got %d", maxAuthzCacheEntries, len(authzCache))
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains adding several authorizations at once. The data store has
+// no transactions, so all-or-nothing is implemented by rolling back the
+// authorizations added so far (and the role claims they changed) on the first
+// failure.
+
+// AuthorizationGrant describes one of the authorizations added by AddAuthorizations().
+//
+// Fields:
+//  TenantName: tenant the role is granted on; ignored for the admin role
+//  Role: role granted to the principal
+//  PrincipalName: local user, LDAP user or group, or ServiceAccount
+//  Local: true if the principal is a local user
+//  ExpiresAt: expiry time in seconds since the epoch; 0 if it never expires
+//  GrantedBy: user making the grant
+type AuthorizationGrant struct {
+	TenantName    string
+	Role          types.RoleType
+	PrincipalName string
+	Local         bool
+	ExpiresAt     int64
+	GrantedBy     string
+}
+
+// roleSnapshot is a principal's role authorizations before a grant was added
+type roleSnapshot struct {
+	principal string
+	authzs    []types.Authorization
+}
+
+// ExistingGrant looks for an authorization which already grants the principal
+// a role on the grant's tenant, or the admin role for admin grants.
+//
+// Parameters:
+//  grant: the authorization to look for
+//
+// Return values:
+//  string: UUID of the existing authorization; empty if there's none
+//  error: nil if successful, else as returned by db.ListAuthorizationsByClaimAndPrincipal
+func ExistingGrant(grant *AuthorizationGrant) (string, error) {
+	claimKey := types.RoleClaimKey
+	if grant.Role != types.Admin {
+		var err error
+		if claimKey, err = GenerateClaimKey(types.Tenant(grant.TenantName)); err != nil {
+			return "", err
+		}
+	}
+
+	authzs, err := db.ListAuthorizationsByClaimAndPrincipal(claimKey, grant.PrincipalName)
+	if err != nil {
+		return "", err
+	}
+
+	for _, authz := range authzs {
+		// the role claim of a principal is only an admin grant if it's admin
+		if claimKey != types.RoleClaimKey || authz.ClaimValue == types.Admin.String() {
+			return authz.UUID, nil
+		}
+	}
+
+	return "", nil
+}
+
+// AddAuthorizations adds the given authorizations in order. Either all of them
+// are added or, if adding one fails, none are: the ones already added are
+// deleted again and the principals' role claims are restored.
+//
+// Parameters:
+//  grants: authorizations to add; they should have been validated
+//
+// Return values:
+//  []types.Authorization: the added authorizations, in the order of `grants`
+//  int: index of the grant which couldn't be added; -1 if all were added
+//  error: nil if successful, else as returned by AddAuthorization()
+func AddAuthorizations(grants []*AuthorizationGrant) ([]types.Authorization, int, error) {
+
+	defer common.Untrace(common.Trace())
+
+	added := []types.Authorization{}
+	snapshots := []roleSnapshot{}
+
+	for i, grant := range grants {
+		snapshot, err := snapshotRole(grant.PrincipalName)
+		if err == nil {
+			var authz types.Authorization
+			authz, err = AddAuthorization(grant.TenantName, grant.Role, grant.PrincipalName, grant.Local, grant.ExpiresAt, grant.GrantedBy)
+			if err == nil {
+				added = append(added, authz)
+				snapshots = append(snapshots, snapshot)
+				continue
+			}
+		}
+
+		log.Warnf("failed to add authorization %d of %d, rolling back: %s", i+1, len(grants), err)
+		rollbackAuthorizations(added, snapshots)
+
+		return nil, i, err
+	}
+
+	return added, -1, nil
+}
+
+// snapshotRole returns the current role authorizations of a principal.
+func snapshotRole(principal string) (roleSnapshot, error) {
+	authzs, err := db.ListAuthorizationsByClaimAndPrincipal(types.RoleClaimKey, principal)
+	return roleSnapshot{principal: principal, authzs: authzs}, err
+}
+
+// rollbackAuthorizations deletes the added authorizations and restores the
+// principals' role authorizations from before, most recent first. Failures are
+// logged; there's nothing else left to do about them.
+// params:
+//  added: authorizations added by AddAuthorizations()
+//  snapshots: role authorizations of the principals before each of them was added
+func rollbackAuthorizations(added []types.Authorization, snapshots []roleSnapshot) {
+	defer InvalidateAuthorizationCache()
+
+	for i := len(added) - 1; i >= 0; i-- {
+		if added[i].ClaimKey != types.RoleClaimKey {
+			if err := db.DeleteAuthorization(added[i].UUID); err != nil {
+				log.Errorf("failed to roll back authorization %s; manual cleanup needed: %s", added[i].UUID, err)
+			}
+		}
+
+		if err := restoreRole(snapshots[i]); err != nil {
+			log.Errorf("failed to restore the role claim of %q; manual cleanup needed: %s", snapshots[i].principal, err)
+		}
+	}
+}
+
+// restoreRole puts a principal's role authorizations back into the state of the snapshot.
+func restoreRole(snapshot roleSnapshot) error {
+	authzs, err := db.ListAuthorizationsByClaimAndPrincipal(types.RoleClaimKey, snapshot.principal)
+	if err != nil {
+		return err
+	}
+
+	before := map[string]types.Authorization{}
+	for _, authz := range snapshot.authzs {
+		before[authz.UUID] = authz
+	}
+
+	for _, authz := range authzs {
+		previous, found := before[authz.UUID]
+		if !found {
+			if err := db.DeleteAuthorization(authz.UUID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		authz.ClaimValue = previous.ClaimValue
+		authz.ExpiresAt = previous.ExpiresAt
+		authz.UpdatedAt = previous.UpdatedAt
+		authz.GrantedBy = previous.GrantedBy
+		if err := db.InsertAuthorization(&authz); err != nil {
+			return fmt.Errorf("failed to restore role authorization %s: %s", authz.UUID, err)
+		}
+	}
+
+	return nil
+}
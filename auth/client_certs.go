@@ -0,0 +1,74 @@
+package auth
+
+import (
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/auth/ldap"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains TLS client certificate authentication: the listener
+// verifies the certificate against the CAs configured under
+// common.ClientCAFileKey, and the user it names (see common.ClientCertIdentity)
+// has to exist as a local user or in LDAP/AD. Like with personal access tokens,
+// an unsigned token is built for every request.
+
+// AuthenticateClientCertificate returns an (unsigned) token for the user named by
+// a verified client certificate. Local users take precedence over LDAP/AD users,
+// just like when logging in; the password and one-time password of local users
+// aren't needed, but disabled users are still denied.
+// params:
+//  username: local or AD username taken from the certificate
+// return values:
+//  *Token: token object carrying the user and its principals
+//  error: auth_errors.ErrUserNotFound if there's no such user,
+//         auth_errors.ErrAccessDenied if the local user is disabled,
+//         otherwise as returned by consecutive func calls, e.g.
+//         auth_errors.ErrLDAPConnectionFailed if the directory couldn't be reached
+func AuthenticateClientCertificate(username string) (*Token, error) {
+	name, principals, err := clientCertPrincipals(username)
+	if err != nil {
+		return nil, err
+	}
+
+	authZ, err := NewTokenWithClaims(principals)
+	if err != nil {
+		return nil, err
+	}
+
+	authZ.AddClaim(UsernameClaimKey, name)
+	authZ.AddClaim(ClientCertClaimKey, true)
+
+	return authZ, nil
+}
+
+// clientCertPrincipals looks up the user named by a client certificate: the
+// local user, or else the LDAP/AD user and its groups.
+// params:
+//  username: local or AD username taken from the certificate
+// return values:
+//  string: the local username or the AD DN, as in tokens issued at login
+//  []string: the user's principals
+//  error: as documented for AuthenticateClientCertificate
+func clientCertPrincipals(username string) (string, []string, error) {
+	user, err := db.GetLocalUser(username)
+	switch {
+	case err == nil && user.DeletedAt == 0:
+		if user.Disable {
+			log.Debugf("Local user %q is disabled", username)
+			return "", nil, auth_errors.ErrAccessDenied
+		}
+
+		return user.Username, []string{user.Username}, nil
+	case err != nil && err != auth_errors.ErrKeyNotFound:
+		return "", nil, err
+	}
+
+	dn, groups, err := ldap.Lookup(username)
+	if err == auth_errors.ErrKeyNotFound || err == auth_errors.ErrLDAPConfigurationNotFound {
+		return "", nil, auth_errors.ErrUserNotFound
+	}
+
+	return dn, groups, err
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains the custom roles, which admins define as sets of
+// permissions on netmaster endpoints and grant through authorizations, like
+// the built-in roles. Custom roles aren't limited to tenants: a permission
+// allows the matching requests on the objects of all tenants.
+
+// customRoleNamePattern matches valid custom role names; they're used in
+// URLs and data store paths
+var customRoleNamePattern = regexp.MustCompile(`^[A-Za-z0-9_\-\.]+$`)
+
+// customRoleMutex serializes granting and deleting custom roles within this
+// proxy, so that a role can't be deleted while it's being granted.
+var customRoleMutex sync.Mutex
+
+// ValidateCustomRole checks the given role and normalizes the methods of its permissions.
+// params:
+//  role: role to be validated
+// return values:
+//  error: nil if the role is valid, otherwise the reason it isn't
+func ValidateCustomRole(role *types.CustomRole) error {
+	if !customRoleNamePattern.MatchString(role.Name) {
+		return fmt.Errorf("invalid role name %q", role.Name)
+	}
+
+	if _, err := types.Role(role.Name); err == nil {
+		return fmt.Errorf("%q is a built-in role", role.Name)
+	}
+
+	if len(role.Permissions) == 0 {
+		return errors.New("a role needs at least one permission")
+	}
+
+	for _, permission := range role.Permissions {
+		if err := validateRulePath(permission.Path); err != nil {
+			return err
+		}
+
+		if err := normalizeMethods(permission.Methods); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteCustomRole deletes a custom role unless it's still granted.
+// params:
+//  name: of the role to be deleted
+// return values:
+//  error: auth_errors.ErrIllegalOperation for built-in roles,
+//    auth_errors.ErrRoleInUse if an unexpired authorization grants the role,
+//    else as returned by db.ListAuthorizationsByClaim() or db.DeleteCustomRole()
+func DeleteCustomRole(name string) error {
+	if _, err := types.Role(name); err == nil {
+		return auth_errors.ErrIllegalOperation
+	}
+
+	customRoleMutex.Lock()
+	defer customRoleMutex.Unlock()
+
+	authzs, err := db.ListAuthorizationsByClaim(types.CustomRoleClaimKey + name)
+	if err != nil {
+		return err
+	}
+
+	if len(authzs) > 0 {
+		log.Warnf("custom role %q is granted by %d authorizations", name, len(authzs))
+		return auth_errors.ErrRoleInUse
+	}
+
+	return db.DeleteCustomRole(name)
+}
+
+// AddCustomRoleAuthorization grants a custom role to a principal.
+// params:
+//  roleName: name of the custom role
+//  principalName: local user, LDAP user or group, or ServiceAccount
+//  isLocal: true if the principal is a local user
+//  expiresAt: expiry time in seconds since the epoch; 0 if it never expires
+//  grantedBy: user making the grant
+// return values:
+//  types.Authorization: the added authorization
+//  error: auth_errors.ErrIllegalOperation for the built-in admin user,
+//    auth_errors.ErrKeyNotFound if there's no such role,
+//    auth_errors.ErrKeyExists if the principal has the role already,
+//    else as returned by consecutive func calls
+func AddCustomRoleAuthorization(roleName, principalName string, isLocal bool, expiresAt int64,
+	grantedBy string) (types.Authorization, error) {
+
+	defer common.Untrace(common.Trace())
+	defer InvalidateAuthorizationCache()
+
+	if isLocal && types.Admin.String() == principalName {
+		return types.Authorization{}, auth_errors.ErrIllegalOperation
+	}
+
+	customRoleMutex.Lock()
+	defer customRoleMutex.Unlock()
+
+	if _, err := db.GetCustomRole(roleName); err != nil {
+		return types.Authorization{}, err
+	}
+
+	claimKey := types.CustomRoleClaimKey + roleName
+	existing, err := db.ListAuthorizationsByClaimAndPrincipal(claimKey, principalName)
+	if err != nil {
+		return types.Authorization{}, err
+	}
+
+	if len(existing) > 0 {
+		return types.Authorization{}, auth_errors.ErrKeyExists
+	}
+
+	sd, err := state.GetStateDriver()
+	if err != nil {
+		return types.Authorization{}, err
+	}
+
+	now := time.Now().Unix()
+	authz := types.Authorization{
+		CommonState: types.CommonState{
+			StateDriver: sd,
+			ID:          uuid.NewV4().String(),
+		},
+		UUID:          uuid.NewV4().String(),
+		PrincipalName: principalName,
+		Local:         isLocal,
+		ClaimKey:      claimKey,
+		ClaimValue:    roleName,
+		ExpiresAt:     expiresAt,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		GrantedBy:     grantedBy,
+	}
+
+	if err := db.InsertAuthorization(&authz); err != nil {
+		log.Error("failed in adding custom role claim:", err)
+		return types.Authorization{}, err
+	}
+
+	log.Debugf("successfully added custom role authorization %#v", authz)
+	return authz, nil
+}
+
+// CustomRolesAllow checks whether a custom role granted to any of the
+// principals in the token allows a request.
+// params:
+//  method: HTTP method of the request
+//  path: path of the request
+// return values:
+//  bool: true if one of the roles has a matching permission
+//  error: nil if successful, else relevant error if the token is malformed or
+//    the authorizations or roles couldn't be read
+func (authZ *Token) CustomRolesAllow(method, path string) (bool, error) {
+	principals, err := authZ.getPrincipals()
+	if err != nil {
+		return false, err
+	}
+
+	segments := splitPath(path)
+	method = strings.ToUpper(method)
+
+	for _, p := range principals {
+		authzs, err := principalAuthorizations(p)
+		if err != nil {
+			return false, err
+		}
+
+		for _, a := range authzs {
+			if !strings.HasPrefix(a.ClaimKey, types.CustomRoleClaimKey) {
+				continue
+			}
+
+			role, err := db.GetCustomRole(a.ClaimValue)
+			switch {
+			case err == auth_errors.ErrKeyNotFound:
+				continue
+			case err != nil:
+				return false, err
+			}
+
+			for _, permission := range role.Permissions {
+				if matchMethod(permission.Methods, method) && matchPath(splitPath(permission.Path), segments) {
+					return true, nil
+				}
+			}
+		}
+	}
+
+	return false, nil
+}
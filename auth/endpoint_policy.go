@@ -0,0 +1,425 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains the endpoint policy which decides the minimum role
+// required to access each of the netmaster endpoints.
+
+const (
+	// matches any single path segment
+	anySegment = "*"
+
+	// matches any number (including zero) of trailing path segments
+	anySegments = "**"
+)
+
+// tenantScopedResources are the netmaster resources whose objects belong to a
+// tenant and can be accessed by ops users authorized for that tenant.
+var tenantScopedResources = []string{
+	"appProfiles",
+	"endpointGroups",
+	"extContractsGroups",
+	"netprofiles",
+	"networks",
+	"policys",
+	"rules",
+	"serviceLBs",
+}
+
+// IsTenantScopedResource returns true if the objects of the given netmaster
+// resource belong to a tenant, i.e. they name it in their `tenantName` field.
+func IsTenantScopedResource(resource string) bool {
+	for _, r := range tenantScopedResources {
+		if r == resource {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DefaultEndpointPolicyRules returns the rules used when the data store has
+// none and no policy file was given. They reflect the built-in access levels
+// of the netmaster API.
+// return values:
+//  []*types.EndpointPolicyRule: default rules; without IDs
+func DefaultEndpointPolicyRules() []*types.EndpointPolicyRule {
+	admin := types.Admin.String()
+	ops := types.Ops.String()
+
+	rules := []*types.EndpointPolicyRule{}
+
+	// admin-only netmaster resources
+	for _, resource := range []string{"aciGws", "Bgps", "globals"} {
+		rules = append(rules,
+			&types.EndpointPolicyRule{Path: "/api/v1/" + resource + "/**", Role: admin, Scope: types.ScopeGlobal},
+			&types.EndpointPolicyRule{Path: "/api/v1/inspect/" + resource + "/**", Role: admin, Scope: types.ScopeGlobal},
+		)
+	}
+
+	// everyone can read the global and ACI gateway settings; the summaries of
+	// all tenants' objects which come with them are filtered for ops users
+	for _, path := range []string{"/api/v1/inspect/globals/global/", "/api/v1/inspect/aciGws/aciGw/"} {
+		rules = append(rules, &types.EndpointPolicyRule{
+			Path:    path,
+			Methods: []string{"GET"},
+			Role:    ops,
+			Scope:   types.ScopeGlobal,
+		})
+	}
+
+	// tenants can only be read by ops users
+	rules = append(rules,
+		&types.EndpointPolicyRule{Path: "/api/v1/tenants/**", Role: admin, Scope: types.ScopeGlobal},
+		&types.EndpointPolicyRule{Path: "/api/v1/tenants/**", Methods: []string{"GET"}, Role: ops, Scope: types.ScopeTenant},
+		&types.EndpointPolicyRule{Path: "/api/v1/inspect/tenants/**", Methods: []string{"GET"}, Role: ops, Scope: types.ScopeTenant},
+	)
+
+	for _, resource := range tenantScopedResources {
+		rules = append(rules,
+			&types.EndpointPolicyRule{Path: "/api/v1/" + resource + "/**", Role: ops, Scope: types.ScopeTenant},
+			&types.EndpointPolicyRule{Path: "/api/v1/inspect/" + resource + "/**", Role: ops, Scope: types.ScopeTenant},
+		)
+	}
+
+	// /api/v1/inspect/endpoints/{epg_name}/ lists the containers attached to an EPG
+	rules = append(rules, &types.EndpointPolicyRule{
+		Path:  "/api/v1/inspect/endpoints/**",
+		Role:  ops,
+		Scope: types.ScopeTenant,
+	})
+
+	return rules
+}
+
+// splitPath splits the given path into its segments, ignoring leading and
+// trailing slashes.
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+
+	return strings.Split(path, "/")
+}
+
+// validateRulePath checks that a rule's path is absolute and only uses wildcards as whole segments.
+func validateRulePath(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("path %q must start with /", path)
+	}
+
+	segments := splitPath(path)
+	for i, segment := range segments {
+		if segment == anySegments && i != len(segments)-1 {
+			return fmt.Errorf("path %q: %s is only allowed as the last segment", path, anySegments)
+		}
+
+		if segment != anySegment && segment != anySegments && strings.Contains(segment, anySegment) {
+			return fmt.Errorf("path %q: wildcards must be whole segments", path)
+		}
+	}
+
+	return nil
+}
+
+// normalizeMethods uppercases the given HTTP methods in place.
+func normalizeMethods(methods []string) error {
+	for i, method := range methods {
+		methods[i] = strings.ToUpper(strings.TrimSpace(method))
+		if common.IsEmpty(methods[i]) {
+			return fmt.Errorf("empty method")
+		}
+	}
+
+	return nil
+}
+
+// ValidateEndpointPolicyRule checks the given rule and normalizes its methods.
+// params:
+//  rule: rule to be validated
+// return values:
+//  error: nil if the rule is valid, otherwise the reason it isn't
+func ValidateEndpointPolicyRule(rule *types.EndpointPolicyRule) error {
+	if err := validateRulePath(rule.Path); err != nil {
+		return err
+	}
+
+	if err := normalizeMethods(rule.Methods); err != nil {
+		return err
+	}
+
+	// tenant admins and guests are treated as ops by the endpoint policy
+	role, err := types.Role(rule.Role)
+	if err != nil || role == types.TenantAdmin || role == types.Guest {
+		return fmt.Errorf("invalid role %q", rule.Role)
+	}
+
+	if role == types.Admin && common.IsEmpty(rule.Scope) {
+		rule.Scope = types.ScopeGlobal
+	}
+
+	if rule.Scope != types.ScopeTenant && rule.Scope != types.ScopeGlobal {
+		return fmt.Errorf("invalid scope %q; must be %q or %q", rule.Scope, types.ScopeTenant, types.ScopeGlobal)
+	}
+
+	return nil
+}
+
+// matchPath returns true if the path pattern matches the given path segments.
+func matchPath(pattern, path []string) bool {
+	for i, segment := range pattern {
+		if segment == anySegments {
+			return true
+		}
+
+		if i >= len(path) || (segment != anySegment && segment != path[i]) {
+			return false
+		}
+	}
+
+	return len(pattern) == len(path)
+}
+
+// matchMethod returns true if a rule or permission listing the given methods
+// applies to the method; an empty list applies to all methods.
+func matchMethod(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// segmentRank ranks pattern segments by how specific they are.
+func segmentRank(segment string) int {
+	switch segment {
+	case anySegments:
+		return 0
+	case anySegment:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// moreSpecific returns true if rule `a` takes precedence over rule `b`.
+// Patterns are compared segment by segment from the left; a literal segment
+// beats `*` which beats `**`. If one pattern runs out first, the longer one
+// wins. Then rules listing methods beat rules applying to all methods and
+// finally the rule ID breaks ties so that the outcome is deterministic.
+func moreSpecific(a, b *types.EndpointPolicyRule) bool {
+	aSegments, bSegments := splitPath(a.Path), splitPath(b.Path)
+
+	for i := 0; i < len(aSegments) && i < len(bSegments); i++ {
+		aRank, bRank := segmentRank(aSegments[i]), segmentRank(bSegments[i])
+		if aRank != bRank {
+			return aRank > bRank
+		}
+	}
+
+	if len(aSegments) != len(bSegments) {
+		return len(aSegments) > len(bSegments)
+	}
+
+	if (len(a.Methods) == 0) != (len(b.Methods) == 0) {
+		return len(a.Methods) != 0
+	}
+
+	return a.ID < b.ID
+}
+
+// byPrecedence sorts rules by precedence, most specific first
+type byPrecedence []*types.EndpointPolicyRule
+
+func (r byPrecedence) Len() int           { return len(r) }
+func (r byPrecedence) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byPrecedence) Less(i, j int) bool { return moreSpecific(r[i], r[j]) }
+
+// MatchEndpointPolicyRule finds the rule which applies to the given request.
+// params:
+//  rules: all the endpoint policy rules
+//  method: HTTP method of the request
+//  path: path of the request
+// return values:
+//  *types.EndpointPolicyRule: the most specific matching rule or nil if none matches
+func MatchEndpointPolicyRule(rules []*types.EndpointPolicyRule, method, path string) *types.EndpointPolicyRule {
+	segments := splitPath(path)
+	method = strings.ToUpper(method)
+
+	matches := []*types.EndpointPolicyRule{}
+	for _, rule := range rules {
+		if matchMethod(rule.Methods, method) && matchPath(splitPath(rule.Path), segments) {
+			matches = append(matches, rule)
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil
+	}
+
+	sort.Sort(byPrecedence(matches))
+
+	return matches[0]
+}
+
+// EndpointPolicyDecision is the outcome of evaluating the endpoint policy for a request.
+//
+// Fields:
+//  Allowed: true if the user has the role required by the policy
+//  TenantScoped: if set, access is further limited to the user's tenants
+//  Reason: human readable explanation of the decision
+//  Rule: the rule which applied; nil if the default policy applied
+type EndpointPolicyDecision struct {
+	Allowed      bool                      `json:"allowed"`
+	TenantScoped bool                      `json:"tenantScoped"`
+	Reason       string                    `json:"reason"`
+	Rule         *types.EndpointPolicyRule `json:"rule,omitempty"`
+}
+
+// DefaultEndpointRole returns the minimum role required to access netmaster
+// endpoints not matched by any rule (see common.EndpointPolicyDefaultRoleKey).
+func DefaultEndpointRole() types.RoleType {
+	value, err := common.Global().Get(common.EndpointPolicyDefaultRoleKey)
+	if err != nil {
+		return types.Admin
+	}
+
+	role, err := types.Role(value)
+	if err != nil {
+		log.Warnf("Invalid %s %q, using %q", common.EndpointPolicyDefaultRoleKey, value, types.Admin.String())
+		return types.Admin
+	}
+
+	return role
+}
+
+// EvaluateEndpointPolicy decides whether a user with the given role can access an endpoint.
+// params:
+//  rules: all the endpoint policy rules
+//  role: highest role of the user; types.Admin for superusers
+//  method: HTTP method of the request
+//  path: path of the request
+// return values:
+//  EndpointPolicyDecision: outcome of the evaluation
+func EvaluateEndpointPolicy(rules []*types.EndpointPolicyRule, role types.RoleType, method, path string) EndpointPolicyDecision {
+	rule := MatchEndpointPolicyRule(rules, method, path)
+
+	if rule == nil {
+		required := DefaultEndpointRole()
+		return EndpointPolicyDecision{
+			Allowed: role <= required,
+			Reason:  fmt.Sprintf("no matching rule; default policy requires role %q", required.String()),
+		}
+	}
+
+	required, err := types.Role(rule.Role)
+	if err != nil {
+		// rules are validated before they're stored, so this should never happen
+		return EndpointPolicyDecision{
+			Reason: fmt.Sprintf("rule %q has an invalid role %q", rule.ID, rule.Role),
+			Rule:   rule,
+		}
+	}
+
+	if role > required {
+		return EndpointPolicyDecision{
+			Reason: fmt.Sprintf("rule %q requires role %q", rule.ID, rule.Role),
+			Rule:   rule,
+		}
+	}
+
+	decision := EndpointPolicyDecision{
+		Allowed: true,
+		Reason:  fmt.Sprintf("rule %q allows role %q", rule.ID, rule.Role),
+		Rule:    rule,
+	}
+
+	// admins have access to all tenants
+	if role != types.Admin && rule.Scope == types.ScopeTenant {
+		decision.TenantScoped = true
+		decision.Reason += "; limited to the user's tenants"
+	}
+
+	return decision
+}
+
+// ReadEndpointPolicyFile reads endpoint policy rules from a JSON file
+// containing a list of rules.
+// params:
+//  path: of the file to read
+// return values:
+//  []*types.EndpointPolicyRule: validated rules read from the file
+//  error: nil on success, otherwise the reason the file couldn't be used
+func ReadEndpointPolicyFile(path string) ([]*types.EndpointPolicyRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read endpoint policy file %q: %s", path, err.Error())
+	}
+
+	rules := []*types.EndpointPolicyRule{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse endpoint policy file %q: %s", path, err.Error())
+	}
+
+	for _, rule := range rules {
+		if err := ValidateEndpointPolicyRule(rule); err != nil {
+			return nil, fmt.Errorf("invalid rule in endpoint policy file %q: %s", path, err.Error())
+		}
+	}
+
+	return rules, nil
+}
+
+// SeedEndpointPolicy stores the initial endpoint policy rules in the data
+// store unless there are rules in it already.
+// params:
+//  path: optional JSON file with the rules; the default rules are used if empty
+// return values:
+//  error: nil on success, otherwise as returned by consecutive func calls
+func SeedEndpointPolicy(path string) error {
+	rules := DefaultEndpointPolicyRules()
+
+	if !common.IsEmpty(path) {
+		var err error
+		if rules, err = ReadEndpointPolicyFile(path); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range rules {
+		if common.IsEmpty(rule.ID) {
+			rule.ID = uuid.NewV4().String()
+		}
+	}
+
+	seeded, err := db.SeedEndpointPolicyRules(rules)
+	if err != nil {
+		return err
+	}
+
+	if seeded {
+		log.Infof("Added %d endpoint policy rules", len(rules))
+	}
+
+	return nil
+}
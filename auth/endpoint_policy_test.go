@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// rule is a shorthand for creating endpoint policy rules in tests
+func rule(id, path, role, scope string, methods ...string) *types.EndpointPolicyRule {
+	return &types.EndpointPolicyRule{ID: id, Path: path, Methods: methods, Role: role, Scope: scope}
+}
+
+// TestMatchEndpointPolicyRule tests rule matching with overlapping patterns
+func TestMatchEndpointPolicyRule(t *testing.T) {
+	rules := []*types.EndpointPolicyRule{
+		rule("catchall", "/api/v1/**", "admin", types.ScopeGlobal),
+		rule("any-resource", "/api/v1/*/", "ops", types.ScopeTenant),
+		rule("any-member", "/api/v1/*/*/", "ops", types.ScopeTenant),
+		rule("networks", "/api/v1/networks/**", "ops", types.ScopeTenant),
+		rule("networks-get", "/api/v1/networks/**", "ops", types.ScopeGlobal, "GET"),
+		rule("network-n1", "/api/v1/networks/n1/", "admin", types.ScopeGlobal),
+		rule("inspect-global", "/api/v1/inspect/*/global/", "ops", types.ScopeGlobal, "GET"),
+		rule("inspect-globals", "/api/v1/inspect/globals/**", "admin", types.ScopeGlobal),
+		rule("dup-b", "/api/v1/dup/", "ops", types.ScopeGlobal),
+		rule("dup-a", "/api/v1/dup/", "admin", types.ScopeGlobal),
+	}
+
+	testCases := []struct {
+		method   string
+		path     string
+		expected string
+	}{
+		// literal segments beat wildcards
+		{"GET", "/api/v1/networks/n1/", "network-n1"},
+		{"DELETE", "/api/v1/networks/n1/", "network-n1"},
+
+		// rules listing methods beat rules for all methods
+		{"GET", "/api/v1/networks/n2/", "networks-get"},
+		{"POST", "/api/v1/networks/n2/", "networks"},
+
+		// `**` matches zero segments too
+		{"POST", "/api/v1/networks/", "networks"},
+
+		// `*` matches exactly one segment; trailing slashes don't matter
+		{"GET", "/api/v1/tenants/", "any-resource"},
+		{"GET", "/api/v1/tenants", "any-resource"},
+		{"GET", "/api/v1/tenants/t1/", "any-member"},
+		{"GET", "/api/v1/tenants/t1/x/", "catchall"},
+
+		// a literal segment further left beats a wildcard even if the wildcard rule is longer
+		{"GET", "/api/v1/inspect/globals/global/", "inspect-globals"},
+		{"GET", "/api/v1/inspect/networks/global/", "inspect-global"},
+		{"POST", "/api/v1/inspect/networks/global/", "catchall"},
+
+		// identical patterns are ordered by ID
+		{"GET", "/api/v1/dup/", "dup-a"},
+
+		// nothing matches outside /api/v1
+		{"GET", "/api/v2/networks/", ""},
+		{"GET", "/", ""},
+	}
+
+	for _, tc := range testCases {
+		matched := MatchEndpointPolicyRule(rules, tc.method, tc.path)
+
+		id := ""
+		if matched != nil {
+			id = matched.ID
+		}
+
+		if id != tc.expected {
+			t.Errorf("%s %s: expected rule %q, got %q", tc.method, tc.path, tc.expected, id)
+		}
+	}
+
+	// the order of the rules must not matter
+	for i, j := 0, len(rules)-1; i < j; i, j = i+1, j-1 {
+		rules[i], rules[j] = rules[j], rules[i]
+	}
+
+	for _, tc := range testCases {
+		matched := MatchEndpointPolicyRule(rules, tc.method, tc.path)
+		if (matched == nil && tc.expected != "") || (matched != nil && matched.ID != tc.expected) {
+			t.Errorf("%s %s: result depends on the order of the rules", tc.method, tc.path)
+		}
+	}
+}
+
+// TestValidateEndpointPolicyRule tests rule validation
+func TestValidateEndpointPolicyRule(t *testing.T) {
+	valid := rule("", "/api/v1/networks/**", "admin", "", "get", " post ")
+	if err := ValidateEndpointPolicyRule(valid); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if valid.Scope != types.ScopeGlobal {
+		t.Errorf("expected admin rule to default to %q scope, got %q", types.ScopeGlobal, valid.Scope)
+	}
+
+	if valid.Methods[0] != "GET" || valid.Methods[1] != "POST" {
+		t.Errorf("methods were not normalized: %v", valid.Methods)
+	}
+
+	for _, invalid := range []*types.EndpointPolicyRule{
+		rule("", "api/v1/networks/", "ops", types.ScopeTenant),
+		rule("", "/api/v1/**/networks/", "ops", types.ScopeTenant),
+		rule("", "/api/v1/net*/", "ops", types.ScopeTenant),
+		rule("", "/api/v1/networks/", "root", types.ScopeTenant),
+		rule("", "/api/v1/networks/", "tenant_admin", types.ScopeTenant),
+		rule("", "/api/v1/networks/", "guest", types.ScopeTenant),
+		rule("", "/api/v1/networks/", "ops", ""),
+		rule("", "/api/v1/networks/", "ops", "cluster"),
+		rule("", "/api/v1/networks/", "ops", types.ScopeTenant, " "),
+	} {
+		if err := ValidateEndpointPolicyRule(invalid); err == nil {
+			t.Errorf("expected an error for %#v", invalid)
+		}
+	}
+}
+
+// TestEvaluateEndpointPolicy tests the decisions made for admins and ops users
+func TestEvaluateEndpointPolicy(t *testing.T) {
+	defer common.Global().Set(common.EndpointPolicyDefaultRoleKey, "admin")
+
+	rules := []*types.EndpointPolicyRule{
+		rule("admin-only", "/api/v1/aciGws/**", "admin", types.ScopeGlobal),
+		rule("tenant", "/api/v1/networks/**", "ops", types.ScopeTenant),
+		rule("global", "/api/v1/inspect/globals/global/", "ops", types.ScopeGlobal, "GET"),
+	}
+
+	testCases := []struct {
+		defaultRole  string
+		role         types.RoleType
+		method       string
+		path         string
+		allowed      bool
+		tenantScoped bool
+	}{
+		{"admin", types.Admin, "GET", "/api/v1/aciGws/", true, false},
+		{"admin", types.Ops, "GET", "/api/v1/aciGws/", false, false},
+		{"admin", types.Admin, "GET", "/api/v1/networks/n1/", true, false},
+		{"admin", types.Ops, "GET", "/api/v1/networks/n1/", true, true},
+		{"admin", types.Ops, "GET", "/api/v1/inspect/globals/global/", true, false},
+		{"admin", types.Ops, "POST", "/api/v1/inspect/globals/global/", false, false},
+
+		// unknown endpoints fall back to the default role
+		{"admin", types.Admin, "GET", "/api/v1/newResources/", true, false},
+		{"admin", types.Ops, "GET", "/api/v1/newResources/", false, false},
+		{"ops", types.Ops, "GET", "/api/v1/newResources/", true, false},
+	}
+
+	for _, tc := range testCases {
+		common.Global().Set(common.EndpointPolicyDefaultRoleKey, tc.defaultRole)
+
+		decision := EvaluateEndpointPolicy(rules, tc.role, tc.method, tc.path)
+		if decision.Allowed != tc.allowed || decision.TenantScoped != tc.tenantScoped {
+			t.Errorf("%s %s as %s (default %s): expected allowed=%t tenantScoped=%t, got %#v",
+				tc.method, tc.path, tc.role.String(), tc.defaultRole, tc.allowed, tc.tenantScoped, decision)
+		}
+	}
+}
+
+// TestDefaultEndpointPolicyRules tests that the default rules are valid and
+// keep the built-in access levels of the netmaster API.
+func TestDefaultEndpointPolicyRules(t *testing.T) {
+	rules := DefaultEndpointPolicyRules()
+	for _, r := range rules {
+		if err := ValidateEndpointPolicyRule(r); err != nil {
+			t.Fatalf("invalid default rule %#v: %s", r, err)
+		}
+	}
+
+	testCases := []struct {
+		method       string
+		path         string
+		allowed      bool
+		tenantScoped bool
+	}{
+		{"GET", "/api/v1/aciGws/", false, false},
+		{"GET", "/api/v1/inspect/Bgps/b1/", false, false},
+		{"PUT", "/api/v1/globals/global/", false, false},
+		{"GET", "/api/v1/globals/global/", false, false},
+		{"GET", "/api/v1/inspect/globals/global/", true, false},
+		{"GET", "/api/v1/inspect/globals/other/", false, false},
+		{"GET", "/api/v1/inspect/aciGws/aciGw/", true, false},
+		{"PUT", "/api/v1/inspect/aciGws/aciGw/", false, false},
+		{"GET", "/api/v1/aciGws/aciGw/", false, false},
+		{"GET", "/api/v1/tenants/", true, true},
+		{"GET", "/api/v1/tenants/t1/", true, true},
+		{"POST", "/api/v1/tenants/t1/", false, false},
+		{"DELETE", "/api/v1/tenants/t1/", false, false},
+		{"GET", "/api/v1/networks/", true, true},
+		{"POST", "/api/v1/networks/n1/", true, true},
+		{"GET", "/api/v1/inspect/endpointGroups/epg1/", true, true},
+		{"GET", "/api/v1/inspect/endpoints/epg1/", true, true},
+		{"GET", "/api/v1/unknown/", false, false},
+	}
+
+	for _, tc := range testCases {
+		decision := EvaluateEndpointPolicy(rules, types.Ops, tc.method, tc.path)
+		if decision.Allowed != tc.allowed || decision.TenantScoped != tc.tenantScoped {
+			t.Errorf("%s %s: expected allowed=%t tenantScoped=%t, got %#v",
+				tc.method, tc.path, tc.allowed, tc.tenantScoped, decision)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"encoding/json"
+	"testing"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+)
+
+// TestFilterByTenant tests that lists only keep the objects of authorized tenants, untouched
+func TestFilterByTenant(t *testing.T) {
+	testCases := []struct {
+		description string
+		payload     string
+		tenants     []string
+		expected    []string
+	}{
+		{"no tenants", "networks.json", nil, []string{}},
+		{"one tenant", "networks.json", []string{"t1"}, []string{"t1", "t1"}},
+		{"several tenants", "networks.json", []string{"default", "t2"}, []string{"default", "default", "t2"}},
+		{"other resource", "appProfiles.json", []string{"t1", "t3"}, []string{"t1", "t3"}},
+	}
+
+	for _, tc := range testCases {
+		filtered, err := filterByTenant(authorizedFor(tc.tenants...), readTestdata(t, tc.payload))
+		if err != nil {
+			t.Errorf("%s: failed to filter: %s", tc.description, err)
+			continue
+		}
+
+		objects := []map[string]interface{}{}
+		if err := json.Unmarshal(filtered, &objects); err != nil {
+			t.Errorf("%s: failed to unmarshal %s: %s", tc.description, filtered, err)
+			continue
+		}
+
+		if len(objects) != len(tc.expected) {
+			t.Errorf("%s: expected %d objects, got %s", tc.description, len(tc.expected), filtered)
+			continue
+		}
+
+		for i, object := range objects {
+			if object["tenantName"] != tc.expected[i] || object["links"] == nil {
+				t.Errorf("%s: unexpected object %d: %v", tc.description, i, object)
+			}
+		}
+	}
+
+	for _, body := range []string{`{"tenantName":"t1"}`, `[{"tenantName":"t1"},{"networkName":"n1"}]`, `["t1"]`} {
+		if _, err := filterByTenant(authorizedFor("t1"), []byte(body)); err != auth_errors.ErrUnknownResponseShape {
+			t.Errorf("%s: expected %v, got %v", body, auth_errors.ErrUnknownResponseShape, err)
+		}
+	}
+}
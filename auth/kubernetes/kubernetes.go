@@ -0,0 +1,288 @@
+package kubernetes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+)
+
+// This library authenticates Kubernetes ServiceAccount tokens using the
+// TokenReview API of the Kubernetes API server.
+// see https://kubernetes.io/docs/reference/access-authn-authz/authentication/#service-account-tokens
+
+const (
+	// tokenReviewPath is the TokenReview endpoint of the API server
+	tokenReviewPath = "/apis/authentication.k8s.io/v1/tokenreviews"
+
+	// ServiceAccountPrefix is the prefix of the usernames of all ServiceAccounts,
+	// which are of the form system:serviceaccount:<namespace>:<name>
+	ServiceAccountPrefix = "system:serviceaccount:"
+
+	// requestTimeout is the time allowed for a TokenReview request
+	requestTimeout = 5 * time.Second
+
+	// cacheTTL is how long the outcome of a TokenReview is reused for the same token
+	cacheTTL = 30 * time.Second
+
+	// maxCacheEntries bounds the cache; expired entries are dropped once it's reached
+	maxCacheEntries = 1000
+)
+
+// tokenReview is the subset of the authentication.k8s.io/v1 TokenReview
+// object which we send and read
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewSpec struct {
+	Token string `json:"token"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool     `json:"authenticated"`
+	User          userInfo `json:"user"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type userInfo struct {
+	Username string `json:"username,omitempty"`
+}
+
+// cacheEntry holds the outcome of a TokenReview
+type cacheEntry struct {
+	username string
+	err      error
+	expires  time.Time
+}
+
+var (
+	cacheMutex  sync.Mutex
+	cache       = map[string]cacheEntry{} // by token hash
+	cacheServer string                    // API server the cached entries came from
+
+	now = time.Now // replaced by tests
+)
+
+// setting returns the value of the given setting; empty if it's not set
+func setting(key string) string {
+	value, _ := common.Global().Get(key)
+	return value
+}
+
+// Enabled returns true if Kubernetes ServiceAccount tokens are accepted,
+// i.e. if the API server is configured
+func Enabled() bool {
+	return !common.IsEmpty(setting(common.KubernetesAPIServerKey))
+}
+
+// Authenticate authenticates the given ServiceAccount token using the TokenReview API.
+// Outcomes are cached for a short while, other than failures to reach the API server.
+// params:
+//  token: bearer token of a Kubernetes ServiceAccount
+// return values:
+//  string: username of the ServiceAccount, i.e. system:serviceaccount:<namespace>:<name>
+//  error: nil on successful authentication, auth_errors.ErrKubernetesAccessDenied if the
+//    token doesn't belong to a ServiceAccount, auth_errors.ErrKubernetesUnavailable if the
+//    TokenReview API couldn't be called
+func Authenticate(token string) (string, error) {
+	server := strings.TrimSuffix(setting(common.KubernetesAPIServerKey), "/")
+	if common.IsEmpty(server) {
+		log.Error("Kubernetes API server is not configured")
+		return "", auth_errors.ErrKubernetesUnavailable
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	if entry, found := cached(server, key); found {
+		return entry.username, entry.err
+	}
+
+	username, err := review(server, token)
+	if err == auth_errors.ErrKubernetesUnavailable {
+		return "", err
+	}
+
+	store(server, key, cacheEntry{username: username, err: err, expires: now().Add(cacheTTL)})
+
+	return username, err
+}
+
+// cached returns the unexpired cache entry of the given token hash
+func cached(server, key string) (cacheEntry, bool) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	if server != cacheServer {
+		return cacheEntry{}, false
+	}
+
+	entry, found := cache[key]
+	if !found || now().After(entry.expires) {
+		return cacheEntry{}, false
+	}
+
+	return entry, true
+}
+
+// store caches the outcome of a TokenReview; the cache is dropped if the API server changed
+func store(server, key string, entry cacheEntry) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	if server != cacheServer {
+		cache = map[string]cacheEntry{}
+		cacheServer = server
+	}
+
+	if len(cache) >= maxCacheEntries {
+		for k, e := range cache {
+			if now().After(e.expires) {
+				delete(cache, k)
+			}
+		}
+
+		// still full; start over rather than grow without bounds
+		if len(cache) >= maxCacheEntries {
+			cache = map[string]cacheEntry{}
+		}
+	}
+
+	cache[key] = entry
+}
+
+// newClient returns a HTTP client which trusts the configured CA, if any. Clients
+// are only created on cache misses, so connections aren't kept alive.
+func newClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if caFile := setting(common.KubernetesCAFileKey); !common.IsEmpty(caFile) {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Kubernetes CA file %q: %s", caFile, err.Error())
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in Kubernetes CA file %q", caFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Client{
+		Timeout:   requestTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true},
+	}, nil
+}
+
+// reviewerToken returns the token used to call the TokenReview API; empty if none is configured
+func reviewerToken() (string, error) {
+	tokenFile := setting(common.KubernetesReviewerTokenFileKey)
+	if common.IsEmpty(tokenFile) {
+		return "", nil
+	}
+
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Kubernetes reviewer token file %q: %s", tokenFile, err.Error())
+	}
+
+	return strings.TrimSpace(string(token)), nil
+}
+
+// review submits the token to the TokenReview API of the given API server
+// params:
+//  server: URL of the API server
+//  token: bearer token of a Kubernetes ServiceAccount
+// return values:
+//  string: username of the ServiceAccount
+//  error: nil on successful authentication, otherwise as described for Authenticate()
+func review(server, token string) (string, error) {
+	client, err := newClient()
+	if err != nil {
+		log.Errorf("Failed to create Kubernetes client: %s", err.Error())
+		return "", auth_errors.ErrKubernetesUnavailable
+	}
+
+	reviewerTkn, err := reviewerToken()
+	if err != nil {
+		log.Error(err.Error())
+		return "", auth_errors.ErrKubernetesUnavailable
+	}
+
+	body, err := json.Marshal(&tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		log.Errorf("Failed to marshal TokenReview request: %s", err.Error())
+		return "", auth_errors.ErrKubernetesUnavailable
+	}
+
+	req, err := http.NewRequest("POST", server+tokenReviewPath, bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("Failed to create TokenReview request: %s", err.Error())
+		return "", auth_errors.ErrKubernetesUnavailable
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if !common.IsEmpty(reviewerTkn) {
+		req.Header.Set("Authorization", "Bearer "+reviewerTkn)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Errorf("TokenReview request to %q failed: %s", server, err.Error())
+		return "", auth_errors.ErrKubernetesUnavailable
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Errorf("Failed to read TokenReview response: %s", err.Error())
+		return "", auth_errors.ErrKubernetesUnavailable
+	}
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		log.Errorf("TokenReview request to %q failed with status %d: %s", server, resp.StatusCode, string(data))
+		return "", auth_errors.ErrKubernetesUnavailable
+	}
+
+	result := &tokenReview{}
+	if err := json.Unmarshal(data, result); err != nil {
+		log.Errorf("Failed to unmarshal TokenReview response: %s", err.Error())
+		return "", auth_errors.ErrKubernetesUnavailable
+	}
+
+	if !result.Status.Authenticated {
+		log.Infof("Kubernetes didn't authenticate the token: %s", result.Status.Error)
+		return "", auth_errors.ErrKubernetesAccessDenied
+	}
+
+	username := result.Status.User.Username
+	if !strings.HasPrefix(username, ServiceAccountPrefix) {
+		log.Infof("Kubernetes user %q is not a ServiceAccount", username)
+		return "", auth_errors.ErrKubernetesAccessDenied
+	}
+
+	return username, nil
+}
@@ -0,0 +1,192 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+)
+
+// usernames returned by the stub TokenReview API, by token
+var reviewedTokens = map[string]string{
+	"sa-token":   "system:serviceaccount:kube-system:controller",
+	"user-token": "jane",
+}
+
+// tokenReviewStub returns a handler which behaves like the TokenReview API
+// for the tokens in reviewedTokens, and counts the reviews in `reviews`.
+func tokenReviewStub(t *testing.T, reviews *int) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		*reviews++
+
+		if req.Method != "POST" || req.URL.Path != tokenReviewPath {
+			t.Errorf("unexpected request: %s %s", req.Method, req.URL.Path)
+		}
+
+		if auth := req.Header.Get("Authorization"); auth != "Bearer reviewer" {
+			t.Errorf("expected the reviewer token, got %q", auth)
+		}
+
+		review := &tokenReview{}
+		if err := json.NewDecoder(req.Body).Decode(review); err != nil {
+			t.Fatalf("failed to decode the TokenReview: %s", err)
+		}
+
+		username, found := reviewedTokens[review.Spec.Token]
+		review.Status.Authenticated = found
+		review.Status.User.Username = username
+		if !found {
+			review.Status.Error = "invalid bearer token"
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(review)
+	}
+}
+
+// configure points the package at the given API server; the returned
+// function restores the previous settings and clears the cache
+func configure(t *testing.T, server, caFile string) func() {
+	tokenFile, err := ioutil.TempFile("", "reviewer-token")
+	if err != nil {
+		t.Fatalf("failed to create the reviewer token file: %s", err)
+	}
+	tokenFile.WriteString("reviewer\n")
+	tokenFile.Close()
+
+	common.Global().Set(common.KubernetesAPIServerKey, server)
+	common.Global().Set(common.KubernetesCAFileKey, caFile)
+	common.Global().Set(common.KubernetesReviewerTokenFileKey, tokenFile.Name())
+
+	return func() {
+		os.Remove(tokenFile.Name())
+
+		common.Global().Set(common.KubernetesAPIServerKey, "")
+		common.Global().Set(common.KubernetesCAFileKey, "")
+		common.Global().Set(common.KubernetesReviewerTokenFileKey, "")
+
+		cacheMutex.Lock()
+		cache = map[string]cacheEntry{}
+		cacheServer = ""
+		cacheMutex.Unlock()
+
+		now = time.Now
+	}
+}
+
+// TestAuthenticate tests allowed and denied tokens along with the cache
+func TestAuthenticate(t *testing.T) {
+	reviews := 0
+	server := httptest.NewServer(tokenReviewStub(t, &reviews))
+	defer server.Close()
+
+	defer configure(t, server.URL, "")()
+
+	if !Enabled() {
+		t.Fatal("expected Kubernetes authentication to be enabled")
+	}
+
+	current := time.Now()
+	now = func() time.Time { return current }
+
+	testCases := []struct {
+		token    string
+		username string
+		err      error
+	}{
+		{"sa-token", "system:serviceaccount:kube-system:controller", nil},
+		{"user-token", "", auth_errors.ErrKubernetesAccessDenied}, // not a ServiceAccount
+		{"unknown-token", "", auth_errors.ErrKubernetesAccessDenied},
+	}
+
+	// the second round is served from the cache
+	for round := 0; round < 2; round++ {
+		for _, tc := range testCases {
+			username, err := Authenticate(tc.token)
+			if username != tc.username || err != tc.err {
+				t.Errorf("%q: expected %q, %v, got %q, %v", tc.token, tc.username, tc.err, username, err)
+			}
+		}
+
+		if reviews != len(testCases) {
+			t.Errorf("expected %d TokenReviews, got %d", len(testCases), reviews)
+		}
+	}
+
+	// cached outcomes expire
+	current = current.Add(cacheTTL + time.Second)
+
+	if _, err := Authenticate("sa-token"); err != nil || reviews != len(testCases)+1 {
+		t.Errorf("expected the token to be reviewed again, got %v after %d reviews", err, reviews)
+	}
+}
+
+// TestAuthenticateUnavailable tests API servers which can't be reached or fail
+func TestAuthenticateUnavailable(t *testing.T) {
+	reviews := 0
+	server := httptest.NewServer(tokenReviewStub(t, &reviews))
+	server.Close() // nothing listens on the URL anymore
+
+	defer configure(t, server.URL, "")()
+
+	for i := 0; i < 2; i++ {
+		if _, err := Authenticate("sa-token"); err != auth_errors.ErrKubernetesUnavailable {
+			t.Errorf("expected ErrKubernetesUnavailable, got %v", err)
+		}
+	}
+
+	// failures aren't cached: the API server is tried again once it's back
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		reviews++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	common.Global().Set(common.KubernetesAPIServerKey, failing.URL)
+
+	for i := 0; i < 2; i++ {
+		if _, err := Authenticate("sa-token"); err != auth_errors.ErrKubernetesUnavailable {
+			t.Errorf("expected ErrKubernetesUnavailable, got %v", err)
+		}
+	}
+
+	if reviews != 2 {
+		t.Errorf("expected 2 TokenReviews, got %d", reviews)
+	}
+}
+
+// TestAuthenticateTLS tests talking to an API server with a self-signed certificate
+func TestAuthenticateTLS(t *testing.T) {
+	reviews := 0
+	server := httptest.NewTLSServer(tokenReviewStub(t, &reviews))
+	defer server.Close()
+
+	caFile, err := ioutil.TempFile("", "kubernetes-ca")
+	if err != nil {
+		t.Fatalf("failed to create the CA file: %s", err)
+	}
+	defer os.Remove(caFile.Name())
+
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+	caFile.Close()
+
+	// the certificate isn't trusted without the CA file
+	restore := configure(t, server.URL, "")
+	if _, err := Authenticate("sa-token"); err != auth_errors.ErrKubernetesUnavailable {
+		t.Errorf("expected ErrKubernetesUnavailable, got %v", err)
+	}
+	restore()
+
+	defer configure(t, server.URL, caFile.Name())()
+
+	if username, err := Authenticate("sa-token"); err != nil || username != reviewedTokens["sa-token"] {
+		t.Errorf("expected %q, got %q, %v", reviewedTokens["sa-token"], username, err)
+	}
+}
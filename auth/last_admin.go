@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains the guard against locking everyone out of the management
+// API by removing the last admin, e.g. by deleting or disabling the user or
+// deleting its admin authorization. Admins are local users and LDAP users or
+// groups whose role authorization is admin and doesn't expire; local users
+// only count while they're neither deleted nor disabled.
+
+// adminRemovalMutex serializes the operations which may remove an admin within
+// this proxy, so that two of them can't both pass the check for the last
+// admin; the state drivers offer no transactions. Among the proxies sharing
+// the data store, they're serialized by a lease on adminRemovalLockKey.
+var adminRemovalMutex sync.Mutex
+
+const (
+	// adminRemovalLeaseTTL is the time after which the lease is taken over if
+	// the proxy holding it goes away; the guarded operations take far less
+	adminRemovalLeaseTTL = 30 * time.Second
+
+	// adminRemovalWait is how long an operation waits for the lease at most
+	adminRemovalWait = 10 * time.Second
+
+	// adminRemovalRetryInterval is how often the lease is tried while waiting
+	adminRemovalRetryInterval = 100 * time.Millisecond
+)
+
+// adminRemovalLockKey is the key of the lease serializing the operations
+// which may remove an admin among the proxies sharing the data store
+var adminRemovalLockKey = db.GetPath(db.RootLocks, "admin_removal")
+
+// lockAdminRemoval acquires the lease serializing the operations which may
+// remove an admin among the proxies sharing the data store, waiting up to
+// adminRemovalWait for another proxy to release it; adminRemovalMutex must be held.
+// return values:
+//  func(): releases the lease
+//  error: auth_errors.ErrConcurrentUpdate if the lease wasn't released in time,
+//    or as returned by state.GetStateDriver() and AcquireLease()
+func lockAdminRemoval() (func(), error) {
+	drv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	holder, err := common.Global().Get(common.InstanceIDKey)
+	if err != nil || holder == "" {
+		holder = fmt.Sprintf("auth_proxy-%d", os.Getpid())
+	}
+
+	deadline := time.Now().Add(adminRemovalWait)
+	for {
+		acquired, err := drv.AcquireLease(adminRemovalLockKey, holder, adminRemovalLeaseTTL)
+		if err != nil {
+			return nil, err
+		}
+
+		if acquired {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			log.Warnf("Timed out waiting for another proxy to finish removing an admin")
+			return nil, auth_errors.ErrConcurrentUpdate
+		}
+
+		time.Sleep(adminRemovalRetryInterval)
+	}
+
+	return func() {
+		if err := drv.ReleaseLease(adminRemovalLockKey, holder); err != nil {
+			// it expires after adminRemovalLeaseTTL anyway
+			log.Warnf("Failed to release the lease on %q: %s", adminRemovalLockKey, err)
+		}
+	}, nil
+}
+
+// GuardLastAdmin runs an operation unless it would leave no admin.
+// params:
+//  removed: returns true for the admin authorizations the operation removes,
+//    e.g. the ones it deletes or makes expire, or those of a user it disables
+//  operation: the operation to run
+// return values:
+//  error: auth_errors.ErrLastAdmin if no admin would be left,
+//    auth_errors.ErrConcurrentUpdate if another proxy kept removing an admin,
+//    an error from reading the authorizations or local users, else as
+//    returned by operation
+func GuardLastAdmin(removed func(types.Authorization) bool, operation func() error) error {
+	adminRemovalMutex.Lock()
+	defer adminRemovalMutex.Unlock()
+
+	release, err := lockAdminRemoval()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	admins, err := activeAdmins()
+	if err != nil {
+		return err
+	}
+
+	remaining := 0
+	for _, admin := range admins {
+		if !removed(admin) {
+			remaining++
+		}
+	}
+
+	if remaining == 0 && len(admins) > 0 {
+		log.Warn("refusing to remove the last admin")
+		return auth_errors.ErrLastAdmin
+	}
+
+	return operation()
+}
+
+// activeAdmins returns the admin role authorizations which don't expire and
+// whose local user, if any, is neither deleted nor disabled.
+func activeAdmins() ([]types.Authorization, error) {
+	roles, err := db.ListAuthorizationsByClaim(types.RoleClaimKey)
+	if err != nil {
+		return nil, err
+	}
+
+	admins := []types.Authorization{}
+	for _, role := range roles {
+		if role.ClaimValue != types.Admin.String() || role.ExpiresAt != 0 {
+			continue
+		}
+
+		if role.Local {
+			user, err := db.GetLocalUser(role.PrincipalName)
+			switch {
+			case err == auth_errors.ErrKeyNotFound:
+				continue
+			case err != nil:
+				return nil, err
+			case user.DeletedAt != 0 || user.Disable:
+				continue
+			}
+		}
+
+		admins = append(admins, role)
+	}
+
+	return admins, nil
+}
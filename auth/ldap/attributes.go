@@ -0,0 +1,66 @@
+package ldap
+
+import (
+	"unicode/utf8"
+
+	"github.com/contiv/auth_proxy/common/types"
+	ldap "github.com/go-ldap/ldap"
+)
+
+// This file contains the attributes of users read from the directory at login,
+// e.g. their display name, which are carried in their tokens so that the UI can
+// greet users by name without querying the directory.
+
+// defaultUserAttributes are read unless types.LdapConfiguration.UserAttributes is set
+var defaultUserAttributes = []string{"displayName", "mail"}
+
+// MaxAttributeLength is the number of bytes of each attribute value kept; longer
+// values are truncated, as they end up in every token of the user
+const MaxAttributeLength = 256
+
+// UserAttributes returns the names of the attributes to read
+// params:
+//  cfg: LDAP configuration; its UserAttributes take precedence over the defaults
+func UserAttributes(cfg *types.LdapConfiguration) []string {
+	if len(cfg.UserAttributes) > 0 {
+		return cfg.UserAttributes
+	}
+
+	return defaultUserAttributes
+}
+
+// entryAttributes returns the attributes of the given entry; attributes the
+// entry doesn't have are left out, and only the first value of multi-valued
+// attributes is kept.
+// params:
+//  entry: the user's entry
+//  names: names of the attributes
+// return values:
+//  map[string]string: values truncated to MaxAttributeLength bytes, by attribute name
+func entryAttributes(entry *ldap.Entry, names []string) map[string]string {
+	attributes := map[string]string{}
+	for _, name := range names {
+		values := attributeValues(entry, name)
+		if len(values) == 0 || values[0] == "" {
+			continue
+		}
+
+		attributes[name] = truncate(values[0], MaxAttributeLength)
+	}
+
+	return attributes
+}
+
+// truncate returns the given string cut to at most the given number of bytes,
+// without splitting a UTF-8 sequence
+func truncate(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+
+	for length > 0 && !utf8.RuneStart(s[length]) {
+		length--
+	}
+
+	return s[:length]
+}
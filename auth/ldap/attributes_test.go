@@ -0,0 +1,71 @@
+package ldap
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestUserAttributes tests reading the attributes of users at login
+func TestUserAttributes(t *testing.T) {
+	directory := newGroupsDirectory()
+	directory.entries["CN=jdoe,DC=example,DC=com"]["mail"] = []string{"jdoe@example.com", "john.doe@example.com"}
+	directory.entries["CN=jdoe,DC=example,DC=com"]["title"] = []string{strings.Repeat("é", MaxAttributeLength)}
+	directory.passwords["CN=cyclic,DC=example,DC=com"] = "cyclic"
+
+	port, stop := startMockDirectory(t, directory)
+	defer stop()
+
+	testCases := []struct {
+		description string
+		username    string
+		attributes  []string
+		expected    map[string]string
+	}{
+		{"default attributes", "jdoe", nil, map[string]string{"displayName": "John Doe", "mail": "jdoe@example.com"}},
+		{"missing attributes", "cyclic", nil, map[string]string{}},
+		{"configured attributes", "jdoe", []string{"title", "department"},
+			map[string]string{"title": strings.Repeat("é", MaxAttributeLength/2)}},
+	}
+
+	for _, tc := range testCases {
+		lm := &Manager{Config: types.LdapConfiguration{
+			Server:                 "127.0.0.1",
+			Port:                   port,
+			BaseDN:                 "DC=example,DC=com",
+			ServiceAccountDN:       "CN=svc,DC=example,DC=com",
+			ServiceAccountPassword: "svc",
+			UserAttributes:         tc.attributes,
+		}}
+
+		_, _, attributes, err := lm.Authenticate(tc.username, tc.username)
+		if err != nil {
+			t.Errorf("%s: failed to authenticate %q: %v", tc.description, tc.username, err)
+		} else if !reflect.DeepEqual(attributes, tc.expected) {
+			t.Errorf("%s: expected attributes %v, got %v", tc.description, tc.expected, attributes)
+		}
+	}
+}
+
+// TestTruncate tests truncating attribute values without splitting characters
+func TestTruncate(t *testing.T) {
+	testCases := []struct {
+		value    string
+		length   int
+		expected string
+	}{
+		{"John Doe", 8, "John Doe"},
+		{"John Doe", 4, "John"},
+		{"Zoë", 3, "Zo"},
+		{"Zoë", 2, "Zo"},
+		{"日本", 2, ""},
+	}
+
+	for _, tc := range testCases {
+		if truncated := truncate(tc.value, tc.length); truncated != tc.expected {
+			t.Errorf("expected %q truncated to %d bytes to be %q, got %q", tc.value, tc.length, tc.expected, truncated)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package ldap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains the LDAP login cache. Successful logins are cached for
+// common.LdapCacheTTLKey seconds and only used to authenticate users while
+// the directory is unreachable.
+
+// cacheTTL returns the time for which logins are cached; 0 if caching is disabled.
+func cacheTTL() time.Duration {
+	value, err := common.Global().Get(common.LdapCacheTTLKey)
+	if err != nil {
+		return 0
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// ConfigVersion identifies the directory and search base of the given LDAP
+// configuration; the service account's password is left out as it's stored encrypted.
+// Cached logins are only used with the configuration they were cached with.
+func ConfigVersion(cfg *types.LdapConfiguration) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%s\x00%s\x00%t\x00%t\x00%s",
+		cfg.Server, cfg.Port, cfg.BaseDN, cfg.ServiceAccountDN,
+		cfg.StartTLS, cfg.InsecureSkipVerify, cfg.TLSCertIssuedTo)))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheLogin caches a successful login; it's a no-op if caching is disabled.
+// params:
+//  cfg: LDAP configuration the user was authenticated with
+//  username: username the user logged in with
+//  password: password of the user
+//  dn: distinguished name of the user
+//  groups: LDAP groups of the user
+//  attributes: attributes of the user
+// return values:
+//  error: as returned by common.GenPasswordHash() or db.CacheLdapLogin()
+func cacheLogin(cfg *types.LdapConfiguration, username, password, dn string, groups []string, attributes map[string]string) error {
+	ttl := cacheTTL()
+	if ttl == 0 {
+		return nil
+	}
+
+	passwordHash, err := common.GenPasswordHash(password)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	return db.CacheLdapLogin(&types.LdapCachedLogin{
+		Username:      username,
+		PasswordHash:  passwordHash,
+		DN:            dn,
+		Groups:        groups,
+		Attributes:    attributes,
+		ConfigVersion: ConfigVersion(cfg),
+		CachedAt:      now.Unix(),
+		ExpiresAt:     now.Add(ttl).Unix(),
+	})
+}
+
+// checkCachedLogin checks whether a cached login can be used to authenticate the user.
+// params:
+//  login: cached login of the user
+//  password: password the user is logging in with
+//  version: version of the current LDAP configuration
+//  ttl: current cache TTL; entries older than that are rejected even if they were cached with a longer TTL
+//  now: current time
+// return values:
+//  error: nil if the login can be used, ErrLDAPCachedLoginExpired if it expired, ErrLDAPAccessDenied otherwise
+func checkCachedLogin(login *types.LdapCachedLogin, password, version string, ttl time.Duration, now time.Time) error {
+	if ttl == 0 || now.Unix() >= login.ExpiresAt || now.Unix() >= login.CachedAt+int64(ttl/time.Second) {
+		return auth_errors.ErrLDAPCachedLoginExpired
+	}
+
+	if login.ConfigVersion != version || !common.ValidatePassword(password, login.PasswordHash) {
+		return auth_errors.ErrLDAPAccessDenied
+	}
+
+	return nil
+}
+
+// AuthenticateFromCache authenticates the user using their cached login. It's
+// meant to be used only when ErrLDAPConnectionFailed is returned by Authenticate().
+// params:
+//  username: username to authenticate
+//  password: password of the user
+// return values:
+//  *types.LdapCachedLogin: the cached login carrying the user's DN and groups
+//  error: nil on successful authentication, auth_errors.ErrKeyNotFound if the
+//         user's login isn't cached or as returned by checkCachedLogin()
+func AuthenticateFromCache(username, password string) (*types.LdapCachedLogin, error) {
+	ttl := cacheTTL()
+	if ttl == 0 {
+		return nil, auth_errors.ErrKeyNotFound
+	}
+
+	cfg, err := db.GetLdapConfiguration()
+	if err != nil {
+		return nil, err
+	}
+
+	login, err := db.GetCachedLdapLogin(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkCachedLogin(login, password, ConfigVersion(cfg), ttl, time.Now()); err != nil {
+		if err == auth_errors.ErrLDAPCachedLoginExpired {
+			if err := db.DeleteCachedLdapLogin(username); err != nil {
+				log.Warnf("failed to delete expired cached login of %q: %v", username, err)
+			}
+		}
+
+		return nil, err
+	}
+
+	return login, nil
+}
@@ -0,0 +1,53 @@
+package ldap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestCheckCachedLogin tests when cached logins can be used
+func TestCheckCachedLogin(t *testing.T) {
+	passwordHash, err := common.GenPasswordHash("secret")
+	if err != nil {
+		t.Fatalf("failed to hash password: %s", err)
+	}
+
+	now := time.Now()
+	cfg := &types.LdapConfiguration{Server: "ad.example.com", Port: 389, BaseDN: "DC=example,DC=com"}
+	login := &types.LdapCachedLogin{
+		Username:      "jdoe",
+		PasswordHash:  passwordHash,
+		ConfigVersion: ConfigVersion(cfg),
+		CachedAt:      now.Add(-10 * time.Minute).Unix(),
+		ExpiresAt:     now.Add(50 * time.Minute).Unix(),
+	}
+
+	otherCfg := *cfg
+	otherCfg.Server = "ad2.example.com"
+
+	testCases := []struct {
+		description string
+		password    string
+		version     string
+		ttl         time.Duration
+		now         time.Time
+		expected    error
+	}{
+		{"valid login", "secret", ConfigVersion(cfg), time.Hour, now, nil},
+		{"wrong password", "wrong", ConfigVersion(cfg), time.Hour, now, auth_errors.ErrLDAPAccessDenied},
+		{"changed configuration", "secret", ConfigVersion(&otherCfg), time.Hour, now, auth_errors.ErrLDAPAccessDenied},
+		{"expired login", "secret", ConfigVersion(cfg), time.Hour, now.Add(time.Hour), auth_errors.ErrLDAPCachedLoginExpired},
+		{"reduced TTL", "secret", ConfigVersion(cfg), 5 * time.Minute, now, auth_errors.ErrLDAPCachedLoginExpired},
+		{"caching disabled", "secret", ConfigVersion(cfg), 0, now, auth_errors.ErrLDAPCachedLoginExpired},
+	}
+
+	for _, tc := range testCases {
+		if err := checkCachedLogin(login, tc.password, tc.version, tc.ttl, tc.now); err != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.description, tc.expected, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package ldap
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+)
+
+// This file contains the check of a LDAP configuration, which admins run before
+// saving it rather than finding out it's broken when users can't log in.
+
+// checkTimeout is the time allowed for each operation of a check
+const checkTimeout = 5 * time.Second
+
+// CheckResult describes how far a check of a LDAP configuration got.
+// Fields:
+//  Connected: whether any of the servers could be connected to
+//  Bound: whether the service account could be bound
+//  UserFound: whether the test user was found; only set if a user was given
+//  DN: distinguished name of the test user
+//  Username: canonical name of the test user (see LoginAttributes())
+//  Groups: groups of the test user, including nested ones
+//  Attributes: attributes of the test user which would be carried in their tokens
+//  Error: reason the check failed, if it did
+type CheckResult struct {
+	Connected  bool              `json:"connected"`
+	Bound      bool              `json:"bound"`
+	UserFound  bool              `json:"user_found"`
+	DN         string            `json:"dn,omitempty"`
+	Username   string            `json:"username,omitempty"`
+	Groups     []string          `json:"groups,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// Check connects to the directory, binds the service account and looks up the
+// given user, without using or affecting the pooled connections. The service
+// password is never part of the result.
+// params:
+//  username: user to look up; optional
+// return values:
+//  CheckResult: how far the check got, and why it failed if it did
+func (lm *Manager) Check(username string) CheckResult {
+	result := CheckResult{}
+
+	ldapConn, err := lm.connect()
+	if err != nil {
+		result.Error = checkError(err)
+		return result
+	}
+
+	defer ldapConn.Close()
+
+	result.Connected = true
+	ldapConn.SetTimeout(checkTimeout)
+
+	if err := ldapConn.Bind(lm.Config.ServiceAccountDN, lm.Config.ServiceAccountPassword); err != nil {
+		log.Infof("LDAP bind operation failed for AD service account %q: %v", lm.Config.ServiceAccountDN, err)
+		result.Error = checkError(accessError(err))
+		return result
+	}
+
+	result.Bound = true
+	if username == "" {
+		return result
+	}
+
+	entry, err := lm.searchUser(ldapConn, username)
+	if err != nil {
+		result.Error = checkError(err)
+		return result
+	}
+
+	result.UserFound = true
+	result.DN = entry.DN
+	result.Username = lm.canonicalName(entry, username)
+	result.Attributes = entryAttributes(entry, UserAttributes(&lm.Config))
+
+	// users without groups can't log in either (see getUserGroups())
+	groups, err := lm.getUserGroups(ldapConn, entry, result.Username)
+	if err != nil {
+		result.Error = checkError(err)
+		return result
+	}
+
+	result.Groups = groups
+	return result
+}
+
+// checkError returns the message of the given error without its code
+func checkError(err error) string {
+	if authErr, ok := err.(*auth_errors.AuthError); ok {
+		return authErr.Message
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,63 @@
+package ldap
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestCheck tests checking LDAP configurations
+func TestCheck(t *testing.T) {
+	directory := newGroupsDirectory()
+	directory.passwords["CN=svc,DC=example,DC=com"] = "s3cr3t"
+
+	port, stop := startMockDirectory(t, directory)
+	defer stop()
+
+	valid := types.LdapConfiguration{
+		Server:                 "127.0.0.1",
+		Port:                   port,
+		BaseDN:                 "DC=example,DC=com",
+		ServiceAccountDN:       "CN=svc,DC=example,DC=com",
+		ServiceAccountPassword: "s3cr3t",
+	}
+
+	wrongPassword := valid
+	wrongPassword.ServiceAccountPassword = "wrong"
+
+	unreachable := valid
+	unreachable.Servers = []string{deadAddress(t)}
+
+	testCases := []struct {
+		description string
+		config      types.LdapConfiguration
+		username    string
+		expected    CheckResult
+	}{
+		{"unreachable server", unreachable, "jdoe", CheckResult{Error: "LDAP/AD connection failed"}},
+		{"wrong service password", wrongPassword, "jdoe", CheckResult{Connected: true, Error: "LDAP/AD access denied"}},
+		{"no user", valid, "", CheckResult{Connected: true, Bound: true}},
+		{"unknown user", valid, "unknown", CheckResult{Connected: true, Bound: true, Error: "User not found"}},
+		{"user", valid, "jdoe", CheckResult{Connected: true, Bound: true, UserFound: true, DN: "CN=jdoe,DC=example,DC=com", Username: "jdoe",
+			Groups:     []string{"CN=NetworkOps,DC=example,DC=com", "CN=TeamA,DC=example,DC=com"},
+			Attributes: map[string]string{"displayName": "John Doe"}}},
+	}
+
+	for _, tc := range testCases {
+		lm := &Manager{Config: tc.config}
+		result := lm.Check(tc.username)
+
+		sort.Strings(result.Groups)
+		if !reflect.DeepEqual(result, tc.expected) {
+			t.Errorf("%s: expected %#v, got %#v", tc.description, tc.expected, result)
+		}
+
+		if jData, _ := json.Marshal(result); strings.Contains(string(jData), "s3cr3t") {
+			t.Errorf("%s: the result contains the service password: %s", tc.description, jData)
+		}
+	}
+}
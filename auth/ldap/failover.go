@@ -0,0 +1,139 @@
+package ldap
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains the failover between several directory servers, e.g.
+// replicated domain controllers: they're tried in order until one of them can
+// be connected to, starting with the one which could be connected to last.
+
+// defaultConnectTimeout is the time allowed to connect to each server unless
+// types.LdapConfiguration.ConnectTimeout or common.LdapConnectTimeoutKey is set,
+// and defaultSearchTimeout the time allowed for each bind and search unless
+// types.LdapConfiguration.SearchTimeout is set
+const (
+	defaultConnectTimeout = 5 * time.Second
+	defaultSearchTimeout  = 5 * time.Second
+)
+
+var (
+	lastServerMutex sync.Mutex
+	lastServer      string   // address of the server connected to last; tried first next time
+	failedServers   []string // addresses of the servers tried by the last connect() which failed
+)
+
+// connectTimeout returns the time allowed to connect to each server
+// params:
+//  cfg: LDAP configuration; its ConnectTimeout takes precedence over the setting
+func connectTimeout(cfg *types.LdapConfiguration) time.Duration {
+	if cfg.ConnectTimeout > 0 {
+		return time.Duration(cfg.ConnectTimeout) * time.Second
+	}
+
+	value, err := common.Global().Get(common.LdapConnectTimeoutKey)
+	if err != nil {
+		return defaultConnectTimeout
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds <= 0 {
+		return defaultConnectTimeout
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// searchTimeout returns the time allowed for each bind and search
+// params:
+//  cfg: LDAP configuration
+func searchTimeout(cfg *types.LdapConfiguration) time.Duration {
+	if cfg.SearchTimeout > 0 {
+		return time.Duration(cfg.SearchTimeout) * time.Second
+	}
+
+	return defaultSearchTimeout
+}
+
+// serverAddresses returns the addresses of the configured servers in order.
+// params:
+//  cfg: LDAP configuration; Servers if set, otherwise Server
+// return values:
+//  []string: host:port of each server; Port is used for servers given without one
+func serverAddresses(cfg *types.LdapConfiguration) []string {
+	servers := cfg.Servers
+	if len(servers) == 0 {
+		servers = []string{cfg.Server}
+	}
+
+	addresses := []string{}
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err == nil {
+			addresses = append(addresses, server)
+			continue
+		}
+
+		addresses = append(addresses, net.JoinHostPort(server, strconv.Itoa(int(cfg.Port))))
+	}
+
+	return addresses
+}
+
+// orderServers moves the server connected to last to the front, so that a
+// server which is down isn't tried first on every login.
+// params:
+//  addresses: addresses of the servers in the configured order
+// return values:
+//  []string: the addresses in the order to try them
+func orderServers(addresses []string) []string {
+	lastServerMutex.Lock()
+	last := lastServer
+	lastServerMutex.Unlock()
+
+	ordered := []string{}
+	for _, address := range addresses {
+		if address == last {
+			ordered = append([]string{address}, ordered...)
+		} else {
+			ordered = append(ordered, address)
+		}
+	}
+
+	return ordered
+}
+
+// rememberServer records the server connected to last
+func rememberServer(address string) {
+	lastServerMutex.Lock()
+	defer lastServerMutex.Unlock()
+
+	lastServer = address
+	failedServers = nil
+}
+
+// rememberFailedServers records the servers tried by a connect() which
+// couldn't connect to any of them
+func rememberFailedServers(addresses []string) {
+	lastServerMutex.Lock()
+	defer lastServerMutex.Unlock()
+
+	failedServers = addresses
+}
+
+// FailedServers returns the servers which couldn't be connected to, so that
+// errors about the directory being unavailable can name them.
+// return values:
+//  []string: addresses of the servers tried by the last attempt to connect, in
+//            the order they were tried, if it failed; nil if it succeeded
+func FailedServers() []string {
+	lastServerMutex.Lock()
+	defer lastServerMutex.Unlock()
+
+	return failedServers
+}
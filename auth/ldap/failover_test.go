@@ -0,0 +1,138 @@
+package ldap
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// startMockLDAP accepts plaintext connections and keeps them open; it returns
+// the listener's address
+func startMockLDAP(t *testing.T) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			defer conn.Close()
+		}
+	}()
+
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+// deadAddress returns the address of a listener which was closed again
+func deadAddress(t *testing.T) string {
+	address, stop := startMockLDAP(t)
+	stop()
+
+	return address
+}
+
+// TestServerAddresses tests the addresses of the configured servers
+func TestServerAddresses(t *testing.T) {
+	testCases := []struct {
+		description string
+		config      types.LdapConfiguration
+		expected    []string
+	}{
+		{"single server", types.LdapConfiguration{Server: "ad.example.com", Port: 389}, []string{"ad.example.com:389"}},
+		{"servers take precedence", types.LdapConfiguration{Server: "ad.example.com", Servers: []string{"dc1.example.com", "dc2.example.com"}, Port: 636},
+			[]string{"dc1.example.com:636", "dc2.example.com:636"}},
+		{"servers with ports", types.LdapConfiguration{Servers: []string{"dc1.example.com:3269", "10.0.0.2"}, Port: 636},
+			[]string{"dc1.example.com:3269", "10.0.0.2:636"}},
+	}
+
+	for _, tc := range testCases {
+		if addresses := serverAddresses(&tc.config); !reflect.DeepEqual(addresses, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.description, tc.expected, addresses)
+		}
+	}
+}
+
+// TestConnectFailover tests that the servers are tried in order, starting with
+// the one connected to last
+func TestConnectFailover(t *testing.T) {
+	defer rememberServer("")
+
+	live, stop := startMockLDAP(t)
+	defer stop()
+
+	dead := deadAddress(t)
+
+	lm := &Manager{Config: types.LdapConfiguration{Servers: []string{dead, live}, Port: 389}}
+	conn, err := lm.connect()
+	if err != nil {
+		t.Fatalf("expected to connect to %s, got %v", live, err)
+	}
+	conn.Close()
+
+	// the live server is tried first from now on
+	if ordered := orderServers([]string{dead, live}); !reflect.DeepEqual(ordered, []string{live, dead}) {
+		t.Errorf("expected %s to be tried first, got %v", live, ordered)
+	}
+
+	if failed := FailedServers(); failed != nil {
+		t.Errorf("expected no failed servers after connecting, got %v", failed)
+	}
+
+	// all servers are down; the error names them
+	lm.Config.Servers = []string{dead, deadAddress(t)}
+	if _, err := lm.connect(); err != auth_errors.ErrLDAPConnectionFailed {
+		t.Errorf("expected %v, got %v", auth_errors.ErrLDAPConnectionFailed, err)
+	}
+
+	if failed := FailedServers(); !reflect.DeepEqual(failed, lm.Config.Servers) {
+		t.Errorf("expected %v to be reported as tried, got %v", lm.Config.Servers, failed)
+	}
+}
+
+// TestTimeouts tests the timeouts of connections and searches
+func TestTimeouts(t *testing.T) {
+	if timeout := connectTimeout(&types.LdapConfiguration{}); timeout != defaultConnectTimeout {
+		t.Errorf("expected the default connect timeout, got %s", timeout)
+	}
+
+	if timeout := connectTimeout(&types.LdapConfiguration{ConnectTimeout: 2}); timeout != 2*time.Second {
+		t.Errorf("expected a connect timeout of 2s, got %s", timeout)
+	}
+
+	if timeout := searchTimeout(&types.LdapConfiguration{}); timeout != defaultSearchTimeout {
+		t.Errorf("expected the default search timeout, got %s", timeout)
+	}
+
+	directory := newGroupsDirectory()
+	directory.delay = 2 * time.Second
+
+	port, stop := startMockDirectory(t, directory)
+	defer stop()
+
+	lm := &Manager{Config: types.LdapConfiguration{
+		Server:                 "127.0.0.1",
+		Port:                   port,
+		BaseDN:                 "DC=example,DC=com",
+		ServiceAccountDN:       "CN=svc,DC=example,DC=com",
+		ServiceAccountPassword: "svc",
+		SearchTimeout:          1,
+	}}
+
+	start := time.Now()
+	if _, _, err := lm.Lookup("jdoe"); err != auth_errors.ErrLDAPConnectionFailed {
+		t.Errorf("expected %v for a search taking too long, got %v", auth_errors.ErrLDAPConnectionFailed, err)
+	}
+
+	if elapsed := time.Since(start); elapsed >= directory.delay {
+		t.Errorf("expected the search to time out after 1s, took %s", elapsed)
+	}
+}
@@ -0,0 +1,46 @@
+package ldap
+
+import (
+	"strings"
+
+	ldap "github.com/go-ldap/ldap"
+)
+
+// This file contains the building of search filters. Values which may come from
+// users, e.g. login names or group queries, are always escaped as described in
+// RFC 4515 so that they can't alter the filters they're part of; attribute
+// names and object classes come from the configuration, which only accepts
+// valid attribute descriptors.
+
+// escapeValue escapes an assertion value: `*`, `(`, `)`, `\`, NUL and the
+// bytes of non-ASCII characters are written as \XX, so that e.g. `O)Brien`
+// matches itself and `*` never acts as a wildcard.
+func escapeValue(value string) string {
+	return ldap.EscapeFilter(value)
+}
+
+// equalityFilter returns a filter matching the entries whose attribute has the given value
+// params:
+//  attribute: attribute name, e.g. sAMAccountName
+//  value: value to match; it's escaped
+func equalityFilter(attribute, value string) string {
+	return "(" + attribute + "=" + escapeValue(value) + ")"
+}
+
+// substringFilter returns a filter matching the entries whose attribute contains the given value
+// params:
+//  attribute: attribute name, e.g. cn
+//  value: value to look for; it's escaped, so it can't add wildcards of its own
+func substringFilter(attribute, value string) string {
+	return "(" + attribute + "=*" + escapeValue(value) + "*)"
+}
+
+// andFilter returns a filter matching the entries matched by all the given filters
+func andFilter(filters ...string) string {
+	return "(&" + strings.Join(filters, "") + ")"
+}
+
+// orFilter returns a filter matching the entries matched by any of the given filters
+func orFilter(filters ...string) string {
+	return "(|" + strings.Join(filters, "") + ")"
+}
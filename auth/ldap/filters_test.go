@@ -0,0 +1,140 @@
+package ldap
+
+import (
+	"testing"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	ldap "github.com/go-ldap/ldap"
+)
+
+// hostileValues are user inputs which would alter a filter they were interpolated into
+var hostileValues = []string{
+	"*",
+	"*)(uid=*)",
+	"*)(|(objectClass=*)",
+	"O)Brien",
+	"jdoe)(&",
+	`back\slash`,
+	`\2a`,
+	"null\x00byte",
+	"Ünïcødé ✓",
+	"",
+}
+
+// TestFilterEscaping tests that values compile to a single assertion of exactly themselves
+func TestFilterEscaping(t *testing.T) {
+	for _, value := range hostileValues {
+		packet, err := ldap.CompileFilter(equalityFilter("sAMAccountName", value))
+		if err != nil {
+			t.Errorf("%q: invalid equality filter: %v", value, err)
+			continue
+		}
+
+		if packet.Tag != ldap.FilterEqualityMatch || len(packet.Children) != 2 ||
+			packet.Children[0].Data.String() != "sAMAccountName" || packet.Children[1].Data.String() != value {
+			t.Errorf("%q: expected an equality match of the value itself, got %s", value, ldap.FilterMap[uint64(packet.Tag)])
+		}
+
+		// group searches require a query
+		if value == "" {
+			continue
+		}
+
+		// *value* compiles to an `any` substring holding the value
+		packet, err = ldap.CompileFilter(substringFilter("cn", value))
+		if err != nil {
+			t.Errorf("%q: invalid substring filter: %v", value, err)
+			continue
+		}
+
+		if packet.Tag != ldap.FilterSubstrings || len(packet.Children) != 2 || len(packet.Children[1].Children) != 1 ||
+			packet.Children[1].Children[0].Tag != ldap.FilterSubstringsAny || packet.Children[1].Children[0].Data.String() != value {
+			t.Errorf("%q: expected a substring match of the value itself, got %s", value, ldap.FilterMap[uint64(packet.Tag)])
+		}
+	}
+}
+
+// TestUserFilter tests that hostile usernames don't alter the structure of the user search filter
+func TestUserFilter(t *testing.T) {
+	for _, value := range hostileValues {
+		filter := andFilter(equalityFilter("objectClass", "user"),
+			orFilter(equalityFilter("sAMAccountName", value), equalityFilter("userPrincipalName", value)))
+
+		packet, err := ldap.CompileFilter(filter)
+		if err != nil {
+			t.Errorf("%q: invalid filter %q: %v", value, filter, err)
+			continue
+		}
+
+		if packet.Tag != ldap.FilterAnd || len(packet.Children) != 2 ||
+			packet.Children[1].Tag != ldap.FilterOr || len(packet.Children[1].Children) != 2 {
+			t.Errorf("%q: unexpected structure of filter %q", value, filter)
+		}
+	}
+}
+
+// TestHostileUsernames tests logging in with usernames holding filter metacharacters
+func TestHostileUsernames(t *testing.T) {
+	directory := &mockDirectory{
+		entries: map[string]map[string][]string{
+			"CN=svc,DC=example,DC=com":     {"objectClass": {"user"}, "sAMAccountName": {"svc"}},
+			"CN=O)Brien,DC=example,DC=com": {"objectClass": {"user"}, "sAMAccountName": {"O)Brien"}},
+			"CN=jdoe,DC=example,DC=com":    {"objectClass": {"user"}, "sAMAccountName": {"jdoe"}},
+			"CN=Ünïcødé,DC=example,DC=com": {"objectClass": {"user"}, "sAMAccountName": {"Ünïcødé"}},
+			"cn=users,DC=example,DC=com": {"objectClass": {"posixGroup"},
+				"memberUid": {"O)Brien", "jdoe", "Ünïcødé"}},
+		},
+		passwords: map[string]string{
+			"CN=svc,DC=example,DC=com":     "svc",
+			"CN=O)Brien,DC=example,DC=com": "secret",
+			"CN=jdoe,DC=example,DC=com":    "secret",
+			"CN=Ünïcødé,DC=example,DC=com": "secret",
+		},
+	}
+
+	port, stop := startMockDirectory(t, directory)
+	defer stop()
+
+	lm := &Manager{Config: types.LdapConfiguration{
+		Server:                   "127.0.0.1",
+		Port:                     port,
+		BaseDN:                   "DC=example,DC=com",
+		ServiceAccountDN:         "CN=svc,DC=example,DC=com",
+		ServiceAccountPassword:   "svc",
+		GroupObjectClass:         "posixGroup",
+		GroupMembershipAttribute: "memberUid",
+		GroupMembership:          types.LdapGroupMembershipGroup,
+	}}
+
+	testCases := []struct {
+		username string
+		dn       string
+		err      error
+	}{
+		{"O)Brien", "CN=O)Brien,DC=example,DC=com", nil},
+		{"Ünïcødé", "CN=Ünïcødé,DC=example,DC=com", nil},
+		// wildcards and injected assertions match no user instead of several or the wrong one
+		{"*", "", auth_errors.ErrUserNotFound},
+		{"j*", "", auth_errors.ErrUserNotFound},
+		{"*)(sAMAccountName=jdoe", "", auth_errors.ErrUserNotFound},
+		{"jdoe)(|(objectClass=*", "", auth_errors.ErrUserNotFound},
+		{"jdoe\x00", "", auth_errors.ErrUserNotFound},
+	}
+
+	for _, tc := range testCases {
+		dn, groups, _, err := lm.Authenticate(tc.username, "secret")
+		if err != tc.err {
+			t.Errorf("%q: expected error %v, got %v", tc.username, tc.err, err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if dn != tc.dn || len(groups) != 1 || groups[0] != "cn=users,DC=example,DC=com" {
+			t.Errorf("%q: expected DN %q in cn=users, got %q in %v", tc.username, tc.dn, dn, groups)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package ldap
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains the mapping of LDAP groups to base roles (see
+// types.LdapConfiguration.GroupRoles), which lets admins grant e.g. the admin
+// role to the members of a group without adding authorizations.
+
+// GroupsRole is a helper function which just reads the configuration and calls groupsRole.
+// params:
+//  groups: DNs of the user's groups, as returned by Authenticate() or Lookup()
+// return values:
+//  types.RoleType: the highest role the groups are mapped to
+//  bool: false if none of the groups is mapped to a role, or there's no configuration
+func GroupsRole(groups []string) (types.RoleType, bool) {
+	cfg, err := db.GetLdapConfiguration()
+	if err != nil || cfg == nil {
+		return types.Invalid, false
+	}
+
+	return groupsRole(cfg, groups)
+}
+
+// groupsRole returns the highest role the given groups are mapped to; group
+// DNs are matched case-insensitively, as the directory may return them in a
+// different case than they were configured in.
+// params:
+//  cfg: LDAP configuration holding the mapping
+//  groups: DNs of the user's groups
+// return values:
+//  types.RoleType: the highest role the groups are mapped to
+//  bool: false if none of the groups is mapped to a role
+func groupsRole(cfg *types.LdapConfiguration, groups []string) (types.RoleType, bool) {
+	if len(cfg.GroupRoles) == 0 {
+		return types.Invalid, false
+	}
+
+	roles := map[string]string{}
+	for dn, role := range cfg.GroupRoles {
+		roles[strings.ToLower(dn)] = role
+	}
+
+	highest, found := types.Invalid, false
+	for _, group := range groups {
+		roleStr, ok := roles[strings.ToLower(group)]
+		if !ok {
+			continue
+		}
+
+		role, err := types.Role(roleStr) // already validated
+		if err != nil {
+			log.Warnf("Ignoring invalid role %q of LDAP group %q", roleStr, group)
+			continue
+		}
+
+		// lower roles are more privileged
+		if role < highest {
+			highest, found = role, true
+		}
+	}
+
+	return highest, found
+}
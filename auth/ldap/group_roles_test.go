@@ -0,0 +1,44 @@
+package ldap
+
+import (
+	"testing"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestGroupsRole tests mapping the groups of users to their base role
+func TestGroupsRole(t *testing.T) {
+	cfg := &types.LdapConfiguration{GroupRoles: map[string]string{
+		"CN=NetAdmins,DC=example,DC=com": "admin",
+		"CN=NetOps,DC=example,DC=com":    "ops",
+		"CN=Auditors,DC=example,DC=com":  "guest",
+		"CN=Broken,DC=example,DC=com":    "root",
+	}}
+
+	testCases := []struct {
+		description string
+		groups      []string
+		role        types.RoleType
+		found       bool
+	}{
+		{"no groups", nil, types.Invalid, false},
+		{"unmapped group", []string{"CN=Sales,DC=example,DC=com"}, types.Invalid, false},
+		{"mapped group", []string{"CN=Sales,DC=example,DC=com", "CN=NetOps,DC=example,DC=com"}, types.Ops, true},
+		{"case-insensitive DNs", []string{"cn=netops,dc=example,dc=com"}, types.Ops, true},
+		// users in several groups get the highest of their roles, in any order
+		{"admin and ops", []string{"CN=NetOps,DC=example,DC=com", "CN=NetAdmins,DC=example,DC=com"}, types.Admin, true},
+		{"ops and guest", []string{"CN=NetOps,DC=example,DC=com", "CN=Auditors,DC=example,DC=com"}, types.Ops, true},
+		{"invalid role", []string{"CN=Broken,DC=example,DC=com"}, types.Invalid, false},
+	}
+
+	for _, tc := range testCases {
+		role, found := groupsRole(cfg, tc.groups)
+		if role != tc.role || found != tc.found {
+			t.Errorf("%s: expected %v (found: %v), got %v (found: %v)", tc.description, tc.role, tc.found, role, found)
+		}
+	}
+
+	if role, found := groupsRole(&types.LdapConfiguration{}, []string{"CN=NetAdmins,DC=example,DC=com"}); found {
+		t.Errorf("expected no role without a mapping, got %v", role)
+	}
+}
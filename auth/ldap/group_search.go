@@ -0,0 +1,179 @@
+package ldap
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/db"
+	ldap "github.com/go-ldap/ldap"
+)
+
+// This file contains the search of groups by name, which lets admins pick the
+// groups they grant authorizations to instead of typing their DNs.
+
+// defaultGroupSearchLimit is the number of groups returned by a search unless
+// common.LdapGroupSearchLimitKey is set
+const defaultGroupSearchLimit = 50
+
+// Group is a group found by SearchGroups()
+//
+// Fields:
+//  DN: distinguished name of the group, which authorizations are granted to
+//  DisplayName: its displayName, or its CN if it has none
+//
+type Group struct {
+	DN          string `json:"dn"`
+	DisplayName string `json:"display_name"`
+}
+
+// groupSearchLimit returns the maximum number of groups returned by a search
+func groupSearchLimit() int {
+	value, err := common.Global().Get(common.LdapGroupSearchLimitKey)
+	if err != nil || common.IsEmpty(value) {
+		return defaultGroupSearchLimit
+	}
+
+	limit, err := strconv.Atoi(value) // already validated
+	if err != nil || limit <= 0 {
+		return defaultGroupSearchLimit
+	}
+
+	return limit
+}
+
+// SearchGroups is a helper function which just sets the configuration and calls ldap group search.
+// params:
+//  query: part of the CN of the groups, or the DN of a group
+// return values:
+//  []Group: groups found, at most common.LdapGroupSearchLimitKey of them
+//  bool: true if more groups match the query
+//  error: auth_errors.ErrKeyNotFound if the config is not found or as returned by ldapManager.SearchGroups
+func SearchGroups(query string) ([]Group, bool, error) {
+	cfg, err := db.GetLdapConfiguration()
+	if err != nil {
+		return nil, false, err
+	}
+
+	cfg.ServiceAccountPassword, err = common.Decrypt(cfg.ServiceAccountPassword)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ldapManager := Manager{Config: *cfg}
+	return ldapManager.SearchGroups(query, groupSearchLimit())
+}
+
+// SearchGroups searches the groups whose CN contains the given query, bound as
+// the service account; a query which is a DN in the base DN finds the group
+// it names as well.
+// params:
+//  query: part of the CN of the groups, or the DN of a group; it's escaped,
+//         so it can't alter the search filter
+//  limit: maximum number of groups returned
+// return values:
+//  []Group: groups found, sorted by display name
+//  bool: true if more groups match the query
+//  error: nil if successful, else as returned by accessError()
+func (lm *Manager) SearchGroups(query string, limit int) (groups []Group, truncated bool, err error) {
+	ldapConn, err := lm.acquire()
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer func() { lm.release(ldapConn, err) }()
+
+	objectClass, _ := groupSchema(&lm.Config)
+	attributes := []string{"cn", "displayName"}
+
+	// one more group than returned tells whether there are more
+	searchRequest := ldap.NewSearchRequest(
+		lm.Config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.DerefAlways, limit+1, searchTimeLimit(&lm.Config), false,
+		andFilter(equalityFilter("objectClass", objectClass), substringFilter("cn", query)),
+		attributes,
+		nil)
+
+	searchRes, err := lm.search(ldapConn, searchRequest)
+	if err != nil {
+		log.Errorf("LDAP search operation failed for the groups matching %q: %v", query, err)
+		return nil, false, accessError(err)
+	}
+
+	entries := searchRes.Entries
+
+	if IsDN(query) && hasDNSuffix(query, lm.Config.BaseDN) {
+		searchRequest := ldap.NewSearchRequest(
+			query,
+			ldap.ScopeBaseObject, ldap.DerefAlways, 0, searchTimeLimit(&lm.Config), false,
+			equalityFilter("objectClass", objectClass),
+			attributes,
+			nil)
+
+		searchRes, err := lm.search(ldapConn, searchRequest)
+		if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			log.Errorf("LDAP search operation failed for group %q: %v", query, err)
+			return nil, false, accessError(err)
+		} else if err == nil {
+			entries = append(searchRes.Entries, entries...)
+		}
+	}
+
+	found := map[string]bool{}
+	groups = []Group{}
+	for _, entry := range entries {
+		if found[strings.ToLower(entry.DN)] {
+			continue
+		}
+
+		found[strings.ToLower(entry.DN)] = true
+		groups = append(groups, Group{DN: entry.DN, DisplayName: groupDisplayName(entry)})
+	}
+
+	sort.Sort(byDisplayName(groups))
+
+	if len(groups) > limit {
+		return groups[:limit], true, nil
+	}
+
+	return groups, false, nil
+}
+
+// groupDisplayName returns the displayName of a group, or its CN if it has none
+func groupDisplayName(entry *ldap.Entry) string {
+	for _, attribute := range []string{"displayName", "cn"} {
+		if values := attributeValues(entry, attribute); len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+
+	return entry.DN
+}
+
+// IsDN returns whether the given string is a DN, e.g. CN=NetOps,DC=example,DC=com;
+// go-ldap parses any string without `=` as an empty DN
+func IsDN(s string) bool {
+	_, err := ldap.ParseDN(s)
+	return err == nil && strings.Contains(s, "=")
+}
+
+// hasDNSuffix returns whether the given DN is in the subtree of the given base DN
+func hasDNSuffix(dn, baseDN string) bool {
+	return strings.HasSuffix(strings.ToLower(dn), strings.ToLower(baseDN))
+}
+
+// byDisplayName sorts groups by display name, case-insensitively, then by DN
+type byDisplayName []Group
+
+func (g byDisplayName) Len() int      { return len(g) }
+func (g byDisplayName) Swap(i, j int) { g[i], g[j] = g[j], g[i] }
+func (g byDisplayName) Less(i, j int) bool {
+	a, b := strings.ToLower(g[i].DisplayName), strings.ToLower(g[j].DisplayName)
+	if a != b {
+		return a < b
+	}
+
+	return g[i].DN < g[j].DN
+}
@@ -0,0 +1,69 @@
+package ldap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestSearchGroups tests searching groups by CN and DN
+func TestSearchGroups(t *testing.T) {
+	directory := newGroupsDirectory()
+	directory.entries["CN=TeamB,DC=example,DC=com"] = map[string][]string{"objectClass": {"group"}, "cn": {"TeamB"}, "displayName": {"Team B"}}
+	directory.entries["CN=Team*,DC=example,DC=com"] = map[string][]string{"objectClass": {"group"}, "cn": {"Team*"}}
+	for _, group := range []string{"TeamA", "NetworkOps", "CycleA", "CycleB"} {
+		directory.entries["CN="+group+",DC=example,DC=com"]["cn"] = []string{group}
+	}
+
+	port, stop := startMockDirectory(t, directory)
+	defer stop()
+
+	lm := &Manager{Config: types.LdapConfiguration{
+		Server:                 "127.0.0.1",
+		Port:                   port,
+		BaseDN:                 "DC=example,DC=com",
+		ServiceAccountDN:       "CN=svc,DC=example,DC=com",
+		ServiceAccountPassword: "svc",
+	}}
+
+	teamA := Group{DN: "CN=TeamA,DC=example,DC=com", DisplayName: "TeamA"}
+	teamB := Group{DN: "CN=TeamB,DC=example,DC=com", DisplayName: "Team B"}
+	teamStar := Group{DN: "CN=Team*,DC=example,DC=com", DisplayName: "Team*"}
+	cycleA := Group{DN: "CN=CycleA,DC=example,DC=com", DisplayName: "CycleA"}
+	cycleB := Group{DN: "CN=CycleB,DC=example,DC=com", DisplayName: "CycleB"}
+
+	testCases := []struct {
+		description string
+		query       string
+		limit       int
+		expected    []Group
+		truncated   bool
+	}{
+		{"part of the CN", "team", 10, []Group{teamB, teamStar, teamA}, false},
+		{"no match", "sales", 10, []Group{}, false},
+		{"users aren't groups", "jdoe", 10, []Group{}, false},
+		{"limited", "cycle", 1, []Group{cycleA}, true},
+		{"exactly the limit", "cycle", 2, []Group{cycleA, cycleB}, false},
+		// the directory returns an error once the size limit is exceeded
+		{"size limit exceeded", "team", 1, []Group{teamStar}, true},
+		// the query is escaped, so `*` only matches itself
+		{"wildcard", "Team*", 10, []Group{teamStar}, false},
+		{"filter injection", "*)(objectClass=*", 10, []Group{}, false},
+		{"DN", "cn=teamb,dc=example,dc=com", 10, []Group{teamB}, false},
+		{"DN of a user", "CN=jdoe,DC=example,DC=com", 10, []Group{}, false},
+		{"unknown DN", "CN=Sales,DC=example,DC=com", 10, []Group{}, false},
+	}
+
+	for _, tc := range testCases {
+		groups, truncated, err := lm.SearchGroups(tc.query, tc.limit)
+		if err != nil {
+			t.Errorf("%s: failed to search groups: %v", tc.description, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(groups, tc.expected) || truncated != tc.truncated {
+			t.Errorf("%s: expected %v (truncated: %v), got %v (truncated: %v)", tc.description, tc.expected, tc.truncated, groups, truncated)
+		}
+	}
+}
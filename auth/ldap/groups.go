@@ -0,0 +1,220 @@
+package ldap
+
+import (
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	ldap "github.com/go-ldap/ldap"
+)
+
+// This file contains the resolution of the user's groups: authorizations
+// granted to a group apply to the members of the groups nested in it, e.g. a
+// user in TeamA is authorized as NetworkOps if TeamA is a member of NetworkOps.
+// Membership is recorded either on the user entries (AD's memberOf) or on the
+// group entries (e.g. posixGroup's memberUid), see types.LdapConfiguration.
+
+// defaultGroupNestingDepth is the number of nesting levels followed unless
+// common.LdapGroupNestingDepthKey is set
+const defaultGroupNestingDepth = 10
+
+// defaults of the group schema, which are AD's
+const (
+	defaultGroupObjectClass         = "group"
+	defaultGroupMembershipAttribute = "memberOf"
+)
+
+// groupNestingDepth returns the number of nesting levels to follow
+func groupNestingDepth() int {
+	value, err := common.Global().Get(common.LdapGroupNestingDepthKey)
+	if err != nil || common.IsEmpty(value) {
+		return defaultGroupNestingDepth
+	}
+
+	depth, err := strconv.Atoi(value) // already validated
+	if err != nil {
+		return defaultGroupNestingDepth
+	}
+
+	return depth
+}
+
+// groupSchema returns the object class of the groups and the attribute recording
+// the group membership; AD's unless configured otherwise
+func groupSchema(cfg *types.LdapConfiguration) (string, string) {
+	objectClass, attribute := cfg.GroupObjectClass, cfg.GroupMembershipAttribute
+	if common.IsEmpty(objectClass) {
+		objectClass = defaultGroupObjectClass
+	}
+
+	if common.IsEmpty(attribute) {
+		attribute = defaultGroupMembershipAttribute
+	}
+
+	return objectClass, attribute
+}
+
+// attributeValues returns the values of the given attribute of an entry; unlike
+// ldap.Entry.GetAttributeValues(), attribute names are case-insensitive
+func attributeValues(entry *ldap.Entry, attribute string) []string {
+	for _, attr := range entry.Attributes {
+		if strings.EqualFold(attr.Name, attribute) {
+			return attr.Values
+		}
+	}
+
+	return []string{}
+}
+
+// getUserGroups performs a nested search on the first-level groups of the given user to uncover all the groups that the user is part of.
+// params:
+//  ldapConn: LDAP connection object
+//  entry: the user's entry, carrying the membership attribute if it's recorded on user entries
+//  username: username of the user; groups record it as member, e.g. posixGroup's memberUid
+// return values:
+//  on successful search, array of unique groups that user is part-of otherwise any relevant error
+func (lm *Manager) getUserGroups(ldapConn *ldap.Conn, entry *ldap.Entry, username string) ([]string, error) {
+	_, attribute := groupSchema(&lm.Config)
+
+	groups := []string{}
+	if lm.Config.GroupMembership == types.LdapGroupMembershipGroup {
+		var err error
+		if groups, err = lm.searchGroups(ldapConn, entry.DN, username); err != nil {
+			return nil, err
+		}
+	} else {
+		groups = attributeValues(entry, attribute)
+	}
+
+	if len(groups) == 0 {
+		// this happens when the user is just part of the primary group; we won't attempt to handle this case!
+		// more details here: http://lists.freeradius.org/pipermail/freeradius-users/2012-August/062055.html
+		log.Debug("User is just part of primary group; can't proceed further")
+		return []string{}, auth_errors.ErrLDAPGroupsNotFound
+	}
+
+	return lm.expandGroups(ldapConn, groups, groupNestingDepth())
+}
+
+// searchGroups searches the groups which record any of the given members on their entries.
+// params:
+//  ldapConn: LDAP connection object
+//  members: DNs or usernames of the members
+// return values:
+//  []string: DNs of the groups
+//  error: nil if successful, else as returned by accessError()
+func (lm *Manager) searchGroups(ldapConn *ldap.Conn, members ...string) ([]string, error) {
+	objectClass, attribute := groupSchema(&lm.Config)
+
+	filters := []string{}
+	for _, member := range members {
+		filters = append(filters, equalityFilter(attribute, member))
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		lm.Config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.DerefAlways, 0, searchTimeLimit(&lm.Config), false,
+		andFilter(equalityFilter("objectClass", objectClass), orFilter(filters...)),
+		[]string{"dn"},
+		nil)
+
+	searchRes, err := lm.search(ldapConn, searchRequest)
+	if err != nil {
+		log.Errorf("LDAP search operation failed for the groups of %q: %v", members, err)
+		return nil, accessError(err)
+	}
+
+	groups := []string{}
+	for _, entry := range searchRes.Entries {
+		groups = append(groups, entry.DN)
+	}
+
+	return groups, nil
+}
+
+// parentGroups returns the groups that the given group is a member of.
+// params:
+//  ldapConn: LDAP connection object
+//  group: DN of the group
+// return values:
+//  []string: DNs of the groups
+//  error: nil if successful, else ErrLDAPMultipleEntries or as returned by accessError()
+func (lm *Manager) parentGroups(ldapConn *ldap.Conn, group string) ([]string, error) {
+	if lm.Config.GroupMembership == types.LdapGroupMembershipGroup {
+		return lm.searchGroups(ldapConn, group)
+	}
+
+	objectClass, attribute := groupSchema(&lm.Config)
+
+	// process active directory group `group`; get group's memberOf set. base object search will always return only a single entry (specified by the DN)
+	searchRequest := ldap.NewSearchRequest(
+		group, // distinguished name of the group in the base domain
+		ldap.ScopeBaseObject, ldap.DerefAlways, 0, searchTimeLimit(&lm.Config), false,
+		equalityFilter("objectClass", objectClass), // search filter; search is restricted to groups as we are not focusing on other entities here
+		[]string{attribute},
+		nil)
+
+	searchRes, err := lm.search(ldapConn, searchRequest)
+	if err != nil {
+		log.Errorf("LDAP search operation failed for AD group %q, error %#v", group, err)
+		return nil, accessError(err)
+	}
+
+	if len(searchRes.Entries) > 1 { // we should never hit this case!
+		return []string{}, auth_errors.ErrLDAPMultipleEntries
+	} else if len(searchRes.Entries) == 0 { // not a group, e.g. a distribution list; it's got no subgroups
+		return []string{}, nil
+	}
+
+	return attributeValues(searchRes.Entries[0], attribute), nil
+}
+
+// expandGroups searches the groups that the given groups are members of, level by level,
+// up to the given depth. Every group is searched once, so cycles in the directory end
+// the search instead of looping.
+// params:
+//  ldapConn: LDAP connection object
+//  groups: list of first-level user groups
+//  depth: number of nesting levels to follow; 0 returns the first-level groups only
+// return values:
+//  on successful search, array of unique groups that user is part-of otherwise any relevant error
+func (lm *Manager) expandGroups(ldapConn *ldap.Conn, groups []string, depth int) ([]string, error) {
+	processedGroups := make(map[string]bool) // to track processed groups during nested search
+	result := []string{}
+
+	for level := 0; len(groups) > 0; level++ {
+		if level > depth {
+			log.Warnf("Ignoring AD groups nested more than %d levels deep: %s", depth, strings.Join(groups, ", "))
+			break
+		}
+
+		nextGroups := []string{}
+		for _, adGroup := range groups {
+			if processedGroups[adGroup] {
+				continue
+			}
+
+			processedGroups[adGroup] = true
+			result = append(result, adGroup)
+
+			// look for possible subgroups to be further processed
+			subGroups, err := lm.parentGroups(ldapConn, adGroup)
+			if err != nil {
+				return []string{}, err
+			}
+
+			for _, sGrp := range subGroups {
+				if !processedGroups[sGrp] {
+					nextGroups = append(nextGroups, sGrp)
+				}
+			}
+		}
+
+		groups = nextGroups
+	}
+
+	return result, nil
+}
@@ -0,0 +1,516 @@
+package ldap
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	ldap "github.com/go-ldap/ldap"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// mockDirectory is an in-memory directory served over LDAP; it supports simple
+// binds and searches filtering by equality, substrings, presence, `&` and `|`
+type mockDirectory struct {
+	entries   map[string]map[string][]string // attributes of the entries by DN
+	passwords map[string]string              // passwords of the entries by DN
+	delay     time.Duration                  // time the searches take
+	paging    mockPaging                     // support of the paging control
+	referrals map[string]string              // referrals to the parts of the directory held by other servers, by base DN
+
+	mutex sync.Mutex
+	conns []net.Conn // connections accepted so far
+	pages int        // pages of results returned so far
+}
+
+// mockPaging is how a mockDirectory handles the paging control (RFC 2696)
+type mockPaging int
+
+const (
+	mockPagingSupported mockPaging = iota // returns the results a page at a time
+	mockPagingIgnored                     // ignores the control, returning all the results at once
+	mockPagingRejected                    // rejects searches carrying the control
+)
+
+// startMockDirectory serves the given directory; it returns the port it
+// listens on
+func startMockDirectory(t *testing.T, directory *mockDirectory) (uint16, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			directory.mutex.Lock()
+			directory.conns = append(directory.conns, conn)
+			directory.mutex.Unlock()
+
+			go directory.serve(conn)
+		}
+	}()
+
+	_, portStr, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	return uint16(port), func() { listener.Close() }
+}
+
+// serve answers the requests sent over the given connection until it's unbound
+func (d *mockDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		request, err := ber.ReadPacket(conn)
+		if err != nil || len(request.Children) < 2 {
+			return
+		}
+
+		messageID := request.Children[0].Value
+		op := request.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+
+			resultCode := int64(ldap.LDAPResultInvalidCredentials)
+			if expected, found := d.passwords[dn]; found && expected == password {
+				resultCode = ldap.LDAPResultSuccess
+			}
+
+			d.write(conn, messageID, ldapResult(ldap.ApplicationBindResponse, resultCode))
+		case ldap.ApplicationSearchRequest:
+			time.Sleep(d.delay)
+
+			baseDN := op.Children[0].Data.String()
+			scope := op.Children[1].Value.(int64)
+
+			var paging *ldap.ControlPaging
+			if len(request.Children) > 2 && d.paging != mockPagingIgnored {
+				for _, control := range request.Children[2].Children {
+					if c, ok := ldap.DecodeControl(control).(*ldap.ControlPaging); ok {
+						paging = c
+					}
+				}
+			}
+
+			referred := false
+			for context := range d.referrals {
+				if hasDNSuffix(baseDN, context) {
+					referred = true
+				}
+			}
+
+			if referred {
+				d.write(conn, messageID, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultReferral))
+				continue
+			}
+
+			if paging != nil && d.paging == mockPagingRejected {
+				d.write(conn, messageID, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultUnavailableCriticalExtension))
+				continue
+			}
+
+			matches := []string{}
+			for dn, attributes := range d.entries {
+				if (scope == ldap.ScopeBaseObject && !strings.EqualFold(dn, baseDN)) ||
+					!strings.HasSuffix(strings.ToLower(dn), strings.ToLower(baseDN)) ||
+					!matchFilter(op.Children[6], attributes) {
+					continue
+				}
+
+				matches = append(matches, dn)
+			}
+
+			// searches exceeding their size limit return the entries up to it, unpaged
+			sort.Strings(matches)
+			resultCode := int64(ldap.LDAPResultSuccess)
+			if sizeLimit := int(op.Children[3].Value.(int64)); sizeLimit > 0 && len(matches) > sizeLimit {
+				matches, paging = matches[:sizeLimit], nil
+				resultCode = ldap.LDAPResultSizeLimitExceeded
+			}
+
+			// the cookie is the offset of the next page in the sorted matches
+			if paging != nil {
+				offset, _ := strconv.Atoi(string(paging.Cookie))
+				end := offset + int(paging.PagingSize)
+				if end >= len(matches) {
+					end = len(matches)
+					paging.SetCookie(nil)
+				} else {
+					paging.SetCookie([]byte(strconv.Itoa(end)))
+				}
+				matches = matches[offset:end]
+			}
+
+			for _, dn := range matches {
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "objectName"))
+				list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+				for name, values := range d.entries[dn] {
+					attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+					attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+					set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+					for _, value := range values {
+						set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+					}
+					attribute.AppendChild(set)
+					list.AppendChild(attribute)
+				}
+				entry.AppendChild(list)
+
+				d.write(conn, messageID, entry)
+			}
+
+			// subtree searches are referred to the parts held by other servers on their last page
+			if scope != ldap.ScopeBaseObject && (paging == nil || len(paging.Cookie) == 0) {
+				for context, referral := range d.referrals {
+					if hasDNSuffix(context, baseDN) {
+						reference := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultReference, nil, "Search Result Reference")
+						reference.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, referral, "URI"))
+						d.write(conn, messageID, reference)
+					}
+				}
+			}
+
+			d.mutex.Lock()
+			d.pages++
+			d.mutex.Unlock()
+
+			if paging == nil {
+				d.write(conn, messageID, ldapResult(ldap.ApplicationSearchResultDone, resultCode))
+				continue
+			}
+
+			controls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+			controls.AppendChild(paging.Encode())
+			d.writeWithControls(conn, messageID, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess), controls)
+		default: // unbind
+			return
+		}
+	}
+}
+
+// dials returns the number of connections accepted so far
+func (d *mockDirectory) dials() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return len(d.conns)
+}
+
+// pagesReturned returns the number of pages of results returned so far; a
+// search without paging returns a single page
+func (d *mockDirectory) pagesReturned() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.pages
+}
+
+// dropConns closes all the connections accepted so far, like a restarted server
+func (d *mockDirectory) dropConns() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, conn := range d.conns {
+		conn.Close()
+	}
+}
+
+// write sends the given response to a request
+func (d *mockDirectory) write(conn net.Conn, messageID interface{}, op *ber.Packet) {
+	d.writeWithControls(conn, messageID, op, nil)
+}
+
+// writeWithControls sends the given response to a request along with the
+// given controls, if any
+func (d *mockDirectory) writeWithControls(conn net.Conn, messageID interface{}, op *ber.Packet, controls *ber.Packet) {
+	response := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	response.AppendChild(op)
+	if controls != nil {
+		response.AppendChild(controls)
+	}
+
+	conn.Write(response.Bytes())
+}
+
+// ldapResult returns a response carrying the given result code
+func ldapResult(tag ber.Tag, resultCode int64) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, resultCode, "resultCode"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+
+	return result
+}
+
+// matchFilter returns whether the given attributes match a search filter;
+// attribute names and values are compared case-insensitively
+func matchFilter(filter *ber.Packet, attributes map[string][]string) bool {
+	values := func(name string) []string {
+		for attribute, values := range attributes {
+			if strings.EqualFold(attribute, name) {
+				return values
+			}
+		}
+
+		return nil
+	}
+
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matchFilter(child, attributes) {
+				return false
+			}
+		}
+
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matchFilter(child, attributes) {
+				return true
+			}
+		}
+
+		return false
+	case ldap.FilterEqualityMatch:
+		for _, value := range values(filter.Children[0].Data.String()) {
+			if strings.EqualFold(value, filter.Children[1].Data.String()) {
+				return true
+			}
+		}
+
+		return false
+	case ldap.FilterSubstrings:
+		for _, value := range values(filter.Children[0].Data.String()) {
+			if matchSubstrings(strings.ToLower(value), filter.Children[1].Children) {
+				return true
+			}
+		}
+
+		return false
+	case ldap.FilterPresent:
+		return len(values(filter.Data.String())) > 0
+	}
+
+	return false
+}
+
+// matchSubstrings returns whether the given lower-cased value matches the
+// initial, any and final parts of a substrings filter
+func matchSubstrings(value string, parts []*ber.Packet) bool {
+	for _, part := range parts {
+		substring := strings.ToLower(part.Data.String())
+
+		switch part.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(value, substring) {
+				return false
+			}
+			value = value[len(substring):]
+		case ldap.FilterSubstringsAny:
+			i := strings.Index(value, substring)
+			if i < 0 {
+				return false
+			}
+			value = value[i+len(substring):]
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(value, substring) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// newGroupsDirectory returns a directory with user `jdoe` in TeamA, which is
+// nested in NetworkOps, and groups CycleA and CycleB which are members of each other
+func newGroupsDirectory() *mockDirectory {
+	return &mockDirectory{
+		entries: map[string]map[string][]string{
+			"CN=svc,DC=example,DC=com": {"objectClass": {"user"}, "sAMAccountName": {"svc"}},
+			"CN=jdoe,DC=example,DC=com": {"objectClass": {"user"}, "sAMAccountName": {"jdoe"}, "displayName": {"John Doe"},
+				"memberOf": {"CN=TeamA,DC=example,DC=com"}},
+			"CN=cyclic,DC=example,DC=com": {"objectClass": {"user"}, "sAMAccountName": {"cyclic"},
+				"memberOf": {"CN=CycleA,DC=example,DC=com"}},
+			"CN=TeamA,DC=example,DC=com":      {"objectClass": {"group"}, "memberOf": {"CN=NetworkOps,DC=example,DC=com"}},
+			"CN=NetworkOps,DC=example,DC=com": {"objectClass": {"group"}},
+			"CN=CycleA,DC=example,DC=com":     {"objectClass": {"group"}, "memberOf": {"CN=CycleB,DC=example,DC=com"}},
+			"CN=CycleB,DC=example,DC=com":     {"objectClass": {"group"}, "memberOf": {"CN=CycleA,DC=example,DC=com"}},
+		},
+		passwords: map[string]string{
+			"CN=svc,DC=example,DC=com":  "svc",
+			"CN=jdoe,DC=example,DC=com": "jdoe",
+		},
+	}
+}
+
+// TestNestedGroups tests resolving groups nested in other groups
+func TestNestedGroups(t *testing.T) {
+	port, stop := startMockDirectory(t, newGroupsDirectory())
+	defer stop()
+
+	lm := &Manager{Config: types.LdapConfiguration{
+		Server:                 "127.0.0.1",
+		Port:                   port,
+		BaseDN:                 "DC=example,DC=com",
+		ServiceAccountDN:       "CN=svc,DC=example,DC=com",
+		ServiceAccountPassword: "svc",
+	}}
+
+	testCases := []struct {
+		description string
+		username    string
+		expected    []string
+	}{
+		{"two levels", "jdoe", []string{"CN=NetworkOps,DC=example,DC=com", "CN=TeamA,DC=example,DC=com"}},
+		{"cycle", "cyclic", []string{"CN=CycleA,DC=example,DC=com", "CN=CycleB,DC=example,DC=com"}},
+	}
+
+	for _, tc := range testCases {
+		_, groups, err := lm.Lookup(tc.username)
+		if err != nil {
+			t.Errorf("%s: failed to look up %q: %v", tc.description, tc.username, err)
+			continue
+		}
+
+		sort.Strings(groups)
+		if strings.Join(groups, ";") != strings.Join(tc.expected, ";") {
+			t.Errorf("%s: expected groups %v, got %v", tc.description, tc.expected, groups)
+		}
+	}
+
+	// authentication resolves the same groups
+	if _, groups, _, err := lm.Authenticate("jdoe", "jdoe"); err != nil || len(groups) != 2 {
+		t.Errorf("expected jdoe to be authenticated with 2 groups, got %v, %v", groups, err)
+	}
+}
+
+// TestGroupNestingDepth tests that groups nested too deep are ignored
+func TestGroupNestingDepth(t *testing.T) {
+	port, stop := startMockDirectory(t, newGroupsDirectory())
+	defer stop()
+
+	lm := &Manager{Config: types.LdapConfiguration{Server: "127.0.0.1", Port: port}}
+	ldapConn, err := lm.connect()
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer ldapConn.Close()
+
+	testCases := []struct {
+		depth    int
+		expected []string
+	}{
+		{0, []string{"CN=TeamA,DC=example,DC=com"}},
+		{1, []string{"CN=TeamA,DC=example,DC=com", "CN=NetworkOps,DC=example,DC=com"}},
+		{10, []string{"CN=TeamA,DC=example,DC=com", "CN=NetworkOps,DC=example,DC=com"}},
+	}
+
+	for _, tc := range testCases {
+		groups, err := lm.expandGroups(ldapConn, []string{"CN=TeamA,DC=example,DC=com"}, tc.depth)
+		if err != nil {
+			t.Errorf("depth %d: failed to resolve groups: %v", tc.depth, err)
+		} else if strings.Join(groups, ";") != strings.Join(tc.expected, ";") {
+			t.Errorf("depth %d: expected groups %v, got %v", tc.depth, tc.expected, groups)
+		}
+	}
+}
+
+// TestGroupMembershipOnGroups tests resolving groups which record their members
+// on their own entries rather than on the users' entries, using OpenLDAP's
+// user schema
+func TestGroupMembershipOnGroups(t *testing.T) {
+	directory := &mockDirectory{
+		entries: map[string]map[string][]string{
+			"cn=svc,dc=example,dc=com": {"objectClass": {"top", "organizationalRole", "simpleSecurityObject"}, "cn": {"svc"}},
+			"uid=jdoe,ou=people,dc=example,dc=com": {"objectClass": {"top", "posixAccount", "inetOrgPerson"},
+				"uid": {"jdoe"}, "cn": {"John Doe"}, "sn": {"Doe"}, "uidNumber": {"1000"}, "gidNumber": {"1000"}, "homeDirectory": {"/home/jdoe"}},
+			"uid=asmith,ou=people,dc=example,dc=com": {"objectClass": {"top", "posixAccount", "inetOrgPerson"},
+				"uid": {"asmith"}, "cn": {"Alice Smith"}, "sn": {"Smith"}, "uidNumber": {"1001"}, "gidNumber": {"1001"}, "homeDirectory": {"/home/asmith"}},
+			"cn=netops,ou=groups,dc=example,dc=com": {"objectClass": {"top", "posixGroup"}, "gidNumber": {"2000"}, "memberUid": {"jdoe", "asmith"}},
+			"cn=devs,ou=groups,dc=example,dc=com":   {"objectClass": {"top", "posixGroup"}, "gidNumber": {"2001"}, "memberUid": {"asmith"}},
+			"cn=teamA,ou=groups,dc=example,dc=com":  {"objectClass": {"top", "groupOfNames"}, "member": {"uid=jdoe,ou=people,dc=example,dc=com"}},
+			"cn=ops,ou=groups,dc=example,dc=com":    {"objectClass": {"top", "groupOfNames"}, "member": {"cn=teamA,ou=groups,dc=example,dc=com"}},
+		},
+		passwords: map[string]string{"cn=svc,dc=example,dc=com": "svc"},
+	}
+
+	port, stop := startMockDirectory(t, directory)
+	defer stop()
+
+	testCases := []struct {
+		description string
+		userClass   string
+		objectClass string
+		attribute   string
+		expected    []string
+	}{
+		{"posixAccount, posixGroup", "posixAccount", "posixGroup", "memberUid", []string{"cn=netops,ou=groups,dc=example,dc=com"}},
+		{"inetOrgPerson, nested groupOfNames", "inetOrgPerson", "groupOfNames", "member",
+			[]string{"cn=ops,ou=groups,dc=example,dc=com", "cn=teamA,ou=groups,dc=example,dc=com"}},
+	}
+
+	for _, tc := range testCases {
+		lm := &Manager{Config: types.LdapConfiguration{
+			Server:                   "127.0.0.1",
+			Port:                     port,
+			BaseDN:                   "dc=example,dc=com",
+			ServiceAccountDN:         "cn=svc,dc=example,dc=com",
+			ServiceAccountPassword:   "svc",
+			LoginAttribute:           []string{"uid"},
+			UserObjectClass:          tc.userClass,
+			GroupObjectClass:         tc.objectClass,
+			GroupMembershipAttribute: tc.attribute,
+			GroupMembership:          types.LdapGroupMembershipGroup,
+		}}
+
+		dn, groups, err := lm.Lookup("jdoe")
+		if err != nil {
+			t.Errorf("%s: failed to look up jdoe: %v", tc.description, err)
+			continue
+		}
+
+		if dn != "uid=jdoe,ou=people,dc=example,dc=com" {
+			t.Errorf("%s: expected DN uid=jdoe,ou=people,dc=example,dc=com, got %q", tc.description, dn)
+		}
+
+		sort.Strings(groups)
+		if strings.Join(groups, ";") != strings.Join(tc.expected, ";") {
+			t.Errorf("%s: expected groups %v, got %v", tc.description, tc.expected, groups)
+		}
+	}
+
+	// users are AD's by default, which OpenLDAP's aren't
+	lm := &Manager{Config: types.LdapConfiguration{
+		Server:                   "127.0.0.1",
+		Port:                     port,
+		BaseDN:                   "dc=example,dc=com",
+		ServiceAccountDN:         "cn=svc,dc=example,dc=com",
+		ServiceAccountPassword:   "svc",
+		LoginAttribute:           []string{"uid"},
+		GroupObjectClass:         "posixGroup",
+		GroupMembershipAttribute: "memberUid",
+		GroupMembership:          types.LdapGroupMembershipGroup,
+	}}
+
+	if _, _, err := lm.Lookup("jdoe"); err != auth_errors.ErrUserNotFound {
+		t.Errorf("expected jdoe not to be found with the default user object class, got %v", err)
+	}
+}
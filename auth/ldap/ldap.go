@@ -2,7 +2,10 @@ package ldap
 
 import (
 	"crypto/tls"
-	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/contiv/auth_proxy/common"
@@ -40,38 +43,78 @@ import (
 //  Attributes: set of attributes to request for inclusion in entries that match the search criteria and are returned to the client.
 //  Controls: yet to figure out what it is; but it's been given a `nil` value everywhere
 
+// defaultLoginAttribute is the attribute users log in with unless
+// types.LdapConfiguration.LoginAttribute is set
+const defaultLoginAttribute = "sAMAccountName"
+
+// defaultUserObjectClass is the object class of the users unless
+// types.LdapConfiguration.UserObjectClass is set
+const defaultUserObjectClass = "user"
+
+// LoginAttributes returns the attributes users can log in with; the first one
+// holds their canonical name
+// params:
+//  cfg: LDAP configuration; its LoginAttribute takes precedence over the default
+func LoginAttributes(cfg *types.LdapConfiguration) []string {
+	if len(cfg.LoginAttribute) > 0 {
+		return cfg.LoginAttribute
+	}
+
+	return []string{defaultLoginAttribute}
+}
+
+// userObjectClass returns the object class of the users; AD's unless configured otherwise
+// params:
+//  cfg: LDAP configuration; its UserObjectClass takes precedence over the default
+func userObjectClass(cfg *types.LdapConfiguration) string {
+	if common.IsEmpty(cfg.UserObjectClass) {
+		return defaultUserObjectClass
+	}
+
+	return cfg.UserObjectClass
+}
+
 // Manager provides the implementation of LDAP Manager fields:
 //   Config: LDAP/AD configuration
 type Manager struct {
 	Config types.LdapConfiguration
 }
 
-// Authenticate is a helper function which just sets the configuration and calls ldap authentication
+// Authenticate is a helper function which just sets the configuration and calls ldap authentication.
+// Successful logins are cached if common.LdapCacheTTLKey is set (see AuthenticateFromCache()).
 // params:
 //  username: username to authenticate
 //  password: password of the user
 // return values:
 //  string: active directory DN; fully qualified domain name of the given user
 //  []string: list of principals (LDAP group names that the user belongs)
+//  map[string]string: attributes of the user (see UserAttributes())
 //  ErrLDAPConfigurationNotFound if the config is not found or as returned by ldapManager.Authenticate
-func Authenticate(username, password string) (string, []string, error) {
+func Authenticate(username, password string) (string, []string, map[string]string, error) {
 	cfg, err := db.GetLdapConfiguration()
 	if err != nil {
-		return "", nil, err
+		return "", nil, nil, err
 	}
 
 	cfg.ServiceAccountPassword, err = common.Decrypt(cfg.ServiceAccountPassword)
 	if err != nil {
-		return "", nil, err
+		return "", nil, nil, err
 	}
 
 	if cfg != nil {
 		ldapManager := Manager{Config: *cfg}
-		return ldapManager.Authenticate(username, password)
+		dn, groups, attributes, err := ldapManager.Authenticate(username, password)
+		if err == nil {
+			if err := cacheLogin(cfg, username, password, dn, groups, attributes); err != nil {
+				log.Warnf("failed to cache LDAP login of %q: %v", username, err)
+			}
+		}
+
+		return dn, groups, attributes, err
 	}
 
 	log.Errorf("LDAP/AD configuration not found")
-	return "", nil, auth_errors.ErrLDAPConfigurationNotFound
+	return "", nil, nil, auth_errors.ErrLDAPConfigurationNotFound
 }
 
 // Authenticate authenticates the given username and password against `AD` using LDAP client
@@ -81,162 +124,341 @@ func Authenticate(username, password string) (string, []string, error) {
 // return values:
 //  string: active directory DN; fully qualified domain name of the given user
 //  []string containing LDAP group names of the user on successful authentication else nil
+//  map[string]string: attributes of the user (see UserAttributes()); the ones the user doesn't have are left out
 //  error: nil on successful authentication otherwise ErrLDAPAccessDenied, ErrUserNotFound, etc.
-func (lm *Manager) Authenticate(username, password string) (string, []string, error) {
-	// list of attributes to be fetched from the matching records
-	var attributes = []string{
-		"memberof",
-	}
-
-	// establish a connection with AD server
-	ldapConn, err := lm.connect()
+//         ErrLDAPConnectionFailed means that the directory couldn't be reached or didn't respond in time,
+//         ErrLDAPTLSFailed that a secure connection couldn't be negotiated
+func (lm *Manager) Authenticate(username, password string) (dn string, groups []string, attributes map[string]string, err error) {
+	// get a connection with AD server bound as the service account
+	ldapConn, err := lm.acquire()
 	if err != nil {
-		return "", nil, err
+		return "", nil, nil, err
 	}
 
-	defer ldapConn.Close()
-
-	// bind AD service account to perform search using the connection established above
-	if err := ldapConn.Bind(lm.Config.ServiceAccountDN, lm.Config.ServiceAccountPassword); err != nil {
-		log.Errorf("LDAP bind operation failed for AD service account %q: %v", lm.Config.ServiceAccountDN, err)
-		return "", nil, auth_errors.ErrLDAPAccessDenied
-	}
+	defer func() { lm.release(ldapConn, err) }()
 
-	searchRequest := ldap.NewSearchRequest(
-		lm.Config.BaseDN,
-		ldap.ScopeWholeSubtree, ldap.DerefAlways, 0, 0, false,
-		"(&(objectClass=user)(sAMAccountName="+username+"))", // query is targeted for user entity
-		attributes,
-		nil)
-
-	// search LDAP for the given `username`
-	searchRes, err := ldapConn.Search(searchRequest)
+	entry, err := lm.searchUser(ldapConn, username)
 	if err != nil {
-		log.Errorf("LDAP search operation failed for %q: %v", username, err)
-		return "", nil, auth_errors.ErrLDAPAccessDenied
-	} else if len(searchRes.Entries) == 0 { // none matched the search criteria
-		log.Errorf("User %q not found in AD server", username)
-		return "", nil, auth_errors.ErrUserNotFound
-	} else if len(searchRes.Entries) > 1 { // > 1 user found with the given search criteria
-		log.Errorf("Found %q entries while searching for %q", len(searchRes.Entries), username)
-		return "", nil, auth_errors.ErrLDAPMultipleEntries
+		return "", nil, nil, err
 	}
 
 	// validate user `password`
-	adUsername := searchRes.Entries[0].DN                       // this need not be specified in attribute list; results will always carry DN
+	adUsername := entry.DN                                      // this need not be specified in attribute list; results will always carry DN
 	if err := ldapConn.Bind(adUsername, password); err != nil { // bind using the given username and password
 		log.Errorf("LDAP bind operation failed for AD user account: %v", err)
-		return "", nil, auth_errors.ErrLDAPAccessDenied
+		return "", nil, nil, accessError(err)
 	}
 
 	// get user AD groups
-	groups, err := lm.getUserGroups(ldapConn, searchRes.Entries[0].GetAttributeValues("memberOf"))
+	groups, err = lm.getUserGroups(ldapConn, entry, lm.canonicalName(entry, username))
 	if err != nil {
-		return "", nil, err
+		return "", nil, nil, err
 	}
 
 	log.Debugf("Authorized groups:%#v", groups)
 	log.Info("AD authentication successful")
 
-	return adUsername, groups, nil
+	return adUsername, groups, entryAttributes(entry, UserAttributes(&lm.Config)), nil
 }
 
-// getUserGroups performs a nested search on the given first-level user groups to uncover all the groups that the user is part of.
+// Lookup is a helper function which just sets the configuration and calls ldap lookup.
 // params:
-//  ldapConn: LDAP connection object
-//  groups: list of first-level user groups
+//  username: username to look up
 // return values:
-//  on successful search, array of unique groups that user is part-of otherwise any relevant error
-func (lm *Manager) getUserGroups(ldapConn *ldap.Conn, groups []string) ([]string, error) {
-	if len(groups) == 0 {
-		// this happens when the user is just part of the primary group; we won't attempt to handle this case!
-		// more details here: http://lists.freeradius.org/pipermail/freeradius-users/2012-August/062055.html
-		log.Debug("User is just part of primary group; can't proceed further")
-		return []string{}, auth_errors.ErrLDAPGroupsNotFound
+//  string: active directory DN; fully qualified domain name of the given user
+//  []string: list of principals (LDAP group names that the user belongs)
+//  ErrLDAPConfigurationNotFound if the config is not found or as returned by ldapManager.Lookup
+func Lookup(username string) (string, []string, error) {
+	cfg, err := db.GetLdapConfiguration()
+	if err != nil {
+		return "", nil, err
 	}
 
-	var attributes = []string{
-		"memberof",
+	cfg.ServiceAccountPassword, err = common.Decrypt(cfg.ServiceAccountPassword)
+	if err != nil {
+		return "", nil, err
 	}
 
-	// below is a similar implementation of FIFO queue
-	processedGroups := make(map[string]bool) // to track processed groups during nested search
+	ldapManager := Manager{Config: *cfg}
+	return ldapManager.Lookup(username)
+}
 
-	for len(groups) > 0 {
-		adGroup := groups[0]
-		groups = groups[1:] // chop the processed groups
-		if processedGroups[adGroup] {
-			continue
-		}
+// Lookup finds the given user in `AD` and its groups without authenticating the
+// user, for users who were authenticated by other means, e.g. a client certificate
+// params:
+//  username: username to look up
+// return values:
+//  string: active directory DN; fully qualified domain name of the given user
+//  []string containing LDAP group names of the user if the user was found else nil
+//  error: nil if the user was found otherwise ErrUserNotFound, ErrLDAPAccessDenied, etc.
+//         ErrLDAPConnectionFailed means that the directory couldn't be reached or didn't respond in time,
+//         ErrLDAPTLSFailed that a secure connection couldn't be negotiated
+func (lm *Manager) Lookup(username string) (dn string, groups []string, err error) {
+	ldapConn, err := lm.acquire()
+	if err != nil {
+		return "", nil, err
+	}
 
-		processedGroups[adGroup] = true
+	defer func() { lm.release(ldapConn, err) }()
 
-		// process active directory group `adGroup`; get group's memberOf set. base object search will always return only a single entry (specified by the DN)
-		searchRequest := ldap.NewSearchRequest(
-			adGroup, // distinguished name of the group in the base domain
-			ldap.ScopeBaseObject, ldap.DerefAlways, 0, 0, false,
-			"(objectClass=group)", // search filter; search is restricted to `group` as we are not focusing on other entities here
-			attributes,
-			nil)
+	entry, err := lm.searchUser(ldapConn, username)
+	if err != nil {
+		return "", nil, err
+	}
 
-		searchRes, err := ldapConn.Search(searchRequest)
-		if err != nil {
-			log.Errorf("LDAP search operation failed for AD group %q, error %#v", adGroup, err)
-			return nil, auth_errors.ErrLDAPAccessDenied
-		}
+	groups, err = lm.getUserGroups(ldapConn, entry, lm.canonicalName(entry, username))
+	if err != nil {
+		return "", nil, err
+	}
 
-		if len(searchRes.Entries) > 1 { // we should never hit this case!
-			return []string{}, auth_errors.ErrLDAPMultipleEntries
-		}
+	return entry.DN, groups, nil
+}
 
-		// look for possible subgroups to be further processed
-		subGroups := searchRes.Entries[0].GetAttributeValues("memberOf")
-		for _, sGrp := range subGroups {
-			if !processedGroups[sGrp] {
-				groups = append(groups, sGrp)
-			}
+// LookupDN is a helper function which just sets the configuration and calls ldap lookup by DN.
+// params:
+//  dn: DN of the user to look up
+// return values:
+//  []string: list of principals (LDAP group names that the user belongs)
+//  ErrLDAPConfigurationNotFound if the config is not found or as returned by ldapManager.LookupDN
+func LookupDN(dn string) ([]string, error) {
+	cfg, err := db.GetLdapConfiguration()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ServiceAccountPassword, err = common.Decrypt(cfg.ServiceAccountPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	ldapManager := Manager{Config: *cfg}
+	return ldapManager.LookupDN(dn)
+}
+
+// adAccountDisabled is the ACCOUNTDISABLE flag of AD's userAccountControl attribute
+const adAccountDisabled = 0x2
+
+// LookupDN finds the user with the given DN in `AD` and its current groups, for
+// credentials which were issued to the user earlier and are only valid as long
+// as the user is, e.g. personal access tokens
+// params:
+//  dn: DN of the user, as returned by Authenticate()
+// return values:
+//  []string containing LDAP group names of the user if the user was found else nil
+//  error: nil if the user was found otherwise ErrUserNotFound, ErrUserDisabled if the
+//         AD account is disabled, ErrLDAPGroupsNotFound, ErrLDAPAccessDenied, etc.
+//         ErrLDAPConnectionFailed means that the directory couldn't be reached or didn't respond in time
+func (lm *Manager) LookupDN(dn string) (groups []string, err error) {
+	ldapConn, err := lm.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { lm.release(ldapConn, err) }()
+
+	_, membershipAttribute := groupSchema(&lm.Config)
+	searchRequest := ldap.NewSearchRequest(
+		dn,
+		ldap.ScopeBaseObject, ldap.DerefAlways, 0, searchTimeLimit(&lm.Config), false,
+		equalityFilter("objectClass", userObjectClass(&lm.Config)),
+		[]string{membershipAttribute, LoginAttributes(&lm.Config)[0], "userAccountControl"},
+		nil)
+
+	searchRes, err := lm.search(ldapConn, searchRequest)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || (err == nil && len(searchRes.Entries) != 1) {
+		log.Errorf("User %q not found in AD server", dn)
+		return nil, auth_errors.ErrUserNotFound
+	} else if err != nil {
+		log.Errorf("LDAP search operation failed for %q: %v", dn, err)
+		return nil, accessError(err)
+	}
+
+	entry := searchRes.Entries[0]
+	for _, value := range attributeValues(entry, "userAccountControl") {
+		if flags, err := strconv.ParseInt(value, 10, 64); err == nil && flags&adAccountDisabled != 0 {
+			log.Errorf("AD account %q is disabled", dn)
+			return nil, auth_errors.ErrUserDisabled
 		}
 	}
 
-	// authorized groups of the user
-	result := []string{}
-	for group := range processedGroups { // all the entries in this map are valid
-		result = append(result, group)
+	return lm.getUserGroups(ldapConn, entry, lm.canonicalName(entry, ""))
+}
+
+// searchUser searches for the given user by any of the LoginAttributes().
+// params:
+//  ldapConn: LDAP connection object bound as the AD service account
+//  username: username to search for
+// return values:
+//  *ldap.Entry: the user's entry, carrying its first-level groups if the membership is recorded on user entries,
+//               its canonical name and the attributes returned by UserAttributes()
+//  error: nil if exactly one user was found otherwise ErrUserNotFound,
+//         ErrLDAPMultipleEntries or as returned by accessError()
+func (lm *Manager) searchUser(ldapConn *ldap.Conn, username string) (*ldap.Entry, error) {
+	loginAttributes := LoginAttributes(&lm.Config)
+
+	// list of attributes to be fetched from the matching records
+	_, membershipAttribute := groupSchema(&lm.Config)
+	var attributes = append([]string{
+		membershipAttribute,
+		loginAttributes[0],
+	}, UserAttributes(&lm.Config)...)
+
+	filters := []string{}
+	for _, attribute := range loginAttributes {
+		filters = append(filters, equalityFilter(attribute, username))
 	}
 
-	return result, nil
+	searchRequest := ldap.NewSearchRequest(
+		lm.Config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.DerefAlways, 0, searchTimeLimit(&lm.Config), false,
+		andFilter(equalityFilter("objectClass", userObjectClass(&lm.Config)), orFilter(filters...)), // query is targeted for user entity
+		attributes,
+		nil)
+
+	// search LDAP for the given `username`
+	searchRes, err := lm.search(ldapConn, searchRequest)
+	if err != nil {
+		log.Errorf("LDAP search operation failed for %q: %v", username, err)
+		return nil, accessError(err)
+	} else if len(searchRes.Entries) == 0 { // none matched the search criteria
+		log.Errorf("User %q not found in AD server", username)
+		return nil, auth_errors.ErrUserNotFound
+	} else if len(searchRes.Entries) > 1 { // > 1 user found with the given search criteria
+		log.Errorf("Found %d entries while searching for %q", len(searchRes.Entries), username)
+		return nil, auth_errors.ErrLDAPMultipleEntries
+	}
+
+	return searchRes.Entries[0], nil
 }
 
-// connect establishes a LDAP connection with the given Active Directory configuration(receiver)
+// canonicalName returns the user's name held by the first of the
+// LoginAttributes(), whichever attribute they logged in with, so that e.g.
+// logging in with the UPN and the sAMAccountName gives the same groups.
+// params:
+//  entry: the user's entry, as returned by searchUser()
+//  username: username the user logged in with; returned if the entry has no canonical name
+func (lm *Manager) canonicalName(entry *ldap.Entry, username string) string {
+	if values := attributeValues(entry, LoginAttributes(&lm.Config)[0]); len(values) > 0 && values[0] != "" {
+		return values[0]
+	}
+
+	return username
+}
+
+// ldapTimeoutMessage is the message of the error go-ldap returns for requests
+// which time out (see ldap.Conn.SetTimeout())
+const ldapTimeoutMessage = "ldap: connection timed out"
+
+// searchTimeLimit returns the time limit (in seconds) of searches, which the
+// server enforces along with the client's timeout
+func searchTimeLimit(cfg *types.LdapConfiguration) int {
+	return int(searchTimeout(cfg) / time.Second)
+}
+
+// accessError returns the error for a failed LDAP operation: ErrLDAPConnectionFailed
+// if the directory couldn't be reached or didn't respond in time, ErrLDAPAccessDenied otherwise
+func accessError(err error) error {
+	if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) || err.Error() == ldapTimeoutMessage {
+		return auth_errors.ErrLDAPConnectionFailed
+	}
+
+	return auth_errors.ErrLDAPAccessDenied
+}
+
+// connect establishes a LDAP connection with the given Active Directory configuration(receiver).
+// The servers are tried in order, starting with the one connected to last (see orderServers()),
+// until one of them can be connected to.
 // return values:
-//  on successful connection with AD, returns a LDAP connection object otherwise ErrLDAPConnectionFailed
+//  on successful connection with AD, returns a LDAP connection object otherwise ErrLDAPConnectionFailed,
+//  or ErrLDAPTLSFailed if TLS couldn't be negotiated with any of the servers tried
 func (lm *Manager) connect() (*ldap.Conn, error) {
-	ldapConn, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", lm.Config.Server, lm.Config.Port))
+	addresses := orderServers(serverAddresses(&lm.Config))
+	timeout := connectTimeout(&lm.Config)
+
+	var connErr error
+	for _, address := range addresses {
+		ldapConn, err := lm.connectTo(address, timeout)
+		if err == nil {
+			rememberServer(address)
+			return ldapConn, nil
+		}
+
+		log.Warnf("Failed to connect to AD server %s: %v", address, err)
+
+		// a server we couldn't talk to securely mustn't be mistaken for an unreachable one
+		if connErr != auth_errors.ErrLDAPTLSFailed {
+			connErr = err
+		}
+	}
+
+	log.Errorf("Failed to connect to any AD server; tried %s", strings.Join(addresses, ", "))
+	rememberFailedServers(addresses)
+
+	return nil, connErr
+}
+
+// connectTo establishes a LDAP connection with the given server. With StartTLS, the
+// connection is upgraded before anything is sent over it; nothing is ever sent in
+// cleartext if the upgrade fails.
+// params:
+//  address: host:port of the server
+//  timeout: time allowed to connect, including the TLS handshake
+// return values:
+//  on successful connection with AD, returns a LDAP connection object otherwise ErrLDAPConnectionFailed,
+//  or ErrLDAPTLSFailed if the TLS configuration is invalid or TLS couldn't be negotiated
+func (lm *Manager) connectTo(address string, timeout time.Duration) (*ldap.Conn, error) {
+	var tlsConfig *tls.Config
+	if lm.Config.StartTLS || lm.Config.UseLDAPS {
+		host, _, _ := net.SplitHostPort(address)
+
+		var err error
+		if tlsConfig, err = TLSConfig(&lm.Config, host); err != nil {
+			log.Errorf("Invalid TLS configuration of AD server: %v", err)
+			return nil, auth_errors.ErrLDAPTLSFailed
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
 	if err != nil {
 		log.Errorf("Failed to connect to AD server:%v", err)
-		return nil, fmt.Errorf("%v, %v", auth_errors.ErrLDAPConnectionFailed, err)
+		return nil, auth_errors.ErrLDAPConnectionFailed
 	}
 
-	// switch to TLS if specified; this needs to have certs in place
-	if lm.Config.StartTLS {
+	// the deadline covers the TLS handshake; it's lifted once connected
+	conn.SetDeadline(time.Now().Add(timeout))
 
-		// NOTE: InsecureSkipVerify should be used only for testing
-		if !common.IsEmpty(lm.Config.TLSCertIssuedTo) {
-			log.Info("Upgrading to TLS mode")
-			err = ldapConn.StartTLS(&tls.Config{ServerName: lm.Config.TLSCertIssuedTo})
-		} else if lm.Config.InsecureSkipVerify {
-			log.Infof("Upgrading to TLS mode with `InsecureSkipVerify=%v`", lm.Config.InsecureSkipVerify)
-			err = ldapConn.StartTLS(&tls.Config{InsecureSkipVerify: lm.Config.InsecureSkipVerify})
-		} else {
-			log.Infof(lm.Config.TLSCertIssuedTo, lm.Config.InsecureSkipVerify)
-			err = fmt.Errorf("InsecureSkipVerify or TLSCertIssuedTo must be provided for TLS/SSL connection")
+	if lm.Config.UseLDAPS {
+		log.Infof("Connecting to AD server over TLS with `InsecureSkipVerify=%v`", lm.Config.InsecureSkipVerify)
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			log.Errorf("Failed to negotiate TLS with AD server: %v", err)
+			return nil, auth_errors.ErrLDAPTLSFailed
 		}
 
-		if err != nil {
+		conn.SetDeadline(time.Time{})
+
+		ldapConn := ldap.NewConn(tlsConn, true)
+		ldapConn.SetTimeout(searchTimeout(&lm.Config))
+		ldapConn.Start()
+		return ldapConn, nil
+	}
+
+	ldapConn := ldap.NewConn(conn, false)
+	ldapConn.SetTimeout(searchTimeout(&lm.Config))
+	ldapConn.Start()
+
+	// switch to TLS if specified; this needs to have certs in place
+	if lm.Config.StartTLS {
+		log.Infof("Upgrading to TLS mode with `InsecureSkipVerify=%v`", lm.Config.InsecureSkipVerify)
+		if err := ldapConn.StartTLS(tlsConfig); err != nil {
+			ldapConn.Close()
 			log.Errorf("Failed to initiate TLS with AD server: %v", err)
-			return nil, fmt.Errorf("%v, %v", auth_errors.ErrLDAPConnectionFailed, err)
+			return nil, auth_errors.ErrLDAPTLSFailed
 		}
 	}
 
+	conn.SetDeadline(time.Time{})
+
 	return ldapConn, nil
 }
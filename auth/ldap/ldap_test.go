@@ -0,0 +1,126 @@
+package ldap
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestLoginAttributes tests logging in with any of the configured login attributes
+func TestLoginAttributes(t *testing.T) {
+	directory := &mockDirectory{
+		entries: map[string]map[string][]string{
+			"CN=svc,DC=example,DC=com": {"objectClass": {"user"}, "sAMAccountName": {"svc"}},
+			"CN=jdoe,DC=example,DC=com": {"objectClass": {"user"}, "sAMAccountName": {"jdoe"},
+				"userPrincipalName": {"jdoe@example.com"}},
+			"cn=netops,DC=example,DC=com": {"objectClass": {"posixGroup"}, "memberUid": {"jdoe"}},
+			"cn=devs,DC=example,DC=com":   {"objectClass": {"posixGroup"}, "memberUid": {"jdoe@example.com"}},
+		},
+		passwords: map[string]string{"CN=svc,DC=example,DC=com": "svc", "CN=jdoe,DC=example,DC=com": "jdoe"},
+	}
+
+	port, stop := startMockDirectory(t, directory)
+	defer stop()
+
+	testCases := []struct {
+		description    string
+		loginAttribute []string
+		username       string
+		expected       []string
+		err            error
+	}{
+		{"default", nil, "jdoe", []string{"cn=netops,DC=example,DC=com"}, nil},
+		{"UPN not configured", nil, "jdoe@example.com", nil, auth_errors.ErrUserNotFound},
+		{"UPN", []string{"userPrincipalName"}, "jdoe@example.com", []string{"cn=devs,DC=example,DC=com"}, nil},
+		// groups are matched against the first attribute, whichever one users log in with
+		{"sAMAccountName first, log in with UPN", []string{"sAMAccountName", "userPrincipalName"}, "jdoe@example.com", []string{"cn=netops,DC=example,DC=com"}, nil},
+		{"sAMAccountName first, log in with sAMAccountName", []string{"sAMAccountName", "userPrincipalName"}, "jdoe", []string{"cn=netops,DC=example,DC=com"}, nil},
+		{"UPN first, log in with sAMAccountName", []string{"userPrincipalName", "sAMAccountName"}, "jdoe", []string{"cn=devs,DC=example,DC=com"}, nil},
+		{"filter injection", []string{"sAMAccountName", "userPrincipalName"}, "*", nil, auth_errors.ErrUserNotFound},
+	}
+
+	for _, tc := range testCases {
+		lm := &Manager{Config: types.LdapConfiguration{
+			Server:                   "127.0.0.1",
+			Port:                     port,
+			BaseDN:                   "DC=example,DC=com",
+			ServiceAccountDN:         "CN=svc,DC=example,DC=com",
+			ServiceAccountPassword:   "svc",
+			GroupObjectClass:         "posixGroup",
+			GroupMembershipAttribute: "memberUid",
+			GroupMembership:          types.LdapGroupMembershipGroup,
+			LoginAttribute:           tc.loginAttribute,
+		}}
+
+		dn, groups, _, err := lm.Authenticate(tc.username, "jdoe")
+		if err != tc.err {
+			t.Errorf("%s: expected error %v, got %v", tc.description, tc.err, err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		// tokens carry the DN, so users get the same identity whichever name they log in with
+		if dn != "CN=jdoe,DC=example,DC=com" {
+			t.Errorf("%s: expected DN CN=jdoe,DC=example,DC=com, got %q", tc.description, dn)
+		}
+
+		sort.Strings(groups)
+		if strings.Join(groups, ";") != strings.Join(tc.expected, ";") {
+			t.Errorf("%s: expected groups %v, got %v", tc.description, tc.expected, groups)
+		}
+	}
+}
+
+// TestLookupDN tests looking up the current groups of a user by DN, e.g. for
+// personal access tokens
+func TestLookupDN(t *testing.T) {
+	directory := newGroupsDirectory()
+	directory.entries["CN=disabled,DC=example,DC=com"] = map[string][]string{"objectClass": {"user"}, "sAMAccountName": {"disabled"},
+		"userAccountControl": {"514"}, "memberOf": {"CN=TeamA,DC=example,DC=com"}}
+
+	port, stop := startMockDirectory(t, directory)
+	defer stop()
+
+	lm := &Manager{Config: types.LdapConfiguration{
+		Server:                 "127.0.0.1",
+		Port:                   port,
+		BaseDN:                 "DC=example,DC=com",
+		ServiceAccountDN:       "CN=svc,DC=example,DC=com",
+		ServiceAccountPassword: "svc",
+	}}
+
+	groups, err := lm.LookupDN("CN=jdoe,DC=example,DC=com")
+	sort.Strings(groups)
+	if err != nil || strings.Join(groups, ";") != "CN=NetworkOps,DC=example,DC=com;CN=TeamA,DC=example,DC=com" {
+		t.Errorf("expected jdoe's groups, got %v, %v", groups, err)
+	}
+
+	// the groups are the user's current ones
+	directory.entries["CN=jdoe,DC=example,DC=com"]["memberOf"] = []string{"CN=CycleA,DC=example,DC=com"}
+	groups, err = lm.LookupDN("CN=jdoe,DC=example,DC=com")
+	sort.Strings(groups)
+	if err != nil || strings.Join(groups, ";") != "CN=CycleA,DC=example,DC=com;CN=CycleB,DC=example,DC=com" {
+		t.Errorf("expected jdoe's new groups, got %v, %v", groups, err)
+	}
+
+	testCases := []struct {
+		dn  string
+		err error
+	}{
+		{"CN=disabled,DC=example,DC=com", auth_errors.ErrUserDisabled},
+		{"CN=gone,DC=example,DC=com", auth_errors.ErrUserNotFound},
+		{"CN=TeamA,DC=example,DC=com", auth_errors.ErrUserNotFound}, // not a user
+	}
+
+	for _, tc := range testCases {
+		if _, err := lm.LookupDN(tc.dn); err != tc.err {
+			t.Errorf("%s: expected error %v, got %v", tc.dn, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package ldap
+
+import (
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/contiv/auth_proxy/common"
+	ldap "github.com/go-ldap/ldap"
+)
+
+// This file contains the paged searches (RFC 2696): directories cap the number
+// of entries a search returns (1000 by default on AD), which large group result
+// sets exceed, so searches ask for the entries a page at a time instead.
+// The paging control isn't critical; servers which don't support it either
+// ignore it and return all the entries at once, or reject the search, which
+// is then run again without it.
+
+// defaultPageSize is the number of entries requested per page unless
+// common.LdapPageSizeKey is set
+const defaultPageSize = 500
+
+// pageSize returns the number of entries to request per page; 0 disables paging
+func pageSize() uint32 {
+	value, err := common.Global().Get(common.LdapPageSizeKey)
+	if err != nil || common.IsEmpty(value) {
+		return defaultPageSize
+	}
+
+	size, err := strconv.ParseUint(value, 10, 32) // already validated
+	if err != nil {
+		return defaultPageSize
+	}
+
+	return uint32(size)
+}
+
+// pagedSearch runs the given search page by page, and returns the entries of
+// all the pages. Searches with a size limit aren't paged: go-ldap drops the
+// entries of the page exceeding the limit.
+// params:
+//  ldapConn: LDAP connection object
+//  searchRequest: search to run; it's left untouched
+// return values:
+//  *ldap.SearchResult: entries found, and the referrals to other servers
+//  error: nil if successful, else as returned by ldap.Conn.Search()
+func pagedSearch(ldapConn *ldap.Conn, searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	size := pageSize()
+	if size == 0 || searchRequest.SizeLimit > 0 {
+		return ldapConn.Search(searchRequest)
+	}
+
+	// go-ldap adds the paging control to the request, and leaves the last cookie in it
+	pagedRequest := *searchRequest
+	searchRes, err := ldapConn.SearchWithPaging(&pagedRequest, size)
+	if err == nil || !pagingUnsupported(err) {
+		return searchRes, err
+	}
+
+	log.Debugf("LDAP server doesn't support paged searches, searching without paging: %v", err)
+
+	return ldapConn.Search(searchRequest)
+}
+
+// pagingUnsupported returns whether the given error is a server's rejection of
+// the paging control
+func pagingUnsupported(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.LDAPResultUnavailableCriticalExtension) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultUnwillingToPerform)
+}
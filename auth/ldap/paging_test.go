@@ -0,0 +1,68 @@
+package ldap
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestPagedSearch tests that the groups of a user are found across several
+// pages of results, and on servers which don't support paging
+func TestPagedSearch(t *testing.T) {
+	common.Global().Set(common.LdapPageSizeKey, "2")
+	defer common.Global().Set(common.LdapPageSizeKey, "")
+
+	testCases := []struct {
+		description string
+		paging      mockPaging
+		pages       int
+	}{
+		// the user's search returns 1 page, its 5 groups 3 pages, and the
+		// search of the parents of each group 1 page
+		{"paged", mockPagingSupported, 9},
+		{"control ignored", mockPagingIgnored, 7},
+		// rejected searches return no page, and are run again without paging
+		{"control rejected", mockPagingRejected, 7},
+	}
+
+	for _, tc := range testCases {
+		directory := &mockDirectory{
+			entries: map[string]map[string][]string{
+				"CN=svc,DC=example,DC=com":  {"objectClass": {"user"}, "sAMAccountName": {"svc"}},
+				"CN=jdoe,DC=example,DC=com": {"objectClass": {"user"}, "sAMAccountName": {"jdoe"}},
+			},
+			passwords: map[string]string{"CN=svc,DC=example,DC=com": "svc"},
+			paging:    tc.paging,
+		}
+
+		for i := 0; i < 5; i++ {
+			dn := fmt.Sprintf("cn=group%d,DC=example,DC=com", i)
+			directory.entries[dn] = map[string][]string{"objectClass": {"posixGroup"}, "memberUid": {"jdoe"}}
+		}
+
+		port, stop := startMockDirectory(t, directory)
+
+		lm := &Manager{Config: types.LdapConfiguration{
+			Server:                   "127.0.0.1",
+			Port:                     port,
+			BaseDN:                   "DC=example,DC=com",
+			ServiceAccountDN:         "CN=svc,DC=example,DC=com",
+			ServiceAccountPassword:   "svc",
+			GroupObjectClass:         "posixGroup",
+			GroupMembershipAttribute: "memberUid",
+			GroupMembership:          types.LdapGroupMembershipGroup,
+		}}
+
+		if _, groups, err := lm.Lookup("jdoe"); err != nil || len(groups) != 5 {
+			t.Errorf("%s: expected jdoe to be found with 5 groups, got %v, %v", tc.description, groups, err)
+		}
+
+		if directory.pagesReturned() != tc.pages {
+			t.Errorf("%s: expected %d pages of results, got %d", tc.description, tc.pages, directory.pagesReturned())
+		}
+
+		stop()
+	}
+}
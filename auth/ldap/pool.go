@@ -0,0 +1,168 @@
+package ldap
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	ldap "github.com/go-ldap/ldap"
+)
+
+// This file contains the pool of connections to the directory, which are reused
+// across logins rather than dialing and tearing down a connection each time.
+// A connection is bound as the service account whenever it's taken from the
+// pool, which checks that the server hasn't closed it and undoes any bind of a
+// user made over it, successful or not.
+
+// defaults of the pool unless common.LdapPoolSizeKey and
+// common.LdapPoolIdleTimeoutKey are set
+const (
+	defaultPoolSize        = 4
+	defaultPoolIdleTimeout = 60 * time.Second
+)
+
+// pooledConn is an idle connection in the pool
+type pooledConn struct {
+	conn      *ldap.Conn
+	idleSince time.Time
+}
+
+var (
+	poolMutex  sync.Mutex
+	poolConfig types.LdapConfiguration // configuration the pooled connections were made with
+	pool       []pooledConn
+)
+
+// poolSize returns the number of idle connections kept in the pool
+func poolSize() int {
+	value, err := common.Global().Get(common.LdapPoolSizeKey)
+	if err != nil || common.IsEmpty(value) {
+		return defaultPoolSize
+	}
+
+	size, err := strconv.Atoi(value) // already validated
+	if err != nil {
+		return defaultPoolSize
+	}
+
+	return size
+}
+
+// poolIdleTimeout returns the time after which idle connections are closed
+func poolIdleTimeout() time.Duration {
+	value, err := common.Global().Get(common.LdapPoolIdleTimeoutKey)
+	if err != nil || common.IsEmpty(value) {
+		return defaultPoolIdleTimeout
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64) // already validated
+	if err != nil || seconds <= 0 {
+		return defaultPoolIdleTimeout
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// takeConn takes the most recently used idle connection out of the pool.
+// Connections made with another configuration or idle for too long are closed.
+// return values:
+//  *ldap.Conn: the connection, or nil if there's none
+func (lm *Manager) takeConn() *ldap.Conn {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+
+	if !reflect.DeepEqual(poolConfig, lm.Config) {
+		closeConns(pool)
+		pool = nil
+		poolConfig = lm.Config
+	}
+
+	timeout := poolIdleTimeout()
+	for len(pool) > 0 {
+		pooled := pool[len(pool)-1]
+		pool = pool[:len(pool)-1]
+
+		if time.Since(pooled.idleSince) <= timeout {
+			return pooled.conn
+		}
+
+		pooled.conn.Close()
+	}
+
+	return nil
+}
+
+// acquire returns a connection bound as the service account, taken from the
+// pool if possible; connections which the server closed are replaced transparently.
+// return values:
+//  *ldap.Conn: the connection; to be handed back with release()
+//  error: nil if successful, else as returned by connect() or accessError()
+func (lm *Manager) acquire() (*ldap.Conn, error) {
+	for {
+		ldapConn := lm.takeConn()
+		if ldapConn == nil {
+			break
+		}
+
+		err := ldapConn.Bind(lm.Config.ServiceAccountDN, lm.Config.ServiceAccountPassword)
+		if err == nil {
+			return ldapConn, nil
+		}
+
+		ldapConn.Close()
+		if accessError(err) != auth_errors.ErrLDAPConnectionFailed {
+			log.Errorf("LDAP bind operation failed for AD service account %q: %v", lm.Config.ServiceAccountDN, err)
+			return nil, accessError(err)
+		}
+
+		log.Debugf("Pooled connection to AD server is closed, discarding it: %v", err)
+	}
+
+	ldapConn, err := lm.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	// bind AD service account to perform searches using the connection established above
+	if err := ldapConn.Bind(lm.Config.ServiceAccountDN, lm.Config.ServiceAccountPassword); err != nil {
+		ldapConn.Close()
+		log.Errorf("LDAP bind operation failed for AD service account %q: %v", lm.Config.ServiceAccountDN, err)
+		return nil, accessError(err)
+	}
+
+	return ldapConn, nil
+}
+
+// release hands a connection back to the pool; it's closed if the pool is full
+// or the connection failed.
+// params:
+//  ldapConn: connection returned by acquire()
+//  err: error of the last operation on the connection, if any
+func (lm *Manager) release(ldapConn *ldap.Conn, err error) {
+	if err == auth_errors.ErrLDAPConnectionFailed {
+		ldapConn.Close()
+		return
+	}
+
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+
+	if len(pool) >= poolSize() || !reflect.DeepEqual(poolConfig, lm.Config) {
+		ldapConn.Close()
+		return
+	}
+
+	pool = append(pool, pooledConn{conn: ldapConn, idleSince: time.Now()})
+}
+
+// closeConns closes the given connections
+func closeConns(conns []pooledConn) {
+	for _, pooled := range conns {
+		pooled.conn.Close()
+	}
+}
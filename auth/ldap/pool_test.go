@@ -0,0 +1,64 @@
+package ldap
+
+import (
+	"testing"
+	"time"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestConnectionPool tests that connections are reused across logins, and
+// replaced once they're closed or idle for too long
+func TestConnectionPool(t *testing.T) {
+	directory := newGroupsDirectory()
+	port, stop := startMockDirectory(t, directory)
+	defer stop()
+
+	lm := &Manager{Config: types.LdapConfiguration{
+		Server:                 "127.0.0.1",
+		Port:                   port,
+		BaseDN:                 "DC=example,DC=com",
+		ServiceAccountDN:       "CN=svc,DC=example,DC=com",
+		ServiceAccountPassword: "svc",
+	}}
+
+	lookup := func(description string, dials int) {
+		if _, groups, err := lm.Lookup("jdoe"); err != nil || len(groups) != 2 {
+			t.Errorf("%s: expected jdoe to be found with 2 groups, got %v, %v", description, groups, err)
+		}
+
+		if directory.dials() != dials {
+			t.Errorf("%s: expected %d connections, got %d", description, dials, directory.dials())
+		}
+	}
+
+	lookup("first login", 1)
+	lookup("reused connection", 1)
+
+	// neither a failed nor a successful bind of a user leaves the connection bound as the user
+	if _, _, _, err := lm.Authenticate("jdoe", "wrong"); err != auth_errors.ErrLDAPAccessDenied {
+		t.Errorf("expected %v for a wrong password, got %v", auth_errors.ErrLDAPAccessDenied, err)
+	}
+	lookup("after failed user bind", 1)
+
+	if _, _, _, err := lm.Authenticate("jdoe", "jdoe"); err != nil {
+		t.Errorf("expected jdoe to be authenticated, got %v", err)
+	}
+	lookup("after user bind", 1)
+
+	// the server closes the connection
+	directory.dropConns()
+	time.Sleep(100 * time.Millisecond)
+	lookup("closed connection", 2)
+
+	// the connection is idle for too long
+	poolMutex.Lock()
+	pool[0].idleSince = time.Now().Add(-time.Hour)
+	poolMutex.Unlock()
+	lookup("idle connection", 3)
+
+	// connections made with another configuration aren't reused
+	lm.Config.Servers = []string{lm.Config.Server}
+	lookup("changed configuration", 4)
+}
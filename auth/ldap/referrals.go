@@ -0,0 +1,188 @@
+package ldap
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	ldap "github.com/go-ldap/ldap"
+)
+
+// This file contains the handling of referrals, which servers return for the
+// parts of the directory held by other servers, e.g. the child domains of an
+// AD forest. They're followed if types.LdapConfiguration.FollowReferrals is
+// set, and ignored otherwise. The service account is only ever bound on the
+// servers of the domains listed in types.LdapConfiguration.ReferralDomains.
+
+// maxReferralHops is the number of referrals followed in a row
+const maxReferralHops = 3
+
+// search runs the given search, page by page (see pagedSearch()), and follows
+// the referrals it returns.
+// params:
+//  ldapConn: LDAP connection object
+//  searchRequest: search to run
+// return values:
+//  *ldap.SearchResult: entries found, including the ones found on referred servers
+//  error: nil if successful, else as returned by ldap.Conn.Search()
+func (lm *Manager) search(ldapConn *ldap.Conn, searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	return lm.searchReferred(ldapConn, searchRequest, 0)
+}
+
+// searchReferred runs the given search, which was referred the given number of times
+func (lm *Manager) searchReferred(ldapConn *ldap.Conn, searchRequest *ldap.SearchRequest, hops int) (*ldap.SearchResult, error) {
+	searchRes, err := pagedSearch(ldapConn, searchRequest)
+	if searchRequest.SizeLimit > 0 && ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		// the search asked for no more entries than the ones returned
+		err = nil
+	}
+
+	referrals := []string{}
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultReferral) {
+		// the base DN is held by another server; go-ldap drops the referral
+		// itself, but AD refers to the domain named by the DN's components
+		searchRes, err = &ldap.SearchResult{}, nil
+		if domain := dnDomain(searchRequest.BaseDN); domain != "" {
+			referral := url.URL{Scheme: "ldap", Host: domain, Path: "/" + searchRequest.BaseDN}
+			referrals = append(referrals, referral.String())
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	referrals = append(referrals, searchRes.Referrals...)
+	searchRes.Referrals = nil
+	if len(referrals) == 0 {
+		return searchRes, nil
+	}
+
+	if !lm.Config.FollowReferrals {
+		log.Debugf("Ignoring LDAP referrals: %s", strings.Join(referrals, ", "))
+		return searchRes, nil
+	}
+
+	if hops >= maxReferralHops {
+		log.Warnf("Ignoring LDAP referrals more than %d hops away: %s", maxReferralHops, strings.Join(referrals, ", "))
+		return searchRes, nil
+	}
+
+	// entries can be found on several servers if they refer to each other
+	found := map[string]bool{}
+	for _, entry := range searchRes.Entries {
+		found[entry.DN] = true
+	}
+
+	// servers unrelated to the search, e.g. AD's ForestDnsZones, are referred to
+	// as well; failing to follow a referral doesn't fail the search
+	for _, referral := range referrals {
+		entries, err := lm.followReferral(referral, searchRequest, hops+1)
+		if err != nil {
+			log.Warnf("Failed to follow LDAP referral %q: %v", referral, err)
+			continue
+		}
+
+		for _, entry := range entries {
+			if !found[entry.DN] {
+				found[entry.DN] = true
+				searchRes.Entries = append(searchRes.Entries, entry)
+			}
+		}
+	}
+
+	return searchRes, nil
+}
+
+// followReferral runs the given search on the server it was referred to, bound
+// as the service account.
+// params:
+//  referral: LDAP URL of the server, e.g. ldap://child.example.com/DC=child,DC=example,DC=com
+//  searchRequest: search which was referred; its base DN is replaced by the URL's, if any
+//  hops: number of times the search was referred
+// return values:
+//  []*ldap.Entry: entries found
+//  error: nil if successful, else the reason the referral couldn't be followed
+func (lm *Manager) followReferral(referral string, searchRequest *ldap.SearchRequest, hops int) ([]*ldap.Entry, error) {
+	u, err := url.Parse(referral)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("invalid referral")
+	}
+
+	// the referred server is reached like the configured ones, on the same port
+	// unless the URL has one, and its certificate is issued to its own name
+	host, address := u.Host, u.Host
+	if h, _, err := net.SplitHostPort(u.Host); err == nil {
+		host = h
+	} else {
+		address = net.JoinHostPort(host, strconv.Itoa(int(lm.Config.Port)))
+	}
+
+	if !lm.referralAllowed(host) {
+		return nil, fmt.Errorf("%s isn't in any of the domains referrals may be followed to", host)
+	}
+
+	referred := &Manager{Config: lm.Config}
+	referred.Config.TLSCertIssuedTo = ""
+
+	ldapConn, err := referred.connectTo(address, connectTimeout(&lm.Config))
+	if err != nil {
+		return nil, err
+	}
+
+	defer ldapConn.Close()
+
+	if err := ldapConn.Bind(lm.Config.ServiceAccountDN, lm.Config.ServiceAccountPassword); err != nil {
+		return nil, err
+	}
+
+	referredRequest := *searchRequest
+	if dn := strings.TrimPrefix(u.Path, "/"); dn != "" {
+		referredRequest.BaseDN = dn
+	}
+
+	searchRes, err := referred.searchReferred(ldapConn, &referredRequest, hops)
+	if err != nil {
+		return nil, err
+	}
+
+	return searchRes.Entries, nil
+}
+
+// referralAllowed returns whether the service account may be bound on the
+// given host, i.e. whether it's in one of the domains referrals may be followed to
+func (lm *Manager) referralAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, domain := range lm.Config.ReferralDomains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dnDomain returns the DNS domain named by the domain components of the given
+// DN, e.g. child.example.com for CN=jdoe,DC=child,DC=example,DC=com
+func dnDomain(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return ""
+	}
+
+	components := []string{}
+	for _, rdn := range parsed.RDNs {
+		for _, attribute := range rdn.Attributes {
+			if strings.EqualFold(attribute.Type, "DC") {
+				components = append(components, attribute.Value)
+			}
+		}
+	}
+
+	return strings.Join(components, ".")
+}
@@ -0,0 +1,111 @@
+package ldap
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestReferrals tests that referrals to child domains are followed if enabled,
+// only to the allowed domains, and ignored otherwise
+func TestReferrals(t *testing.T) {
+	child := &mockDirectory{
+		entries: map[string]map[string][]string{
+			"CN=svc,DC=example,DC=com": {"objectClass": {"user"}, "sAMAccountName": {"svc"}},
+			"CN=jdoe,DC=child,DC=example,DC=com": {"objectClass": {"user"}, "sAMAccountName": {"jdoe"},
+				"memberOf": {"CN=NetworkOps,DC=example,DC=com"}},
+		},
+		passwords: map[string]string{"CN=svc,DC=example,DC=com": "svc"},
+	}
+
+	childPort, stopChild := startMockDirectory(t, child)
+	defer stopChild()
+
+	parent := &mockDirectory{
+		entries: map[string]map[string][]string{
+			"CN=svc,DC=example,DC=com": {"objectClass": {"user"}, "sAMAccountName": {"svc"}},
+			"CN=asmith,DC=example,DC=com": {"objectClass": {"user"}, "sAMAccountName": {"asmith"},
+				"memberOf": {"CN=ChildOps,DC=child,DC=example,DC=com"}},
+			"CN=NetworkOps,DC=example,DC=com": {"objectClass": {"group"}},
+		},
+		passwords: map[string]string{"CN=svc,DC=example,DC=com": "svc"},
+		referrals: map[string]string{
+			"DC=child,DC=example,DC=com": fmt.Sprintf("ldap://localhost:%d/DC=child,DC=example,DC=com", childPort),
+		},
+	}
+
+	port, stop := startMockDirectory(t, parent)
+	defer stop()
+
+	newManager := func(followReferrals bool, domains ...string) *Manager {
+		return &Manager{Config: types.LdapConfiguration{
+			Server:                 "127.0.0.1",
+			Port:                   port,
+			BaseDN:                 "DC=example,DC=com",
+			ServiceAccountDN:       "CN=svc,DC=example,DC=com",
+			ServiceAccountPassword: "svc",
+			FollowReferrals:        followReferrals,
+			ReferralDomains:        domains,
+		}}
+	}
+
+	// ignored referrals don't fail the searches, be it the user's search or the
+	// search of a group held by the child domain
+	lm := newManager(false)
+	if _, _, err := lm.Lookup("jdoe"); err != auth_errors.ErrUserNotFound {
+		t.Errorf("referrals ignored: expected %v, got %v", auth_errors.ErrUserNotFound, err)
+	}
+
+	if _, groups, err := lm.Lookup("asmith"); err != nil || strings.Join(groups, ";") != "CN=ChildOps,DC=child,DC=example,DC=com" {
+		t.Errorf("referrals ignored: expected asmith to be found with group ChildOps, got %v, %v", groups, err)
+	}
+
+	// the service account isn't bound on servers outside the allowed domains
+	lm = newManager(true, "example.com")
+	if _, _, err := lm.Lookup("jdoe"); err != auth_errors.ErrUserNotFound {
+		t.Errorf("domain not allowed: expected %v, got %v", auth_errors.ErrUserNotFound, err)
+	}
+
+	if child.dials() != 0 {
+		t.Errorf("domain not allowed: expected no connection to the child domain, got %d", child.dials())
+	}
+
+	lm = newManager(true, "localhost")
+	dn, groups, err := lm.Lookup("jdoe")
+	if err != nil || dn != "CN=jdoe,DC=child,DC=example,DC=com" || strings.Join(groups, ";") != "CN=NetworkOps,DC=example,DC=com" {
+		t.Errorf("referrals followed: expected jdoe to be found with group NetworkOps, got %q, %v, %v", dn, groups, err)
+	}
+
+	// the child domain refers to itself; the referrals are followed a few times only
+	child.referrals = map[string]string{
+		"DC=loop,DC=child,DC=example,DC=com": fmt.Sprintf("ldap://localhost:%d/DC=child,DC=example,DC=com", childPort),
+	}
+
+	dials := child.dials()
+	if _, _, err := lm.Lookup("jdoe"); err != nil {
+		t.Errorf("referral loop: expected jdoe to be found, got %v", err)
+	}
+
+	if child.dials()-dials != maxReferralHops {
+		t.Errorf("referral loop: expected %d connections to the child domain, got %d", maxReferralHops, child.dials()-dials)
+	}
+}
+
+// TestDNDomain tests deriving the DNS domain of DNs
+func TestDNDomain(t *testing.T) {
+	testCases := map[string]string{
+		"CN=jdoe,DC=child,DC=example,DC=com": "child.example.com",
+		"cn=ops,ou=groups,dc=example,dc=com": "example.com",
+		"CN=jdoe,OU=Users":                   "",
+		"not a DN":                           "",
+	}
+
+	for dn, expected := range testCases {
+		if domain := dnDomain(dn); domain != expected {
+			t.Errorf("expected domain %q for %q, got %q", expected, dn, domain)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains the TLS configuration of connections to the directory,
+// which are either upgraded using StartTLS or made over TLS (LDAPS) from the
+// start.
+
+// pemMarker starts every PEM block; CA certificates which don't contain it
+// are taken to be the path of a PEM file
+const pemMarker = "-----BEGIN"
+
+// LoadCACertificate returns a pool holding the given CA certificates.
+// params:
+//  caCert: PEM-encoded certificates, or the path of a PEM file containing them
+// return values:
+//  *x509.CertPool: pool of the certificates
+//  error: nil if successful, else the reason the certificates couldn't be loaded
+func LoadCACertificate(caCert string) (*x509.CertPool, error) {
+	data := []byte(caCert)
+	if !strings.Contains(caCert, pemMarker) {
+		var err error
+		if data, err = ioutil.ReadFile(caCert); err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %s", err.Error())
+		}
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no PEM-encoded certificate found in CA certificate")
+	}
+
+	return pool, nil
+}
+
+// TLSConfig returns the TLS configuration of connections to a directory server.
+// params:
+//  cfg: LDAP configuration; StartTLS or UseLDAPS should be set
+//  host: name of the server; its certificate has to be issued to it, unless
+//    TLSCertIssuedTo is set
+// return values:
+//  *tls.Config: the server's certificate is verified against CACertificate,
+//    or the system's CAs if it's empty, unless InsecureSkipVerify is set
+//  error: nil if successful, else the reason the configuration is invalid
+func TLSConfig(cfg *types.LdapConfiguration, host string) (*tls.Config, error) {
+	serverName := cfg.TLSCertIssuedTo
+	if common.IsEmpty(serverName) {
+		serverName = host
+	}
+
+	// NOTE: InsecureSkipVerify should be used only for testing
+	if common.IsEmpty(serverName) && !cfg.InsecureSkipVerify {
+		return nil, errors.New("InsecureSkipVerify or TLSCertIssuedTo must be provided for TLS/SSL connection")
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if !common.IsEmpty(cfg.CACertificate) {
+		pool, err := LoadCACertificate(cfg.CACertificate)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
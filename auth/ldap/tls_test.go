@@ -0,0 +1,247 @@
+package ldap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	ldap "github.com/go-ldap/ldap"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// newTestCertificate returns a self-signed certificate for 127.0.0.1 along
+// with its PEM encoding
+func newTestCertificate(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "auth_proxy test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, string(certPEM)
+}
+
+// startMockLDAPS accepts TLS connections like a LDAPS server would, without
+// answering any LDAP requests; it returns the listener's port
+func startMockLDAPS(t *testing.T, cert tls.Certificate) (uint16, func()) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+				ioutil.ReadAll(conn)
+			}()
+		}
+	}()
+
+	_, portStr, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	return uint16(port), func() { listener.Close() }
+}
+
+// startMockStartTLS accepts plaintext connections like a LDAP server requiring
+// StartTLS would: the first request is answered with the given result code and
+// the connection is upgraded to TLS if it's successful. It returns the
+// listener's port and a channel receiving whether each connection was upgraded.
+func startMockStartTLS(t *testing.T, cert tls.Certificate, resultCode int64) (uint16, <-chan bool, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	upgraded := make(chan bool, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				request, err := ber.ReadPacket(conn)
+				if err != nil || len(request.Children) < 2 {
+					upgraded <- false
+					return
+				}
+
+				response := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+				response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, request.Children[0].Value, "MessageID"))
+				result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedResponse, nil, "Extended Response")
+				result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, resultCode, "resultCode"))
+				result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+				result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+				response.AppendChild(result)
+
+				if _, err := conn.Write(response.Bytes()); err != nil || resultCode != ldap.LDAPResultSuccess {
+					upgraded <- false
+					return
+				}
+
+				tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+				upgraded <- tlsConn.Handshake() == nil
+				ioutil.ReadAll(tlsConn)
+			}()
+		}
+	}()
+
+	_, portStr, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	return uint16(port), upgraded, func() { listener.Close() }
+}
+
+// TestLoadCACertificate tests loading CA certificates from PEM strings and files
+func TestLoadCACertificate(t *testing.T) {
+	_, certPEM := newTestCertificate(t)
+
+	if _, err := LoadCACertificate(certPEM); err != nil {
+		t.Errorf("failed to load PEM certificate: %s", err)
+	}
+
+	file, err := ioutil.TempFile("", "ldap_ca")
+	if err != nil {
+		t.Fatalf("failed to create file: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.WriteString(certPEM); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	file.Close()
+
+	if _, err := LoadCACertificate(file.Name()); err != nil {
+		t.Errorf("failed to load certificate file: %s", err)
+	}
+
+	for _, invalid := range []string{"-----BEGIN CERTIFICATE-----\ngarbage\n-----END CERTIFICATE-----\n", "/nonexistent/ca.pem"} {
+		if _, err := LoadCACertificate(invalid); err == nil {
+			t.Errorf("expected an error loading %q", invalid)
+		}
+	}
+}
+
+// TestConnectLDAPS tests connecting to a LDAPS server with a self-signed certificate
+func TestConnectLDAPS(t *testing.T) {
+	cert, certPEM := newTestCertificate(t)
+	port, stop := startMockLDAPS(t, cert)
+	defer stop()
+
+	testCases := []struct {
+		description string
+		config      types.LdapConfiguration
+		succeeds    bool
+	}{
+		{"trusted CA", types.LdapConfiguration{UseLDAPS: true, TLSCertIssuedTo: "127.0.0.1", CACertificate: certPEM}, true},
+		{"system CAs", types.LdapConfiguration{UseLDAPS: true, TLSCertIssuedTo: "127.0.0.1"}, false},
+		{"wrong server name", types.LdapConfiguration{UseLDAPS: true, TLSCertIssuedTo: "ldap.example.com", CACertificate: certPEM}, false},
+		{"insecure", types.LdapConfiguration{UseLDAPS: true, InsecureSkipVerify: true}, true},
+		{"server's own name", types.LdapConfiguration{UseLDAPS: true, CACertificate: certPEM}, true},
+	}
+
+	for _, tc := range testCases {
+		lm := &Manager{Config: tc.config}
+		lm.Config.Server = "127.0.0.1"
+		lm.Config.Port = port
+
+		conn, err := lm.connect()
+		if tc.succeeds != (err == nil) {
+			t.Errorf("%s: expected success %t, got error %v", tc.description, tc.succeeds, err)
+		}
+
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// TestConnectStartTLS tests upgrading connections using StartTLS, which must
+// fail rather than carry on in cleartext
+func TestConnectStartTLS(t *testing.T) {
+	cert, certPEM := newTestCertificate(t)
+
+	testCases := []struct {
+		description string
+		resultCode  int64
+		caCert      string
+		expected    error
+		upgraded    bool
+	}{
+		{"trusted CA", ldap.LDAPResultSuccess, certPEM, nil, true},
+		{"untrusted certificate", ldap.LDAPResultSuccess, "", auth_errors.ErrLDAPTLSFailed, false},
+		{"StartTLS refused", ldap.LDAPResultUnavailable, certPEM, auth_errors.ErrLDAPTLSFailed, false},
+	}
+
+	for _, tc := range testCases {
+		port, upgraded, stop := startMockStartTLS(t, cert, tc.resultCode)
+
+		lm := &Manager{Config: types.LdapConfiguration{
+			Server:          "127.0.0.1",
+			Port:            port,
+			StartTLS:        true,
+			TLSCertIssuedTo: "127.0.0.1",
+			CACertificate:   tc.caCert,
+		}}
+
+		conn, err := lm.connect()
+		if err != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.description, tc.expected, err)
+		}
+
+		if conn != nil {
+			conn.Close()
+		}
+
+		select {
+		case u := <-upgraded:
+			if u != tc.upgraded {
+				t.Errorf("%s: expected upgraded %t, got %t", tc.description, tc.upgraded, u)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: the server didn't get a StartTLS request", tc.description)
+		}
+
+		stop()
+	}
+}
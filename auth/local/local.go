@@ -1,39 +1,204 @@
 package local
 
 import (
+	"bytes"
+	"strconv"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/contiv/auth_proxy/common"
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
 	"github.com/contiv/auth_proxy/db"
 )
 
-// Authenticate authenticates the user against local DB with the given username and password
+// Authenticate authenticates the user against local DB with the given username and password,
+// and the one-time password if the user has MFA enabled
 // params:
 //  username: username to authenticate
 //  password: password of the user
+//  otp: one-time password of the user; ignored unless the user has MFA enabled
 // return values:
 //  []string containing the `PrincipalName`(username) on successful authentication else nil
-//  error: nil on successful authentication otherwise ErrLocalAuthenticationFailed
-func Authenticate(username, password string) ([]string, error) {
+//  bool: true if the user has to change the password (see PasswordChangeRequired)
+//  error: nil on successful authentication otherwise ErrLocalAuthenticationFailed,
+//         ErrUserDisabled if the password was right but the user is disabled,
+//         or ErrOTPRequired/ErrInvalidOTP if the password was right but the
+//         one-time password is missing/wrong
+func Authenticate(username, password, otp string) ([]string, bool, error) {
 	user, err := db.GetLocalUser(username)
 	if err != nil {
 		if err == auth_errors.ErrKeyNotFound {
-			return nil, auth_errors.ErrUserNotFound
+			return nil, false, auth_errors.ErrUserNotFound
 		}
 
-		return nil, err
+		return nil, false, err
 	}
 
-	if user.Disable {
-		log.Debugf("Local user %q is disabled", username)
-		return nil, auth_errors.ErrAccessDenied
+	if user.DeletedAt != 0 {
+		log.Debugf("Local user %q is deleted", username)
+		return nil, false, auth_errors.ErrUserNotFound
 	}
 
 	if !common.ValidatePassword(password, user.PasswordHash) {
 		log.Debugf("Incorrect password for user %q", username)
-		return nil, auth_errors.ErrAccessDenied
+		return nil, false, auth_errors.ErrAccessDenied
+	}
+
+	// only checked once the password is right, so that it doesn't tell who's disabled
+	if user.Disable {
+		log.Debugf("Local user %q is disabled", username)
+		return nil, false, auth_errors.ErrUserDisabled
+	}
+
+	if user.MFAEnabled {
+		if common.IsEmpty(otp) {
+			log.Debugf("No one-time password given for user %q", username)
+			return nil, false, auth_errors.ErrOTPRequired
+		}
+
+		if !ValidateUserTOTP(user, otp, time.Now()) {
+			log.Debugf("Incorrect one-time password for user %q", username)
+			return nil, false, auth_errors.ErrInvalidOTP
+		}
 	}
 
+	if common.PasswordHashOutdated(user.PasswordHash) {
+		upgradePasswordHash(user, password)
+	}
+
+	now := time.Now()
+	recordLastLogin(user, now)
+
 	// user.Username is the PrincipalName for localuser
-	return []string{user.Username}, nil
+	return []string{user.Username}, PasswordChangeRequired(user, now), nil
+}
+
+// lastLoginResolution is how often the last login of a local user is recorded
+// at most, so that e.g. basic auth, which logs in with every request, doesn't
+// write the user with every request
+const lastLoginResolution = time.Minute
+
+// recordLastLogin records the time of the user's login unless the last one was
+// recorded less than lastLoginResolution ago; failures are only logged, as the
+// login mustn't fail because of them. The login is recorded apart from the
+// user's entry, which is left as it is, e.g. if an admin disabled the user in
+// the meantime.
+// params:
+//  user: local user who just logged in
+//  now: time of the login
+func recordLastLogin(user *types.LocalUser, now time.Time) {
+	if now.Sub(time.Unix(user.LastLogin, 0)) < lastLoginResolution {
+		return
+	}
+
+	if err := db.RecordLocalUserLogin(user.Username, now.Unix()); err != nil {
+		log.Warnf("Failed to record the last login of user %q: %#v", user.Username, err)
+		return
+	}
+
+	user.LastLogin = now.Unix()
+}
+
+// ValidateUserTOTP checks a one-time password against the TOTP secret of a
+// local user, which is stored encrypted (see db.SetLocalUserMFASecret()).
+// params:
+//  user: local user as read from the data store
+//  code: one-time password given by the user
+//  now: current time
+// return values:
+//  bool: true if the one-time password is valid
+func ValidateUserTOTP(user *types.LocalUser, code string, now time.Time) bool {
+	secret, err := common.Decrypt(user.MFASecret)
+	if err != nil {
+		log.Errorf("Failed to decrypt the MFA secret of user %q: %#v", user.Username, err)
+		return false
+	}
+
+	return ValidateTOTP(secret, code, now)
+}
+
+// upgradePasswordHash regenerates the user's password hash with the cost
+// configured under common.PasswordHashCostKey; failures are only logged, as the
+// old hash keeps working. Only the hash of the user's current entry is
+// replaced, and only if it's still the one the password was checked against,
+// so that e.g. a password reset or a disable in the meantime isn't undone.
+// params:
+//  user: local user who just logged in
+//  password: the user's (correct) password
+func upgradePasswordHash(user *types.LocalUser, password string) {
+	hash, err := common.GenPasswordHash(password)
+	if err != nil {
+		log.Warnf("Failed to upgrade the password hash of user %q: %#v", user.Username, err)
+		return
+	}
+
+	current, err := db.GetLocalUser(user.Username)
+	if err != nil {
+		log.Warnf("Failed to upgrade the password hash of user %q: %#v", user.Username, err)
+		return
+	}
+
+	if !bytes.Equal(current.PasswordHash, user.PasswordHash) {
+		log.Debugf("Not upgrading the password hash of user %q as its password changed", user.Username)
+		return
+	}
+
+	// the password's age is kept
+	current.Password = ""
+	current.PasswordHash = hash
+
+	if err := db.UpdateLocalUser(user.Username, current); err != nil {
+		log.Warnf("Failed to store the upgraded password hash of user %q: %#v", user.Username, err)
+		return
+	}
+
+	user.PasswordHash = hash
+}
+
+// passwordMaxAge returns the maximum password age configured under
+// common.PasswordMaxAgeKey; 0 if passwords don't expire.
+func passwordMaxAge() time.Duration {
+	value, err := common.Global().Get(common.PasswordMaxAgeKey)
+	if err != nil {
+		return 0
+	}
+
+	days, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || days <= 0 {
+		return 0
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// PasswordExpired checks whether the user's password is older than the
+// maximum password age. Passwords of users created before password changes
+// were recorded have an unknown age; they don't expire until they're changed,
+// so that setting a maximum age doesn't lock out every existing user,
+// including the built-in admin.
+// params:
+//  user: local user whose password is checked
+//  now: current time
+// return values:
+//  bool: true if the password has to be changed before the user can do anything else
+func PasswordExpired(user *types.LocalUser, now time.Time) bool {
+	maxAge := passwordMaxAge()
+	if maxAge == 0 || user.PasswordExpiryExempt || user.PasswordChangedAt == 0 {
+		return false
+	}
+
+	return now.Sub(time.Unix(user.PasswordChangedAt, 0)) > maxAge
+}
+
+// PasswordChangeRequired checks whether the user has to change the password
+// before doing anything else: because it expired, or because an admin
+// requires it to be reset.
+// params:
+//  user: local user whose password is checked
+//  now: current time
+// return values:
+//  bool: true if the password has to be changed
+func PasswordChangeRequired(user *types.LocalUser, now time.Time) bool {
+	return user.PasswordResetRequired || PasswordExpired(user, now)
 }
@@ -0,0 +1,83 @@
+package local
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestPasswordExpired tests the password expiry policy
+func TestPasswordExpired(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+
+	testCases := []struct {
+		description string
+		maxAge      string
+		user        types.LocalUser
+		expected    bool
+	}{
+		{"expiry disabled", "0", types.LocalUser{PasswordChangedAt: now.Add(-1000 * day).Unix()}, false},
+		{"expiry not configured", "", types.LocalUser{PasswordChangedAt: now.Add(-1000 * day).Unix()}, false},
+		{"fresh password", "90", types.LocalUser{PasswordChangedAt: now.Add(-89 * day).Unix()}, false},
+		{"expired password", "90", types.LocalUser{PasswordChangedAt: now.Add(-91 * day).Unix()}, true},
+		{"unknown password age", "90", types.LocalUser{}, false},
+		{"exempt user", "90", types.LocalUser{PasswordChangedAt: now.Add(-91 * day).Unix(), PasswordExpiryExempt: true}, false},
+	}
+
+	defer common.Global().Set(common.PasswordMaxAgeKey, "")
+
+	for _, tc := range testCases {
+		common.Global().Set(common.PasswordMaxAgeKey, tc.maxAge)
+
+		if expired := PasswordExpired(&tc.user, now); expired != tc.expected {
+			t.Errorf("%s: expected %t, got %t", tc.description, tc.expected, expired)
+		}
+	}
+}
+
+// TestPasswordExpiredUnknownAge tests that the passwords of users stored
+// before password changes were recorded don't expire
+func TestPasswordExpiredUnknownAge(t *testing.T) {
+	defer common.Global().Set(common.PasswordMaxAgeKey, "")
+	common.Global().Set(common.PasswordMaxAgeKey, "90")
+
+	user := types.LocalUser{}
+	if err := json.Unmarshal([]byte(`{"username":"admin","first_name":"","last_name":"","disable":false}`), &user); err != nil {
+		t.Fatalf("failed to unmarshal the user: %s", err)
+	}
+
+	if PasswordChangeRequired(&user, time.Now()) {
+		t.Error("expected the password of unknown age not to expire")
+	}
+}
+
+// TestPasswordChangeRequired tests that users have to change expired passwords
+// and passwords an admin requires them to reset
+func TestPasswordChangeRequired(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+
+	testCases := []struct {
+		description string
+		user        types.LocalUser
+		expected    bool
+	}{
+		{"fresh password", types.LocalUser{PasswordChangedAt: now.Add(-89 * day).Unix()}, false},
+		{"expired password", types.LocalUser{PasswordChangedAt: now.Add(-91 * day).Unix()}, true},
+		{"reset required", types.LocalUser{PasswordChangedAt: now.Unix(), PasswordResetRequired: true}, true},
+		{"reset required, exempt user", types.LocalUser{PasswordExpiryExempt: true, PasswordResetRequired: true}, true},
+	}
+
+	defer common.Global().Set(common.PasswordMaxAgeKey, "")
+	common.Global().Set(common.PasswordMaxAgeKey, "90")
+
+	for _, tc := range testCases {
+		if required := PasswordChangeRequired(&tc.user, now); required != tc.expected {
+			t.Errorf("%s: expected %t, got %t", tc.description, tc.expected, required)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package local
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// This file contains the time-based one-time passwords (RFC 6238) local users
+// with MFA enabled have to log in with: 6 digits derived from a shared secret
+// using HMAC-SHA1 and 30 second time steps, as expected by authenticator apps.
+
+const (
+	// totpIssuer is the issuer shown by authenticator apps
+	totpIssuer = "auth_proxy"
+
+	// totpSecretSize is the size of TOTP secrets in bytes
+	totpSecretSize = 20
+
+	// totpDigits is the number of digits of one-time passwords, and totpModulo
+	// 10^totpDigits
+	totpDigits = 6
+	totpModulo = 1000000
+
+	// totpStep is the time step of one-time passwords
+	totpStep = 30 * time.Second
+
+	// totpSkew is the number of time steps a one-time password may be early or
+	// late, to tolerate clock skew between the proxy and the user's device
+	totpSkew = 1
+)
+
+// NewTOTPSecret generates a random TOTP secret.
+// return values:
+//  string: the secret, base32 encoded without padding
+//  error: as returned by rand.Read()
+func NewTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(secret), "="), nil
+}
+
+// TOTPURL returns the otpauth:// URL authenticator apps enroll the given
+// secret with, e.g. by scanning it as a QR code.
+// params:
+//  username: of the local user the secret belongs to
+//  secret: as returned by NewTOTPSecret()
+// return values:
+//  string: otpauth:// URL
+func TOTPURL(username, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int(totpStep.Seconds())))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + username,
+		RawQuery: query.Encode(),
+	}
+
+	return u.String()
+}
+
+// decodeTOTPSecret decodes a base32 TOTP secret, with or without padding
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.TrimRight(secret, "="))
+	if pad := len(secret) % 8; pad != 0 {
+		secret += strings.Repeat("=", 8-pad)
+	}
+
+	return base32.StdEncoding.DecodeString(secret)
+}
+
+// totpCode computes the one-time password of the given time step (RFC 4226)
+func totpCode(key []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulo)
+}
+
+// TOTP returns the one-time password of the given secret at the given time,
+// like an authenticator app does.
+// params:
+//  secret: as returned by NewTOTPSecret()
+//  now: current time
+// return values:
+//  string: the one-time password
+//  error: if the secret isn't base32 encoded
+func TOTP(secret string, now time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return totpCode(key, now.Unix()/int64(totpStep.Seconds())), nil
+}
+
+// ValidateTOTP checks a one-time password against the given secret, allowing
+// for clock skew of up to totpSkew time steps.
+// params:
+//  secret: as returned by NewTOTPSecret()
+//  code: one-time password given by the user
+//  now: current time
+// return values:
+//  bool: true if the one-time password is valid
+func ValidateTOTP(secret, code string, now time.Time) bool {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(key) == 0 || len(code) != totpDigits {
+		return false
+	}
+
+	current := now.Unix() / int64(totpStep.Seconds())
+
+	valid := false
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			valid = true
+		}
+	}
+
+	return valid
+}
@@ -0,0 +1,106 @@
+package local
+
+import (
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 key of the RFC 6238 test vectors
+var rfc6238Secret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+// TestTOTPCode tests one-time passwords against the RFC 6238 test vectors,
+// truncated to 6 digits
+func TestTOTPCode(t *testing.T) {
+	testCases := []struct {
+		time     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tc := range testCases {
+		if !ValidateTOTP(rfc6238Secret, tc.expected, time.Unix(tc.time, 0)) {
+			t.Errorf("expected %q to be valid at %d", tc.expected, tc.time)
+		}
+	}
+}
+
+// TestValidateTOTP tests the clock skew tolerance and invalid input
+func TestValidateTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatalf("failed to generate a secret: %s", err)
+	}
+
+	if strings.Contains(secret, "=") {
+		t.Errorf("expected a secret without padding, got %q", secret)
+	}
+
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(key) != totpSecretSize {
+		t.Fatalf("failed to decode %q: %v", secret, err)
+	}
+
+	now := time.Unix(1500000000, 0)
+	step := now.Unix() / 30
+
+	testCases := []struct {
+		description string
+		code        string
+		expected    bool
+	}{
+		{"current step", totpCode(key, step), true},
+		{"previous step", totpCode(key, step-1), true},
+		{"next step", totpCode(key, step+1), true},
+		{"two steps early", totpCode(key, step-2), false},
+		{"two steps late", totpCode(key, step+2), false},
+		{"empty", "", false},
+		{"too short", totpCode(key, step)[1:], false},
+	}
+
+	for _, tc := range testCases {
+		// a code may coincide with another step's by chance
+		if tc.expected == false && tc.code == totpCode(key, step) {
+			continue
+		}
+
+		if valid := ValidateTOTP(secret, tc.code, now); valid != tc.expected {
+			t.Errorf("%s: expected %t, got %t", tc.description, tc.expected, valid)
+		}
+	}
+
+	if code, err := TOTP(secret, now); err != nil || code != totpCode(key, step) {
+		t.Errorf("expected %q, got %q (%v)", totpCode(key, step), code, err)
+	}
+
+	if ValidateTOTP("not base32!", totpCode(key, step), now) {
+		t.Error("expected an invalid secret to be rejected")
+	}
+}
+
+// TestTOTPURL tests the otpauth:// URL of a secret
+func TestTOTPURL(t *testing.T) {
+	u, err := url.Parse(TOTPURL("jdoe", "JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatalf("failed to parse the URL: %s", err)
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/auth_proxy:jdoe" {
+		t.Errorf("unexpected URL %q", u.String())
+	}
+
+	if secret := u.Query().Get("secret"); secret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("expected the secret in the URL, got %q", secret)
+	}
+
+	if issuer := u.Query().Get("issuer"); issuer != "auth_proxy" {
+		t.Errorf("expected the issuer in the URL, got %q", issuer)
+	}
+}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"sort"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
@@ -8,7 +9,6 @@ import (
 
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
 	"github.com/contiv/auth_proxy/common/types"
-	"github.com/contiv/auth_proxy/db"
 )
 
 // getPrincipals returns the stored principals info from the token.
@@ -37,6 +37,132 @@ func (authZ *Token) getPrincipals() ([]string, error) {
 	return principals, nil
 }
 
+// Tenants returns the names of the tenants the principals in the token are
+// currently authorized for.
+//
+// Return values:
+//  []string: sorted tenant names; empty if there are none. A wildcard
+//    authorization is listed as types.AllTenants, which sorts first
+//  error: nil if successful, else relevant error if the token is malformed or
+//    the authorizations couldn't be read
+func (authZ *Token) Tenants() ([]string, error) {
+	principals, err := authZ.getPrincipals()
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	tenants := []string{}
+
+	for _, p := range principals {
+		authz, err := principalAuthorizations(p)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, a := range authz {
+			if !strings.HasPrefix(a.ClaimKey, types.TenantClaimKey) {
+				continue
+			}
+
+			tenant := strings.TrimPrefix(a.ClaimKey, types.TenantClaimKey)
+			if !found[tenant] {
+				found[tenant] = true
+				tenants = append(tenants, tenant)
+			}
+		}
+	}
+
+	sort.Strings(tenants)
+	return tenants, nil
+}
+
+// TenantRoles returns the roles the principals in the token currently have on
+// their tenants; a tenant authorized through several principals, e.g. a user
+// and its LDAP groups, gets the highest of their roles.
+//
+// Return values:
+//  map[string]types.RoleType: roles by tenant name; a wildcard authorization
+//    is keyed by types.AllTenants
+//  error: nil if successful, else relevant error if the token is malformed or
+//    the authorizations couldn't be read
+func (authZ *Token) TenantRoles() (map[string]types.RoleType, error) {
+	principals, err := authZ.getPrincipals()
+	if err != nil {
+		return nil, err
+	}
+
+	roles := map[string]types.RoleType{}
+	for _, p := range principals {
+		authz, err := principalAuthorizations(p)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, a := range authz {
+			if !strings.HasPrefix(a.ClaimKey, types.TenantClaimKey) {
+				continue
+			}
+
+			role, err := types.Role(a.ClaimValue)
+			if err != nil {
+				log.Debug("malformed authorization, error:", err)
+				continue
+			}
+
+			tenant := strings.TrimPrefix(a.ClaimKey, types.TenantClaimKey)
+			if current, found := roles[tenant]; !found || role < current {
+				roles[tenant] = role
+			}
+		}
+	}
+
+	return roles, nil
+}
+
+// byAuthzUUID sorts authorizations by UUID
+type byAuthzUUID []types.Authorization
+
+func (a byAuthzUUID) Len() int           { return len(a) }
+func (a byAuthzUUID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAuthzUUID) Less(i, j int) bool { return a[i].UUID < a[j].UUID }
+
+// MatchedAuthorizations returns the unexpired authorizations of the given
+// principals, i.e. the ones a user with these principals currently gets its
+// roles from.
+//
+// Parameters:
+//  principals: security principals of a user, e.g. a local username or the
+//    LDAP groups of a user
+//
+// Return values:
+//  []types.Authorization: the authorizations, sorted by UUID
+//  error: nil if successful, else as returned by db.ListAuthorizationsByPrincipal()
+//
+func MatchedAuthorizations(principals []string) ([]types.Authorization, error) {
+	found := map[string]bool{}
+	matched := []types.Authorization{}
+
+	for _, p := range principals {
+		authzs, err := principalAuthorizations(p)
+		if err != nil {
+			return nil, err
+		}
+
+		// principals differing in case only match the same authorizations
+		// if usernames are normalized
+		for _, authz := range authzs {
+			if !found[authz.UUID] {
+				found[authz.UUID] = true
+				matched = append(matched, authz)
+			}
+		}
+	}
+
+	sort.Sort(byAuthzUUID(matched))
+	return matched, nil
+}
+
 //
 // checkRolePolicy checks the authorization db for a role claim that matches
 // the specified role.
@@ -65,19 +191,24 @@ func (authZ *Token) checkRolePolicy(desired types.RoleType) error {
 		return err
 	}
 
+	// the base role mapped from the user's LDAP groups is carried by the token
+	if granted, ok := authZ.groupRole(); ok && checkAccessClaim(granted, desired) == nil {
+		return nil
+	}
+
 	for _, p := range principals {
 
 		// Get role claim for the principal
-		authz, err := db.ListAuthorizationsByClaimAndPrincipal(types.RoleClaimKey, p)
+		authz, err := principalClaims(types.RoleClaimKey, p)
 		// If not found, ignore error and move on to next principal
 		if err != nil || len(authz) == 0 {
 			log.Debug("no role claim found for principal ", p)
 			continue
 		}
 
-		granted, err := types.Role(authz[0].ClaimValue)
-		if err != nil {
-			log.Debug("malformed authorization, error:", err)
+		_, granted, ok := highestRole(authz)
+		if !ok {
+			log.Debug("malformed role claims for principal ", p)
 			continue
 		}
 
@@ -100,8 +231,8 @@ func (authZ *Token) checkRolePolicy(desired types.RoleType) error {
 
 //
 // checkTenantPolicy checks the authorization token for an explicit claim that
-// allows access to a tenant
-// TODO  add wildcard access to all tenants.
+// allows access to a tenant, or for a wildcard claim (see types.AllTenants)
+// that allows access to all tenants.
 //
 // Parameters:
 //  (Receiver): authorization token object
@@ -122,6 +253,12 @@ func (authZ *Token) checkTenantPolicy(tenant types.Tenant, desiredAccess interfa
 		return auth_errors.NewError(auth_errors.Internal, msg)
 	}
 
+	// an explicit claim is looked for first, then a wildcard claim
+	claimKeys := []string{claimStr}
+	if tenant != types.AllTenants {
+		claimKeys = append(claimKeys, types.TenantClaimKey+string(types.AllTenants))
+	}
+
 	// Gather tenant authorizations for principals claim present in token
 	// and look for authorizations for given tenant with desiredAccess. We
 	// don't cache authorizations in token itself, rather we rely on
@@ -137,49 +274,37 @@ func (authZ *Token) checkTenantPolicy(tenant types.Tenant, desiredAccess interfa
 		return err
 	}
 
-	for _, p := range principals {
-		// Get tenant claim for the principal
-		authz, err := db.ListAuthorizationsByClaimAndPrincipal(claimStr, p)
-		// If not found, ignore error and move on to next principal
-		if err != nil || len(authz) == 0 {
-			log.Debug("no tenant claim found for principal ", p)
-			continue
-		}
-
-		// If this claim is present, value is the role assigned with
-		// the tenant.
-		role, err := types.Role(authz[0].ClaimValue)
-		if err != nil {
-			msg := "malformed claim statement, error:" + err.Error()
-			log.Error(msg)
-			// continue processing
-			continue
-		}
-
-		if checkAccessClaim(role, desiredAccess) == nil {
-			// Success
-			return nil
+	for _, claimKey := range claimKeys {
+		for _, p := range principals {
+			if principalHasTenantClaim(p, claimKey, desiredAccess) {
+				return nil
+			}
 		}
-
 	}
 
-	// @TODO: Add wildcard claims
-	/*
-		// If we are here, then an explicit claim check didn't succeed. Look
-		// for a wildcard claim.
-		claimStr, err = GenerateClaimKey(types.ALL_CLUSTERS_AUTH)
-		if err != nil {
-			msg := "malformed claim statement, error:" + err.Error()
-			log.Error(msg)
-			return types.NewError(types.Internal, msg)
-		}
-
-		if v, ok := authZ.t.Claims[claimStr]; ok && v.(bool) == true {
-			return nil
-		}
-	*/
-
 	// If no principal found that can satisfy the claim, return error
 	log.Debug("access denied for claim:", claimStr)
 	return auth_errors.ErrUnauthorized
 }
+
+// principalHasTenantClaim returns true if the principal has the given tenant
+// claim with at least the desired access.
+func principalHasTenantClaim(principal, claimKey string, desiredAccess interface{}) bool {
+	// Get tenant claim for the principal
+	authz, err := principalClaims(claimKey, principal)
+	// If not found, ignore error and move on to next principal
+	if err != nil || len(authz) == 0 {
+		log.Debug("no tenant claim ", claimKey, " found for principal ", principal)
+		return false
+	}
+
+	// If this claim is present, value is the role assigned with
+	// the tenant.
+	role, err := types.Role(authz[0].ClaimValue)
+	if err != nil {
+		log.Error("malformed claim statement, error:" + err.Error())
+		return false
+	}
+
+	return checkAccessClaim(role, desiredAccess) == nil
+}
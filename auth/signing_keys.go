@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains the signing of tokens and the rotation of token signing
+// keys. New tokens are always signed with the current key and carry its ID in
+// their `kid` header: by default, a shared key used with HS256 (see
+// getTokenSigningKey()), or an RSA key used with RS256 if configured (see
+// InitTokenSigning()). Rotating the shared key retires the current one, which
+// is still accepted until all the tokens signed with it have expired.
+
+// kidHeader is the JWT header holding the ID of the key a token was signed with
+const kidHeader = "kid"
+
+// rotationMutex serializes the rotation of token signing keys
+var rotationMutex sync.Mutex
+
+// rsaSigningKey is the RSA key tokens are signed with if common.TokenSigningMethodKey
+// is RS256, and rsaSigningKeyID its ID; both are set by InitTokenSigning() at startup
+var (
+	rsaSigningKey   *rsa.PrivateKey
+	rsaSigningKeyID string
+)
+
+// InitTokenSigning reads the RSA private key tokens are signed with if
+// common.TokenSigningMethodKey is RS256; it has to be called at startup.
+// return values:
+//  error: nil if HS256 is used or the key could be read, otherwise a description of the problem
+func InitTokenSigning() error {
+	rsaSigningKey, rsaSigningKeyID = nil, ""
+
+	if tokenSetting(common.TokenSigningMethodKey) != common.TokenSigningRS256 {
+		return nil
+	}
+
+	path := tokenSetting(common.TokenSigningKeyFileKey)
+	if common.IsEmpty(path) {
+		return fmt.Errorf("%s is required with %s %q", common.TokenSigningKeyFileKey, common.TokenSigningMethodKey, common.TokenSigningRS256)
+	}
+
+	key, err := common.ReadRSAPrivateKey(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s %q: %s", common.TokenSigningKeyFileKey, path, err.Error())
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	rsaSigningKey, rsaSigningKeyID = key, signingKeyID(string(der))
+	log.Infof("Signing tokens with RS256 key %q", rsaSigningKeyID)
+
+	return nil
+}
+
+// SigningPublicKey returns the public key which verifies our tokens if they're
+// signed with RS256.
+// return values:
+//  *rsa.PublicKey: the public key; nil if tokens are signed with HS256
+//  string: the key's ID (`kid` header)
+func SigningPublicKey() (*rsa.PublicKey, string) {
+	if rsaSigningKey == nil {
+		return nil, ""
+	}
+
+	return &rsaSigningKey.PublicKey, rsaSigningKeyID
+}
+
+// signToken signs the given token with the current key and sets its `kid` header.
+// params:
+//  token: token to be signed
+// return values:
+//  string: the signed token
+//  error: as returned by getTokenSigningKey() or jwt.Token.SignedString()
+func signToken(token *jwt.Token) (string, error) {
+	if rsaSigningKey != nil {
+		token.Method = jwt.SigningMethodRS256
+		token.Header["alg"] = token.Method.Alg()
+		token.Header[kidHeader] = rsaSigningKeyID
+
+		return token.SignedString(rsaSigningKey)
+	}
+
+	key, err := getTokenSigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	token.Header[kidHeader] = signingKeyID(key)
+
+	return token.SignedString([]byte(key))
+}
+
+// signingKeyID returns the ID of the given token signing key; it identifies
+// the key without revealing it.
+// params:
+//  key: token signing key
+// return values:
+//  string: hex encoded prefix of the key's SHA-256 hash
+func signingKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// CurrentSigningKeyID returns the ID of the key new tokens are signed with.
+// return values:
+//  string: ID of the current token signing key
+//  error: as returned by getTokenSigningKey()
+func CurrentSigningKeyID() (string, error) {
+	if rsaSigningKey != nil {
+		return rsaSigningKeyID, nil
+	}
+
+	key, err := getTokenSigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	return signingKeyID(key), nil
+}
+
+// RotateSigningKey replaces the current token signing key with a new one. The
+// replaced key is retired: tokens signed with it are accepted until they've all
+// expired, i.e. for MaxTokenTTL().
+// params:
+//  now: time of the rotation
+// return values:
+//  string: ID of the new key
+//  error: auth_errors.ErrSigningKeyManaged if the key is held by the secrets
+//         backend or an RSA key is used, otherwise as returned by consecutive func calls
+func RotateSigningKey(now time.Time) (string, error) {
+	if rsaSigningKey != nil {
+		return "", auth_errors.ErrSigningKeyManaged
+	}
+
+	if _, err := common.GetSecret(common.SecretTokenSigningKey); err == nil {
+		return "", auth_errors.ErrSigningKeyManaged
+	} else if err != auth_errors.ErrSecretNotConfigured {
+		return "", err
+	}
+
+	rotationMutex.Lock()
+	defer rotationMutex.Unlock()
+
+	key, err := getTokenSigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	maxTTL, err := MaxTokenTTL()
+	if err != nil {
+		return "", err
+	}
+
+	encryptedKey, err := common.Encrypt(key)
+	if err != nil {
+		return "", err
+	}
+
+	retired := &types.RetiredSigningKey{
+		ID:        signingKeyID(key),
+		Key:       encryptedKey,
+		RetiredAt: now.Unix(),
+		ExpiresAt: now.Add(maxTTL).Unix(),
+	}
+
+	if err := db.AddRetiredSigningKey(retired); err != nil {
+		return "", err
+	}
+
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return "", err
+	}
+
+	signingKeyMutex.Lock()
+	defer signingKeyMutex.Unlock()
+
+	newKey, err := generateTokenSigningKey(stateDrv)
+	if err != nil {
+		return "", err
+	}
+
+	log.Infof("Rotated the token signing key; retired key %q is accepted until %s",
+		retired.ID, time.Unix(retired.ExpiresAt, 0).UTC().Format(time.RFC3339))
+
+	return signingKeyID(newKey), nil
+}
+
+// verificationKey is the jwt.Keyfunc of ParseToken(); it returns the key the
+// token was signed with: the RSA public key if tokens are signed with RS256,
+// otherwise the shared key named by its `kid` header, i.e. the current key or
+// a retired one which is still accepted.
+// params:
+//  token: parsed, but not yet verified token
+// return values:
+//  interface{}: the key as a *rsa.PublicKey or []byte
+//  error: if the token isn't signed with the configured method, names a key
+//         which is unknown or no longer accepted, or as returned by consecutive func calls
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	if rsaSigningKey != nil {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return &rsaSigningKey.PublicKey, nil
+	}
+
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+
+	key, err := getTokenSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	kid, _ := token.Header[kidHeader].(string)
+	if common.IsEmpty(kid) {
+		return legacyVerificationKey(token, key), nil
+	}
+
+	if kid == signingKeyID(key) {
+		return []byte(key), nil
+	}
+
+	retired, err := db.GetRetiredSigningKey(kid)
+	if err == auth_errors.ErrKeyNotFound || (err == nil && retired.ExpiresAt <= time.Now().Unix()) {
+		return nil, fmt.Errorf("Unknown or expired token signing key %q", kid)
+	} else if err != nil {
+		return nil, err
+	}
+
+	retiredKey, err := common.Decrypt(retired.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(retiredKey), nil
+}
+
+// legacyVerificationKey returns the key a token without `kid` header, i.e.
+// issued before key IDs were introduced, was signed with: the current key or,
+// if the signature doesn't match it, the retired key it matches.
+// params:
+//  token: parsed, but not yet verified token without `kid` header
+//  key: current token signing key
+// return values:
+//  []byte: the matching key; the current key if none matches
+func legacyVerificationKey(token *jwt.Token, key string) []byte {
+	parts := strings.Split(token.Raw, ".")
+	signingString := strings.Join(parts[0:2], ".")
+
+	if token.Method.Verify(signingString, parts[2], []byte(key)) == nil {
+		return []byte(key)
+	}
+
+	retiredKeys, err := db.ListRetiredSigningKeys(time.Now().Unix())
+	if err != nil {
+		log.Warnf("Failed to list retired token signing keys: %#v", err)
+		return []byte(key)
+	}
+
+	for _, retired := range retiredKeys {
+		retiredKey, err := common.Decrypt(retired.Key)
+		if err != nil {
+			log.Warnf("Failed to decrypt retired token signing key %q: %#v", retired.ID, err)
+			continue
+		}
+
+		if token.Method.Verify(signingString, parts[2], []byte(retiredKey)) == nil {
+			return []byte(retiredKey)
+		}
+	}
+
+	return []byte(key)
+}
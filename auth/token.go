@@ -3,12 +3,16 @@ package auth
 import (
 	"fmt"
 	"math/rand"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	jwt "github.com/dgrijalva/jwt-go"
+	uuid "github.com/satori/go.uuid"
 
+	"github.com/contiv/auth_proxy/auth/ldap"
 	"github.com/contiv/auth_proxy/common"
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
 	"github.com/contiv/auth_proxy/common/types"
@@ -19,7 +23,7 @@ import (
 // This file contains all utility methods to create and handle JWT tokens
 
 const (
-	// TokenValidityInHours represents the token validity; used to set token expiry
+	// TokenValidityInHours is the default token validity; see TokenTTL()
 	TokenValidityInHours = 10
 
 	// our randomly generated token signing key will be 128 characters before encryption
@@ -30,6 +34,50 @@ const (
 
 	// UsernameClaimKey is only added to the token, and is not part of authorization db
 	UsernameClaimKey = "username"
+
+	// IDClaimKey holds the unique token ID; used to revoke individual tokens
+	IDClaimKey = "jti"
+
+	// tokenIssuer is the "iss" claim of all the tokens we issue
+	tokenIssuer = "auth_proxy"
+
+	// PasswordChangeOnlyClaimKey is set on tokens which can only be used to change
+	// the user's password, e.g. because it expired
+	PasswordChangeOnlyClaimKey = "password_change_only"
+
+	// CachedAuthClaimKey is set on tokens issued using a cached LDAP login
+	// because the directory was unreachable
+	CachedAuthClaimKey = "cached_auth"
+
+	// IssuedAtClaimKey holds the time the token was issued at; see Token.IssuedAt()
+	IssuedAtClaimKey = "issued_at"
+
+	// AccessTokenClaimKey is set on tokens standing in for a personal access token
+	AccessTokenClaimKey = "access_token"
+
+	// ClientCertClaimKey is set on tokens standing in for a TLS client certificate
+	ClientCertClaimKey = "client_cert"
+
+	// AttributesClaimKey holds attributes of LDAP users read from the directory
+	// at login, e.g. their display name; see ldap.UserAttributes()
+	AttributesClaimKey = "attributes"
+
+	// GroupRoleClaimKey holds the base role of LDAP users mapped from their
+	// groups; see Token.AddGroupRoleClaim()
+	GroupRoleClaimKey = "group_role"
+
+	// defaultTokenRefreshWindow is used if common.TokenRefreshWindowKey isn't set
+	defaultTokenRefreshWindow = 20
+)
+
+// signingKeyMutex serializes the generation of new token signing keys
+var signingKeyMutex sync.Mutex
+
+// recordedTokenTTL is the longest token validity known to be recorded in the
+// data store (see recordTokenTTL()); guarded by recordedTokenTTLMutex
+var (
+	recordedTokenTTLMutex sync.Mutex
+	recordedTokenTTL      time.Duration
 )
 
 func init() {
@@ -60,9 +108,16 @@ func generateTokenSigningKey(stateDrv types.StateDriver) (string, error) {
 	return string(key), nil
 }
 
-// getTokenSigningKey decrypts and returns the existing token signing key or generates, encrypts,
+// getTokenSigningKey returns the token signing key from the secrets backend if it holds one.
+// Otherwise, it decrypts and returns the existing token signing key or generates, encrypts,
 // stores, and returns a brand new one.
 func getTokenSigningKey() (string, error) {
+	if key, err := common.GetSecret(common.SecretTokenSigningKey); err == nil {
+		return string(key), nil
+	} else if err != auth_errors.ErrSecretNotConfigured {
+		return "", err
+	}
+
 	stateDrv, err := state.GetStateDriver()
 	if err != nil {
 		return "", err
@@ -70,6 +125,14 @@ func getTokenSigningKey() (string, error) {
 
 	// check for an existing existing key
 	existingKey, err := stateDrv.Read(db.GetPath(db.RootTokenSigningKey))
+	if err == auth_errors.ErrKeyNotFound {
+		// make sure concurrent logins don't generate (and overwrite) different keys
+		signingKeyMutex.Lock()
+		defer signingKeyMutex.Unlock()
+
+		existingKey, err = stateDrv.Read(db.GetPath(db.RootTokenSigningKey))
+	}
+
 	switch err {
 	case auth_errors.ErrKeyNotFound:
 		// generate, encrypt, store, and return a new key
@@ -102,9 +165,19 @@ func NewToken() *Token {
 
 	authZ.tkn = jwt.New(jwt.SigningMethodHS256)
 
+	now := time.Now()
+	ttl := TokenTTL()
+	recordTokenTTL(ttl)
+
 	// provide any reserved claims here
-	authZ.AddClaim("exp", time.Now().Add(time.Hour*TokenValidityInHours).Unix()) // expiration time
-	authZ.AddClaim("iss", "auth_proxy")                                          // issuer
+	authZ.AddClaim("exp", now.Add(ttl).Unix())        // expiration time
+	authZ.AddClaim("iss", issuer())                   // issuer
+	authZ.AddClaim(IDClaimKey, uuid.NewV4().String()) // token ID
+	authZ.AddClaim(IssuedAtClaimKey, now.Unix())      // issue time; the TTL may change
+
+	if audience := tokenSetting(common.TokenAudienceKey); !common.IsEmpty(audience) {
+		authZ.AddClaim("aud", audience) // audience
+	}
 
 	return authZ
 }
@@ -131,6 +204,8 @@ func NewTokenWithClaims(principals []string) (*Token, error) {
 		authZ.AddRoleClaim(principal)
 	}
 
+	authZ.AddGroupRoleClaim(principals)
+
 	return authZ, nil
 }
 
@@ -162,7 +237,10 @@ func (authZ *Token) AddPrincipalsClaim(principals []string) error {
 // implementation at API level doesn't look at the role claim in Token - rather
 // it pulls the current state from state store based on principals. This makes
 // authorization changes almost instantaneous, at an increased cost of round
-// trip communication with state store.
+// trip communication with state store. Temporary authorizations are only
+// checked that way: the claim carries the principal's base role from its
+// permanent authorizations, so that it never outlives a temporary one, and
+// the token stays valid once a temporary authorization expired.
 //
 // params:
 //  principal: a security principal associated with a user
@@ -170,22 +248,29 @@ func (authZ *Token) AddPrincipalsClaim(principals []string) error {
 //  error: nil if successful, else relevant error if claim is malformed.
 func (authZ *Token) AddRoleClaim(principal string) error {
 
-	authz, err := db.ListAuthorizationsByClaimAndPrincipal(types.RoleClaimKey, principal)
+	claims, err := principalClaims(types.RoleClaimKey, principal)
 	if err != nil {
 		return err
 	}
 
+	authz := []types.Authorization{}
+	for _, a := range claims {
+		if a.ExpiresAt == 0 {
+			authz = append(authz, a)
+		}
+	}
+
 	l := len(authz)
 	switch {
-	// If no authorizations are found, this user has not been authorized to
-	// access any resources yet. Return success without adding the claim.
+	// If no permanent authorizations are found, this user has no base role.
+	// Return success without adding the claim.
 	case l == 0:
 		return nil
 
 	default:
-		grantedRole, err := types.Role(authz[0].ClaimValue)
-		// Invalid claim in authorizations db, skip over
-		if err != nil {
+		_, grantedRole, ok := highestRole(authz)
+		// Invalid claims in authorizations db, skip over
+		if !ok {
 			return nil
 		}
 
@@ -216,6 +301,67 @@ func (authZ *Token) AddRoleClaim(principal string) error {
 	return nil
 }
 
+// AddGroupRoleClaim adds a claim of type key="group_role" value=<RoleType>
+// carrying the base role the principals are mapped to by the LDAP
+// configuration (see types.LdapConfiguration.GroupRoles), and raises the role
+// claim to it if it's higher. Unlike authorizations, which are looked up at
+// runtime, the mapping is evaluated when the token is issued, so a changed
+// mapping applies at the user's next login or refresh, just like a changed
+// group membership.
+//
+// Only LDAP groups are mapped: their DNs can't be mistaken for the names of
+// local users.
+//
+// params:
+//  principals: security principals associated with a user
+func (authZ *Token) AddGroupRoleClaim(principals []string) {
+	role, found := ldap.GroupsRole(principals)
+	if !found {
+		return
+	}
+
+	authZ.AddClaim(GroupRoleClaimKey, role.String())
+
+	v, ok := authZ.tkn.Claims.(jwt.MapClaims)[types.RoleClaimKey]
+	if ok {
+		if availableRole, err := types.Role(v.(string)); err == nil && availableRole <= role {
+			return
+		}
+	}
+
+	authZ.AddClaim(types.RoleClaimKey, role.String())
+}
+
+// groupRole returns the base role carried by the token (see AddGroupRoleClaim())
+// return values:
+//  types.RoleType: the base role
+//  bool: false if the token carries none
+func (authZ *Token) groupRole() (types.RoleType, bool) {
+	v, ok := authZ.tkn.Claims.(jwt.MapClaims)[GroupRoleClaimKey].(string)
+	if !ok {
+		return types.Invalid, false
+	}
+
+	role, err := types.Role(v)
+	if err != nil {
+		log.Debug("malformed group role claim, error:", err)
+		return types.Invalid, false
+	}
+
+	return role, true
+}
+
+// capExpiry makes the token expire no later than the given time.
+// params:
+//  expiresAt: time in seconds since the epoch; ignored if 0
+func (authZ *Token) capExpiry(expiresAt int64) {
+	if expiresAt == 0 || expiresAt >= authZ.ExpiresAt() {
+		return
+	}
+
+	authZ.AddClaim("exp", expiresAt)
+}
+
 // AddClaim adds a claim to an existing authorization token object. A claim is
 // a key value pair, where key is a string which encodes the object, such as a
 // role, tenant, etc. Since Add is called on a map, it also serves to update the claim.
@@ -239,12 +385,7 @@ func (authZ *Token) Stringify() (string, error) {
 	// Retrieve signed string encoded representation of underlying JWT token object.
 	log.Debugf("Claims %#v", authZ.tkn.Claims.(jwt.MapClaims))
 
-	key, err := getTokenSigningKey()
-	if err != nil {
-		return "", err
-	}
-
-	tokenString, err := authZ.tkn.SignedString([]byte(key))
+	tokenString, err := signToken(authZ.tkn)
 	if err != nil {
 		log.Errorf("Failed to sign token %#v", err)
 		return "", err
@@ -289,29 +430,27 @@ func GenerateClaimKey(object interface{}) (string, error) {
 //      any other error that happened during token parsing.
 func ParseToken(tokenStr string) (*Token, error) {
 	// parse and validate the token
-	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
+	token, err := jwt.Parse(tokenStr, verificationKey)
 
-		key, err := getTokenSigningKey()
-		if err != nil {
-			return nil, err
-		}
-
-		return []byte(key), nil
-	})
-
-	switch err.(type) {
+	switch vErr := err.(type) {
 	case nil: // no error
 		if !token.Valid { // expired
 			log.Warn("Invalid token")
 			return nil, fmt.Errorf("Invalid token: %#v", err)
 		}
 
+		if err := checkIssuerAndAudience(token.Claims.(jwt.MapClaims)); err != nil {
+			log.Warnf("Rejected token issued for another environment: %s", err.Error())
+			return nil, err
+		}
+
 		return &Token{tkn: token}, nil
 
 	case *jwt.ValidationError: // something was wrong during the validation
+		if vErr.Errors == jwt.ValidationErrorExpired { // nothing but the expiry
+			return nil, auth_errors.ErrTokenExpired
+		}
+
 		log.Errorf("Error validating access token %#v", err)
 		return nil, fmt.Errorf("Error validating access token %#v", err)
 
@@ -321,6 +460,127 @@ func ParseToken(tokenStr string) (*Token, error) {
 	}
 }
 
+// IsForeignToken checks whether the given string is a JWT which was not issued by
+// us, e.g. a Kubernetes ServiceAccount token. The signature is not checked.
+// Tokens issued by other environments (see token_issuer) are foreign as well.
+// params:
+//  tokenStr: string encoding of a JWT object.
+// return values:
+//  bool: true if tokenStr is a well-formed JWT with an issuer other than ours
+func IsForeignToken(tokenStr string) bool {
+	token, err := jwt.Parse(tokenStr, nil) // only decodes the token without a key
+	if vErr, ok := err.(*jwt.ValidationError); !ok || vErr.Errors&jwt.ValidationErrorMalformed != 0 {
+		return false
+	}
+
+	iss, _ := token.Claims.(jwt.MapClaims)["iss"].(string)
+	return iss != tokenIssuer && iss != issuer()
+}
+
+// tokenSetting returns the value of the given setting; empty if it isn't set
+func tokenSetting(key string) string {
+	value, err := common.Global().Get(key)
+	if err != nil {
+		return ""
+	}
+
+	return value
+}
+
+// TokenTTL returns the validity of new tokens configured under
+// common.TokenTTLKey; TokenValidityInHours if it isn't set.
+func TokenTTL() time.Duration {
+	if ttl, err := time.ParseDuration(tokenSetting(common.TokenTTLKey)); err == nil && ttl > 0 {
+		return ttl
+	}
+
+	return time.Hour * TokenValidityInHours
+}
+
+// MaxTokenTTL returns the longest validity any token issued so far may have,
+// i.e. the longest TTL which has been in effect; revocations have to last at
+// least that long.
+// return values:
+//  time.Duration: the longer of TokenTTL() and the longest TTL tokens were issued with
+//  error: as returned by db.MaxTokenTTL()
+func MaxTokenTTL() (time.Duration, error) {
+	ttl := TokenTTL()
+
+	recorded, err := db.MaxTokenTTL()
+	if err != nil {
+		return 0, err
+	}
+
+	if maxTTL := time.Duration(recorded) * time.Second; maxTTL > ttl {
+		return maxTTL, nil
+	}
+
+	return ttl, nil
+}
+
+// recordTokenTTL records in the data store that a token is issued with the
+// given validity, unless a longer one is recorded already. Failing to record
+// it is logged; it's tried again when the next token is issued.
+func recordTokenTTL(ttl time.Duration) {
+	recordedTokenTTLMutex.Lock()
+	defer recordedTokenTTLMutex.Unlock()
+
+	if ttl <= recordedTokenTTL {
+		return
+	}
+
+	// round up to whole seconds
+	if err := db.RecordTokenTTL(int64((ttl + time.Second - 1) / time.Second)); err != nil {
+		log.Warnf("Failed to record the token TTL %s: %s", ttl, err)
+		return
+	}
+
+	recordedTokenTTL = ttl
+}
+
+// issuer returns the "iss" claim of the tokens we issue
+func issuer() string {
+	if iss := tokenSetting(common.TokenIssuerKey); !common.IsEmpty(iss) {
+		return iss
+	}
+
+	return tokenIssuer
+}
+
+// checkIssuerAndAudience checks the "iss" and "aud" claims of a token against
+// token_issuer and token_audience; either is only checked if it's set.
+// params:
+//  claims: claims of a token with a valid signature
+// return values:
+//  error: nil if the claims match, otherwise ErrTokenWrongIssuer or ErrTokenWrongAudience
+func checkIssuerAndAudience(claims jwt.MapClaims) error {
+	if expected := tokenSetting(common.TokenIssuerKey); !common.IsEmpty(expected) {
+		if iss, _ := claims["iss"].(string); iss != expected {
+			return auth_errors.ErrTokenWrongIssuer
+		}
+	}
+
+	if expected := tokenSetting(common.TokenAudienceKey); !common.IsEmpty(expected) {
+		// "aud" is either a single string or a list of strings
+		switch aud := claims["aud"].(type) {
+		case string:
+			if aud == expected {
+				return nil
+			}
+		case []interface{}:
+			for _, a := range aud {
+				if a == expected {
+					return nil
+				}
+			}
+		}
+
+		return auth_errors.ErrTokenWrongAudience
+	}
+
+	return nil
+}
+
 // GetClaim returns the value of the given claim key
 // params:
 //  claimKey: string representing the claim key
@@ -342,6 +602,137 @@ func (authZ *Token) GetClaim(claimKey string) string {
 	return claimVal
 }
 
+// ID returns the unique ID of the token; empty for tokens issued before IDs were introduced
+func (authZ *Token) ID() string {
+	return authZ.GetClaim(IDClaimKey)
+}
+
+// ExpiresAt returns the expiry time of the token
+// return values:
+//  int64: expiry time in seconds since the epoch; 0 if the token has no valid "exp" claim
+func (authZ *Token) ExpiresAt() int64 {
+	switch exp := authZ.tkn.Claims.(jwt.MapClaims)["exp"].(type) {
+	case float64: // parsed tokens
+		return int64(exp)
+	case int64: // tokens created by NewToken()
+		return exp
+	default:
+		return 0
+	}
+}
+
+// IssuedAt returns the time the token was issued at. There's no "iat" claim;
+// jwt-go would reject tokens issued by another instance of the proxy whose
+// clock is slightly ahead, so it's kept in a custom claim instead. Tokens
+// issued before the claim was introduced were issued TokenValidityInHours
+// before they expire.
+// return values:
+//  int64: issue time in seconds since the epoch
+func (authZ *Token) IssuedAt() int64 {
+	switch iat := authZ.tkn.Claims.(jwt.MapClaims)[IssuedAtClaimKey].(type) {
+	case float64: // parsed tokens
+		return int64(iat)
+	case int64: // tokens created by NewToken()
+		return iat
+	default:
+		return authZ.ExpiresAt() - int64((time.Hour*TokenValidityInHours)/time.Second)
+	}
+}
+
+// refreshWindow returns the last part (in percent) of a token's lifetime
+// during which it can be refreshed; 0 if refreshing tokens is disabled.
+func refreshWindow() int64 {
+	value := tokenSetting(common.TokenRefreshWindowKey)
+	if common.IsEmpty(value) {
+		return defaultTokenRefreshWindow
+	}
+
+	percent, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || percent <= 0 {
+		return 0
+	}
+
+	return percent
+}
+
+// refreshable checks whether the token is within its refresh window
+// params:
+//  now: current time in seconds since the epoch
+// return values:
+//  bool: true if the token hasn't expired yet and at most refreshWindow()
+//    percent of its lifetime are left
+func (authZ *Token) refreshable(now int64) bool {
+	expiresAt := authZ.ExpiresAt()
+	lifetime := expiresAt - authZ.IssuedAt()
+
+	return now < expiresAt && now >= expiresAt-lifetime*refreshWindow()/100
+}
+
+// Principals returns the security principals the token was issued for; none
+// for tokens which can only be used to change the password
+func (authZ *Token) Principals() []string {
+	principals := authZ.GetClaim(principalsClaimKey)
+	if common.IsEmpty(principals) {
+		return nil
+	}
+
+	return strings.Split(principals, ";")
+}
+
+// AddAttributesClaim adds the given attributes of the user to the token; tokens
+// of users without attributes carry no such claim.
+// params:
+//  attributes: attribute values by attribute name
+func (authZ *Token) AddAttributesClaim(attributes map[string]string) {
+	if len(attributes) > 0 {
+		authZ.AddClaim(AttributesClaimKey, attributes)
+	}
+}
+
+// Attributes returns the attributes of the user the token was issued for; none
+// for local users and tokens issued before attributes were introduced
+func (authZ *Token) Attributes() map[string]string {
+	switch claim := authZ.tkn.Claims.(jwt.MapClaims)[AttributesClaimKey].(type) {
+	case map[string]string: // tokens created by NewToken()
+		return claim
+	case map[string]interface{}: // parsed tokens
+		attributes := map[string]string{}
+		for name, value := range claim {
+			if s, ok := value.(string); ok {
+				attributes[name] = s
+			}
+		}
+
+		return attributes
+	default:
+		return nil
+	}
+}
+
+// CachedAuth returns true if the token was issued using a cached LDAP login
+func (authZ *Token) CachedAuth() bool {
+	cached, _ := authZ.tkn.Claims.(jwt.MapClaims)[CachedAuthClaimKey].(bool)
+	return cached
+}
+
+// AccessToken returns true if the token stands in for a personal access token
+func (authZ *Token) AccessToken() bool {
+	pat, _ := authZ.tkn.Claims.(jwt.MapClaims)[AccessTokenClaimKey].(bool)
+	return pat
+}
+
+// ClientCertificate returns true if the token stands in for a TLS client certificate
+func (authZ *Token) ClientCertificate() bool {
+	cert, _ := authZ.tkn.Claims.(jwt.MapClaims)[ClientCertClaimKey].(bool)
+	return cert
+}
+
+// PasswordChangeOnly returns true if the token can only be used to change the user's password
+func (authZ *Token) PasswordChangeOnly() bool {
+	restricted, _ := authZ.tkn.Claims.(jwt.MapClaims)[PasswordChangeOnlyClaimKey].(bool)
+	return restricted
+}
+
 // IsSuperuser checks if the token belongs to a superuser (i.e. `admin` in our
 // system). It queries the authorization database to obtain this information.
 // params:
@@ -351,12 +742,18 @@ func (authZ *Token) GetClaim(claimKey string) string {
 //  true if the token belongs to superuser else false
 func (authZ *Token) IsSuperuser() bool {
 
+	// The base role mapped from the user's LDAP groups
+	if role, ok := authZ.groupRole(); ok && role == types.Admin {
+		log.Debug("admin role mapped from the user's LDAP groups")
+		return true
+	}
+
 	// Deserialize principals as a slice
 	principals := strings.Split(authZ.GetClaim(principalsClaimKey), ";")
 
 	for _, p := range principals {
 		// Get role claim for the principal
-		authz, err := db.ListAuthorizationsByClaimAndPrincipal(types.RoleClaimKey, p)
+		authz, err := principalClaims(types.RoleClaimKey, p)
 		// If not found, ignore error and move on to next principal
 		if err != nil || len(authz) == 0 {
 			log.Debug("no admin claim found for principal ", p)
@@ -364,9 +761,8 @@ func (authZ *Token) IsSuperuser() bool {
 		}
 
 		// If not a valid role, ignore error and move on to next principal
-		r, err := types.Role(authz[0].ClaimValue)
-		if err != nil {
-			log.Error("invalid role claim found for principal ", p)
+		_, r, ok := highestRole(authz)
+		if !ok {
 			continue
 		}
 
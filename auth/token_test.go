@@ -0,0 +1,380 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+)
+
+// signedToken returns a JWT with the given issuer signed with an arbitrary key
+func signedToken(t *testing.T, issuer string) string {
+	claims := jwt.MapClaims{"sub": "system:serviceaccount:default:controller"}
+	if issuer != "" {
+		claims["iss"] = issuer
+	}
+
+	tokenStr, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("not our key"))
+	if err != nil {
+		t.Fatalf("failed to sign token: %s", err)
+	}
+
+	return tokenStr
+}
+
+// TestIsForeignToken tests telling our tokens apart from other JWTs
+func TestIsForeignToken(t *testing.T) {
+	testCases := []struct {
+		description string
+		token       string
+		expected    bool
+	}{
+		{"kubernetes issuer", signedToken(t, "kubernetes/serviceaccount"), true},
+		{"no issuer", signedToken(t, ""), true},
+		{"our issuer", signedToken(t, tokenIssuer), false},
+		{"not a JWT", "asdf", false},
+		{"garbage segments", "a.b.c", false},
+		{"empty", "", false},
+	}
+
+	for _, tc := range testCases {
+		if foreign := IsForeignToken(tc.token); foreign != tc.expected {
+			t.Errorf("%s: expected %t, got %t", tc.description, tc.expected, foreign)
+		}
+	}
+}
+
+// TestTokenIssuedAt tests that new tokens are issued now
+func TestTokenIssuedAt(t *testing.T) {
+	before := time.Now().Unix()
+	token := NewToken()
+
+	if issuedAt := token.IssuedAt(); issuedAt < before || issuedAt > time.Now().Unix() {
+		t.Errorf("expected the token to be issued now, got %d", issuedAt)
+	}
+}
+
+// TestTokenTTL tests that new tokens expire after the configured TTL
+func TestTokenTTL(t *testing.T) {
+	defer common.Global().Set(common.TokenTTLKey, "")
+
+	testCases := []struct {
+		ttl      string
+		expected time.Duration
+	}{
+		{"", time.Hour * TokenValidityInHours},
+		{"garbage", time.Hour * TokenValidityInHours},
+		{"-1h", time.Hour * TokenValidityInHours},
+		{"30m", 30 * time.Minute},
+		{"24h", 24 * time.Hour},
+	}
+
+	for _, tc := range testCases {
+		common.Global().Set(common.TokenTTLKey, tc.ttl)
+
+		token := NewToken()
+		if lifetime := time.Duration(token.ExpiresAt()-token.IssuedAt()) * time.Second; lifetime != tc.expected {
+			t.Errorf("%q: expected tokens to be valid for %s, got %s", tc.ttl, tc.expected, lifetime)
+		}
+	}
+
+	// tokens issued before the TTL became configurable were valid for TokenValidityInHours
+	common.Global().Set(common.TokenTTLKey, "")
+
+	before := time.Now().Unix()
+	token := NewToken()
+	delete(token.tkn.Claims.(jwt.MapClaims), IssuedAtClaimKey)
+
+	if issuedAt := token.IssuedAt(); issuedAt < before || issuedAt > time.Now().Unix() {
+		t.Errorf("expected the token to be issued now, got %d", issuedAt)
+	}
+}
+
+// TestCheckIssuerAndAudience tests rejecting tokens of other environments
+func TestCheckIssuerAndAudience(t *testing.T) {
+	defer func() {
+		common.Global().Set(common.TokenIssuerKey, "")
+		common.Global().Set(common.TokenAudienceKey, "")
+	}()
+
+	testCases := []struct {
+		description string
+		issuer      string
+		audience    string
+		claims      jwt.MapClaims
+		expected    error
+	}{
+		{"nothing configured", "", "", jwt.MapClaims{"iss": tokenIssuer}, nil},
+		{"audience not checked", "", "", jwt.MapClaims{"iss": tokenIssuer, "aud": "staging"}, nil},
+		{"same issuer", "prod", "", jwt.MapClaims{"iss": "prod"}, nil},
+		{"other issuer", "prod", "", jwt.MapClaims{"iss": "staging"}, auth_errors.ErrTokenWrongIssuer},
+		{"no issuer", "prod", "", jwt.MapClaims{}, auth_errors.ErrTokenWrongIssuer},
+		{"same audience", "", "prod", jwt.MapClaims{"aud": "prod"}, nil},
+		{"audience in list", "", "prod", jwt.MapClaims{"aud": []interface{}{"staging", "prod"}}, nil},
+		{"other audience", "", "prod", jwt.MapClaims{"aud": "staging"}, auth_errors.ErrTokenWrongAudience},
+		{"other audiences", "", "prod", jwt.MapClaims{"aud": []interface{}{"staging"}}, auth_errors.ErrTokenWrongAudience},
+		{"no audience", "", "prod", jwt.MapClaims{}, auth_errors.ErrTokenWrongAudience},
+	}
+
+	for _, tc := range testCases {
+		common.Global().Set(common.TokenIssuerKey, tc.issuer)
+		common.Global().Set(common.TokenAudienceKey, tc.audience)
+
+		if err := checkIssuerAndAudience(tc.claims); err != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.description, tc.expected, err)
+		}
+	}
+
+	// tokens issued by us before the issuer was configured aren't foreign
+	common.Global().Set(common.TokenIssuerKey, "prod")
+	if IsForeignToken(signedToken(t, "prod")) || IsForeignToken(signedToken(t, tokenIssuer)) {
+		t.Error("expected tokens of either issuer not to be foreign")
+	}
+}
+
+// TestCapExpiry tests that tokens which expire early keep their issue time
+func TestCapExpiry(t *testing.T) {
+	token := NewToken()
+	issuedAt, expiresAt := token.IssuedAt(), token.ExpiresAt()
+
+	token.capExpiry(0)
+	token.capExpiry(expiresAt + 60)
+	if token.ExpiresAt() != expiresAt {
+		t.Errorf("expected the expiry to be unchanged, got %d instead of %d", token.ExpiresAt(), expiresAt)
+	}
+
+	token.capExpiry(issuedAt + 2)
+	if token.ExpiresAt() != issuedAt+2 || token.IssuedAt() != issuedAt {
+		t.Errorf("expected issue/expiry time %d/%d, got %d/%d",
+			issuedAt, issuedAt+2, token.IssuedAt(), token.ExpiresAt())
+	}
+}
+
+// TestTokenRefreshable tests that tokens can only be refreshed at the end of their lifetime
+func TestTokenRefreshable(t *testing.T) {
+	defer common.Global().Set(common.TokenRefreshWindowKey, "")
+
+	token := NewToken()
+	issuedAt, expiresAt := token.IssuedAt(), token.ExpiresAt()
+	lifetime := expiresAt - issuedAt
+
+	testCases := []struct {
+		description string
+		window      string
+		now         int64
+		expected    bool
+	}{
+		{"fresh token", "", issuedAt, false},
+		{"before the default window", "", expiresAt - lifetime/5 - 1, false},
+		{"start of the default window", "", expiresAt - lifetime/5, true},
+		{"about to expire", "", expiresAt - 1, true},
+		{"expired", "", expiresAt, false},
+		{"whole lifetime", "100", issuedAt, true},
+		{"before the window", "50", expiresAt - lifetime/2 - 1, false},
+		{"within the window", "50", expiresAt - lifetime/2, true},
+		{"disabled", "0", expiresAt - 1, false},
+	}
+
+	for _, tc := range testCases {
+		common.Global().Set(common.TokenRefreshWindowKey, tc.window)
+
+		if refreshable := token.refreshable(tc.now); refreshable != tc.expected {
+			t.Errorf("%s: expected %t, got %t", tc.description, tc.expected, refreshable)
+		}
+	}
+
+	// tokens which expire early can be refreshed at the end of their shorter lifetime
+	common.Global().Set(common.TokenRefreshWindowKey, "")
+	token.capExpiry(issuedAt + 100)
+
+	if token.refreshable(issuedAt+79) || !token.refreshable(issuedAt+80) {
+		t.Error("expected the window to be based on the token's actual lifetime")
+	}
+}
+
+// TestSigningKeyID tests that key IDs tell keys apart without revealing them
+func TestSigningKeyID(t *testing.T) {
+	id := signingKeyID("first key")
+
+	if id != signingKeyID("first key") {
+		t.Error("the ID of a key changed")
+	}
+
+	if id == signingKeyID("second key") {
+		t.Error("different keys have the same ID")
+	}
+
+	if len(id) != 16 {
+		t.Errorf("expected a 16 character ID, got %q", id)
+	}
+}
+
+// TestLegacyVerificationKey tests that tokens without key ID signed with the
+// current key are verified with it
+func TestLegacyVerificationKey(t *testing.T) {
+	tokenStr, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"iss": tokenIssuer}).SignedString([]byte("current key"))
+	if err != nil {
+		t.Fatalf("failed to sign token: %s", err)
+	}
+
+	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+		return legacyVerificationKey(token, "current key"), nil
+	})
+	if err != nil || !token.Valid {
+		t.Errorf("token signed with the current key was rejected: %v", err)
+	}
+}
+
+// TestRS256Signing tests that tokens are signed and verified with the RSA key
+// if RS256 is configured, and that HS256 tokens are rejected then
+func TestRS256Signing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_proxy_rs256")
+	if err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	keyFile := filepath.Join(dir, "signing.key")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("failed to write key: %s", err)
+	}
+
+	defer func() {
+		common.Global().Set(common.TokenSigningMethodKey, "")
+		common.Global().Set(common.TokenSigningKeyFileKey, "")
+		InitTokenSigning()
+	}()
+
+	common.Global().Set(common.TokenSigningMethodKey, common.TokenSigningRS256)
+
+	for _, path := range []string{"", filepath.Join(dir, "missing.key")} {
+		common.Global().Set(common.TokenSigningKeyFileKey, path)
+		if err := InitTokenSigning(); err == nil {
+			t.Errorf("%q: expected an error", path)
+		}
+	}
+
+	common.Global().Set(common.TokenSigningKeyFileKey, keyFile)
+	if err := InitTokenSigning(); err != nil {
+		t.Fatalf("failed to initialize token signing: %s", err)
+	}
+
+	publicKey, kid := SigningPublicKey()
+	if publicKey == nil || publicKey.N.Cmp(key.N) != 0 {
+		t.Fatal("the public key doesn't match the signing key")
+	}
+
+	tokenStr, err := NewToken().Stringify()
+	if err != nil {
+		t.Fatalf("failed to sign token: %s", err)
+	}
+
+	// others can verify it with the public key alone
+	verified, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+		return publicKey, nil
+	})
+	if err != nil || verified.Header["alg"] != "RS256" || verified.Header[kidHeader] != kid {
+		t.Errorf("unexpected token %v: %v", verified, err)
+	}
+
+	if _, err := ParseToken(tokenStr); err != nil {
+		t.Errorf("RS256 token was rejected: %s", err)
+	}
+
+	if _, err := ParseToken(signedToken(t, tokenIssuer)); err == nil {
+		t.Error("HS256 token was accepted")
+	}
+}
+
+// TestIsAccessToken tests telling personal access tokens apart from JWTs
+func TestIsAccessToken(t *testing.T) {
+	id, secret := strings.Repeat("a", 2*accessTokenIDLength), strings.Repeat("b", 2*accessTokenSecretLength)
+
+	testCases := []struct {
+		description string
+		token       string
+		expected    bool
+	}{
+		{"access token", accessTokenPrefix + id + "_" + secret, true},
+		{"prefix only", accessTokenPrefix + id, false},
+		{"short secret", accessTokenPrefix + id + "_" + secret[1:], false},
+		{"extra part", accessTokenPrefix + id + "_" + secret + "_" + secret, false},
+		{"JWT", signedToken(t, tokenIssuer), false},
+		{"empty", "", false},
+	}
+
+	for _, tc := range testCases {
+		if pat := IsAccessToken(tc.token); pat != tc.expected {
+			t.Errorf("%s: expected %t, got %t", tc.description, tc.expected, pat)
+		}
+
+		if IsForeignToken(tc.token) && tc.expected {
+			t.Errorf("%s: access token taken for a foreign token", tc.description)
+		}
+	}
+}
+
+// TestAccessTokenRefresh tests that tokens standing in for personal access
+// tokens can't be refreshed
+func TestAccessTokenRefresh(t *testing.T) {
+	token := NewToken()
+	token.AddClaim(IssuedAtClaimKey, time.Now().Add(-365*24*time.Hour).Unix())
+	token.AddClaim(AccessTokenClaimKey, true)
+
+	if _, err := RefreshToken(token); err != auth_errors.ErrTokenRefreshNotAllowed {
+		t.Errorf("expected ErrTokenRefreshNotAllowed, got %v", err)
+	}
+}
+
+// TestTokenAttributes tests that the attributes of users survive the token's
+// encoding, and that tokens without attributes carry none
+func TestTokenAttributes(t *testing.T) {
+	attributes := map[string]string{"displayName": "John Doe", "mail": "jdoe@example.com"}
+
+	token := NewToken()
+	token.AddAttributesClaim(attributes)
+	if !reflect.DeepEqual(token.Attributes(), attributes) {
+		t.Errorf("expected attributes %v, got %v", attributes, token.Attributes())
+	}
+
+	// parsed tokens hold the claims decoded from JSON
+	encoded, err := json.Marshal(token.tkn.Claims)
+	if err != nil {
+		t.Fatalf("failed to encode claims: %s", err)
+	}
+
+	claims := jwt.MapClaims{}
+	if err := json.Unmarshal(encoded, &claims); err != nil {
+		t.Fatalf("failed to decode claims: %s", err)
+	}
+
+	parsed := &Token{tkn: &jwt.Token{Claims: claims}}
+	if !reflect.DeepEqual(parsed.Attributes(), attributes) {
+		t.Errorf("expected parsed attributes %v, got %v", attributes, parsed.Attributes())
+	}
+
+	token = NewToken()
+	token.AddAttributesClaim(map[string]string{})
+	if _, found := token.tkn.Claims.(jwt.MapClaims)[AttributesClaimKey]; found || token.Attributes() != nil {
+		t.Errorf("expected no attributes, got %v", token.Attributes())
+	}
+}
@@ -0,0 +1,365 @@
+package common
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// This file contains the validation of the startup configuration. Unlike
+// ValidateSettings(), which guards every reload, it also checks the settings
+// which are only read at startup and the files they name, and it reports all
+// the problems it finds instead of stopping at the first one.
+
+// configCheck checks one aspect of the configuration.
+// params:
+//  settings: complete set of settings to be checked
+// return values:
+//  error: nil if the configuration is fine, otherwise a description of the problem
+type configCheck func(settings map[string]string) error
+
+// configChecks returns all the checks done by CheckConfiguration()
+func configChecks() []configCheck {
+	checks := []configCheck{
+		ValidateSettings,
+		checkTLSKeyPair,
+		checkPreviousTLSKeys,
+		checkSecretsBackend,
+		checkAddress(ListenAddressKey),
+		checkAddress(NetmasterAddressKey),
+		checkDistinctAddresses,
+		checkDataStoreAddress,
+		checkDataStoreTLS,
+		checkNonNegativeInteger(DataStoreStartupTimeoutKey),
+		checkConsulOptions,
+		checkPositiveInteger(ClientReadTimeoutKey),
+		checkPositiveInteger(ClientWriteTimeoutKey),
+		checkKubernetesOptions,
+		checkTokenSigningKey,
+		checkClientCertAuth,
+		checkDirectory(UIAssetsPathKey),
+	}
+
+	for _, key := range []string{KubernetesCAFileKey, KubernetesReviewerTokenFileKey} {
+		checks = append(checks, checkFile(key))
+	}
+
+	return checks
+}
+
+// CheckConfiguration checks the configuration the proxy is started with: files
+// must exist and be readable, addresses and durations must be well-formed and
+// options must not contradict each other. Nothing is contacted over the network.
+// params:
+//  flagSettings: settings set from flags; the environment and configuration
+//                file are layered on top of them like ReloadSettings() does,
+//                but settings stored in the data store aren't
+// return values:
+//  []error: all the problems found; empty if there are none
+func CheckConfiguration(flagSettings map[string]string) []error {
+	problems := []error{}
+
+	settings, err := localSettings(flagSettings)
+	if err != nil {
+		problems = append(problems, err)
+
+		// check the rest of the settings without the broken configuration file
+		withoutFile := map[string]string{}
+		for key, value := range flagSettings {
+			withoutFile[key] = value
+		}
+		delete(withoutFile, ConfigFileKey)
+
+		if settings, err = localSettings(withoutFile); err != nil {
+			return problems // the file is named by the environment
+		}
+	}
+
+	for _, check := range configChecks() {
+		if err := check(settings); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	return problems
+}
+
+// CheckReadable checks that the given path names a readable file (or directory).
+// params:
+//  name: name of the setting or flag holding the path, used in the error
+//  path: path to be checked
+//  dir: true if the path must be a directory, false if it must be a file
+// return values:
+//  error: nil if the path can be read
+func CheckReadable(name, path string, dir bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %s", name, path, err.Error())
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %s", name, path, err.Error())
+	}
+
+	if info.IsDir() != dir {
+		if dir {
+			return fmt.Errorf("invalid %s %q: not a directory", name, path)
+		}
+
+		return fmt.Errorf("invalid %s %q: is a directory", name, path)
+	}
+
+	return nil
+}
+
+// checkFile returns a check that the file named by the given key, if any, can be read
+func checkFile(key string) configCheck {
+	return func(settings map[string]string) error {
+		if path := settings[key]; !IsEmpty(path) {
+			return CheckReadable(key, path, false)
+		}
+
+		return nil
+	}
+}
+
+// checkDirectory returns a check that the directory named by the given key, if any, can be read
+func checkDirectory(key string) configCheck {
+	return func(settings map[string]string) error {
+		if path := settings[key]; !IsEmpty(path) {
+			return CheckReadable(key, path, true)
+		}
+
+		return nil
+	}
+}
+
+// checkTLSKeyPair checks that both the TLS certificate and key are given and
+// that they form a valid key pair
+func checkTLSKeyPair(settings map[string]string) error {
+	if tlsFromVault(settings) {
+		return nil // Vault isn't contacted, InitSecrets() checks the key pair
+	}
+
+	cert, key := settings[TLSCertificateKey], settings[TLSKeyFileKey]
+	if IsEmpty(cert) || IsEmpty(key) {
+		return fmt.Errorf("both %s and %s are required", TLSCertificateKey, TLSKeyFileKey)
+	}
+
+	for name, path := range map[string]string{TLSCertificateKey: cert, TLSKeyFileKey: key} {
+		if err := CheckReadable(name, path, false); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tls.LoadX509KeyPair(cert, key); err != nil {
+		return fmt.Errorf("invalid %s/%s: %s", TLSCertificateKey, TLSKeyFileKey, err.Error())
+	}
+
+	return nil
+}
+
+// checkAddress returns a check that the given key holds a host:port address
+func checkAddress(key string) configCheck {
+	return func(settings map[string]string) error {
+		value := settings[key]
+
+		_, port, err := net.SplitHostPort(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: must be host:port", key, value)
+		}
+
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+			return fmt.Errorf("invalid %s %q: invalid port %q", key, value, port)
+		}
+
+		return nil
+	}
+}
+
+// checkDistinctAddresses checks that we don't proxy requests to ourselves
+func checkDistinctAddresses(settings map[string]string) error {
+	if listen := settings[ListenAddressKey]; !IsEmpty(listen) && listen == settings[NetmasterAddressKey] {
+		return fmt.Errorf("%s and %s must differ (%q)", ListenAddressKey, NetmasterAddressKey, listen)
+	}
+
+	return nil
+}
+
+// checkDataStoreAddress checks that the data store address names a supported data store
+func checkDataStoreAddress(settings map[string]string) error {
+	value := settings[DataStoreAddressKey]
+
+	name, _, _, err := ParseDataStoreAddresses(value)
+	if err != nil || (name != "etcd" && name != "etcdv3" && name != "consul") {
+		return fmt.Errorf("invalid %s %q: must be etcd://host:port, etcdv3://host:port or consul://host:port, "+
+			"with %s appended to the scheme to connect over TLS; the endpoints of a cluster are separated by %q and use the same scheme",
+			DataStoreAddressKey, value, DataStoreHTTPSSuffix, DataStoreEndpointSeparator)
+	}
+
+	return nil
+}
+
+// checkDataStoreTLS checks that the data store TLS options are only given with
+// an https data store address, and that their files can be read
+func checkDataStoreTLS(settings map[string]string) error {
+	options := &DataStoreTLSOptions{
+		CAFile:   settings[DataStoreCAFileKey],
+		CertFile: settings[DataStoreCertFileKey],
+		KeyFile:  settings[DataStoreKeyFileKey],
+	}
+
+	insecure, err := strconv.ParseBool(settings[DataStoreInsecureSkipVerifyKey])
+	if err != nil && !IsEmpty(settings[DataStoreInsecureSkipVerifyKey]) {
+		return fmt.Errorf("invalid %s %q: must be true or false", DataStoreInsecureSkipVerifyKey, settings[DataStoreInsecureSkipVerifyKey])
+	}
+
+	endpoint, secure := settings[DataStoreAddressKey], false
+	if _, hostPorts, https, err := ParseDataStoreAddresses(endpoint); err == nil {
+		endpoint, secure = strings.Join(hostPorts, ", "), https
+	}
+
+	if !secure {
+		if !options.IsEmpty() || insecure {
+			return fmt.Errorf("data store TLS options are set but %s %q doesn't use %s", DataStoreAddressKey, settings[DataStoreAddressKey], DataStoreHTTPSSuffix)
+		}
+
+		return nil
+	}
+
+	// InsecureSkipVerify is left out so that its warning is only logged when connecting
+	_, err = DataStoreTLSConfig(endpoint, options)
+	return err
+}
+
+// checkConsulOptions checks that the consul datacenter and stale reads are only
+// set with a consul data store address
+func checkConsulOptions(settings map[string]string) error {
+	allowStale, err := strconv.ParseBool(settings[ConsulAllowStaleReadsKey])
+	if err != nil && !IsEmpty(settings[ConsulAllowStaleReadsKey]) {
+		return fmt.Errorf("invalid %s %q: must be true or false", ConsulAllowStaleReadsKey, settings[ConsulAllowStaleReadsKey])
+	}
+
+	if IsEmpty(settings[ConsulDatacenterKey]) && !allowStale {
+		return nil
+	}
+
+	if name, _, _, err := ParseDataStoreAddresses(settings[DataStoreAddressKey]); err == nil && name != "consul" {
+		return fmt.Errorf("%s and %s are only used with consul but %s is %q",
+			ConsulDatacenterKey, ConsulAllowStaleReadsKey, DataStoreAddressKey, settings[DataStoreAddressKey])
+	}
+
+	return nil
+}
+
+// checkPositiveInteger returns a check that the given key holds an integer > 0, e.g. a duration in seconds
+func checkPositiveInteger(key string) configCheck {
+	return func(settings map[string]string) error {
+		value := settings[key]
+		if n, err := strconv.ParseInt(value, 10, 64); err != nil || n <= 0 {
+			return fmt.Errorf("invalid %s %q: must be an integer > 0", key, value)
+		}
+
+		return nil
+	}
+}
+
+// checkNonNegativeInteger returns a check that the given key, if set, holds an integer >= 0
+func checkNonNegativeInteger(key string) configCheck {
+	return func(settings map[string]string) error {
+		value, found := settings[key]
+		if !found {
+			return nil
+		}
+
+		if n, err := strconv.ParseInt(value, 10, 64); err != nil || n < 0 {
+			return fmt.Errorf("invalid %s %q: must be an integer >= 0", key, value)
+		}
+
+		return nil
+	}
+}
+
+// checkKubernetesOptions checks that the Kubernetes CA and reviewer token are
+// only given along with the API server they're used for
+func checkKubernetesOptions(settings map[string]string) error {
+	if !IsEmpty(settings[KubernetesAPIServerKey]) {
+		return nil
+	}
+
+	for _, key := range []string{KubernetesCAFileKey, KubernetesReviewerTokenFileKey} {
+		if !IsEmpty(settings[key]) {
+			return fmt.Errorf("%s is set but %s isn't", key, KubernetesAPIServerKey)
+		}
+	}
+
+	return nil
+}
+
+// checkPreviousTLSKeys checks that the previous TLS keys, if any, are readable RSA private keys
+func checkPreviousTLSKeys(settings map[string]string) error {
+	for _, path := range strings.Split(settings[PreviousTLSKeyFilesKey], ",") {
+		if path = strings.TrimSpace(path); IsEmpty(path) {
+			continue
+		}
+
+		if _, err := ReadRSAPrivateKey(path); err != nil {
+			return fmt.Errorf("invalid %s %q: %s", PreviousTLSKeyFilesKey, path, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// checkTokenSigningKey checks that a readable RSA private key is given for
+// RS256 token signing, and only then
+func checkTokenSigningKey(settings map[string]string) error {
+	path := settings[TokenSigningKeyFileKey]
+
+	if settings[TokenSigningMethodKey] != TokenSigningRS256 {
+		if !IsEmpty(path) {
+			return fmt.Errorf("%s is set but %s isn't %q", TokenSigningKeyFileKey, TokenSigningMethodKey, TokenSigningRS256)
+		}
+
+		return nil
+	}
+
+	if IsEmpty(path) {
+		return fmt.Errorf("%s is required with %s %q", TokenSigningKeyFileKey, TokenSigningMethodKey, TokenSigningRS256)
+	}
+
+	if _, err := ReadRSAPrivateKey(path); err != nil {
+		return fmt.Errorf("invalid %s %q: %s", TokenSigningKeyFileKey, path, err.Error())
+	}
+
+	return nil
+}
+
+// checkClientCertAuth checks that a readable CA bundle is given for client
+// certificate authentication, and only then
+func checkClientCertAuth(settings map[string]string) error {
+	path := settings[ClientCAFileKey]
+
+	if enabled, _ := strconv.ParseBool(settings[ClientCertAuthKey]); !enabled {
+		if !IsEmpty(path) {
+			return fmt.Errorf("%s is set but %s isn't", ClientCAFileKey, ClientCertAuthKey)
+		}
+
+		return nil
+	}
+
+	if IsEmpty(path) {
+		return fmt.Errorf("%s is required with %s", ClientCAFileKey, ClientCertAuthKey)
+	}
+
+	if _, err := ReadCertPool(path); err != nil {
+		return fmt.Errorf("invalid %s %q: %s", ClientCAFileKey, path, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed certificate and its key to the given directory
+func writeKeyPair(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "auth_proxy"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "local.key")
+	writeConfigFile(t, certFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})))
+	writeConfigFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})))
+
+	return certFile, keyFile
+}
+
+// TestCheckConfiguration tests that every invalid setting is reported
+func TestCheckConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_proxy_check")
+	if err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeKeyPair(t, dir)
+	configFile := filepath.Join(dir, "config.json")
+	writeConfigFile(t, configFile, `{"log_level": "info"}`)
+
+	valid := func() map[string]string {
+		return map[string]string{
+			ConfigFileKey:                  configFile,
+			DataStoreAddressKey:            "etcd://127.0.0.1:2379",
+			ListenAddressKey:               ":10000",
+			NetmasterAddressKey:            "localhost:9999",
+			TLSCertificateKey:              certFile,
+			TLSKeyFileKey:                  keyFile,
+			ClientReadTimeoutKey:           "5",
+			ClientWriteTimeoutKey:          "11",
+			NetmasterTimeoutKey:            "10",
+			KubernetesAPIServerKey:         "https://kubernetes.default.svc",
+			KubernetesCAFileKey:            certFile,
+			KubernetesReviewerTokenFileKey: keyFile,
+			UIAssetsPathKey:                dir,
+		}
+	}
+
+	if problems := CheckConfiguration(valid()); len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	rs256 := valid()
+	rs256[TokenSigningMethodKey] = TokenSigningRS256
+	rs256[TokenSigningKeyFileKey] = writeRSAKey(t, dir)
+
+	if problems := CheckConfiguration(rs256); len(problems) != 0 {
+		t.Fatalf("unexpected problems with RS256: %v", problems)
+	}
+
+	clientCerts := valid()
+	clientCerts[ClientCertAuthKey] = "true"
+	clientCerts[ClientCAFileKey] = certFile
+
+	if problems := CheckConfiguration(clientCerts); len(problems) != 0 {
+		t.Fatalf("unexpected problems with client certificate authentication: %v", problems)
+	}
+
+	etcdV3 := valid()
+	etcdV3[DataStoreAddressKey] = "etcdv3://127.0.0.1:2379"
+
+	if problems := CheckConfiguration(etcdV3); len(problems) != 0 {
+		t.Fatalf("unexpected problems with etcd v3: %v", problems)
+	}
+
+	dataStoreTLS := valid()
+	dataStoreTLS[DataStoreAddressKey] = "etcd+https://127.0.0.1:2379"
+	dataStoreTLS[DataStoreCAFileKey] = certFile
+	dataStoreTLS[DataStoreCertFileKey] = certFile
+	dataStoreTLS[DataStoreKeyFileKey] = keyFile
+
+	if problems := CheckConfiguration(dataStoreTLS); len(problems) != 0 {
+		t.Fatalf("unexpected problems with an https data store: %v", problems)
+	}
+
+	consulOptions := valid()
+	consulOptions[DataStoreAddressKey] = "consul://127.0.0.1:8500"
+	consulOptions[ConsulDatacenterKey] = "dc2"
+	consulOptions[ConsulAllowStaleReadsKey] = "true"
+
+	if problems := CheckConfiguration(consulOptions); len(problems) != 0 {
+		t.Fatalf("unexpected problems with consul options: %v", problems)
+	}
+
+	dataStoreCluster := valid()
+	dataStoreCluster[DataStoreAddressKey] = "etcd://10.0.0.1:2379, etcd://10.0.0.2:2379,etcd://10.0.0.3:2379"
+
+	if problems := CheckConfiguration(dataStoreCluster); len(problems) != 0 {
+		t.Fatalf("unexpected problems with a data store cluster: %v", problems)
+	}
+
+	previousKeys := valid()
+	previousKeys[PreviousTLSKeyFilesKey] = writeRSAKey(t, dir) + ", " + writeRSAKey(t, dir)
+
+	if problems := CheckConfiguration(previousKeys); len(problems) != 0 {
+		t.Fatalf("unexpected problems with previous TLS keys: %v", problems)
+	}
+
+	missing := filepath.Join(dir, "missing")
+
+	testCases := []struct {
+		description string
+		changes     map[string]string
+	}{
+		{"unreadable config file", map[string]string{ConfigFileKey: missing}},
+		{"invalid setting", map[string]string{EndpointPolicyDefaultRoleKey: "guest"}},
+		{"no TLS key", map[string]string{TLSKeyFileKey: ""}},
+		{"unreadable TLS certificate", map[string]string{TLSCertificateKey: missing}},
+		{"mismatched TLS key pair", map[string]string{TLSCertificateKey: configFile}},
+		{"unreadable previous TLS key", map[string]string{PreviousTLSKeyFilesKey: writeRSAKey(t, dir) + "," + missing}},
+		{"previous TLS key isn't an RSA key", map[string]string{PreviousTLSKeyFilesKey: keyFile}},
+		{"listen address without port", map[string]string{ListenAddressKey: "localhost"}},
+		{"netmaster address with invalid port", map[string]string{NetmasterAddressKey: "localhost:http"}},
+		{"netmaster address is our own", map[string]string{NetmasterAddressKey: ":10000"}},
+		{"unsupported data store", map[string]string{DataStoreAddressKey: "zk://127.0.0.1:2181"}},
+		{"data store without port", map[string]string{DataStoreAddressKey: "consul://127.0.0.1"}},
+		{"unsupported https data store", map[string]string{DataStoreAddressKey: "zk+https://127.0.0.1:2181"}},
+		{"data store endpoints with different schemes", map[string]string{DataStoreAddressKey: "etcd://10.0.0.1:2379,etcdv3://10.0.0.2:2379"}},
+		{"data store endpoints with and without https", map[string]string{DataStoreAddressKey: "consul+https://10.0.0.1:8501,consul://10.0.0.2:8500"}},
+		{"data store endpoint without scheme", map[string]string{DataStoreAddressKey: "etcd://10.0.0.1:2379,10.0.0.2:2379"}},
+		{"data store TLS options without https", map[string]string{DataStoreCAFileKey: certFile}},
+		{"data store insecure skip verify without https", map[string]string{DataStoreInsecureSkipVerifyKey: "true"}},
+		{"invalid data store insecure skip verify", map[string]string{DataStoreInsecureSkipVerifyKey: "maybe"}},
+		{"unreadable data store CA", map[string]string{DataStoreAddressKey: "consul+https://127.0.0.1:8501", DataStoreCAFileKey: missing}},
+		{"data store certificate without key", map[string]string{DataStoreAddressKey: "etcdv3+https://127.0.0.1:2379", DataStoreCertFileKey: certFile}},
+		{"negative data store startup timeout", map[string]string{DataStoreStartupTimeoutKey: "-1"}},
+		{"consul datacenter with etcd", map[string]string{ConsulDatacenterKey: "dc2"}},
+		{"consul stale reads with etcd", map[string]string{ConsulAllowStaleReadsKey: "true"}},
+		{"invalid consul stale reads", map[string]string{DataStoreAddressKey: "consul://127.0.0.1:8500", ConsulAllowStaleReadsKey: "sometimes"}},
+		{"mismatched data store key pair", map[string]string{DataStoreAddressKey: "etcd+https://127.0.0.1:2379", DataStoreCertFileKey: certFile, DataStoreKeyFileKey: configFile}},
+		{"invalid client read timeout", map[string]string{ClientReadTimeoutKey: "5s"}},
+		{"invalid client write timeout", map[string]string{ClientWriteTimeoutKey: "eleven"}},
+		{"unreadable Kubernetes CA", map[string]string{KubernetesCAFileKey: missing}},
+		{"Kubernetes token is a directory", map[string]string{KubernetesReviewerTokenFileKey: dir}},
+		{"Kubernetes CA without API server", map[string]string{KubernetesAPIServerKey: "", KubernetesReviewerTokenFileKey: ""}},
+		{"UI assets path is a file", map[string]string{UIAssetsPathKey: configFile}},
+		{"invalid token signing method", map[string]string{TokenSigningMethodKey: "none"}},
+		{"RS256 without signing key", map[string]string{TokenSigningMethodKey: TokenSigningRS256}},
+		{"RS256 signing key isn't an RSA key", map[string]string{TokenSigningMethodKey: TokenSigningRS256, TokenSigningKeyFileKey: keyFile}},
+		{"signing key without RS256", map[string]string{TokenSigningKeyFileKey: writeRSAKey(t, dir)}},
+		{"client certificate authentication without CA file", map[string]string{ClientCertAuthKey: "true"}},
+		{"client CA file isn't PEM", map[string]string{ClientCertAuthKey: "true", ClientCAFileKey: configFile}},
+		{"client CA file without client certificate authentication", map[string]string{ClientCAFileKey: certFile}},
+		{"invalid client certificate identity", map[string]string{ClientCertIdentityKey: "uid"}},
+	}
+
+	for _, tc := range testCases {
+		settings := valid()
+		for key, value := range tc.changes {
+			settings[key] = value
+		}
+
+		// the other settings are valid, so only the changed one may be reported
+		if problems := CheckConfiguration(settings); len(problems) != 1 {
+			t.Errorf("%s: expected one problem, got %v", tc.description, problems)
+		}
+	}
+}
+
+// TestCheckConfigurationReportsAll tests that all the problems are reported at once
+func TestCheckConfigurationReportsAll(t *testing.T) {
+	problems := CheckConfiguration(map[string]string{
+		ConfigFileKey:       "/nonexistent/config.json",
+		ListenAddressKey:    ":10000",
+		NetmasterAddressKey: ":10000",
+	})
+
+	// config file, TLS, same listen and netmaster address, data store, read and write timeouts
+	if len(problems) != 6 {
+		t.Errorf("expected 6 problems, got %d: %v", len(problems), problems)
+	}
+}
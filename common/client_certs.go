@@ -0,0 +1,55 @@
+package common
+
+import (
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// This file contains the helpers of client certificate authentication; see
+// ClientCertAuthKey.
+
+// ReadCertPool reads a bundle of PEM encoded CA certificates.
+// params:
+//  path: path of the bundle
+// return values:
+//  *x509.CertPool: the certificates
+//  error: nil if the file holds at least one certificate, else the appropriate read/parse failure
+func ReadCertPool(path string) (*x509.CertPool, error) {
+	pemData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, errors.New("no PEM encoded certificates found")
+	}
+
+	return pool, nil
+}
+
+// ClientCertIdentity returns the name of the user a verified client certificate
+// authenticates, taken from the field configured under ClientCertIdentityKey.
+// params:
+//  cert: the client's (leaf) certificate
+// return values:
+//  string: the user's name; empty if the certificate lacks the field
+func ClientCertIdentity(cert *x509.Certificate) string {
+	identity, _ := Global().Get(ClientCertIdentityKey)
+
+	switch identity {
+	case ClientCertIdentityDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case ClientCertIdentityEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+
+	return ""
+}
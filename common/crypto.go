@@ -7,8 +7,9 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
-	"fmt"
+	"errors"
 	"io/ioutil"
+	"strconv"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -17,13 +18,46 @@ import (
 )
 
 const (
+	// DefaultPasswordHashCost is used unless PasswordHashCostKey is set.
 	// bcrypt.DefaultCost is 10, but this is too weak for modern hardware.
 	// 13 is a good choice for 2017:
 	//   - strong enough that it won't be considered weak any time soon
 	//   - doesn't take an egregious amount of time to generate hashes
-	cost = 13
+	DefaultPasswordHashCost = 13
 )
 
+// PasswordHashCost returns the bcrypt cost of new password hashes configured
+// under PasswordHashCostKey; DefaultPasswordHashCost if it isn't set.
+func PasswordHashCost() int {
+	value, err := Global().Get(PasswordHashCostKey)
+	if err != nil {
+		return DefaultPasswordHashCost
+	}
+
+	cost, err := strconv.Atoi(value)
+	if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return DefaultPasswordHashCost
+	}
+
+	return cost
+}
+
+// PasswordHashOutdated checks whether the password hash was generated with a
+// lower cost than PasswordHashCost(), so that it should be regenerated the
+// next time the password is known, i.e. on login.
+// params:
+//  passwordHash: hash to be checked
+// return values:
+//  bool: true if the hash's cost is lower than the configured one
+func PasswordHashOutdated(passwordHash []byte) bool {
+	cost, err := bcrypt.Cost(passwordHash)
+	if err != nil {
+		return false
+	}
+
+	return cost < PasswordHashCost()
+}
+
 // GenPasswordHash generates a hash from the provided password.
 // params:
 //  password: plaintext password string
@@ -31,7 +65,7 @@ const (
 //  []byte: hash of password
 //  error: nil if successful, otherwise the error from bcrypt.GenerateFromPassword()
 func GenPasswordHash(password string) ([]byte, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordHashCost())
 	if err != nil {
 		log.Error(err)
 		return nil, err
@@ -81,7 +115,9 @@ func Encrypt(data string) (string, error) {
 	return base64.StdEncoding.EncodeToString(encrypted), nil
 }
 
-// Decrypt decrypts the given string with the RSA private key.
+// Decrypt decrypts the given string with the RSA private key, or with one of
+// the previous ones (see PreviousTLSKeyFilesKey) if it was encrypted before
+// the key was replaced.
 // params:
 //   data: String to decode + decrypt, which is in a base64 encoded format
 // return values:
@@ -89,52 +125,132 @@ func Encrypt(data string) (string, error) {
 //  error: nil if base64 decode and RSA decrypt succeeds, else the
 //         appropriate decode/decrypt failure
 func Decrypt(data string) (string, error) {
+	decrypted, _, err := decrypt(data)
+	return decrypted, err
+}
+
+// EncryptionOutdated checks whether the given string was encrypted with one of
+// the previous RSA private keys, so that it should be re-encrypted with the
+// current one.
+// params:
+//  data: encrypted string, as returned by Encrypt()
+// return values:
+//  bool: true if it was encrypted with a previous key
+//  error: nil if any of the keys decrypts it, else the decode/decrypt failure
+func EncryptionOutdated(data string) (bool, error) {
+	_, current, err := decrypt(data)
+	return err == nil && !current, err
+}
+
+// Reencrypt encrypts the given string with the current RSA private key if it
+// was encrypted with one of the previous ones.
+// params:
+//  data: encrypted string, as returned by Encrypt()
+// return values:
+//  string: the string encrypted with the current key; `data` if it already was
+//  bool: true if it was re-encrypted
+//  error: nil if successful, else the decrypt/encrypt failure
+func Reencrypt(data string) (string, bool, error) {
+	decrypted, current, err := decrypt(data)
+	if err != nil || current {
+		return data, false, err
+	}
+
+	encrypted, err := Encrypt(decrypted)
+	if err != nil {
+		return data, false, err
+	}
+
+	return encrypted, true, nil
+}
+
+// decrypt decrypts the given string with the current RSA private key, or with
+// the previous ones if it fails.
+// return values:
+//  string: Decrypted text
+//  bool: true if it was decrypted with the current key
+//  error: nil if base64 decode and RSA decrypt succeeds, else the
+//         appropriate decode/decrypt failure
+func decrypt(data string) (string, bool, error) {
 	if IsEmpty(data) {
-		return data, nil
+		return data, true, nil
 	}
 	privateKey, err := getPrivateKey()
 
 	if err != nil || privateKey == nil {
 		log.Debugf("Error retrieving RSA Private key: %#v", err)
-		return data, err
+		return data, false, err
 	}
 
-	md5Hash := md5.New()
-
 	encryptedBytes, err := base64.StdEncoding.DecodeString(data)
 	if err != nil {
 		log.Debugf("Base64 decode failed: %#v", err)
-		return data, err
+		return data, false, err
 	}
 
-	decrypted, err := rsa.DecryptOAEP(md5Hash, rand.Reader, privateKey, encryptedBytes, nil)
-	if err != nil {
-		log.Debugf("RSA decryption failed: %#v", err)
-		return data, err
+	decrypted, err := rsa.DecryptOAEP(md5.New(), rand.Reader, privateKey, encryptedBytes, nil)
+	if err == nil {
+		return string(decrypted), true, nil
 	}
 
-	return string(decrypted), nil
+	for _, previousKey := range getPreviousPrivateKeys() {
+		if decrypted, err := rsa.DecryptOAEP(md5.New(), rand.Reader, previousKey, encryptedBytes, nil); err == nil {
+			return string(decrypted), false, nil
+		}
+	}
 
+	log.Debugf("RSA decryption failed: %#v", err)
+	return data, false, err
 }
 
-// getPrivateKey gets the private key from the .key file
+// ReadRSAPrivateKey reads a PEM encoded RSA private key in PKCS #8 or PKCS #1 format.
+// params:
+//  path: path of the key file
 // return values:
-//  *rsa.PrivateKey: RSA private key, which also contains the public key for encryption
-//  error: nil if it reads a valid RSA private key,
-//         else appropriate parse/decoding error.
-func getPrivateKey() (*rsa.PrivateKey, error) {
-	keyFile, err := Global().Get("tls_key_file")
+//  *rsa.PrivateKey: the key, which also contains the public key
+//  error: nil if the file holds a RSA private key, else the appropriate read/parse failure
+func ReadRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	pemData, err := ioutil.ReadFile(path)
 	if err != nil {
-		if err == auth_errors.ErrKeyNotFound {
-			return nil, fmt.Errorf("No TLS key file found")
-		}
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	return parseRSAPrivateKey(block.Bytes)
+}
 
+// parseRSAPrivateKey parses a DER encoded RSA private key in PKCS #1 or PKCS #8 format.
+func parseRSAPrivateKey(der []byte) (*rsa.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
 		return nil, err
 	}
 
-	pemData, err := ioutil.ReadFile(keyFile)
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not a RSA private key")
+	}
+
+	return rsaKey, nil
+}
+
+// getPrivateKey gets the private key of our TLS key pair from the secrets backend
+// return values:
+//  *rsa.PrivateKey: RSA private key, which also contains the public key for encryption
+//  error: nil if it reads a valid RSA private key,
+//         else appropriate parse/decoding error.
+func getPrivateKey() (*rsa.PrivateKey, error) {
+	pemData, err := GetSecret(SecretTLSKey)
 	if err != nil {
-		log.Debugf("Error reading pem file: ", err)
+		log.Debugf("Error reading TLS key: %#v", err)
 		return nil, err
 	}
 
@@ -158,3 +274,31 @@ func getPrivateKey() (*rsa.PrivateKey, error) {
 
 	return privateKey.(*rsa.PrivateKey), nil
 }
+
+// getPreviousPrivateKeys gets the private keys which were replaced by the
+// current one from the secrets backend; keys which can't be parsed are skipped.
+// return values:
+//  []*rsa.PrivateKey: RSA private keys; empty if there are none
+func getPreviousPrivateKeys() []*rsa.PrivateKey {
+	pemData, err := GetSecret(SecretPreviousTLSKeys)
+	if err != nil {
+		if err != auth_errors.ErrSecretNotConfigured {
+			log.Debugf("Error reading previous TLS keys: %#v", err)
+		}
+
+		return nil
+	}
+
+	keys := []*rsa.PrivateKey{}
+	for block, rest := pem.Decode(pemData); block != nil; block, rest = pem.Decode(rest) {
+		key, err := parseRSAPrivateKey(block.Bytes)
+		if err != nil {
+			log.Debug("Failed to decode previous private key: ", err)
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys
+}
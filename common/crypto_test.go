@@ -0,0 +1,162 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestPasswordHashCost tests that new hashes use the configured cost and that
+// hashes with a lower cost still validate, but are reported as outdated
+func TestPasswordHashCost(t *testing.T) {
+	defer Global().Set(PasswordHashCostKey, "")
+
+	for value, expected := range map[string]int{"": DefaultPasswordHashCost, "invalid": DefaultPasswordHashCost, "3": DefaultPasswordHashCost, "5": 5} {
+		Global().Set(PasswordHashCostKey, value)
+
+		if cost := PasswordHashCost(); cost != expected {
+			t.Errorf("%q: expected cost %d, got %d", value, expected, cost)
+		}
+	}
+
+	Global().Set(PasswordHashCostKey, "4")
+
+	oldHash, err := GenPasswordHash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cost, err := bcrypt.Cost(oldHash); err != nil || cost != 4 {
+		t.Fatalf("expected cost 4, got %d (%v)", cost, err)
+	}
+
+	if PasswordHashOutdated(oldHash) {
+		t.Error("hash with the configured cost is reported as outdated")
+	}
+
+	Global().Set(PasswordHashCostKey, "5")
+
+	if !ValidatePassword("password", oldHash) {
+		t.Error("hash with a lower cost no longer validates")
+	}
+
+	if !PasswordHashOutdated(oldHash) {
+		t.Error("hash with a lower cost isn't reported as outdated")
+	}
+
+	if PasswordHashOutdated([]byte("not a hash")) {
+		t.Error("invalid hash is reported as outdated")
+	}
+}
+
+// writeRSAKey writes a new RSA private key to the given directory
+func writeRSAKey(t *testing.T, dir string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	file, err := ioutil.TempFile(dir, "rsa")
+	if err != nil {
+		t.Fatalf("failed to create key file: %s", err)
+	}
+	defer file.Close()
+
+	if err := pem.Encode(file, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}); err != nil {
+		t.Fatalf("failed to write key file: %s", err)
+	}
+
+	return file.Name()
+}
+
+// TestReadRSAPrivateKey tests reading RSA private keys
+func TestReadRSAPrivateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_proxy_rsa")
+	if err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := ReadRSAPrivateKey(writeRSAKey(t, dir)); err != nil {
+		t.Errorf("failed to read key: %s", err)
+	}
+
+	_, ecKey := writeKeyPair(t, dir)
+	notPEM := filepath.Join(dir, "not.pem")
+	writeConfigFile(t, notPEM, "not a key")
+
+	for _, path := range []string{filepath.Join(dir, "missing"), notPEM, ecKey} {
+		if _, err := ReadRSAPrivateKey(path); err == nil {
+			t.Errorf("%s: expected an error", path)
+		}
+	}
+}
+
+// TestKeyRotation tests that data encrypted with a TLS key is still read once
+// the key is replaced, and is re-encrypted with the new key
+func TestKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_proxy_rsa")
+	if err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer Global().Set(TLSKeyFileKey, "")
+	defer Global().Set(PreviousTLSKeyFilesKey, "")
+
+	keyA, keyB := writeRSAKey(t, dir), writeRSAKey(t, dir)
+	Global().Set(TLSKeyFileKey, keyA)
+
+	encryptedA, err := Encrypt("s3cr3t")
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err)
+	}
+
+	if outdated, err := EncryptionOutdated(encryptedA); err != nil || outdated {
+		t.Errorf("expected data encrypted with the current key to be up to date, got %v (%v)", outdated, err)
+	}
+
+	// key A is replaced by key B
+	Global().Set(TLSKeyFileKey, keyB)
+
+	if _, err := Decrypt(encryptedA); err == nil {
+		t.Error("expected data encrypted with an unknown key not to be decrypted")
+	}
+
+	Global().Set(PreviousTLSKeyFilesKey, writeRSAKey(t, dir)+","+keyA)
+
+	if decrypted, err := Decrypt(encryptedA); err != nil || decrypted != "s3cr3t" {
+		t.Errorf("expected to decrypt %q with the previous key, got %q (%v)", "s3cr3t", decrypted, err)
+	}
+
+	if outdated, err := EncryptionOutdated(encryptedA); err != nil || !outdated {
+		t.Errorf("expected data encrypted with the previous key to be outdated, got %v (%v)", outdated, err)
+	}
+
+	encryptedB, reencrypted, err := Reencrypt(encryptedA)
+	if err != nil || !reencrypted {
+		t.Fatalf("expected data encrypted with the previous key to be re-encrypted, got %v (%v)", reencrypted, err)
+	}
+
+	if again, reencrypted, err := Reencrypt(encryptedB); err != nil || reencrypted || again != encryptedB {
+		t.Errorf("expected data encrypted with the current key to be left alone, got %v (%v)", reencrypted, err)
+	}
+
+	// the previous key is no longer needed
+	Global().Set(PreviousTLSKeyFilesKey, "")
+
+	if decrypted, err := Decrypt(encryptedB); err != nil || decrypted != "s3cr3t" {
+		t.Errorf("expected to decrypt %q with the current key, got %q (%v)", "s3cr3t", decrypted, err)
+	}
+
+	if _, _, err := Reencrypt(encryptedA); err == nil {
+		t.Error("expected data encrypted with a removed key not to be re-encrypted")
+	}
+}
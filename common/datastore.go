@@ -0,0 +1,144 @@
+package common
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// This file contains the helpers of connecting to the data store over TLS; see
+// DataStoreCAFileKey.
+
+// DataStoreHTTPSSuffix is appended to the scheme of a data store address to
+// connect to it over TLS, e.g. etcd+https://host:2379
+const DataStoreHTTPSSuffix = "+https"
+
+// DataStoreEndpointSeparator separates the endpoints of a data store cluster
+// in its address, e.g. etcd://host1:2379,etcd://host2:2379
+const DataStoreEndpointSeparator = ","
+
+// DataStoreTLSOptions holds the files and options used to connect to the data
+// store over TLS
+type DataStoreTLSOptions struct {
+	CAFile             string // PEM bundle of the CAs the data store's certificate is verified with; the system's if empty
+	CertFile           string // PEM file of the client certificate presented to the data store, if any
+	KeyFile            string // PEM file of the client certificate's key
+	InsecureSkipVerify bool   // if set, the data store's certificate isn't verified
+}
+
+// IsEmpty returns true if none of the options is set
+func (o *DataStoreTLSOptions) IsEmpty() bool {
+	return o == nil || *o == DataStoreTLSOptions{}
+}
+
+// ParseDataStoreAddress splits a data store address like etcd://host:2379 or
+// consul+https://host:8501
+// params:
+//  address: the data store address
+// return values:
+//  string: the name of the data store, e.g. "etcd"
+//  string: the host:port of the data store
+//  bool: true if the data store is connected to over TLS
+//  error: nil if the address is of the form name[+https]://host:port
+func ParseDataStoreAddress(address string) (string, string, bool, error) {
+	parts := strings.SplitN(address, "://", 2)
+	if len(parts) != 2 {
+		return "", "", false, errors.New("missing scheme")
+	}
+
+	name, secure := strings.TrimSuffix(parts[0], DataStoreHTTPSSuffix), strings.HasSuffix(parts[0], DataStoreHTTPSSuffix)
+
+	if _, _, err := net.SplitHostPort(parts[1]); err != nil {
+		return "", "", false, err
+	}
+
+	return name, parts[1], secure, nil
+}
+
+// ParseDataStoreAddresses splits a data store address listing the endpoints of
+// a cluster, e.g. etcd://host1:2379,etcd://host2:2379; a single endpoint is
+// accepted too
+// params:
+//  address: the data store address
+// return values:
+//  string: the name of the data store, e.g. "etcd"
+//  []string: the host:port of each endpoint
+//  bool: true if the data store is connected to over TLS
+//  error: nil if every endpoint is of the form name[+https]://host:port with the same scheme
+func ParseDataStoreAddresses(address string) (string, []string, bool, error) {
+	var (
+		name, scheme string
+		hostPorts    []string
+		secure       bool
+	)
+
+	for _, endpoint := range strings.Split(address, DataStoreEndpointSeparator) {
+		endpoint = strings.TrimSpace(endpoint)
+
+		endpointName, hostPort, endpointSecure, err := ParseDataStoreAddress(endpoint)
+		if err != nil {
+			return "", nil, false, fmt.Errorf("endpoint %q: %s", endpoint, err.Error())
+		}
+
+		endpointScheme := strings.SplitN(endpoint, "://", 2)[0]
+		if len(hostPorts) == 0 {
+			name, scheme, secure = endpointName, endpointScheme, endpointSecure
+		} else if endpointScheme != scheme {
+			return "", nil, false, fmt.Errorf("endpoint %q doesn't use the scheme %s:// of the first endpoint", endpoint, scheme)
+		}
+
+		hostPorts = append(hostPorts, hostPort)
+	}
+
+	return name, hostPorts, secure, nil
+}
+
+// DataStoreTLSConfig builds the configuration used to connect to the data
+// store over TLS.
+// params:
+//  endpoint: host:port of the data store (or of its endpoints), for messages
+//  options: the files and options to use
+// return values:
+//  *tls.Config: the configuration
+//  error: nil if the CA bundle and client key pair can be read, else the failure naming the file
+func DataStoreTLSConfig(endpoint string, options *DataStoreTLSOptions) (*tls.Config, error) {
+	if options == nil {
+		options = &DataStoreTLSOptions{}
+	}
+
+	config := &tls.Config{InsecureSkipVerify: options.InsecureSkipVerify}
+
+	if !IsEmpty(options.CAFile) {
+		pool, err := ReadCertPool(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA file %q of data store %s: %s", options.CAFile, endpoint, err.Error())
+		}
+
+		config.RootCAs = pool
+	}
+
+	if IsEmpty(options.CertFile) != IsEmpty(options.KeyFile) {
+		return nil, fmt.Errorf("both %s and %s are required for a client certificate", DataStoreCertFileKey, DataStoreKeyFileKey)
+	}
+
+	if !IsEmpty(options.CertFile) {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the client certificate %q and key %q of data store %s: %s",
+				options.CertFile, options.KeyFile, endpoint, err.Error())
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if options.InsecureSkipVerify {
+		log.Warnf("The certificate of data store %s isn't verified as %s is set; it must only be used in labs",
+			endpoint, DataStoreInsecureSkipVerifyKey)
+	}
+
+	return config, nil
+}
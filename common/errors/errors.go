@@ -37,6 +37,41 @@ const (
 	LDAPMultipleEntries
 	LocalAuthenticationFailed
 
+	DatastoreUnavailable
+
+	KubernetesUnavailable
+	KubernetesAccessDenied
+
+	TokenExpired
+	TokenWrongIssuer
+	TokenWrongAudience
+
+	LDAPCachedLoginExpired
+
+	UnknownResponseShape
+
+	SecretNotConfigured
+
+	TokenRefreshNotAllowed
+
+	SigningKeyManaged
+
+	OTPRequired
+
+	InvalidOTP
+
+	ConcurrentUpdate
+
+	LastAdmin
+
+	RoleInUse
+
+	LDAPTLSFailed
+
+	UserDisabled
+
+	DatastoreAccessDenied
+
 	// N.B. Add all new error codes above this line.  All error codes >=
 	// LastError are invalid.
 	LastError
@@ -128,9 +163,68 @@ var ErrLDAPGroupsNotFound = NewError(LDAPGroupsNotFound, "No groups found, canno
 // ErrLDAPMultipleEntries used when LDAP/AD search returns multiple results when 1 is expected
 var ErrLDAPMultipleEntries = NewError(LDAPMultipleEntries, "Expected single entry; found multiple entries in AD")
 
+// ErrLDAPTLSFailed used when a TLS connection couldn't be negotiated with `LDAP/Active Directory`
+var ErrLDAPTLSFailed = NewError(LDAPTLSFailed, "LDAP/AD TLS negotiation failed")
+
+// ErrLDAPCachedLoginExpired used when a cached LDAP/AD login is too old to be used
+var ErrLDAPCachedLoginExpired = NewError(LDAPCachedLoginExpired, "Cached LDAP/AD login expired")
+
 // ErrLocalAuthenticationFailed used when local authentication fails
 var ErrLocalAuthenticationFailed = NewError(LocalAuthenticationFailed, "Local authentication failed")
 
+// ErrDatastoreUnavailable is returned without contacting the datastore while
+// the state driver's circuit breaker is open
+var ErrDatastoreUnavailable = NewError(DatastoreUnavailable, "datastore unavailable")
+
+// ErrDatastoreAccessDenied is returned when the datastore's ACLs deny an
+// operation, e.g. because consul's ACL token is missing or lacks a rule for our keys
+var ErrDatastoreAccessDenied = NewError(DatastoreAccessDenied, "datastore access denied by its ACLs; check the datastore's ACL token")
+
+// ErrKubernetesUnavailable used when the Kubernetes TokenReview API couldn't be called
+var ErrKubernetesUnavailable = NewError(KubernetesUnavailable, "Kubernetes API server unavailable")
+
+// ErrKubernetesAccessDenied used when Kubernetes didn't authenticate a token as a ServiceAccount
+var ErrKubernetesAccessDenied = NewError(KubernetesAccessDenied, "Kubernetes access denied")
+
+// ErrTokenExpired used when a token is valid except for having expired
+var ErrTokenExpired = NewError(TokenExpired, "token expired")
+
+// ErrTokenWrongIssuer used when a token was issued by another environment (see token_issuer)
+var ErrTokenWrongIssuer = NewError(TokenWrongIssuer, "wrong token issuer")
+
+// ErrTokenWrongAudience used when a token was issued for another environment (see token_audience)
+var ErrTokenWrongAudience = NewError(TokenWrongAudience, "wrong token audience")
+
+// ErrUnknownResponseShape used when a netmaster response can't be filtered because its shape isn't recognized
+var ErrUnknownResponseShape = NewError(UnknownResponseShape, "unknown response shape")
+
+// ErrSecretNotConfigured used when the secrets backend doesn't hold a secret, e.g. the token signing key
+var ErrSecretNotConfigured = NewError(SecretNotConfigured, "secret not configured")
+
+// ErrTokenRefreshNotAllowed used when a token can't be refreshed (yet); see token_refresh_window
+var ErrTokenRefreshNotAllowed = NewError(TokenRefreshNotAllowed, "token refresh not allowed")
+
+// ErrSigningKeyManaged used when the token signing key is held by the secrets backend or a key file and can't be rotated by us
+var ErrSigningKeyManaged = NewError(SigningKeyManaged, "token signing key is managed outside the proxy")
+
+// ErrOTPRequired used when a local user with MFA enabled logs in without a one-time password
+var ErrOTPRequired = NewError(OTPRequired, "one-time password required")
+
+// ErrInvalidOTP used when the one-time password given by a local user with MFA enabled is wrong
+var ErrInvalidOTP = NewError(InvalidOTP, "invalid one-time password")
+
+// ErrConcurrentUpdate used when an object changed between being read and being updated
+var ErrConcurrentUpdate = NewError(ConcurrentUpdate, "object was updated concurrently")
+
+// ErrLastAdmin used when an operation would leave no principal with the admin role
+var ErrLastAdmin = NewError(LastAdmin, "the last admin can't be removed")
+
+// ErrRoleInUse used when a custom role which is still granted is to be deleted
+var ErrRoleInUse = NewError(RoleInUse, "role is still granted")
+
+// ErrUserDisabled used when a local user who was disabled logs in with the right password
+var ErrUserDisabled = NewError(UserDisabled, "user is disabled")
+
 //
 // AuthError describes an error response message
 //
@@ -0,0 +1,135 @@
+package identity
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// This library signs and verifies the identity headers which auth_proxy adds
+// to the requests it forwards to netmaster after authorizing them, so that
+// netmaster can make its own decisions without validating tokens. Netmaster
+// should only trust the headers if Verify() succeeds. It only depends on the
+// standard library so that netmaster can use it as is.
+//
+// The signature is a hex-encoded HMAC-SHA256, keyed with the secret shared by
+// auth_proxy and netmaster, over the user, role, tenants and request path,
+// each separated by a newline (which cannot appear in a header value).
+
+const (
+	// UserHeader carries the username of the user, i.e. the DN of LDAP users
+	UserHeader = "X-Proxy-User"
+
+	// RoleHeader carries the role of the user: "admin" or "ops"
+	RoleHeader = "X-Proxy-Role"
+
+	// TenantsHeader carries the comma-separated names of the tenants the user
+	// is authorized for; empty for admins, who are authorized for all of them
+	TenantsHeader = "X-Proxy-Tenants"
+
+	// SignatureHeader carries the signature of the other headers and the request path
+	SignatureHeader = "X-Proxy-Signature"
+)
+
+// Headers lists all the identity headers
+var Headers = []string{UserHeader, RoleHeader, TenantsHeader, SignatureHeader}
+
+var (
+	// ErrMissingSignature is returned by Verify() if the request isn't signed
+	ErrMissingSignature = errors.New("missing identity signature")
+
+	// ErrInvalidSignature is returned by Verify() if the signature doesn't match
+	ErrInvalidSignature = errors.New("invalid identity signature")
+)
+
+// Identity is the identity of an authorized user.
+//
+// Fields:
+//  User: username of the user
+//  Role: "admin" or "ops"
+//  Tenants: tenants the user is authorized for
+//
+type Identity struct {
+	User    string
+	Role    string
+	Tenants []string
+}
+
+// Sign computes the signature of the given identity for a request.
+// params:
+//  secret: secret shared with netmaster
+//  id: identity of the user
+//  path: path of the request as seen by netmaster
+// return values:
+//  string: hex-encoded signature
+func Sign(secret []byte, id Identity, path string) string {
+	return sign(secret, id.User, id.Role, strings.Join(id.Tenants, ","), path)
+}
+
+// sign computes the signature over the values of the identity headers and the path
+func sign(secret []byte, user, role, tenants, path string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{user, role, tenants, path}, "\n")))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// StripHeaders removes all the identity headers; it must be called on every
+// request received from a client before it's forwarded.
+// params:
+//  header: headers of the request
+func StripHeaders(header http.Header) {
+	for _, name := range Headers {
+		header.Del(name)
+	}
+}
+
+// SetHeaders replaces the identity headers with the given identity and its signature.
+// params:
+//  header: headers of the request to be forwarded
+//  secret: secret shared with netmaster
+//  id: identity of the user
+//  path: path of the request as seen by netmaster
+func SetHeaders(header http.Header, secret []byte, id Identity, path string) {
+	StripHeaders(header)
+
+	header.Set(UserHeader, id.User)
+	header.Set(RoleHeader, id.Role)
+	header.Set(TenantsHeader, strings.Join(id.Tenants, ","))
+	header.Set(SignatureHeader, Sign(secret, id, path))
+}
+
+// Verify checks the signature of the identity headers of a request and
+// returns the identity they carry.
+// params:
+//  header: headers of the received request
+//  secret: secret shared with auth_proxy
+//  path: path of the received request, i.e. req.URL.Path
+// return values:
+//  *Identity: identity of the user if the signature is valid
+//  error: nil if the signature is valid, ErrMissingSignature or ErrInvalidSignature otherwise
+func Verify(header http.Header, secret []byte, path string) (*Identity, error) {
+	signature := header.Get(SignatureHeader)
+	if signature == "" {
+		return nil, ErrMissingSignature
+	}
+
+	user := header.Get(UserHeader)
+	role := header.Get(RoleHeader)
+	tenants := header.Get(TenantsHeader)
+
+	expected := sign(secret, user, role, tenants, path)
+	if len(secret) == 0 || !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, ErrInvalidSignature
+	}
+
+	id := &Identity{User: user, Role: role, Tenants: []string{}}
+	if tenants != "" {
+		id.Tenants = strings.Split(tenants, ",")
+	}
+
+	return id, nil
+}
@@ -0,0 +1,90 @@
+package identity
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// TestSignAndVerify tests that only untampered identity headers are accepted
+func TestSignAndVerify(t *testing.T) {
+	secret := []byte("shared secret")
+	path := "/api/v1/networks/t1:n1/"
+	id := Identity{User: "CN=John Doe,OU=eng,DC=example,DC=com", Role: "ops", Tenants: []string{"t1", "t2"}}
+
+	header := http.Header{}
+	SetHeaders(header, secret, id, path)
+
+	verified, err := Verify(header, secret, path)
+	if err != nil {
+		t.Fatalf("failed to verify signed headers: %s", err)
+	}
+
+	if !reflect.DeepEqual(*verified, id) {
+		t.Errorf("expected %#v, got %#v", id, *verified)
+	}
+
+	// the signature is deterministic, so netmaster can compute it on its own
+	if header.Get(SignatureHeader) != Sign(secret, id, path) {
+		t.Errorf("unexpected signature %q", header.Get(SignatureHeader))
+	}
+
+	testCases := []struct {
+		description string
+		tamper      func(http.Header)
+		secret      []byte
+		path        string
+		expected    error
+	}{
+		{"other user", func(h http.Header) { h.Set(UserHeader, "admin") }, secret, path, ErrInvalidSignature},
+		{"other role", func(h http.Header) { h.Set(RoleHeader, "admin") }, secret, path, ErrInvalidSignature},
+		{"more tenants", func(h http.Header) { h.Set(TenantsHeader, "t1,t2,t3") }, secret, path, ErrInvalidSignature},
+		{"tenants moved into the user", func(h http.Header) {
+			h.Set(UserHeader, h.Get(UserHeader)+"\nops\nt1,t2,t3")
+		}, secret, path, ErrInvalidSignature},
+		{"other path", func(h http.Header) {}, secret, "/api/v1/networks/t2:n1/", ErrInvalidSignature},
+		{"other secret", func(h http.Header) {}, []byte("guessed"), path, ErrInvalidSignature},
+		{"no secret", func(h http.Header) {}, nil, path, ErrInvalidSignature},
+		{"no signature", func(h http.Header) { h.Del(SignatureHeader) }, secret, path, ErrMissingSignature},
+	}
+
+	for _, tc := range testCases {
+		tampered := http.Header{}
+		SetHeaders(tampered, secret, id, path)
+		tc.tamper(tampered)
+
+		if _, err := Verify(tampered, tc.secret, tc.path); err != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.description, tc.expected, err)
+		}
+	}
+}
+
+// TestVerifyNoTenants tests identities without tenants, e.g. of admins
+func TestVerifyNoTenants(t *testing.T) {
+	secret := []byte("shared secret")
+	id := Identity{User: "admin", Role: "admin", Tenants: []string{}}
+
+	header := http.Header{}
+	SetHeaders(header, secret, id, "/api/v1/globals/")
+
+	verified, err := Verify(header, secret, "/api/v1/globals/")
+	if err != nil || !reflect.DeepEqual(*verified, id) {
+		t.Errorf("expected %#v, got %#v (%v)", id, verified, err)
+	}
+}
+
+// TestStripHeaders tests that clients can't pass their own identity headers
+func TestStripHeaders(t *testing.T) {
+	header := http.Header{}
+	for _, name := range Headers {
+		header.Add(name, "forged")
+		header.Add(name, "forged again")
+	}
+	header.Set("X-Auth-Token", "token")
+
+	StripHeaders(header)
+
+	if !reflect.DeepEqual(header, http.Header{"X-Auth-Token": []string{"token"}}) {
+		t.Errorf("expected only X-Auth-Token to be left, got %#v", header)
+	}
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"net"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// `GlobalMap` keys restricting which client IPs can access the proxy's own
+// management API (/api/v1/auth_proxy/*); the proxied netmaster endpoints are
+// not affected. Both lists are comma-separated CIDRs as accepted by
+// ParseCIDRList(). An empty allow list allows everyone.
+const (
+	ManagementAllowedCIDRsKey = "management_allowed_cidrs"
+	ManagementDeniedCIDRsKey  = "management_denied_cidrs"
+
+	// ManagementRestrictLoginKey holds "true" if the lists above apply to the
+	// login endpoint as well; login is reachable from everywhere by default
+	ManagementRestrictLoginKey = "management_restrict_login"
+)
+
+// managementCIDRs returns the networks configured under the given key.
+// return values:
+//  []*net.IPNet: parsed networks; empty if the setting is empty or missing
+//  error: nil on success, otherwise the parse error
+func managementCIDRs(key string) ([]*net.IPNet, error) {
+	list, err := Global().Get(key)
+	if err != nil {
+		return []*net.IPNet{}, nil
+	}
+
+	return ParseCIDRList(list)
+}
+
+// ipAllowed evaluates the given allow and deny lists for `ip`. The deny list
+// takes precedence, i.e. addresses in both lists are denied.
+func ipAllowed(ip net.IP, allowed, denied []*net.IPNet) bool {
+	if containsIP(denied, ip) {
+		return false
+	}
+
+	return len(allowed) == 0 || containsIP(allowed, ip)
+}
+
+// ManagementLoginRestricted returns true if the management allow/deny lists
+// apply to the login endpoint as well (see ManagementRestrictLoginKey).
+func ManagementLoginRestricted() bool {
+	value, err := Global().Get(ManagementRestrictLoginKey)
+	if err != nil {
+		return false
+	}
+
+	restricted, _ := strconv.ParseBool(value) // already validated
+	return restricted
+}
+
+// ManagementAccessAllowed checks the given client IP against the management
+// allow/deny lists. An invalid configuration is logged and denies everyone.
+// params:
+//  clientIP: IP address of the client, see RealIP()
+// return values:
+//  bool: true if the client may access the management API
+func ManagementAccessAllowed(clientIP string) bool {
+	allowed, err := managementCIDRs(ManagementAllowedCIDRsKey)
+	if err != nil {
+		log.Errorf("Denying management access, invalid %s setting: %s", ManagementAllowedCIDRsKey, err.Error())
+		return false
+	}
+
+	denied, err := managementCIDRs(ManagementDeniedCIDRsKey)
+	if err != nil {
+		log.Errorf("Denying management access, invalid %s setting: %s", ManagementDeniedCIDRsKey, err.Error())
+		return false
+	}
+
+	// current behavior, don't bother parsing the IP
+	if len(allowed) == 0 && len(denied) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+
+	return ipAllowed(ip, allowed, denied)
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"testing"
+)
+
+// TestManagementAccessAllowed tests the management allow/deny lists
+func TestManagementAccessAllowed(t *testing.T) {
+	testCases := []struct {
+		description string
+		allowed     string
+		denied      string
+		clientIP    string
+		expected    bool
+	}{
+		{"no lists configured", "", "", "1.2.3.4", true},
+		{"no lists configured, garbage IP", "", "", "garbage", true},
+		{"allowed", "10.0.0.0/8, 192.168.1.1", "", "10.1.2.3", true},
+		{"allowed bare IP", "10.0.0.0/8, 192.168.1.1", "", "192.168.1.1", true},
+		{"not in the allow list", "10.0.0.0/8", "", "1.2.3.4", false},
+		{"denied", "", "1.2.3.0/24", "1.2.3.4", false},
+		{"not in the deny list", "", "1.2.3.0/24", "1.2.4.1", true},
+		{"overlapping lists, denied wins", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.3", false},
+		{"overlapping lists, allowed outside the denied range", "10.0.0.0/8", "10.1.0.0/16", "10.2.2.3", true},
+		{"IPv6 allowed", "fd00::/8", "", "fd00::1", true},
+		{"IPv6 not in the allow list", "fd00::/8", "", "2001:db8::1", false},
+		{"IPv6 denied", "fd00::/8", "fd00:1::/32", "fd00:1::1", false},
+		{"IPv4 client against an IPv6 list", "fd00::/8", "", "10.1.2.3", false},
+		{"garbage IP", "10.0.0.0/8", "", "garbage", false},
+		{"invalid allow list denies everyone", "10.0.0.0/8, not-a-cidr", "", "10.1.2.3", false},
+		{"invalid deny list denies everyone", "", "not-a-cidr", "10.1.2.3", false},
+	}
+
+	defer Global().Set(ManagementAllowedCIDRsKey, "")
+	defer Global().Set(ManagementDeniedCIDRsKey, "")
+
+	for _, tc := range testCases {
+		if err := Global().Set(ManagementAllowedCIDRsKey, tc.allowed); err != nil {
+			t.Fatalf("failed to set %s: %s", ManagementAllowedCIDRsKey, err)
+		}
+
+		if err := Global().Set(ManagementDeniedCIDRsKey, tc.denied); err != nil {
+			t.Fatalf("failed to set %s: %s", ManagementDeniedCIDRsKey, err)
+		}
+
+		if allowed := ManagementAccessAllowed(tc.clientIP); allowed != tc.expected {
+			t.Errorf("%s: expected %t for %q, got %t", tc.description, tc.expected, tc.clientIP, allowed)
+		}
+	}
+}
+
+// TestValidateManagementSettings tests validation of the management settings
+func TestValidateManagementSettings(t *testing.T) {
+	valid := map[string]string{
+		ManagementAllowedCIDRsKey:  "10.0.0.0/8, fd00::/8",
+		ManagementDeniedCIDRsKey:   "10.1.0.0/16",
+		ManagementRestrictLoginKey: "true",
+	}
+
+	if err := ValidateSettings(valid); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	for _, invalid := range []map[string]string{
+		{ManagementAllowedCIDRsKey: "10.0.0.0/33"},
+		{ManagementDeniedCIDRsKey: "foo"},
+		{ManagementRestrictLoginKey: "sometimes"},
+	} {
+		if err := ValidateSettings(invalid); err == nil {
+			t.Errorf("expected an error for %v", invalid)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// This file contains the password policy of local users. Passwords which are
+// set through the API have to follow it; the default users are exempt when
+// they're added at bootstrap.
+
+// password policy rules, as reported by PasswordPolicyViolations()
+const (
+	PasswordRuleMinLength = "min_length"
+	PasswordRuleMixedCase = "mixed_case"
+	PasswordRuleDigit     = "digit"
+	PasswordRuleSymbol    = "symbol"
+	PasswordRuleUsername  = "username"
+)
+
+// passwordPolicyFlag returns the value of the given boolean password policy setting
+func passwordPolicyFlag(key string) bool {
+	value, err := Global().Get(key)
+	if err != nil {
+		return false
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	return err == nil && enabled
+}
+
+// passwordMinLength returns the minimum password length; 0 if there is none
+func passwordMinLength() int {
+	value, err := Global().Get(PasswordMinLengthKey)
+	if err != nil {
+		return 0
+	}
+
+	length, err := strconv.Atoi(value)
+	if err != nil || length < 0 {
+		return 0
+	}
+
+	return length
+}
+
+// passwordCharacterClasses returns whether the given password contains upper
+// case letters, lower case letters, digits and symbols (punctuation and spaces
+// included)
+func passwordCharacterClasses(password string) (upper, lower, digit, symbol bool) {
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	return
+}
+
+// PasswordPolicyViolations checks a local user's new password against the
+// password policy configured in the settings.
+// params:
+//  username: name of the local user
+//  password: the new password
+// return values:
+//  map[string]string: the rules (PasswordRule* constants) the password breaks,
+//                     each with a description; empty if it follows the policy
+func PasswordPolicyViolations(username, password string) map[string]string {
+	violations := map[string]string{}
+
+	if minLength := passwordMinLength(); len([]rune(password)) < minLength {
+		violations[PasswordRuleMinLength] = fmt.Sprintf("must be at least %d characters long", minLength)
+	}
+
+	upper, lower, digit, symbol := passwordCharacterClasses(password)
+
+	if passwordPolicyFlag(PasswordRequireMixedCaseKey) && !(upper && lower) {
+		violations[PasswordRuleMixedCase] = "must contain both upper and lower case letters"
+	}
+
+	if passwordPolicyFlag(PasswordRequireDigitKey) && !digit {
+		violations[PasswordRuleDigit] = "must contain a digit"
+	}
+
+	if passwordPolicyFlag(PasswordRequireSymbolKey) && !symbol {
+		violations[PasswordRuleSymbol] = "must contain a symbol"
+	}
+
+	if passwordPolicyFlag(PasswordRejectUsernameKey) && strings.EqualFold(password, username) {
+		violations[PasswordRuleUsername] = "must not be the username"
+	}
+
+	return violations
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestPasswordPolicyViolations tests checking passwords against the password policy
+func TestPasswordPolicyViolations(t *testing.T) {
+	policy := map[string]string{
+		PasswordMinLengthKey:        "8",
+		PasswordRequireMixedCaseKey: "true",
+		PasswordRequireDigitKey:     "true",
+		PasswordRequireSymbolKey:    "true",
+		PasswordRejectUsernameKey:   "true",
+	}
+
+	defer func() {
+		for key := range policy {
+			Global().Set(key, "")
+		}
+	}()
+
+	// no policy is configured by default
+	if violations := PasswordPolicyViolations("jdoe", "jdoe"); len(violations) != 0 {
+		t.Fatalf("expected no violations without a policy, got %v", violations)
+	}
+
+	for key, value := range policy {
+		if err := Global().Set(key, value); err != nil {
+			t.Fatalf("failed to set %s: %s", key, err)
+		}
+	}
+
+	testCases := []struct {
+		password string
+		expected []string
+	}{
+		{"Secret-Passw0rd", nil},
+		{"Ünïcödé-1", nil},
+		{"Sh0rt!", []string{PasswordRuleMinLength}},
+		{"lowercase-only-1", []string{PasswordRuleMixedCase}},
+		{"No-Digits-Here", []string{PasswordRuleDigit}},
+		{"NoSymbols1234", []string{PasswordRuleSymbol}},
+		{"JDoe", []string{PasswordRuleDigit, PasswordRuleMinLength, PasswordRuleSymbol, PasswordRuleUsername}},
+		{"", []string{PasswordRuleDigit, PasswordRuleMinLength, PasswordRuleMixedCase, PasswordRuleSymbol}},
+	}
+
+	for _, tc := range testCases {
+		rules := []string{}
+		for rule := range PasswordPolicyViolations("jdoe", tc.password) {
+			rules = append(rules, rule)
+		}
+		sort.Strings(rules)
+
+		if strings.Join(rules, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("expected violations %v for %q, got %v", tc.expected, tc.password, rules)
+		}
+	}
+}
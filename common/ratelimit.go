@@ -0,0 +1,109 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRateLimiterBuckets is the number of keys a RateLimiter tracks before it
+// starts forgetting keys whose bucket has refilled completely
+const maxRateLimiterBuckets = 10000
+
+// RateLimiter is a token bucket rate limiter which keeps a separate bucket for
+// every key, e.g. for every client IP. Each bucket holds up to `burst` tokens
+// and is refilled at `rate` tokens per second; every allowed request takes a token.
+type RateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64 // tokens per second; 0 disables rate limiting
+	burst   float64
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+// tokenBucket holds the tokens left for a single key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // when `tokens` was last updated
+}
+
+// NewRateLimiter creates a new rate limiter.
+// params:
+//  rate: number of requests per second allowed for each key; 0 disables rate limiting
+//  burst: number of requests allowed in a burst; at least 1
+// return values:
+//  *RateLimiter: rate limiter object
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	rl := &RateLimiter{
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+
+	rl.SetLimit(rate, burst)
+	return rl
+}
+
+// SetLimit changes the rate and burst of the limiter; existing buckets are kept.
+// params:
+//  rate: number of requests per second allowed for each key; 0 disables rate limiting
+//  burst: number of requests allowed in a burst; at least 1
+func (rl *RateLimiter) SetLimit(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	rl.rate = rate
+	rl.burst = float64(burst)
+}
+
+// Allow checks whether a request for the given key is allowed and, if so,
+// takes a token from the key's bucket.
+// params:
+//  key: the requester, e.g. client IP address
+// return values:
+//  bool: true if the request is allowed, false if it should be rejected
+func (rl *RateLimiter) Allow(key string) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if rl.rate <= 0 {
+		return true
+	}
+
+	now := rl.now()
+
+	b, found := rl.buckets[key]
+	if !found {
+		if len(rl.buckets) >= maxRateLimiterBuckets {
+			rl.evict(now)
+		}
+
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// evict forgets all the keys whose bucket is full again, i.e. which haven't
+// been rate limited recently; a new bucket for them would be full too.
+func (rl *RateLimiter) evict(now time.Time) {
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRateLimiter tests bursts, refills and per-key buckets
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	rl := NewRateLimiter(2, 3)
+	rl.now = func() time.Time { return now }
+
+	// the burst is allowed right away
+	for i := 0; i < 3; i++ {
+		if !rl.Allow("a") {
+			t.Fatalf("request %d of the burst was rejected", i+1)
+		}
+	}
+
+	if rl.Allow("a") {
+		t.Fatal("request exceeding the burst was allowed")
+	}
+
+	// other keys have their own bucket
+	if !rl.Allow("b") {
+		t.Fatal("request for a different key was rejected")
+	}
+
+	// 2 requests per second
+	now = now.Add(500 * time.Millisecond)
+	if !rl.Allow("a") {
+		t.Fatal("request after refill was rejected")
+	}
+
+	if rl.Allow("a") {
+		t.Fatal("request exceeding the rate was allowed")
+	}
+
+	// the bucket never holds more than the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !rl.Allow("a") {
+			t.Fatalf("request %d of the burst was rejected after refill", i+1)
+		}
+	}
+
+	if rl.Allow("a") {
+		t.Fatal("bucket was refilled beyond the burst")
+	}
+
+	// a rate of 0 disables rate limiting
+	rl.SetLimit(0, 0)
+	for i := 0; i < 10; i++ {
+		if !rl.Allow("a") {
+			t.Fatal("request was rejected with rate limiting disabled")
+		}
+	}
+}
+
+// TestRateLimiterEviction tests that idle keys are forgotten
+func TestRateLimiterEviction(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	rl := NewRateLimiter(1, 1)
+	rl.now = func() time.Time { return now }
+
+	rl.Allow("idle")
+	now = now.Add(time.Minute)
+
+	rl.Allow("busy")
+	rl.evict(now)
+
+	if _, found := rl.buckets["idle"]; found {
+		t.Error("idle key was not evicted")
+	}
+
+	if _, found := rl.buckets["busy"]; !found {
+		t.Error("rate limited key was evicted")
+	}
+}
@@ -0,0 +1,164 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// TrustedProxiesKey is the `GlobalMap` key which holds a comma-separated list
+// of CIDRs (or bare IPs) belonging to reverse proxies/load balancers sitting
+// in front of auth_proxy. Only these peers are allowed to tell us who the
+// real client is via the X-Forwarded-For/X-Real-IP headers.
+const TrustedProxiesKey = "trusted_proxies"
+
+// ParseCIDRList parses a comma-separated list of CIDRs. Bare IP addresses are
+// accepted as well and are treated as single host networks (/32 or /128).
+// params:
+//  list: comma-separated CIDRs, e.g. "10.0.0.0/8, 192.168.1.1, fd00::/8"
+// return values:
+//  []*net.IPNet: parsed networks; empty if `list` is empty
+//  error: nil on success, otherwise an error naming the first invalid entry
+func ParseCIDRList(list string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if IsEmpty(entry) {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %s", entry, err.Error())
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// containsIP returns true if any of the given networks contains `ip`.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// trustedProxies returns the networks configured under TrustedProxiesKey.
+// An invalid configuration is logged and treated as "trust nobody".
+func trustedProxies() []*net.IPNet {
+	list, err := Global().Get(TrustedProxiesKey)
+	if err != nil {
+		return []*net.IPNet{}
+	}
+
+	networks, err := ParseCIDRList(list)
+	if err != nil {
+		log.Errorf("Ignoring invalid %s setting: %s", TrustedProxiesKey, err.Error())
+		return []*net.IPNet{}
+	}
+
+	return networks
+}
+
+// peerIP returns the IP address of the directly connected peer.
+func peerIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		// RemoteAddr has no port; use it as is
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// RealIP returns the IP address of the client which originated the given
+// request. This should be used by everything which cares about the client's
+// identity (rate limiting, lockouts, audit logging, etc.)
+//
+// If the directly connected peer is not a trusted proxy (see TrustedProxiesKey),
+// the forwarding headers are ignored entirely as they could have been spoofed
+// by the client and the peer's address is returned.
+//
+// If the peer is a trusted proxy, the X-Forwarded-For chain is walked from
+// right to left and the first address which doesn't belong to a trusted proxy
+// is returned; everything to the left of it could have been made up by the
+// client. If there is no X-Forwarded-For header, X-Real-IP is used instead.
+// params:
+//  req: http request object
+// return values:
+//  string: IP address of the client
+func RealIP(req *http.Request) string {
+	peer := peerIP(req)
+
+	trusted := trustedProxies()
+	if len(trusted) == 0 {
+		return peer
+	}
+
+	ip := net.ParseIP(peer)
+	if ip == nil || !containsIP(trusted, ip) {
+		return peer
+	}
+
+	// multiple X-Forwarded-For headers are equivalent to a single
+	// comma-separated one, in the order they were received.
+	hops := []string{}
+	for _, header := range req.Header[http.CanonicalHeaderKey("X-Forwarded-For")] {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); !IsEmpty(hop) {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	if len(hops) > 0 {
+		client := peer
+
+		for i := len(hops) - 1; i >= 0; i-- {
+			hopIP := net.ParseIP(hops[i])
+			if hopIP == nil {
+				// the hop was added by one of our trusted proxies, so
+				// this should never happen. stop at the last good hop.
+				log.Debugf("Invalid X-Forwarded-For entry %q from %s", hops[i], peer)
+				break
+			}
+
+			client = hopIP.String()
+			if !containsIP(trusted, hopIP) {
+				break
+			}
+		}
+
+		return client
+	}
+
+	if realIP := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP.String()
+	}
+
+	return peer
+}
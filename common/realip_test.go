@@ -0,0 +1,152 @@
+package common
+
+import (
+	"net/http"
+	"testing"
+)
+
+func newRequest(remoteAddr string, headers map[string][]string) *http.Request {
+	req := &http.Request{
+		RemoteAddr: remoteAddr,
+		Header:     http.Header{},
+	}
+
+	for name, values := range headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	return req
+}
+
+// TestRealIP tests client IP determination with and without trusted proxies
+func TestRealIP(t *testing.T) {
+	testCases := []struct {
+		description string
+		trusted     string
+		remoteAddr  string
+		headers     map[string][]string
+		expected    string
+	}{
+		{
+			description: "no trusted proxies configured",
+			trusted:     "",
+			remoteAddr:  "10.1.1.1:1234",
+			headers:     map[string][]string{"X-Forwarded-For": {"1.2.3.4"}},
+			expected:    "10.1.1.1",
+		},
+		{
+			description: "spoofed X-Forwarded-For from an untrusted peer",
+			trusted:     "10.0.0.0/8",
+			remoteAddr:  "192.168.1.5:1234",
+			headers:     map[string][]string{"X-Forwarded-For": {"1.2.3.4"}},
+			expected:    "192.168.1.5",
+		},
+		{
+			description: "spoofed X-Real-IP from an untrusted peer",
+			trusted:     "10.0.0.0/8",
+			remoteAddr:  "192.168.1.5:1234",
+			headers:     map[string][]string{"X-Real-IP": {"1.2.3.4"}},
+			expected:    "192.168.1.5",
+		},
+		{
+			description: "single hop through a trusted proxy",
+			trusted:     "10.0.0.0/8",
+			remoteAddr:  "10.1.1.1:1234",
+			headers:     map[string][]string{"X-Forwarded-For": {"1.2.3.4"}},
+			expected:    "1.2.3.4",
+		},
+		{
+			description: "multi-hop chain with a spoofed leftmost entry",
+			trusted:     "10.0.0.0/8",
+			remoteAddr:  "10.1.1.1:1234",
+			headers:     map[string][]string{"X-Forwarded-For": {"6.6.6.6, 1.2.3.4, 10.2.2.2"}},
+			expected:    "1.2.3.4",
+		},
+		{
+			description: "multi-hop chain split across multiple headers",
+			trusted:     "10.0.0.0/8, 172.16.0.1",
+			remoteAddr:  "10.1.1.1:1234",
+			headers:     map[string][]string{"X-Forwarded-For": {"6.6.6.6, 1.2.3.4", "172.16.0.1"}},
+			expected:    "1.2.3.4",
+		},
+		{
+			description: "every hop is trusted",
+			trusted:     "10.0.0.0/8",
+			remoteAddr:  "10.1.1.1:1234",
+			headers:     map[string][]string{"X-Forwarded-For": {"10.3.3.3, 10.2.2.2"}},
+			expected:    "10.3.3.3",
+		},
+		{
+			description: "garbage in the chain stops the walk",
+			trusted:     "10.0.0.0/8",
+			remoteAddr:  "10.1.1.1:1234",
+			headers:     map[string][]string{"X-Forwarded-For": {"1.2.3.4, garbage, 10.2.2.2"}},
+			expected:    "10.2.2.2",
+		},
+		{
+			description: "X-Real-IP from a trusted proxy",
+			trusted:     "10.0.0.0/8",
+			remoteAddr:  "10.1.1.1:1234",
+			headers:     map[string][]string{"X-Real-IP": {"1.2.3.4"}},
+			expected:    "1.2.3.4",
+		},
+		{
+			description: "trusted proxy without forwarding headers",
+			trusted:     "10.0.0.0/8",
+			remoteAddr:  "10.1.1.1:1234",
+			headers:     map[string][]string{},
+			expected:    "10.1.1.1",
+		},
+		{
+			description: "IPv6 trusted proxy",
+			trusted:     "fd00::/8",
+			remoteAddr:  "[fd00::1]:1234",
+			headers:     map[string][]string{"X-Forwarded-For": {"2001:db8::1"}},
+			expected:    "2001:db8::1",
+		},
+		{
+			description: "invalid trusted proxy configuration trusts nobody",
+			trusted:     "10.0.0.0/8, not-a-cidr",
+			remoteAddr:  "10.1.1.1:1234",
+			headers:     map[string][]string{"X-Forwarded-For": {"1.2.3.4"}},
+			expected:    "10.1.1.1",
+		},
+	}
+
+	defer Global().Set(TrustedProxiesKey, "")
+
+	for _, tc := range testCases {
+		if err := Global().Set(TrustedProxiesKey, tc.trusted); err != nil {
+			t.Fatalf("failed to set %s: %s", TrustedProxiesKey, err)
+		}
+
+		ip := RealIP(newRequest(tc.remoteAddr, tc.headers))
+		if ip != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.description, tc.expected, ip)
+		}
+	}
+}
+
+// TestParseCIDRList tests parsing of CIDR lists
+func TestParseCIDRList(t *testing.T) {
+	networks, err := ParseCIDRList(" 10.0.0.0/8, 192.168.1.1 ,, fd00::/8, ::1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(networks) != 4 {
+		t.Fatalf("expected 4 networks, got %d", len(networks))
+	}
+
+	if networks[1].String() != "192.168.1.1/32" || networks[3].String() != "::1/128" {
+		t.Errorf("bare IPs were not converted to host networks: %v", networks)
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "foo", "10.0.0.0/8,bar"} {
+		if _, err := ParseCIDRList(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package common
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+)
+
+// This file contains the backends which the TLS key pair and the token signing
+// key are read from. The "file" backend reads the files named by
+// tls_certificate and tls_key_file; the "vault" backend reads the secrets from
+// a HashiCorp Vault key/value secrets engine. Secrets are fetched once by
+// InitSecrets() and, if secrets_refresh_interval is set, re-fetched
+// periodically so that secrets rotated in the backend are used without a
+// restart.
+
+// `GlobalMap` keys of the secrets backend; they're only read at startup
+const (
+	// SecretsBackendKey holds the backend secrets are read from: "file" (the
+	// default) or "vault"
+	SecretsBackendKey = "secrets_backend"
+
+	// VaultAddressKey holds the URL of the Vault server, e.g. https://vault:8200
+	VaultAddressKey = "vault_address"
+
+	// VaultTokenKey holds the token used to authenticate to Vault. Alternatively,
+	// VaultRoleIDKey and VaultSecretIDKey hold the credential of an AppRole used
+	// to log in. They're best set using the environment (e.g.
+	// AUTH_PROXY_VAULT_TOKEN) and are never logged.
+	VaultTokenKey    = "vault_token"
+	VaultRoleIDKey   = "vault_role_id"
+	VaultSecretIDKey = "vault_secret_id"
+
+	// VaultTLSCertificatePathKey, VaultTLSKeyPathKey and VaultSigningKeyPathKey
+	// hold the Vault paths of the secrets, e.g. "secret/auth_proxy#tls_key"; the
+	// field after '#' defaults to "value". The TLS key pair is read from files if
+	// its paths are empty and the token signing key is generated and kept in the
+	// data store if its path is empty.
+	VaultTLSCertificatePathKey = "vault_tls_certificate_path"
+	VaultTLSKeyPathKey         = "vault_tls_key_path"
+	VaultSigningKeyPathKey     = "vault_signing_key_path"
+
+	// SecretsRefreshIntervalKey holds the time (in seconds) between re-fetches of
+	// the secrets; 0 disables re-fetching
+	SecretsRefreshIntervalKey = "secrets_refresh_interval"
+)
+
+// names of the secrets read from the secrets backend
+const (
+	SecretTLSCertificate  = "tls_certificate"
+	SecretTLSKey          = "tls_key"
+	SecretTokenSigningKey = "token_signing_key"
+
+	// SecretPreviousTLSKeys holds the PEM encoded TLS keys which were replaced
+	// by the current one; it's always read from the files named by
+	// PreviousTLSKeyFilesKey
+	SecretPreviousTLSKeys = "previous_tls_keys"
+)
+
+// secretNames lists all the secrets, in the order they're fetched
+var secretNames = []string{SecretTLSCertificate, SecretTLSKey, SecretTokenSigningKey, SecretPreviousTLSKeys}
+
+// SecretsProvider reads secrets from a secrets backend.
+type SecretsProvider interface {
+	// Secret returns the named secret (see the Secret* constants) or
+	// auth_errors.ErrSecretNotConfigured if the backend doesn't hold it
+	Secret(name string) ([]byte, error)
+}
+
+// secrets holds the provider set up by InitSecrets() and the secrets it returned
+var secrets = struct {
+	sync.RWMutex
+	provider    SecretsProvider
+	values      map[string][]byte // secrets by name
+	certificate *tls.Certificate  // parsed from the TLS secrets
+}{}
+
+// fileSecrets reads the TLS key pair from the files named by the settings
+type fileSecrets map[string]string
+
+// Secret reads the named secret from its file.
+func (f fileSecrets) Secret(name string) ([]byte, error) {
+	if name == SecretPreviousTLSKeys {
+		return f.previousTLSKeys()
+	}
+
+	key, found := map[string]string{SecretTLSCertificate: TLSCertificateKey, SecretTLSKey: TLSKeyFileKey}[name]
+	if !found {
+		return nil, auth_errors.ErrSecretNotConfigured
+	}
+
+	if IsEmpty(f[key]) {
+		return nil, fmt.Errorf("%s is not set", key)
+	}
+
+	return ioutil.ReadFile(f[key])
+}
+
+// previousTLSKeys reads all the files named by PreviousTLSKeyFilesKey.
+func (f fileSecrets) previousTLSKeys() ([]byte, error) {
+	keys := []byte{}
+
+	for _, path := range strings.Split(f[PreviousTLSKeyFilesKey], ",") {
+		if path = strings.TrimSpace(path); IsEmpty(path) {
+			continue
+		}
+
+		key, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(append(keys, key...), '\n')
+	}
+
+	if len(keys) == 0 {
+		return nil, auth_errors.ErrSecretNotConfigured
+	}
+
+	return keys, nil
+}
+
+// vaultSecrets reads secrets from Vault's key/value secrets engine (version 1
+// or 2); secrets without a Vault path are read from `fallback`.
+type vaultSecrets struct {
+	address  string
+	paths    map[string]string // Vault paths by secret name
+	fallback SecretsProvider
+	client   *http.Client
+
+	roleID   string // AppRole credential; empty if a token is set
+	secretID string
+
+	tokenMutex sync.Mutex // guards token
+	token      string     // never logged
+}
+
+// vaultResponse holds the parts of Vault's responses we use
+type vaultResponse struct {
+	Data map[string]interface{} `json:"data"`
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// newVaultSecrets returns a Vault provider configured by the settings.
+func newVaultSecrets(settings map[string]string) *vaultSecrets {
+	return &vaultSecrets{
+		address: strings.TrimSuffix(settings[VaultAddressKey], "/"),
+		paths: map[string]string{
+			SecretTLSCertificate:  settings[VaultTLSCertificatePathKey],
+			SecretTLSKey:          settings[VaultTLSKeyPathKey],
+			SecretTokenSigningKey: settings[VaultSigningKeyPathKey],
+		},
+		fallback: fileSecrets(settings),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		roleID:   settings[VaultRoleIDKey],
+		secretID: settings[VaultSecretIDKey],
+		token:    settings[VaultTokenKey],
+	}
+}
+
+// Secret reads the named secret from Vault, or from the fallback if it has no Vault path.
+func (v *vaultSecrets) Secret(name string) ([]byte, error) {
+	if IsEmpty(v.paths[name]) {
+		return v.fallback.Secret(name)
+	}
+
+	path, field := v.paths[name], "value"
+	if i := strings.LastIndex(path, "#"); i >= 0 {
+		path, field = path[:i], path[i+1:]
+	}
+
+	data, err := v.read(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// version 2 of the key/value secrets engine wraps the fields with metadata
+	if nested, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+		data = nested
+	}
+
+	value, ok := data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("Vault secret %q has no field %q", path, field)
+	}
+
+	return []byte(value), nil
+}
+
+// read returns the data of the Vault secret at `path`. AppRole logins are
+// renewed once if Vault rejects the token, e.g. because it expired.
+func (v *vaultSecrets) read(path string) (map[string]interface{}, error) {
+	token, err := v.currentToken(false)
+	if err != nil {
+		return nil, err
+	}
+
+	status, resp, err := v.do("GET", "/v1/"+path, token, nil)
+	if err == nil && status == http.StatusForbidden && !IsEmpty(v.roleID) {
+		if token, err = v.currentToken(true); err == nil {
+			status, resp, err = v.do("GET", "/v1/"+path, token, nil)
+		}
+	}
+
+	switch {
+	case err != nil:
+		return nil, err
+	case status == http.StatusNotFound:
+		return nil, fmt.Errorf("Vault secret %q not found", path)
+	case status != http.StatusOK:
+		return nil, fmt.Errorf("failed to read Vault secret %q: status %d %v", path, status, resp.Errors)
+	}
+
+	return resp.Data, nil
+}
+
+// currentToken returns the token used to authenticate to Vault, logging in
+// using the AppRole first if there's no token yet or `renew` is set.
+func (v *vaultSecrets) currentToken(renew bool) (string, error) {
+	v.tokenMutex.Lock()
+	defer v.tokenMutex.Unlock()
+
+	if IsEmpty(v.roleID) || (!IsEmpty(v.token) && !renew) {
+		return v.token, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"role_id": v.roleID, "secret_id": v.secretID})
+
+	status, resp, err := v.do("POST", "/v1/auth/approle/login", "", body)
+	if err != nil {
+		return "", err
+	}
+
+	if status != http.StatusOK || IsEmpty(resp.Auth.ClientToken) {
+		return "", fmt.Errorf("Vault AppRole login failed: status %d %v", status, resp.Errors)
+	}
+
+	v.token = resp.Auth.ClientToken
+	return v.token, nil
+}
+
+// do sends a request to Vault.
+// params:
+//  method: HTTP method
+//  path: path of the endpoint, e.g. /v1/secret/auth_proxy
+//  token: Vault token; not sent if empty
+//  body: JSON request body; nil for none
+// return values:
+//  int: HTTP status code
+//  *vaultResponse: parsed response; empty if the response isn't JSON
+//  error: nil unless Vault couldn't be reached. Errors never contain the token.
+func (v *vaultSecrets) do(method, path, token string, body []byte) (int, *vaultResponse, error) {
+	req, err := http.NewRequest(method, v.address+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if !IsEmpty(token) {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Vault at %s is unreachable: %s", v.address, err.Error())
+	}
+	defer resp.Body.Close()
+
+	vr := &vaultResponse{}
+	if data, err := ioutil.ReadAll(resp.Body); err == nil {
+		json.Unmarshal(data, vr) // errors are reported using the status code
+	}
+
+	return resp.StatusCode, vr, nil
+}
+
+// NewSecretsProvider returns the provider of the backend configured by the settings.
+// params:
+//  settings: settings configuring the backend, e.g. Global()
+// return values:
+//  SecretsProvider: provider of the configured backend
+//  error: nil if successful, otherwise the reason the settings are invalid
+func NewSecretsProvider(settings map[string]string) (SecretsProvider, error) {
+	if err := checkSecretsBackend(settings); err != nil {
+		return nil, err
+	}
+
+	if settings[SecretsBackendKey] == "vault" {
+		return newVaultSecrets(settings), nil
+	}
+
+	return fileSecrets(settings), nil
+}
+
+// fetchSecrets reads all the secrets the provider holds.
+// return values:
+//  map[string][]byte: secrets by name
+//  *tls.Certificate: TLS key pair parsed from the secrets; nil if it isn't held
+//  error: nil if successful, otherwise the first secret which couldn't be read
+func fetchSecrets(provider SecretsProvider) (map[string][]byte, *tls.Certificate, error) {
+	values := map[string][]byte{}
+
+	for _, name := range secretNames {
+		value, err := provider.Secret(name)
+		if err == auth_errors.ErrSecretNotConfigured {
+			continue
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to read the %s: %s", strings.Replace(name, "_", " ", -1), err.Error())
+		}
+
+		values[name] = value
+	}
+
+	cert, key := values[SecretTLSCertificate], values[SecretTLSKey]
+	if cert == nil || key == nil {
+		return values, nil, nil
+	}
+
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid TLS key pair: %s", err.Error())
+	}
+
+	return values, &pair, nil
+}
+
+// InitSecrets sets up the configured secrets backend and reads all the secrets
+// it holds. Until it's called, secrets are read from the files named by Global().
+// params:
+//  settings: settings configuring the backend, e.g. Global()
+// return values:
+//  error: nil if successful, otherwise the reason the backend couldn't be set
+//         up, e.g. Vault being unreachable or a secret not being found
+func InitSecrets(settings map[string]string) error {
+	provider, err := NewSecretsProvider(settings)
+	if err != nil {
+		return err
+	}
+
+	values, certificate, err := fetchSecrets(provider)
+	if err != nil {
+		return err
+	}
+
+	secrets.Lock()
+	secrets.provider, secrets.values, secrets.certificate = provider, values, certificate
+	secrets.Unlock()
+
+	if interval, _ := strconv.ParseInt(settings[SecretsRefreshIntervalKey], 10, 64); interval > 0 {
+		go refreshSecretsEvery(time.Duration(interval) * time.Second)
+	}
+
+	if settings[SecretsBackendKey] == "vault" {
+		log.Infoln("Reading secrets from Vault at", settings[VaultAddressKey])
+	}
+
+	return nil
+}
+
+// refreshSecretsEvery re-fetches the secrets at the given interval, forever.
+func refreshSecretsEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		refreshSecrets()
+	}
+}
+
+// refreshSecrets re-fetches the secrets; the current ones are kept if any of them can't be read.
+func refreshSecrets() {
+	secrets.RLock()
+	provider := secrets.provider
+	secrets.RUnlock()
+
+	values, certificate, err := fetchSecrets(provider)
+	if err != nil {
+		log.Warnln("Failed to refresh secrets, keeping the current ones:", err)
+		return
+	}
+
+	secrets.Lock()
+	defer secrets.Unlock()
+
+	for _, name := range secretNames {
+		if !bytes.Equal(values[name], secrets.values[name]) {
+			log.Infof("The %s was rotated", strings.Replace(name, "_", " ", -1))
+		}
+	}
+
+	secrets.values, secrets.certificate = values, certificate
+}
+
+// GetSecret returns the named secret (see the Secret* constants).
+// params:
+//  name: name of the secret
+// return values:
+//  []byte: the secret
+//  error: nil if successful, auth_errors.ErrSecretNotConfigured if the backend
+//         doesn't hold it, otherwise the reason it couldn't be read
+func GetSecret(name string) ([]byte, error) {
+	secrets.RLock()
+	defer secrets.RUnlock()
+
+	if secrets.provider == nil {
+		return fileSecrets(Global()).Secret(name)
+	}
+
+	value, found := secrets.values[name]
+	if !found {
+		return nil, auth_errors.ErrSecretNotConfigured
+	}
+
+	return value, nil
+}
+
+// TLSCertificate returns the TLS key pair our HTTPS server uses.
+// return values:
+//  *tls.Certificate: current TLS key pair
+//  error: nil if successful, otherwise the reason it couldn't be read
+func TLSCertificate() (*tls.Certificate, error) {
+	secrets.RLock()
+	certificate := secrets.certificate
+	secrets.RUnlock()
+
+	if certificate != nil {
+		return certificate, nil
+	}
+
+	cert, err := GetSecret(SecretTLSCertificate)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := GetSecret(SecretTLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pair, nil
+}
+
+// checkSecretsBackend checks the settings of the secrets backend.
+func checkSecretsBackend(settings map[string]string) error {
+	if value := settings[SecretsRefreshIntervalKey]; !IsEmpty(value) {
+		if n, err := strconv.ParseInt(value, 10, 64); err != nil || n < 0 {
+			return fmt.Errorf("invalid %s %q: must be an integer >= 0", SecretsRefreshIntervalKey, value)
+		}
+	}
+
+	switch backend := settings[SecretsBackendKey]; backend {
+	case "", "file":
+		return nil
+	case "vault":
+		return checkVaultSettings(settings)
+	default:
+		return fmt.Errorf("invalid %s %q: must be \"file\" or \"vault\"", SecretsBackendKey, backend)
+	}
+}
+
+// checkVaultSettings checks the settings of the Vault backend.
+func checkVaultSettings(settings map[string]string) error {
+	address := settings[VaultAddressKey]
+	if u, err := url.Parse(address); err != nil || (u.Scheme != "https" && u.Scheme != "http") || IsEmpty(u.Host) {
+		return fmt.Errorf("invalid %s %q: must be a http(s) URL", VaultAddressKey, address)
+	}
+
+	appRole := !IsEmpty(settings[VaultRoleIDKey]) && !IsEmpty(settings[VaultSecretIDKey])
+	if IsEmpty(settings[VaultTokenKey]) && !appRole {
+		return fmt.Errorf("either %s or both %s and %s are required", VaultTokenKey, VaultRoleIDKey, VaultSecretIDKey)
+	}
+
+	cert, key := settings[VaultTLSCertificatePathKey], settings[VaultTLSKeyPathKey]
+	if IsEmpty(cert) != IsEmpty(key) {
+		return fmt.Errorf("either both or neither of %s and %s must be set", VaultTLSCertificatePathKey, VaultTLSKeyPathKey)
+	}
+
+	if IsEmpty(key) && IsEmpty(settings[VaultSigningKeyPathKey]) {
+		return fmt.Errorf("at least one of %s and %s must be set", VaultTLSKeyPathKey, VaultSigningKeyPathKey)
+	}
+
+	return nil
+}
+
+// tlsFromVault returns true if the settings read the TLS key pair from Vault.
+func tlsFromVault(settings map[string]string) bool {
+	return settings[SecretsBackendKey] == "vault" && !IsEmpty(settings[VaultTLSKeyPathKey])
+}
@@ -0,0 +1,345 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+)
+
+// newTestKeyPair returns a PEM encoded self-signed certificate and its RSA key
+func newTestKeyPair(t *testing.T) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "auth_proxy test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	return string(cert), string(keyPEM)
+}
+
+// stubVault serves Vault's key/value and AppRole login APIs from memory
+type stubVault struct {
+	sync.Mutex
+	*httptest.Server
+
+	secrets map[string]interface{} // data of the secrets by path
+	tokens  map[string]bool        // valid tokens
+	logins  int                    // number of AppRole logins
+}
+
+// newStubVault returns a running stub Vault which accepts the given token
+func newStubVault(token string) *stubVault {
+	v := &stubVault{secrets: map[string]interface{}{}, tokens: map[string]bool{token: true}}
+	v.Server = httptest.NewServer(http.HandlerFunc(v.serveHTTP))
+
+	return v
+}
+
+// setSecret sets the data of the secret at `path`
+func (v *stubVault) setSecret(path string, data interface{}) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.secrets[path] = data
+}
+
+// revokeTokens invalidates all the tokens
+func (v *stubVault) revokeTokens() {
+	v.Lock()
+	defer v.Unlock()
+
+	v.tokens = map[string]bool{}
+}
+
+// serveHTTP implements the stub's endpoints, answering like Vault does
+func (v *stubVault) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	v.Lock()
+	defer v.Unlock()
+
+	reply := func(status int, body interface{}) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+
+	if req.URL.Path == "/v1/auth/approle/login" {
+		credential := map[string]string{}
+		json.NewDecoder(req.Body).Decode(&credential)
+
+		if credential["role_id"] != "role" || credential["secret_id"] != "secret" {
+			reply(http.StatusBadRequest, map[string][]string{"errors": {"invalid secret id"}})
+			return
+		}
+
+		v.logins++
+		token := "approle-token-" + strconv.Itoa(v.logins)
+		v.tokens[token] = true
+		reply(http.StatusOK, map[string]interface{}{"auth": map[string]string{"client_token": token}})
+		return
+	}
+
+	if !v.tokens[req.Header.Get("X-Vault-Token")] {
+		reply(http.StatusForbidden, map[string][]string{"errors": {"permission denied"}})
+		return
+	}
+
+	data, found := v.secrets[strings.TrimPrefix(req.URL.Path, "/v1/")]
+	if !found {
+		reply(http.StatusNotFound, map[string][]string{"errors": {}})
+		return
+	}
+
+	reply(http.StatusOK, map[string]interface{}{"data": data})
+}
+
+// vaultSettings returns the settings of a Vault backend at the given address
+func vaultSettings(address string, keysAndValues ...string) map[string]string {
+	settings := map[string]string{
+		SecretsBackendKey:      "vault",
+		VaultAddressKey:        address,
+		VaultTokenKey:          "root-token",
+		VaultSigningKeyPathKey: "secret/auth_proxy#signing_key",
+	}
+
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		settings[keysAndValues[i]] = keysAndValues[i+1]
+	}
+
+	return settings
+}
+
+// resetSecrets restores the secrets set up by InitSecrets() to reading files
+func resetSecrets() {
+	secrets.Lock()
+	defer secrets.Unlock()
+
+	secrets.provider, secrets.values, secrets.certificate = nil, nil, nil
+}
+
+// TestVaultSecrets tests reading secrets from both versions of the key/value secrets engine
+func TestVaultSecrets(t *testing.T) {
+	vault := newStubVault("root-token")
+	defer vault.Close()
+
+	vault.setSecret("secret/auth_proxy", map[string]interface{}{"signing_key": "v1 key", "number": 1})
+	vault.setSecret("kv/data/auth_proxy", map[string]interface{}{
+		"data":     map[string]interface{}{"value": "v2 key"},
+		"metadata": map[string]interface{}{"version": 3},
+	})
+
+	testCases := []struct {
+		path     string
+		expected string
+		err      string
+	}{
+		{"secret/auth_proxy#signing_key", "v1 key", ""},
+		{"kv/data/auth_proxy", "v2 key", ""},
+		{"kv/data/auth_proxy#value", "v2 key", ""},
+		{"secret/auth_proxy#other", "", `Vault secret "secret/auth_proxy" has no field "other"`},
+		{"secret/auth_proxy#number", "", `Vault secret "secret/auth_proxy" has no field "number"`},
+		{"secret/missing#signing_key", "", `Vault secret "secret/missing" not found`},
+	}
+
+	for _, tc := range testCases {
+		provider := newVaultSecrets(vaultSettings(vault.URL, VaultSigningKeyPathKey, tc.path))
+
+		secret, err := provider.Secret(SecretTokenSigningKey)
+		if err != nil && err.Error() != tc.err {
+			t.Errorf("%s: expected error %q, got %q", tc.path, tc.err, err)
+		} else if err == nil && string(secret) != tc.expected {
+			t.Errorf("%s: expected %q, got %q (%v)", tc.path, tc.expected, secret, tc.err)
+		}
+	}
+
+	// the token isn't accepted anymore
+	vault.revokeTokens()
+
+	_, err := newVaultSecrets(vaultSettings(vault.URL)).Secret(SecretTokenSigningKey)
+	if err == nil || strings.Contains(err.Error(), "root-token") {
+		t.Errorf("expected an error without the token, got %v", err)
+	}
+
+	// secrets without a Vault path are read like the file backend does
+	_, err = newVaultSecrets(vaultSettings(vault.URL)).Secret(SecretTLSKey)
+	if err == nil || err.Error() != "tls_key_file is not set" {
+		t.Errorf("expected the TLS key to be read from its file, got %v", err)
+	}
+}
+
+// TestVaultAppRole tests logging in using an AppRole, again once the token expires
+func TestVaultAppRole(t *testing.T) {
+	vault := newStubVault("root-token")
+	defer vault.Close()
+
+	vault.setSecret("secret/auth_proxy", map[string]interface{}{"signing_key": "key"})
+
+	provider := newVaultSecrets(vaultSettings(vault.URL, VaultTokenKey, "", VaultRoleIDKey, "role", VaultSecretIDKey, "secret"))
+
+	for _, expectedLogins := range []int{1, 1, 2} {
+		if expectedLogins == 2 {
+			vault.revokeTokens()
+		}
+
+		if secret, err := provider.Secret(SecretTokenSigningKey); err != nil || string(secret) != "key" {
+			t.Fatalf("expected the secret, got %q (%v)", secret, err)
+		}
+
+		if vault.logins != expectedLogins {
+			t.Errorf("expected %d logins, got %d", expectedLogins, vault.logins)
+		}
+	}
+
+	provider = newVaultSecrets(vaultSettings(vault.URL, VaultTokenKey, "", VaultRoleIDKey, "role", VaultSecretIDKey, "wrong"))
+
+	_, err := provider.Secret(SecretTokenSigningKey)
+	if err == nil || !strings.Contains(err.Error(), "Vault AppRole login failed: status 400 [invalid secret id]") {
+		t.Errorf("expected the login to fail, got %v", err)
+	}
+}
+
+// TestInitSecretsFailures tests that InitSecrets() fails clearly if the secrets can't be read
+func TestInitSecretsFailures(t *testing.T) {
+	defer resetSecrets()
+
+	vault := newStubVault("root-token")
+	defer vault.Close()
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	// reads the TLS key pair from Vault as well
+	withTLS := func(address string, keysAndValues ...string) map[string]string {
+		settings := vaultSettings(address, VaultTLSCertificatePathKey, "secret/auth_proxy#cert", VaultTLSKeyPathKey, "secret/auth_proxy#key")
+		for i := 0; i+1 < len(keysAndValues); i += 2 {
+			settings[keysAndValues[i]] = keysAndValues[i+1]
+		}
+
+		return settings
+	}
+
+	testCases := []struct {
+		settings map[string]string
+		err      string
+	}{
+		{withTLS(unreachable.URL), "failed to read the tls certificate: Vault at " + unreachable.URL + " is unreachable"},
+		{withTLS(vault.URL), `failed to read the tls certificate: Vault secret "secret/auth_proxy" not found`},
+		{withTLS(vault.URL, VaultTokenKey, "wrong-token"), `failed to read the tls certificate: failed to read Vault secret "secret/auth_proxy": status 403 [permission denied]`},
+		{vaultSettings(vault.URL), "failed to read the tls certificate: tls_certificate is not set"},
+		{vaultSettings("vault:8200"), `invalid vault_address "vault:8200": must be a http(s) URL`},
+		{vaultSettings(vault.URL, VaultTokenKey, "", VaultRoleIDKey, "role"), "either vault_token or both vault_role_id and vault_secret_id are required"},
+		{vaultSettings(vault.URL, VaultTLSKeyPathKey, "secret/tls#key"), "either both or neither of vault_tls_certificate_path and vault_tls_key_path must be set"},
+		{vaultSettings(vault.URL, VaultSigningKeyPathKey, ""), "at least one of vault_tls_key_path and vault_signing_key_path must be set"},
+		{vaultSettings(vault.URL, SecretsRefreshIntervalKey, "-1"), `invalid secrets_refresh_interval "-1": must be an integer >= 0`},
+		{map[string]string{SecretsBackendKey: "consul"}, `invalid secrets_backend "consul": must be "file" or "vault"`},
+		{map[string]string{TLSCertificateKey: "/nonexistent/cert.pem", TLSKeyFileKey: "/nonexistent/local.key"}, "failed to read the tls certificate: open /nonexistent/cert.pem: no such file or directory"},
+	}
+
+	for _, tc := range testCases {
+		err := InitSecrets(tc.settings)
+		if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+			t.Errorf("expected error %q, got %v", tc.err, err)
+		} else if strings.Contains(err.Error(), "-token") {
+			t.Errorf("expected the error not to contain the token, got %q", err)
+		}
+	}
+}
+
+// TestRefreshSecrets tests that secrets rotated in Vault are used once they're re-fetched
+func TestRefreshSecrets(t *testing.T) {
+	defer resetSecrets()
+
+	vault := newStubVault("root-token")
+	defer vault.Close()
+
+	setKeyPair := func(signingKey string) (string, string) {
+		cert, key := newTestKeyPair(t)
+		vault.setSecret("secret/auth_proxy", map[string]interface{}{"cert": cert, "key": key, "signing_key": signingKey})
+		return cert, key
+	}
+
+	cert, _ := setKeyPair("first")
+
+	settings := vaultSettings(vault.URL, VaultTLSCertificatePathKey, "secret/auth_proxy#cert", VaultTLSKeyPathKey, "secret/auth_proxy#key")
+	if err := InitSecrets(settings); err != nil {
+		t.Fatalf("failed to init secrets: %s", err)
+	}
+
+	// the secrets are read from Vault and the TLS key is used for encryption
+	checkSecrets := func(expectedCert, expectedSigningKey string) {
+		if key, err := GetSecret(SecretTokenSigningKey); err != nil || string(key) != expectedSigningKey {
+			t.Errorf("expected signing key %q, got %q (%v)", expectedSigningKey, key, err)
+		}
+
+		pair, err := TLSCertificate()
+		if err != nil {
+			t.Fatalf("failed to get the TLS certificate: %s", err)
+		}
+
+		if block, _ := pem.Decode([]byte(expectedCert)); string(pair.Certificate[0]) != string(block.Bytes) {
+			t.Errorf("expected the TLS certificate to be the one in Vault")
+		}
+
+		encrypted, err := Encrypt("data")
+		if err != nil {
+			t.Fatalf("failed to encrypt: %s", err)
+		}
+
+		if decrypted, err := Decrypt(encrypted); err != nil || decrypted != "data" {
+			t.Errorf("expected to decrypt %q, got %q (%v)", "data", decrypted, err)
+		}
+	}
+
+	checkSecrets(cert, "first")
+
+	// rotated secrets are used once they're re-fetched
+	rotated, _ := setKeyPair("second")
+	checkSecrets(cert, "first")
+
+	refreshSecrets()
+	checkSecrets(rotated, "second")
+
+	// the current secrets are kept if the new ones can't be used
+	mismatched, _ := newTestKeyPair(t)
+	vault.setSecret("secret/auth_proxy", map[string]interface{}{"cert": mismatched, "key": "", "signing_key": "third"})
+
+	refreshSecrets()
+	checkSecrets(rotated, "second")
+
+	// the token signing key is kept in the data store unless it's in Vault
+	delete(settings, VaultSigningKeyPathKey)
+	setKeyPair("")
+
+	if err := InitSecrets(settings); err != nil {
+		t.Fatalf("failed to init secrets: %s", err)
+	}
+
+	if _, err := GetSecret(SecretTokenSigningKey); err != auth_errors.ErrSecretNotConfigured {
+		t.Errorf("expected %v, got %v", auth_errors.ErrSecretNotConfigured, err)
+	}
+}
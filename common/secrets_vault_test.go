@@ -0,0 +1,91 @@
+// +build vault
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// These tests read secrets from a real Vault server started in dev mode, e.g.
+//   vault server -dev -dev-root-token-id=root
+//   VAULT_ADDR=http://127.0.0.1:8200 VAULT_TOKEN=root go test -tags vault ./common -run TestDevVault
+
+// devVault returns the address and root token of the dev mode Vault server
+func devVault(t *testing.T) (string, string) {
+	address, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if IsEmpty(address) || IsEmpty(token) {
+		t.Fatal("VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+
+	return address, token
+}
+
+// writeDevVaultSecret writes the fields of a secret to the dev mode server's
+// key/value secrets engine (version 2, mounted at secret/)
+func writeDevVaultSecret(t *testing.T, address, token, name string, fields map[string]string) {
+	body, _ := json.Marshal(map[string]interface{}{"data": fields})
+
+	req, err := http.NewRequest("POST", address+"/v1/secret/data/"+name, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to write secret: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("failed to write secret: status %d", resp.StatusCode)
+	}
+}
+
+// TestDevVault tests reading and rotating the TLS key pair and token signing key
+func TestDevVault(t *testing.T) {
+	defer resetSecrets()
+
+	address, token := devVault(t)
+
+	cert, key := newTestKeyPair(t)
+	writeDevVaultSecret(t, address, token, "auth_proxy_test", map[string]string{"cert": cert, "key": key, "signing_key": "first"})
+
+	settings := map[string]string{
+		SecretsBackendKey:          "vault",
+		VaultAddressKey:            address,
+		VaultTokenKey:              token,
+		VaultTLSCertificatePathKey: "secret/data/auth_proxy_test#cert",
+		VaultTLSKeyPathKey:         "secret/data/auth_proxy_test#key",
+		VaultSigningKeyPathKey:     "secret/data/auth_proxy_test#signing_key",
+	}
+
+	if err := InitSecrets(settings); err != nil {
+		t.Fatalf("failed to init secrets: %s", err)
+	}
+
+	if _, err := TLSCertificate(); err != nil {
+		t.Errorf("failed to get the TLS certificate: %s", err)
+	}
+
+	if signingKey, err := GetSecret(SecretTokenSigningKey); err != nil || string(signingKey) != "first" {
+		t.Errorf("expected signing key %q, got %q (%v)", "first", signingKey, err)
+	}
+
+	cert, key = newTestKeyPair(t)
+	writeDevVaultSecret(t, address, token, "auth_proxy_test", map[string]string{"cert": cert, "key": key, "signing_key": "second"})
+	refreshSecrets()
+
+	if signingKey, err := GetSecret(SecretTokenSigningKey); err != nil || string(signingKey) != "second" {
+		t.Errorf("expected signing key %q, got %q (%v)", "second", signingKey, err)
+	}
+
+	settings[VaultSigningKeyPathKey] = "secret/data/auth_proxy_missing#signing_key"
+	if err := InitSecrets(settings); err == nil {
+		t.Error("expected a missing secret to fail")
+	}
+}
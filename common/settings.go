@@ -0,0 +1,634 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// `GlobalMap` keys which can be changed at runtime via ReloadSettings()
+const (
+	// LogLevelKey holds the logrus log level, e.g. "info" or "debug"
+	LogLevelKey = "log_level"
+
+	// NetmasterTimeoutKey holds the time (in seconds) allowed for a request to netmaster
+	NetmasterTimeoutKey = "netmaster_timeout"
+
+	// EndpointPolicyDefaultRoleKey holds the minimum role ("admin" or "ops") required
+	// to access netmaster endpoints which aren't matched by any endpoint policy rule
+	EndpointPolicyDefaultRoleKey = "endpoint_policy_default_role"
+
+	// IntrospectionClientIDKey and IntrospectionClientSecretKey hold the credential
+	// which services use to authenticate to the token introspection endpoint.
+	// Introspection is limited to admin tokens if either of them is empty.
+	IntrospectionClientIDKey     = "introspection_client_id"
+	IntrospectionClientSecretKey = "introspection_client_secret"
+
+	// IntrospectionRateLimitKey holds the number of introspection requests per
+	// second allowed for each client IP; 0 disables rate limiting
+	IntrospectionRateLimitKey = "introspection_rate_limit"
+
+	// PasswordMaxAgeKey holds the number of days after which local users have to
+	// change their password; 0 disables password expiry. Passwords whose last
+	// change wasn't recorded don't expire.
+	PasswordMaxAgeKey = "password_max_age"
+
+	// PasswordMinLengthKey holds the minimum length of new local user passwords,
+	// and the other PasswordRequire*/PasswordRejectUsernameKey keys ("true" or
+	// "false") the further rules they have to follow; see PasswordPolicyViolations().
+	// All of them are disabled by default.
+	PasswordMinLengthKey        = "password_min_length"
+	PasswordRequireMixedCaseKey = "password_require_mixed_case"
+	PasswordRequireDigitKey     = "password_require_digit"
+	PasswordRequireSymbolKey    = "password_require_symbol"
+	PasswordRejectUsernameKey   = "password_reject_username"
+
+	// AllowBasicAuthKey holds whether requests proxied to netmaster can carry a
+	// local or LDAP/AD username and password using HTTP Basic auth instead of a
+	// token ("true" or "false"); disabled by default
+	AllowBasicAuthKey = "allow_basic_auth"
+
+	// StrictAuthorizationKey holds whether requests proxied to netmaster are
+	// rejected for non-admin users who aren't authorized for any tenant
+	// ("true" or "false"), rather than getting lists filtered down to nothing.
+	// Such users can still log in. Disabled by default.
+	StrictAuthorizationKey = "strict_authorization"
+
+	// NormalizeUsernamesKey holds whether usernames are case-insensitive ("true"
+	// or "false"): new local users are stored and looked up lowercased, and
+	// authorizations apply to their principal in any case. Local users created
+	// with mixed-case names before keep working under the name they were
+	// created with. Disabled by default.
+	NormalizeUsernamesKey = "normalize_usernames"
+
+	// UsernamePatternKey holds a regular expression the whole name of new local
+	// users has to match, e.g. "[a-z][a-z0-9.]*", and UsernameMinLengthKey and
+	// UsernameMaxLengthKey their minimum and maximum length; see ValidateUsername().
+	// They can only restrict LocalUsernamePattern further, and don't apply to
+	// existing users. All of them are disabled by default.
+	UsernamePatternKey   = "username_pattern"
+	UsernameMinLengthKey = "username_min_length"
+	UsernameMaxLengthKey = "username_max_length"
+
+	// PasswordHashCostKey holds the bcrypt cost of new password hashes; see
+	// PasswordHashCost()
+	PasswordHashCostKey = "password_hash_cost"
+
+	// DeletedUserRetentionKey holds the number of days for which deleted local
+	// users can be restored before they're permanently deleted; 0 keeps them
+	// until they're deleted permanently by an admin
+	DeletedUserRetentionKey = "deleted_user_retention"
+
+	// LoginAuditMaxAgeKey holds the number of days for which login audit records
+	// are kept, and LoginAuditMaxEntriesKey the maximum number of records kept;
+	// the oldest records are pruned first. 0 disables either limit.
+	LoginAuditMaxAgeKey     = "login_audit_max_age"
+	LoginAuditMaxEntriesKey = "login_audit_max_entries"
+
+	// RevocationCleanupIntervalKey holds the time (in seconds) between two scans
+	// deleting the revoked tokens and principals whose tokens have all expired;
+	// each wait is jittered. 0 disables the cleanup.
+	RevocationCleanupIntervalKey = "revocation_cleanup_interval"
+
+	// LdapCacheTTLKey holds the time (in seconds) for which successful LDAP logins
+	// are cached; cached logins are only used while the directory is unreachable.
+	// 0 disables the cache.
+	LdapCacheTTLKey = "ldap_cache_ttl"
+
+	// LdapConnectTimeoutKey holds the time (in seconds) allowed to connect to
+	// each LDAP/AD server, including the TLS handshake; 5 by default
+	LdapConnectTimeoutKey = "ldap_connect_timeout"
+
+	// LdapGroupNestingDepthKey holds the number of levels of nested LDAP/AD groups
+	// followed when resolving the groups of a user; 10 by default, 0 resolves
+	// the groups the user is a direct member of only
+	LdapGroupNestingDepthKey = "ldap_group_nesting_depth"
+
+	// LdapPoolSizeKey holds the number of idle connections to the LDAP/AD server
+	// kept for reuse across logins; 4 by default, 0 disables the pool
+	LdapPoolSizeKey = "ldap_pool_size"
+
+	// LdapPoolIdleTimeoutKey holds the time (in seconds) after which idle pooled
+	// LDAP/AD connections are closed; 60 by default
+	LdapPoolIdleTimeoutKey = "ldap_pool_idle_timeout"
+
+	// LdapPageSizeKey holds the number of entries requested per page of LDAP/AD
+	// searches; 500 by default, 0 disables paging
+	LdapPageSizeKey = "ldap_page_size"
+
+	// LdapGroupSearchLimitKey holds the maximum number of groups returned by
+	// the LDAP/AD group search; 50 by default
+	LdapGroupSearchLimitKey = "ldap_group_search_limit"
+
+	// AuthzCacheTTLKey holds the time (in seconds) for which the principals'
+	// authorizations are cached. Changes made through other proxies sharing the
+	// data store are only seen once the cached entries expire. 0 disables the cache.
+	AuthzCacheTTLKey = "authz_cache_ttl"
+
+	// KubernetesAPIServerKey holds the URL of the Kubernetes API server, e.g.
+	// https://kubernetes.default.svc; Kubernetes ServiceAccount tokens are only
+	// accepted if it's set. KubernetesCAFileKey and KubernetesReviewerTokenFileKey
+	// hold the paths of the API server's CA certificate and of the token used to
+	// call the TokenReview API; both are optional.
+	KubernetesAPIServerKey         = "kubernetes_api_server"
+	KubernetesCAFileKey            = "kubernetes_ca_file"
+	KubernetesReviewerTokenFileKey = "kubernetes_reviewer_token_file"
+
+	// TokenIssuerKey and TokenAudienceKey hold the "iss" and "aud" claims of new
+	// tokens; tokens with other claims are rejected, so that tokens don't work
+	// across environments sharing a signing key. The issuer defaults to
+	// "auth_proxy" and the audience isn't checked if empty.
+	TokenIssuerKey   = "token_issuer"
+	TokenAudienceKey = "token_audience"
+
+	// TokenTTLKey holds the validity of new tokens as a Go duration, e.g. "30m"
+	// or "24h"; tokens issued already keep their expiry
+	TokenTTLKey = "token_ttl"
+
+	// TokenRefreshWindowKey holds the last part (in percent) of a token's
+	// lifetime during which it can be exchanged for a new token; 0 disables
+	// refreshing tokens
+	TokenRefreshWindowKey = "token_refresh_window"
+
+	// IdentityHeaderSecretKey holds the secret shared with netmaster which is
+	// used to sign the identity headers added to authorized requests (see
+	// package identity); the headers aren't added if it's empty
+	IdentityHeaderSecretKey = "identity_header_secret"
+
+	// MaxBodySizeKey holds the maximum size (in bytes) of request bodies; larger
+	// requests are rejected with a 413. 0 disables the limit.
+	MaxBodySizeKey = "max_body_size"
+
+	// ClientCertIdentityKey holds which field of a verified client certificate
+	// names the local or LDAP/AD user it authenticates (see ClientCertAuthKey):
+	// ClientCertIdentityCN (the default), or the first DNS or email SAN with
+	// ClientCertIdentityDNS or ClientCertIdentityEmail
+	ClientCertIdentityKey = "client_cert_identity"
+
+	// ConfigFileKey holds the path of the JSON configuration file re-read on every reload
+	ConfigFileKey = "config_file"
+)
+
+// `GlobalMap` keys which are only read at startup; changing them requires a restart
+const (
+	ListenAddressKey      = "listen_address"
+	NetmasterAddressKey   = "netmaster_address"
+	DataStoreAddressKey   = "data_store_address"
+	TLSCertificateKey     = "tls_certificate"
+	TLSKeyFileKey         = "tls_key_file"
+	ClientReadTimeoutKey  = "client_read_timeout"
+	ClientWriteTimeoutKey = "client_write_timeout"
+	UIAssetsPathKey       = "ui_assets_path"
+
+	// PreviousTLSKeyFilesKey holds the comma-separated paths of TLS keys which
+	// were replaced by the current one; data encrypted with them (see Decrypt())
+	// can still be read until it's re-encrypted with the current key
+	PreviousTLSKeyFilesKey = "previous_tls_key_files"
+
+	// NetmasterMaxIdleConnsPerHostKey, NetmasterIdleConnTimeoutKey and
+	// NetmasterTLSHandshakeTimeoutKey tune the pool of connections to netmaster
+	NetmasterMaxIdleConnsPerHostKey = "max_idle_conns_per_host"
+	NetmasterIdleConnTimeoutKey     = "idle_conn_timeout"
+	NetmasterTLSHandshakeTimeoutKey = "tls_handshake_timeout"
+
+	// HTTP2EnabledKey holds whether HTTP/2 is offered to clients ("true" or "false")
+	HTTP2EnabledKey = "http2_enabled"
+
+	// NetmasterH2CKey holds whether requests are sent to netmaster using HTTP/2
+	// over cleartext with prior knowledge ("true" or "false")
+	NetmasterH2CKey = "netmaster_h2c"
+
+	// LeaderElectionKey holds whether the instances sharing the data store elect
+	// a leader which alone adds the default users and runs the background sweepers
+	// ("true" or "false"). LeaderLeaseTTLKey holds the time (in seconds) after
+	// which another instance takes over if the leader goes away, and
+	// InstanceIDKey the name of this instance in the election.
+	LeaderElectionKey = "leader_election"
+	LeaderLeaseTTLKey = "leader_lease_ttl"
+	InstanceIDKey     = "instance_id"
+
+	// TokenSigningMethodKey holds how our tokens are signed: TokenSigningHS256
+	// (the default) with a shared key, or TokenSigningRS256 with the RSA private
+	// key in the PEM file named by TokenSigningKeyFileKey, so that others can
+	// verify them using the public key
+	TokenSigningMethodKey  = "token_signing_method"
+	TokenSigningKeyFileKey = "token_signing_key_file"
+
+	// ClientCertAuthKey holds whether the listener asks clients for a certificate
+	// ("true" or "false"); requests carrying one which was issued by a CA in the
+	// PEM bundle named by ClientCAFileKey are authenticated without a token.
+	// Clients without a certificate aren't affected.
+	ClientCertAuthKey = "client_cert_auth"
+	ClientCAFileKey   = "client_ca_file"
+
+	// DataStoreCAFileKey holds the PEM bundle of the CAs the data store's
+	// certificate is verified with when its address uses https, e.g.
+	// etcd+https://host:2379; DataStoreCertFileKey and DataStoreKeyFileKey
+	// hold the client certificate presented to it, if any.
+	// DataStoreInsecureSkipVerifyKey ("true" or "false") disables the
+	// verification of the data store's certificate and is only meant for labs.
+	DataStoreCAFileKey             = "data_store_ca_file"
+	DataStoreCertFileKey           = "data_store_cert_file"
+	DataStoreKeyFileKey            = "data_store_key_file"
+	DataStoreInsecureSkipVerifyKey = "data_store_insecure_skip_verify"
+
+	// DataStoreStartupTimeoutKey holds the time (in seconds) during which the
+	// data store is tried again at startup if it can't be reached; 0 gives up
+	// right away
+	DataStoreStartupTimeoutKey = "data_store_startup_timeout"
+
+	// ConsulDatacenterKey holds the consul datacenter the keys are kept in (the
+	// agent's if empty), and ConsulAllowStaleReadsKey ("true" or "false")
+	// whether reads may be answered by any consul server rather than the
+	// leader, which avoids a round trip to the leader at the cost of possibly
+	// slightly out-of-date answers; writes are always consistent
+	ConsulDatacenterKey      = "consul_datacenter"
+	ConsulAllowStaleReadsKey = "consul_allow_stale_reads"
+)
+
+// client certificate identities; see ClientCertIdentityKey
+const (
+	ClientCertIdentityCN    = "cn"
+	ClientCertIdentityDNS   = "dns"
+	ClientCertIdentityEmail = "email"
+)
+
+// token signing methods; see TokenSigningMethodKey
+const (
+	TokenSigningHS256 = "HS256"
+	TokenSigningRS256 = "RS256"
+)
+
+// restartRequiredKeys are the settings which cannot be changed by a reload
+var restartRequiredKeys = []string{
+	ListenAddressKey,
+	NetmasterAddressKey,
+	DataStoreAddressKey,
+	TLSCertificateKey,
+	TLSKeyFileKey,
+	PreviousTLSKeyFilesKey,
+	ClientReadTimeoutKey,
+	ClientWriteTimeoutKey,
+	UIAssetsPathKey,
+	ConfigFileKey,
+	NetmasterMaxIdleConnsPerHostKey,
+	NetmasterIdleConnTimeoutKey,
+	NetmasterTLSHandshakeTimeoutKey,
+	HTTP2EnabledKey,
+	NetmasterH2CKey,
+	SecretsBackendKey,
+	VaultAddressKey,
+	VaultTokenKey,
+	VaultRoleIDKey,
+	VaultSecretIDKey,
+	VaultTLSCertificatePathKey,
+	VaultTLSKeyPathKey,
+	VaultSigningKeyPathKey,
+	SecretsRefreshIntervalKey,
+	LeaderElectionKey,
+	LeaderLeaseTTLKey,
+	InstanceIDKey,
+	TokenSigningMethodKey,
+	TokenSigningKeyFileKey,
+	ClientCertAuthKey,
+	ClientCAFileKey,
+	DataStoreCAFileKey,
+	DataStoreCertFileKey,
+	DataStoreKeyFileKey,
+	DataStoreInsecureSkipVerifyKey,
+	DataStoreStartupTimeoutKey,
+	ConsulDatacenterKey,
+	ConsulAllowStaleReadsKey,
+}
+
+// EnvPrefix is prepended to the upper-cased setting key to form the name of
+// the environment variable which overrides it, e.g. AUTH_PROXY_LOG_LEVEL
+const EnvPrefix = "AUTH_PROXY_"
+
+// RestartRequired is the reason reported for settings ignored by a reload
+const RestartRequired = "ignored, restart required"
+
+// SettingsSource returns a set of settings (key:value pairs) to be layered on
+// top of the flags, environment and configuration file on every reload.
+type SettingsSource func() (map[string]string, error)
+
+// ReloadResult describes the outcome of a successful ReloadSettings() call
+type ReloadResult struct {
+	Changed []string          `json:"changed"` // keys whose value changed
+	Ignored map[string]string `json:"ignored"` // keys which changed but were not applied, and why
+}
+
+var (
+	settingsMutex   sync.Mutex       // serializes reloads and Set(), guards baseSettings and settingsSources
+	baseSettings    = GlobalMap{}    // everything Set() programmatically, i.e. from flags
+	settingsSources []SettingsSource // additional sources registered by other packages
+)
+
+// RegisterSettingsSource adds a source of settings which is consulted on
+// every reload after the environment and configuration file, e.g. globals
+// stored in the data store. Sources registered later take precedence.
+// params:
+//  source: function returning the settings to apply
+func RegisterSettingsSource(source SettingsSource) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	settingsSources = append(settingsSources, source)
+}
+
+// readConfigFile reads settings from a JSON file containing a single object
+// of string values, e.g. {"log_level": "debug", "netmaster_timeout": "30"}
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %q: %s", path, err.Error())
+	}
+
+	settings := map[string]string{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %q: %s", path, err.Error())
+	}
+
+	return settings, nil
+}
+
+// envSettings returns the settings overridden through AUTH_PROXY_<KEY> envvars
+func envSettings() map[string]string {
+	settings := map[string]string{}
+
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], EnvPrefix) {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimPrefix(parts[0], EnvPrefix))
+		if !IsEmpty(key) {
+			settings[key] = parts[1]
+		}
+	}
+
+	return settings
+}
+
+// localSettings layers the environment and the configuration file on top of
+// the given settings, i.e. all the sources which don't need the data store.
+// params:
+//  base: settings set from flags; not modified
+// return values:
+//  GlobalMap: the resulting settings
+//  error: nil unless the configuration file couldn't be read
+func localSettings(base map[string]string) (GlobalMap, error) {
+	settings := GlobalMap{}
+	for key, value := range base {
+		settings[key] = value
+	}
+
+	for key, value := range envSettings() {
+		settings[key] = value
+	}
+
+	if path, found := settings[ConfigFileKey]; found && !IsEmpty(path) {
+		fileSettings, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, value := range fileSettings {
+			settings[key] = value
+		}
+	}
+
+	return settings, nil
+}
+
+// ValidateSettings checks the values of all the settings we know about.
+// params:
+//  settings: complete set of settings to be validated
+// return values:
+//  error: nil if all the settings are valid, otherwise an error naming the invalid one
+func ValidateSettings(settings map[string]string) error {
+	if level, found := settings[LogLevelKey]; found {
+		if _, err := log.ParseLevel(level); err != nil {
+			return fmt.Errorf("invalid %s %q: %s", LogLevelKey, level, err.Error())
+		}
+	}
+
+	if role, found := settings[EndpointPolicyDefaultRoleKey]; found && role != "admin" && role != "ops" {
+		return fmt.Errorf("invalid %s %q: must be \"admin\" or \"ops\"", EndpointPolicyDefaultRoleKey, role)
+	}
+
+	if list, found := settings[TrustedProxiesKey]; found {
+		if _, err := ParseCIDRList(list); err != nil {
+			return fmt.Errorf("invalid %s: %s", TrustedProxiesKey, err.Error())
+		}
+	}
+
+	for _, key := range []string{ManagementAllowedCIDRsKey, ManagementDeniedCIDRsKey} {
+		if list, found := settings[key]; found {
+			if _, err := ParseCIDRList(list); err != nil {
+				return fmt.Errorf("invalid %s: %s", key, err.Error())
+			}
+		}
+	}
+
+	if identity, found := settings[ClientCertIdentityKey]; found && !IsEmpty(identity) &&
+		identity != ClientCertIdentityCN && identity != ClientCertIdentityDNS && identity != ClientCertIdentityEmail {
+		return fmt.Errorf("invalid %s %q: must be %q, %q or %q", ClientCertIdentityKey, identity,
+			ClientCertIdentityCN, ClientCertIdentityDNS, ClientCertIdentityEmail)
+	}
+
+	for _, key := range []string{ManagementRestrictLoginKey, HTTP2EnabledKey, NetmasterH2CKey, LeaderElectionKey, ClientCertAuthKey, AllowBasicAuthKey, NormalizeUsernamesKey, StrictAuthorizationKey,
+		PasswordRequireMixedCaseKey, PasswordRequireDigitKey, PasswordRequireSymbolKey, PasswordRejectUsernameKey} {
+		if value, found := settings[key]; found && !IsEmpty(value) {
+			if _, err := strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("invalid %s %q: must be \"true\" or \"false\"", key, value)
+			}
+		}
+	}
+
+	if value, found := settings[UsernamePatternKey]; found && !IsEmpty(value) {
+		if _, err := compileUsernamePattern(value); err != nil {
+			return fmt.Errorf("invalid %s %q: %s", UsernamePatternKey, value, err.Error())
+		}
+	}
+
+	for _, key := range []string{PasswordMaxAgeKey, PasswordMinLengthKey, UsernameMinLengthKey, UsernameMaxLengthKey, DeletedUserRetentionKey, LoginAuditMaxAgeKey, LoginAuditMaxEntriesKey, LdapCacheTTLKey, MaxBodySizeKey,
+		RevocationCleanupIntervalKey, AuthzCacheTTLKey, LdapGroupNestingDepthKey, LdapPoolSizeKey, LdapPageSizeKey} {
+		if value, found := settings[key]; found && !IsEmpty(value) {
+			if n, err := strconv.ParseInt(value, 10, 64); err != nil || n < 0 {
+				return fmt.Errorf("invalid %s %q: must be an integer >= 0", key, value)
+			}
+		}
+	}
+
+	if value, found := settings[UsernameMaxLengthKey]; found && !IsEmpty(value) {
+		maxLength, _ := strconv.Atoi(value)
+		if minLength, err := strconv.Atoi(settings[UsernameMinLengthKey]); err == nil && maxLength > 0 && maxLength < minLength {
+			return fmt.Errorf("invalid %s %d: must be >= %s (%d)", UsernameMaxLengthKey, maxLength, UsernameMinLengthKey, minLength)
+		}
+	}
+
+	if value, found := settings[KubernetesAPIServerKey]; found && !IsEmpty(value) {
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "https" && u.Scheme != "http") || IsEmpty(u.Host) {
+			return fmt.Errorf("invalid %s %q: must be a http(s) URL", KubernetesAPIServerKey, value)
+		}
+	}
+
+	if value, found := settings[TokenSigningMethodKey]; found && !IsEmpty(value) && value != TokenSigningHS256 && value != TokenSigningRS256 {
+		return fmt.Errorf("invalid %s %q: must be %q or %q", TokenSigningMethodKey, value, TokenSigningHS256, TokenSigningRS256)
+	}
+
+	if value, found := settings[TokenTTLKey]; found && !IsEmpty(value) {
+		if ttl, err := time.ParseDuration(value); err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid %s %q: must be a duration > 0, e.g. \"10h\"", TokenTTLKey, value)
+		}
+	}
+
+	if value, found := settings[TokenRefreshWindowKey]; found && !IsEmpty(value) {
+		if n, err := strconv.ParseInt(value, 10, 64); err != nil || n < 0 || n > 100 {
+			return fmt.Errorf("invalid %s %q: must be an integer between 0 and 100", TokenRefreshWindowKey, value)
+		}
+	}
+
+	if value, found := settings[PasswordHashCostKey]; found && !IsEmpty(value) {
+		if n, err := strconv.Atoi(value); err != nil || n < bcrypt.MinCost || n > bcrypt.MaxCost {
+			return fmt.Errorf("invalid %s %q: must be an integer between %d and %d", PasswordHashCostKey, value, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	}
+
+	if value, found := settings[IntrospectionRateLimitKey]; found {
+		if limit, err := strconv.ParseFloat(value, 64); err != nil || limit < 0 {
+			return fmt.Errorf("invalid %s %q: must be a number >= 0", IntrospectionRateLimitKey, value)
+		}
+	}
+
+	for _, key := range []string{NetmasterMaxIdleConnsPerHostKey, NetmasterIdleConnTimeoutKey, NetmasterTLSHandshakeTimeoutKey, LeaderLeaseTTLKey, LdapConnectTimeoutKey, LdapPoolIdleTimeoutKey,
+		LdapGroupSearchLimitKey} {
+		if value, found := settings[key]; found {
+			if n, err := strconv.ParseInt(value, 10, 64); err != nil || n <= 0 {
+				return fmt.Errorf("invalid %s %q: must be an integer > 0", key, value)
+			}
+		}
+	}
+
+	if value, found := settings[NetmasterTimeoutKey]; found {
+		timeout, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid %s %q: must be an integer > 0", NetmasterTimeoutKey, value)
+		}
+
+		if value, found := settings[ClientWriteTimeoutKey]; found {
+			writeTimeout, err := strconv.ParseInt(value, 10, 64)
+			if err == nil && writeTimeout <= timeout {
+				return fmt.Errorf("invalid %s %d: must be < %s (%d)",
+					NetmasterTimeoutKey, timeout, ClientWriteTimeoutKey, writeTimeout)
+			}
+		}
+	}
+
+	return nil
+}
+
+// applySettings performs the side effects of settings which aren't simply
+// read from `GlobalMap` when they're needed.
+func applySettings(settings GlobalMap) {
+	if value, found := settings[LogLevelKey]; found {
+		level, _ := log.ParseLevel(value) // already validated
+		log.SetLevel(level)
+	}
+}
+
+// ReloadSettings re-reads all the configuration sources, validates the result
+// and atomically swaps it in as the new `GlobalMap`. The sources are applied
+// in the following order, later ones taking precedence:
+//   1. flags (i.e. everything set using `Global().Set()`)
+//   2. AUTH_PROXY_<KEY> environment variables
+//   3. the JSON file named by ConfigFileKey, if any
+//   4. registered SettingsSources (e.g. the data store)
+//
+// Settings which can only be applied at startup are left unchanged and
+// reported in ReloadResult.Ignored. Nothing is changed if any source fails
+// or the new settings are invalid.
+// return values:
+//  *ReloadResult: changed and ignored settings
+//  error: nil on success, otherwise the reason the reload failed
+func ReloadSettings() (*ReloadResult, error) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	current := Global()
+
+	settings, err := localSettings(baseSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, source := range settingsSources {
+		sourceSettings, err := source()
+		if err != nil {
+			return nil, err
+		}
+
+		for key, value := range sourceSettings {
+			settings[key] = value
+		}
+	}
+
+	result := &ReloadResult{Changed: []string{}, Ignored: map[string]string{}}
+
+	for _, key := range restartRequiredKeys {
+		oldValue, wasFound := current[key]
+		newValue, found := settings[key]
+		if wasFound == found && oldValue == newValue {
+			continue
+		}
+
+		result.Ignored[key] = RestartRequired
+		if wasFound {
+			settings[key] = oldValue
+		} else {
+			delete(settings, key)
+		}
+	}
+
+	if err := ValidateSettings(settings); err != nil {
+		return nil, err
+	}
+
+	for key, value := range settings {
+		if oldValue, found := current[key]; !found || oldValue != value {
+			result.Changed = append(result.Changed, key)
+		}
+	}
+
+	for key := range current {
+		if _, found := settings[key]; !found {
+			result.Changed = append(result.Changed, key)
+		}
+	}
+
+	sort.Strings(result.Changed)
+
+	global.Store(settings)
+
+	applySettings(settings)
+
+	for key, reason := range result.Ignored {
+		log.Warnf("Setting %q was not reloaded: %s", key, reason)
+	}
+
+	log.Infof("Reloaded settings, changed: %v", result.Changed)
+
+	return result, nil
+}
@@ -0,0 +1,359 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// writeConfigFile replaces the contents of the given config file
+func writeConfigFile(t *testing.T, path, data string) {
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("failed to write config file: %s", err)
+	}
+}
+
+// TestReloadSettings tests changing the log level and netmaster timeout at runtime
+func TestReloadSettings(t *testing.T) {
+	f, err := ioutil.TempFile("", "auth_proxy_settings")
+	if err != nil {
+		t.Fatalf("failed to create config file: %s", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	defer log.SetLevel(log.GetLevel())
+
+	// flags
+	Global().Set(ConfigFileKey, f.Name())
+	Global().Set(LogLevelKey, "info")
+	Global().Set(NetmasterTimeoutKey, "10")
+	Global().Set(ClientWriteTimeoutKey, "11")
+	Global().Set(ListenAddressKey, ":10000")
+	defer Global().Set(ConfigFileKey, "")
+
+	writeConfigFile(t, f.Name(), `{}`)
+	if _, err := ReloadSettings(); err != nil {
+		t.Fatalf("failed to load settings: %s", err)
+	}
+
+	if log.GetLevel() != log.InfoLevel {
+		t.Fatalf("expected log level %q, got %q", log.InfoLevel, log.GetLevel())
+	}
+
+	// change the log level and timeout, try to change the listen address
+	writeConfigFile(t, f.Name(), `{"log_level": "debug", "netmaster_timeout": "5", "listen_address": ":20000"}`)
+
+	before := Global()
+
+	result, err := ReloadSettings()
+	if err != nil {
+		t.Fatalf("failed to reload settings: %s", err)
+	}
+
+	if log.GetLevel() != log.DebugLevel {
+		t.Errorf("expected log level %q, got %q", log.DebugLevel, log.GetLevel())
+	}
+
+	if timeout, _ := Global().Get(NetmasterTimeoutKey); timeout != "5" {
+		t.Errorf("expected %s 5, got %q", NetmasterTimeoutKey, timeout)
+	}
+
+	if address, _ := Global().Get(ListenAddressKey); address != ":10000" {
+		t.Errorf("expected %s to be unchanged, got %q", ListenAddressKey, address)
+	}
+
+	if len(result.Changed) != 2 || result.Changed[0] != LogLevelKey || result.Changed[1] != NetmasterTimeoutKey {
+		t.Errorf("unexpected changed settings: %v", result.Changed)
+	}
+
+	if result.Ignored[ListenAddressKey] != RestartRequired {
+		t.Errorf("expected %s to be ignored, got %v", ListenAddressKey, result.Ignored)
+	}
+
+	// the previous snapshot must not have been modified
+	if timeout, _ := before.Get(NetmasterTimeoutKey); timeout != "10" {
+		t.Errorf("previous settings were modified: %s = %q", NetmasterTimeoutKey, timeout)
+	}
+
+	// the environment overrides flags but not the config file
+	os.Setenv(EnvPrefix+"NETMASTER_TIMEOUT", "7")
+	defer os.Unsetenv(EnvPrefix + "NETMASTER_TIMEOUT")
+
+	writeConfigFile(t, f.Name(), `{"log_level": "debug"}`)
+	if _, err := ReloadSettings(); err != nil {
+		t.Fatalf("failed to reload settings: %s", err)
+	}
+
+	if timeout, _ := Global().Get(NetmasterTimeoutKey); timeout != "7" {
+		t.Errorf("expected %s 7 from the environment, got %q", NetmasterTimeoutKey, timeout)
+	}
+
+	// invalid settings are rejected as a whole
+	for _, data := range []string{
+		`{"log_level": "loud"}`,
+		`{"log_level": "warn", "netmaster_timeout": "0"}`,
+		`{"log_level": "warn", "netmaster_timeout": "11"}`,
+		`{"log_level": "warn", "trusted_proxies": "foo"}`,
+		`{"log_level": `,
+	} {
+		writeConfigFile(t, f.Name(), data)
+		if _, err := ReloadSettings(); err == nil {
+			t.Errorf("expected reload to fail for %s", data)
+		}
+
+		if log.GetLevel() != log.DebugLevel {
+			t.Errorf("failed reload changed the log level to %q", log.GetLevel())
+		}
+
+		if timeout, _ := Global().Get(NetmasterTimeoutKey); timeout != "7" {
+			t.Errorf("failed reload changed %s to %q", NetmasterTimeoutKey, timeout)
+		}
+	}
+}
+
+// TestConcurrentSettings tests reading settings from many goroutines while
+// they're being Set and reloaded; run with -race.
+func TestConcurrentSettings(t *testing.T) {
+	defer Global().Set(ConfigFileKey, "")
+	Global().Set(ConfigFileKey, "")
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				g := Global()
+				g.Get(LogLevelKey)
+				for range g {
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		if err := Global().Set("concurrency_test", strconv.Itoa(i)); err != nil {
+			t.Fatalf("failed to set: %s", err)
+		}
+
+		if i%20 == 0 {
+			if _, err := ReloadSettings(); err != nil {
+				t.Fatalf("failed to reload settings: %s", err)
+			}
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+
+	if value, _ := Global().Get("concurrency_test"); value != "199" {
+		t.Errorf("expected the last value to win, got %q", value)
+	}
+
+	// snapshots are not affected by later changes
+	snapshot := Global()
+	Global().Set("concurrency_test", "changed")
+
+	if value, _ := snapshot.Get("concurrency_test"); value != "199" {
+		t.Errorf("snapshot was modified: %q", value)
+	}
+}
+
+// TestValidateKubernetesAPIServer tests validation of the Kubernetes API server URL
+func TestValidateKubernetesAPIServer(t *testing.T) {
+	for _, server := range []string{"", "https://kubernetes.default.svc", "http://10.0.0.1:8080/"} {
+		if err := ValidateSettings(map[string]string{KubernetesAPIServerKey: server}); err != nil {
+			t.Errorf("unexpected error for %q: %s", server, err)
+		}
+	}
+
+	for _, server := range []string{"kubernetes.default.svc", "ftp://kubernetes", "https://", "://"} {
+		if err := ValidateSettings(map[string]string{KubernetesAPIServerKey: server}); err == nil {
+			t.Errorf("expected an error for %q", server)
+		}
+	}
+}
+
+// TestValidateConnectionPool tests validation of the netmaster connection pool settings
+func TestValidateConnectionPool(t *testing.T) {
+	for _, key := range []string{NetmasterMaxIdleConnsPerHostKey, NetmasterIdleConnTimeoutKey, NetmasterTLSHandshakeTimeoutKey} {
+		if err := ValidateSettings(map[string]string{key: "64"}); err != nil {
+			t.Errorf("unexpected error for %s: %s", key, err)
+		}
+
+		for _, value := range []string{"", "0", "-1", "abc"} {
+			if err := ValidateSettings(map[string]string{key: value}); err == nil {
+				t.Errorf("expected an error for %s %q", key, value)
+			}
+		}
+	}
+}
+
+// TestValidateLdapCacheTTL tests validation of the LDAP login cache TTL
+func TestValidateLdapCacheTTL(t *testing.T) {
+	for _, ttl := range []string{"", "0", "300"} {
+		if err := ValidateSettings(map[string]string{LdapCacheTTLKey: ttl}); err != nil {
+			t.Errorf("unexpected error for %q: %s", ttl, err)
+		}
+	}
+
+	for _, ttl := range []string{"-1", "5m", "1.5"} {
+		if err := ValidateSettings(map[string]string{LdapCacheTTLKey: ttl}); err == nil {
+			t.Errorf("expected an error for %q", ttl)
+		}
+	}
+}
+
+// TestValidateLoginAuditLimits tests validation of the login audit retention limits
+func TestValidateLoginAuditLimits(t *testing.T) {
+	for _, key := range []string{LoginAuditMaxAgeKey, LoginAuditMaxEntriesKey} {
+		for _, value := range []string{"", "0", "90"} {
+			if err := ValidateSettings(map[string]string{key: value}); err != nil {
+				t.Errorf("unexpected error for %s %q: %s", key, value, err)
+			}
+		}
+
+		for _, value := range []string{"-1", "90d", "1.5"} {
+			if err := ValidateSettings(map[string]string{key: value}); err == nil {
+				t.Errorf("expected an error for %s %q", key, value)
+			}
+		}
+	}
+}
+
+// TestValidatePasswordPolicy tests validation of the password policy settings
+func TestValidatePasswordPolicy(t *testing.T) {
+	valid := map[string]string{
+		PasswordMinLengthKey:        "12",
+		PasswordRequireMixedCaseKey: "true",
+		PasswordRequireDigitKey:     "false",
+		PasswordRequireSymbolKey:    "true",
+		PasswordRejectUsernameKey:   "true",
+	}
+
+	if err := ValidateSettings(valid); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	for key, value := range map[string]string{
+		PasswordMinLengthKey:        "-1",
+		PasswordRequireMixedCaseKey: "yes",
+		PasswordRequireDigitKey:     "1 digit",
+		PasswordRequireSymbolKey:    "on",
+		PasswordRejectUsernameKey:   "always",
+	} {
+		if err := ValidateSettings(map[string]string{key: value}); err == nil {
+			t.Errorf("expected an error for %s %q", key, value)
+		}
+	}
+}
+
+// TestValidateUsernameRules tests validation of the username rule settings
+func TestValidateUsernameRules(t *testing.T) {
+	valid := map[string]string{
+		UsernamePatternKey:   "[a-z][a-z0-9.]*",
+		UsernameMinLengthKey: "3",
+		UsernameMaxLengthKey: "32",
+	}
+
+	if err := ValidateSettings(valid); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	for _, invalid := range []map[string]string{
+		{UsernamePatternKey: "[a-z"},
+		{UsernameMinLengthKey: "-1"},
+		{UsernameMaxLengthKey: "ten"},
+		{UsernameMinLengthKey: "8", UsernameMaxLengthKey: "4"},
+	} {
+		if err := ValidateSettings(invalid); err == nil {
+			t.Errorf("expected an error for %v", invalid)
+		}
+	}
+}
+
+// TestValidateTokenTTL tests validation of token_ttl
+func TestValidateTokenTTL(t *testing.T) {
+	for _, ttl := range []string{"", "10h", "30m", "90s"} {
+		if err := ValidateSettings(map[string]string{TokenTTLKey: ttl}); err != nil {
+			t.Errorf("unexpected error for %q: %s", ttl, err)
+		}
+	}
+
+	for _, ttl := range []string{"0", "0s", "-1h", "10", "ten hours"} {
+		if err := ValidateSettings(map[string]string{TokenTTLKey: ttl}); err == nil {
+			t.Errorf("expected an error for %q", ttl)
+		}
+	}
+}
+
+// TestValidateTokenRefreshWindow tests validation of token_refresh_window
+func TestValidateTokenRefreshWindow(t *testing.T) {
+	for _, window := range []string{"", "0", "20", "100"} {
+		if err := ValidateSettings(map[string]string{TokenRefreshWindowKey: window}); err != nil {
+			t.Errorf("unexpected error for %q: %s", window, err)
+		}
+	}
+
+	for _, window := range []string{"-1", "101", "20%", "0.5"} {
+		if err := ValidateSettings(map[string]string{TokenRefreshWindowKey: window}); err == nil {
+			t.Errorf("expected an error for %q", window)
+		}
+	}
+}
+
+// TestValidatePasswordHashCost tests that the bcrypt cost is within bcrypt's bounds
+func TestValidatePasswordHashCost(t *testing.T) {
+	for _, cost := range []string{"", "4", "13", "31"} {
+		if err := ValidateSettings(map[string]string{PasswordHashCostKey: cost}); err != nil {
+			t.Errorf("unexpected error for %q: %s", cost, err)
+		}
+	}
+
+	for _, cost := range []string{"3", "32", "-1", "ten", "12.5"} {
+		if err := ValidateSettings(map[string]string{PasswordHashCostKey: cost}); err == nil {
+			t.Errorf("expected an error for %q", cost)
+		}
+	}
+}
+
+// TestValidateLeaderElection tests validation of the leader election settings
+func TestValidateLeaderElection(t *testing.T) {
+	valid := []map[string]string{
+		{LeaderElectionKey: ""},
+		{LeaderElectionKey: "true", LeaderLeaseTTLKey: "15"},
+		{LeaderElectionKey: "false", LeaderLeaseTTLKey: "1"},
+	}
+
+	for _, settings := range valid {
+		if err := ValidateSettings(settings); err != nil {
+			t.Errorf("unexpected error for %v: %s", settings, err)
+		}
+	}
+
+	invalid := []map[string]string{
+		{LeaderElectionKey: "yes"},
+		{LeaderLeaseTTLKey: "0"},
+		{LeaderLeaseTTLKey: "15s"},
+	}
+
+	for _, settings := range invalid {
+		if err := ValidateSettings(settings); err == nil {
+			t.Errorf("expected an error for %v", settings)
+		}
+	}
+}
@@ -16,6 +16,13 @@ import (
 //  addr: address of the datastore, e.g., "etcd://w.x.y.z:2379"
 func EmptyDatastore(addr string) {
 	switch {
+	case strings.HasPrefix(addr, "etcdv3://"):
+		cmd := "docker exec -e ETCDCTL_API=3 " + os.Getenv("ETCDV3_CONTAINER_NAME") + " etcdctl del --prefix /auth_proxy || true"
+		log.Debugln("Emptying datastore:", cmd)
+
+		if err := exec.Command("/bin/sh", "-c", cmd).Run(); err != nil {
+			log.Fatalln("Failed to clear etcd: ", err)
+		}
 	case strings.HasPrefix(addr, "etcd://"):
 		cmd := "docker exec " + os.Getenv("ETCD_CONTAINER_NAME") + " /etcdctl rm --recursive /auth_proxy || true"
 		log.Debugln("Emptying datastore:", cmd)
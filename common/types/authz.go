@@ -29,6 +29,10 @@ var DatastoreDirectories = []string{
 	AuthZDir,
 	AuthProxyDir + "/local_users",
 	AuthProxyDir + "/principals",
+	AuthProxyDir + "/endpoint_policy",
+	AuthProxyDir + "/revoked_tokens",
+	AuthProxyDir + "/revoked_principals",
+	AuthProxyDir + "/ldap_login_cache",
 }
 
 //
@@ -63,6 +67,14 @@ var DatastoreDirectories = []string{
 //  ClaimKey: string encoding of the claim's key associated with the authorization
 //  ClaimValue: string encoding of the claim's value associated with the
 //    authorization
+//  ExpiresAt: time (in seconds since the epoch) after which the authorization
+//    behaves as if it had been deleted; 0 if it never expires
+//  CreatedAt: time (in seconds since the epoch) the authorization was added;
+//    0 if unknown, e.g. for authorizations added by older versions
+//  UpdatedAt: time (in seconds since the epoch) the authorization was last
+//    written; 0 if unknown
+//  GrantedBy: user who granted the role of the authorization; empty if
+//    unknown or added by the proxy itself, e.g. the built-in admin's
 //
 type Authorization struct {
 	CommonState
@@ -71,6 +83,10 @@ type Authorization struct {
 	Local         bool   `json:"local"`
 	ClaimKey      string `json:"claimKey"`
 	ClaimValue    string `json:"claimValue"`
+	ExpiresAt     int64  `json:"expiresAt,omitempty"`
+	CreatedAt     int64  `json:"createdAt,omitempty"`
+	UpdatedAt     int64  `json:"updatedAt,omitempty"`
+	GrantedBy     string `json:"grantedBy,omitempty"`
 }
 
 //
@@ -116,6 +132,16 @@ func (a *Authorization) BelongsToBuiltInAdmin() bool {
 	return a.Local && Admin.String() == a.PrincipalName
 }
 
+//
+// Expired determines if the authz has expired.
+//
+// Parameters:
+//  now: current time in seconds since the epoch
+//
+func (a *Authorization) Expired(now int64) bool {
+	return a.ExpiresAt != 0 && a.ExpiresAt <= now
+}
+
 //
 // Write adds an authz instance to the authz dir in the KV store
 //
@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 // State identifies data uniquely identifiable by 'id' and stored in a
 // (distributed) key-value store implemented by types.StateDriver.
 type State interface {
@@ -50,4 +52,18 @@ type StateDriver interface {
 	WatchAllState(baseKey string, stateType State,
 		unmarshal func([]byte, interface{}) error, chStateChanges chan WatchState) error
 	ClearState(key string) error
+
+	// Watch streams the creations, updates and deletions of the keys below
+	// `prefix` from the point it's called, in the order they happened. It's
+	// re-established whenever it fails, without missing changes. Calling the
+	// returned function stops the watch; the channel is closed once it stopped.
+	Watch(prefix string) (<-chan WatchEvent, func())
+
+	// AcquireLease sets `key` to `holder` unless it's held by someone else. The
+	// key is removed once `ttl` passes without the lease being acquired again,
+	// so acquiring a lease which is already held renews it. It returns true if
+	// `holder` holds the lease.
+	AcquireLease(key, holder string, ttl time.Duration) (bool, error)
+	// ReleaseLease removes `key` if it's held by `holder`
+	ReleaseLease(key, holder string) error
 }
@@ -1,6 +1,8 @@
 package types
 
 import (
+	"crypto/tls"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/contiv/auth_proxy/common/errors"
 )
@@ -14,6 +16,10 @@ const (
 	// available role available to a principal in token object or
 	// authorization db
 	RoleClaimKey = "role"
+
+	// CustomRoleClaimKey is a prefix added to the claim keys of authorizations
+	// granting a custom role (see CustomRole); the claim value is the role's name
+	CustomRoleClaimKey = "custom_role:"
 )
 
 // RoleType each role type is associated with a group and set of capabilities
@@ -21,19 +27,29 @@ type RoleType uint
 
 // Set of pre-defined roles here
 const (
-	Admin   RoleType = iota // can perform any operation
-	Ops                     // restricted to only assigned tenants
-	Invalid                 // Invalid role, this needs to be the last role
+	Admin       RoleType = iota // can perform any operation
+	TenantAdmin                 // ops on assigned tenants, plus managing their authorizations
+	Ops                         // restricted to only assigned tenants
+	Guest                       // read-only access to assigned tenants
+	Invalid                     // Invalid role, this needs to be the last role
 )
 
 // Tenant is a type to represent the name of the tenant
 type Tenant string
 
+// AllTenants is the tenant of wildcard authorizations, which grant their role
+// on every tenant
+const AllTenants Tenant = "*"
+
 // String returns the string representation of `RoleType`
 func (role RoleType) String() string {
 	switch role {
+	case Guest:
+		return "guest"
 	case Ops:
 		return "ops"
+	case TenantAdmin:
+		return "tenant_admin"
 	case Admin:
 		return "admin"
 	default:
@@ -47,8 +63,12 @@ func Role(roleStr string) (RoleType, error) {
 	switch roleStr {
 	case Admin.String():
 		return Admin, nil
+	case TenantAdmin.String():
+		return TenantAdmin, nil
 	case Ops.String():
 		return Ops, nil
+	case Guest.String():
+		return Guest, nil
 	default:
 		log.Debugf("Unsupported role %q", roleStr)
 		return Invalid, errors.ErrUnsupportedType
@@ -62,17 +82,45 @@ func Role(roleStr string) (RoleType, error) {
 //  UserName: of the user. Read only field. Must be unique.
 //  FirstName: of the user
 //  LastName: of the user
+//  Email: optional email address of the user, e.g. for audit records and listings
+//  FullName: optional full name of the user, e.g. when usernames are employee IDs
+//  Labels: optional labels of the user, e.g. its team or cost center, for reporting;
+//          they have no effect on authentication or authorization.
 //  Password: of the user. Not stored anywhere. Used only for updates.
 //  Disable: if authorizations for this local user is disabled.
 //  PasswordHash: of the password string.
+//  PasswordChangedAt: time of the last password change, in seconds since the epoch.
+//  PasswordExpiryExempt: if the password never expires, e.g. for service accounts.
+//  PasswordResetRequired: if the user has to change the password at the next login,
+//                         e.g. after an admin set a temporary one. Cleared once they do.
+//  MFAEnabled: if the user has to log in with a one-time password as well.
+//  MFASecret: TOTP secret the one-time passwords are derived from, encrypted with
+//             common.Encrypt(); set when the user enrolls and only used once
+//             MFAEnabled is set. Never returned by the API.
+//  DeletedAt: time the user was (soft) deleted, in seconds since the epoch; 0 unless deleted.
+//             Deleted users cannot log in and keep their authorizations until they're
+//             restored or permanently deleted.
+//  LastLogin: time of the user's last successful login, in seconds since the epoch
+//             (to the minute); 0 if the user never logged in. Read only field,
+//             recorded apart from the user's entry (see db.RecordLocalUserLogin).
 //
 type LocalUser struct {
-	Username     string `json:"username"`
-	Password     string `json:"password,omitempty"`
-	FirstName    string `json:"first_name"`
-	LastName     string `json:"last_name"`
-	Disable      bool   `json:"disable"`
-	PasswordHash []byte `json:"password_hash,omitempty"`
+	Username              string            `json:"username"`
+	Password              string            `json:"password,omitempty"`
+	FirstName             string            `json:"first_name"`
+	LastName              string            `json:"last_name"`
+	Email                 string            `json:"email,omitempty"`
+	FullName              string            `json:"full_name,omitempty"`
+	Labels                map[string]string `json:"labels,omitempty"`
+	Disable               bool              `json:"disable"`
+	PasswordHash          []byte            `json:"password_hash,omitempty"`
+	PasswordChangedAt     int64             `json:"password_changed_at,omitempty"`
+	PasswordExpiryExempt  bool              `json:"password_expiry_exempt,omitempty"`
+	PasswordResetRequired bool              `json:"password_reset_required,omitempty"`
+	MFAEnabled            bool              `json:"mfa_enabled,omitempty"`
+	MFASecret             string            `json:"mfa_secret,omitempty"`
+	DeletedAt             int64             `json:"deleted_at,omitempty"`
+	LastLogin             int64             `json:"last_login,omitempty"`
 }
 
 // LdapConfiguration represents the LDAP/AD configuration.
@@ -80,7 +128,10 @@ type LocalUser struct {
 //
 // Fields:
 //  Server: FQDN or IP address of LDAP/AD server
-//  Port: listening port of LDAP/AD server
+//  Servers: FQDNs or IP addresses of several LDAP/AD servers, e.g. replicated
+//           domain controllers, optionally followed by :port; they're tried in
+//           order until one can be connected to. Server is used if empty.
+//  Port: listening port of LDAP/AD server(s)
 //  BaseDN: Distinguished name for base entity.
 //          E.g., ou=eng,dc=auth,dc=com. All search queries will be scope to this BaseDN.
 //  ServiceAccountDN: DN of the service account. auth_proxy will use this
@@ -88,32 +139,96 @@ type LocalUser struct {
 //                    must have appropriate privileges, specifically for lookup.
 //  ServiceAccountPassword: of the service account
 //  StartTLS: if set, the connection will be upgrated to SSL/TLS mode
+//  UseLDAPS: if set, the connection is made over SSL/TLS from the start (LDAPS,
+//            usually on port 636); can't be set along with `StartTLS`.
 //  InsecureSkipVerify: if set, the certificate verification is skipped;
-//                      used only when `StartTLS` is enabled.
+//                      used only when `StartTLS` or `UseLDAPS` is enabled.
 //  TLSCertIssuedTo: Servername for which the TLS/SSL certificate was issued.
-//                   This is used only when `StartTLS` is enabled.
+//                   This is used only when `StartTLS` or `UseLDAPS` is enabled.
 //                   The connection is prone to man-in-the-middle attacks,
 //                   if empty(TLSCertIssuedTo) and InsecureSkipVerify == false.
+//  CACertificate: PEM-encoded CA certificates which issued the server's certificate,
+//                 or the path of a PEM file containing them; the system's CAs are
+//                 used if empty. Used only when `StartTLS` or `UseLDAPS` is enabled.
+//  UserObjectClass: object class of the users; "user" (AD) if empty, e.g.
+//                   posixAccount or inetOrgPerson for OpenLDAP.
+//  GroupObjectClass: object class of the groups; "group" (AD) if empty.
+//  GroupMembershipAttribute: attribute recording the group membership; "memberOf" (AD) if empty.
+//  GroupMembership: LdapGroupMembershipUser (default) if the membership attribute is
+//                   on the user entries and holds the DNs of their groups,
+//                   LdapGroupMembershipGroup if it's on the group entries and holds
+//                   the DNs or usernames of their members, e.g. `memberUid` of posixGroup.
+//  ConnectTimeout: time (in seconds) allowed to connect to each server, including the
+//                  TLS handshake; the `ldap_connect_timeout` setting (5 by default) if 0.
+//  SearchTimeout: time (in seconds) allowed for each bind and search; 5 if 0.
+//  FollowReferrals: if set, referrals to other servers, e.g. the domain controllers
+//                   of child domains, are followed; they're ignored otherwise.
+//  ReferralDomains: DNS domains of the servers which referrals may be followed to;
+//                   the service account is never bound on any other server.
+//  UserAttributes: attributes of the users read at login and carried in their
+//                  tokens, e.g. for the UI to greet them; displayName and mail if empty.
+//  LoginAttribute: attributes users can log in with, e.g. userPrincipalName to
+//                  log in with their email-style UPN; sAMAccountName if empty. The
+//                  value of the first one is the user's canonical name, which
+//                  groups recording their members by name are matched against.
+//  GroupRoles: base roles of the users by the DN of their groups, e.g.
+//              {"CN=NetAdmins,DC=example,DC=com": "admin"}; users in several of
+//              the groups get the highest of their roles. Authorizations still
+//              grant the users' tenants (see Token.AddGroupRoleClaim()).
 type LdapConfiguration struct {
-	Server                 string `json:"server"`
-	Port                   uint16 `json:"port"`
-	BaseDN                 string `json:"base_dn"`
-	ServiceAccountDN       string `json:"service_account_dn"`
-	ServiceAccountPassword string `json:"service_account_password,omitempty"`
-	StartTLS               bool   `json:"start_tls"`
-	InsecureSkipVerify     bool   `json:"insecure_skip_verify"`
-	TLSCertIssuedTo        string `json:"tls_cert_issued_to"`
+	Server                   string            `json:"server"`
+	Servers                  []string          `json:"servers,omitempty"`
+	Port                     uint16            `json:"port"`
+	BaseDN                   string            `json:"base_dn"`
+	ServiceAccountDN         string            `json:"service_account_dn"`
+	ServiceAccountPassword   string            `json:"service_account_password,omitempty"`
+	StartTLS                 bool              `json:"start_tls"`
+	UseLDAPS                 bool              `json:"use_ldaps"`
+	InsecureSkipVerify       bool              `json:"insecure_skip_verify"`
+	TLSCertIssuedTo          string            `json:"tls_cert_issued_to"`
+	CACertificate            string            `json:"ca_certificate,omitempty"`
+	UserObjectClass          string            `json:"user_object_class,omitempty"`
+	GroupObjectClass         string            `json:"group_object_class,omitempty"`
+	GroupMembershipAttribute string            `json:"group_membership_attribute,omitempty"`
+	GroupMembership          string            `json:"group_membership,omitempty"`
+	ConnectTimeout           int               `json:"connect_timeout,omitempty"`
+	SearchTimeout            int               `json:"search_timeout,omitempty"`
+	FollowReferrals          bool              `json:"follow_referrals"`
+	ReferralDomains          []string          `json:"referral_domains,omitempty"`
+	UserAttributes           []string          `json:"user_attributes,omitempty"`
+	LoginAttribute           []string          `json:"login_attribute,omitempty"`
+	GroupRoles               map[string]string `json:"group_roles,omitempty"`
 }
 
+const (
+	// LdapGroupMembershipUser records the group membership on the user entries (AD's memberOf)
+	LdapGroupMembershipUser = "user"
+
+	// LdapGroupMembershipGroup records the group membership on the group entries
+	// (member of groupOfNames, memberUid of posixGroup)
+	LdapGroupMembershipGroup = "group"
+)
+
 //
 // KVStoreConfig encapsulates config data that determines KV store
 // details specific to a running instance of auth_proxy
 //
 // Fields:
 //   StoreURL: URL of the key-value store
+//   TLS:      configuration used to connect to the key-value store over
+//             TLS; it's connected to over plain HTTP if nil
+//   Token:    ACL token used to access the key-value store; only used by consul
+//   Datacenter: consul datacenter the keys are kept in; the agent's if empty
+//   AllowStaleReads: if set, consul reads may be answered by any server
+//                    rather than the leader, and so be slightly out of date;
+//                    writes are always consistent
 //
 type KVStoreConfig struct {
-	StoreURL string `json:"kvstore-url"`
+	StoreURL        string      `json:"kvstore-url"`
+	TLS             *tls.Config `json:"-"`
+	Token           string      `json:"-"`
+	Datacenter      string      `json:"-"`
+	AllowStaleReads bool        `json:"-"`
 }
 
 //
@@ -129,6 +244,31 @@ type WatchState struct {
 	Prev State
 }
 
+// WatchEventType is the kind of change reported by a WatchEvent
+type WatchEventType string
+
+// kinds of WatchEvent
+const (
+	WatchEventCreate WatchEventType = "create"
+	WatchEventUpdate WatchEventType = "update"
+	WatchEventDelete WatchEventType = "delete"
+)
+
+//
+// WatchEvent is a change to a key below a prefix watched by StateDriver.Watch()
+//
+// Fields:
+//   Type:  whether the key was created, updated or deleted
+//   Key:   the key, with a leading slash whatever the data store, e.g.
+//          /auth_proxy/authorizations/1234
+//   Value: the new value of the key; nil for deletions
+//
+type WatchEvent struct {
+	Type  WatchEventType
+	Key   string
+	Value []byte
+}
+
 //
 // CommonState defines the fields common to all types.State
 // implementations. This struct will be embedded as an anonymous
@@ -142,3 +282,263 @@ type CommonState struct {
 	StateDriver StateDriver `json:"-"`
 	ID          string      `json:"id"`
 }
+
+// Scopes of an endpoint policy rule
+const (
+	// ScopeTenant means access is further restricted to the tenants the user is authorized for
+	ScopeTenant = "tenant"
+
+	// ScopeGlobal means access is granted regardless of the user's tenant authorizations
+	ScopeGlobal = "global"
+)
+
+// EndpointPolicyRule maps netmaster endpoints to the minimum role required to access them.
+//
+// Fields:
+//  ID: unique identifier of the rule; assigned when the rule is added
+//  Path: path pattern matched against the request path. Pattern segments are either
+//        literals, `*` (any single segment) or a trailing `**` (any number of segments).
+//        E.g., /api/v1/networks/**, /api/v1/inspect/*/global/
+//  Methods: HTTP methods this rule applies to; all methods if empty
+//  Role: minimum role (admin or ops) required to access the matching endpoints
+//  Scope: `tenant` if access is limited to the user's tenants, `global` otherwise.
+//         Only meaningful for non-admin roles.
+type EndpointPolicyRule struct {
+	ID      string   `json:"id"`
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+	Role    string   `json:"role"`
+	Scope   string   `json:"scope"`
+}
+
+// RolePermission allows the requests to some netmaster endpoints.
+//
+// Fields:
+//  Path: path pattern matched against the request path, like EndpointPolicyRule's
+//  Methods: HTTP methods allowed; all methods if empty
+type RolePermission struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+}
+
+// CustomRole is a role defined by admins besides the built-in ones. It allows
+// the requests matching any of its permissions, on the objects of all tenants.
+//
+// Fields:
+//  Name: unique name of the role; can't be the name of a built-in role
+//  Description: optional description of the role
+//  Permissions: requests the role allows
+type CustomRole struct {
+	Name        string           `json:"name"`
+	Description string           `json:"description,omitempty"`
+	Permissions []RolePermission `json:"permissions"`
+}
+
+// RevokedToken records a token which must no longer be accepted even though it hasn't expired.
+//
+// Fields:
+//  ID: unique ID (`jti` claim) of the revoked token
+//  ExpiresAt: expiry time of the token in seconds since the epoch; the record
+//             is only needed until then
+type RevokedToken struct {
+	ID        string `json:"id"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// Session records a token issued when a user logged in or refreshed a token,
+// so that admins can see who is logged in and revoke individual sessions.
+//
+// Fields:
+//  ID: unique ID (`jti` claim) of the token
+//  Username: user the token was issued to
+//  Principals: security principals the token was issued for, e.g. the LDAP groups
+//              resolved at login
+//  IssuedAt: issue time of the token in seconds since the epoch
+//  ExpiresAt: expiry time of the token in seconds since the epoch; the record
+//             is only needed until then
+//  SourceIP: IP address of the client the token was issued to
+//  MatchedAuthorizations: UUIDs of the authorizations of the principals when the
+//                         token was issued
+type Session struct {
+	ID                    string   `json:"id"`
+	Username              string   `json:"username"`
+	Principals            []string `json:"principals,omitempty"`
+	IssuedAt              int64    `json:"issued_at"`
+	ExpiresAt             int64    `json:"expires_at"`
+	SourceIP              string   `json:"source_ip"`
+	MatchedAuthorizations []string `json:"matched_authorizations,omitempty"`
+}
+
+// RetiredSigningKey is a token signing key which was replaced by a new one;
+// tokens signed with it are still accepted until they've all expired.
+// Fields:
+//  ID: key ID (`kid` header) of the tokens signed with it
+//  Key: the key, encrypted with common.Encrypt()
+//  RetiredAt: time it was replaced in seconds since the epoch
+//  ExpiresAt: time at which all the tokens signed with it have expired; the
+//             key is no longer accepted from then on
+type RetiredSigningKey struct {
+	ID        string `json:"id"`
+	Key       string `json:"key"`
+	RetiredAt int64  `json:"retired_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// AccessToken is a named, long-lived personal access token used for automation.
+// Only a hash of the token value is kept; the value itself is shown once, when
+// the token is created.
+//
+// Fields:
+//  ID: unique ID of the token; part of its value
+//  Name: name given by its owner, e.g. the CI pipeline using it
+//  Username: user who created the token
+//  Principals: security principals of the user when the token was created, as
+//              recorded by earlier versions; the user's current principals
+//              determine the token's role and tenants
+//  Prefix: the non-secret beginning of the token value, used to recognize it
+//  Hash: hex encoded SHA-256 hash of the token value
+//  CreatedAt: creation time in seconds since the epoch
+type AccessToken struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Username   string   `json:"username"`
+	Principals []string `json:"principals,omitempty"`
+	Prefix     string   `json:"prefix"`
+	Hash       string   `json:"hash"`
+	CreatedAt  int64    `json:"created_at"`
+}
+
+// LoginAuditRecord records a call to the login endpoint for security audits.
+//
+// Fields:
+//  ID: unique ID of the record
+//  Time: time of the login attempt in seconds since the epoch
+//  Username: username given by the client; empty if there was none
+//  Success: true if the user was authenticated and got a token
+//  FailureReason: category of the failure, e.g. "invalid_credentials"; empty on success
+//  SourceIP: IP address of the client
+//  UserAgent: User-Agent header sent by the client
+//  CachedAuth: true if LDAP/AD was unreachable and the user was authenticated
+//              using their cached login (see ldap_cache_ttl)
+type LoginAuditRecord struct {
+	ID            string `json:"id"`
+	Time          int64  `json:"time"`
+	Username      string `json:"username"`
+	Success       bool   `json:"success"`
+	FailureReason string `json:"failure_reason,omitempty"`
+	SourceIP      string `json:"source_ip"`
+	UserAgent     string `json:"user_agent"`
+	CachedAuth    bool   `json:"cached_auth,omitempty"`
+}
+
+// RevokedPrincipal records that all the tokens of a principal issued up to a
+// point in time must no longer be accepted, e.g. because the principal was purged.
+//
+// Fields:
+//  Principal: name of the principal; a local user, LDAP user or group, or ServiceAccount
+//  RevokedAt: tokens issued at or before this time (seconds since the epoch) are revoked
+//  ExpiresAt: time at which all the revoked tokens have expired; the record
+//             is only needed until then
+type RevokedPrincipal struct {
+	Principal string `json:"principal"`
+	RevokedAt int64  `json:"revoked_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// PrincipalLogin records the last successful login of a principal, i.e. an LDAP
+// user or a local user; the latter's is returned as LocalUser.LastLogin.
+//
+// Fields:
+//  Principal: name of the principal; the DN of an LDAP user or a local username
+//  LastLogin: time of the last successful login in seconds since the epoch (to the minute)
+type PrincipalLogin struct {
+	Principal string `json:"principal"`
+	LastLogin int64  `json:"last_login"`
+}
+
+// LdapCachedLogin records a successful LDAP login so that the user can still log
+// in while the directory is unreachable (see ldap_cache_ttl).
+//
+// Fields:
+//  Username: username the user logged in with
+//  PasswordHash: bcrypt hash of the password the user logged in with
+//  DN: distinguished name of the user in the directory
+//  Groups: LDAP groups of the user; the principals of tokens issued from the cache
+//  Attributes: attributes of the user read at login, e.g. the display name
+//  ConfigVersion: identifies the LDAP configuration the login was made with;
+//                 entries made with another configuration are never used
+//  CachedAt: time of the login in seconds since the epoch
+//  ExpiresAt: time after which the entry must no longer be used
+type LdapCachedLogin struct {
+	Username      string            `json:"username"`
+	PasswordHash  []byte            `json:"password_hash"`
+	DN            string            `json:"dn"`
+	Groups        []string          `json:"groups"`
+	Attributes    map[string]string `json:"attributes,omitempty"`
+	ConfigVersion string            `json:"config_version"`
+	CachedAt      int64             `json:"cached_at"`
+	ExpiresAt     int64             `json:"expires_at"`
+}
+
+// TenantStats holds the usage counters of a tenant, accumulated from the
+// requests proxied to netmaster on behalf of the tenant.
+//
+// Fields:
+//  Tenant: name of the tenant
+//  Requests: requests proxied to netmaster
+//  Writes: requests other than GET (POST, PUT, DELETE)
+//  Denials: requests denied because the user isn't authorized for the tenant
+//  Bytes: request and response bodies
+type TenantStats struct {
+	Tenant   string `json:"tenant"`
+	Requests uint64 `json:"requests"`
+	Writes   uint64 `json:"writes"`
+	Denials  uint64 `json:"denials"`
+	Bytes    uint64 `json:"bytes"`
+}
+
+// Stable, machine-readable codes of error responses; clients should check
+// these rather than the messages, which are meant for humans and may change.
+const (
+	ErrorCodeBadRequest             = "bad_request"              // malformed or incomplete request
+	ErrorCodeInvalidCredentials     = "invalid_credentials"      // login failed
+	ErrorCodeOTPRequired            = "otp_required"             // login needs a one-time password as well
+	ErrorCodeUserDisabled           = "user_disabled"            // the password was right, but the local user is disabled
+	ErrorCodeMissingToken           = "missing_token"            // no X-Auth-Token or Authorization: Bearer header
+	ErrorCodeInvalidToken           = "invalid_token"            // token can't be parsed or verified
+	ErrorCodeTokenExpired           = "token_expired"            // token was valid but has expired
+	ErrorCodeTokenRevoked           = "token_revoked"            // token or its principal was revoked
+	ErrorCodeTokenWrongIssuer       = "token_wrong_issuer"       // token was issued by another environment (see token_issuer)
+	ErrorCodeTokenWrongAudience     = "token_wrong_audience"     // token was issued for another environment (see token_audience)
+	ErrorCodeUnauthorized           = "unauthorized"             // caller isn't authenticated
+	ErrorCodeForbidden              = "forbidden"                // caller isn't allowed to do this
+	ErrorCodeNoTenants              = "no_tenants"               // caller isn't authorized for any tenant (see strict_authorization)
+	ErrorCodePasswordChangeRequired = "password_change_required" // token can only be used to change the password
+	ErrorCodeRefreshNotAllowed      = "refresh_not_allowed"      // token can't be refreshed (yet)
+	ErrorCodePasswordPolicy         = "password_policy"          // new password breaks the password policy
+	ErrorCodeNotFound               = "not_found"                // no such endpoint or object
+	ErrorCodeMethodNotAllowed       = "method_not_allowed"       // endpoint doesn't support the method
+	ErrorCodeConflict               = "conflict"                 // object exists already or is in use
+	ErrorCodeRateLimited            = "rate_limited"             // too many requests; retry later
+	ErrorCodeBodyTooLarge           = "body_too_large"           // request body exceeds max_body_size
+	ErrorCodeInternal               = "internal_error"           // something broke
+	ErrorCodeUnavailable            = "unavailable"              // a dependency (datastore, Kubernetes) is unavailable
+	ErrorCodeUpstreamFailed         = "upstream_failed"          // netmaster couldn't be reached
+	ErrorCodeUpstreamTimeout        = "upstream_timeout"         // netmaster didn't respond in time
+	ErrorCodeDirectoryUnavailable   = "directory_unavailable"    // LDAP/AD couldn't be reached or didn't respond in time
+)
+
+// ErrorResponse is the body of every error response of the proxy's own
+// endpoints, and of the errors we return instead of a netmaster response.
+//
+// Fields:
+//  Code: one of the ErrorCode* constants
+//  Message: human-readable description of the error
+//  RequestID: ID of the request (see the X-Request-Id header) to look it up in the logs
+//  Details: additional information depending on the code; omitted if there is none
+type ErrorResponse struct {
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	RequestID string            `json:"request_id,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
@@ -0,0 +1,107 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LocalUsernamePattern matches the names local users can have at most. They
+// can be used in URL paths as they are; UsernamePatternKey and the length
+// settings can only restrict them further.
+var LocalUsernamePattern = regexp.MustCompile(`^[A-Za-z0-9\_\-\.\@]+$`)
+
+// NormalizeUsernames returns true if usernames and principals are
+// case-insensitive (see NormalizeUsernamesKey).
+func NormalizeUsernames() bool {
+	value, err := Global().Get(NormalizeUsernamesKey)
+	if err != nil {
+		return false
+	}
+
+	normalize, _ := strconv.ParseBool(value) // already validated
+	return normalize
+}
+
+// NormalizeUsername returns the form a username is stored and looked up in.
+// params:
+//  username: username as given by the client
+// return values:
+//  string: the lowercased username if NormalizeUsernamesKey is set, otherwise username as it is
+func NormalizeUsername(username string) string {
+	if NormalizeUsernames() {
+		return strings.ToLower(username)
+	}
+
+	return username
+}
+
+// SamePrincipal checks whether two principal names, e.g. usernames or LDAP
+// groups, refer to the same principal; their case is ignored if
+// NormalizeUsernamesKey is set.
+// params:
+//  a, b: principal names to compare
+// return values:
+//  bool: true if they're the same principal
+func SamePrincipal(a, b string) bool {
+	if NormalizeUsernames() {
+		return strings.EqualFold(a, b)
+	}
+
+	return a == b
+}
+
+// usernameLengthLimit returns the value of the given username length setting; 0 if unset
+func usernameLengthLimit(key string) int {
+	value, err := Global().Get(key)
+	if err != nil {
+		return 0
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return 0
+	}
+
+	return limit
+}
+
+// compileUsernamePattern compiles the value of UsernamePatternKey, which has to
+// match the whole username
+func compileUsernamePattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// ValidateUsername checks the name of a new local user against the username
+// rules configured in the settings. Existing users aren't checked, so that
+// they keep working when the rules change.
+// params:
+//  username: name of the local user to be added
+// return values:
+//  error: nil if the username is valid, otherwise the rule it breaks; the
+//         message is returned to the client
+func ValidateUsername(username string) error {
+	// `.` and `..` would be cleaned out of URL paths
+	if !LocalUsernamePattern.MatchString(username) || strings.Trim(username, ".") == "" {
+		return errors.New("only alpha-numeric and [-_.@] characters are allowed")
+	}
+
+	if minLength := usernameLengthLimit(UsernameMinLengthKey); len(username) < minLength {
+		return fmt.Errorf("it must be at least %d characters long (%s)", minLength, UsernameMinLengthKey)
+	}
+
+	if maxLength := usernameLengthLimit(UsernameMaxLengthKey); maxLength > 0 && len(username) > maxLength {
+		return fmt.Errorf("it must be at most %d characters long (%s)", maxLength, UsernameMaxLengthKey)
+	}
+
+	if pattern, err := Global().Get(UsernamePatternKey); err == nil && !IsEmpty(pattern) {
+		re, err := compileUsernamePattern(pattern)
+		if err == nil && !re.MatchString(username) { // already validated
+			return fmt.Errorf("it must match %s %q", UsernamePatternKey, pattern)
+		}
+	}
+
+	return nil
+}
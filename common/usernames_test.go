@@ -0,0 +1,83 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestNormalizeUsernames tests that usernames and principals are only
+// case-insensitive if normalize_usernames is set
+func TestNormalizeUsernames(t *testing.T) {
+	defer Global().Set(NormalizeUsernamesKey, "")
+
+	if NormalizeUsername("JSmith") != "JSmith" || SamePrincipal("JSmith", "jsmith") || !SamePrincipal("jsmith", "jsmith") {
+		t.Fatal("expected case-sensitive usernames by default")
+	}
+
+	if err := Global().Set(NormalizeUsernamesKey, "true"); err != nil {
+		t.Fatalf("failed to set %s: %s", NormalizeUsernamesKey, err)
+	}
+
+	if normalized := NormalizeUsername("JSmith"); normalized != "jsmith" {
+		t.Errorf("expected %q, got %q", "jsmith", normalized)
+	}
+
+	if !SamePrincipal("JSmith", "jsmith") || !SamePrincipal("CN=Admins", "cn=admins") {
+		t.Error("expected case-insensitive principals")
+	}
+
+	if SamePrincipal("jsmith", "jsmith2") {
+		t.Error("expected different principals to differ")
+	}
+}
+
+// TestValidateUsername tests checking the names of new local users against the
+// username rules
+func TestValidateUsername(t *testing.T) {
+	defer func() {
+		for _, key := range []string{UsernamePatternKey, UsernameMinLengthKey, UsernameMaxLengthKey} {
+			Global().Set(key, "")
+		}
+	}()
+
+	for _, username := range []string{"j.doe", "j-doe", "jdoe@example.com", "J_Doe", "a", ".jdoe", strings.Repeat("a", 300)} {
+		if err := ValidateUsername(username); err != nil {
+			t.Errorf("%q: unexpected error %s", username, err)
+		}
+	}
+
+	for _, username := range []string{"", ".", "..", "j doe", "j/doe", "j%2Fdoe", "jdöe", "jdoe?", "jdoe#1"} {
+		if err := ValidateUsername(username); err == nil {
+			t.Errorf("%q: expected an error", username)
+		}
+	}
+
+	Global().Set(UsernamePatternKey, "[a-z][a-z0-9.]*")
+	Global().Set(UsernameMinLengthKey, "3")
+	Global().Set(UsernameMaxLengthKey, "8")
+
+	testCases := []struct {
+		username string
+		rule     string // in the error message; empty if valid
+	}{
+		{"jdoe", ""},
+		{"j.doe", ""},
+		{"jd", UsernameMinLengthKey},
+		{"jdoe.long", UsernameMaxLengthKey},
+		{"j-doe", UsernamePatternKey},
+		{"jdoe@ex", UsernamePatternKey},
+		{"1jdoe", UsernamePatternKey},
+		{"JDoe", UsernamePatternKey},
+		{"j doe", "alpha-numeric"},
+	}
+
+	for _, tc := range testCases {
+		err := ValidateUsername(tc.username)
+		switch {
+		case tc.rule == "" && err != nil:
+			t.Errorf("%q: unexpected error %s", tc.username, err)
+		case tc.rule != "" && (err == nil || !strings.Contains(err.Error(), tc.rule)):
+			t.Errorf("%q: expected an error naming %s, got %v", tc.username, tc.rule, err)
+		}
+	}
+}
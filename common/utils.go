@@ -7,15 +7,19 @@ import (
 	"net/http"
 	"runtime"
 	"strings"
+	"sync/atomic"
 
 	log "github.com/Sirupsen/logrus"
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
 )
 
-// GlobalMap is a map to hold variables(key:value pair) that can be accessed anywhere in auth_proxy
+// GlobalMap is a map to hold variables(key:value pair) that can be accessed anywhere in auth_proxy.
+// A GlobalMap returned by Global() is an immutable snapshot; it must not be modified.
 type GlobalMap map[string]string
 
-var global GlobalMap
+// global holds the current `GlobalMap` snapshot. Snapshots are never modified
+// once stored, Set() and ReloadSettings() store an updated copy instead.
+var global atomic.Value
 
 // IsEmpty checks if the given string is empty or not
 // params:
@@ -26,16 +30,21 @@ func IsEmpty(str string) bool {
 	return len(strings.TrimSpace(str)) == 0
 }
 
-// Global returns `GlobalMap` singleton object
+// Global returns the current `GlobalMap` snapshot.
+// The snapshot is replaced as a whole by Set() and ReloadSettings(), so callers which
+// need a consistent view of several settings should call this once and hold on to it.
 func Global() GlobalMap {
-	if global == nil {
-		global = map[string]string{}
+	if g, ok := global.Load().(GlobalMap); ok {
+		return g
 	}
 
-	return global
+	return GlobalMap{}
 }
 
-// Set adds a key:value pair in `GlobalMap`
+// Set adds a key:value pair to the global settings by swapping in an updated
+// copy of the current snapshot; `g` itself is left untouched.
+// Values set this way are treated like flags: they are the starting point for
+// ReloadSettings() and can be overridden by the other configuration sources.
 // params:
 //  key: string; to be set in map
 //  value: string; value for the key
@@ -46,7 +55,19 @@ func (g GlobalMap) Set(key, value string) error {
 		return fmt.Errorf("Cannot set globals: empty key")
 	}
 
-	g[key] = value
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	baseSettings[key] = value
+
+	current := Global()
+	updated := make(GlobalMap, len(current)+1)
+	for k, v := range current {
+		updated[k] = v
+	}
+	updated[key] = value
+
+	global.Store(updated)
 	return nil
 }
 
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains all personal access token APIs.
+
+// AddAccessToken adds the given access token to /auth_proxy/access_tokens.
+// params:
+//  token: access token to be added
+// return values:
+//  error: as returned by consecutive func calls
+func AddAccessToken(token *types.AccessToken) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	val, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal access token %q: %#v", token.ID, err)
+	}
+
+	if err := stateDrv.Write(GetPath(RootAccessTokens, token.ID), val); err != nil {
+		return fmt.Errorf("Failed to write access token %q to data store: %#v", token.ID, err)
+	}
+
+	return nil
+}
+
+// GetAccessToken looks up the access token with the given ID.
+// params:
+//  id: unique ID of the access token
+// return values:
+//  *types.AccessToken: the access token
+//  error: auth_errors.ErrKeyNotFound if there is none, or as returned by consecutive func calls
+func GetAccessToken(id string) (*types.AccessToken, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := stateDrv.Read(GetPath(RootAccessTokens, id))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("Failed to read access token %q from store: %#v", id, err)
+	}
+
+	token := &types.AccessToken{}
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal access token %q: %#v", id, err)
+	}
+
+	return token, nil
+}
+
+// ListAccessTokens returns the access tokens in /auth_proxy/access_tokens.
+// return values:
+//  []*types.AccessToken: slice of access tokens; empty if there are none
+//  error: as returned by consecutive func calls
+func ListAccessTokens() ([]*types.AccessToken, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []*types.AccessToken{}
+	rawData, err := stateDrv.ReadAll(GetPath(RootAccessTokens))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return tokens, nil
+		}
+
+		return nil, fmt.Errorf("Couldn't fetch access tokens from data store: %s", err.Error())
+	}
+
+	for _, data := range rawData {
+		token := &types.AccessToken{}
+		if err := json.Unmarshal(data, token); err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+// DeleteAccessToken removes the access token with the given ID; the token is
+// no longer accepted from then on.
+// Deleting an access token which doesn't exist is not an error.
+// params:
+//  id: unique ID of the access token
+// return values:
+//  error: as returned by consecutive func calls
+func DeleteAccessToken(id string) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	if err := stateDrv.Clear(GetPath(RootAccessTokens, id)); err != nil && err != auth_errors.ErrKeyNotFound {
+		return fmt.Errorf("Failed to clear access token %q from data store: %#v", id, err)
+	}
+
+	return nil
+}
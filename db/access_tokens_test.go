@@ -0,0 +1,45 @@
+package db
+
+import (
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	. "gopkg.in/check.v1"
+)
+
+// TestAccessTokens tests adding, looking up, listing and deleting access tokens
+func (s *dbSuite) TestAccessTokens(c *C) {
+	token := &types.AccessToken{
+		ID:         "0123456789abcdef",
+		Name:       "ci",
+		Username:   "jdoe",
+		Principals: []string{"jdoe"},
+		Prefix:     "pat_0123456789abcdef",
+		Hash:       "f00d",
+		CreatedAt:  1500000000,
+	}
+
+	_, err := GetAccessToken(token.ID)
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	tokens, err := ListAccessTokens()
+	c.Assert(err, IsNil)
+	c.Assert(tokens, HasLen, 0)
+
+	c.Assert(AddAccessToken(token), IsNil)
+
+	obtained, err := GetAccessToken(token.ID)
+	c.Assert(err, IsNil)
+	c.Assert(obtained, DeepEquals, token)
+
+	tokens, err = ListAccessTokens()
+	c.Assert(err, IsNil)
+	c.Assert(tokens, DeepEquals, []*types.AccessToken{token})
+
+	c.Assert(DeleteAccessToken(token.ID), IsNil)
+
+	// deleting it again is fine
+	c.Assert(DeleteAccessToken(token.ID), IsNil)
+
+	_, err = GetAccessToken(token.ID)
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"encoding/json"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 
@@ -101,7 +102,8 @@ func ListAuthorizations() (
 
 //
 // ListAuthorizationsByPrincipal looks up all authorizations in
-// authz dir for the specific principal (subject).
+// authz dir for the specific principal (subject). Expired
+// authorizations are skipped.
 //
 // Parameters:
 //  ID: of the principal for whom authorizations need to be returned
@@ -123,6 +125,7 @@ func ListAuthorizationsByPrincipal(pName string) (
 	(*a).StateDriver = sd
 
 	match := []types.Authorization{}
+	now := time.Now().Unix()
 
 	allAuthZList, err := a.StateDriver.ReadAllState(types.AuthZDir, a, json.Unmarshal)
 	if err != nil {
@@ -136,8 +139,8 @@ func ListAuthorizationsByPrincipal(pName string) (
 
 	for _, auth := range allAuthZList {
 		tmp, ok := auth.(*types.Authorization)
-		if ok {
-			if tmp.PrincipalName == pName {
+		if ok && !tmp.Expired(now) {
+			if common.SamePrincipal(tmp.PrincipalName, pName) {
 				match = append(match, *tmp)
 
 			}
@@ -149,7 +152,9 @@ func ListAuthorizationsByPrincipal(pName string) (
 
 //
 // DeleteAuthorizationsByPrincipal deletes all authorizations in
-// in the KV store for the specific principal (subject).
+// in the KV store for the specific principal (subject). Every deleted
+// authorization is logged. If a deletion fails, the remaining ones are
+// kept and the error is returned.
 //
 // Parameters:
 //  ID: of the principal whose authorizations need to be removed
@@ -179,7 +184,7 @@ func DeleteAuthorizationsByPrincipal(pName string) error {
 	for _, auth := range allAuthZList {
 		tmp, ok := auth.(*types.Authorization)
 		if ok {
-			if tmp.PrincipalName == pName {
+			if common.SamePrincipal(tmp.PrincipalName, pName) {
 
 				// record UUID so that its key path
 				// can be determined
@@ -189,6 +194,9 @@ func DeleteAuthorizationsByPrincipal(pName string) error {
 					log.Error("failed to delete authorization, err:", err)
 					return err
 				}
+
+				log.Infof("Deleted authorization %s of principal %q (claim %q: %q)",
+					tmp.UUID, tmp.PrincipalName, tmp.ClaimKey, tmp.ClaimValue)
 			}
 		}
 	}
@@ -198,7 +206,8 @@ func DeleteAuthorizationsByPrincipal(pName string) error {
 
 //
 // ListAuthorizationsByClaim looks up all authorizations in the
-// authz dir that contains a claim key
+// authz dir that contains a claim key. Expired authorizations
+// are skipped.
 //
 // Parameters:
 //  claim: claim string (object) for which authorizations are being searched.
@@ -221,6 +230,7 @@ func ListAuthorizationsByClaim(claim string) (
 	(*a).StateDriver = sd
 
 	match := []types.Authorization{}
+	now := time.Now().Unix()
 
 	allAuthZList, err := a.StateDriver.ReadAllState(types.AuthZDir, a, json.Unmarshal)
 	if err != nil {
@@ -234,7 +244,7 @@ func ListAuthorizationsByClaim(claim string) (
 
 	for _, auth := range allAuthZList {
 		tmp, ok := auth.(*types.Authorization)
-		if ok {
+		if ok && !tmp.Expired(now) {
 			if tmp.ClaimKey == claim {
 				match = append(match, *tmp)
 			}
@@ -291,7 +301,8 @@ func DeleteAuthorizationsByClaim(claim string) error {
 
 //
 // ListAuthorizationsByClaimAndPrincipal looks up all authorizations in
-// the KV store for a specific claim and principal
+// the KV store for a specific claim and principal. Expired
+// authorizations are skipped.
 //
 // Parameters:
 //  claim: claim string for which authorizations are being searched.
@@ -315,6 +326,7 @@ func ListAuthorizationsByClaimAndPrincipal(claim string, principal string) (
 	(*a).StateDriver = sd
 
 	match := []types.Authorization{}
+	now := time.Now().Unix()
 
 	allAuthZList, err := a.StateDriver.ReadAllState(types.AuthZDir, a, json.Unmarshal)
 	if err != nil {
@@ -328,8 +340,8 @@ func ListAuthorizationsByClaimAndPrincipal(claim string, principal string) (
 
 	for _, auth := range allAuthZList {
 		tmp, ok := auth.(*types.Authorization)
-		if ok {
-			if (tmp.ClaimKey == claim) && (tmp.PrincipalName == principal) {
+		if ok && !tmp.Expired(now) {
+			if (tmp.ClaimKey == claim) && common.SamePrincipal(tmp.PrincipalName, principal) {
 				match = append(match, *tmp)
 			}
 		}
@@ -337,3 +349,41 @@ func ListAuthorizationsByClaimAndPrincipal(claim string, principal string) (
 
 	return match, nil
 }
+
+//
+// DeleteExpiredAuthorizations deletes all authorizations in the
+// authz dir which have expired.
+//
+// Parameters:
+//  now: current time in seconds since the epoch
+//
+// Return Values:
+//  []types.Authorization: the deleted authorizations
+//  error: Any error encountered when reading or deleting from the
+//         KV store; the authorizations deleted so far are returned
+//
+func DeleteExpiredAuthorizations(now int64) ([]types.Authorization, error) {
+	defer common.Untrace(common.Trace())
+
+	deleted := []types.Authorization{}
+
+	authzs, err := ListAuthorizations()
+	if err != nil {
+		return deleted, err
+	}
+
+	for _, authz := range authzs {
+		if !authz.Expired(now) {
+			continue
+		}
+
+		if err := DeleteAuthorization(authz.UUID); err != nil && err != auth_errors.ErrKeyNotFound {
+			log.Error("failed to delete expired authorization, err:", err)
+			return deleted, err
+		}
+
+		deleted = append(deleted, authz)
+	}
+
+	return deleted, nil
+}
@@ -1,6 +1,9 @@
 package db
 
 import (
+	"time"
+
+	"github.com/contiv/auth_proxy/common"
 	"github.com/contiv/auth_proxy/common/types"
 	"github.com/contiv/auth_proxy/state"
 	. "gopkg.in/check.v1"
@@ -84,6 +87,30 @@ func (s *dbSuite) TestListAuthorizationsByPrincipal(c *C) {
 	c.Assert(len(aList), Equals, 2)
 }
 
+// TestListAuthorizationsByPrincipalCase tests that principals are only matched
+// case-insensitively if usernames are normalized
+func (s *dbSuite) TestListAuthorizationsByPrincipalCase(c *C) {
+	defer common.Global().Set(common.NormalizeUsernamesKey, "")
+
+	mixedCase := a1
+	mixedCase.PrincipalName = "JSmith"
+	c.Assert(InsertAuthorization(&mixedCase), IsNil)
+
+	aList, err := ListAuthorizationsByPrincipal("jsmith")
+	c.Assert(err, IsNil)
+	c.Assert(aList, HasLen, 0)
+
+	c.Assert(common.Global().Set(common.NormalizeUsernamesKey, "true"), IsNil)
+
+	aList, err = ListAuthorizationsByPrincipal("jsmith")
+	c.Assert(err, IsNil)
+	c.Assert(aList, HasLen, 1)
+
+	aList, err = ListAuthorizationsByClaimAndPrincipal(mixedCase.ClaimKey, "JSMITH")
+	c.Assert(err, IsNil)
+	c.Assert(aList, HasLen, 1)
+}
+
 // TestDeleteAuthorizationsByPrincipal tests deleting an authorization
 // by principal
 func (s *dbSuite) TestDeleteAuthorizationsByPrincipal(c *C) {
@@ -170,3 +197,65 @@ func (s *dbSuite) TestListAuthorizationsByClaimAndPrincipal(c *C) {
 
 	c.Assert(len(aList), Equals, 0)
 }
+
+// TestExpiredAuthorizations tests that expired authorizations are only
+// listed by ListAuthorizations until they're deleted
+func (s *dbSuite) TestExpiredAuthorizations(c *C) {
+	now := time.Now().Unix()
+
+	expired := types.Authorization{
+		CommonState:   commonState,
+		UUID:          "5555",
+		PrincipalName: "6666",
+		ClaimKey:      "tenant: Tenant1",
+		ClaimValue:    "ops",
+		ExpiresAt:     now - 1,
+	}
+	temporary := expired
+	temporary.UUID = "7777"
+	temporary.ClaimKey = "tenant: Tenant2"
+	temporary.ExpiresAt = now + 60
+
+	c.Assert(InsertAuthorization(&expired), IsNil)
+	c.Assert(InsertAuthorization(&temporary), IsNil)
+
+	aList, err := ListAuthorizationsByPrincipal(expired.PrincipalName)
+	c.Assert(err, IsNil)
+	c.Assert(aList, HasLen, 1)
+	c.Assert(aList[0].UUID, Equals, temporary.UUID)
+
+	aList, err = ListAuthorizationsByClaimAndPrincipal(expired.ClaimKey, expired.PrincipalName)
+	c.Assert(err, IsNil)
+	c.Assert(aList, HasLen, 0)
+
+	aList, err = ListAuthorizationsByClaim(expired.ClaimKey)
+	c.Assert(err, IsNil)
+	for _, a := range aList {
+		c.Assert(a.UUID, Not(Equals), expired.UUID)
+	}
+
+	// expired authorizations are listed until they're deleted
+	aList, err = ListAuthorizations()
+	c.Assert(err, IsNil)
+	found := 0
+	for _, a := range aList {
+		if a.PrincipalName == expired.PrincipalName {
+			found++
+		}
+	}
+	c.Assert(found, Equals, 2)
+
+	deleted, err := DeleteExpiredAuthorizations(now)
+	c.Assert(err, IsNil)
+	c.Assert(deleted, HasLen, 1)
+	c.Assert(deleted[0].UUID, Equals, expired.UUID)
+
+	_, err = GetAuthorization(expired.UUID)
+	c.Assert(err, NotNil)
+
+	// the temporary authorization is deleted once it has expired, too
+	deleted, err = DeleteExpiredAuthorizations(temporary.ExpiresAt)
+	c.Assert(err, IsNil)
+	c.Assert(deleted, HasLen, 1)
+	c.Assert(deleted[0].UUID, Equals, temporary.UUID)
+}
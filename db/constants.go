@@ -13,6 +13,22 @@ var (
 	RootLocalUsers        = "local_users"
 	RootLdapConfiguration = "ldap_configuration"
 	RootTokenSigningKey   = "token_signing_key"
+	RootRetiredKeys       = "retired_token_signing_keys"
+	RootSettings          = "settings"
+	RootEndpointPolicy    = "endpoint_policy"
+	RootCustomRoles       = "custom_roles"
+	RootRevokedTokens     = "revoked_tokens"
+	RootTenantStats       = "tenant_stats"
+	RootRevokedPrincipals = "revoked_principals"
+	RootLdapLoginCache    = "ldap_login_cache"
+	RootLeader            = "leader"
+	RootSessions          = "sessions"
+	RootAccessTokens      = "access_tokens"
+	RootLoginAudit        = "audit/logins"
+	RootPrincipalLogins   = "principal_logins"
+	RootLocalUserLogins   = "local_user_logins"
+	RootLocks             = "locks"
+	RootMaxTokenTTL       = "max_token_ttl"
 )
 
 // GetPath joins the given list of strings using path separator with `root` data store path.
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains all custom role management APIs.
+
+// ListCustomRoles returns all the custom roles.
+// return values:
+//  []*types.CustomRole: slice of roles; empty if there are none
+//  error: as returned by consecutive func calls
+func ListCustomRoles() ([]*types.CustomRole, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	roles := []*types.CustomRole{}
+	rawData, err := stateDrv.ReadAll(GetPath(RootCustomRoles))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return roles, nil
+		}
+
+		return nil, fmt.Errorf("Couldn't fetch custom roles from data store")
+	}
+
+	for _, data := range rawData {
+		role := &types.CustomRole{}
+		if err := json.Unmarshal(data, role); err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, role)
+	}
+
+	return roles, nil
+}
+
+// GetCustomRole looks up a role in `/auth_proxy/custom_roles` path.
+// params:
+//  name: of the role to be fetched
+// return values:
+//  *types.CustomRole: reference to the role fetched from data store
+//  error: auth_errors.ErrKeyNotFound if the role doesn't exist or any relevant error
+func GetCustomRole(name string) (*types.CustomRole, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	rawData, err := stateDrv.Read(GetPath(RootCustomRoles, name))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("Failed to read custom role %q from store: %#v", name, err)
+	}
+
+	role := &types.CustomRole{}
+	if err := json.Unmarshal(rawData, role); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal custom role %q: %#v", name, err)
+	}
+
+	return role, nil
+}
+
+// AddCustomRole adds a new role to /auth_proxy/custom_roles/.
+// params:
+//  role: role to be added
+// return values:
+//  error: auth_errors.ErrKeyExists if a role with the same name exists or any relevant error
+func AddCustomRole(role *types.CustomRole) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	key := GetPath(RootCustomRoles, role.Name)
+
+	_, err = stateDrv.Read(key)
+
+	switch err {
+	case nil:
+		return auth_errors.ErrKeyExists
+	case auth_errors.ErrKeyNotFound:
+		val, err := json.Marshal(role)
+		if err != nil {
+			return fmt.Errorf("Failed to marshal custom role %#v: %#v", role, err)
+		}
+
+		if err := stateDrv.Write(key, val); err != nil {
+			return fmt.Errorf("Failed to write custom role to data store: %#v", err)
+		}
+
+		return nil
+	default:
+		return err
+	}
+}
+
+// DeleteCustomRole removes a role from /auth_proxy/custom_roles.
+// params:
+//  name: of the role to be removed
+// return values:
+//  error: auth_errors.ErrKeyNotFound if the role doesn't exist or any relevant error
+func DeleteCustomRole(name string) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	key := GetPath(RootCustomRoles, name)
+
+	// handles `ErrKeyNotFound`
+	if _, err := stateDrv.Read(key); err != nil {
+		return err
+	}
+
+	if err := stateDrv.Clear(key); err != nil {
+		return fmt.Errorf("Failed to clear custom role %q from store: %#v", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains all endpoint policy rule management APIs.
+
+// ListEndpointPolicyRules returns all the endpoint policy rules.
+// return values:
+//  []*types.EndpointPolicyRule: slice of rules; empty if there are none
+//  error: as returned by consecutive func calls
+func ListEndpointPolicyRules() ([]*types.EndpointPolicyRule, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []*types.EndpointPolicyRule{}
+	rawData, err := stateDrv.ReadAll(GetPath(RootEndpointPolicy))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return rules, nil
+		}
+
+		return nil, fmt.Errorf("Couldn't fetch endpoint policy rules from data store")
+	}
+
+	for _, data := range rawData {
+		rule := &types.EndpointPolicyRule{}
+		if err := json.Unmarshal(data, rule); err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// GetEndpointPolicyRule looks up a rule in `/auth_proxy/endpoint_policy` path.
+// params:
+//  id: of the rule to be fetched
+// return values:
+//  *types.EndpointPolicyRule: reference to the rule fetched from data store
+//  error: auth_errors.ErrKeyNotFound if the rule doesn't exist or any relevant error
+func GetEndpointPolicyRule(id string) (*types.EndpointPolicyRule, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	rawData, err := stateDrv.Read(GetPath(RootEndpointPolicy, id))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("Failed to read endpoint policy rule %q from store: %#v", id, err)
+	}
+
+	rule := &types.EndpointPolicyRule{}
+	if err := json.Unmarshal(rawData, rule); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal endpoint policy rule %q: %#v", id, err)
+	}
+
+	return rule, nil
+}
+
+// writeEndpointPolicyRule writes the given rule to /auth_proxy/endpoint_policy/<id>.
+func writeEndpointPolicyRule(stateDrv types.StateDriver, rule *types.EndpointPolicyRule) error {
+	val, err := json.Marshal(rule)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal endpoint policy rule %#v: %#v", rule, err)
+	}
+
+	if err := stateDrv.Write(GetPath(RootEndpointPolicy, rule.ID), val); err != nil {
+		return fmt.Errorf("Failed to write endpoint policy rule to data store: %#v", err)
+	}
+
+	return nil
+}
+
+// AddEndpointPolicyRule adds a new rule to /auth_proxy/endpoint_policy/.
+// params:
+//  rule: rule to be added; rule.ID must be set
+// return values:
+//  error: auth_errors.ErrKeyExists if a rule with the same ID exists or any relevant error
+func AddEndpointPolicyRule(rule *types.EndpointPolicyRule) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	_, err = stateDrv.Read(GetPath(RootEndpointPolicy, rule.ID))
+
+	switch err {
+	case nil:
+		return auth_errors.ErrKeyExists
+	case auth_errors.ErrKeyNotFound:
+		return writeEndpointPolicyRule(stateDrv, rule)
+	default:
+		return err
+	}
+}
+
+// UpdateEndpointPolicyRule replaces an existing rule in /auth_proxy/endpoint_policy/<id>.
+// params:
+//  rule: rule to be updated; identified by rule.ID
+// return values:
+//  error: auth_errors.ErrKeyNotFound if the rule doesn't exist or any relevant error
+func UpdateEndpointPolicyRule(rule *types.EndpointPolicyRule) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	if _, err := stateDrv.Read(GetPath(RootEndpointPolicy, rule.ID)); err != nil {
+		return err
+	}
+
+	return writeEndpointPolicyRule(stateDrv, rule)
+}
+
+// DeleteEndpointPolicyRule removes a rule from /auth_proxy/endpoint_policy.
+// params:
+//  id: of the rule to be removed
+// return values:
+//  error: auth_errors.ErrKeyNotFound if the rule doesn't exist or any relevant error
+func DeleteEndpointPolicyRule(id string) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	key := GetPath(RootEndpointPolicy, id)
+
+	// handles `ErrKeyNotFound`
+	if _, err := stateDrv.Read(key); err != nil {
+		return err
+	}
+
+	if err := stateDrv.Clear(key); err != nil {
+		return fmt.Errorf("Failed to clear endpoint policy rule %q from store: %#v", id, err)
+	}
+
+	return nil
+}
+
+// SeedEndpointPolicyRules adds the given rules only if there are no rules in
+// the data store yet, i.e. on the very first start.
+// params:
+//  rules: rules to be added
+// return values:
+//  bool: true if the rules were added
+//  error: as returned by consecutive func calls
+func SeedEndpointPolicyRules(rules []*types.EndpointPolicyRule) (bool, error) {
+	existing, err := ListEndpointPolicyRules()
+	if err != nil {
+		return false, err
+	}
+
+	if len(existing) > 0 {
+		log.Debugf("Found %d endpoint policy rules, not seeding", len(existing))
+		return false, nil
+	}
+
+	for _, rule := range rules {
+		if err := AddEndpointPolicyRule(rule); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
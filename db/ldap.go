@@ -64,6 +64,11 @@ func UpdateLdapConfiguration(ldapConfiguration *types.LdapConfiguration, existin
 			return fmt.Errorf("Failed to marshal LDAP configuration %#v, %#v", ldapConfiguration, err)
 		}
 
+		// logins cached using the old configuration must not be used anymore
+		if err := ClearLdapLoginCache(); err != nil {
+			return err
+		}
+
 		if err := stateDrv.Write(GetPath(RootLdapConfiguration), val); err != nil {
 			return fmt.Errorf("Failed to update LDAP setting to data store: %#v", err)
 		}
@@ -102,6 +107,10 @@ func DeleteLdapConfiguration() error {
 		return err
 	}
 
+	if err := ClearLdapLoginCache(); err != nil {
+		return err
+	}
+
 	if err := stateDrv.Clear(GetPath(RootLdapConfiguration)); err != nil {
 		return fmt.Errorf("Failed to clear LDAP setting from data store: %#v", err)
 	}
@@ -130,9 +139,54 @@ func AddLdapConfiguration(ldapConfiguration *types.LdapConfiguration) error {
 		return fmt.Errorf("Failed to marshal LDAP configuration %#v, %#v", ldapConfiguration, err)
 	}
 
+	if err := ClearLdapLoginCache(); err != nil {
+		return err
+	}
+
 	if err := stateDrv.Write(GetPath(RootLdapConfiguration), val); err != nil {
 		return fmt.Errorf("Failed to write LDAP setting to data store: %#v", err)
 	}
 
 	return nil
 }
+
+// ReencryptLdapConfiguration re-encrypts the LDAP service account password
+// with the current TLS key if it's encrypted with one of the previous ones
+// (see common.PreviousTLSKeyFilesKey).
+// return values:
+//  bool: true if the password was re-encrypted, false if it already was encrypted with the current key
+//  error: nil if successful, auth_errors.ErrKeyNotFound if there's no LDAP
+//         configuration, otherwise any relevant custom error
+func ReencryptLdapConfiguration() (bool, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return false, err
+	}
+
+	ldapConfiguration, err := getLdapConfiguration(stateDrv)
+	if err != nil {
+		return false, err
+	}
+
+	password, reencrypted, err := common.Reencrypt(ldapConfiguration.ServiceAccountPassword)
+	if err != nil {
+		return false, fmt.Errorf("Failed to decrypt LDAP service account password with any of the TLS keys: %#v", err)
+	}
+
+	if !reencrypted {
+		return false, nil
+	}
+
+	// the configuration itself is unchanged, so cached logins are kept
+	ldapConfiguration.ServiceAccountPassword = password
+	val, err := json.Marshal(ldapConfiguration)
+	if err != nil {
+		return false, fmt.Errorf("Failed to marshal LDAP configuration %#v, %#v", ldapConfiguration, err)
+	}
+
+	if err := stateDrv.Write(GetPath(RootLdapConfiguration), val); err != nil {
+		return false, fmt.Errorf("Failed to update LDAP setting to data store: %#v", err)
+	}
+
+	return true, nil
+}
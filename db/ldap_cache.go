@@ -0,0 +1,143 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains all LDAP login cache APIs.
+
+// ldapLoginCacheKey returns the key of a user's cached login; usernames are
+// case-insensitive in Active Directory
+func ldapLoginCacheKey(username string) string {
+	return GetPath(RootLdapLoginCache, url.QueryEscape(strings.ToLower(username)))
+}
+
+// CacheLdapLogin adds the given login to /auth_proxy/ldap_login_cache,
+// replacing the user's previous login if any.
+// params:
+//  login: login to be cached
+// return values:
+//  error: as returned by consecutive func calls
+func CacheLdapLogin(login *types.LdapCachedLogin) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	val, err := json.Marshal(login)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal cached login of %q: %#v", login.Username, err)
+	}
+
+	if err := stateDrv.Write(ldapLoginCacheKey(login.Username), val); err != nil {
+		return fmt.Errorf("Failed to write cached login of %q to data store: %#v", login.Username, err)
+	}
+
+	return nil
+}
+
+// GetCachedLdapLogin looks up the cached login of the given user.
+// params:
+//  username: username the user logs in with
+// return values:
+//  *types.LdapCachedLogin: the cached login
+//  error: auth_errors.ErrKeyNotFound if there is none, or as returned by consecutive func calls
+func GetCachedLdapLogin(username string) (*types.LdapCachedLogin, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := stateDrv.Read(ldapLoginCacheKey(username))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("Failed to read cached login of %q from store: %#v", username, err)
+	}
+
+	login := &types.LdapCachedLogin{}
+	if err := json.Unmarshal(data, login); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal cached login of %q: %#v", username, err)
+	}
+
+	return login, nil
+}
+
+// ListCachedLdapLogins returns all the logins in /auth_proxy/ldap_login_cache.
+// return values:
+//  []*types.LdapCachedLogin: slice of cached logins; empty if there are none
+//  error: as returned by consecutive func calls
+func ListCachedLdapLogins() ([]*types.LdapCachedLogin, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	logins := []*types.LdapCachedLogin{}
+	rawData, err := stateDrv.ReadAll(GetPath(RootLdapLoginCache))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return logins, nil
+		}
+
+		return nil, fmt.Errorf("Couldn't fetch cached LDAP logins from data store: %s", err.Error())
+	}
+
+	for _, data := range rawData {
+		login := &types.LdapCachedLogin{}
+		if err := json.Unmarshal(data, login); err != nil {
+			return nil, err
+		}
+
+		logins = append(logins, login)
+	}
+
+	return logins, nil
+}
+
+// DeleteCachedLdapLogin removes the cached login of the given user.
+// Deleting a login which isn't cached is not an error.
+// params:
+//  username: username the user logs in with
+// return values:
+//  error: as returned by consecutive func calls
+func DeleteCachedLdapLogin(username string) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	if err := stateDrv.Clear(ldapLoginCacheKey(username)); err != nil && err != auth_errors.ErrKeyNotFound {
+		return fmt.Errorf("Failed to clear cached login of %q from data store: %#v", username, err)
+	}
+
+	return nil
+}
+
+// ClearLdapLoginCache removes all the cached logins, e.g. because the LDAP
+// configuration changed.
+// return values:
+//  error: as returned by consecutive func calls
+func ClearLdapLoginCache() error {
+	logins, err := ListCachedLdapLogins()
+	if err != nil {
+		return err
+	}
+
+	for _, login := range logins {
+		if err := DeleteCachedLdapLogin(login.Username); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"time"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	. "gopkg.in/check.v1"
+)
+
+// TestLdapLoginCache tests caching, looking up and clearing cached LDAP logins
+func (s *dbSuite) TestLdapLoginCache(c *C) {
+	now := time.Now().Unix()
+
+	login := &types.LdapCachedLogin{
+		Username:      "jdoe",
+		PasswordHash:  []byte("hash"),
+		DN:            "CN=John Doe,CN=Users,DC=auth,DC=example,DC=com",
+		Groups:        []string{"CN=Ops,CN=Users,DC=auth,DC=example,DC=com"},
+		ConfigVersion: "v1",
+		CachedAt:      now,
+		ExpiresAt:     now + 60,
+	}
+
+	_, err := GetCachedLdapLogin("jdoe")
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	c.Assert(CacheLdapLogin(login), IsNil)
+	c.Assert(CacheLdapLogin(&types.LdapCachedLogin{Username: "other"}), IsNil)
+
+	// usernames are case-insensitive
+	obtained, err := GetCachedLdapLogin("JDoe")
+	c.Assert(err, IsNil)
+	c.Assert(obtained, DeepEquals, login)
+
+	logins, err := ListCachedLdapLogins()
+	c.Assert(err, IsNil)
+	c.Assert(logins, HasLen, 2)
+
+	c.Assert(DeleteCachedLdapLogin("other"), IsNil)
+	c.Assert(DeleteCachedLdapLogin("other"), IsNil)
+
+	logins, err = ListCachedLdapLogins()
+	c.Assert(err, IsNil)
+	c.Assert(logins, DeepEquals, []*types.LdapCachedLogin{login})
+
+	// changing the LDAP configuration clears the cache
+	configuration := newLdapConfiguration[0]
+	c.Assert(AddLdapConfiguration(&configuration), IsNil)
+	defer DeleteLdapConfiguration()
+
+	_, err = GetCachedLdapLogin("jdoe")
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	c.Assert(CacheLdapLogin(login), IsNil)
+	c.Assert(UpdateLdapConfiguration(&configuration, configuration.ServiceAccountPassword), IsNil)
+
+	logins, err = ListCachedLdapLogins()
+	c.Assert(err, IsNil)
+	c.Assert(logins, HasLen, 0)
+}
@@ -1,6 +1,13 @@
 package db
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+
 	"github.com/contiv/auth_proxy/common"
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
 	"github.com/contiv/auth_proxy/common/types"
@@ -135,3 +142,57 @@ func (s *dbSuite) TestGetLdapConfiguration(c *C) {
 		c.Assert(obtained, IsNil)
 	}
 }
+
+// TestReencryptLdapConfiguration tests `ReencryptLdapConfiguration`
+func (s *dbSuite) TestReencryptLdapConfiguration(c *C) {
+	_, err := ReencryptLdapConfiguration()
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	// the configuration is written under the current key (A)
+	configuration := newLdapConfiguration[0]
+	err = AddLdapConfiguration(&configuration)
+	c.Assert(err, IsNil)
+
+	reencrypted, err := ReencryptLdapConfiguration()
+	c.Assert(err, IsNil)
+	c.Assert(reencrypted, Equals, false)
+
+	// switch the current key to B, keeping A as the previous key
+	keyFile, err := ioutil.TempFile("", "auth_proxy_rsa")
+	c.Assert(err, IsNil)
+	defer os.Remove(keyFile.Name())
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, IsNil)
+	c.Assert(pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), IsNil)
+	c.Assert(keyFile.Close(), IsNil)
+
+	common.Global().Set("tls_key_file", keyFile.Name())
+	common.Global().Set("previous_tls_key_files", "../local_certs/local.key")
+	defer common.Global().Set("tls_key_file", "../local_certs/local.key")
+	defer common.Global().Set("previous_tls_key_files", "")
+
+	obtained, err := GetLdapConfiguration()
+	c.Assert(err, IsNil)
+
+	outdated, err := common.EncryptionOutdated(obtained.ServiceAccountPassword)
+	c.Assert(err, IsNil)
+	c.Assert(outdated, Equals, true)
+
+	reencrypted, err = ReencryptLdapConfiguration()
+	c.Assert(err, IsNil)
+	c.Assert(reencrypted, Equals, true)
+
+	// the password is readable with key B alone
+	common.Global().Set("previous_tls_key_files", "")
+
+	obtained, err = GetLdapConfiguration()
+	c.Assert(err, IsNil)
+
+	obtained.ServiceAccountPassword, err = common.Decrypt(obtained.ServiceAccountPassword)
+	c.Assert(err, IsNil)
+	c.Assert(obtained.ServiceAccountPassword, Equals, "xyz")
+
+	err = DeleteLdapConfiguration()
+	c.Assert(err, IsNil)
+}
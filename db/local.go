@@ -3,6 +3,9 @@ package db
 import (
 	"encoding/json"
 	"fmt"
+	"path"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/contiv/auth_proxy/common"
@@ -34,12 +37,21 @@ func GetLocalUsers() ([]*types.LocalUser, error) {
 		return nil, fmt.Errorf("Couldn't fetch users from data store")
 	}
 
+	logins, err := localUserLogins(stateDrv)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, data := range rawData {
 		localUser := &types.LocalUser{}
 		if err := json.Unmarshal(data, localUser); err != nil {
 			return nil, err
 		}
 
+		if lastLogin, found := logins[localUser.Username]; found {
+			localUser.LastLogin = lastLogin
+		}
+
 		users = append(users, localUser)
 	}
 
@@ -58,7 +70,7 @@ func GetLocalUser(username string) (*types.LocalUser, error) {
 		return nil, err
 	}
 
-	rawData, err := stateDrv.Read(GetPath(RootLocalUsers, username))
+	rawData, err := stateDrv.Read(localUserKey(stateDrv, username))
 	if err != nil {
 		if err == auth_errors.ErrKeyNotFound {
 			return nil, err
@@ -72,6 +84,10 @@ func GetLocalUser(username string) (*types.LocalUser, error) {
 		return nil, fmt.Errorf("Failed to unmarshal local user %q info %#v", username, err)
 	}
 
+	if err := addLocalUserLogin(stateDrv, &localUser); err != nil {
+		return nil, err
+	}
+
 	return &localUser, nil
 }
 
@@ -87,7 +103,7 @@ func UpdateLocalUser(username string, user *types.LocalUser) error {
 		return err
 	}
 
-	key := GetPath(RootLocalUsers, username)
+	key := localUserKey(stateDrv, username)
 
 	_, err = stateDrv.Read(key)
 
@@ -101,6 +117,8 @@ func UpdateLocalUser(username string, user *types.LocalUser) error {
 				log.Debugf("Failed to create password hash for user %q: %#v", user.Username, err)
 				return err
 			}
+
+			user.PasswordChangedAt = time.Now().Unix()
 		}
 
 		// raw password will never be stored in the store
@@ -128,14 +146,114 @@ func UpdateLocalUser(username string, user *types.LocalUser) error {
 
 }
 
-// DeleteLocalUser removes a local user from `/auth_proxy/local_users`
+// SetLocalUserMFASecret stores the TOTP secret of a local user who enrolls for
+// MFA, encrypted with common.Encrypt(); see local.ValidateUserTOTP().
+// params:
+//  user: local user as read from the data store
+//  secret: TOTP secret; it's encrypted in `user` as well
+// return values:
+//  error: as returned by common.Encrypt() or UpdateLocalUser()
+func SetLocalUserMFASecret(user *types.LocalUser, secret string) error {
+	encrypted, err := common.Encrypt(secret)
+	if err != nil {
+		return fmt.Errorf("Failed to encrypt the MFA secret of user %q: %#v", user.Username, err)
+	}
+
+	user.MFASecret = encrypted
+	return UpdateLocalUser(user.Username, user)
+}
+
+// SoftDeleteLocalUser flags a local user as deleted; the user's record and
+// authorizations are kept until the user is restored or permanently deleted.
 // Built-in admin and ops local users cannot be deleted.
 // params:
+//  username: string; user to be deleted
+//  deletedAt: time of the deletion in seconds since the epoch
+// return values:
+//  error: auth_errors.ErrKeyNotFound if there's no such user or it's deleted already,
+//         auth_errors.ErrIllegalOperation or any relevant error from the consecutive func calls
+func SoftDeleteLocalUser(username string, deletedAt int64) error {
+	if common.SamePrincipal(username, types.Admin.String()) || common.SamePrincipal(username, types.Ops.String()) {
+		// built-in users cannot be deleted
+		return auth_errors.ErrIllegalOperation
+	}
+
+	user, err := GetLocalUser(username)
+	if err != nil {
+		return err
+	}
+
+	if user.DeletedAt != 0 {
+		return auth_errors.ErrKeyNotFound
+	}
+
+	user.DeletedAt = deletedAt
+
+	return UpdateLocalUser(username, user)
+}
+
+// RestoreLocalUser clears the deleted flag of a soft-deleted local user.
+// params:
+//  username: string; user to be restored
+// return values:
+//  *types.LocalUser: the restored user
+//  error: auth_errors.ErrKeyNotFound if there's no such user, auth_errors.ErrIllegalOperation
+//         if the user isn't deleted or any relevant error from the consecutive func calls
+func RestoreLocalUser(username string) (*types.LocalUser, error) {
+	user, err := GetLocalUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.DeletedAt == 0 {
+		return nil, auth_errors.ErrIllegalOperation
+	}
+
+	user.DeletedAt = 0
+	if err := UpdateLocalUser(username, user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// PurgeDeletedLocalUsers permanently deletes the local users which were
+// soft-deleted at or before the given time, along with their authorizations.
+// params:
+//  deletedBefore: time in seconds since the epoch
+// return values:
+//  []string: names of the purged users
+//  error: as returned by consecutive func calls
+func PurgeDeletedLocalUsers(deletedBefore int64) ([]string, error) {
+	users, err := GetLocalUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	purged := []string{}
+	for _, user := range users {
+		if user.DeletedAt == 0 || user.DeletedAt > deletedBefore {
+			continue
+		}
+
+		if err := DeleteLocalUser(user.Username); err != nil && err != auth_errors.ErrKeyNotFound {
+			return purged, err
+		}
+
+		purged = append(purged, user.Username)
+	}
+
+	return purged, nil
+}
+
+// DeleteLocalUser permanently removes a local user from `/auth_proxy/local_users`
+// along with the user's authorizations. Built-in admin and ops local users cannot be deleted.
+// params:
 //  username: string; user to be removed from the system
 // return values:
 //  error: auth_errors.ErrIllegalOperation or any relevant error from the consecutive func calls
 func DeleteLocalUser(username string) error {
-	if username == types.Admin.String() || username == types.Ops.String() {
+	if common.SamePrincipal(username, types.Admin.String()) || common.SamePrincipal(username, types.Ops.String()) {
 		// built-in users cannot be deleted
 		return auth_errors.ErrIllegalOperation
 	}
@@ -145,7 +263,7 @@ func DeleteLocalUser(username string) error {
 		return err
 	}
 
-	key := GetPath(RootLocalUsers, username)
+	key := localUserKey(stateDrv, username)
 
 	// handles `ErrKeyNotFound`
 	if _, err := stateDrv.Read(key); err != nil {
@@ -157,28 +275,36 @@ func DeleteLocalUser(username string) error {
 		return err
 	}
 
-	if err := stateDrv.Clear(GetPath(RootLocalUsers, username)); err != nil {
+	if err := stateDrv.Clear(key); err != nil {
 		// XXX: If this fails, data store will be in inconsistent state
 		return fmt.Errorf("Failed to clear %q from store: %#v", username, err)
 	}
 
-	return nil
+	// a user created later under the same name never logged in; the key ends
+	// with the name as stored
+	return deleteLocalUserLogin(stateDrv, path.Base(key))
 }
 
 // AddLocalUser adds a new user entry to /auth_proxy/local_users/.
+// The username is normalized (see common.NormalizeUsername()) first.
 // params:
 //  user: *types.LocalUser object that should be added to the data store
 // return Values:
-//  error: auth_errors.ErrKeyExists if the user already exists or any relevant error from state driver
+//  error: auth_errors.ErrKeyExists if the user already exists, in any case if usernames
+//         are normalized, or any relevant error from state driver
 func AddLocalUser(user *types.LocalUser) error {
 	stateDrv, err := state.GetStateDriver()
 	if err != nil {
 		return err
 	}
 
+	user.Username = common.NormalizeUsername(user.Username)
 	key := GetPath(RootLocalUsers, user.Username)
 
 	_, err = stateDrv.Read(key)
+	if err == auth_errors.ErrKeyNotFound && common.NormalizeUsernames() {
+		err = localUserExistsInAnyCase(user.Username)
+	}
 
 	switch err {
 	case nil:
@@ -191,6 +317,11 @@ func AddLocalUser(user *types.LocalUser) error {
 			return err
 		}
 
+		user.PasswordChangedAt = time.Now().Unix()
+
+		// a new user never logged in
+		user.LastLogin = 0
+
 		// raw password will never be stored in the store
 		user.Password = ""
 
@@ -211,3 +342,44 @@ func AddLocalUser(user *types.LocalUser) error {
 		return err
 	}
 }
+
+// localUserKey returns the key of the given local user: the key of the
+// normalized username (see common.NormalizeUsername()) if it exists, else the
+// key of the username as it is, so that users created with a mixed-case name
+// before usernames were normalized are still found.
+// params:
+//  stateDrv: data store driver
+//  username: username as given by the client
+// return values:
+//  string: key of the user; it might not exist
+func localUserKey(stateDrv types.StateDriver, username string) string {
+	key := GetPath(RootLocalUsers, common.NormalizeUsername(username))
+	if _, err := stateDrv.Read(key); err != auth_errors.ErrKeyNotFound {
+		return key
+	}
+
+	return GetPath(RootLocalUsers, username)
+}
+
+// localUserExistsInAnyCase checks whether a local user exists whose name only
+// differs from the given one in case, e.g. one created before usernames were
+// normalized.
+// params:
+//  username: normalized username
+// return values:
+//  error: auth_errors.ErrKeyExists if there's such a user, auth_errors.ErrKeyNotFound
+//         if there's none, or as returned by GetLocalUsers()
+func localUserExistsInAnyCase(username string) error {
+	users, err := GetLocalUsers()
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if strings.EqualFold(user.Username, username) {
+			return auth_errors.ErrKeyExists
+		}
+	}
+
+	return auth_errors.ErrKeyNotFound
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"encoding/json"
 	"os"
 	"sort"
 	"strings"
@@ -59,7 +60,7 @@ func (s *dbSuite) SetUpSuite(c *C) {
 		log.Fatalln("you must provide a DATASTORE_ADDRESS")
 	}
 
-	if err := state.InitializeStateDriver(datastoreAddress); err != nil {
+	if err := state.InitializeStateDriver(datastoreAddress, nil); err != nil {
 		log.Fatalln(err)
 	}
 
@@ -219,6 +220,83 @@ func (s *dbSuite) TestDeleteLocalUser(c *C) {
 
 }
 
+// TestSoftDeleteLocalUser tests `SoftDeleteLocalUser(...)`, `RestoreLocalUser(...)`
+// and `PurgeDeletedLocalUsers(...)`
+func (s *dbSuite) TestSoftDeleteLocalUser(c *C) {
+	s.addBuiltInUsers(c)
+	s.TestAddLocalUser(c)
+
+	stateDrv, err := state.GetStateDriver()
+	c.Assert(err, IsNil)
+
+	// built-in users cannot be deleted
+	for _, username := range builtInUsers {
+		c.Assert(SoftDeleteLocalUser(username, 100), Equals, auth_errors.ErrIllegalOperation)
+	}
+
+	for i, user := range newUsers {
+		a := types.Authorization{
+			CommonState: types.CommonState{
+				ID:          "0000",
+				StateDriver: stateDrv,
+			},
+			UUID:          user.Username,
+			PrincipalName: user.Username,
+			ClaimKey:      "tenant: Tenant2",
+			ClaimValue:    "devops",
+		}
+		c.Assert(InsertAuthorization(&a), IsNil)
+
+		// restoring a user which isn't deleted is not allowed
+		_, err := RestoreLocalUser(user.Username)
+		c.Assert(err, Equals, auth_errors.ErrIllegalOperation)
+
+		c.Assert(SoftDeleteLocalUser(user.Username, int64(100*(i+1))), IsNil)
+		c.Assert(SoftDeleteLocalUser(user.Username, 1000), Equals, auth_errors.ErrKeyNotFound)
+
+		// the record and the authorizations are kept
+		dUser, err := GetLocalUser(user.Username)
+		c.Assert(err, IsNil)
+		c.Assert(dUser.DeletedAt, Equals, int64(100*(i+1)))
+
+		authZs, err := ListAuthorizationsByPrincipal(user.Username)
+		c.Assert(err, IsNil)
+		c.Assert(len(authZs), Equals, 1)
+
+		// the name can't be reused while the record exists
+		c.Assert(AddLocalUser(&types.LocalUser{Username: user.Username, Password: "x"}), Equals, auth_errors.ErrKeyExists)
+	}
+
+	// restore the first user
+	rUser, err := RestoreLocalUser(newUsers[0].Username)
+	c.Assert(err, IsNil)
+	c.Assert(rUser.DeletedAt, Equals, int64(0))
+
+	authZs, err := ListAuthorizationsByPrincipal(newUsers[0].Username)
+	c.Assert(err, IsNil)
+	c.Assert(len(authZs), Equals, 1)
+
+	// only the users deleted at or before 200 are purged
+	purged, err := PurgeDeletedLocalUsers(200)
+	c.Assert(err, IsNil)
+	c.Assert(purged, DeepEquals, []string{newUsers[1].Username})
+
+	_, err = GetLocalUser(newUsers[1].Username)
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	authZs, err = ListAuthorizationsByPrincipal(newUsers[1].Username)
+	c.Assert(err, IsNil)
+	c.Assert(len(authZs), Equals, 0)
+
+	for _, user := range append(builtInUsers, newUsers[0].Username, newUsers[2].Username) {
+		_, err := GetLocalUser(user)
+		c.Assert(err, IsNil)
+	}
+
+	_, err = RestoreLocalUser(newUsers[1].Username)
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+}
+
 // TestUpdateLocalUser test `UpdateLocalUser(...)`
 func (s *dbSuite) TestUpdateLocalUser(c *C) {
 	s.TestAddLocalUser(c)
@@ -269,6 +347,85 @@ func (s *dbSuite) TestUpdateLocalUser(c *C) {
 	}
 }
 
+// TestLocalUserPasswordChangedAt tests that `PasswordChangedAt` is set when a
+// user is added and updated only when the password changes
+func (s *dbSuite) TestLocalUserPasswordChangedAt(c *C) {
+	s.TestAddLocalUser(c)
+
+	for _, user := range newUsers {
+		uUser, err := GetLocalUser(user.Username)
+		c.Assert(err, IsNil)
+		c.Assert(uUser.PasswordChangedAt, Not(Equals), int64(0))
+
+		// pretend the password was changed a long time ago
+		uUser.PasswordChangedAt = 1
+		c.Assert(UpdateLocalUser(user.Username, uUser), IsNil)
+
+		uUser, err = GetLocalUser(user.Username)
+		c.Assert(err, IsNil)
+		c.Assert(uUser.PasswordChangedAt, Equals, int64(1))
+
+		// a new password resets it
+		uUser.Password = "new_password"
+		c.Assert(UpdateLocalUser(user.Username, uUser), IsNil)
+
+		uUser, err = GetLocalUser(user.Username)
+		c.Assert(err, IsNil)
+		c.Assert(uUser.PasswordChangedAt > 1, Equals, true)
+	}
+}
+
+// TestLocalUserPasswordResetRequired tests that `password_reset_required` is stored
+func (s *dbSuite) TestLocalUserPasswordResetRequired(c *C) {
+	s.TestAddLocalUser(c)
+
+	for _, user := range newUsers {
+		uUser, err := GetLocalUser(user.Username)
+		c.Assert(err, IsNil)
+		c.Assert(uUser.PasswordResetRequired, Equals, false)
+
+		uUser.PasswordResetRequired = true
+		c.Assert(UpdateLocalUser(user.Username, uUser), IsNil)
+
+		uUser, err = GetLocalUser(user.Username)
+		c.Assert(err, IsNil)
+		c.Assert(uUser.PasswordResetRequired, Equals, true)
+	}
+}
+
+// TestLocalUserMFASecret tests that MFA secrets are stored encrypted
+func (s *dbSuite) TestLocalUserMFASecret(c *C) {
+	s.TestAddLocalUser(c)
+
+	secret := "JBSWY3DPEHPK3PXP"
+
+	stateDrv, err := state.GetStateDriver()
+	c.Assert(err, IsNil)
+
+	for _, user := range newUsers {
+		uUser, err := GetLocalUser(user.Username)
+		c.Assert(err, IsNil)
+		c.Assert(SetLocalUserMFASecret(uUser, secret), IsNil)
+
+		// the data store never sees the secret itself
+		rawData, err := stateDrv.Read(GetPath(RootLocalUsers, user.Username))
+		c.Assert(err, IsNil)
+		c.Assert(strings.Contains(string(rawData), secret), Equals, false)
+
+		stored := types.LocalUser{}
+		c.Assert(json.Unmarshal(rawData, &stored), IsNil)
+		c.Assert(stored.MFASecret, Not(Equals), "")
+
+		decrypted, err := common.Decrypt(stored.MFASecret)
+		c.Assert(err, IsNil)
+		c.Assert(decrypted, Equals, secret)
+
+		uUser, err = GetLocalUser(user.Username)
+		c.Assert(err, IsNil)
+		c.Assert(uUser.MFASecret, Equals, stored.MFASecret)
+	}
+}
+
 // TestGetLocalUsers tests `GetLocalUsers(...)`
 func (s *dbSuite) TestGetLocalUsers(c *C) {
 	users, err := GetLocalUsers()
@@ -348,3 +505,40 @@ func (s *dbSuite) TestUpdateBuiltInUsers(c *C) {
 	}
 
 }
+
+// TestNormalizedUsernames tests that local users are stored lowercased once
+// usernames are normalized, and that users created before are still found
+func (s *dbSuite) TestNormalizedUsernames(c *C) {
+	defer common.Global().Set(common.NormalizeUsernamesKey, "")
+
+	legacy := &types.LocalUser{Username: "JSmith", Password: "JSmith"}
+	c.Assert(AddLocalUser(legacy), IsNil)
+
+	c.Assert(common.Global().Set(common.NormalizeUsernamesKey, "true"), IsNil)
+
+	// found under the name it was created with, but no other
+	user, err := GetLocalUser("JSmith")
+	c.Assert(err, IsNil)
+	c.Assert(user.Username, Equals, "JSmith")
+
+	_, err = GetLocalUser("jsmith")
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	// names differing in case only conflict
+	c.Assert(AddLocalUser(&types.LocalUser{Username: "jsmith", Password: "jsmith"}), Equals, auth_errors.ErrKeyExists)
+
+	user = &types.LocalUser{Username: "MDoe", Password: "MDoe"}
+	c.Assert(AddLocalUser(user), IsNil)
+	c.Assert(user.Username, Equals, "mdoe")
+
+	for _, username := range []string{"mdoe", "MDoe", "MDOE"} {
+		user, err := GetLocalUser(username)
+		c.Assert(err, IsNil)
+		c.Assert(user.Username, Equals, "mdoe")
+	}
+
+	c.Assert(AddLocalUser(&types.LocalUser{Username: "MDOE", Password: "MDOE"}), Equals, auth_errors.ErrKeyExists)
+
+	c.Assert(DeleteLocalUser("MDoe"), IsNil)
+	c.Assert(DeleteLocalUser("JSmith"), IsNil)
+}
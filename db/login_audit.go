@@ -0,0 +1,103 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains all login audit APIs.
+
+// byTime sorts login audit records oldest first; records of the same second
+// are sorted by ID, so that the order is stable
+type byTime []*types.LoginAuditRecord
+
+func (r byTime) Len() int      { return len(r) }
+func (r byTime) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byTime) Less(i, j int) bool {
+	if r[i].Time != r[j].Time {
+		return r[i].Time < r[j].Time
+	}
+
+	return r[i].ID < r[j].ID
+}
+
+// AddLoginAuditRecord adds the given record to /auth_proxy/audit/logins.
+// params:
+//  record: login audit record to be added
+// return values:
+//  error: as returned by consecutive func calls
+func AddLoginAuditRecord(record *types.LoginAuditRecord) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	val, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal login audit record %q: %#v", record.ID, err)
+	}
+
+	if err := stateDrv.Write(GetPath(RootLoginAudit, record.ID), val); err != nil {
+		return fmt.Errorf("Failed to write login audit record %q to data store: %#v", record.ID, err)
+	}
+
+	return nil
+}
+
+// ListLoginAuditRecords returns the records in /auth_proxy/audit/logins.
+// return values:
+//  []*types.LoginAuditRecord: slice of records, oldest first; empty if there are none
+//  error: as returned by consecutive func calls
+func ListLoginAuditRecords() ([]*types.LoginAuditRecord, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*types.LoginAuditRecord{}
+	rawData, err := stateDrv.ReadAll(GetPath(RootLoginAudit))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return records, nil
+		}
+
+		return nil, fmt.Errorf("Couldn't fetch login audit records from data store: %s", err.Error())
+	}
+
+	for _, data := range rawData {
+		record := &types.LoginAuditRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	sort.Sort(byTime(records))
+
+	return records, nil
+}
+
+// DeleteLoginAuditRecord removes the login audit record with the given ID.
+// Deleting a record which doesn't exist is not an error.
+// params:
+//  id: unique ID of the record
+// return values:
+//  error: as returned by consecutive func calls
+func DeleteLoginAuditRecord(id string) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	if err := stateDrv.Clear(GetPath(RootLoginAudit, id)); err != nil && err != auth_errors.ErrKeyNotFound {
+		return fmt.Errorf("Failed to clear login audit record %q from data store: %#v", id, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"github.com/contiv/auth_proxy/common/types"
+	. "gopkg.in/check.v1"
+)
+
+// TestLoginAuditRecords tests adding, listing and deleting login audit records
+func (s *dbSuite) TestLoginAuditRecords(c *C) {
+	records, err := ListLoginAuditRecords()
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 0)
+
+	newer := &types.LoginAuditRecord{ID: "b", Time: 200, Username: "jdoe", Success: true, SourceIP: "10.0.0.1", UserAgent: "curl"}
+	older := &types.LoginAuditRecord{ID: "c", Time: 100, Username: "jdoe", FailureReason: "invalid_credentials"}
+	sameSecond := &types.LoginAuditRecord{ID: "a", Time: 200, Username: "admin", Success: true}
+
+	for _, record := range []*types.LoginAuditRecord{newer, older, sameSecond} {
+		c.Assert(AddLoginAuditRecord(record), IsNil)
+	}
+
+	// oldest first, then by ID
+	records, err = ListLoginAuditRecords()
+	c.Assert(err, IsNil)
+	c.Assert(records, DeepEquals, []*types.LoginAuditRecord{older, sameSecond, newer})
+
+	c.Assert(DeleteLoginAuditRecord(older.ID), IsNil)
+
+	// deleting it again is fine
+	c.Assert(DeleteLoginAuditRecord(older.ID), IsNil)
+
+	records, err = ListLoginAuditRecords()
+	c.Assert(err, IsNil)
+	c.Assert(records, DeepEquals, []*types.LoginAuditRecord{sameSecond, newer})
+
+	for _, record := range records {
+		c.Assert(DeleteLoginAuditRecord(record.ID), IsNil)
+	}
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains all APIs recording the last logins of principals. Local
+// users' are kept apart from their entries, so that recording a login doesn't
+// write back (and possibly undo concurrent changes to) the whole user.
+
+// principalLoginKey returns the key of a principal's last login; DNs are case-insensitive
+func principalLoginKey(principal string) string {
+	// DNs contain characters which aren't safe in a key
+	return GetPath(RootPrincipalLogins, url.QueryEscape(strings.ToLower(principal)))
+}
+
+// RecordPrincipalLogin adds the given login to /auth_proxy/principal_logins,
+// replacing the principal's previous login if any.
+// params:
+//  principal: name of the principal, e.g. the DN of an LDAP user
+//  at: time of the login in seconds since the epoch
+// return values:
+//  error: as returned by consecutive func calls
+func RecordPrincipalLogin(principal string, at int64) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	val, err := json.Marshal(&types.PrincipalLogin{Principal: principal, LastLogin: at})
+	if err != nil {
+		return fmt.Errorf("Failed to marshal last login of %q: %#v", principal, err)
+	}
+
+	if err := stateDrv.Write(principalLoginKey(principal), val); err != nil {
+		return fmt.Errorf("Failed to write last login of %q to data store: %#v", principal, err)
+	}
+
+	return nil
+}
+
+// GetPrincipalLogin looks up the last login of the given principal.
+// params:
+//  principal: name of the principal
+// return values:
+//  *types.PrincipalLogin: the last login
+//  error: auth_errors.ErrKeyNotFound if the principal never logged in, or as
+//         returned by consecutive func calls
+func GetPrincipalLogin(principal string) (*types.PrincipalLogin, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := stateDrv.Read(principalLoginKey(principal))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("Failed to read last login of %q from store: %#v", principal, err)
+	}
+
+	login := &types.PrincipalLogin{}
+	if err := json.Unmarshal(data, login); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal last login of %q: %#v", principal, err)
+	}
+
+	return login, nil
+}
+
+// DeletePrincipalLogin removes the last login of the given principal; it's not
+// an error if there is none.
+// params:
+//  principal: name of the principal
+// return values:
+//  error: as returned by consecutive func calls
+func DeletePrincipalLogin(principal string) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	if err := stateDrv.Clear(principalLoginKey(principal)); err != nil && err != auth_errors.ErrKeyNotFound {
+		return fmt.Errorf("Failed to clear last login of %q from data store: %#v", principal, err)
+	}
+
+	return nil
+}
+
+// localUserLoginKey returns the key of a local user's last login
+func localUserLoginKey(username string) string {
+	return GetPath(RootLocalUserLogins, username)
+}
+
+// RecordLocalUserLogin adds the given login to /auth_proxy/local_user_logins,
+// replacing the user's previous login if any; GetLocalUser() and GetLocalUsers()
+// return it as LocalUser.LastLogin.
+// params:
+//  username: name of the local user as stored in its entry
+//  at: time of the login in seconds since the epoch
+// return values:
+//  error: as returned by consecutive func calls
+func RecordLocalUserLogin(username string, at int64) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	val, err := json.Marshal(&types.PrincipalLogin{Principal: username, LastLogin: at})
+	if err != nil {
+		return fmt.Errorf("Failed to marshal last login of local user %q: %#v", username, err)
+	}
+
+	if err := stateDrv.Write(localUserLoginKey(username), val); err != nil {
+		return fmt.Errorf("Failed to write last login of local user %q to data store: %#v", username, err)
+	}
+
+	return nil
+}
+
+// localUserLogins returns the recorded last logins of all local users.
+// params:
+//  stateDrv: data store driver
+// return values:
+//  map[string]int64: last login by username
+//  error: as returned by consecutive func calls
+func localUserLogins(stateDrv types.StateDriver) (map[string]int64, error) {
+	logins := map[string]int64{}
+
+	rawData, err := stateDrv.ReadAll(GetPath(RootLocalUserLogins))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return logins, nil
+		}
+
+		return nil, fmt.Errorf("Failed to read last logins of local users from store: %#v", err)
+	}
+
+	for _, data := range rawData {
+		login := types.PrincipalLogin{}
+		if err := json.Unmarshal(data, &login); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal last login of local user: %#v", err)
+		}
+
+		logins[login.Principal] = login.LastLogin
+	}
+
+	return logins, nil
+}
+
+// addLocalUserLogin sets the user's LastLogin to its recorded last login;
+// entries written by earlier versions keep their own if none is recorded.
+// params:
+//  stateDrv: data store driver
+//  user: local user read from the data store
+// return values:
+//  error: as returned by consecutive func calls
+func addLocalUserLogin(stateDrv types.StateDriver, user *types.LocalUser) error {
+	data, err := stateDrv.Read(localUserLoginKey(user.Username))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil
+		}
+
+		return fmt.Errorf("Failed to read last login of local user %q from store: %#v", user.Username, err)
+	}
+
+	login := types.PrincipalLogin{}
+	if err := json.Unmarshal(data, &login); err != nil {
+		return fmt.Errorf("Failed to unmarshal last login of local user %q: %#v", user.Username, err)
+	}
+
+	user.LastLogin = login.LastLogin
+	return nil
+}
+
+// deleteLocalUserLogin removes the last login of the given local user; it's not
+// an error if there is none.
+// params:
+//  stateDrv: data store driver
+//  username: name of the local user as stored in its entry
+// return values:
+//  error: as returned by consecutive func calls
+func deleteLocalUserLogin(stateDrv types.StateDriver, username string) error {
+	if err := stateDrv.Clear(localUserLoginKey(username)); err != nil && err != auth_errors.ErrKeyNotFound {
+		return fmt.Errorf("Failed to clear last login of local user %q from data store: %#v", username, err)
+	}
+
+	return nil
+}
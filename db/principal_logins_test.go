@@ -0,0 +1,73 @@
+package db
+
+import (
+	"time"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	. "gopkg.in/check.v1"
+)
+
+// TestPrincipalLogins tests recording, looking up and deleting the last logins of principals
+func (s *dbSuite) TestPrincipalLogins(c *C) {
+	now := time.Now().Unix()
+	dn := "CN=John Doe,CN=Users,DC=auth,DC=example,DC=com"
+
+	_, err := GetPrincipalLogin(dn)
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	c.Assert(RecordPrincipalLogin(dn, now-60), IsNil)
+	c.Assert(RecordPrincipalLogin(dn, now), IsNil)
+
+	// the latest login replaces the previous one; DNs are case-insensitive
+	login, err := GetPrincipalLogin("cn=john doe,cn=users,dc=auth,dc=example,dc=com")
+	c.Assert(err, IsNil)
+	c.Assert(login, DeepEquals, &types.PrincipalLogin{Principal: dn, LastLogin: now})
+
+	c.Assert(DeletePrincipalLogin(dn), IsNil)
+
+	_, err = GetPrincipalLogin(dn)
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	// deleting it again is fine
+	c.Assert(DeletePrincipalLogin(dn), IsNil)
+}
+
+// TestLocalUserLogins tests that the recorded last logins of local users are
+// returned with them, survive updates of the users and go along with them
+func (s *dbSuite) TestLocalUserLogins(c *C) {
+	now := time.Now().Unix()
+	user := &types.LocalUser{Username: "login_user", Password: "login_user"}
+
+	c.Assert(AddLocalUser(user), IsNil)
+
+	stale, err := GetLocalUser(user.Username)
+	c.Assert(err, IsNil)
+	c.Assert(stale.LastLogin, Equals, int64(0))
+
+	c.Assert(RecordLocalUserLogin(user.Username, now), IsNil)
+
+	stored, err := GetLocalUser(user.Username)
+	c.Assert(err, IsNil)
+	c.Assert(stored.LastLogin, Equals, now)
+
+	// an update made with a copy of the user read before the login doesn't undo it
+	stale.Disable = true
+	c.Assert(UpdateLocalUser(user.Username, stale), IsNil)
+
+	users, err := GetLocalUsers()
+	c.Assert(err, IsNil)
+	c.Assert(users, HasLen, 1)
+	c.Assert(users[0].Disable, Equals, true)
+	c.Assert(users[0].LastLogin, Equals, now)
+
+	// a user added later under the same name never logged in
+	c.Assert(DeleteLocalUser(user.Username), IsNil)
+	c.Assert(AddLocalUser(&types.LocalUser{Username: user.Username, Password: "login_user"}), IsNil)
+
+	stored, err = GetLocalUser(user.Username)
+	c.Assert(err, IsNil)
+	c.Assert(stored.LastLogin, Equals, int64(0))
+
+	c.Assert(DeleteLocalUser(user.Username), IsNil)
+}
@@ -0,0 +1,253 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains all token revocation APIs.
+
+// RevokeToken adds the given token ID to /auth_proxy/revoked_tokens.
+// Revoking a token twice is not an error.
+// params:
+//  id: unique ID of the token to be revoked
+//  expiresAt: expiry time of the token in seconds since the epoch
+// return values:
+//  error: as returned by consecutive func calls
+func RevokeToken(id string, expiresAt int64) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	val, err := json.Marshal(&types.RevokedToken{ID: id, ExpiresAt: expiresAt})
+	if err != nil {
+		return fmt.Errorf("Failed to marshal revoked token %q: %#v", id, err)
+	}
+
+	if err := stateDrv.Write(GetPath(RootRevokedTokens, id), val); err != nil {
+		return fmt.Errorf("Failed to write revoked token %q to data store: %#v", id, err)
+	}
+
+	return nil
+}
+
+// IsTokenRevoked checks whether the given token ID is in /auth_proxy/revoked_tokens.
+// params:
+//  id: unique ID of the token
+// return values:
+//  bool: true if the token was revoked
+//  error: any relevant error other than the token not being revoked
+func IsTokenRevoked(id string) (bool, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := stateDrv.Read(GetPath(RootRevokedTokens, id)); err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed to read revoked token %q from store: %#v", id, err)
+	}
+
+	return true, nil
+}
+
+// RevokePrincipalTokens adds the given principal to /auth_proxy/revoked_principals;
+// all the principal's tokens issued at or before `revokedAt` are revoked.
+// Revoking a principal again moves `revokedAt` forward.
+// params:
+//  principal: name of the principal whose tokens are to be revoked
+//  revokedAt: time in seconds since the epoch
+//  expiresAt: time at which all the revoked tokens have expired
+// return values:
+//  error: as returned by consecutive func calls
+func RevokePrincipalTokens(principal string, revokedAt, expiresAt int64) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	val, err := json.Marshal(&types.RevokedPrincipal{Principal: principal, RevokedAt: revokedAt, ExpiresAt: expiresAt})
+	if err != nil {
+		return fmt.Errorf("Failed to marshal revoked principal %q: %#v", principal, err)
+	}
+
+	if err := stateDrv.Write(revokedPrincipalKey(principal), val); err != nil {
+		return fmt.Errorf("Failed to write revoked principal %q to data store: %#v", principal, err)
+	}
+
+	return nil
+}
+
+// PrincipalTokensRevokedAt looks up the given principal in /auth_proxy/revoked_principals.
+// params:
+//  principal: name of the principal
+// return values:
+//  int64: the principal's tokens issued at or before this time are revoked; 0 if none are
+//  error: any relevant error other than the principal not being revoked
+func PrincipalTokensRevokedAt(principal string) (int64, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := stateDrv.Read(revokedPrincipalKey(principal))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return 0, nil
+		}
+
+		return 0, fmt.Errorf("Failed to read revoked principal %q from store: %#v", principal, err)
+	}
+
+	revoked := &types.RevokedPrincipal{}
+	if err := json.Unmarshal(data, revoked); err != nil {
+		return 0, fmt.Errorf("Failed to unmarshal revoked principal %q: %#v", principal, err)
+	}
+
+	return revoked.RevokedAt, nil
+}
+
+// RecordTokenTTL raises the longest validity of the tokens issued so far, kept
+// in /auth_proxy/max_token_ttl, to the given one if it's longer.
+// params:
+//  ttl: validity of a token in seconds
+// return values:
+//  error: as returned by consecutive func calls
+func RecordTokenTTL(ttl int64) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	maxTTL, err := MaxTokenTTL()
+	if err != nil || maxTTL >= ttl {
+		return err
+	}
+
+	val, err := json.Marshal(ttl)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal token TTL %d: %#v", ttl, err)
+	}
+
+	if err := stateDrv.Write(GetPath(RootMaxTokenTTL), val); err != nil {
+		return fmt.Errorf("Failed to write max token TTL to data store: %#v", err)
+	}
+
+	return nil
+}
+
+// MaxTokenTTL returns the longest validity of the tokens issued so far, as
+// recorded by RecordTokenTTL().
+// return values:
+//  int64: validity in seconds; 0 if none was recorded
+//  error: any relevant error other than none being recorded
+func MaxTokenTTL() (int64, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := stateDrv.Read(GetPath(RootMaxTokenTTL))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return 0, nil
+		}
+
+		return 0, fmt.Errorf("Failed to read max token TTL from store: %#v", err)
+	}
+
+	var ttl int64
+	if err := json.Unmarshal(data, &ttl); err != nil {
+		return 0, fmt.Errorf("Failed to unmarshal max token TTL: %#v", err)
+	}
+
+	return ttl, nil
+}
+
+// revokedPrincipalKey returns the key of a revoked principal; principals which
+// only differ in case share it if usernames are normalized (see
+// common.NormalizeUsername()).
+func revokedPrincipalKey(principal string) string {
+	// LDAP group DNs contain characters which aren't safe in a key
+	return GetPath(RootRevokedPrincipals, url.QueryEscape(common.NormalizeUsername(principal)))
+}
+
+// DeleteExpiredRevokedTokens deletes the revoked tokens in /auth_proxy/revoked_tokens
+// which have expired; they're rejected for being expired anyway.
+// params:
+//  now: current time in seconds since the epoch
+// return values:
+//  int: number of deleted records
+//  error: as returned by consecutive func calls
+func DeleteExpiredRevokedTokens(now int64) (int, error) {
+	return deleteExpiredRevocations(RootRevokedTokens, now, func(data []byte) (string, int64, error) {
+		revoked := &types.RevokedToken{}
+		err := json.Unmarshal(data, revoked)
+		return GetPath(RootRevokedTokens, revoked.ID), revoked.ExpiresAt, err
+	})
+}
+
+// DeleteExpiredRevokedPrincipals deletes the revoked principals in
+// /auth_proxy/revoked_principals whose revoked tokens have all expired.
+// params:
+//  now: current time in seconds since the epoch
+// return values:
+//  int: number of deleted records
+//  error: as returned by consecutive func calls
+func DeleteExpiredRevokedPrincipals(now int64) (int, error) {
+	return deleteExpiredRevocations(RootRevokedPrincipals, now, func(data []byte) (string, int64, error) {
+		revoked := &types.RevokedPrincipal{}
+		err := json.Unmarshal(data, revoked)
+		return revokedPrincipalKey(revoked.Principal), revoked.ExpiresAt, err
+	})
+}
+
+// deleteExpiredRevocations deletes the records below the given root which
+// expired at or before `now`. Records which can't be parsed are skipped.
+// params:
+//  root: root of the records, e.g. RootRevokedTokens
+//  now: current time in seconds since the epoch
+//  parse: returns the key and expiry time of a record
+// return values:
+//  int: number of deleted records
+//  error: as returned by consecutive func calls
+func deleteExpiredRevocations(root string, now int64, parse func([]byte) (string, int64, error)) (int, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return 0, err
+	}
+
+	rawData, err := stateDrv.ReadAll(GetPath(root))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return 0, nil
+		}
+
+		return 0, fmt.Errorf("Couldn't fetch %s from data store: %#v", root, err)
+	}
+
+	deleted := 0
+	for _, data := range rawData {
+		key, expiresAt, err := parse(data)
+		if err != nil || expiresAt > now {
+			continue
+		}
+
+		if err := stateDrv.Clear(key); err != nil && err != auth_errors.ErrKeyNotFound {
+			return deleted, fmt.Errorf("Failed to clear %q from data store: %#v", key, err)
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestRevokeToken tests `RevokeToken(...)` and `IsTokenRevoked(...)`
+func (s *dbSuite) TestRevokeToken(c *C) {
+	expiresAt := time.Now().Add(time.Hour).Unix()
+
+	revoked, err := IsTokenRevoked("token1")
+	c.Assert(err, IsNil)
+	c.Assert(revoked, Equals, false)
+
+	c.Assert(RevokeToken("token1", expiresAt), IsNil)
+
+	// revoking the same token again is fine
+	c.Assert(RevokeToken("token1", expiresAt), IsNil)
+
+	revoked, err = IsTokenRevoked("token1")
+	c.Assert(err, IsNil)
+	c.Assert(revoked, Equals, true)
+
+	// other tokens are unaffected
+	revoked, err = IsTokenRevoked("token2")
+	c.Assert(err, IsNil)
+	c.Assert(revoked, Equals, false)
+}
+
+// TestRevokePrincipalTokens tests `RevokePrincipalTokens(...)` and `PrincipalTokensRevokedAt(...)`
+func (s *dbSuite) TestRevokePrincipalTokens(c *C) {
+	now := time.Now().Unix()
+	group := "CN=Service Desk,OU=Groups,DC=example,DC=com"
+
+	revokedAt, err := PrincipalTokensRevokedAt("user1")
+	c.Assert(err, IsNil)
+	c.Assert(revokedAt, Equals, int64(0))
+
+	c.Assert(RevokePrincipalTokens("user1", now, now+3600), IsNil)
+	c.Assert(RevokePrincipalTokens(group, now, now+3600), IsNil)
+
+	revokedAt, err = PrincipalTokensRevokedAt("user1")
+	c.Assert(err, IsNil)
+	c.Assert(revokedAt, Equals, now)
+
+	revokedAt, err = PrincipalTokensRevokedAt(group)
+	c.Assert(err, IsNil)
+	c.Assert(revokedAt, Equals, now)
+
+	// revoking again moves the time forward
+	c.Assert(RevokePrincipalTokens("user1", now+10, now+3610), IsNil)
+
+	revokedAt, err = PrincipalTokensRevokedAt("user1")
+	c.Assert(err, IsNil)
+	c.Assert(revokedAt, Equals, now+10)
+
+	// other principals are unaffected
+	revokedAt, err = PrincipalTokensRevokedAt("user2")
+	c.Assert(err, IsNil)
+	c.Assert(revokedAt, Equals, int64(0))
+}
+
+// TestMaxTokenTTL tests `RecordTokenTTL(...)` and `MaxTokenTTL()`
+func (s *dbSuite) TestMaxTokenTTL(c *C) {
+	ttl, err := MaxTokenTTL()
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, int64(0))
+
+	c.Assert(RecordTokenTTL(36000), IsNil)
+	c.Assert(RecordTokenTTL(1800), IsNil)
+
+	// shorter TTLs don't lower the recorded one
+	ttl, err = MaxTokenTTL()
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, int64(36000))
+
+	c.Assert(RecordTokenTTL(86400), IsNil)
+
+	ttl, err = MaxTokenTTL()
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, int64(86400))
+}
+
+// TestDeleteExpiredRevocations tests `DeleteExpiredRevokedTokens(...)` and
+// `DeleteExpiredRevokedPrincipals(...)`
+func (s *dbSuite) TestDeleteExpiredRevocations(c *C) {
+	now := time.Now().Unix()
+	group := "CN=Service Desk,OU=Groups,DC=example,DC=com"
+
+	c.Assert(RevokeToken("expired", now-10), IsNil)
+	c.Assert(RevokeToken("valid", now+3600), IsNil)
+	c.Assert(RevokePrincipalTokens(group, now-3600, now-10), IsNil)
+	c.Assert(RevokePrincipalTokens("user1", now, now+3600), IsNil)
+
+	deleted, err := DeleteExpiredRevokedTokens(now)
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, 1)
+
+	deleted, err = DeleteExpiredRevokedPrincipals(now)
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, 1)
+
+	revoked, err := IsTokenRevoked("expired")
+	c.Assert(err, IsNil)
+	c.Assert(revoked, Equals, false)
+
+	revoked, err = IsTokenRevoked("valid")
+	c.Assert(err, IsNil)
+	c.Assert(revoked, Equals, true)
+
+	revokedAt, err := PrincipalTokensRevokedAt(group)
+	c.Assert(err, IsNil)
+	c.Assert(revokedAt, Equals, int64(0))
+
+	revokedAt, err = PrincipalTokensRevokedAt("user1")
+	c.Assert(err, IsNil)
+	c.Assert(revokedAt, Equals, now)
+
+	// nothing is left to delete
+	deleted, err = DeleteExpiredRevokedTokens(now)
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, 0)
+}
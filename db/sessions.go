@@ -0,0 +1,174 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains all session APIs.
+
+// AddSession adds the given session to /auth_proxy/sessions.
+// params:
+//  session: session to be added
+// return values:
+//  error: as returned by consecutive func calls
+func AddSession(session *types.Session) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	val, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal session %q: %#v", session.ID, err)
+	}
+
+	if err := stateDrv.Write(GetPath(RootSessions, session.ID), val); err != nil {
+		return fmt.Errorf("Failed to write session %q to data store: %#v", session.ID, err)
+	}
+
+	return nil
+}
+
+// GetSession looks up the session of the given token ID.
+// params:
+//  id: unique ID of the session's token
+// return values:
+//  *types.Session: the session
+//  error: auth_errors.ErrKeyNotFound if there is none, or as returned by consecutive func calls
+func GetSession(id string) (*types.Session, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := stateDrv.Read(GetPath(RootSessions, id))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("Failed to read session %q from store: %#v", id, err)
+	}
+
+	session := &types.Session{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal session %q: %#v", id, err)
+	}
+
+	return session, nil
+}
+
+// readSessions returns all the sessions in /auth_proxy/sessions, expired or not.
+// params:
+//  stateDrv: data store driver
+// return values:
+//  []*types.Session: slice of sessions; empty if there are none
+//  error: as returned by consecutive func calls
+func readSessions(stateDrv types.StateDriver) ([]*types.Session, error) {
+	sessions := []*types.Session{}
+	rawData, err := stateDrv.ReadAll(GetPath(RootSessions))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return sessions, nil
+		}
+
+		return nil, fmt.Errorf("Couldn't fetch sessions from data store: %s", err.Error())
+	}
+
+	for _, data := range rawData {
+		session := &types.Session{}
+		if err := json.Unmarshal(data, session); err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// ListSessions returns the sessions in /auth_proxy/sessions which haven't
+// expired yet; expired ones are left to DeleteExpiredSessions().
+// params:
+//  now: current time in seconds since the epoch
+// return values:
+//  []*types.Session: slice of sessions; empty if there are none
+//  error: as returned by consecutive func calls
+func ListSessions(now int64) ([]*types.Session, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := readSessions(stateDrv)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []*types.Session{}
+	for _, session := range all {
+		if session.ExpiresAt > now {
+			sessions = append(sessions, session)
+		}
+	}
+
+	return sessions, nil
+}
+
+// DeleteExpiredSessions deletes the sessions in /auth_proxy/sessions which
+// have expired.
+// params:
+//  now: current time in seconds since the epoch
+// return values:
+//  int: number of deleted sessions
+//  error: as returned by consecutive func calls; the sessions deleted so far
+//         are counted
+func DeleteExpiredSessions(now int64) (int, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return 0, err
+	}
+
+	sessions, err := readSessions(stateDrv)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, session := range sessions {
+		if session.ExpiresAt > now {
+			continue
+		}
+
+		if err := DeleteSession(session.ID); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// DeleteSession removes the session of the given token ID.
+// Deleting a session which doesn't exist is not an error.
+// params:
+//  id: unique ID of the session's token
+// return values:
+//  error: as returned by consecutive func calls
+func DeleteSession(id string) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	if err := stateDrv.Clear(GetPath(RootSessions, id)); err != nil && err != auth_errors.ErrKeyNotFound {
+		return fmt.Errorf("Failed to clear session %q from data store: %#v", id, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"time"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	. "gopkg.in/check.v1"
+)
+
+// TestSessions tests adding, looking up, listing and deleting sessions
+func (s *dbSuite) TestSessions(c *C) {
+	now := time.Now().Unix()
+
+	session := &types.Session{
+		ID:         "session1",
+		Username:   "jdoe",
+		Principals: []string{"jdoe"},
+		IssuedAt:   now,
+		ExpiresAt:  now + 60,
+		SourceIP:   "10.0.0.1",
+	}
+
+	_, err := GetSession("session1")
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	c.Assert(AddSession(session), IsNil)
+	c.Assert(AddSession(&types.Session{ID: "expired", Username: "jdoe", ExpiresAt: now - 1}), IsNil)
+
+	obtained, err := GetSession("session1")
+	c.Assert(err, IsNil)
+	c.Assert(obtained, DeepEquals, session)
+
+	// expired sessions are skipped, but only deleted by DeleteExpiredSessions()
+	sessions, err := ListSessions(now)
+	c.Assert(err, IsNil)
+	c.Assert(sessions, DeepEquals, []*types.Session{session})
+
+	_, err = GetSession("expired")
+	c.Assert(err, IsNil)
+
+	deleted, err := DeleteExpiredSessions(now)
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, 1)
+
+	_, err = GetSession("expired")
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	_, err = GetSession("session1")
+	c.Assert(err, IsNil)
+
+	c.Assert(DeleteSession("session1"), IsNil)
+
+	// deleting it again is fine
+	c.Assert(DeleteSession("session1"), IsNil)
+
+	sessions, err = ListSessions(now)
+	c.Assert(err, IsNil)
+	c.Assert(sessions, HasLen, 0)
+}
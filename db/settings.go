@@ -0,0 +1,40 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// GetSettings retrieves the global settings stored in the data store (/auth_proxy/settings).
+// The settings are stored as a single JSON object of string values, e.g.
+// {"log_level": "debug"}, and are applied on top of the flags on every reload.
+// return values:
+//  map[string]string: settings from the data store; empty if there are none
+//  error: nil on success, otherwise anything as returned by the consecutive
+//         function calls or any relevant custom error
+func GetSettings() (map[string]string, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	settings := map[string]string{}
+
+	rawData, err := stateDrv.Read(GetPath(RootSettings))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return settings, nil
+		}
+
+		return nil, fmt.Errorf("Failed to read settings from data store: %#v", err)
+	}
+
+	if err := json.Unmarshal(rawData, &settings); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal settings %#v: %#v", rawData, err)
+	}
+
+	return settings, nil
+}
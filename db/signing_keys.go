@@ -0,0 +1,130 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains all APIs for retired token signing keys; the current key
+// is kept at /auth_proxy/token_signing_key by package auth.
+
+// AddRetiredSigningKey adds the given key to /auth_proxy/retired_token_signing_keys.
+// params:
+//  key: retired key to be added
+// return values:
+//  error: as returned by consecutive func calls
+func AddRetiredSigningKey(key *types.RetiredSigningKey) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	val, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal retired signing key %q: %#v", key.ID, err)
+	}
+
+	if err := stateDrv.Write(GetPath(RootRetiredKeys, key.ID), val); err != nil {
+		return fmt.Errorf("Failed to write retired signing key %q to data store: %#v", key.ID, err)
+	}
+
+	return nil
+}
+
+// GetRetiredSigningKey looks up the retired key with the given ID.
+// params:
+//  id: key ID (`kid` header) of the tokens signed with the key
+// return values:
+//  *types.RetiredSigningKey: the key
+//  error: auth_errors.ErrKeyNotFound if there is none, or as returned by consecutive func calls
+func GetRetiredSigningKey(id string) (*types.RetiredSigningKey, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := stateDrv.Read(GetPath(RootRetiredKeys, id))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("Failed to read retired signing key %q from store: %#v", id, err)
+	}
+
+	key := &types.RetiredSigningKey{}
+	if err := json.Unmarshal(data, key); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal retired signing key %q: %#v", id, err)
+	}
+
+	return key, nil
+}
+
+// ListRetiredSigningKeys returns the retired keys in /auth_proxy/retired_token_signing_keys
+// which are still accepted; expired keys are deleted along the way.
+// params:
+//  now: current time in seconds since the epoch
+// return values:
+//  []*types.RetiredSigningKey: slice of retired keys; empty if there are none
+//  error: as returned by consecutive func calls
+func ListRetiredSigningKeys(now int64) ([]*types.RetiredSigningKey, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*types.RetiredSigningKey{}
+	rawData, err := stateDrv.ReadAll(GetPath(RootRetiredKeys))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return keys, nil
+		}
+
+		return nil, fmt.Errorf("Couldn't fetch retired signing keys from data store: %s", err.Error())
+	}
+
+	for _, data := range rawData {
+		key := &types.RetiredSigningKey{}
+		if err := json.Unmarshal(data, key); err != nil {
+			return nil, err
+		}
+
+		if key.ExpiresAt <= now {
+			if err := DeleteRetiredSigningKey(key.ID); err != nil {
+				log.Warnf("failed to delete expired signing key %q: %s", key.ID, err)
+			}
+
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// DeleteRetiredSigningKey removes the retired key with the given ID; tokens
+// signed with it are no longer accepted. Deleting a key which doesn't exist is
+// not an error.
+// params:
+//  id: key ID (`kid` header) of the tokens signed with the key
+// return values:
+//  error: as returned by consecutive func calls
+func DeleteRetiredSigningKey(id string) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	if err := stateDrv.Clear(GetPath(RootRetiredKeys, id)); err != nil && err != auth_errors.ErrKeyNotFound {
+		return fmt.Errorf("Failed to clear retired signing key %q from data store: %#v", id, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"time"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	. "gopkg.in/check.v1"
+)
+
+// TestRetiredSigningKeys tests adding, looking up, listing and deleting retired signing keys
+func (s *dbSuite) TestRetiredSigningKeys(c *C) {
+	now := time.Now().Unix()
+
+	key := &types.RetiredSigningKey{
+		ID:        "key1",
+		Key:       "encrypted",
+		RetiredAt: now,
+		ExpiresAt: now + 60,
+	}
+
+	_, err := GetRetiredSigningKey("key1")
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	c.Assert(AddRetiredSigningKey(key), IsNil)
+	c.Assert(AddRetiredSigningKey(&types.RetiredSigningKey{ID: "expired", Key: "encrypted", ExpiresAt: now - 1}), IsNil)
+
+	obtained, err := GetRetiredSigningKey("key1")
+	c.Assert(err, IsNil)
+	c.Assert(obtained, DeepEquals, key)
+
+	// expired keys are skipped and deleted
+	keys, err := ListRetiredSigningKeys(now)
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []*types.RetiredSigningKey{key})
+
+	_, err = GetRetiredSigningKey("expired")
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	c.Assert(DeleteRetiredSigningKey("key1"), IsNil)
+
+	// deleting it again is fine
+	c.Assert(DeleteRetiredSigningKey("key1"), IsNil)
+
+	keys, err = ListRetiredSigningKeys(now)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 0)
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains all tenant usage statistics APIs.
+//
+// Every proxy instance counts the requests it proxied and keeps its totals of
+// all tenants in `/auth_proxy/tenant_stats/<instance>`, which no other instance
+// writes; so instances sharing the data store don't overwrite each other's
+// counters. The statistics of a tenant are the sum over all instances.
+
+// ListTenantStats returns the usage statistics of all tenants, summed over all
+// proxy instances.
+// return values:
+//  []*types.TenantStats: slice of statistics; empty if there are none
+//  error: as returned by consecutive func calls
+func ListTenantStats() ([]*types.TenantStats, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []*types.TenantStats{}
+	rawData, err := stateDrv.ReadAll(GetPath(RootTenantStats))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return stats, nil
+		}
+
+		return nil, fmt.Errorf("Couldn't fetch tenant statistics from data store: %s", err.Error())
+	}
+
+	byTenant := map[string]*types.TenantStats{}
+	for _, data := range rawData {
+		instanceStats := []*types.TenantStats{}
+		if err := json.Unmarshal(data, &instanceStats); err != nil {
+			// the totals of a single tenant, as kept before per-instance statistics
+			legacy := &types.TenantStats{}
+			if json.Unmarshal(data, legacy) != nil {
+				return nil, err
+			}
+
+			instanceStats = append(instanceStats, legacy)
+		}
+
+		for _, s := range instanceStats {
+			total, found := byTenant[s.Tenant]
+			if !found {
+				total = &types.TenantStats{Tenant: s.Tenant}
+				byTenant[s.Tenant] = total
+				stats = append(stats, total)
+			}
+
+			addTenantStats(total, s)
+		}
+	}
+
+	return stats, nil
+}
+
+// AddTenantStats adds the given counters to the statistics which a proxy
+// instance keeps in `/auth_proxy/tenant_stats/<instance>`. Only the instance
+// itself may call it; the statistics are created if they don't exist.
+// params:
+//  instance: name of the proxy instance; unique among the instances sharing the data store
+//  deltas: counters to be added, one per tenant; delta.Tenant names the tenant
+// return values:
+//  error: as returned by consecutive func calls
+func AddTenantStats(instance string, deltas []*types.TenantStats) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	key := GetPath(RootTenantStats, instance)
+	stats := []*types.TenantStats{}
+
+	data, err := stateDrv.Read(key)
+	switch err {
+	case nil:
+		if err := json.Unmarshal(data, &stats); err != nil {
+			return err
+		}
+	case auth_errors.ErrKeyNotFound:
+	default:
+		return fmt.Errorf("Failed to read tenant statistics of instance %q from data store: %s", instance, err.Error())
+	}
+
+	byTenant := map[string]*types.TenantStats{}
+	for _, s := range stats {
+		byTenant[s.Tenant] = s
+	}
+
+	for _, delta := range deltas {
+		s, found := byTenant[delta.Tenant]
+		if !found {
+			s = &types.TenantStats{Tenant: delta.Tenant}
+			byTenant[delta.Tenant] = s
+			stats = append(stats, s)
+		}
+
+		addTenantStats(s, delta)
+	}
+
+	val, err := json.Marshal(stats)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal tenant statistics of instance %q: %#v", instance, err)
+	}
+
+	if err := stateDrv.Write(key, val); err != nil {
+		return fmt.Errorf("Failed to write tenant statistics of instance %q to data store: %s", instance, err.Error())
+	}
+
+	return nil
+}
+
+// addTenantStats adds the counters of `delta` to `total`
+func addTenantStats(total, delta *types.TenantStats) {
+	total.Requests += delta.Requests
+	total.Writes += delta.Writes
+	total.Denials += delta.Denials
+	total.Bytes += delta.Bytes
+}
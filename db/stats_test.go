@@ -0,0 +1,64 @@
+package db
+
+import (
+	"sort"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+
+	. "gopkg.in/check.v1"
+)
+
+// byTenant returns the given statistics by tenant name
+func byTenant(stats []*types.TenantStats) map[string]types.TenantStats {
+	result := map[string]types.TenantStats{}
+	for _, s := range stats {
+		result[s.Tenant] = *s
+	}
+
+	return result
+}
+
+// TestTenantStats tests `AddTenantStats(...)` and `ListTenantStats(...)`
+func (s *dbSuite) TestTenantStats(c *C) {
+	stats, err := ListTenantStats()
+	c.Assert(err, IsNil)
+	c.Assert(stats, DeepEquals, []*types.TenantStats{})
+
+	c.Assert(AddTenantStats("proxy1", []*types.TenantStats{{Tenant: "t1", Requests: 2, Writes: 1, Bytes: 100}}), IsNil)
+
+	stats, err = ListTenantStats()
+	c.Assert(err, IsNil)
+	c.Assert(stats, DeepEquals, []*types.TenantStats{{Tenant: "t1", Requests: 2, Writes: 1, Bytes: 100}})
+
+	// counters are added to the existing ones
+	c.Assert(AddTenantStats("proxy1", []*types.TenantStats{
+		{Tenant: "t1", Requests: 1, Denials: 3, Bytes: 10},
+		{Tenant: "t2", Denials: 1},
+	}), IsNil)
+
+	stats, err = ListTenantStats()
+	c.Assert(err, IsNil)
+	c.Assert(len(stats), Equals, 2)
+
+	tenants := []string{stats[0].Tenant, stats[1].Tenant}
+	sort.Strings(tenants)
+	c.Assert(tenants, DeepEquals, []string{"t1", "t2"})
+	c.Assert(byTenant(stats)["t1"], DeepEquals, types.TenantStats{Tenant: "t1", Requests: 3, Writes: 1, Denials: 3, Bytes: 110})
+
+	// other instances keep their own counters, which are summed up
+	c.Assert(AddTenantStats("proxy2", []*types.TenantStats{{Tenant: "t1", Requests: 5}, {Tenant: "t3", Requests: 1}}), IsNil)
+
+	// the totals of a tenant from before per-instance statistics are included
+	stateDrv, err := state.GetStateDriver()
+	c.Assert(err, IsNil)
+	c.Assert(stateDrv.Write(GetPath(RootTenantStats, "t3"), []byte(`{"tenant":"t3","requests":2,"bytes":20}`)), IsNil)
+
+	stats, err = ListTenantStats()
+	c.Assert(err, IsNil)
+	c.Assert(byTenant(stats), DeepEquals, map[string]types.TenantStats{
+		"t1": {Tenant: "t1", Requests: 8, Writes: 1, Denials: 3, Bytes: 110},
+		"t2": {Tenant: "t2", Denials: 1},
+		"t3": {Tenant: "t3", Requests: 3, Bytes: 20},
+	})
+}
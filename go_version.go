@@ -0,0 +1,9 @@
+//go:build !go1.17
+// +build !go1.17
+
+package main
+
+// The vendored golang.org/x/net/http2 needs Go 1.17 or newer; build with the
+// toolchain pinned in build/Dockerfile.build. This fails the build early on
+// older toolchains instead of somewhere deep in the vendor directory.
+var _ = authProxyRequiresGo117OrNewer
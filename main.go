@@ -1,15 +1,21 @@
 package main
 
 import (
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/blang/semver"
 	"github.com/contiv/auth_proxy/auth"
 	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/db"
 	"github.com/contiv/auth_proxy/proxy"
 	"github.com/contiv/auth_proxy/state"
 
@@ -23,12 +29,70 @@ const (
 
 var (
 	// flags
+	configFile       string // path to a JSON file with settings which can be reloaded
 	dataStoreAddress string // address of the data store used by netmaster
+	endpointPolicy   string // path to a JSON file with the initial endpoint policy rules
 	debug            bool   // if set, log level is set to `debug`
 	listenAddress    string // address we listen on
 	netmasterAddress string // address of the netmaster we proxy to
 	tlsKeyFile       string // path to TLS key
+	previousTLSKeys  string // comma-separated paths to TLS keys replaced by the current one
 	tlsCertificate   string // path to TLS certificate
+	trustedProxies   string // comma-separated CIDRs of proxies/load balancers in front of us
+	mgmtAllowedCIDRs string // comma-separated CIDRs allowed to access the management API
+	mgmtDeniedCIDRs  string // comma-separated CIDRs denied access to the management API
+	routesForAll     bool   // if set, all authenticated users can list the routes
+	http2Enabled     bool   // if set, HTTP/2 is offered to clients
+	netmasterH2C     bool   // if set, requests are sent to netmaster using HTTP/2 over cleartext
+	uiAssetsPath     string // directory containing the UI; not served if empty
+
+	dataStoreCAFile             string // PEM bundle of the CAs the data store's certificate is verified with
+	dataStoreCertFile           string // client certificate presented to the data store
+	dataStoreKeyFile            string // key of the client certificate presented to the data store
+	dataStoreInsecureSkipVerify bool   // if set, the data store's certificate isn't verified
+	consulToken                 string // ACL token used to access consul
+	consulDatacenter            string // consul datacenter the keys are kept in
+	consulAllowStaleReads       bool   // if set, consul reads may be answered by any server
+	dataStoreStartupTimeout     int64  // seconds to keep trying to reach the data store at startup
+
+	clientCertAuth     bool   // if set, clients can authenticate with a TLS certificate
+	clientCAFile       string // PEM bundle of the CAs whose client certificates are accepted
+	clientCertIdentity string // field of a client certificate naming its user: "cn", "dns" or "email"
+
+	k8sAPIServer         string // URL of the Kubernetes API server; ServiceAccount tokens are rejected if empty
+	k8sCAFile            string // path to the Kubernetes API server's CA certificate
+	k8sReviewerTokenFile string // path to the token used to call the Kubernetes TokenReview API
+
+	tokenIssuer   string // "iss" claim of our tokens; tokens from other issuers are rejected
+	tokenAudience string // "aud" claim of our tokens; not checked if empty
+
+	tokenSigningMethod  string // "HS256" (shared key) or "RS256" (RSA key pair)
+	tokenSigningKeyFile string // PEM file holding the RSA private key used with RS256
+
+	tokenTTL           string // validity of new tokens as a Go duration
+	tokenRefreshWindow int64  // last part (in percent) of a token's lifetime during which it can be refreshed
+
+	deletedUserRetention int64 // days for which deleted local users can be restored
+	loginAuditMaxAge     int64 // days for which login audit records are kept; 0 disables the limit
+	loginAuditMaxEntries int64 // maximum number of login audit records kept; 0 disables the limit
+	revocationCleanup    int64 // seconds between the cleanups of expired revocation records; 0 disables them
+	authzCacheTTL        int64 // seconds for which the principals' authorizations are cached; 0 disables the cache
+	passwordHashCost     int   // bcrypt cost of new password hashes
+	maxBodySize          int64 // maximum size of request bodies in bytes; 0 disables the limit
+
+	secretsBackend         string // backend the TLS key pair and token signing key are read from
+	vaultAddress           string // URL of the Vault server
+	vaultTLSCertPath       string // Vault path of the TLS certificate
+	vaultTLSKeyPath        string // Vault path of the TLS key
+	vaultSigningKeyPath    string // Vault path of the token signing key
+	secretsRefreshInterval int64  // seconds between re-fetches of the secrets; 0 disables them
+
+	leaderElection bool   // if set, only the elected leader performs the background duties
+	leaderLeaseTTL int64  // seconds after which another instance takes over if the leader goes away
+	instanceID     string // name of this instance in the leader election
+
+	checkOnly         bool // if set, the configuration is checked and we exit
+	checkConnectivity bool // if set along with checkOnly, the data store and netmaster are contacted too
 
 	// ProgramName is used in logging output and the X-Forwarded-By header.
 	ProgramName = "Auth Proxy"
@@ -41,6 +105,11 @@ var (
 	netmasterRequestTimeout int64
 	clientReadTimeout       int64
 	clientWriteTimeout      int64
+
+	// tuning of the connection pool to netmaster.  See proxy.Config for comments
+	maxIdleConnsPerHost int
+	idleConnTimeout     int64
+	tlsHandshakeTimeout int64
 )
 
 func processFlags() {
@@ -65,6 +134,27 @@ func processFlags() {
 		"time (in seconds) to allow for auth_proxy to send a response after receiving a request from a client",
 	)
 
+	flag.IntVar(
+		&maxIdleConnsPerHost,
+		"max-idle-conns-per-host",
+		proxy.DefaultNetmasterMaxIdleConnsPerHost,
+		"number of idle connections to netmaster kept open for reuse",
+	)
+
+	flag.Int64Var(
+		&idleConnTimeout,
+		"idle-conn-timeout",
+		proxy.DefaultNetmasterIdleConnTimeout,
+		"time (in seconds) an idle connection to netmaster is kept open",
+	)
+
+	flag.Int64Var(
+		&tlsHandshakeTimeout,
+		"tls-handshake-timeout",
+		proxy.DefaultNetmasterTLSHandshakeTimeout,
+		"time (in seconds) to allow for the TLS handshake with netmaster",
+	)
+
 	flag.StringVar(
 		&listenAddress,
 		"listen-address",
@@ -86,6 +176,13 @@ func processFlags() {
 		"path to TLS key",
 	)
 
+	flag.StringVar(
+		&previousTLSKeys,
+		"previous-tls-key-files",
+		"",
+		"comma-separated paths to TLS keys replaced by --tls-key-file; stored data encrypted with them can still be read until it's re-encrypted",
+	)
+
 	flag.StringVar(
 		&tlsCertificate,
 		"tls-certificate",
@@ -93,6 +190,251 @@ func processFlags() {
 		"path to TLS certificate",
 	)
 
+	flag.StringVar(
+		&trustedProxies,
+		"trusted-proxies",
+		"",
+		"comma-separated list of CIDRs whose X-Forwarded-For/X-Real-IP headers are trusted",
+	)
+
+	flag.StringVar(
+		&mgmtAllowedCIDRs,
+		"management-allowed-cidrs",
+		"",
+		"comma-separated list of CIDRs allowed to access /api/v1/auth_proxy/*; everyone if empty",
+	)
+
+	flag.StringVar(
+		&mgmtDeniedCIDRs,
+		"management-denied-cidrs",
+		"",
+		"comma-separated list of CIDRs denied access to /api/v1/auth_proxy/*; takes precedence over the allowed CIDRs",
+	)
+
+	flag.StringVar(
+		&uiAssetsPath,
+		"ui-assets-path",
+		proxy.DefaultUIAssetsPath,
+		"directory containing the UI which is served from /; the UI is not served if empty",
+	)
+
+	flag.StringVar(
+		&k8sAPIServer,
+		"kubernetes-api-server",
+		"",
+		"URL of the Kubernetes API server used to authenticate ServiceAccount tokens; they are rejected if empty",
+	)
+
+	flag.StringVar(
+		&k8sCAFile,
+		"kubernetes-ca-file",
+		"",
+		"path to the CA certificate of the Kubernetes API server",
+	)
+
+	flag.StringVar(
+		&k8sReviewerTokenFile,
+		"kubernetes-reviewer-token-file",
+		"",
+		"path to the token used to call the Kubernetes TokenReview API, e.g. /var/run/secrets/kubernetes.io/serviceaccount/token",
+	)
+
+	flag.StringVar(
+		&tokenIssuer,
+		"token-issuer",
+		"auth_proxy",
+		"issuer (\"iss\" claim) of the tokens we issue; tokens from other issuers are rejected",
+	)
+
+	flag.StringVar(
+		&tokenAudience,
+		"token-audience",
+		"",
+		"audience (\"aud\" claim) of the tokens we issue, e.g. the environment's name; tokens for other audiences are rejected unless empty",
+	)
+
+	flag.StringVar(
+		&tokenSigningMethod,
+		"token-signing-method",
+		common.TokenSigningHS256,
+		"how tokens are signed: \"HS256\" with a generated shared key, or \"RS256\" with --token-signing-key-file, so that others can verify them using the keys published at "+proxy.JWKSPath,
+	)
+
+	flag.StringVar(
+		&tokenSigningKeyFile,
+		"token-signing-key-file",
+		"",
+		"PEM file holding the RSA private key tokens are signed with if --token-signing-method is \"RS256\"",
+	)
+
+	flag.StringVar(
+		&tokenTTL,
+		"token-ttl",
+		"10h",
+		"validity of new tokens as a duration, e.g. \"30m\" for kiosks or \"24h\" for automation",
+	)
+
+	flag.Int64Var(
+		&tokenRefreshWindow,
+		"token-refresh-window",
+		20,
+		"last part (in percent) of a token's lifetime during which it can be exchanged for a new one; 0 disables refreshing tokens",
+	)
+
+	flag.Int64Var(
+		&deletedUserRetention,
+		"deleted-user-retention",
+		30,
+		"time (in days) for which deleted local users can be restored before they're permanently deleted; 0 keeps them until they're deleted with hard=true",
+	)
+
+	flag.Int64Var(
+		&loginAuditMaxAge,
+		"login-audit-max-age",
+		90,
+		"time (in days) for which login audit records are kept; 0 disables the limit",
+	)
+
+	flag.Int64Var(
+		&loginAuditMaxEntries,
+		"login-audit-max-entries",
+		100000,
+		"maximum number of login audit records kept, the oldest are pruned first; 0 disables the limit",
+	)
+
+	flag.Int64Var(
+		&revocationCleanup,
+		"revocation-cleanup-interval",
+		600,
+		"time (in seconds) between the scans deleting expired token revocation records; 0 disables them",
+	)
+
+	flag.Int64Var(
+		&authzCacheTTL,
+		"authz-cache-ttl",
+		5,
+		"time (in seconds) for which the principals' authorizations are cached; 0 disables the cache",
+	)
+
+	flag.IntVar(
+		&passwordHashCost,
+		"password-hash-cost",
+		common.DefaultPasswordHashCost,
+		"bcrypt cost of new password hashes; hashes with a lower cost are upgraded when their user logs in",
+	)
+
+	flag.StringVar(
+		&secretsBackend,
+		"secrets-backend",
+		"file",
+		"backend the TLS key pair and token signing key are read from: \"file\" or \"vault\"; Vault credentials are read from AUTH_PROXY_VAULT_TOKEN or AUTH_PROXY_VAULT_ROLE_ID and AUTH_PROXY_VAULT_SECRET_ID",
+	)
+
+	flag.StringVar(
+		&vaultAddress,
+		"vault-address",
+		"",
+		"URL of the Vault server, e.g. https://vault:8200",
+	)
+
+	flag.StringVar(
+		&vaultTLSCertPath,
+		"vault-tls-certificate-path",
+		"",
+		"Vault path of the TLS certificate, e.g. secret/auth_proxy#certificate; read from --tls-certificate if empty",
+	)
+
+	flag.StringVar(
+		&vaultTLSKeyPath,
+		"vault-tls-key-path",
+		"",
+		"Vault path of the TLS key, e.g. secret/auth_proxy#key; read from --tls-key-file if empty",
+	)
+
+	flag.StringVar(
+		&vaultSigningKeyPath,
+		"vault-signing-key-path",
+		"",
+		"Vault path of the token signing key, e.g. secret/auth_proxy#signing_key; generated and kept in the data store if empty",
+	)
+
+	flag.Int64Var(
+		&secretsRefreshInterval,
+		"secrets-refresh-interval",
+		0,
+		"time (in seconds) between re-fetches of the secrets so that rotated secrets are used without a restart; 0 disables re-fetching",
+	)
+
+	flag.Int64Var(
+		&maxBodySize,
+		"max-body-size",
+		0,
+		"maximum size (in bytes) of request bodies; larger requests are rejected with a 413. 0 disables the limit",
+	)
+
+	flag.BoolVar(
+		&routesForAll,
+		"routes-listing-for-all-users",
+		false,
+		"if set, all authenticated users can list the proxy's routes; otherwise only admins can",
+	)
+
+	flag.BoolVar(
+		&http2Enabled,
+		"http2-enabled",
+		true,
+		"if set, HTTP/2 is offered to clients during the TLS handshake; clients can always use HTTP/1.1",
+	)
+
+	flag.BoolVar(
+		&netmasterH2C,
+		"netmaster-h2c",
+		false,
+		"if set, requests are sent to netmaster using HTTP/2 over cleartext (h2c) with prior knowledge; netmaster must support it",
+	)
+
+	flag.BoolVar(
+		&clientCertAuth,
+		"client-cert-auth",
+		false,
+		"if set, clients can authenticate with a TLS certificate issued by a CA in --client-ca-file instead of a token; clients without one aren't affected",
+	)
+
+	flag.StringVar(
+		&clientCAFile,
+		"client-ca-file",
+		"",
+		"PEM bundle of the CAs whose client certificates are accepted if --client-cert-auth is set",
+	)
+
+	flag.StringVar(
+		&clientCertIdentity,
+		"client-cert-identity",
+		common.ClientCertIdentityCN,
+		"field of a client certificate naming the local or LDAP user it authenticates: \"cn\" (common name), or the first \"dns\" or \"email\" subject alternative name",
+	)
+
+	flag.BoolVar(
+		&leaderElection,
+		"leader-election",
+		false,
+		"if set, the instances sharing the data store elect a leader which alone adds the default users and runs the background sweepers",
+	)
+
+	flag.Int64Var(
+		&leaderLeaseTTL,
+		"leader-lease-ttl",
+		15,
+		"time (in seconds) after which another instance takes over if the leader goes away; consul doesn't accept less than 10",
+	)
+
+	flag.StringVar(
+		&instanceID,
+		"instance-id",
+		defaultInstanceID(),
+		"name of this instance in the leader election; it must be unique among the instances sharing the data store",
+	)
+
 	flag.BoolVar(
 		&debug,
 		"debug",
@@ -100,16 +442,173 @@ func processFlags() {
 		"if set, log level is set to debug",
 	)
 
+	flag.StringVar(
+		&configFile,
+		"config-file",
+		"",
+		"path to a JSON file with settings (e.g. log_level, netmaster_timeout) which are re-read on SIGHUP",
+	)
+
+	flag.StringVar(
+		&endpointPolicy,
+		"endpoint-policy-file",
+		"",
+		"path to a JSON file with the endpoint policy rules to seed the data store with on first start",
+	)
+
 	flag.StringVar(
 		&dataStoreAddress,
 		"data-store-address",
 		"",
-		"address of the state store used by netmaster",
+		"address of the state store used by netmaster, e.g. etcd://host:2379 (etcd v2 API), etcdv3://host:2379 (etcd v3 API) or consul://host:8500; append +https to the scheme to connect over TLS, e.g. etcd+https://host:2379; separate the endpoints of a cluster by commas, e.g. etcd://host1:2379,etcd://host2:2379",
+	)
+
+	flag.StringVar(
+		&dataStoreCAFile,
+		"data-store-ca-file",
+		"",
+		"PEM bundle of the CAs the certificate of an https data store is verified with; the system's CAs are used if empty",
+	)
+
+	flag.StringVar(
+		&dataStoreCertFile,
+		"data-store-cert-file",
+		"",
+		"PEM file of the client certificate presented to an https data store; requires --data-store-key-file",
+	)
+
+	flag.StringVar(
+		&dataStoreKeyFile,
+		"data-store-key-file",
+		"",
+		"PEM file of the key of the client certificate presented to an https data store",
+	)
+
+	flag.BoolVar(
+		&dataStoreInsecureSkipVerify,
+		"data-store-insecure-skip-verify",
+		false,
+		"if set, the certificate of an https data store isn't verified; only meant for labs",
+	)
+
+	flag.Int64Var(
+		&dataStoreStartupTimeout,
+		"data-store-startup-timeout",
+		60,
+		"time (in seconds) to keep trying to reach the data store at startup, e.g. while it's still starting up; 0 to give up right away",
+	)
+
+	flag.StringVar(
+		&consulToken,
+		"consul-token",
+		"",
+		"ACL token used to access consul if its ACLs are enabled; $CONSUL_HTTP_TOKEN is used if empty, which keeps the token out of the process list",
+	)
+
+	flag.StringVar(
+		&consulDatacenter,
+		"consul-datacenter",
+		"",
+		"consul datacenter the keys are kept in; the datacenter of the consul agent if empty",
+	)
+
+	flag.BoolVar(
+		&consulAllowStaleReads,
+		"consul-allow-stale-reads",
+		false,
+		"if set, consul reads (e.g. the authorization lookups of every request) may be answered by any consul server rather than the leader, which may be slightly out of date; writes stay consistent",
+	)
+
+	flag.BoolVar(
+		&checkOnly,
+		"check",
+		false,
+		"if set, the configuration is checked, all problems are reported and we exit with 0 if there are none or 1 otherwise",
+	)
+
+	flag.BoolVar(
+		&checkConnectivity,
+		"check-connectivity",
+		false,
+		"if set along with --check, the data store and netmaster are contacted as well",
 	)
 
 	flag.Parse()
 }
 
+// defaultInstanceID returns the name of this instance in the leader election
+// if none is given: the hostname and the pid, e.g. "proxy1-42"
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "auth_proxy"
+	}
+
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// newLeaderElector returns the elector picking the instance which adds the
+// default users and runs the background sweepers; nil if every instance does.
+func newLeaderElector() (*state.LeaderElector, error) {
+	if !leaderElection {
+		return nil, nil
+	}
+
+	drv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Leader election enabled, campaigning as %q", instanceID)
+
+	return state.NewLeaderElector(drv, db.GetPath(db.RootLeader), instanceID,
+		time.Duration(leaderLeaseTTL)*time.Second), nil
+}
+
+// clientCertificateAuthorities returns the CAs whose client certificates
+// authenticate requests; nil if client certificate authentication is disabled.
+func clientCertificateAuthorities() (*x509.CertPool, error) {
+	if !clientCertAuth {
+		return nil, nil
+	}
+
+	log.Infof("Client certificate authentication enabled, accepting certificates issued by the CAs in %q", clientCAFile)
+
+	return common.ReadCertPool(clientCAFile)
+}
+
+// seedDataStore adds the built-in users and the initial endpoint policy
+// unless they exist already.
+func seedDataStore() error {
+	log.Println("Adding default users with default passwords")
+	if err := auth.AddDefaultUsers(); err != nil {
+		return err
+	}
+
+	return auth.SeedEndpointPolicy(endpointPolicy)
+}
+
+// checkLdapEncryption logs whether the stored LDAP service account password is
+// still encrypted with one of the previous TLS keys, or with none of the keys.
+func checkLdapEncryption() {
+	ldapConfiguration, err := db.GetLdapConfiguration()
+	if err != nil {
+		if err != auth_errors.ErrKeyNotFound {
+			log.Warnln("Failed to read the LDAP configuration:", err)
+		}
+
+		return
+	}
+
+	outdated, err := common.EncryptionOutdated(ldapConfiguration.ServiceAccountPassword)
+	switch {
+	case err != nil:
+		log.Errorln("The LDAP service account password can't be decrypted with the TLS key or any of --previous-tls-key-files")
+	case outdated:
+		log.Warnf("The LDAP service account password is encrypted with a previous TLS key; POST %s to re-encrypt it with the current one", proxy.LdapConfigurationReencryptPath)
+	}
+}
+
 // We perform two checks here:
 //   1. that the version of the netmaster we're pointed at is a compatible version,
 //      i.e., its major version is the same and the minor version of netmaster is
@@ -191,6 +690,167 @@ func netmasterStartupCheck() error {
 	return nil
 }
 
+// flagSettings returns the settings set from flags; they're the starting point
+// for every reload of the settings
+func flagSettings() map[string]string {
+	logLevel := log.InfoLevel
+	if debug {
+		logLevel = log.DebugLevel
+	}
+
+	return map[string]string{
+		common.AuthzCacheTTLKey:                strconv.FormatInt(authzCacheTTL, 10),
+		common.ConfigFileKey:                   configFile,
+		common.ConsulAllowStaleReadsKey:        strconv.FormatBool(consulAllowStaleReads),
+		common.ConsulDatacenterKey:             consulDatacenter,
+		common.DataStoreAddressKey:             dataStoreAddress,
+		common.DataStoreCAFileKey:              dataStoreCAFile,
+		common.DataStoreCertFileKey:            dataStoreCertFile,
+		common.DataStoreKeyFileKey:             dataStoreKeyFile,
+		common.DataStoreStartupTimeoutKey:      strconv.FormatInt(dataStoreStartupTimeout, 10),
+		common.DataStoreInsecureSkipVerifyKey:  strconv.FormatBool(dataStoreInsecureSkipVerify),
+		common.DeletedUserRetentionKey:         strconv.FormatInt(deletedUserRetention, 10),
+		common.KubernetesAPIServerKey:          k8sAPIServer,
+		common.KubernetesCAFileKey:             k8sCAFile,
+		common.KubernetesReviewerTokenFileKey:  k8sReviewerTokenFile,
+		common.ListenAddressKey:                listenAddress,
+		common.LogLevelKey:                     logLevel.String(),
+		common.LoginAuditMaxAgeKey:             strconv.FormatInt(loginAuditMaxAge, 10),
+		common.LoginAuditMaxEntriesKey:         strconv.FormatInt(loginAuditMaxEntries, 10),
+		common.MaxBodySizeKey:                  strconv.FormatInt(maxBodySize, 10),
+		common.RevocationCleanupIntervalKey:    strconv.FormatInt(revocationCleanup, 10),
+		common.ManagementAllowedCIDRsKey:       mgmtAllowedCIDRs,
+		common.ManagementDeniedCIDRsKey:        mgmtDeniedCIDRs,
+		common.NetmasterAddressKey:             netmasterAddress,
+		common.NetmasterTimeoutKey:             strconv.FormatInt(netmasterRequestTimeout, 10),
+		common.PasswordHashCostKey:             strconv.Itoa(passwordHashCost),
+		common.ClientReadTimeoutKey:            strconv.FormatInt(clientReadTimeout, 10),
+		common.ClientWriteTimeoutKey:           strconv.FormatInt(clientWriteTimeout, 10),
+		common.NetmasterMaxIdleConnsPerHostKey: strconv.Itoa(maxIdleConnsPerHost),
+		common.NetmasterIdleConnTimeoutKey:     strconv.FormatInt(idleConnTimeout, 10),
+		common.NetmasterTLSHandshakeTimeoutKey: strconv.FormatInt(tlsHandshakeTimeout, 10),
+		common.PreviousTLSKeyFilesKey:          previousTLSKeys,
+		common.ClientCAFileKey:                 clientCAFile,
+		common.ClientCertAuthKey:               strconv.FormatBool(clientCertAuth),
+		common.ClientCertIdentityKey:           clientCertIdentity,
+		common.HTTP2EnabledKey:                 strconv.FormatBool(http2Enabled),
+		common.NetmasterH2CKey:                 strconv.FormatBool(netmasterH2C),
+		common.InstanceIDKey:                   instanceID,
+		common.LeaderElectionKey:               strconv.FormatBool(leaderElection),
+		common.LeaderLeaseTTLKey:               strconv.FormatInt(leaderLeaseTTL, 10),
+		common.SecretsBackendKey:               secretsBackend,
+		common.SecretsRefreshIntervalKey:       strconv.FormatInt(secretsRefreshInterval, 10),
+		common.TLSCertificateKey:               tlsCertificate,
+		common.TLSKeyFileKey:                   tlsKeyFile,
+		common.TokenAudienceKey:                tokenAudience,
+		common.TokenIssuerKey:                  tokenIssuer,
+		common.TokenRefreshWindowKey:           strconv.FormatInt(tokenRefreshWindow, 10),
+		common.TokenSigningKeyFileKey:          tokenSigningKeyFile,
+		common.TokenSigningMethodKey:           tokenSigningMethod,
+		common.TokenTTLKey:                     tokenTTL,
+		common.TrustedProxiesKey:               trustedProxies,
+		common.UIAssetsPathKey:                 uiAssetsPath,
+		common.VaultAddressKey:                 vaultAddress,
+		common.VaultSigningKeyPathKey:          vaultSigningKeyPath,
+		common.VaultTLSCertificatePathKey:      vaultTLSCertPath,
+		common.VaultTLSKeyPathKey:              vaultTLSKeyPath,
+	}
+}
+
+// checkConfiguration logs all the problems with the configuration we were
+// started with.  The data store and netmaster are only contacted if
+// --check-connectivity is set, as they're checked anyway during startup.
+// params:
+//  settings: settings set from flags
+// return values:
+//  bool: true if there are no problems
+func checkConfiguration(settings map[string]string) bool {
+	problems := common.CheckConfiguration(settings)
+
+	if !common.IsEmpty(endpointPolicy) {
+		if err := common.CheckReadable("endpoint policy file", endpointPolicy, false); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	if checkOnly && checkConnectivity {
+		problems = append(problems, connectivityProblems()...)
+	}
+
+	for _, problem := range problems {
+		log.Errorln("Invalid configuration:", problem)
+	}
+
+	return len(problems) == 0
+}
+
+// dataStoreOptions returns how to connect to the data store
+// params:
+//  startupTimeout: how long to keep trying to reach the data store; 0 to try once
+// return values:
+//  *state.DriverOptions: the options
+func dataStoreOptions(startupTimeout time.Duration) *state.DriverOptions {
+	return &state.DriverOptions{
+		TLS: &common.DataStoreTLSOptions{
+			CAFile:             dataStoreCAFile,
+			CertFile:           dataStoreCertFile,
+			KeyFile:            dataStoreKeyFile,
+			InsecureSkipVerify: dataStoreInsecureSkipVerify,
+		},
+		ConsulToken:           consulToken,
+		ConsulDatacenter:      consulDatacenter,
+		ConsulAllowStaleReads: consulAllowStaleReads,
+		StartupTimeout:        startupTimeout,
+	}
+}
+
+// connectivityProblems contacts the data store and netmaster and returns the
+// problems found, including invalid settings stored in the data store
+func connectivityProblems() []error {
+	problems := []error{}
+
+	if err := state.InitializeStateDriver(dataStoreAddress, dataStoreOptions(0)); err != nil {
+		problems = append(problems, err)
+	} else if stored, err := db.GetSettings(); err != nil {
+		problems = append(problems, err)
+	} else if err := common.ValidateSettings(stored); err != nil {
+		problems = append(problems, fmt.Errorf("invalid settings in the data store: %s", err.Error()))
+	}
+
+	if err := netmasterStartupCheck(); err != nil {
+		problems = append(problems, err)
+	}
+
+	return problems
+}
+
+// reloadOnSIGHUP reloads the global settings every time we receive a SIGHUP.
+func reloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		log.Info("Received SIGHUP, reloading settings")
+
+		if _, err := common.ReloadSettings(); err != nil {
+			log.Errorln("Failed to reload settings, keeping the current ones:", err)
+		}
+	}
+}
+
+// stopOnSignal stops the proxy when we're asked to terminate so that it can
+// persist its state (e.g. the tenant statistics) before we exit.
+func stopOnSignal(p *proxy.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	sig := <-signals
+	log.Infof("Received %s, shutting down", sig)
+
+	p.Stop()
+	os.Exit(0)
+}
+
 func main() {
 
 	// prevent this process from being swapped out to disk
@@ -210,42 +870,115 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	// Initialize data store
-	if err := state.InitializeStateDriver(dataStoreAddress); err != nil {
+	settings := flagSettings()
+
+	valid := checkConfiguration(settings)
+	if checkOnly {
+		if !valid {
+			os.Exit(1)
+		}
+
+		log.Info("Configuration is valid")
+		os.Exit(0)
+	}
+
+	if !valid {
+		log.Fatalln("Refusing to start with an invalid configuration")
+		return
+	}
+
+	// Initialize data store; it may still be starting up, e.g. if it's in a
+	// container started along with ours
+	if err := state.InitializeStateDriver(dataStoreAddress, dataStoreOptions(time.Duration(dataStoreStartupTimeout)*time.Second)); err != nil {
 		log.Fatalln(err)
 		return
 	}
 
-	// Add built-in users
-	log.Println("Adding default users with default passwords")
-	if err := auth.AddDefaultUsers(); err != nil {
+	elector, err := newLeaderElector()
+	if err != nil {
 		log.Fatalln(err)
 		return
 	}
 
+	// with leader election, followers leave seeding the data store to the
+	// leader and only do it once they take over
+	if elector == nil || elector.Campaign() {
+		if err := seedDataStore(); err != nil {
+			log.Fatalln(err)
+			return
+		}
+	}
+
+	if elector != nil {
+		elector.OnElected(func() {
+			if err := seedDataStore(); err != nil {
+				log.Errorln("Failed to seed the data store:", err)
+			}
+		})
+	}
+
 	if err := netmasterStartupCheck(); err != nil {
 		log.Fatalln(err)
 		return
 	}
 
-	if err := common.Global().Set("tls_key_file", tlsKeyFile); err != nil {
-		log.Fatalln(err)
+	for key, value := range settings {
+		if err := common.Global().Set(key, value); err != nil {
+			log.Fatalln(err)
+			return
+		}
+	}
+
+	// globals stored in the data store override everything else
+	common.RegisterSettingsSource(db.GetSettings)
+
+	if _, err := common.ReloadSettings(); err != nil {
+		log.Fatalln("Failed to load settings:", err)
 		return
 	}
 
+	if err := common.InitSecrets(common.Global()); err != nil {
+		log.Fatalln("Failed to read secrets:", err)
+		return
+	}
+
+	if err := auth.InitTokenSigning(); err != nil {
+		log.Fatalln("Failed to initialize token signing:", err)
+		return
+	}
+
+	checkLdapEncryption()
+
+	clientCAs, err := clientCertificateAuthorities()
+	if err != nil {
+		log.Fatalln("Failed to read the client CA file:", err)
+		return
+	}
+
+	go reloadOnSIGHUP()
+
 	p := proxy.NewServer(&proxy.Config{
-		Name:                    ProgramName,
-		Version:                 ProgramVersion,
-		NetmasterAddress:        netmasterAddress,
-		ListenAddress:           listenAddress,
-		TLSCertificate:          tlsCertificate,
-		TLSKeyFile:              tlsKeyFile,
-		NetmasterRequestTimeout: netmasterRequestTimeout,
-		ClientReadTimeout:       clientReadTimeout,
-		ClientWriteTimeout:      clientWriteTimeout,
+		Name:                     ProgramName,
+		Version:                  ProgramVersion,
+		NetmasterAddress:         netmasterAddress,
+		ListenAddress:            listenAddress,
+		NetmasterRequestTimeout:  netmasterRequestTimeout,
+		ClientReadTimeout:        clientReadTimeout,
+		ClientWriteTimeout:       clientWriteTimeout,
+		UIAssetsPath:             uiAssetsPath,
+		RoutesListingForAllUsers: routesForAll,
+
+		NetmasterMaxIdleConnsPerHost: maxIdleConnsPerHost,
+		NetmasterIdleConnTimeout:     idleConnTimeout,
+		NetmasterTLSHandshakeTimeout: tlsHandshakeTimeout,
+		HTTP2Enabled:                 http2Enabled,
+		NetmasterH2C:                 netmasterH2C,
+		Leader:                       elector,
+		ClientCAs:                    clientCAs,
 	})
 
 	go p.Serve()
+	go stopOnSignal(p)
 
 	runtime.Goexit()
 }
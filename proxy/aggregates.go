@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/contiv/auth_proxy/auth"
+)
+
+// aggregateData describes a netmaster inspect endpoint whose oper state
+// summarizes the objects of all tenants.
+type aggregateData struct {
+	entries string               // netmaster resource listing the summarized objects, e.g. "networks"
+	filter  auth.AggregateFilter // recomputes the summary from the caller's objects
+}
+
+var (
+	// aggregates map containing the aggregated inspect endpoints by resource
+	aggregates = map[string]aggregateData{
+		"globals": {entries: "networks", filter: auth.FilterGlobalInspect},
+		"aciGws":  {entries: "appProfiles", filter: auth.FilterAciGwInspect},
+	}
+
+	// unfilterableResponses counts the netmaster responses which were denied
+	// because they couldn't be filtered; accessed using sync/atomic
+	unfilterableResponses uint64
+)
+
+// aggregateFor returns the aggregated inspect endpoint the request is for.
+// params:
+//  req: http request object
+//  resource: resource obtained from the http endpoint. e.g. globals
+// return values:
+//  aggregateData: details of the endpoint
+//  bool: true if the request is for an aggregated inspect endpoint
+func aggregateFor(req *http.Request, resource string) (aggregateData, bool) {
+	if req.Method != "GET" || !strings.HasPrefix(req.URL.Path, "/api/v1/inspect/") {
+		return aggregateData{}, false
+	}
+
+	data, found := aggregates[resource]
+	return data, found
+}
+
+// proxyAggregate proxies a request for an aggregated inspect endpoint and
+// filters its response for the tenants the user is authorized for.
+// params:
+//  s:      proxy server object
+//  req:    http request object
+//  w:      http response writer
+//  token:  user token; carries the embebbed authZs of the user
+//  data:   details of the endpoint
+//  errors are written using http response writer
+func proxyAggregate(s *Server, req *http.Request, w http.ResponseWriter, token *auth.Token, data aggregateData) {
+	endpoint := "http://" + s.config.NetmasterAddress + "/api/v1/" + data.entries + "/"
+
+	entries := getResourceDetails(s, req, w, endpoint, data.entries)
+	if entries == nil {
+		return
+	}
+
+	proxyFilteredRequest(s, req, w, token, func(t *auth.Token, body []byte) ([]byte, error) {
+		return data.filter(t, body, entries)
+	}, "")
+}
+
+// unfilterableResponseCount returns the number of responses denied because they couldn't be filtered
+func unfilterableResponseCount() uint64 {
+	return atomic.LoadUint64(&unfilterableResponses)
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/auth"
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains the filters of the authorizations list, which also select
+// the authorizations deleted by deleteAuthorizations(). They're applied to the
+// authorizations read from the data store in one go, so filtering doesn't cost
+// any extra reads. The list can also be sorted and paginated.
+
+const (
+	// maxAuthzPageSize caps the `limit` of a page of the authorizations list
+	maxAuthzPageSize = 1000
+
+	// totalCountHeader carries the number of authorizations matching the
+	// filters, of which a page is returned
+	totalCountHeader = "X-Total-Count"
+)
+
+// orders accepted by the `sort` parameter of the authorizations list
+const (
+	// sortCreatedAt: oldest first; authorizations of unknown age come first
+	sortCreatedAt = "created_at"
+
+	// sortCreatedAtDesc: newest first
+	sortCreatedAtDesc = "-created_at"
+)
+
+// principal types accepted by the `principal_type` filter
+const (
+	// principalTypeLocal: local users
+	principalTypeLocal = "local"
+
+	// principalTypeLDAP: LDAP users and groups
+	principalTypeLDAP = "ldap"
+)
+
+// authzListFilter selects the authorizations returned by listAuthorizations();
+// all the given filters have to match, empty ones match any authorization.
+type authzListFilter struct {
+	principalName string // principal of the authorization; compared like usernames
+	principalType string // principalTypeLocal or principalTypeLDAP
+	tenant        string // tenant of the authorization; role authorizations have none
+	expired       string // "true" or "false"
+	sort          string // order of the list; sortCreatedAt, sortCreatedAtDesc or empty for the store's
+	limit         int    // size of the page to return; 0 if the list isn't paginated
+	offset        int    // index of the first authorization of the page
+}
+
+// parseAuthzListFilter parses the query parameters of the authorizations list.
+// params:
+//  query: query parameters of the request
+// return values:
+//  *authzListFilter: the filter to apply
+//  error: if a parameter is unknown or has an invalid value
+func parseAuthzListFilter(query url.Values) (*authzListFilter, error) {
+	for key := range query {
+		switch key {
+		case "principal_name", "principal_type", "tenant", "expired", "sort":
+		case "limit", "offset":
+			if n, err := strconv.Atoi(query.Get(key)); err != nil || n < 0 || key == "limit" && n == 0 {
+				return nil, fmt.Errorf("%s must be a positive number", key)
+			}
+		default:
+			return nil, fmt.Errorf("unknown query parameter %q", key)
+		}
+	}
+
+	filter := &authzListFilter{
+		principalName: query.Get("principal_name"),
+		principalType: query.Get("principal_type"),
+		tenant:        query.Get("tenant"),
+		expired:       query.Get("expired"),
+		sort:          query.Get("sort"),
+	}
+
+	// pages are at most maxAuthzPageSize long, also if only an offset is given
+	filter.offset, _ = strconv.Atoi(query.Get("offset"))
+	filter.limit, _ = strconv.Atoi(query.Get("limit"))
+	if _, found := query["offset"]; found && filter.limit == 0 || filter.limit > maxAuthzPageSize {
+		filter.limit = maxAuthzPageSize
+	}
+
+	switch filter.principalType {
+	case "", principalTypeLocal, principalTypeLDAP:
+	default:
+		return nil, fmt.Errorf("principal_type must be %q or %q", principalTypeLocal, principalTypeLDAP)
+	}
+
+	switch filter.sort {
+	case "", sortCreatedAt, sortCreatedAtDesc:
+	default:
+		return nil, fmt.Errorf("sort must be %q or %q", sortCreatedAt, sortCreatedAtDesc)
+	}
+
+	return filter, nil
+}
+
+// matches returns true if the authorization passes all the filters
+func (f *authzListFilter) matches(authz GetAuthorizationReply) bool {
+	switch {
+	case !common.IsEmpty(f.principalName) && !common.SamePrincipal(f.principalName, authz.PrincipalName):
+		return false
+	case f.principalType == principalTypeLocal && !authz.Local, f.principalType == principalTypeLDAP && authz.Local:
+		return false
+	case !common.IsEmpty(f.tenant) && f.tenant != authz.TenantName:
+		return false
+	case !common.IsEmpty(f.expired) && strconv.FormatBool(authz.Expired) != f.expired:
+		return false
+	default:
+		return true
+	}
+}
+
+// byCreatedAt sorts authorizations by creation time, oldest first
+type byCreatedAt []GetAuthorizationReply
+
+func (a byCreatedAt) Len() int           { return len(a) }
+func (a byCreatedAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byCreatedAt) Less(i, j int) bool { return a[i].CreatedAt < a[j].CreatedAt }
+
+// byUUID sorts authorizations by UUID, which gives pages a stable order
+type byUUID []GetAuthorizationReply
+
+func (a byUUID) Len() int           { return len(a) }
+func (a byUUID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byUUID) Less(i, j int) bool { return a[i].AuthzUUID < a[j].AuthzUUID }
+
+// wildcardsFirst sorts wildcard authorizations (see types.AllTenants) before the others
+type wildcardsFirst []GetAuthorizationReply
+
+func (a wildcardsFirst) Len() int           { return len(a) }
+func (a wildcardsFirst) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a wildcardsFirst) Less(i, j int) bool { return a[i].AllTenants && !a[j].AllTenants }
+
+// paginated returns true if only a page of the list is requested
+func (f *authzListFilter) paginated() bool {
+	return f.limit > 0
+}
+
+// order sorts the listed authorizations as requested. Wildcard authorizations
+// come first, unless the list is sorted by creation time; authorizations
+// created at the same time keep their order. Paginated lists are sorted by
+// UUID first, since the data store doesn't guarantee any order.
+func (f *authzListFilter) order(authzs []GetAuthorizationReply) {
+	if f.paginated() {
+		sort.Sort(byUUID(authzs))
+	}
+
+	switch f.sort {
+	case sortCreatedAt:
+		sort.Stable(byCreatedAt(authzs))
+	case sortCreatedAtDesc:
+		sort.Stable(sort.Reverse(byCreatedAt(authzs)))
+	default:
+		sort.Stable(wildcardsFirst(authzs))
+	}
+}
+
+// page returns the requested page of the sorted authorizations; it's empty if
+// the offset is beyond the end of the list.
+func (f *authzListFilter) page(authzs []GetAuthorizationReply) []GetAuthorizationReply {
+	if !f.paginated() {
+		return authzs
+	}
+
+	if f.offset >= len(authzs) {
+		return []GetAuthorizationReply{}
+	}
+
+	end := f.offset + f.limit
+	if end > len(authzs) {
+		end = len(authzs)
+	}
+
+	return authzs[f.offset:end]
+}
+
+// deleteAuthorizationsHelper helper function to delete all the authorizations
+// selected by a filter; the built-in admin user's authorizations are kept.
+// Nothing is deleted if that would remove the last admin.
+// params:
+//  filter: selects the authorizations to delete; must name a principal
+// return values:
+//  int: http status code; http.StatusConflict if the last admin would be removed
+//  []byte: http response message; this goes along with status code
+//          on success, it contains the `DeleteAuthorizationsReply` object
+func deleteAuthorizationsHelper(filter *authzListFilter) (int, []byte) {
+	if common.IsEmpty(filter.principalName) {
+		return http.StatusBadRequest, []byte("principal_name is required")
+	}
+
+	if filter.paginated() {
+		return http.StatusBadRequest, []byte("limit and offset can't be used when deleting")
+	}
+
+	authzList, err := auth.ListAuthorizations()
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	selected := func(authz types.Authorization) bool {
+		return !authz.BelongsToBuiltInAdmin() && filter.matches(convertAuthz(authz))
+	}
+
+	reply := &DeleteAuthorizationsReply{AuthzUUIDs: []string{}}
+	err = auth.GuardLastAdmin(selected, func() error {
+		for _, authz := range authzList {
+			if !selected(authz) {
+				continue
+			}
+
+			switch err := auth.DeleteAuthorization(authz.UUID); err {
+			case nil:
+				reply.AuthzUUIDs = append(reply.AuthzUUIDs, authz.UUID)
+			case auth_errors.ErrKeyNotFound:
+				// it expired and was swept in the meantime
+			default:
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	switch {
+	case err == auth_errors.ErrLastAdmin:
+		return http.StatusConflict, []byte(fmt.Sprintf("Cannot delete the authorizations of %q, the last admin", filter.principalName))
+	case err == auth_errors.ErrConcurrentUpdate && len(reply.AuthzUUIDs) == 0: // from auth.GuardLastAdmin()
+		return http.StatusConflict, []byte(fmt.Sprintf("Another proxy is removing an admin; retry deleting the authorizations of %q", filter.principalName))
+	case err != nil:
+		log.Warnf("audit: deleted %d authorizations of %q before failing: %s", len(reply.AuthzUUIDs), filter.principalName, err)
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	reply.Count = len(reply.AuthzUUIDs)
+	log.Infof("audit: deleted %d authorizations of %q", reply.Count, filter.principalName)
+
+	jsonReply, err := json.Marshal(reply)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jsonReply
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestAuthzListFilter tests parsing and applying the filters of the authorizations list
+func TestAuthzListFilter(t *testing.T) {
+	for _, invalid := range []string{"principal=alice", "tenant=t1&foo=bar", "principal_type=group",
+		"limit=0", "limit=ten", "offset=-1"} {
+		query, _ := url.ParseQuery(invalid)
+		if _, err := parseAuthzListFilter(query); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+
+	authzs := []GetAuthorizationReply{
+		{AuthzUUID: "1", PrincipalName: "alice", Local: true, Role: "ops", TenantName: "t1"},
+		{AuthzUUID: "2", PrincipalName: "alice", Local: true, Role: "ops"},
+		{AuthzUUID: "3", PrincipalName: "CN=ops,DC=example,DC=com", Role: "ops", TenantName: "t1", Expired: true},
+		{AuthzUUID: "4", PrincipalName: "bob", Local: true, Role: "guest", TenantName: "t2"},
+	}
+
+	testCases := []struct {
+		query    string
+		expected string
+	}{
+		{"", "1234"},
+		{"principal_name=alice", "12"},
+		{"principal_type=local", "124"},
+		{"principal_type=ldap", "3"},
+		{"tenant=t1", "13"},
+		{"tenant=t1&principal_type=local", "1"},
+		{"tenant=t1&expired=true", "3"},
+		{"principal_name=bob&tenant=t1", ""},
+		{"tenant=t3", ""},
+	}
+
+	for _, tc := range testCases {
+		query, _ := url.ParseQuery(tc.query)
+		filter, err := parseAuthzListFilter(query)
+		if err != nil {
+			t.Fatalf("%q: unexpected error %v", tc.query, err)
+		}
+
+		matched := ""
+		for _, authz := range authzs {
+			if filter.matches(authz) {
+				matched += authz.AuthzUUID
+			}
+		}
+
+		if matched != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.query, tc.expected, matched)
+		}
+	}
+}
+
+// TestDeleteAuthorizationsRequiresPrincipal tests that deleting authorizations
+// without naming a principal is refused before the datastore is touched
+func TestDeleteAuthorizationsRequiresPrincipal(t *testing.T) {
+	for _, query := range []string{"", "principal_type=ldap", "tenant=t1"} {
+		values, _ := url.ParseQuery(query)
+		filter, err := parseAuthzListFilter(values)
+		if err != nil {
+			t.Fatalf("%q: unexpected error %v", query, err)
+		}
+
+		if status, _ := deleteAuthorizationsHelper(filter); status != http.StatusBadRequest {
+			t.Errorf("%q: expected %d, got %d", query, http.StatusBadRequest, status)
+		}
+	}
+}
+
+// TestAuthzListOrder tests sorting the authorizations list by creation time;
+// authorizations stored before it was recorded come first
+func TestAuthzListOrder(t *testing.T) {
+	legacy := types.Authorization{}
+	if err := json.Unmarshal([]byte(`{"uuid":"1","principalName":"alice","local":true,"claimKey":"tenant:t1","claimValue":"ops"}`), &legacy); err != nil {
+		t.Fatalf("failed to unmarshal a legacy authorization: %v", err)
+	}
+
+	authzs := []GetAuthorizationReply{
+		{AuthzUUID: "2", CreatedAt: 200, GrantedBy: "admin"},
+		convertAuthz(legacy),
+		{AuthzUUID: "3", CreatedAt: 100, GrantedBy: "admin"},
+		{AuthzUUID: "4", CreatedAt: 200, GrantedBy: "admin"},
+	}
+
+	testCases := []struct {
+		sort     string
+		expected string
+	}{
+		{"", "2134"},
+		{"created_at", "1324"},
+		{"-created_at", "2431"},
+	}
+
+	for _, tc := range testCases {
+		filter, err := parseAuthzListFilter(url.Values{"sort": {tc.sort}})
+		if err != nil {
+			t.Fatalf("%q: unexpected error %v", tc.sort, err)
+		}
+
+		sorted := append([]GetAuthorizationReply{}, authzs...)
+		filter.order(sorted)
+
+		order := ""
+		for _, authz := range sorted {
+			order += authz.AuthzUUID
+		}
+
+		if order != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.sort, tc.expected, order)
+		}
+	}
+
+	if _, err := parseAuthzListFilter(url.Values{"sort": {"principal_name"}}); err == nil {
+		t.Errorf("expected an error for sorting by principal_name")
+	}
+}
+
+// TestAuthzListPage tests paginating the authorizations list
+func TestAuthzListPage(t *testing.T) {
+	authzs := []GetAuthorizationReply{{AuthzUUID: "c"}, {AuthzUUID: "a"}, {AuthzUUID: "d", AllTenants: true}, {AuthzUUID: "b"}}
+
+	testCases := []struct {
+		query    string
+		limit    int
+		expected string
+	}{
+		{"", 0, "dcab"},
+		{"limit=2", 2, "da"},
+		{"limit=2&offset=2", 2, "bc"},
+		{"limit=10&offset=3", 10, "c"},
+		{"limit=2&offset=4", 2, ""},
+		{"offset=1", maxAuthzPageSize, "abc"},
+		{"limit=100000", maxAuthzPageSize, "dabc"},
+	}
+
+	for _, tc := range testCases {
+		query, _ := url.ParseQuery(tc.query)
+		filter, err := parseAuthzListFilter(query)
+		if err != nil {
+			t.Fatalf("%q: unexpected error %v", tc.query, err)
+		}
+
+		if filter.limit != tc.limit {
+			t.Errorf("%q: expected a limit of %d, got %d", tc.query, tc.limit, filter.limit)
+		}
+
+		sorted := append([]GetAuthorizationReply{}, authzs...)
+		filter.order(sorted)
+
+		page := ""
+		for _, authz := range filter.page(sorted) {
+			page += authz.AuthzUUID
+		}
+
+		if page != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.query, tc.expected, page)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package proxy
+
+import "testing"
+
+// TestUpdatedAuthorizationRequest tests that updates only change the given fields
+func TestUpdatedAuthorizationRequest(t *testing.T) {
+	current := GetAuthorizationReply{AuthzUUID: "1", PrincipalName: "alice", Local: true, Role: "ops", TenantName: "t1", ExpiresAt: 42}
+	role, tenant, expiresAt := "guest", "t2", int64(0)
+
+	testCases := []struct {
+		update   UpdateAuthorizationRequest
+		expected AddAuthorizationRequest
+	}{
+		{UpdateAuthorizationRequest{Role: &role}, AddAuthorizationRequest{PrincipalName: "alice", Local: true, Role: "guest", TenantName: "t1"}},
+		{UpdateAuthorizationRequest{TenantName: &tenant}, AddAuthorizationRequest{PrincipalName: "alice", Local: true, Role: "ops", TenantName: "t2"}},
+		{UpdateAuthorizationRequest{Role: &role, TenantName: &tenant, ExpiresAt: &expiresAt},
+			AddAuthorizationRequest{PrincipalName: "alice", Local: true, Role: "guest", TenantName: "t2"}},
+	}
+
+	for _, tc := range testCases {
+		if addAuthzReq := updatedAuthorizationRequest(current, &tc.update); *addAuthzReq != tc.expected {
+			t.Errorf("expected %#v, got %#v", tc.expected, *addAuthzReq)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/auth"
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains HTTP Basic auth on the requests proxied to netmaster, for
+// CLI tools which can't log in and keep a token (see common.AllowBasicAuthKey).
+// Every such request is authenticated like a login, which is costly and
+// encourages clients to keep passwords around, so every use is logged.
+
+// basicAuthChallenge is sent in the WWW-Authenticate header when Basic auth fails
+const basicAuthChallenge = `Basic realm="auth_proxy"`
+
+// basicAuthRequests counts the requests authenticated using Basic auth; it's only
+// accessed using sync/atomic
+var basicAuthRequests uint64
+
+// basicAuthAllowed returns true if proxied requests can use Basic auth
+func basicAuthAllowed() bool {
+	value, err := common.Global().Get(common.AllowBasicAuthKey)
+	if err != nil {
+		return false
+	}
+
+	allowed, _ := strconv.ParseBool(value) // already validated
+	return allowed
+}
+
+// proxiedRequestToken authenticates a request to be proxied to netmaster: using
+// its token like validateToken(), or else using its Basic auth credentials if
+// they're allowed. It writes an error response if that fails.
+// params:
+//  w: response writer
+//  req: http request
+// return values:
+//  *auth.Token: token object of the request's user
+//  bool: false if the request couldn't be authenticated
+func proxiedRequestToken(w http.ResponseWriter, req *http.Request) (*auth.Token, bool) {
+	username, password, hasCredentials := req.BasicAuth()
+	if _, found, _ := tokenFromHeaders(req.Header); found || !hasCredentials || !basicAuthAllowed() {
+		return validateToken(w, req)
+	}
+
+	return basicAuthToken(w, req, username, password)
+}
+
+// basicAuthToken authenticates the given credentials the same way as
+// loginHandler() and returns a token for this request only. Failures are
+// recorded in the login audit trail. The credentials are removed from the
+// request, so that they're not forwarded to netmaster.
+// params:
+//  w: response writer
+//  req: http request carrying the credentials
+//  username: local or AD username
+//  password: password of the user
+// return values:
+//  *auth.Token: token object of the user
+//  bool: false if the user couldn't be authenticated
+func basicAuthToken(w http.ResponseWriter, req *http.Request, username, password string) (*auth.Token, bool) {
+	req.Header.Del("Authorization")
+
+	// users with MFA enabled can't send a one-time password, so they're rejected
+	tokenStr, loginInfo, err := auth.Authenticate(username, password, "")
+	if err != nil {
+		auditLogin(req, username, loginFailureReason(err), false)
+		log.Errorf("Basic auth of user %q from %s failed: %s", username, common.RealIP(req), err)
+
+		if err == auth_errors.ErrLDAPConnectionFailed {
+			authError(w, http.StatusBadGateway, types.ErrorCodeDirectoryUnavailable, directoryUnavailable())
+			return nil, false
+		}
+
+		if err == auth_errors.ErrUserDisabled {
+			authError(w, http.StatusForbidden, types.ErrorCodeUserDisabled, "User account disabled")
+			return nil, false
+		}
+
+		w.Header().Set("WWW-Authenticate", basicAuthChallenge)
+		authError(w, http.StatusUnauthorized, types.ErrorCodeInvalidCredentials, "Invalid username/password")
+		return nil, false
+	}
+
+	if loginInfo.PasswordChange {
+		authError(w, http.StatusForbidden, types.ErrorCodePasswordChangeRequired, errPasswordChangeRequired.Error())
+		return nil, false
+	}
+
+	token, err := auth.ParseToken(tokenStr)
+	if err != nil {
+		serverError(w, errors.New("Failed to parse the new token: "+err.Error()))
+		return nil, false
+	}
+
+	count := atomic.AddUint64(&basicAuthRequests, 1)
+	log.Infof("Basic auth used by %q from %s for %s %s (%d Basic auth requests since startup)",
+		username, common.RealIP(req), req.Method, req.URL.Path, count)
+
+	return token, true
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains the limit on the size of request bodies (see
+// max_body_size). Bodies proxied to netmaster are streamed rather than
+// buffered, so the limit is enforced while they're read: requests whose
+// Content-Length exceeds it are rejected right away and the others fail once
+// they've sent too much.
+
+// errBodyTooLarge is returned when reading more of a request body than max_body_size allows
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedBody is a request body which fails once more than `remaining` bytes are read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  int32 // set using sync/atomic, since netmaster's client reads the body in its own goroutine
+}
+
+// Read reads from the body until the limit is exceeded; the byte beyond the limit is never returned.
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.tooLarge() {
+		return 0, errBodyTooLarge
+	}
+
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if b.remaining -= int64(n); b.remaining < 0 {
+		atomic.StoreInt32(&b.exceeded, 1)
+		return n + int(b.remaining), errBodyTooLarge
+	}
+
+	return n, err
+}
+
+// tooLarge returns true if more of the body was read than the limit allows
+func (b *limitedBody) tooLarge() bool {
+	return atomic.LoadInt32(&b.exceeded) == 1
+}
+
+// maxBodySize returns the current limit on the size of request bodies; 0 if there's none
+func maxBodySize() int64 {
+	value, err := common.Global().Get(common.MaxBodySizeKey)
+	if err != nil {
+		return 0
+	}
+
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit < 0 {
+		return 0
+	}
+
+	return limit
+}
+
+// limitBodySize takes a HTTP handler and limits the size of the request bodies
+// it reads to max_body_size.
+func limitBodySize(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// requests without a body are left alone so that none is sent to netmaster
+		if limit := maxBodySize(); limit > 0 && req.ContentLength != 0 {
+			if req.ContentLength > limit {
+				bodyTooLarge(w)
+				return
+			}
+
+			req.Body = &limitedBody{ReadCloser: req.Body, remaining: limit}
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// bodyExceededLimit returns true if reading the request's body failed because it's too large
+func bodyExceededLimit(req *http.Request) bool {
+	body, ok := req.Body.(*limitedBody)
+	return ok && body.tooLarge()
+}
+
+// bodyTooLarge writes the error response for requests whose body exceeds max_body_size.
+func bodyTooLarge(w http.ResponseWriter) {
+	writeError(w, http.StatusRequestEntityTooLarge, types.ErrorCodeBodyTooLarge,
+		"Request body exceeds "+strconv.FormatInt(maxBodySize(), 10)+" bytes", nil)
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/contiv/auth_proxy/auth"
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// randomBytes returns `n` random bytes
+func randomBytes(t *testing.T, n int) []byte {
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("failed to generate data: %s", err)
+	}
+
+	return data
+}
+
+// chunked hides the length of a request body so that it's sent chunked
+type chunked struct {
+	io.Reader
+}
+
+// TestLimitBodySize tests that request bodies larger than max_body_size are rejected
+func TestLimitBodySize(t *testing.T) {
+	defer common.Global().Set(common.MaxBodySizeKey, "")
+
+	var read []byte
+	var readErr error
+
+	handler := limitBodySize(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		read, readErr = ioutil.ReadAll(req.Body)
+		if bodyExceededLimit(req) {
+			bodyTooLarge(w)
+		}
+	}))
+
+	body := randomBytes(t, 1000)
+
+	testCases := []struct {
+		limit    string
+		body     io.Reader
+		status   int
+		expected int // bytes read by the handler; -1 if it isn't called
+	}{
+		{"", bytes.NewReader(body), http.StatusOK, 1000},
+		{"0", chunked{bytes.NewReader(body)}, http.StatusOK, 1000},
+		{"1000", bytes.NewReader(body), http.StatusOK, 1000},
+		{"1000", chunked{bytes.NewReader(body)}, http.StatusOK, 1000},
+		{"999", bytes.NewReader(body), http.StatusRequestEntityTooLarge, -1},
+		{"999", chunked{bytes.NewReader(body)}, http.StatusRequestEntityTooLarge, 999},
+		{"1", chunked{bytes.NewReader(body)}, http.StatusRequestEntityTooLarge, 1},
+	}
+
+	for _, tc := range testCases {
+		common.Global().Set(common.MaxBodySizeKey, tc.limit)
+		read, readErr = nil, nil
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/bundles/", tc.body))
+
+		if w.Code != tc.status {
+			t.Errorf("limit %q: expected status %d, got %d", tc.limit, tc.status, w.Code)
+		}
+
+		if tc.expected < 0 {
+			if read != nil {
+				t.Errorf("limit %q: expected the body not to be read, got %d bytes", tc.limit, len(read))
+			}
+		} else if len(read) != tc.expected || !bytes.Equal(read, body[:tc.expected]) {
+			t.Errorf("limit %q: expected to read %d bytes of the body, got %d (%v)", tc.limit, tc.expected, len(read), readErr)
+		}
+
+		if tc.status != http.StatusOK {
+			errResp := types.ErrorResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &errResp); err != nil || errResp.Code != types.ErrorCodeBodyTooLarge {
+				t.Errorf("limit %q: expected a %s error, got %q", tc.limit, types.ErrorCodeBodyTooLarge, w.Body.String())
+			}
+		}
+	}
+}
+
+// TestStreamingProxy tests that bodies of any content type are proxied byte for byte in both directions
+func TestStreamingProxy(t *testing.T) {
+	defer common.Global().Set(common.MaxBodySizeKey, "")
+
+	// netmaster echoes the request body back with the same content type; it's
+	// read first since net/http doesn't read requests while writing responses
+	netmaster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+
+		w.Header().Set("Content-Type", req.Header.Get("Content-Type"))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+	defer netmaster.Close()
+
+	s := newUpstreamTestServer(netmaster.Listener.Addr().String(), 1)
+
+	proxied := func(body io.Reader, contentType string, filter func(*[]byte) error) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/v1/bundles/b1/", body)
+		req.Header.Set("Content-Type", contentType)
+
+		w := httptest.NewRecorder()
+		limitBodySize(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if filter == nil {
+				proxyFilteredRequest(s, req, w, nil, nil, "")
+				return
+			}
+
+			proxyFilteredRequest(s, req, w, nil, func(_ *auth.Token, body []byte) ([]byte, error) {
+				return body, filter(&body)
+			}, "")
+		})).ServeHTTP(w, req)
+
+		return w
+	}
+
+	// larger than any buffer used while copying
+	body := randomBytes(t, 3<<20+7)
+
+	for _, contentType := range []string{"application/octet-stream", "multipart/form-data; boundary=xyz", "application/json"} {
+		w := proxied(bytes.NewReader(body), contentType, nil)
+
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), body) {
+			t.Errorf("%s: expected the body to be echoed, got %d and %d bytes", contentType, w.Code, w.Body.Len())
+		}
+
+		if w.Header().Get("Content-Type") != contentType || w.Header().Get("Content-Length") != strconv.Itoa(len(body)) {
+			t.Errorf("%s: expected the headers to be preserved, got %v", contentType, w.Header())
+		}
+	}
+
+	// bodies sent chunked are streamed
+	w := proxied(chunked{bytes.NewReader(body)}, "application/octet-stream", nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), body) {
+		t.Errorf("chunked: expected the body to be echoed, got %d and %d bytes", w.Code, w.Body.Len())
+	}
+
+	// filtered responses are read as a whole
+	w = proxied(bytes.NewReader([]byte(`[]`)), "application/json", func(body *[]byte) error {
+		*body = []byte(`["filtered"]`)
+		return nil
+	})
+	if w.Code != http.StatusOK || w.Body.String() != `["filtered"]` || w.Header().Get("Content-Length") != "" {
+		t.Errorf("expected the filtered response, got %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+
+	// bodies exceeding the limit while they're streamed are rejected
+	common.Global().Set(common.MaxBodySizeKey, strconv.Itoa(1<<20))
+
+	w = proxied(chunked{bytes.NewReader(body)}, "application/octet-stream", nil)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
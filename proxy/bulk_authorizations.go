@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/auth"
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains granting several authorizations at once. All of them are
+// validated before any is added, and they're added all-or-nothing: see
+// auth.AddAuthorizations().
+
+// parseGrant validates an authorization request and turns it into a grant.
+// params:
+//  addAuthzReq: the authorization request
+// return values:
+//  *auth.AuthorizationGrant: the authorization to add
+//  error: why the request is invalid; the message is returned to the client
+func parseGrant(addAuthzReq *AddAuthorizationRequest) (*auth.AuthorizationGrant, error) {
+	if common.IsEmpty(addAuthzReq.PrincipalName) {
+		return nil, errors.New("principal name is missing")
+	}
+
+	role, err := types.Role(addAuthzReq.Role)
+	if err != nil {
+		return nil, errors.New("illegal role specified")
+	}
+
+	// All roles except admin are granted on a tenant
+	if role != types.Admin && common.IsEmpty(addAuthzReq.TenantName) {
+		return nil, errors.New(role.String() + " role requires a tenant to be specified")
+	}
+
+	if err := validateAuthzExpiry(addAuthzReq.ExpiresAt); err != nil {
+		return nil, err
+	}
+
+	return &auth.AuthorizationGrant{
+		TenantName:    addAuthzReq.TenantName,
+		Role:          role,
+		PrincipalName: addAuthzReq.PrincipalName,
+		Local:         addAuthzReq.Local,
+		ExpiresAt:     addAuthzReq.ExpiresAt,
+	}, nil
+}
+
+// grantKey identifies what a grant is about, to find duplicates within a bulk request
+func grantKey(grant *auth.AuthorizationGrant) string {
+	tenant := grant.TenantName
+	if grant.Role == types.Admin {
+		tenant = ""
+	}
+
+	return tenant + "\x00" + common.NormalizeUsername(grant.PrincipalName)
+}
+
+// checkBulkGrant checks that the caller can add a grant and that it's new.
+// params:
+//  scope: tenants the caller can manage authorizations for
+//  grant: the authorization to add
+//  seen: keys of the grants checked before (see grantKey()) => their index
+// return values:
+//  int: http.StatusOK if the grant can be added, else an http status code
+//  error: why the grant can't be added
+func checkBulkGrant(scope *tenantAdminScope, grant *auth.AuthorizationGrant, seen map[string]int) (int, error) {
+	if status, resp := scope.checkGrant(grant.Role, grant.TenantName, grant.PrincipalName); status != http.StatusOK {
+		return status, errors.New(string(resp))
+	}
+
+	if i, found := seen[grantKey(grant)]; found {
+		return http.StatusBadRequest, fmt.Errorf("duplicate of authorization %d", i)
+	}
+
+	existing, err := auth.ExistingGrant(grant)
+	switch {
+	case err != nil:
+		return datastoreStatusCode(err), err
+	case !common.IsEmpty(existing) && grant.Role == types.Admin:
+		return http.StatusBadRequest, fmt.Errorf("%q already has the admin role (authorization %s)", grant.PrincipalName, existing)
+	case !common.IsEmpty(existing):
+		return http.StatusBadRequest, fmt.Errorf("%q already has a role on tenant %q (authorization %s)",
+			grant.PrincipalName, grant.TenantName, existing)
+	}
+
+	return http.StatusOK, nil
+}
+
+// addAuthorizationsHelper helper function to grant several authorizations at once.
+// params:
+//  scope: tenants the caller can manage authorizations for
+//  addAuthzReqs: the authorizations to add
+// return values:
+//  int: http status code; the worst status of the invalid authorizations, if any
+//  []byte: http response message; this goes along with status code
+//          on success, it contains the added `GetAuthorizationReply` objects in order
+//  map[string]string: index of each authorization which couldn't be added => why;
+//                     nil on success
+func addAuthorizationsHelper(scope *tenantAdminScope, addAuthzReqs []AddAuthorizationRequest) (int, []byte, map[string]string) {
+	if len(addAuthzReqs) == 0 {
+		return http.StatusBadRequest, []byte("no authorizations given"), nil
+	}
+
+	grants := []*auth.AuthorizationGrant{}
+	seen := map[string]int{}
+	invalid := map[string]string{}
+	httpStatus := http.StatusOK
+
+	for i := range addAuthzReqs {
+		grant, err := parseGrant(&addAuthzReqs[i])
+		status := http.StatusBadRequest
+		if err == nil {
+			status, err = checkBulkGrant(scope, grant, seen)
+		}
+
+		if err != nil {
+			invalid[strconv.Itoa(i)] = err.Error()
+			if status > httpStatus {
+				httpStatus = status
+			}
+			continue
+		}
+
+		grant.GrantedBy = scope.username()
+		seen[grantKey(grant)] = i
+		grants = append(grants, grant)
+	}
+
+	if len(invalid) > 0 {
+		log.Warnf("%d of %d authorizations are invalid: %v", len(invalid), len(addAuthzReqs), invalid)
+		return httpStatus, []byte("no authorizations were added; some are invalid"), invalid
+	}
+
+	authzs, failed, err := auth.AddAuthorizations(grants)
+	if err != nil {
+		return http.StatusInternalServerError, []byte("no authorizations were added; adding one failed"),
+			map[string]string{strconv.Itoa(failed): err.Error()}
+	}
+
+	authzReplyList := []GetAuthorizationReply{}
+	for _, authz := range authzs {
+		authzReplyList = append(authzReplyList, convertAuthz(authz))
+	}
+
+	jsonAuthzReplyList, err := json.Marshal(authzReplyList)
+	if err != nil {
+		log.Errorf("failed to marshal %d added authorizations: %s", len(authzs), err)
+		return datastoreStatusCode(err), []byte(err.Error()), nil
+	}
+
+	return http.StatusCreated, jsonAuthzReplyList, nil
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestParseGrant tests validating authorization requests
+func TestParseGrant(t *testing.T) {
+	for _, invalid := range []AddAuthorizationRequest{
+		{Role: "ops", TenantName: "t1"},
+		{PrincipalName: "alice", Role: "root", TenantName: "t1"},
+		{PrincipalName: "alice", Role: "ops"},
+		{PrincipalName: "alice", Role: "ops", TenantName: "t1", ExpiresAt: time.Now().Unix() - 1},
+	} {
+		if _, err := parseGrant(&invalid); err == nil {
+			t.Errorf("expected an error for %#v", invalid)
+		}
+	}
+
+	grant, err := parseGrant(&AddAuthorizationRequest{PrincipalName: "alice", Local: true, Role: "guest", TenantName: "t1"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if grant.Role != types.Guest || grant.TenantName != "t1" || grant.PrincipalName != "alice" || !grant.Local {
+		t.Errorf("unexpected grant %#v", grant)
+	}
+
+	// the tenant doesn't matter for admin grants
+	admin1, _ := parseGrant(&AddAuthorizationRequest{PrincipalName: "alice", Role: "admin", TenantName: "t1"})
+	admin2, _ := parseGrant(&AddAuthorizationRequest{PrincipalName: "alice", Role: "admin"})
+	if grantKey(admin1) != grantKey(admin2) {
+		t.Errorf("expected admin grants to have the same key")
+	}
+
+	if grantKey(grant) == grantKey(admin2) {
+		t.Errorf("expected tenant and admin grants to have different keys")
+	}
+}
@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/auth"
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains adding several local users at once, e.g. when standing up
+// a new cluster. All of them are validated before any is added, and they're
+// added all-or-nothing: the users (and authorizations) added so far are
+// deleted again on the first failure.
+
+// Statuses of the users in a BulkLocalUsersResponse
+const (
+	bulkLocalUserCreated = "created"
+	bulkLocalUserValid   = "valid"
+)
+
+// bulkLocalUser is a validated user of a bulk request, along with its role if any
+type bulkLocalUser struct {
+	user  *types.LocalUser
+	grant *auth.AuthorizationGrant // nil if the user isn't granted a role
+}
+
+// checkBulkLocalUser validates a user of a bulk request.
+// params:
+//  userReq: the user to add
+//  seen: normalized usernames of the users checked before => their index
+// return values:
+//  *bulkLocalUser: the user to add, if valid
+//  int: http.StatusOK if the user can be added, else an http status code
+//  error: why the user can't be added; the message is returned to the client
+func checkBulkLocalUser(userReq *BulkLocalUserRequest, seen map[string]int) (*bulkLocalUser, int, error) {
+	if common.IsEmpty(userReq.Username) || common.IsEmpty(userReq.Password) {
+		return nil, http.StatusBadRequest, errors.New("username/password is empty")
+	}
+
+	if err := common.ValidateUsername(userReq.Username); err != nil {
+		return nil, http.StatusBadRequest, errors.New("invalid username: " + err.Error())
+	}
+
+	if i, found := seen[common.NormalizeUsername(userReq.Username)]; found {
+		return nil, http.StatusBadRequest, fmt.Errorf("duplicate of user %d", i)
+	}
+
+	if violations := common.PasswordPolicyViolations(userReq.Username, userReq.Password); len(violations) > 0 {
+		rules := []string{}
+		for _, description := range violations {
+			rules = append(rules, description)
+		}
+
+		sort.Strings(rules)
+		return nil, http.StatusBadRequest, errors.New("the password doesn't follow the password policy: it " + strings.Join(rules, ", "))
+	}
+
+	profile := &types.LocalUser{Email: userReq.Email, FullName: userReq.FullName, Labels: userReq.Labels}
+	if err := validateLocalUserProfile(profile); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	existing, err := db.GetLocalUser(userReq.Username)
+	switch {
+	case err == nil && existing.DeletedAt != 0:
+		return nil, http.StatusConflict, fmt.Errorf("user %q was deleted; restore it or delete it permanently first", existing.Username)
+	case err == nil:
+		return nil, http.StatusBadRequest, fmt.Errorf("user %q exists already", existing.Username)
+	case err != auth_errors.ErrKeyNotFound:
+		return nil, datastoreStatusCode(err), err
+	}
+
+	bulkUser := &bulkLocalUser{user: &types.LocalUser{
+		Username:              userReq.Username,
+		Password:              userReq.Password,
+		FirstName:             userReq.FirstName,
+		LastName:              userReq.LastName,
+		Email:                 userReq.Email,
+		FullName:              userReq.FullName,
+		Labels:                userReq.Labels,
+		Disable:               userReq.Disable,
+		PasswordResetRequired: userReq.PasswordResetRequired,
+	}}
+
+	if !common.IsEmpty(userReq.Role) {
+		bulkUser.grant, err = parseGrant(&AddAuthorizationRequest{
+			PrincipalName: userReq.Username,
+			Local:         true,
+			Role:          userReq.Role,
+			TenantName:    userReq.TenantName,
+		})
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+
+	return bulkUser, http.StatusOK, nil
+}
+
+// addBulkLocalUsers adds the given users in order, then grants their roles.
+// Either all of them are added or, if adding one fails, none are: the users
+// already added are deleted again along with their authorizations.
+// params:
+//  bulkUsers: validated users to add
+//  grantedBy: user making the grants
+// return values:
+//  int: index of the user which couldn't be added; -1 if all were added
+//  error: nil if successful, else as returned by db.AddLocalUser() or auth.AddAuthorizations()
+func addBulkLocalUsers(bulkUsers []*bulkLocalUser, grantedBy string) (int, error) {
+	added := []string{}
+	rollback := func() {
+		for i := len(added) - 1; i >= 0; i-- {
+			if err := db.DeleteLocalUser(added[i]); err != nil {
+				log.Errorf("failed to roll back local user %q; manual cleanup needed: %s", added[i], err)
+			}
+		}
+
+		auth.InvalidateAuthorizationCache()
+	}
+
+	grants := []*auth.AuthorizationGrant{}
+	grantIndexes := []int{}
+
+	for i, bulkUser := range bulkUsers {
+		if err := db.AddLocalUser(bulkUser.user); err != nil {
+			log.Warnf("failed to add local user %d of %d, rolling back: %s", i+1, len(bulkUsers), err)
+			rollback()
+			return i, err
+		}
+
+		added = append(added, bulkUser.user.Username)
+
+		if bulkUser.grant != nil {
+			bulkUser.grant.PrincipalName = bulkUser.user.Username
+			bulkUser.grant.GrantedBy = grantedBy
+			grants = append(grants, bulkUser.grant)
+			grantIndexes = append(grantIndexes, i)
+		}
+	}
+
+	if len(grants) > 0 {
+		if _, failed, err := auth.AddAuthorizations(grants); err != nil {
+			rollback()
+			return grantIndexes[failed], err
+		}
+	}
+
+	return -1, nil
+}
+
+// addLocalUsersHelper helper function to add several local users at once.
+// params:
+//  userReqs: the users to add
+//  dryRun: if true, the users are only validated
+//  grantedBy: user making the request; recorded as the granter of the users' roles
+// return values:
+//  int: http status code; the worst status of the invalid users, if any
+//  []byte: http response message; this goes along with status code
+//          on success, it contains a `BulkLocalUsersResponse`
+//  map[string]string: index of each user which couldn't be added => why;
+//                     nil on success
+func addLocalUsersHelper(userReqs []BulkLocalUserRequest, dryRun bool, grantedBy string) (int, []byte, map[string]string) {
+	if len(userReqs) == 0 {
+		return http.StatusBadRequest, []byte("no users given"), nil
+	}
+
+	bulkUsers := []*bulkLocalUser{}
+	seen := map[string]int{}
+	invalid := map[string]string{}
+	httpStatus := http.StatusOK
+
+	for i := range userReqs {
+		bulkUser, status, err := checkBulkLocalUser(&userReqs[i], seen)
+		if err != nil {
+			invalid[strconv.Itoa(i)] = err.Error()
+			if status > httpStatus {
+				httpStatus = status
+			}
+			continue
+		}
+
+		seen[common.NormalizeUsername(bulkUser.user.Username)] = i
+		bulkUsers = append(bulkUsers, bulkUser)
+	}
+
+	if len(invalid) > 0 {
+		log.Warnf("%d of %d local users are invalid: %v", len(invalid), len(userReqs), invalid)
+		return httpStatus, []byte("no users were added; some are invalid"), invalid
+	}
+
+	resp := BulkLocalUsersResponse{DryRun: dryRun, Users: []BulkLocalUserStatus{}}
+	status, httpStatus := bulkLocalUserValid, http.StatusOK
+
+	if !dryRun {
+		if failed, err := addBulkLocalUsers(bulkUsers, grantedBy); err != nil {
+			return http.StatusInternalServerError, []byte("no users were added; adding one failed"),
+				map[string]string{strconv.Itoa(failed): err.Error()}
+		}
+
+		status, httpStatus = bulkLocalUserCreated, http.StatusCreated
+	}
+
+	// passwords are never returned
+	for _, bulkUser := range bulkUsers {
+		userStatus := BulkLocalUserStatus{Username: bulkUser.user.Username, Status: status}
+		if bulkUser.grant != nil {
+			userStatus.Role = bulkUser.grant.Role.String()
+			if bulkUser.grant.Role != types.Admin {
+				userStatus.TenantName = bulkUser.grant.TenantName
+			}
+		}
+
+		resp.Users = append(resp.Users, userStatus)
+	}
+
+	jData, err := json.Marshal(resp)
+	if err != nil {
+		log.Errorf("failed to marshal %d added local users: %s", len(bulkUsers), err)
+		return datastoreStatusCode(err), []byte(err.Error()), nil
+	}
+
+	return httpStatus, jData, nil
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/contiv/auth_proxy/auth"
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains TLS client certificate authentication (see
+// Config.ClientCAs). Requests carrying a token are authenticated by the token,
+// even if the client presented a certificate too.
+
+// clientCertIdentity returns the user named by the client certificate the
+// request's connection was verified with.
+// params:
+//  req: http request
+// return values:
+//  string: local or AD username; see common.ClientCertIdentity()
+//  bool: false if the client presented no (verified) certificate or it names no user
+func clientCertIdentity(req *http.Request) (string, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	identity := common.ClientCertIdentity(req.TLS.VerifiedChains[0][0])
+
+	return identity, !common.IsEmpty(identity)
+}
+
+// clientCertToken authenticates the user named by the request's client
+// certificate; it writes an error response if that fails.
+// params:
+//  w: response writer
+//  username: local or AD username as returned by clientCertIdentity()
+// return values:
+//  *auth.Token: token object standing in for the certificate
+//  bool: false if the user couldn't be authenticated
+func clientCertToken(w http.ResponseWriter, username string) (*auth.Token, bool) {
+	token, err := auth.AuthenticateClientCertificate(username)
+	switch err {
+	case nil:
+		return token, true
+	case auth_errors.ErrUserNotFound, auth_errors.ErrAccessDenied:
+		authError(w, http.StatusUnauthorized, types.ErrorCodeUnauthorized, "Unknown or disabled user in client certificate")
+	case auth_errors.ErrLDAPConnectionFailed:
+		authError(w, http.StatusServiceUnavailable, types.ErrorCodeUnavailable, "Failed to look up client certificate user: "+err.Error())
+	default:
+		serverError(w, err)
+	}
+
+	return nil, false
+}
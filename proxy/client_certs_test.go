@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/contiv/auth_proxy/common"
+)
+
+// TestClientCertIdentity tests that clients are only asked for a certificate
+// if client certificate authentication is enabled, and that clients without one
+// can still connect
+func TestClientCertIdentity(t *testing.T) {
+	clientCert := newTestCertificate(t)
+
+	leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+
+	// the self-signed client certificate is its own CA
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		identity, _ := clientCertIdentity(req)
+		fmt.Fprint(w, identity)
+	})
+
+	testCases := []struct {
+		description string
+		clientCAs   *x509.CertPool
+		certs       []tls.Certificate
+		identity    string
+	}{
+		{"disabled, without certificate", nil, nil, ""},
+		{"disabled, with certificate", nil, []tls.Certificate{clientCert}, ""},
+		{"enabled, without certificate", pool, nil, ""},
+		{"enabled, with certificate", pool, []tls.Certificate{clientCert}, leaf.Subject.CommonName},
+	}
+
+	for _, tc := range testCases {
+		address, stop := startTLSListener(t, &Config{ClientCAs: tc.clientCAs}, handler)
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: tc.certs},
+		}}
+
+		resp, err := client.Get("https://" + address)
+		if err != nil {
+			stop()
+			t.Fatalf("%s: request failed: %s", tc.description, err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		stop()
+
+		if string(body) != tc.identity {
+			t.Errorf("%s: expected identity %q, got %q", tc.description, tc.identity, body)
+		}
+	}
+}
+
+// TestClientCertIdentityField tests that the certificate field configured under
+// common.ClientCertIdentityKey names the user
+func TestClientCertIdentityField(t *testing.T) {
+	defer common.Global().Set(common.ClientCertIdentityKey, "")
+
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "alice"},
+		DNSNames:       []string{"ci.example.com", "build.example.com"},
+		EmailAddresses: []string{"bob@example.com"},
+	}
+	noSANs := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}
+
+	testCases := []struct {
+		field    string
+		cert     *x509.Certificate
+		identity string
+		ok       bool
+	}{
+		{"", cert, "alice", true},
+		{common.ClientCertIdentityCN, cert, "alice", true},
+		{common.ClientCertIdentityDNS, cert, "ci.example.com", true},
+		{common.ClientCertIdentityEmail, cert, "bob@example.com", true},
+		{common.ClientCertIdentityDNS, noSANs, "", false},
+		{common.ClientCertIdentityEmail, noSANs, "", false},
+		{common.ClientCertIdentityCN, &x509.Certificate{}, "", false},
+	}
+
+	for _, tc := range testCases {
+		if err := common.Global().Set(common.ClientCertIdentityKey, tc.field); err != nil {
+			t.Fatalf("failed to set %q: %s", tc.field, err)
+		}
+
+		req := &http.Request{TLS: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tc.cert}}}}
+
+		identity, ok := clientCertIdentity(req)
+		if identity != tc.identity || ok != tc.ok {
+			t.Errorf("%q: expected (%q, %t), got (%q, %t)", tc.field, tc.identity, tc.ok, identity, ok)
+		}
+	}
+
+	if _, ok := clientCertIdentity(&http.Request{}); ok {
+		t.Error("expected no identity without TLS")
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains the datastore liveness check of /health. The datastore
+// is pinged by reading a key nobody writes, which is cheap for every driver;
+// an answer (including "key not found") means it's reachable. The result is
+// reused for a moment so that frequent health probes don't load the datastore.
+
+const (
+	// datastoreLivenessTimeout is how long the ping may take
+	datastoreLivenessTimeout = 2 * time.Second
+
+	// datastoreLivenessCacheTTL is how long the result of a ping is reused
+	datastoreLivenessCacheTTL = 2 * time.Second
+)
+
+// datastoreLivenessKey is the key read to ping the datastore; it's never written
+var datastoreLivenessKey = types.AuthProxyDir + "/liveness"
+
+// errDatastoreLivenessTimeout is the result of a ping which took too long
+var errDatastoreLivenessTimeout = errors.New("datastore didn't answer within " + datastoreLivenessTimeout.String())
+
+// datastoreLiveness pings the datastore, at most once per datastoreLivenessCacheTTL
+type datastoreLiveness struct {
+	mutex     sync.Mutex // held during a ping, so concurrent probes wait for its result
+	checkedAt time.Time
+	err       error
+
+	// replaced by tests
+	ping func() error
+	now  func() time.Time
+}
+
+// newDatastoreLiveness returns a datastoreLiveness pinging the state driver
+func newDatastoreLiveness() *datastoreLiveness {
+	return &datastoreLiveness{ping: pingDatastore, now: time.Now}
+}
+
+// check returns the result of the last ping if it's recent enough, else pings the datastore.
+// return values:
+//  error: nil if the datastore is reachable, else why it isn't
+func (l *datastoreLiveness) check() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.checkedAt.IsZero() && l.now().Sub(l.checkedAt) < datastoreLivenessCacheTTL {
+		return l.err
+	}
+
+	l.err = l.ping()
+	l.checkedAt = l.now()
+
+	return l.err
+}
+
+// pingDatastore reads datastoreLivenessKey, giving up after datastoreLivenessTimeout.
+// return values:
+//  error: nil if the datastore answered, else why it didn't
+func pingDatastore() error {
+	drv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	// a read which times out keeps going in the background until the state
+	// driver's own timeouts and retries end it
+	result := make(chan error, 1)
+	go func() {
+		_, err := drv.Read(datastoreLivenessKey)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err == auth_errors.ErrKeyNotFound {
+			return nil
+		}
+
+		return err
+	case <-time.After(datastoreLivenessTimeout):
+		return errDatastoreLivenessTimeout
+	}
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestDatastoreLivenessCache tests that the result of a ping is reused until it's too old
+func TestDatastoreLivenessCache(t *testing.T) {
+	errUnreachable := errors.New("connection refused")
+
+	now := time.Now()
+	pings := 0
+	result := errUnreachable
+
+	l := newDatastoreLiveness()
+	l.now = func() time.Time { return now }
+	l.ping = func() error {
+		pings++
+		return result
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := l.check(); err != errUnreachable {
+			t.Fatalf("expected the ping's error, got %v", err)
+		}
+	}
+
+	if pings != 1 {
+		t.Errorf("expected a single ping within the cache TTL, got %d", pings)
+	}
+
+	// once the result is too old, the datastore is pinged again
+	result = nil
+	now = now.Add(datastoreLivenessCacheTTL)
+
+	if err := l.check(); err != nil {
+		t.Fatalf("expected the datastore to be reachable, got %v", err)
+	}
+
+	if pings != 2 {
+		t.Errorf("expected another ping after the cache TTL, got %d pings", pings)
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains the garbage collection of soft-deleted local users; they
+// are permanently deleted once they've been deleted for longer than the
+// retention period (common.DeletedUserRetentionKey).
+
+// deletedUserGCInterval is how often soft-deleted users are garbage collected
+const deletedUserGCInterval = time.Hour
+
+// deletedUserRetention returns the time for which deleted users can be
+// restored; 0 if they're kept until they're deleted permanently.
+func deletedUserRetention() time.Duration {
+	value, err := common.Global().Get(common.DeletedUserRetentionKey)
+	if err != nil {
+		return 0
+	}
+
+	days, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || days <= 0 {
+		return 0
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// purgeDeletedUsers permanently deletes the users which were deleted longer
+// than the retention period ago.
+// params:
+//  now: current time
+// return values:
+//  []string: names of the purged users
+//  error: as returned by db.PurgeDeletedLocalUsers()
+func purgeDeletedUsers(now time.Time) ([]string, error) {
+	retention := deletedUserRetention()
+	if retention == 0 {
+		return []string{}, nil
+	}
+
+	purged, err := db.PurgeDeletedLocalUsers(now.Add(-retention).Unix())
+	for _, username := range purged {
+		log.Infof("Permanently deleted local user %q after the retention period", username)
+	}
+
+	return purged, err
+}
+
+// runDeletedUserGC purges deleted users every `interval` until `done` is
+// closed, as long as `leader` returns true.
+func runDeletedUserGC(interval time.Duration, leader func() bool, done chan bool) {
+	runAsLeader(interval, leader, done, func(now time.Time) {
+		if _, err := purgeDeletedUsers(now); err != nil {
+			log.Warnf("Failed to purge deleted local users: %s", err.Error())
+		}
+	})
+}
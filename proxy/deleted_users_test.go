@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/contiv/auth_proxy/common"
+)
+
+// TestDeletedUserRetention tests parsing of the deleted user retention period
+func TestDeletedUserRetention(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"-1", 0},
+		{"abc", 0},
+		{"30", 30 * 24 * time.Hour},
+	}
+
+	defer common.Global().Set(common.DeletedUserRetentionKey, "")
+
+	for _, tc := range testCases {
+		common.Global().Set(common.DeletedUserRetentionKey, tc.value)
+
+		if retention := deletedUserRetention(); retention != tc.expected {
+			t.Errorf("%q: expected %s, got %s", tc.value, tc.expected, retention)
+		}
+
+		// nothing is purged, and the datastore isn't needed, if retention is disabled
+		if tc.expected == 0 {
+			if purged, err := purgeDeletedUsers(time.Now()); err != nil || len(purged) != 0 {
+				t.Errorf("%q: expected nothing to be purged, got %v (%v)", tc.value, purged, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+	uuid "github.com/satori/go.uuid"
+)
+
+// This file contains the helpers writing error responses. All errors are
+// written as a types.ErrorResponse carrying a stable code and the ID of the
+// request, which is also returned in the X-Request-Id header and forwarded
+// to netmaster.
+
+// requestIDHeader carries the ID of a request; the client's ID is kept if it's valid
+const requestIDHeader = "X-Request-Id"
+
+// validRequestID matches request IDs passed by clients; anything else is replaced
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// upstreamError is returned by ProxyRequest() if netmaster couldn't be reached
+// or didn't respond in time.
+type upstreamError struct {
+	err     error
+	timeout bool // true if the request to netmaster timed out
+}
+
+func (e *upstreamError) Error() string {
+	return e.err.Error()
+}
+
+// newUpstreamError wraps an error of a request to netmaster.
+// params:
+//  ctx: context of the request to netmaster
+//  err: error returned when sending the request or reading the response
+// return values:
+//  *upstreamError: error whose `timeout` is set if the context's deadline passed
+func newUpstreamError(ctx context.Context, err error) *upstreamError {
+	return &upstreamError{err: err, timeout: ctx.Err() == context.DeadlineExceeded}
+}
+
+// errorCode returns the code of errors without a more specific one.
+// params:
+//  statusCode: HTTP status code of the error response
+// return values:
+//  string: one of the types.ErrorCode* constants
+func errorCode(statusCode int) string {
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return types.ErrorCodeUnauthorized
+	case http.StatusForbidden:
+		return types.ErrorCodeForbidden
+	case http.StatusNotFound:
+		return types.ErrorCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return types.ErrorCodeMethodNotAllowed
+	case http.StatusConflict:
+		return types.ErrorCodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return types.ErrorCodeBodyTooLarge
+	case http.StatusTooManyRequests:
+		return types.ErrorCodeRateLimited
+	case http.StatusBadGateway:
+		return types.ErrorCodeUpstreamFailed
+	case http.StatusServiceUnavailable:
+		return types.ErrorCodeUnavailable
+	case http.StatusGatewayTimeout:
+		return types.ErrorCodeUpstreamTimeout
+	}
+
+	if statusCode < http.StatusInternalServerError {
+		return types.ErrorCodeBadRequest
+	}
+
+	return types.ErrorCodeInternal
+}
+
+// writeError writes an error response.
+// params:
+//  w: http response writer; its X-Request-Id header (see withRequestID()) is included
+//  statusCode: HTTP status code of the response
+//  code: one of the types.ErrorCode* constants
+//  msg: human-readable description of the error
+//  details: additional information; may be nil
+func writeError(w http.ResponseWriter, statusCode int, code, msg string, details map[string]string) {
+	common.SetDefaultResponseHeaders(w)
+	w.WriteHeader(statusCode)
+
+	writeJSONResponse(w, types.ErrorResponse{
+		Code:      code,
+		Message:   msg,
+		RequestID: w.Header().Get(requestIDHeader),
+		Details:   details,
+	})
+}
+
+// upstreamFailure writes the error response for a failed request to netmaster:
+// a 504 if it timed out, a 502 if netmaster couldn't be reached and a 500 otherwise.
+func upstreamFailure(w http.ResponseWriter, err error) {
+	uErr, ok := err.(*upstreamError)
+	if !ok {
+		serverError(w, err)
+		return
+	}
+
+	log.Errorln(err.Error())
+
+	if uErr.timeout {
+		writeError(w, http.StatusGatewayTimeout, types.ErrorCodeUpstreamTimeout, "Netmaster didn't respond in time", nil)
+		return
+	}
+
+	writeError(w, http.StatusBadGateway, types.ErrorCodeUpstreamFailed, "Failed to reach netmaster", nil)
+}
+
+// acceptsJSON returns true if the client asked for a JSON response.
+func acceptsJSON(req *http.Request) bool {
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0])
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeUpstreamError writes an error response received from netmaster. Its status
+// code and body are passed through verbatim, except that bodies which aren't JSON
+// (netmaster's plain-text errors or no body at all) are translated into an error
+// response if the client asked for JSON.
+// params:
+//  w: http response writer; netmaster's headers must have been copied already
+//  req: request of the client
+//  statusCode: status code returned by netmaster
+//  body: body returned by netmaster
+func writeUpstreamError(w http.ResponseWriter, req *http.Request, statusCode int, body []byte) {
+	var doc interface{}
+	if !acceptsJSON(req) || json.Unmarshal(body, &doc) == nil {
+		w.WriteHeader(statusCode)
+		w.Write(body)
+		return
+	}
+
+	msg := strings.TrimSpace(string(body))
+	if common.IsEmpty(msg) {
+		msg = fmt.Sprintf("Netmaster returned %d %s", statusCode, http.StatusText(statusCode))
+	}
+
+	writeError(w, statusCode, errorCode(statusCode), msg, map[string]string{"upstream_status": strconv.Itoa(statusCode)})
+}
+
+// notFound is used for requests which don't match any route.
+func notFound(w http.ResponseWriter, req *http.Request) {
+	writeError(w, http.StatusNotFound, types.ErrorCodeNotFound, "No such endpoint: "+req.Method+" "+req.URL.Path, nil)
+}
+
+// withRequestID takes a HTTP handler and assigns an ID to every request before
+// handling it. The ID is returned in the X-Request-Id header, included in error
+// responses and forwarded to netmaster.
+func withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewV4().String()
+			req.Header.Set(requestIDHeader, id)
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// recoverPanics takes a HTTP handler and turns panics while handling a request
+// into 500s instead of dropping the connection.
+func recoverPanics(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("panic while handling %s %s (request %s): %v\n%s",
+					req.Method, req.URL.Path, w.Header().Get(requestIDHeader), r, debug.Stack())
+
+				writeError(w, http.StatusInternalServerError, types.ErrorCodeInternal,
+					fmt.Sprintf("Internal error; see request %s in the logs", w.Header().Get(requestIDHeader)), nil)
+			}
+		}()
+
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/contiv/auth_proxy/auth"
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/gorilla/mux"
+)
+
+// serveError serves a GET request for the given path with the given handler
+// wrapped like Serve() does and decodes the error response.
+func serveError(t *testing.T, handler http.Handler, path, requestID string) (*httptest.ResponseRecorder, types.ErrorResponse) {
+	req := httptest.NewRequest("GET", "https://localhost"+path, nil)
+	if requestID != "" {
+		req.Header.Set(requestIDHeader, requestID)
+	}
+
+	w := httptest.NewRecorder()
+	withRequestID(recoverPanics(handler)).ServeHTTP(w, req)
+
+	errResp := types.ErrorResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &errResp); err != nil {
+		t.Errorf("GET %s: expected an error response, got %q", path, w.Body.String())
+	}
+
+	return w, errResp
+}
+
+// TestErrorResponses tests the envelope of errors written by the helpers and middleware
+func TestErrorResponses(t *testing.T) {
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+
+	router.Path("/panic/").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var m map[string]string
+		m["boom"] = "nil map"
+	})
+	router.Path("/auth/").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authError(w, http.StatusBadRequest, types.ErrorCodeMissingToken, "X-Auth-Token header is missing")
+	})
+	router.Path("/missing/").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		processStatusCodes(http.StatusNotFound, nil, w)
+	})
+	router.Path("/conflict/").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		processStatusCodes(http.StatusConflict, []byte("exists already"), w)
+	})
+	router.Path("/rate/").HandlerFunc(rateLimited(common.NewRateLimiter(1, 1), func() float64 { return 0.001 },
+		func(w http.ResponseWriter, req *http.Request) {}))
+
+	testCases := []struct {
+		path     string
+		status   int
+		expected types.ErrorResponse
+	}{
+		{"/unknown/", 404, types.ErrorResponse{Code: types.ErrorCodeNotFound, Message: "No such endpoint: GET /unknown/"}},
+		{"/panic/", 500, types.ErrorResponse{Code: types.ErrorCodeInternal, Message: "Internal error; see request req-1 in the logs"}},
+		{"/auth/", 400, types.ErrorResponse{Code: types.ErrorCodeMissingToken, Message: "X-Auth-Token header is missing"}},
+		{"/missing/", 404, types.ErrorResponse{Code: types.ErrorCodeNotFound, Message: "Not found"}},
+		{"/conflict/", 409, types.ErrorResponse{Code: types.ErrorCodeConflict, Message: "exists already"}},
+	}
+
+	for _, tc := range testCases {
+		w, errResp := serveError(t, router, tc.path, "req-1")
+
+		if w.Code != tc.status {
+			t.Errorf("GET %s: expected status %d, got %d", tc.path, tc.status, w.Code)
+		}
+
+		tc.expected.RequestID = "req-1"
+		if !reflect.DeepEqual(errResp, tc.expected) {
+			t.Errorf("GET %s: expected %#v, got %#v", tc.path, tc.expected, errResp)
+		}
+
+		if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("GET %s: unexpected Content-Type %q", tc.path, ct)
+		}
+	}
+
+	// the first request is allowed by the rate limiter
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "https://localhost/rate/", nil))
+	_, errResp := serveError(t, router, "/rate/", "")
+	if errResp.Code != types.ErrorCodeRateLimited || errResp.Details["retry_after"] != "1" {
+		t.Errorf("expected a rate limited error, got %#v", errResp)
+	}
+}
+
+// TestRequestID tests that clients' request IDs are kept if they're valid
+func TestRequestID(t *testing.T) {
+	handler := http.HandlerFunc(notFound)
+
+	for _, id := range []string{"", "not valid", "<script>", string(make([]byte, 200))} {
+		w, errResp := serveError(t, handler, "/", id)
+
+		generated := w.Header().Get(requestIDHeader)
+		if generated == id || len(generated) != 36 || errResp.RequestID != generated {
+			t.Errorf("%q: expected a new request ID, got %q (response: %q)", id, generated, errResp.RequestID)
+		}
+	}
+
+	w, errResp := serveError(t, handler, "/", "a1b2-c3.d4:5_6")
+	if w.Header().Get(requestIDHeader) != "a1b2-c3.d4:5_6" || errResp.RequestID != "a1b2-c3.d4:5_6" {
+		t.Errorf("expected the client's request ID, got %q", w.Header().Get(requestIDHeader))
+	}
+}
+
+// TestUpstreamErrors tests the errors of requests netmaster doesn't answer
+func TestUpstreamErrors(t *testing.T) {
+	netmaster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+	}))
+	defer netmaster.Close()
+
+	slow := NewServer(&Config{
+		NetmasterAddress:        netmaster.Listener.Addr().String(),
+		NetmasterRequestTimeout: 1,
+		ClientReadTimeout:       DefaultClientReadTimeout,
+		ClientWriteTimeout:      DefaultClientWriteTimeout,
+	})
+
+	// nothing listens on port 1
+	down := newUpstreamTestServer("127.0.0.1:1", 1)
+
+	testCases := []struct {
+		server *Server
+		status int
+		code   string
+	}{
+		{slow, http.StatusGatewayTimeout, types.ErrorCodeUpstreamTimeout},
+		{down, http.StatusBadGateway, types.ErrorCodeUpstreamFailed},
+	}
+
+	for _, tc := range testCases {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.RequestURI = req.URL.Path
+			proxyRequest(tc.server, req, w, nil, nil, "")
+		})
+
+		w, errResp := serveError(t, handler, "/api/v1/networks/", "")
+
+		if w.Code != tc.status || errResp.Code != tc.code {
+			t.Errorf("expected %d %s, got %d %#v", tc.status, tc.code, w.Code, errResp)
+		}
+	}
+}
+
+// TestUpstreamErrorBodies tests that netmaster's error responses are passed
+// through, and translated into error responses for clients asking for JSON
+func TestUpstreamErrorBodies(t *testing.T) {
+	netmaster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/v1/networks/":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[{"networkName":"n1"}]`))
+		case "/api/v1/networks/t1:n1/":
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("network with that name already exists\n"))
+		case "/api/v1/tenants/":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"state store failure"}`))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer netmaster.Close()
+
+	s := newUpstreamTestServer(netmaster.Listener.Addr().String(), 1)
+
+	filtered := false
+	filter := func(token *auth.Token, body []byte) []byte {
+		filtered = true
+		return []byte("[]")
+	}
+
+	testCases := []struct {
+		path     string
+		accept   string
+		status   int
+		body     string
+		expected *types.ErrorResponse
+	}{
+		{"/api/v1/networks/", "application/json", 200, "[]", nil},
+		{"/api/v1/networks/t1:n1/", "", 409, "network with that name already exists\n", nil},
+		{"/api/v1/networks/t1:n1/", "application/json", 409, "",
+			&types.ErrorResponse{Code: types.ErrorCodeConflict, Message: "network with that name already exists"}},
+		{"/api/v1/tenants/", "application/json", 500, `{"error":"state store failure"}`, nil},
+		{"/api/v1/aciGws/", "", 503, "", nil},
+		{"/api/v1/aciGws/", "text/html, application/json;q=0.9", 503, "",
+			&types.ErrorResponse{Code: types.ErrorCodeUnavailable, Message: "Netmaster returned 503 Service Unavailable"}},
+	}
+
+	for _, tc := range testCases {
+		filtered = false
+
+		req := httptest.NewRequest("GET", "https://localhost"+tc.path, nil)
+		req.RequestURI = tc.path
+		req.Header.Set("Accept", tc.accept)
+		req.Header.Set(requestIDHeader, "req-1")
+
+		w := httptest.NewRecorder()
+		withRequestID(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			proxyRequest(s, req, w, nil, filter, "")
+		})).ServeHTTP(w, req)
+
+		if w.Code != tc.status {
+			t.Errorf("GET %s: expected status %d, got %d", tc.path, tc.status, w.Code)
+		}
+
+		// only successful responses are filtered
+		if filtered != (tc.status == http.StatusOK) {
+			t.Errorf("GET %s: unexpected filtering of a %d response", tc.path, w.Code)
+		}
+
+		if tc.expected == nil {
+			if w.Body.String() != tc.body {
+				t.Errorf("GET %s: expected body %q, got %q", tc.path, tc.body, w.Body.String())
+			}
+
+			continue
+		}
+
+		errResp := types.ErrorResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &errResp); err != nil {
+			t.Errorf("GET %s: expected an error response, got %q", tc.path, w.Body.String())
+			continue
+		}
+
+		tc.expected.RequestID = "req-1"
+		tc.expected.Details = map[string]string{"upstream_status": strconv.Itoa(tc.status)}
+		if !reflect.DeepEqual(errResp, *tc.expected) {
+			t.Errorf("GET %s: expected %#v, got %#v", tc.path, *tc.expected, errResp)
+		}
+	}
+
+	m := s.netmasterPool.responseMetrics()
+	if m.Success != 1 || m.ClientError != 2 || m.ServerError != 3 || m.Failed != 0 {
+		t.Errorf("unexpected response metrics %#v", m)
+	}
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains the sweeping of expired authorizations. They already
+// behave as if they were deleted as soon as they expire; sweeping them keeps
+// the authorizations list (and the data store) clean.
+
+// expiredAuthzSweepInterval is how often expired authorizations are deleted
+const expiredAuthzSweepInterval = 10 * time.Second
+
+// sweepExpiredAuthorizations deletes the authorizations which have expired and
+// logs an audit entry for each of them.
+// params:
+//  now: current time
+// return values:
+//  int: number of deleted authorizations
+//  error: as returned by db.DeleteExpiredAuthorizations()
+func sweepExpiredAuthorizations(now time.Time) (int, error) {
+	deleted, err := db.DeleteExpiredAuthorizations(now.Unix())
+	for _, authz := range deleted {
+		log.Infof("audit: deleted expired authorization %s (%s=%s for principal %q, expired at %s)",
+			authz.UUID, authz.ClaimKey, authz.ClaimValue, authz.PrincipalName,
+			time.Unix(authz.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	}
+
+	return len(deleted), err
+}
+
+// runExpiredAuthzSweeper sweeps expired authorizations every `interval` until
+// `done` is closed, as long as `leader` returns true.
+func runExpiredAuthzSweeper(interval time.Duration, leader func() bool, done chan bool) {
+	runAsLeader(interval, leader, done, func(now time.Time) {
+		if _, err := sweepExpiredAuthorizations(now); err != nil {
+			log.Warnf("Failed to delete expired authorizations: %s", err.Error())
+		}
+	})
+}
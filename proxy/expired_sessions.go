@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains the sweeping of expired sessions. Listing the sessions
+// already skips them; sweeping them keeps the data store from growing with
+// every login. Each wait is jittered (see jittered()) so that several proxies
+// don't scan the data store in lockstep.
+
+// expiredSessionSweepInterval is how often expired sessions are deleted
+const expiredSessionSweepInterval = time.Minute
+
+// sweepExpiredSessions deletes the sessions which have expired.
+// params:
+//  now: current time
+// return values:
+//  int: number of deleted sessions
+//  error: as returned by db.DeleteExpiredSessions()
+func sweepExpiredSessions(now time.Time) (int, error) {
+	deleted, err := db.DeleteExpiredSessions(now.Unix())
+	if deleted > 0 {
+		log.Infof("Deleted %d expired session(s)", deleted)
+	}
+
+	return deleted, err
+}
+
+// runExpiredSessionSweeper sweeps expired sessions every `interval` (jittered)
+// until `done` is closed, as long as `leader` returns true.
+func runExpiredSessionSweeper(interval time.Duration, leader func() bool, done chan bool) {
+	for {
+		select {
+		case now := <-time.After(jittered(interval)):
+			if !leader() {
+				continue
+			}
+
+			if _, err := sweepExpiredSessions(now); err != nil {
+				log.Warnf("Failed to delete expired sessions: %s", err.Error())
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -3,70 +3,255 @@ package proxy
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/contiv/auth_proxy/auth"
 	"github.com/contiv/auth_proxy/common"
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
 	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/state"
 	"github.com/gorilla/mux"
 
 	log "github.com/Sirupsen/logrus"
 )
 
-// authError logs a message and changes the HTTP status code as requested.
-func authError(w http.ResponseWriter, statusCode int, msg string) {
+// authError logs a message and writes an error response with the given status and code.
+func authError(w http.ResponseWriter, statusCode int, code, msg string) {
 	log.Println(msg)
-	w.WriteHeader(statusCode)
-	writeJSONResponse(w, errorResponse{Error: msg})
+	writeError(w, statusCode, code, msg, nil)
 }
 
-// serverError logs a message + error and changes the HTTP status code to 500.
+// serverError logs a message + error and changes the HTTP status code to 500
+// (503 if the datastore is unavailable).
 func serverError(w http.ResponseWriter, err error) {
 	log.Errorln(err.Error())
-	w.WriteHeader(http.StatusInternalServerError)
-	writeJSONResponse(w, errorResponse{Error: err.Error()})
+
+	statusCode := datastoreStatusCode(err)
+	writeError(w, statusCode, errorCode(statusCode), err.Error(), nil)
 }
 
 // loginHandler handles the login request and returns auth token with user capabilities
+// if the user's password expired, the token can only be used to change the password.
 // it can return various HTTP status codes:
 //     200 (authorization succeeded)
 //     400 (username and/or password were not provided)
-//     401 (authorization failed)
+//     401 (authorization failed; the error code is otp_required if the user has
+//          MFA enabled and only the one-time password is missing)
 //     500 (something broke)
+//     502 (LDAP/AD couldn't be reached or didn't respond in time)
 func loginHandler(w http.ResponseWriter, req *http.Request) {
 	common.SetDefaultResponseHeaders(w)
 
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
+		auditLogin(req, "", loginFailureBadRequest, false)
 		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
 		return
 	}
 
 	lReq := &loginReq{}
 	if err := json.Unmarshal(body, lReq); err != nil {
+		auditLogin(req, "", loginFailureBadRequest, false)
 		serverError(w, errors.New("Failed to unmarshal credentials from request body: "+err.Error()))
 		return
 	}
 
 	if common.IsEmpty(lReq.Username) || common.IsEmpty(lReq.Password) {
-		authError(w, http.StatusBadRequest, "Username and password must be provided")
+		auditLogin(req, lReq.Username, loginFailureBadRequest, false)
+		authError(w, http.StatusBadRequest, types.ErrorCodeBadRequest, "Username and password must be provided")
 		return
 	}
 
 	// authenticate the user using `username` and `password`
-	tokenStr, err := auth.Authenticate(lReq.Username, lReq.Password)
+	tokenStr, loginInfo, err := auth.Authenticate(lReq.Username, lReq.Password, lReq.OTP)
 	if err != nil {
+		// the response doesn't tell unknown users apart from wrong passwords; the audit trail does
+		auditLogin(req, lReq.Username, loginFailureReason(err), false)
 		log.Error("failed to authenticate user, err:", err)
-		authError(w, http.StatusUnauthorized, "Invalid username/password")
+
+		// the password was right, so the client can prompt for the one-time password
+		if err == auth_errors.ErrOTPRequired {
+			authError(w, http.StatusUnauthorized, types.ErrorCodeOTPRequired, "A one-time password is required")
+			return
+		}
+
+		// the password was right, so the client can say the account is disabled
+		if err == auth_errors.ErrUserDisabled {
+			authError(w, http.StatusForbidden, types.ErrorCodeUserDisabled, "User account disabled")
+			return
+		}
+
+		// the credentials couldn't be checked at all; the client can retry later
+		if err == auth_errors.ErrLDAPConnectionFailed {
+			authError(w, http.StatusBadGateway, types.ErrorCodeDirectoryUnavailable, directoryUnavailable())
+			return
+		}
+
+		authError(w, http.StatusUnauthorized, types.ErrorCodeInvalidCredentials, "Invalid username/password")
 		return
 	}
 
+	auditLogin(req, lReq.Username, "", loginInfo.CachedAuth)
+
 	log.Debugf("Token String %q", tokenStr)
 
+	writeLoginResponse(w, req, tokenStr, loginInfo.PasswordChange)
+}
+
+// writeLoginResponse records the session of a new token issued by a login or
+// token refresh and writes the response, which tells the client who they are
+// and what they're granted without decoding the token.
+// params:
+//  w: http response writer
+//  req: http request the token was issued for
+//  tokenStr: the new token
+//  passwordChange: true if the token can only be used to change the password
+func writeLoginResponse(w http.ResponseWriter, req *http.Request, tokenStr string, passwordChange bool) {
+	token, err := auth.ParseToken(tokenStr)
+	if err != nil {
+		serverError(w, errors.New("Failed to parse the new token: "+err.Error()))
+		return
+	}
+
+	// the token works without its session; it just isn't listed
+	if err := recordSession(req, token); err != nil {
+		log.Errorf("failed to record the session of token %q: %s", token.ID(), err)
+	}
+
+	loginResp := LoginResponse{
+		Token:      tokenStr,
+		ExpiresAt:  time.Unix(token.ExpiresAt(), 0).UTC().Format(time.RFC3339),
+		Username:   token.GetClaim(auth.UsernameClaimKey),
+		Attributes: token.Attributes(),
+	}
+
+	if passwordChange {
+		loginResp.PasswordResetRequired = passwordResetRequired(loginResp.Username)
+		loginResp.PasswordExpired = !loginResp.PasswordResetRequired
+	}
+
+	// password change tokens carry no principals, hence no role or tenants
+	if !token.PasswordChangeOnly() {
+		tenants, err := token.Tenants()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		loginResp.Role = tokenRole(token).String()
+		loginResp.Tenants = tenants
+		loginResp.StrictAuthorization = strictAuthorization() && !token.IsSuperuser()
+	}
+
 	w.WriteHeader(http.StatusOK)
-	writeJSONResponse(w, LoginResponse{Token: tokenStr})
+	writeJSONResponse(w, loginResp)
+}
+
+// refreshHandler exchanges a valid token for a new one with the same user and
+// principals, so that sessions don't expire while they're in use. Tokens can
+// only be refreshed during the last part of their lifetime (see
+// common.TokenRefreshWindowKey); expired and revoked tokens are rejected by
+// authenticatedOnly() already.
+// it can return various HTTP status codes:
+//     200 (OK; the response contains the new token)
+//     403 (Forbidden; the token can't be refreshed (yet))
+//     500 (internal server error)
+func refreshHandler(w http.ResponseWriter, req *http.Request) {
+	if auth.IsForeignToken(requestTokenString(req)) { // Kubernetes issues ServiceAccount tokens, not us
+		authError(w, http.StatusForbidden, types.ErrorCodeRefreshNotAllowed, "Only tokens issued by the proxy can be refreshed")
+		return
+	}
+
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	newTokenStr, err := auth.RefreshToken(token)
+	if err != nil {
+		if err == auth_errors.ErrTokenRefreshNotAllowed {
+			authError(w, http.StatusForbidden, types.ErrorCodeRefreshNotAllowed, "Token can't be refreshed (yet); log in again once it expired")
+			return
+		}
+
+		serverError(w, err)
+		return
+	}
+
+	writeLoginResponse(w, req, newTokenStr, false)
+}
+
+// logoutHandler revokes the caller's token, so that it's rejected with a 401
+// from now on; other tokens of the same user are unaffected. Users who have to
+// change their password can log out too.
+// it can return various HTTP status codes:
+//     204 (NoContent; the token was revoked)
+//     400 (BadRequest; the token can't be revoked individually)
+//     500 (internal server error)
+//     503 (ServiceUnavailable; the datastore is unavailable)
+func logoutHandler(w http.ResponseWriter, req *http.Request) {
+	if auth.IsForeignToken(requestTokenString(req)) { // Kubernetes issues ServiceAccount tokens, not us
+		authError(w, http.StatusBadRequest, types.ErrorCodeBadRequest, "Only tokens issued by the proxy can be revoked")
+		return
+	}
+
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	statusCode, resp := logoutHelper(token)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// changePassword changes the password of the calling local user, who has to
+// give the current password too. Admins change other users' passwords through
+// updateLocalUser. Users who have to change their password can use it too.
+// it can return various HTTP status codes:
+//     204 (NoContent; the password was changed)
+//     400 (BadRequest; a password is missing, the new password is the old one
+//          or breaks the password policy, or the caller isn't a local user)
+//     403 (Forbidden; the old password is wrong)
+//     500 (internal server error)
+func changePassword(w http.ResponseWriter, req *http.Request) {
+	if auth.IsForeignToken(requestTokenString(req)) { // Kubernetes ServiceAccounts have no password
+		authError(w, http.StatusBadRequest, types.ErrorCodeBadRequest, "Only local users can change their password")
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	changeReq := &changePasswordRequest{}
+	if err := json.Unmarshal(body, changeReq); err != nil {
+		authError(w, http.StatusBadRequest, types.ErrorCodeBadRequest, "Failed to unmarshal password change request: "+err.Error())
+		return
+	}
+
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	if !common.IsEmpty(changeReq.NewPassword) && !passwordFollowsPolicy(w, token.GetClaim(auth.UsernameClaimKey), changeReq.NewPassword) {
+		return
+	}
+
+	statusCode, resp := changePasswordHelper(token.GetClaim(auth.UsernameClaimKey), changeReq)
+	processStatusCodes(statusCode, resp, w)
 }
 
 const (
@@ -75,6 +260,13 @@ const (
 
 	// StatusUnhealthy is used to indicate an unhealthy response
 	StatusUnhealthy = "unhealthy"
+
+	// StatusDegraded is used to indicate that the proxy can't serve requests
+	// because the datastore is unreachable
+	StatusDegraded = "degraded"
+
+	// StatusUnreachable is used to indicate that the datastore didn't answer a ping
+	StatusUnreachable = "unreachable"
 )
 
 // NetmasterHealthCheckResponse represents our netmaster's health and version info.
@@ -86,6 +278,15 @@ type NetmasterHealthCheckResponse struct {
 
 	// if we can't reach netmaster, we won't have a version
 	Version string `json:"version,omitempty"`
+
+	// state of our connections to netmaster
+	ConnectionPool *ConnectionPoolMetrics `json:"connection_pool,omitempty"`
+
+	// status classes of the responses received from netmaster
+	Responses *UpstreamResponseMetrics `json:"responses,omitempty"`
+
+	// responses which were denied because they couldn't be filtered for the user's tenants
+	UnfilterableResponses uint64 `json:"unfilterable_responses"`
 }
 
 // MarkHealthy marks netmaster as being healthy and running the specified version
@@ -100,10 +301,28 @@ func (nhcr *NetmasterHealthCheckResponse) MarkUnhealthy(reason string) {
 	nhcr.Reason = reason
 }
 
+// DatastoreHealthCheckResponse represents the health of our datastore as seen
+// by the state driver's circuit breaker, and whether it answers a ping.
+type DatastoreHealthCheckResponse struct {
+	Status string `json:"status"`
+
+	// why the datastore is unreachable; empty if it answered the ping
+	Reason string `json:"reason,omitempty"`
+
+	// metrics of the circuit breaker; the datastore is unhealthy unless it's closed
+	CircuitBreaker *state.BreakerMetrics `json:"circuit_breaker,omitempty"`
+
+	// reads passed on to the datastore and reads which shared another one's round trip
+	SingleFlight *state.SingleFlightMetrics `json:"single_flight,omitempty"`
+}
+
 // HealthCheckResponse represents a response from the /health endpoint.
-// It contains our health status + the health status of our netmaster
+// It contains our health status + the health status of our netmaster and datastore.
+// Leadership is only set if leader election is enabled; followers are healthy too.
 type HealthCheckResponse struct {
+	DatastoreHealth *DatastoreHealthCheckResponse `json:"datastore"`
 	NetmasterHealth *NetmasterHealthCheckResponse `json:"netmaster"`
+	Leadership      *state.LeaderMetrics          `json:"leadership,omitempty"`
 	Status          string                        `json:"status"`
 	Version         string                        `json:"version"`
 }
@@ -113,14 +332,20 @@ func (hcr *HealthCheckResponse) MarkUnhealthy() {
 	hcr.Status = StatusUnhealthy
 }
 
-// healthCheckHandler handles /health requests
-func healthCheckHandler(config *Config) func(http.ResponseWriter, *http.Request) {
+// healthCheckHandler handles /health requests. The datastore is pinged unless
+// the `quick` query parameter is "true", which liveness-only probes can use.
+// it can return various HTTP status codes:
+//    200 (the proxy can serve requests; the response tells whether everything is healthy)
+//    503 (the datastore is unreachable; the response's status is "degraded")
+func healthCheckHandler(s *Server) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		common.SetDefaultResponseHeaders(w)
 
+		quick := req.URL.Query().Get("quick") == "true"
+
 		hcr := &HealthCheckResponse{
 			Status:  StatusHealthy, // default to being healthy
-			Version: config.Version,
+			Version: s.config.Version,
 		}
 
 		nhcr := &NetmasterHealthCheckResponse{}
@@ -128,7 +353,7 @@ func healthCheckHandler(config *Config) func(http.ResponseWriter, *http.Request)
 		//
 		// check our netmaster's /version endpoint
 		//
-		if version, err := common.GetNetmasterVersion(config.NetmasterAddress); err != nil {
+		if version, err := common.GetNetmasterVersion(s.config.NetmasterAddress); err != nil {
 			nhcr.MarkUnhealthy(err.Error())
 
 			// if netmaster is unhealthy, so are we
@@ -137,8 +362,64 @@ func healthCheckHandler(config *Config) func(http.ResponseWriter, *http.Request)
 			nhcr.MarkHealthy(version)
 		}
 
+		if s.netmasterPool != nil {
+			metrics := s.netmasterPool.metrics()
+			nhcr.ConnectionPool = &metrics
+
+			responses := s.netmasterPool.responseMetrics()
+			nhcr.Responses = &responses
+		}
+
+		nhcr.UnfilterableResponses = unfilterableResponseCount()
+
 		hcr.NetmasterHealth = nhcr
 
+		//
+		// check whether the datastore's circuit breaker is open
+		//
+		dhcr := &DatastoreHealthCheckResponse{Status: StatusHealthy}
+
+		if drv, err := state.GetStateDriver(); err != nil {
+			dhcr.Status = StatusUnhealthy
+		} else {
+			if breaker, ok := state.CircuitBreaker(drv); ok {
+				metrics := breaker.Metrics()
+				dhcr.CircuitBreaker = &metrics
+
+				if metrics.State != state.BreakerClosed {
+					dhcr.Status = StatusUnhealthy
+				}
+			}
+
+			if sf, ok := drv.(*state.SingleFlightDriver); ok {
+				metrics := sf.Metrics()
+				dhcr.SingleFlight = &metrics
+			}
+		}
+
+		//
+		// check that the datastore answers; every request needs it
+		//
+		if !quick {
+			if err := s.datastoreLiveness.check(); err != nil {
+				dhcr.Status = StatusUnreachable
+				dhcr.Reason = err.Error()
+			}
+		}
+
+		if dhcr.Status == StatusUnreachable {
+			hcr.Status = StatusDegraded
+		} else if dhcr.Status != StatusHealthy {
+			hcr.MarkUnhealthy()
+		}
+
+		hcr.DatastoreHealth = dhcr
+
+		if s.config.Leader != nil {
+			metrics := s.config.Leader.Metrics()
+			hcr.Leadership = &metrics
+		}
+
 		//
 		// prepare the response
 		//
@@ -148,10 +429,26 @@ func healthCheckHandler(config *Config) func(http.ResponseWriter, *http.Request)
 			return
 		}
 
+		// load balancers stop sending requests to instances which can't serve them
+		if hcr.Status == StatusDegraded {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
 		w.Write(data)
 	}
 }
 
+// jwksHandler publishes the public key verifying our tokens as a JWK Set, so
+// that other services can verify them without sharing a secret; the set is
+// empty unless tokens are signed with RS256.
+// it can return various HTTP status codes:
+//    200 (OK; the response contains the JWK Set)
+//    500 (internal server error)
+func jwksHandler(w http.ResponseWriter, req *http.Request) {
+	statusCode, resp := jwksHelper(auth.SigningPublicKey())
+	processStatusCodes(statusCode, resp, w)
+}
+
 // VersionResponse represents a response from the /version endpoint
 type VersionResponse struct {
 	Version string `json:"version"`
@@ -174,6 +471,135 @@ func versionHandler(version string) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+// reloadSettings re-reads the global settings from all the configuration
+// sources, the same way as receiving a SIGHUP does.
+// it can return various HTTP status codes:
+//    200 (settings reloaded; the response lists changed and ignored settings)
+//    400 (the new settings are invalid or could not be read; nothing was changed)
+func reloadSettings(w http.ResponseWriter, req *http.Request) {
+	result, err := common.ReloadSettings()
+	if err != nil {
+		processStatusCodes(http.StatusBadRequest, []byte("Failed to reload settings: "+err.Error()), w)
+		return
+	}
+
+	jsonResult, err := json.Marshal(result)
+	if err != nil {
+		serverError(w, errors.New("Failed to marshal reload result: "+err.Error()))
+		return
+	}
+
+	processStatusCodes(http.StatusOK, jsonResult, w)
+}
+
+// authenticatedOnly takes a HTTP handler and ensures that the client sent a valid token
+// before handling the request.
+func authenticatedOnly(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if _, valid := validateToken(w, req); valid {
+			handler(w, req)
+		}
+	}
+}
+
+// managementNetworkOnly takes a HTTP handler and rejects requests from clients
+// outside of the management network with a 403 before anything else is done.
+// Login requests are let through unless common.ManagementLoginRestricted().
+// The response carries no details so as not to reveal the configured networks.
+func managementNetworkOnly(isLogin bool, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if isLogin && !common.ManagementLoginRestricted() {
+			handler(w, req)
+			return
+		}
+
+		clientIP := common.RealIP(req)
+		if !common.ManagementAccessAllowed(clientIP) {
+			log.Warnf("forbidden: %s %s from %s which is outside of the management network", req.Method, req.URL.Path, clientIP)
+
+			writeError(w, http.StatusForbidden, types.ErrorCodeForbidden, "Forbidden", nil)
+			return
+		}
+
+		handler(w, req)
+	}
+}
+
+// introspectionCallerOnly takes a HTTP handler and ensures that the caller authenticated
+// with the introspection credential (HTTP basic auth) or an admin token before
+// handling the request. Anonymous requests are rejected with a 401.
+func introspectionCallerOnly(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		clientID, secret, hasCredential := req.BasicAuth()
+		tokenStr, _, tokenErr := tokenFromHeaders(req.Header)
+
+		switch {
+		case hasCredential:
+			if !validIntrospectionCredential(clientID, secret) {
+				log.Errorf("unauthorized: invalid introspection credential from %s", common.RealIP(req))
+
+				w.Header().Set("WWW-Authenticate", `Basic realm="auth_proxy"`)
+				processStatusCodes(http.StatusUnauthorized, []byte("invalid introspection credential"), w)
+				return
+			}
+
+			handler(w, req)
+
+		case common.IsEmpty(tokenStr) && tokenErr == nil: // conflicting tokens are rejected by adminOnly()
+			w.Header().Set("WWW-Authenticate", `Basic realm="auth_proxy"`)
+			processStatusCodes(http.StatusUnauthorized, []byte("introspection credential or admin token required"), w)
+
+		default:
+			adminOnly(handler)(w, req)
+		}
+	}
+}
+
+// rateLimited takes a HTTP handler and rejects requests from client IPs which
+// exceed the rate returned by `limit` with a 429.
+func rateLimited(limiter *common.RateLimiter, limit func() float64, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rate := limit()
+		limiter.SetLimit(rate, int(math.Ceil(rate)))
+
+		clientIP := common.RealIP(req)
+		if !limiter.Allow(clientIP) {
+			log.Warnf("rate limit exceeded for %s %s by %s", req.Method, req.URL.Path, clientIP)
+
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, types.ErrorCodeRateLimited, "Too many requests", map[string]string{"retry_after": "1"})
+			return
+		}
+
+		handler(w, req)
+	}
+}
+
+// introspectToken checks whether a token is currently valid and describes it (see RFC 7662).
+// it can return various HTTP status codes:
+//    200 (OK; the response describes the token, `active` is false for unusable tokens)
+//    400 (BadRequest; malformed request)
+//    401 (Unauthorized; no or invalid introspection credential)
+//    403 (Forbidden; the caller's token doesn't belong to an admin)
+//    429 (TooManyRequests; rate limit exceeded)
+//    500 (internal server error)
+func introspectToken(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	introspectionReq := &IntrospectionRequest{}
+	if err := json.Unmarshal(body, introspectionReq); err != nil {
+		processStatusCodes(http.StatusBadRequest, []byte("Failed to unmarshal introspection request from request body: "+err.Error()), w)
+		return
+	}
+
+	statusCode, resp := introspectTokenHelper(introspectionReq)
+	processStatusCodes(statusCode, resp, w)
+}
+
 // authorizedUserOnly takes a HTTP handler and ensures that the client's token has
 // enough privileges before handling the request.
 // if the client is not an admin or the user himself, the request attempt is logged and a 403 is returned.
@@ -188,7 +614,7 @@ func authorizedUserOnly(handler func(http.ResponseWriter, *http.Request)) func(h
 			// There is a possibility that the same username can exists in both local and LDAP systems.
 			// In such case, it's possible that one user(LDAP) can update/attempt to update the details of the other(local).
 			// To avoid such scenarios, LDAP users are represented by AD domain name (as username), this distinguishes local users from LDAP users.
-			if token.IsSuperuser() || vars["username"] == token.GetClaim(auth.UsernameClaimKey) {
+			if token.IsSuperuser() || common.SamePrincipal(vars["username"], token.GetClaim(auth.UsernameClaimKey)) {
 				handler(w, req)
 				return
 			}
@@ -229,14 +655,56 @@ func adminOnly(handler func(http.ResponseWriter, *http.Request)) func(http.Respo
 	}
 }
 
+// tenantAdminOnly takes a HTTP handler and ensures that the client's token has
+// admin or tenant admin privileges before allowing the handler to run its code.
+// if it has neither, the request attempt is logged and a 403 is returned.
+// handlers that are called must limit tenant admins to their own tenants.
+func tenantAdminOnly(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+
+		if token, valid := validateToken(w, req); valid {
+			// the role hierarchy includes admins
+			if err := token.CheckClaims(types.TenantAdmin); err != nil {
+				log.Error("unauthorized: caller doesn't have admin or tenant admin privileges")
+
+				processStatusCodes(http.StatusForbidden, []byte("access denied"), w)
+				return
+			}
+
+			handler(w, req)
+		}
+	}
+}
+
 // User management handler functions
 // These actions can only be performed by administrators.
 // They are protected at the router by the adminOnly() function above.
 
+// passwordFollowsPolicy checks a local user's new password against the
+// password policy, and writes a 400 listing the broken rules in its details if
+// it doesn't follow it.
+// params:
+//  w: http response writer
+//  username: name of the local user
+//  password: the new password
+// return values:
+//  bool: true if the password follows the policy; false if the response was written
+func passwordFollowsPolicy(w http.ResponseWriter, username, password string) bool {
+	violations := common.PasswordPolicyViolations(username, password)
+	if len(violations) == 0 {
+		return true
+	}
+
+	writeError(w, http.StatusBadRequest, types.ErrorCodePasswordPolicy, "The password doesn't follow the password policy", violations)
+	return false
+}
+
 // addLocalUser adds a new local user to the system.
 // it can return various HTTP status codes:
 //    201 (Created; user added to the system)
-//    400 (BadRequest; user exists in the system already/invalid role)
+//    400 (BadRequest; user exists in the system already/invalid role/the
+//         password breaks the password policy)
+//    409 (Conflict; a deleted user with the same name exists)
 //    500 (internal server error)
 func addLocalUser(w http.ResponseWriter, req *http.Request) {
 	body, err := ioutil.ReadAll(req.Body)
@@ -251,27 +719,100 @@ func addLocalUser(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !passwordFollowsPolicy(w, userCreateReq.Username, userCreateReq.Password) {
+		return
+	}
+
 	statusCode, resp := addLocalUserHelper(userCreateReq)
 	processStatusCodes(statusCode, resp, w)
 }
 
-// deleteLocalUser deletes the given user from the system.
+// addLocalUsers adds several local users at once, along with their roles;
+// either all of them are added, or none are. Given `dry_run=true`, they're only
+// validated.
+// it can return various HTTP status codes:
+//    200 (OK; dry run: the response lists the users, which could all be added)
+//    201 (Created; the response lists the added users in order)
+//    400 (BadRequest; some users are invalid, exist already or break the
+//         password policy; the error's details map their index to why)
+//    409 (Conflict; deleted users with the same names exist)
+//    500 (internal server error; the details name the user which couldn't be added)
+func addLocalUsers(w http.ResponseWriter, req *http.Request) {
+	defer common.Untrace(common.Trace())
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Warn("failed to parse request body for adding local users, err:", err)
+		serverError(w, auth_errors.ErrParsingRequest)
+		return
+	}
+
+	userReqs := []BulkLocalUserRequest{}
+	if err := json.Unmarshal(body, &userReqs); err != nil {
+		log.Warn("failed to unmarshal local users, err:", err)
+		authError(w, http.StatusBadRequest, types.ErrorCodeBadRequest, "expected a list of users")
+		return
+	}
+
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	dryRun := req.URL.Query().Get("dry_run") == "true"
+
+	statusCode, resp, details := addLocalUsersHelper(userReqs, dryRun, token.GetClaim(auth.UsernameClaimKey))
+	if details != nil {
+		writeError(w, statusCode, errorCode(statusCode), string(resp), details)
+		return
+	}
+
+	processStatusCodes(statusCode, resp, w)
+}
+
+// deleteLocalUser deletes the given user from the system. The user is only
+// flagged as deleted and can be restored, unless `hard=true` is given.
 // it can return various HTTP status codes:
-//    200 (OK; user deleted from the system)
+//    204 (NoContent; user deleted from the system)
 //    404 (NotFound; username not found)
 //    400 (BadRequest; cannot delete  built-in users)
+//    409 (Conflict; the user is the last admin)
 //    500 (internal server error)
 func deleteLocalUser(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 
-	statusCode, resp := deleteLocalUserHelper(vars["username"])
+	statusCode, resp := deleteLocalUserHelper(vars["username"], req.URL.Query().Get("hard") == "true")
+	processStatusCodes(statusCode, resp, w)
+}
+
+// restoreLocalUser restores a deleted user along with its authorizations.
+// it can return various HTTP status codes:
+//    200 (OK; user restored)
+//    404 (NotFound; username not found)
+//    409 (Conflict; user is not deleted)
+//    500 (internal server error)
+func restoreLocalUser(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	statusCode, resp := restoreLocalUserHelper(vars["username"])
 	processStatusCodes(statusCode, resp, w)
 }
 
 // updateLocalUser updates the existing user with the given details.
+// only admins can change `disable`, `password_expiry_exempt` and `password_reset_required`,
+// and disable MFA with `"mfa_enabled": false`, e.g. for a user who lost their
+// device; MFA is only enabled through enrollment. Callers with a password change
+// token have to change the password. Users setting their own password clear
+// `password_reset_required`.
 // it can return various HTTP status codes:
 //    204 (NoContent; update was successful)
+//    400 (BadRequest; no new password was given with a password change token,
+//         the new password breaks the password policy, or `mfa_enabled` is true)
+//    403 (Forbidden; a non-admin tried to change `disable`, `password_expiry_exempt`,
+//         `password_reset_required` or `mfa_enabled`)
 //    404 (NotFound; user not found)
+//    409 (Conflict; the user is the last admin and was to be disabled)
 //    500 (internal server error)
 func updateLocalUser(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
@@ -288,40 +829,178 @@ func updateLocalUser(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	statusCode, resp := updateLocalUserHelper(vars["username"], userUpdateReq)
-	processStatusCodes(statusCode, resp, w)
-}
+	// tells missing flags apart from false
+	flagsReq := &localUserFlagsRequest{}
+	if err := json.Unmarshal(body, flagsReq); err != nil {
+		serverError(w, errors.New("Failed to unmarshal user info. from request body: "+err.Error()))
+		return
+	}
 
-// getLocalUsers returns all the local users available in the system
-// it can return various HTTP status codes:
-//    200 (OK; fetch was successful)
-//    500 (internal server error)
-func getLocalUsers(w http.ResponseWriter, req *http.Request) {
-	statusCode, resp := getLocalUsersHelper()
-	processStatusCodes(statusCode, resp, w)
-}
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
 
-// getLocalUser returns the details for the given username
+	if token.PasswordChangeOnly() && common.IsEmpty(userUpdateReq.Password) {
+		processStatusCodes(http.StatusBadRequest, []byte("A new password must be provided"), w)
+		return
+	}
+
+	if !common.IsEmpty(userUpdateReq.Password) && !passwordFollowsPolicy(w, vars["username"], userUpdateReq.Password) {
+		return
+	}
+
+	if flagsReq.MFAEnabled != nil && *flagsReq.MFAEnabled {
+		processStatusCodes(http.StatusBadRequest, []byte("MFA can only be enabled through enrollment"), w)
+		return
+	}
+
+	if !token.IsSuperuser() && !localUserFlagsUnchanged(vars["username"], flagsReq) {
+		log.Error("unauthorized: only admins can disable users and change password expiry exemptions and resets")
+		processStatusCodes(http.StatusForbidden, []byte("access denied"), w)
+		return
+	}
+
+	// the user chose a new password, so there's nothing left to reset
+	if !common.IsEmpty(userUpdateReq.Password) && common.SamePrincipal(token.GetClaim(auth.UsernameClaimKey), vars["username"]) {
+		reset := false
+		flagsReq.PasswordResetRequired = &reset
+	}
+
+	statusCode, resp := updateLocalUserHelper(vars["username"], userUpdateReq, flagsReq)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// localUserFlagsUnchanged checks whether a local user update leaves the admin-only
+// `disable`, `password_expiry_exempt`, `password_reset_required` and `mfa_enabled` alone.
+// Non-admins may send the current values back, e.g. after fetching their user;
+// those are dropped from the update.
+// params:
+//  username: of the user to be updated
+//  flags: values given in the update; nil if not given
+// return values:
+//  bool: false if the update changes either of them
+func localUserFlagsUnchanged(username string, flags *localUserFlagsRequest) bool {
+	if flags.Disable == nil && flags.PasswordExpiryExempt == nil && flags.PasswordResetRequired == nil && flags.MFAEnabled == nil {
+		return true
+	}
+
+	user, err := db.GetLocalUser(username)
+	if err != nil { // left to updateLocalUserHelper()
+		return true
+	}
+
+	if flags.Disable != nil && user.Disable != *flags.Disable {
+		return false
+	}
+
+	if flags.PasswordExpiryExempt != nil && user.PasswordExpiryExempt != *flags.PasswordExpiryExempt {
+		return false
+	}
+
+	if flags.PasswordResetRequired != nil && user.PasswordResetRequired != *flags.PasswordResetRequired {
+		return false
+	}
+
+	if flags.MFAEnabled != nil && user.MFAEnabled != *flags.MFAEnabled {
+		return false
+	}
+
+	flags.Disable, flags.PasswordExpiryExempt, flags.PasswordResetRequired, flags.MFAEnabled = nil, nil, nil, nil
+	return true
+}
+
+// getLocalUsers returns all the local users available in the system, sorted
+// by username; deleted users are only listed if `include_deleted=true` is
+// given, and `inactive_since=<duration>` (e.g. 90d or 2160h) only lists the
+// users who haven't logged in for that long. They can also be filtered by
+// `username_contains` and `role`, and paginated; see localUserListFilter.
+// Given `include=authorizations`, each user comes with the authorizations
+// granted to it which the caller can see.
+// it can return various HTTP status codes:
+//    200 (OK; fetch was successful)
+//    400 (BadRequest; invalid or unknown parameter, or unknown role)
+//    500 (internal server error)
+func getLocalUsers(w http.ResponseWriter, req *http.Request) {
+	filter, err := parseLocalUserListFilter(req.URL.Query(), time.Now())
+	if err != nil {
+		authError(w, http.StatusBadRequest, types.ErrorCodeBadRequest, err.Error())
+		return
+	}
+
+	scope, err := newTenantAdminScope(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	statusCode, resp, total := getLocalUsersHelper(filter, scope)
+	if statusCode == http.StatusOK {
+		w.Header().Set(totalCountHeader, strconv.Itoa(total))
+	}
+
+	processStatusCodes(statusCode, resp, w)
+}
+
+// parseDays parses a positive duration given either in days, e.g. 90d, or as
+// understood by time.ParseDuration(), e.g. 2160h
+func parseDays(value string) (time.Duration, error) {
+	var duration time.Duration
+
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.ParseInt(strings.TrimSuffix(value, "d"), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		duration = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		if duration, err = time.ParseDuration(value); err != nil {
+			return 0, err
+		}
+	}
+
+	if duration <= 0 {
+		return 0, fmt.Errorf("duration %q isn't positive", value)
+	}
+
+	return duration, nil
+}
+
+// getLocalUser returns the details for the given username, along with its
+// authorizations if `include=authorizations` is given
 // it can return various HTTP status codes:
 //  200 (OK; fetch was successful)
+//  400 (BadRequest; invalid `include`)
 //  404 (NotFound; bad request; user not found)
 //  500 (internal server error)
 func getLocalUser(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 
-	statusCode, resp := getLocalUserHelper(vars["username"])
+	withAuthorizations, err := parseInclude(req.URL.Query())
+	if err != nil {
+		authError(w, http.StatusBadRequest, types.ErrorCodeBadRequest, err.Error())
+		return
+	}
+
+	statusCode, resp := getLocalUserHelper(vars["username"], withAuthorizations)
 	processStatusCodes(statusCode, resp, w)
 }
 
 // Authorization handler functions
-// These actions can only be performed by administrators.
-// They are protected at the router by the adminOnly() function above.
+// These actions can be performed by administrators and, for the tenants they
+// administer, by tenant admins. They are protected at the router by the
+// tenantAdminOnly() function above and check the caller's tenants themselves.
 
 //
 // addAuthorization adds an authorization
 // Returns these HTTP status codes:
 //    201 (authz added)
-//    400 (attempted to add authorization to built-in local admin user)
+//    400 (attempted to add authorization to built-in local admin user,
+//         expiry time in the past, or unknown custom role)
+//    403 (tenant admin granting admin, a custom role or a role on another tenant)
 //    500 (internal server error)
 //
 func addAuthorization(w http.ResponseWriter, req *http.Request) {
@@ -346,42 +1025,35 @@ func addAuthorization(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// input validation
-	if common.IsEmpty(addAuthzReq.PrincipalName) {
-		log.Warnf("principal name missing from authorization: %#v", addAuthzReq)
-
-		httpStatus = http.StatusBadRequest
-		httpResponse = []byte("principal name is missing")
+	scope, err := newTenantAdminScope(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
 
+	// roles which aren't built-in are custom roles
+	if _, err := types.Role(addAuthzReq.Role); err != nil && !common.IsEmpty(addAuthzReq.Role) {
+		httpStatus, httpResponse = addCustomRoleAuthorizationHelper(scope, addAuthzReq)
 		processStatusCodes(httpStatus, httpResponse, w)
 		return
 	}
 
-	role, err := types.Role(addAuthzReq.Role)
+	// input validation
+	grant, err := parseGrant(addAuthzReq)
 	if err != nil {
-		log.Warnf("illegal role specified in authorization: %#v", addAuthzReq)
-
-		httpStatus = http.StatusBadRequest
-		httpResponse = []byte("illegal role specified")
-
-		processStatusCodes(httpStatus, httpResponse, w)
+		log.Warnf("%s in authorization: %#v", err.Error(), addAuthzReq)
+		processStatusCodes(http.StatusBadRequest, []byte(err.Error()), w)
 		return
 	}
 
-	// If role specific is ops, a tenant name must be specified
-	if role == types.Ops && common.IsEmpty(addAuthzReq.TenantName) {
-		log.Warnf("ops role without specifying tenant in authorization: %#v", addAuthzReq)
-
-		httpStatus = http.StatusBadRequest
-		httpResponse = []byte("ops role requires a tenant to be specified")
-
-		processStatusCodes(httpStatus, httpResponse, w)
+	if status, resp := scope.checkGrant(grant.Role, grant.TenantName, grant.PrincipalName); status != http.StatusOK {
+		processStatusCodes(status, resp, w)
 		return
 	}
 
 	// invoke helper to add authz
-	authz, err := auth.AddAuthorization(addAuthzReq.TenantName,
-		role, addAuthzReq.PrincipalName, addAuthzReq.Local)
+	authz, err := auth.AddAuthorization(grant.TenantName,
+		grant.Role, grant.PrincipalName, grant.Local, grant.ExpiresAt, scope.username())
 	switch err {
 	case nil:
 
@@ -419,7 +1091,8 @@ func addAuthorization(w http.ResponseWriter, req *http.Request) {
 	processStatusCodes(httpStatus, httpResponse, w)
 }
 
-// deleteAuthorization deletes an authorization
+// deleteAuthorization deletes an authorization; the admin authorization of
+// the last admin can't be deleted (409).
 func deleteAuthorization(w http.ResponseWriter, req *http.Request) {
 
 	defer common.Untrace(common.Trace())
@@ -431,8 +1104,15 @@ func deleteAuthorization(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	authzUUID := vars["authzUUID"]
 
+	if status, resp := checkAuthorizationScope(req, authzUUID, "deleting"); status != http.StatusOK {
+		processStatusCodes(status, resp, w)
+		return
+	}
+
 	// invoke helper to delete authz
-	err := auth.DeleteAuthorization(authzUUID)
+	err := auth.GuardLastAdmin(withUUID(authzUUID), func() error {
+		return auth.DeleteAuthorization(authzUUID)
+	})
 	switch err {
 	case nil:
 		httpStatus = http.StatusNoContent
@@ -443,6 +1123,12 @@ func deleteAuthorization(w http.ResponseWriter, req *http.Request) {
 	case auth_errors.ErrIllegalOperation:
 		httpStatus = http.StatusBadRequest
 		httpResponse = []byte(err.Error())
+	case auth_errors.ErrLastAdmin:
+		httpStatus = http.StatusConflict
+		httpResponse = []byte(fmt.Sprintf("Cannot delete authorization %q of the last admin", authzUUID))
+	case auth_errors.ErrConcurrentUpdate: // from auth.GuardLastAdmin()
+		httpStatus = http.StatusConflict
+		httpResponse = []byte(fmt.Sprintf("Another proxy is removing an admin; retry deleting authorization %q", authzUUID))
 	default:
 		httpStatus = http.StatusInternalServerError
 		httpResponse = []byte(err.Error())
@@ -453,6 +1139,38 @@ func deleteAuthorization(w http.ResponseWriter, req *http.Request) {
 
 }
 
+// updateAuthorization changes the expiry time of an authorization.
+// it can return various HTTP codes:
+//    200 (OK; authz updated)
+//    400 (BadRequest; built-in local admin user, or expiry time in the past)
+//    404 (NotFound; authz not found)
+//    409 (Conflict; the authorization changed concurrently, or an expiry was
+//         set on the admin authorization of the last admin)
+//    500 (internal server error)
+func updateAuthorization(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	updateAuthzReq := &UpdateAuthorizationRequest{}
+	if err := json.Unmarshal(body, updateAuthzReq); err != nil {
+		serverError(w, errors.New("Failed to unmarshal authorization from request body: "+err.Error()))
+		return
+	}
+
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	vars := mux.Vars(req)
+	statusCode, resp := updateAuthorizationHelper(vars["authzUUID"], updateAuthzReq, token.GetClaim(auth.UsernameClaimKey))
+	processStatusCodes(statusCode, resp, w)
+}
+
 // getAuthorization returns the specified authorization
 func getAuthorization(w http.ResponseWriter, req *http.Request) {
 
@@ -465,6 +1183,11 @@ func getAuthorization(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	authzUUID := vars["authzUUID"]
 
+	if status, resp := checkAuthorizationScope(req, authzUUID, "reading"); status != http.StatusOK {
+		processStatusCodes(status, resp, w)
+		return
+	}
+
 	// invoke helper to get authz
 	authz, err := auth.GetAuthorization(authzUUID)
 	switch err {
@@ -494,7 +1217,72 @@ func getAuthorization(w http.ResponseWriter, req *http.Request) {
 
 }
 
-// listAuthorization lists all authorizations
+// addAuthorizations adds several authorizations at once; either all of them
+// are added, or none are.
+// it can return various HTTP status codes:
+//    201 (Created; the response contains the added authorizations in order)
+//    400 (BadRequest; some authorizations are invalid or exist already; the
+//         error's details map their index to why)
+//    403 (Forbidden; a tenant admin tried to grant roles out of their tenants)
+//    500 (internal server error; the details name the authorization which
+//         couldn't be added)
+func addAuthorizations(w http.ResponseWriter, req *http.Request) {
+	defer common.Untrace(common.Trace())
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Warn("failed to parse request body for adding authorizations, err:", err)
+		serverError(w, auth_errors.ErrParsingRequest)
+		return
+	}
+
+	addAuthzReqs := []AddAuthorizationRequest{}
+	if err := json.Unmarshal(body, &addAuthzReqs); err != nil {
+		log.Warn("failed to unmarshal authorizations, err:", err)
+		authError(w, http.StatusBadRequest, types.ErrorCodeBadRequest, "expected a list of authorizations")
+		return
+	}
+
+	scope, err := newTenantAdminScope(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	statusCode, resp, details := addAuthorizationsHelper(scope, addAuthzReqs)
+	if details != nil {
+		writeError(w, statusCode, errorCode(statusCode), string(resp), details)
+		return
+	}
+
+	processStatusCodes(statusCode, resp, w)
+}
+
+// deleteAuthorizations deletes all the authorizations of a principal; they're
+// selected by the same filters as listAuthorizations(), of which
+// `principal_name` is required.
+// it can return various HTTP status codes:
+//    200 (OK; the response lists the deleted authorizations, if any)
+//    400 (BadRequest; `principal_name` is missing or a filter is invalid)
+//    500 (internal server error)
+//    503 (ServiceUnavailable; the datastore is unavailable)
+func deleteAuthorizations(w http.ResponseWriter, req *http.Request) {
+	defer common.Untrace(common.Trace())
+
+	filter, err := parseAuthzListFilter(req.URL.Query())
+	if err != nil {
+		authError(w, http.StatusBadRequest, types.ErrorCodeBadRequest, err.Error())
+		return
+	}
+
+	statusCode, resp := deleteAuthorizationsHelper(filter)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// listAuthorization lists all authorizations; only expired (or only active)
+// authorizations are listed if `expired=true` (or `expired=false`) is given.
+// They can also be filtered by `principal_name`, `principal_type` ("local" or
+// "ldap") and `tenant`; see authzListFilter.
 func listAuthorizations(w http.ResponseWriter, req *http.Request) {
 
 	defer common.Untrace(common.Trace())
@@ -502,21 +1290,38 @@ func listAuthorizations(w http.ResponseWriter, req *http.Request) {
 	var httpStatus int
 	var httpResponse []byte
 
+	filter, err := parseAuthzListFilter(req.URL.Query())
+	if err != nil {
+		authError(w, http.StatusBadRequest, types.ErrorCodeBadRequest, err.Error())
+		return
+	}
+
+	scope, err := newTenantAdminScope(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
 	// invoke helper to get authz
 	authzList, err := auth.ListAuthorizations()
 	switch err {
 	case nil:
 		httpStatus = http.StatusOK
 
-		// convert authorizations to authorization reply msgs
+		// convert authorizations to authorization reply msgs; tenant admins
+		// only see the authorizations of the tenants they administer
 		authzReplyList := []GetAuthorizationReply{}
 		for _, authz := range authzList {
 			authzReply := convertAuthz(authz)
-			authzReplyList = append(authzReplyList, authzReply)
+			if scope.allows(authzReply.TenantName) && filter.matches(authzReply) {
+				authzReplyList = append(authzReplyList, authzReply)
+			}
 		}
+		filter.order(authzReplyList)
+		w.Header().Set(totalCountHeader, strconv.Itoa(len(authzReplyList)))
 
 		// convert authorization reply list to JSON
-		jsonAuthzReplyList, err := json.Marshal(authzReplyList)
+		jsonAuthzReplyList, err := json.Marshal(filter.page(authzReplyList))
 		if err != nil {
 			httpStatus = http.StatusInternalServerError
 			httpResponse = []byte(err.Error())
@@ -603,3 +1408,542 @@ func updateLdapConfiguration(w http.ResponseWriter, req *http.Request) {
 	processStatusCodes(statusCode, resp, w)
 
 }
+
+// testLdapConfiguration tests the stored or the given LDAP configuration
+// without saving anything.
+// it can return various HTTP codes:
+//    200 (OK; the test ran, see the result for how far it got)
+//    400 (BadRequest; invalid configuration)
+//    404 (NotFound; no configuration given and none stored)
+//    500 (internal server error)
+func testLdapConfiguration(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	testReq := &LdapConfigurationTestRequest{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, testReq); err != nil {
+			serverError(w, errors.New("Failed to unmarshal LDAP test request from request body: "+err.Error()))
+			return
+		}
+	}
+
+	statusCode, resp := testLdapConfigurationHelper(testReq)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// searchLdapGroups searches the LDAP/AD groups whose CN contains the `query`
+// parameter, or whose DN it is.
+// it can return various HTTP codes:
+//    200 (OK; see the result for the groups found)
+//    400 (BadRequest; no query given)
+//    404 (NotFound; configuration not found)
+//    502 (BadGateway; the directory couldn't be reached)
+//    500 (internal server error)
+func searchLdapGroups(w http.ResponseWriter, req *http.Request) {
+	statusCode, resp := searchLdapGroupsHelper(req.URL.Query().Get("query"))
+	processStatusCodes(statusCode, resp, w)
+}
+
+// debugPrincipal resolves the DN, groups, roles and matched authorizations of
+// the given LDAP user live, to troubleshoot why the user gets (or doesn't get)
+// some access.
+// it can return various HTTP codes:
+//    200 (OK; see the result for how the user's roles are resolved)
+//    404 (NotFound; configuration or user not found, or the user has no groups)
+//    502 (BadGateway; the directory couldn't be reached)
+//    500 (internal server error)
+func debugPrincipal(w http.ResponseWriter, req *http.Request) {
+	statusCode, resp := debugPrincipalHelper(mux.Vars(req)["name"])
+	processStatusCodes(statusCode, resp, w)
+}
+
+// reencryptLdapConfiguration re-encrypts the LDAP service account password
+// with the current TLS key if it's encrypted with a previous one.
+// it can return various HTTP codes:
+//    200 (OK; see the result for whether it was re-encrypted)
+//    404 (NotFound; configuration not found)
+//    500 (internal server error, e.g. none of the TLS keys decrypts it)
+func reencryptLdapConfiguration(w http.ResponseWriter, req *http.Request) {
+	statusCode, resp := reencryptLdapConfigurationHelper()
+	processStatusCodes(statusCode, resp, w)
+}
+
+// Endpoint policy management handler functions
+// These actions can only be performed by administrators.
+// They are protected at the router by the adminOnly() function above.
+
+// getEndpointPolicyRules returns all the endpoint policy rules.
+// it can return various HTTP status codes:
+//    200 (OK; fetch was successful)
+//    500 (internal server error)
+func getEndpointPolicyRules(w http.ResponseWriter, req *http.Request) {
+	statusCode, resp := getEndpointPolicyRulesHelper()
+	processStatusCodes(statusCode, resp, w)
+}
+
+// getEndpointPolicyRule returns the given endpoint policy rule.
+// it can return various HTTP status codes:
+//    200 (OK; fetch was successful)
+//    404 (NotFound; rule not found)
+//    500 (internal server error)
+func getEndpointPolicyRule(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	statusCode, resp := getEndpointPolicyRuleHelper(vars["ruleID"])
+	processStatusCodes(statusCode, resp, w)
+}
+
+// addEndpointPolicyRule adds a new endpoint policy rule.
+// it can return various HTTP status codes:
+//    201 (Created; rule added)
+//    400 (BadRequest; invalid rule)
+//    500 (internal server error)
+func addEndpointPolicyRule(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	rule := &types.EndpointPolicyRule{}
+	if err := json.Unmarshal(body, rule); err != nil {
+		serverError(w, errors.New("Failed to unmarshal endpoint policy rule from request body: "+err.Error()))
+		return
+	}
+
+	statusCode, resp := addEndpointPolicyRuleHelper(rule)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// updateEndpointPolicyRule replaces the given endpoint policy rule.
+// it can return various HTTP status codes:
+//    200 (OK; rule updated)
+//    400 (BadRequest; invalid rule)
+//    404 (NotFound; rule not found)
+//    500 (internal server error)
+func updateEndpointPolicyRule(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	rule := &types.EndpointPolicyRule{}
+	if err := json.Unmarshal(body, rule); err != nil {
+		serverError(w, errors.New("Failed to unmarshal endpoint policy rule from request body: "+err.Error()))
+		return
+	}
+
+	statusCode, resp := updateEndpointPolicyRuleHelper(vars["ruleID"], rule)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// deleteEndpointPolicyRule deletes the given endpoint policy rule.
+// it can return various HTTP status codes:
+//    204 (NoContent; rule deleted)
+//    404 (NotFound; rule not found)
+//    500 (internal server error)
+func deleteEndpointPolicyRule(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	statusCode, resp := deleteEndpointPolicyRuleHelper(vars["ruleID"])
+	processStatusCodes(statusCode, resp, w)
+}
+
+// endpointPolicyDryRun answers whether a user would be allowed to access a netmaster endpoint.
+// it can return various HTTP status codes:
+//    200 (OK; the response contains the decision)
+//    400 (BadRequest; user, method or path missing)
+//    500 (internal server error)
+func endpointPolicyDryRun(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	dryRunReq := &EndpointPolicyDryRunRequest{}
+	if err := json.Unmarshal(body, dryRunReq); err != nil {
+		serverError(w, errors.New("Failed to unmarshal dry run request from request body: "+err.Error()))
+		return
+	}
+
+	statusCode, resp := endpointPolicyDryRunHelper(dryRunReq)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// Custom role management handler functions
+// These actions can only be performed by administrators.
+// They are protected at the router by the adminOnly() function above.
+
+// getCustomRoles returns all the custom roles.
+// it can return various HTTP status codes:
+//    200 (OK; fetch was successful)
+//    500 (internal server error)
+func getCustomRoles(w http.ResponseWriter, req *http.Request) {
+	statusCode, resp := getCustomRolesHelper()
+	processStatusCodes(statusCode, resp, w)
+}
+
+// getCustomRole returns the given custom role.
+// it can return various HTTP status codes:
+//    200 (OK; fetch was successful)
+//    404 (NotFound; role not found)
+//    500 (internal server error)
+func getCustomRole(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	statusCode, resp := getCustomRoleHelper(vars["roleName"])
+	processStatusCodes(statusCode, resp, w)
+}
+
+// addCustomRole adds a new custom role.
+// it can return various HTTP status codes:
+//    201 (Created; role added)
+//    400 (BadRequest; invalid role, or a role with the same name exists)
+//    500 (internal server error)
+func addCustomRole(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	role := &types.CustomRole{}
+	if err := json.Unmarshal(body, role); err != nil {
+		serverError(w, errors.New("Failed to unmarshal custom role from request body: "+err.Error()))
+		return
+	}
+
+	statusCode, resp := addCustomRoleHelper(role)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// deleteCustomRole deletes the given custom role.
+// it can return various HTTP status codes:
+//    204 (NoContent; role deleted)
+//    400 (BadRequest; built-in role)
+//    404 (NotFound; role not found)
+//    409 (Conflict; the role is still granted)
+//    500 (internal server error)
+func deleteCustomRole(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	statusCode, resp := deleteCustomRoleHelper(vars["roleName"])
+	processStatusCodes(statusCode, resp, w)
+}
+
+// whoami describes the caller; it's available to users who have to change their password.
+// it can return various HTTP status codes:
+//    200 (OK; the response describes the caller)
+//    500 (internal server error)
+func whoami(w http.ResponseWriter, req *http.Request) {
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	statusCode, resp := whoamiHelper(token)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// me describes the caller's identity and permissions, so that the UI can show
+// what the caller is allowed to do; no privileges are needed as only the
+// caller's own data is returned.
+// it can return various HTTP status codes:
+//    200 (OK; the response describes the caller)
+//    500 (internal server error)
+func me(w http.ResponseWriter, req *http.Request) {
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	statusCode, resp := meHelper(token)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// listSessions lists the sessions which haven't expired yet; admins get all
+// the sessions, everyone else only their own.
+// it can return various HTTP status codes:
+//    200 (OK; the response contains the sessions)
+//    500 (internal server error)
+//    503 (ServiceUnavailable; the datastore is unavailable)
+func listSessions(w http.ResponseWriter, req *http.Request) {
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	statusCode, resp := listSessionsHelper(token)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// deleteSession revokes the token of a session and deletes the session; admins
+// can revoke any session, everyone else only their own.
+// it can return various HTTP status codes:
+//    204 (NoContent; the session was revoked)
+//    404 (NotFound; there's no such session, or it's someone else's)
+//    500 (internal server error)
+//    503 (ServiceUnavailable; the datastore is unavailable)
+func deleteSession(w http.ResponseWriter, req *http.Request) {
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	statusCode, resp := deleteSessionHelper(token, mux.Vars(req)["id"])
+	processStatusCodes(statusCode, resp, w)
+}
+
+// revokeUserSessions revokes every token issued to the user (or principal)
+// given as `?username=` so far, e.g. when off-boarding someone, and deletes the
+// user's sessions and personal access tokens.
+// it can return various HTTP status codes:
+//    200 (OK; the response summarizes what was revoked)
+//    400 (BadRequest; no username was given)
+//    500 (internal server error)
+//    503 (ServiceUnavailable; the datastore is unavailable)
+func revokeUserSessions(w http.ResponseWriter, req *http.Request) {
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	statusCode, resp := revokeUserSessionsHelper(token, req.URL.Query().Get("username"))
+	processStatusCodes(statusCode, resp, w)
+}
+
+// addAccessToken creates a personal access token with the caller's role and
+// tenants; its value is only part of this response. Access tokens can't be
+// used to create further access tokens.
+// it can return various HTTP status codes:
+//    201 (Created; the response contains the new token)
+//    400 (BadRequest; the name is missing or the caller used an access token)
+//    500 (internal server error)
+//    503 (ServiceUnavailable; the datastore is unavailable)
+func addAccessToken(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	addReq := &addAccessTokenRequest{}
+	if err := json.Unmarshal(body, addReq); err != nil {
+		authError(w, http.StatusBadRequest, types.ErrorCodeBadRequest, "Failed to unmarshal access token request: "+err.Error())
+		return
+	}
+
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	statusCode, resp := addAccessTokenHelper(token, addReq)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// listAccessTokens lists the personal access tokens without revealing them;
+// admins get all the access tokens, everyone else only their own.
+// it can return various HTTP status codes:
+//    200 (OK; the response contains the access tokens)
+//    500 (internal server error)
+//    503 (ServiceUnavailable; the datastore is unavailable)
+func listAccessTokens(w http.ResponseWriter, req *http.Request) {
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	statusCode, resp := listAccessTokensHelper(token)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// deleteAccessToken revokes a personal access token; admins can revoke any
+// access token, everyone else only their own.
+// it can return various HTTP status codes:
+//    204 (NoContent; the access token was revoked)
+//    404 (NotFound; there's no such access token, or it's someone else's)
+//    500 (internal server error)
+//    503 (ServiceUnavailable; the datastore is unavailable)
+func deleteAccessToken(w http.ResponseWriter, req *http.Request) {
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	statusCode, resp := deleteAccessTokenHelper(token, mux.Vars(req)["id"])
+	processStatusCodes(statusCode, resp, w)
+}
+
+// getLoginAudit lists the login audit records, oldest first; they can be
+// filtered by `since` (seconds since the epoch) and `username`.
+// it can return various HTTP status codes:
+//    200 (OK; the response contains the records)
+//    400 (BadRequest; `since` is not a number)
+//    500 (internal server error)
+//    503 (ServiceUnavailable; the datastore is unavailable)
+func getLoginAudit(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	since := int64(0)
+	if value := query.Get("since"); !common.IsEmpty(value) {
+		var err error
+		if since, err = strconv.ParseInt(value, 10, 64); err != nil {
+			authError(w, http.StatusBadRequest, types.ErrorCodeBadRequest, "since must be a time in seconds since the epoch")
+			return
+		}
+	}
+
+	statusCode, resp := getLoginAuditHelper(since, query.Get("username"))
+	processStatusCodes(statusCode, resp, w)
+}
+
+// enrollMFA generates a new TOTP secret for the calling local user, who then has
+// to confirm it with a one-time password (see confirmMFA) before MFA is enabled.
+// Enrolling again before confirming replaces the secret.
+// it can return various HTTP status codes:
+//    200 (OK; the response contains the secret)
+//    400 (BadRequest; the caller isn't a local user or used an access token)
+//    409 (Conflict; MFA is enabled already)
+//    500 (internal server error)
+//    503 (ServiceUnavailable; the datastore is unavailable)
+func enrollMFA(w http.ResponseWriter, req *http.Request) {
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	statusCode, resp := enrollMFAHelper(token)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// confirmMFA enables MFA for the calling local user, given a valid one-time
+// password derived from the secret returned by enrollMFA. From then on, the
+// user has to log in with a one-time password as well.
+// it can return various HTTP status codes:
+//    204 (NoContent; MFA is enabled)
+//    400 (BadRequest; the one-time password is missing or wrong, the user
+//         hasn't enrolled, or the caller isn't a local user or used an access token)
+//    409 (Conflict; MFA is enabled already)
+//    500 (internal server error)
+//    503 (ServiceUnavailable; the datastore is unavailable)
+func confirmMFA(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	confirmReq := &confirmMFARequest{}
+	if err := json.Unmarshal(body, confirmReq); err != nil {
+		authError(w, http.StatusBadRequest, types.ErrorCodeBadRequest, "Failed to unmarshal MFA confirmation: "+err.Error())
+		return
+	}
+
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	statusCode, resp := confirmMFAHelper(token, confirmReq)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// listSigningKeys lists the IDs of the token signing keys which are accepted:
+// the current key and the retired ones which haven't expired yet.
+// it can return various HTTP status codes:
+//    200 (OK; the response contains the keys)
+//    500 (internal server error)
+//    503 (ServiceUnavailable; the datastore is unavailable)
+func listSigningKeys(w http.ResponseWriter, req *http.Request) {
+	statusCode, resp := listSigningKeysHelper()
+	processStatusCodes(statusCode, resp, w)
+}
+
+// rotateSigningKey replaces the token signing key with a new one; tokens signed
+// with the replaced key are accepted until they've expired.
+// it can return various HTTP status codes:
+//    201 (Created; the response lists the keys)
+//    400 (BadRequest; the key is held by the secrets backend or a key file)
+//    500 (internal server error)
+//    503 (ServiceUnavailable; the datastore is unavailable)
+func rotateSigningKey(w http.ResponseWriter, req *http.Request) {
+	statusCode, resp := rotateSigningKeyHelper()
+	processStatusCodes(statusCode, resp, w)
+}
+
+// retireSigningKey stops accepting a retired token signing key right away,
+// e.g. because it was compromised; the current key has to be rotated first.
+// it can return various HTTP status codes:
+//    204 (NoContent; the key is no longer accepted)
+//    400 (BadRequest; the key is the current key)
+//    404 (NotFound; there's no such retired key)
+//    500 (internal server error)
+//    503 (ServiceUnavailable; the datastore is unavailable)
+func retireSigningKey(w http.ResponseWriter, req *http.Request) {
+	statusCode, resp := retireSigningKeyHelper(mux.Vars(req)["id"])
+	processStatusCodes(statusCode, resp, w)
+}
+
+// getTenantStats returns the usage statistics of the tenants; admins get all
+// tenants, everyone else only the tenants they're authorized for.
+// it can return various HTTP status codes:
+//    200 (OK; the response contains the statistics)
+//    500 (internal server error)
+//    503 (ServiceUnavailable; the datastore is unavailable)
+func getTenantStats(w http.ResponseWriter, req *http.Request) {
+	token, err := requestToken(req)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	statusCode, resp := getTenantStatsHelper(token)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// purgePrincipal removes every trace of a principal: the local user, all its
+// authorizations, and all its tokens. The `purge=true` query parameter is required.
+// it can return various HTTP status codes:
+//    200 (OK; the response summarizes what was removed)
+//    400 (BadRequest; purge=true is missing, or a built-in user or the last admin was given)
+//    500 (internal server error)
+//    503 (ServiceUnavailable; the datastore is unavailable)
+func purgePrincipal(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("purge") != "true" {
+		processStatusCodes(http.StatusBadRequest, []byte("purge=true is required"), w)
+		return
+	}
+
+	statusCode, resp := purgePrincipalHelper(mux.Vars(req)["name"])
+	processStatusCodes(statusCode, resp, w)
+}
+
+// getRoutes lists all the routes served by the proxy along with who can access them.
+// it can return various HTTP status codes:
+//    200 (OK; the response contains the routes)
+//    500 (internal server error)
+func getRoutes(s *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		statusCode, resp := getRoutesHelper(s)
+		processStatusCodes(statusCode, resp, w)
+	}
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParseDays tests parsing of durations given in days or as Go durations
+func TestParseDays(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected time.Duration
+		valid    bool
+	}{
+		{"90d", 90 * 24 * time.Hour, true},
+		{"1d", 24 * time.Hour, true},
+		{"2160h", 90 * 24 * time.Hour, true},
+		{"30m", 30 * time.Minute, true},
+		{"0d", 0, false},
+		{"-1d", 0, false},
+		{"0s", 0, false},
+		{"d", 0, false},
+		{"1.5d", 0, false},
+		{"90", 0, false},
+		{"abc", 0, false},
+	}
+
+	for _, tc := range testCases {
+		duration, err := parseDays(tc.value)
+		if (err == nil) != tc.valid || duration != tc.expected {
+			t.Errorf("%q: expected %s (valid: %v), got %s (%v)", tc.value, tc.expected, tc.valid, duration, err)
+		}
+	}
+}
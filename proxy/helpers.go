@@ -1,15 +1,31 @@
 package proxy
 
 import (
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
+	"net"
 	"net/http"
+	"net/mail"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	log "github.com/Sirupsen/logrus"
+	uuid "github.com/satori/go.uuid"
 
 	"github.com/contiv/auth_proxy/auth"
+	"github.com/contiv/auth_proxy/auth/kubernetes"
+	"github.com/contiv/auth_proxy/auth/ldap"
+	"github.com/contiv/auth_proxy/auth/local"
 	"github.com/contiv/auth_proxy/common"
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
 	"github.com/contiv/auth_proxy/common/types"
@@ -22,9 +38,44 @@ var (
 	ipAddrPattern = "^(([01]?[0-9][0-9]?|2[0-4][0-9]|25[0-5])(.|$)){4}"
 	re            = regexp.MustCompile(ipAddrPattern)
 
-	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9\_\-\.\@]+$`)
+	// LDAP attribute and object class names (RFC 4512 descriptors)
+	ldapDescriptorPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*$`)
+
+	errInvalidUser  = errors.New("Invalid user")
+	errUserDisabled = errors.New("User account disabled")
+	errTokenRevoked = errors.New("Token revoked")
+
+	errConflictingTokens = errors.New("Authorization and X-Auth-Token headers carry different tokens")
+
+	errPasswordChangeRequired = errors.New("Password change required")
+
+	errDirectoryUnavailable = errors.New("LDAP/AD directory unavailable; try again later")
+)
+
+// directoryUnavailable returns the message of errors about the directory being
+// unavailable, naming the servers which couldn't be connected to.
+func directoryUnavailable() string {
+	failed := ldap.FailedServers()
+	if len(failed) == 0 {
+		return errDirectoryUnavailable.Error()
+	}
+
+	return fmt.Sprintf("%s (tried %s)", errDirectoryUnavailable, strings.Join(failed, ", "))
+}
+
+// caps on the optional profile fields of local users
+const (
+	maxEmailLength    = 254 // longest address which can be delivered to (RFC 5321)
+	maxFullNameLength = 128
+	maxLabels         = 16
+	maxLabelKeyLength = 63
+	maxLabelLength    = 256 // in bytes
 )
 
+// labelKeyRegex matches the keys of the labels of local users; they can't
+// contain `=`, which separates them from the value in `?label=key=value`
+var labelKeyRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._/-]*$`)
+
 // updateLdapConfigurationInfo helper function for `updateLdapConfigurationHelper`.
 // params:
 //  ldapConfiguration: configuration to be updated in the data store
@@ -35,13 +86,27 @@ var (
 //          this could be an error message or JSON response based on the execution flow or nil
 func updateLdapConfigurationInfo(ldapConfiguration *types.LdapConfiguration, actual *types.LdapConfiguration) (int, []byte) {
 	ldapConfigurationUpdateObj := &types.LdapConfiguration{
-		Server:                 actual.Server,
-		Port:                   actual.Port,
-		BaseDN:                 actual.BaseDN,
-		ServiceAccountDN:       actual.ServiceAccountDN,
-		ServiceAccountPassword: actual.ServiceAccountPassword,
-		StartTLS:               actual.StartTLS,
-		TLSCertIssuedTo:        actual.TLSCertIssuedTo,
+		Server:                   actual.Server,
+		Servers:                  actual.Servers,
+		Port:                     actual.Port,
+		BaseDN:                   actual.BaseDN,
+		ServiceAccountDN:         actual.ServiceAccountDN,
+		ServiceAccountPassword:   actual.ServiceAccountPassword,
+		StartTLS:                 actual.StartTLS,
+		UseLDAPS:                 actual.UseLDAPS,
+		TLSCertIssuedTo:          actual.TLSCertIssuedTo,
+		CACertificate:            actual.CACertificate,
+		UserObjectClass:          actual.UserObjectClass,
+		GroupObjectClass:         actual.GroupObjectClass,
+		GroupMembershipAttribute: actual.GroupMembershipAttribute,
+		GroupMembership:          actual.GroupMembership,
+		ConnectTimeout:           actual.ConnectTimeout,
+		SearchTimeout:            actual.SearchTimeout,
+		FollowReferrals:          actual.FollowReferrals,
+		ReferralDomains:          actual.ReferralDomains,
+		UserAttributes:           actual.UserAttributes,
+		LoginAttribute:           actual.LoginAttribute,
+		GroupRoles:               actual.GroupRoles,
 	}
 
 	// update `Server`
@@ -49,6 +114,11 @@ func updateLdapConfigurationInfo(ldapConfiguration *types.LdapConfiguration, act
 		ldapConfigurationUpdateObj.Server = ldapConfiguration.Server
 	}
 
+	// update `Servers`; an empty list (rather than none) reverts to `Server`
+	if ldapConfiguration.Servers != nil {
+		ldapConfigurationUpdateObj.Servers = ldapConfiguration.Servers
+	}
+
 	// update `Port`; Range checking 0-65535 is not needed as `Port` is of type `uint16`
 	if ldapConfiguration.Port > 0 {
 		ldapConfigurationUpdateObj.Port = ldapConfiguration.Port
@@ -74,6 +144,11 @@ func updateLdapConfigurationInfo(ldapConfiguration *types.LdapConfiguration, act
 		ldapConfigurationUpdateObj.StartTLS = ldapConfiguration.StartTLS
 	}
 
+	// update `UseLDAPS`
+	if actual.UseLDAPS != ldapConfiguration.UseLDAPS {
+		ldapConfigurationUpdateObj.UseLDAPS = ldapConfiguration.UseLDAPS
+	}
+
 	// update `InsecureSkipVerify`
 	if actual.InsecureSkipVerify != ldapConfiguration.InsecureSkipVerify {
 		ldapConfigurationUpdateObj.InsecureSkipVerify = ldapConfiguration.InsecureSkipVerify
@@ -84,6 +159,94 @@ func updateLdapConfigurationInfo(ldapConfiguration *types.LdapConfiguration, act
 		ldapConfigurationUpdateObj.TLSCertIssuedTo = ldapConfiguration.TLSCertIssuedTo
 	}
 
+	// update `CACertificate`
+	if !common.IsEmpty(ldapConfiguration.CACertificate) {
+		ldapConfigurationUpdateObj.CACertificate = ldapConfiguration.CACertificate
+	}
+
+	// update `UserObjectClass`
+	if !common.IsEmpty(ldapConfiguration.UserObjectClass) {
+		ldapConfigurationUpdateObj.UserObjectClass = ldapConfiguration.UserObjectClass
+	}
+
+	// update `GroupObjectClass`
+	if !common.IsEmpty(ldapConfiguration.GroupObjectClass) {
+		ldapConfigurationUpdateObj.GroupObjectClass = ldapConfiguration.GroupObjectClass
+	}
+
+	// update `GroupMembershipAttribute`
+	if !common.IsEmpty(ldapConfiguration.GroupMembershipAttribute) {
+		ldapConfigurationUpdateObj.GroupMembershipAttribute = ldapConfiguration.GroupMembershipAttribute
+	}
+
+	// update `GroupMembership`
+	if !common.IsEmpty(ldapConfiguration.GroupMembership) {
+		ldapConfigurationUpdateObj.GroupMembership = ldapConfiguration.GroupMembership
+	}
+
+	// update `ConnectTimeout`
+	if ldapConfiguration.ConnectTimeout != 0 {
+		ldapConfigurationUpdateObj.ConnectTimeout = ldapConfiguration.ConnectTimeout
+	}
+
+	// update `SearchTimeout`
+	if ldapConfiguration.SearchTimeout != 0 {
+		ldapConfigurationUpdateObj.SearchTimeout = ldapConfiguration.SearchTimeout
+	}
+
+	// update `FollowReferrals`
+	if actual.FollowReferrals != ldapConfiguration.FollowReferrals {
+		ldapConfigurationUpdateObj.FollowReferrals = ldapConfiguration.FollowReferrals
+	}
+
+	// update `ReferralDomains`; an empty list (rather than none) clears them
+	if ldapConfiguration.ReferralDomains != nil {
+		ldapConfigurationUpdateObj.ReferralDomains = ldapConfiguration.ReferralDomains
+	}
+
+	// update `UserAttributes`; an empty list (rather than none) reverts to the defaults
+	if ldapConfiguration.UserAttributes != nil {
+		ldapConfigurationUpdateObj.UserAttributes = ldapConfiguration.UserAttributes
+	}
+
+	// update `LoginAttribute`; an empty list (rather than none) reverts to the default
+	if ldapConfiguration.LoginAttribute != nil {
+		ldapConfigurationUpdateObj.LoginAttribute = ldapConfiguration.LoginAttribute
+	}
+
+	// update `GroupRoles`; an empty map (rather than none) removes the mapping
+	if ldapConfiguration.GroupRoles != nil {
+		ldapConfigurationUpdateObj.GroupRoles = ldapConfiguration.GroupRoles
+	}
+
+	if err := validateLdapServers(ldapConfigurationUpdateObj); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if err := validateLdapTimeouts(ldapConfigurationUpdateObj); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if err := validateGroupSchema(ldapConfigurationUpdateObj); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if err := validateLdapReferrals(ldapConfigurationUpdateObj); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if err := validateUserAttributes(ldapConfigurationUpdateObj); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if err := validateLoginAttribute(ldapConfigurationUpdateObj); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if err := validateGroupRoles(ldapConfigurationUpdateObj); err != nil {
+		return http.StatusBadRequest, err
+	}
+
 	if err := validateTLSParams(ldapConfigurationUpdateObj); err != nil {
 		return http.StatusBadRequest, err
 	}
@@ -95,7 +258,7 @@ func updateLdapConfigurationInfo(ldapConfiguration *types.LdapConfiguration, act
 		ldapConfigurationUpdateObj.ServiceAccountPassword = ""
 		jData, err := json.Marshal(ldapConfigurationUpdateObj)
 		if err != nil {
-			return http.StatusInternalServerError, []byte(err.Error())
+			return datastoreStatusCode(err), []byte(err.Error())
 		}
 
 		return http.StatusOK, jData
@@ -164,7 +327,7 @@ func getLdapConfigurationHelper() (int, []byte) {
 		ldapConfiguration.ServiceAccountPassword = ""
 		jData, err := json.Marshal(ldapConfiguration)
 		if err != nil {
-			return http.StatusInternalServerError, []byte(err.Error())
+			return datastoreStatusCode(err), []byte(err.Error())
 		}
 
 		return http.StatusOK, jData
@@ -177,33 +340,218 @@ func getLdapConfigurationHelper() (int, []byte) {
 
 }
 
-// addLdapConfigurationHelper helper function to add given ldap configuration to the data store.
+// testLdapConfigurationHelper helper function to test the given or the stored LDAP
+// configuration; nothing is saved, and the service account password is never returned.
 // params:
-//  ldapConfiguration: configuration to be added to the data store
+//  testReq: configuration to test and user to look up
 // return values:
 //  int: http status code
 //  []byte: http response message; this goes along with status code
-//          this could be an error message or JSON response based on the execution flow
-func addLdapConfigurationHelper(ldapConfiguration *types.LdapConfiguration) (int, []byte) {
-	// NOTE: Range checking 0-65535 is not needed for the port as it's of type uint16
-	if common.IsEmpty(ldapConfiguration.Server) || ldapConfiguration.Port == 0 {
-		return http.StatusBadRequest, []byte("Invalid Server/Port details")
+//          on success, it contains `ldap.CheckResult` object
+func testLdapConfigurationHelper(testReq *LdapConfigurationTestRequest) (int, []byte) {
+	stored, err := db.GetLdapConfiguration()
+	if err != nil && err != auth_errors.ErrKeyNotFound {
+		log.Debugf("Failed to retrieve LDAP configuration: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to retrieve LDAP configuration from the data store")
+	}
+
+	storedPassword := ""
+	if stored != nil {
+		if storedPassword, err = common.Decrypt(stored.ServiceAccountPassword); err != nil {
+			log.Debugf("Failed to decrypt LDAP service account password: %#v", err)
+			return http.StatusInternalServerError, []byte("Failed to retrieve LDAP configuration from the data store")
+		}
+	}
+
+	ldapConfiguration := testReq.Configuration
+	if ldapConfiguration == nil {
+		if stored == nil {
+			return http.StatusNotFound, []byte("LDAP configuration not found")
+		}
+
+		ldapConfiguration = stored
+		ldapConfiguration.ServiceAccountPassword = storedPassword
+	} else if common.IsEmpty(ldapConfiguration.ServiceAccountPassword) {
+		ldapConfiguration.ServiceAccountPassword = storedPassword
+	}
+
+	if err := validateLdapConfiguration(ldapConfiguration); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	ldapManager := ldap.Manager{Config: *ldapConfiguration}
+	jData, err := json.Marshal(ldapManager.Check(testReq.Username))
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// searchLdapGroupsHelper helper function to search the LDAP/AD groups matching the given query.
+// params:
+//  query: part of the CN of the groups, or the DN of a group
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains `LdapGroupsResponse` object
+func searchLdapGroupsHelper(query string) (int, []byte) {
+	query = strings.TrimSpace(query)
+	if common.IsEmpty(query) {
+		return http.StatusBadRequest, []byte("query is required")
+	}
+
+	groups, truncated, err := ldap.SearchGroups(query)
+
+	switch err {
+	case nil:
+		jData, err := json.Marshal(&LdapGroupsResponse{Groups: groups, Truncated: truncated})
+		if err != nil {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+
+		return http.StatusOK, jData
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, []byte("LDAP configuration not found")
+	case auth_errors.ErrLDAPConnectionFailed, auth_errors.ErrLDAPTLSFailed:
+		return http.StatusBadGateway, []byte(directoryUnavailable())
+	default:
+		log.Debugf("Failed to search LDAP groups: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to search LDAP groups: " + err.Error())
+	}
+}
+
+// debugPrincipalHelper helper function for `debugPrincipal`. The user is looked
+// up live using the service account, like users logging in with a client
+// certificate, so that the groups and roles reflect the directory as it is now
+// rather than as it was at the user's last login.
+// params:
+//  name: name of the LDAP user, as it would be given at login
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains `DebugPrincipalResponse` object
+func debugPrincipalHelper(name string) (int, []byte) {
+	name = common.NormalizeUsername(strings.TrimSpace(name))
+	if common.IsEmpty(name) {
+		return http.StatusBadRequest, []byte("name is required")
+	}
+
+	dn, groups, err := ldap.Lookup(name)
+
+	switch err {
+	case nil:
+	case auth_errors.ErrKeyNotFound, auth_errors.ErrLDAPConfigurationNotFound:
+		return http.StatusNotFound, []byte("LDAP configuration not found")
+	case auth_errors.ErrUserNotFound:
+		return http.StatusNotFound, []byte("LDAP user not found")
+	case auth_errors.ErrLDAPGroupsNotFound:
+		return http.StatusNotFound, []byte("LDAP user has no groups and can't log in")
+	case auth_errors.ErrLDAPConnectionFailed, auth_errors.ErrLDAPTLSFailed:
+		return http.StatusBadGateway, []byte(directoryUnavailable())
+	default:
+		log.Debugf("Failed to look up LDAP user %q: %#v", name, err)
+		return http.StatusInternalServerError, []byte("Failed to look up LDAP user: " + err.Error())
+	}
+
+	// the same token the user would get at login, minus the user's attributes
+	token, err := auth.NewTokenWithClaims(groups)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+	token.AddClaim(auth.UsernameClaimKey, dn)
+
+	roles, err := token.TenantRoles()
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	authzs, err := auth.MatchedAuthorizations(groups)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	resp := &DebugPrincipalResponse{
+		Name:                  name,
+		DN:                    dn,
+		Groups:                groups,
+		Role:                  tokenRole(token).String(),
+		Tenants:               []TenantRoleRef{},
+		MatchedAuthorizations: []GetAuthorizationReply{},
+	}
+
+	if role, found := ldap.GroupsRole(groups); found {
+		resp.GroupRole = role.String()
+	}
+
+	tenants := []string{}
+	for tenant := range roles {
+		tenants = append(tenants, tenant)
 	}
+	sort.Strings(tenants)
 
-	if common.IsEmpty(ldapConfiguration.ServiceAccountDN) || common.IsEmpty(ldapConfiguration.ServiceAccountPassword) {
-		return http.StatusBadRequest, []byte("Empty service account DN/Password")
+	for _, tenant := range tenants {
+		resp.Tenants = append(resp.Tenants, TenantRoleRef{TenantName: tenant, Role: roles[tenant].String()})
 	}
 
-	if common.IsEmpty(ldapConfiguration.BaseDN) {
-		return http.StatusBadRequest, []byte("Empty base DN")
+	for _, authz := range authzs {
+		resp.MatchedAuthorizations = append(resp.MatchedAuthorizations, convertAuthz(authz))
 	}
 
-	if !ldapConfiguration.StartTLS {
-		ldapConfiguration.InsecureSkipVerify = false
-		ldapConfiguration.TLSCertIssuedTo = ""
+	user, err := db.GetLocalUser(name)
+	switch {
+	case err == nil:
+		resp.LocalUser = user.DeletedAt == 0
+	case err != auth_errors.ErrKeyNotFound:
+		return datastoreStatusCode(err), []byte(err.Error())
 	}
 
-	if err := validateTLSParams(ldapConfiguration); err != nil {
+	jData, err := json.Marshal(resp)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// reencryptLdapConfigurationHelper helper function to re-encrypt the LDAP
+// service account password with the current TLS key.
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains `LdapConfigurationReencryptResponse` object
+func reencryptLdapConfigurationHelper() (int, []byte) {
+	reencrypted, err := db.ReencryptLdapConfiguration()
+
+	switch err {
+	case nil:
+		if reencrypted {
+			log.Info("Re-encrypted the LDAP service account password with the current TLS key")
+		}
+
+		jData, err := json.Marshal(&LdapConfigurationReencryptResponse{Reencrypted: reencrypted})
+		if err != nil {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+
+		return http.StatusOK, jData
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, []byte("LDAP configuration not found")
+	default:
+		log.Errorf("Failed to re-encrypt LDAP configuration: %v", err)
+		return http.StatusInternalServerError, []byte("Failed to re-encrypt the LDAP configuration")
+	}
+}
+
+// addLdapConfigurationHelper helper function to add given ldap configuration to the data store.
+// params:
+//  ldapConfiguration: configuration to be added to the data store
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON response based on the execution flow
+func addLdapConfigurationHelper(ldapConfiguration *types.LdapConfiguration) (int, []byte) {
+	if err := validateLdapConfiguration(ldapConfiguration); err != nil {
 		return http.StatusBadRequest, err
 	}
 
@@ -215,7 +563,7 @@ func addLdapConfigurationHelper(ldapConfiguration *types.LdapConfiguration) (int
 		ldapConfiguration.ServiceAccountPassword = ""
 		jData, err := json.Marshal(ldapConfiguration)
 		if err != nil {
-			return http.StatusInternalServerError, []byte(err.Error())
+			return datastoreStatusCode(err), []byte(err.Error())
 		}
 
 		return http.StatusOK, jData
@@ -231,21 +579,39 @@ func addLdapConfigurationHelper(ldapConfiguration *types.LdapConfiguration) (int
 // getLocalUserHelper helper function to get the details of given username.
 // params:
 //  username: of the user to fetch details from the data store
+//  withAuthorizations: if the user's authorizations are embedded
 // return values:
 //  int: http status code
 //  []byte: http response message; this goes along with status code
-//          on successful fetch from data store, it contains `types.LocalUser` object
-func getLocalUserHelper(username string) (int, []byte) {
+//          on successful fetch from data store, it contains `types.LocalUser` object,
+//          or a `LocalUserWithAuthorizations` object if withAuthorizations is set
+func getLocalUserHelper(username string, withAuthorizations bool) (int, []byte) {
 	user, err := db.GetLocalUser(username)
+	if err == nil && user.DeletedAt != 0 { // deleted users are hidden
+		err = auth_errors.ErrKeyNotFound
+	}
 
 	switch err {
 	case nil:
 		user.Password = ""
 		user.PasswordHash = []byte{}
+		user.PasswordChangedAt = 0
+		user.MFASecret = ""
+
+		var reply interface{} = user
+		if withAuthorizations {
+			// only the user or an admin gets here, so all its authorizations are shown
+			authzs, err := localUserAuthorizations(func(string) bool { return true })
+			if err != nil {
+				return datastoreStatusCode(err), []byte(err.Error())
+			}
+
+			reply = withUserAuthorizations(*user, authzs)
+		}
 
-		jData, err := json.Marshal(user)
+		jData, err := json.Marshal(reply)
 		if err != nil {
-			return http.StatusInternalServerError, []byte(err.Error())
+			return datastoreStatusCode(err), []byte(err.Error())
 		}
 
 		return http.StatusOK, jData
@@ -258,86 +624,212 @@ func getLocalUserHelper(username string) (int, []byte) {
 
 }
 
+// localUserAuthorizations reads all the authorizations at once and groups the
+// ones granted to local users by user.
+// params:
+//  visible: returns true if the caller can see the authorizations of the given
+//           tenant ("" for those which aren't granted on a tenant)
+// return values:
+//  map[string][]GetAuthorizationReply: normalized username (see
+//    common.NormalizeUsername()) => its visible authorizations, sorted by UUID
+//  error: as returned by auth.ListAuthorizations()
+func localUserAuthorizations(visible func(tenant string) bool) (map[string][]GetAuthorizationReply, error) {
+	authzList, err := auth.ListAuthorizations()
+	if err != nil {
+		return nil, err
+	}
+
+	byUser := map[string][]GetAuthorizationReply{}
+	for _, authz := range authzList {
+		authzReply := convertAuthz(authz)
+		if !authzReply.Local || !visible(authzReply.TenantName) {
+			continue
+		}
+
+		principal := common.NormalizeUsername(authzReply.PrincipalName)
+		byUser[principal] = append(byUser[principal], authzReply)
+	}
+
+	for _, authzs := range byUser {
+		sort.Sort(byUUID(authzs))
+	}
+
+	return byUser, nil
+}
+
+// withUserAuthorizations embeds its authorizations in a local user
+// params:
+//  user: local user as it's returned by the API
+//  authzs: authorizations as returned by localUserAuthorizations()
+func withUserAuthorizations(user types.LocalUser, authzs map[string][]GetAuthorizationReply) LocalUserWithAuthorizations {
+	userAuthzs := authzs[common.NormalizeUsername(user.Username)]
+	if userAuthzs == nil {
+		userAuthzs = []GetAuthorizationReply{}
+	}
+
+	return LocalUserWithAuthorizations{LocalUser: user, Authorizations: userAuthzs}
+}
+
 // getLocalUsersHelper helper function to get the list of local users.
+// params:
+//  filter: selects the users to list and the page to return
+//  scope: authorizations the caller can see; only used if they're embedded
 // return values:
 //  int: http status code
 //  []byte: http response message; this goes along with status code
 //          on successful fetch from data store, it contains the list of localuser objects
-func getLocalUsersHelper() (int, []byte) {
+//  int: number of users matching the filter, of which a page is returned
+func getLocalUsersHelper(filter *localUserListFilter, scope *tenantAdminScope) (int, []byte, int) {
 	users, err := db.GetLocalUsers()
 	if err != nil {
-		return http.StatusInternalServerError, []byte(err.Error())
+		return datastoreStatusCode(err), []byte(err.Error()), 0
+	}
+
+	withRole, err := principalsWithRole(filter.role)
+	switch err {
+	case nil:
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusBadRequest, []byte(fmt.Sprintf("Unknown role %q", filter.role)), 0
+	default:
+		return datastoreStatusCode(err), []byte(err.Error()), 0
 	}
 
 	localUsers := []types.LocalUser{}
 	for _, user := range users {
+		if !filter.matches(user, withRole) {
+			continue
+		}
+
 		lu := types.LocalUser{
 			Username:  user.Username,
 			FirstName: user.FirstName,
 			LastName:  user.LastName,
+			Email:     user.Email,
+			FullName:  user.FullName,
+			Labels:    user.Labels,
 			Disable:   user.Disable,
+			DeletedAt: user.DeletedAt,
+			LastLogin: user.LastLogin,
 		}
 
 		localUsers = append(localUsers, lu)
 	}
 
-	jData, err := json.Marshal(localUsers)
+	// the data store doesn't guarantee any order
+	sort.Sort(byUsername(localUsers))
+
+	var reply interface{} = filter.page(localUsers)
+	if filter.authorizations {
+		// both collections are read once and joined here
+		authzs, err := localUserAuthorizations(scope.allows)
+		if err != nil {
+			return datastoreStatusCode(err), []byte(err.Error()), 0
+		}
+
+		usersWithAuthzs := []LocalUserWithAuthorizations{}
+		for _, user := range filter.page(localUsers) {
+			usersWithAuthzs = append(usersWithAuthzs, withUserAuthorizations(user, authzs))
+		}
+		reply = usersWithAuthzs
+	}
+
+	jData, err := json.Marshal(reply)
 	if err != nil {
 		log.Debugf("Failed to marshal %#v: %#v", jData, err)
-		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to fetch local users"))
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to fetch local users")), 0
 	}
 
-	return http.StatusOK, jData
+	return http.StatusOK, jData, len(localUsers)
 }
 
-// updateLocalUserInfo helper function for updateLocalUserHelper.
+// principalsWithRole returns the local principals which are granted a role, on
+// any tenant, by an authorization which hasn't expired.
 // params:
-//  username: of the user to be updated
-//  updateReq: to be updated in the data store
-//  actual: existing user details fetched from the data store for user `username`
+//  role: built-in or custom role; empty if the list isn't filtered by role
 // return values:
-//  int: http status code
-//  []byte: http response message; this goes along with status code
-func updateLocalUserInfo(username string, updateReq *types.LocalUser, actual *types.LocalUser) (int, []byte) {
-	updatedUserObj := &types.LocalUser{
-		// username == actual.Username
-		Username:     actual.Username,
-		FirstName:    actual.FirstName,
-		LastName:     actual.LastName,
-		Disable:      actual.Disable,
-		PasswordHash: actual.PasswordHash,
-		// `Password` will be empty
+//  map[string]bool: normalized names of the principals granted the role (see
+//                   common.NormalizeUsername()); nil if no role is given
+//  error: auth_errors.ErrKeyNotFound if there's no such role, or as returned by
+//         consecutive func calls
+func principalsWithRole(role string) (map[string]bool, error) {
+	if common.IsEmpty(role) {
+		return nil, nil
 	}
 
-	// Update `first_name`
-	if !common.IsEmpty(updateReq.FirstName) {
-		updatedUserObj.FirstName = updateReq.FirstName
+	if _, err := types.Role(role); err != nil {
+		if _, err := db.GetCustomRole(role); err != nil {
+			return nil, err
+		}
 	}
 
-	// Update `last_name`
-	if !common.IsEmpty(updateReq.LastName) {
-		updatedUserObj.LastName = updateReq.LastName
+	authzs, err := auth.ListAuthorizations()
+	if err != nil {
+		return nil, err
 	}
 
-	// Update `disable`
-	if actual.Disable != updateReq.Disable {
-		updatedUserObj.Disable = updateReq.Disable
+	now := time.Now().Unix()
+	principals := map[string]bool{}
+	for _, authz := range authzs {
+		if authz.Local && authz.ClaimValue == role && !authz.Expired(now) {
+			principals[common.NormalizeUsername(authz.PrincipalName)] = true
+		}
 	}
 
-	// Update `password`
-	if !common.IsEmpty(updateReq.Password) {
-		updatedUserObj.Password = updateReq.Password
+	return principals, nil
+}
+
+// saveLocalUser writes an updated local user; the last admin can't be disabled.
+// params:
+//  username: of the user to be updated
+//  updated: new details of the user
+//  actual: existing details of the user
+// return values:
+//  error: auth_errors.ErrLastAdmin if the last admin would be disabled, else
+//         as returned by db.UpdateLocalUser()
+func saveLocalUser(username string, updated, actual *types.LocalUser) error {
+	update := func() error { return db.UpdateLocalUser(username, updated) }
+	if updated.Disable && !actual.Disable {
+		return auth.GuardLastAdmin(ofLocalUser(username), update)
 	}
 
-	err := db.UpdateLocalUser(username, updatedUserObj)
+	return update()
+}
+
+// updateLocalUserInfo helper function for updateLocalUserHelper.
+// params:
+//  username: of the user to be updated
+//  updateReq: to be updated in the data store
+//  flags: new values of `disable`, `password_expiry_exempt`, `password_reset_required`
+//         and `mfa_enabled` (which can only be disabled); nil fields keep the existing ones
+//  actual: existing user details fetched from the data store for user `username`
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+func updateLocalUserInfo(username string, updateReq *types.LocalUser, flags *localUserFlagsRequest, actual *types.LocalUser) (int, []byte) {
+	updatedUserObj := updatedLocalUser(updateReq, flags, actual)
+
+	err := saveLocalUser(username, updatedUserObj, actual)
 	switch err {
 	case nil:
+		// disabled users' tokens are rejected anyway; revoking them keeps them
+		// from working again once the user is enabled
+		if updatedUserObj.Disable && !actual.Disable {
+			if _, _, err := revokePrincipalTokens(username); err != nil {
+				log.Errorf("Failed to revoke the tokens of disabled local user %q: %s", username, err)
+				return http.StatusInternalServerError, []byte(fmt.Sprintf("Disabled local user %q but failed to revoke its tokens", username))
+			}
+		}
+
+		// the response holds what can be updated
 		updatedUserObj.Password = ""
 		updatedUserObj.PasswordHash = []byte{}
+		updatedUserObj.PasswordChangedAt = 0
+		updatedUserObj.MFASecret = ""
+		updatedUserObj.LastLogin = 0
 
 		jData, err := json.Marshal(updatedUserObj)
 		if err != nil {
-			return http.StatusInternalServerError, []byte(err.Error())
+			return datastoreStatusCode(err), []byte(err.Error())
 		}
 
 		return http.StatusOK, jData
@@ -345,6 +837,10 @@ func updateLocalUserInfo(username string, updateReq *types.LocalUser, actual *ty
 		return http.StatusNotFound, nil
 	case auth_errors.ErrIllegalOperation:
 		return http.StatusBadRequest, []byte(fmt.Sprintf("Cannot update built-in user %q", username))
+	case auth_errors.ErrLastAdmin:
+		return http.StatusConflict, []byte(fmt.Sprintf("Cannot disable local user %q, the last admin", username))
+	case auth_errors.ErrConcurrentUpdate: // from auth.GuardLastAdmin()
+		return http.StatusConflict, []byte(fmt.Sprintf("Another proxy is removing an admin; retry disabling local user %q", username))
 	default:
 		log.Debugf("Failed to update local user %q with %#v: %#v", username, updateReq, err)
 		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to update local user %q", username))
@@ -352,56 +848,276 @@ func updateLocalUserInfo(username string, updateReq *types.LocalUser, actual *ty
 
 }
 
-// updateLocalUserHelper helper function to update the existing user details in the data store.
+// updatedLocalUser applies a local user update to the existing user.
 // params:
-// username: of the user to be updated
-// userUpdateReq: *localUserCreateRequest contains the fields to be updated
+//  updateReq: fields given in the update; empty ones keep the existing values
+//  flags: new values of `disable`, `password_expiry_exempt`, `password_reset_required`
+//         and `mfa_enabled` (which can only be disabled); nil fields keep the existing ones
+//  actual: existing user details fetched from the data store
 // return values:
-//  int: http status code
-//  []byte: http response message; this goes along with status code
-func updateLocalUserHelper(username string, userUpdateReq *types.LocalUser) (int, []byte) {
-	if common.IsEmpty(username) {
-		return http.StatusBadRequest, []byte("Empty username")
+//  *types.LocalUser: the updated user, with `Password` set if a new one was given
+func updatedLocalUser(updateReq *types.LocalUser, flags *localUserFlagsRequest, actual *types.LocalUser) *types.LocalUser {
+	updatedUserObj := &types.LocalUser{
+		// username == actual.Username
+		Username:              actual.Username,
+		FirstName:             actual.FirstName,
+		LastName:              actual.LastName,
+		Email:                 actual.Email,
+		FullName:              actual.FullName,
+		Labels:                actual.Labels,
+		Disable:               actual.Disable,
+		PasswordHash:          actual.PasswordHash,
+		PasswordChangedAt:     actual.PasswordChangedAt,
+		PasswordExpiryExempt:  actual.PasswordExpiryExempt,
+		PasswordResetRequired: actual.PasswordResetRequired,
+		MFAEnabled:            actual.MFAEnabled,
+		MFASecret:             actual.MFASecret,
+		LastLogin:             actual.LastLogin,
+		// `Password` will be empty
 	}
 
-	localUser, err := db.GetLocalUser(username)
-	switch err {
-	case nil:
-		return updateLocalUserInfo(username, userUpdateReq, localUser)
-	case auth_errors.ErrKeyNotFound:
-		return http.StatusNotFound, nil
-	default:
-		log.Debugf("Failed to update local user %q with %#v: %#v", username, userUpdateReq, err)
-		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to update local user %q", username))
+	// Update `first_name`
+	if !common.IsEmpty(updateReq.FirstName) {
+		updatedUserObj.FirstName = updateReq.FirstName
+	}
+
+	// Update `last_name`
+	if !common.IsEmpty(updateReq.LastName) {
+		updatedUserObj.LastName = updateReq.LastName
+	}
+
+	// Update `email` and `full_name`; like the names above, they're kept if not given
+	if !common.IsEmpty(updateReq.Email) {
+		updatedUserObj.Email = updateReq.Email
+	}
+
+	if !common.IsEmpty(updateReq.FullName) {
+		updatedUserObj.FullName = updateReq.FullName
+	}
+
+	// Update `labels`; given ones replace all the existing ones, so `{}` removes them
+	if updateReq.Labels != nil {
+		updatedUserObj.Labels = updateReq.Labels
+	}
+
+	// Update `password`
+	if !common.IsEmpty(updateReq.Password) {
+		updatedUserObj.Password = updateReq.Password
+	}
+
+	// Update `disable`, `password_expiry_exempt` and `password_reset_required`;
+	// they're left alone if not given
+	if flags.Disable != nil {
+		updatedUserObj.Disable = *flags.Disable
+	}
+
+	if flags.PasswordExpiryExempt != nil {
+		updatedUserObj.PasswordExpiryExempt = *flags.PasswordExpiryExempt
+	}
+
+	if flags.PasswordResetRequired != nil {
+		updatedUserObj.PasswordResetRequired = *flags.PasswordResetRequired
+	}
+
+	// Disable MFA; the user has to enroll again to enable it
+	if flags.MFAEnabled != nil && !*flags.MFAEnabled {
+		updatedUserObj.MFAEnabled = false
+		updatedUserObj.MFASecret = ""
+	}
+
+	return updatedUserObj
+}
+
+// updateLocalUserHelper helper function to update the existing user details in the data store.
+// params:
+// username: of the user to be updated
+// userUpdateReq: *localUserCreateRequest contains the fields to be updated
+// flags: new values of `disable`, `password_expiry_exempt`, `password_reset_required`
+//        and `mfa_enabled`; nil fields keep the existing ones
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+func updateLocalUserHelper(username string, userUpdateReq *types.LocalUser, flags *localUserFlagsRequest) (int, []byte) {
+	if common.IsEmpty(username) {
+		return http.StatusBadRequest, []byte("Empty username")
+	}
+
+	if err := validateLocalUserProfile(userUpdateReq); err != nil {
+		return http.StatusBadRequest, []byte(err.Error())
+	}
+
+	localUser, err := db.GetLocalUser(username)
+	if err == nil && localUser.DeletedAt != 0 { // deleted users have to be restored first
+		err = auth_errors.ErrKeyNotFound
+	}
+
+	switch err {
+	case nil:
+		return updateLocalUserInfo(username, userUpdateReq, flags, localUser)
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	default:
+		log.Debugf("Failed to update local user %q with %#v: %#v", username, userUpdateReq, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to update local user %q", username))
+	}
+
+}
+
+// validateLocalUserProfile checks the optional email, full name and labels of a
+// local user; empty ones aren't checked.
+// params:
+//  user: local user to be added, or the fields of one to be updated
+// return values:
+//  error: why the fields are invalid; the message is returned to the client
+func validateLocalUserProfile(user *types.LocalUser) error {
+	if !common.IsEmpty(user.Email) {
+		if len(user.Email) > maxEmailLength {
+			return fmt.Errorf("email must be at most %d characters long", maxEmailLength)
+		}
+
+		// a bare address; no display name, comments or surrounding spaces
+		addr, err := mail.ParseAddress(user.Email)
+		if err != nil || addr.Name != "" || addr.Address != user.Email {
+			return fmt.Errorf("invalid email %q; expected an address such as jdoe@example.com", user.Email)
+		}
+	}
+
+	if utf8.RuneCountInString(user.FullName) > maxFullNameLength {
+		return fmt.Errorf("full_name must be at most %d characters long", maxFullNameLength)
+	}
+
+	if strings.IndexFunc(user.FullName, unicode.IsControl) >= 0 {
+		return errors.New("full_name can't contain control characters")
+	}
+
+	if len(user.Labels) > maxLabels {
+		return fmt.Errorf("a user can have at most %d labels", maxLabels)
+	}
+
+	for key, value := range user.Labels {
+		if len(key) > maxLabelKeyLength || !labelKeyRegex.MatchString(key) {
+			return fmt.Errorf("invalid label %q; keys are up to %d alpha-numeric and [-_./] characters", key, maxLabelKeyLength)
+		}
+
+		if len(value) > maxLabelLength {
+			return fmt.Errorf("label %q must be at most %d bytes long", key, maxLabelLength)
+		}
+
+		if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return fmt.Errorf("label %q can't contain control characters", key)
+		}
+	}
+
+	return nil
+}
+
+// ofLocalUser returns a function selecting the authorizations of a local user,
+// e.g. to pass to auth.GuardLastAdmin().
+func ofLocalUser(username string) func(types.Authorization) bool {
+	return func(authz types.Authorization) bool {
+		return authz.Local && common.SamePrincipal(authz.PrincipalName, username)
 	}
+}
 
+// withUUID returns a function selecting the authorization with the given UUID.
+func withUUID(authzUUID string) func(types.Authorization) bool {
+	return func(authz types.Authorization) bool {
+		return authz.UUID == authzUUID
+	}
 }
 
 // deleteLocalUserHelper helper function to delete given user from the data store.
+// The user's tokens are revoked, so that they aren't accepted again if the user
+// is restored.
 // params:
 //  username: of the user to be deleted from store
+//  hard: true to delete the user and its authorizations permanently, false to
+//        only flag the user as deleted so that it can be restored
 // return values:
 //  int: http status code
 //  []byte: http response message; this goes along with status code
-func deleteLocalUserHelper(username string) (int, []byte) {
+func deleteLocalUserHelper(username string, hard bool) (int, []byte) {
 	if common.IsEmpty(username) {
 		return http.StatusBadRequest, []byte("Empty username")
 	}
 
-	err := db.DeleteLocalUser(username)
+	err := auth.GuardLastAdmin(ofLocalUser(username), func() error {
+		if hard {
+			return db.DeleteLocalUser(username)
+		}
+
+		return db.SoftDeleteLocalUser(username, time.Now().Unix())
+	})
+
 	switch err {
 	case nil:
+		// hard deletes take the user's authorizations along
+		auth.InvalidateAuthorizationCache()
+
+		if _, _, err := revokePrincipalTokens(username); err != nil {
+			log.Errorf("Failed to revoke the tokens of deleted local user %q: %s", username, err)
+			return http.StatusInternalServerError, []byte(fmt.Sprintf("Deleted local user %q but failed to revoke its tokens", username))
+		}
+
 		return http.StatusNoContent, nil
 	case auth_errors.ErrKeyNotFound:
 		return http.StatusNotFound, nil
 	case auth_errors.ErrIllegalOperation:
 		return http.StatusBadRequest, []byte(fmt.Sprintf("Cannot delete built-in user %q", username))
+	case auth_errors.ErrLastAdmin:
+		return http.StatusConflict, []byte(fmt.Sprintf("Cannot delete local user %q, the last admin", username))
+	case auth_errors.ErrConcurrentUpdate: // from auth.GuardLastAdmin()
+		return http.StatusConflict, []byte(fmt.Sprintf("Another proxy is removing an admin; retry deleting local user %q", username))
 	default:
 		log.Debugf("Failed to delete local user %q: %#v", username, err)
 		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to delete local user %q from the system", username))
 	}
 }
 
+// restoreLocalUserHelper helper function to restore a soft-deleted user.
+// params:
+//  username: of the user to be restored
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful restore, it contains the `types.LocalUser` object
+func restoreLocalUserHelper(username string) (int, []byte) {
+	if common.IsEmpty(username) {
+		return http.StatusBadRequest, []byte("Empty username")
+	}
+
+	user, err := db.RestoreLocalUser(username)
+	switch err {
+	case nil:
+		log.Infof("Restored local user %q", username)
+
+		jData, err := json.Marshal(types.LocalUser{
+			Username:              user.Username,
+			FirstName:             user.FirstName,
+			LastName:              user.LastName,
+			Email:                 user.Email,
+			FullName:              user.FullName,
+			Labels:                user.Labels,
+			Disable:               user.Disable,
+			PasswordExpiryExempt:  user.PasswordExpiryExempt,
+			PasswordResetRequired: user.PasswordResetRequired,
+			MFAEnabled:            user.MFAEnabled,
+		})
+		if err != nil {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+
+		return http.StatusOK, jData
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	case auth_errors.ErrIllegalOperation:
+		return http.StatusConflict, []byte(fmt.Sprintf("User %q is not deleted", username))
+	default:
+		log.Debugf("Failed to restore local user %q: %#v", username, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to restore local user %q", username))
+	}
+}
+
 // addLocalUserHelper helper function to add given user to the data store.
 // params:
 //  userCreateReq: *types.LocalUser request object; to be added to the store
@@ -413,15 +1129,24 @@ func addLocalUserHelper(userCreateReq *types.LocalUser) (int, []byte) {
 		return http.StatusBadRequest, []byte("Username/Password is empty")
 	}
 
-	if !usernamePattern.MatchString(userCreateReq.Username) {
-		return http.StatusBadRequest, []byte("Invalid username. Only aplha-numeric and [-_.@] are allowed")
+	if err := common.ValidateUsername(userCreateReq.Username); err != nil {
+		return http.StatusBadRequest, []byte("Invalid username: " + err.Error())
+	}
+
+	if err := validateLocalUserProfile(userCreateReq); err != nil {
+		return http.StatusBadRequest, []byte(err.Error())
 	}
 
+	// users enroll for MFA themselves
+	userCreateReq.MFAEnabled = false
+	userCreateReq.MFASecret = ""
+
 	err := db.AddLocalUser(userCreateReq)
 	switch err {
 	case nil:
 		userCreateReq.Password = ""
 		userCreateReq.PasswordHash = []byte{}
+		userCreateReq.PasswordChangedAt = 0
 
 		jData, err := json.Marshal(userCreateReq)
 		if err != nil {
@@ -431,6 +1156,18 @@ func addLocalUserHelper(userCreateReq *types.LocalUser) (int, []byte) {
 
 		return http.StatusCreated, jData
 	case auth_errors.ErrKeyExists:
+		if user, err := db.GetLocalUser(userCreateReq.Username); err == nil && user.DeletedAt != 0 {
+			return http.StatusConflict, []byte(fmt.Sprintf("User %q was deleted; restore it (POST %s/local_users/%s/restore/) "+
+				"or delete it permanently (DELETE %s/local_users/%s/?hard=true) first",
+				userCreateReq.Username, V1Prefix, userCreateReq.Username, V1Prefix, userCreateReq.Username))
+		}
+
+		if common.NormalizeUsernames() {
+			return http.StatusBadRequest, []byte(fmt.Sprintf("User %q exists already; usernames are case-insensitive "+
+				"since %s is set, so it can't differ from an existing user's name in case only",
+				userCreateReq.Username, common.NormalizeUsernamesKey))
+		}
+
 		return http.StatusBadRequest, []byte(fmt.Sprintf("User %q exists already", userCreateReq.Username))
 	default:
 		log.Debugf("Failed to add local user %#v: %#v", userCreateReq, err)
@@ -439,15 +1176,252 @@ func addLocalUserHelper(userCreateReq *types.LocalUser) (int, []byte) {
 
 }
 
+// validateLdapConfiguration validates a LDAP configuration to be added or tested
+// params:
+//  ldapConfig: config to be validated
+// return values:
+//  error if validation fails, otherwise nil
+func validateLdapConfiguration(ldapConfig *types.LdapConfiguration) []byte {
+	// NOTE: Range checking 0-65535 is not needed for the port as it's of type uint16
+	if (common.IsEmpty(ldapConfig.Server) && len(ldapConfig.Servers) == 0) || ldapConfig.Port == 0 {
+		return []byte("Invalid Server/Port details")
+	}
+
+	if err := validateLdapServers(ldapConfig); err != nil {
+		return err
+	}
+
+	if common.IsEmpty(ldapConfig.ServiceAccountDN) || common.IsEmpty(ldapConfig.ServiceAccountPassword) {
+		return []byte("Empty service account DN/Password")
+	}
+
+	if common.IsEmpty(ldapConfig.BaseDN) {
+		return []byte("Empty base DN")
+	}
+
+	if err := validateLdapTimeouts(ldapConfig); err != nil {
+		return err
+	}
+
+	if err := validateGroupSchema(ldapConfig); err != nil {
+		return err
+	}
+
+	if err := validateLdapReferrals(ldapConfig); err != nil {
+		return err
+	}
+
+	if err := validateUserAttributes(ldapConfig); err != nil {
+		return err
+	}
+
+	if err := validateLoginAttribute(ldapConfig); err != nil {
+		return err
+	}
+
+	if err := validateGroupRoles(ldapConfig); err != nil {
+		return err
+	}
+
+	return validateTLSParams(ldapConfig)
+}
+
+// validateLdapServers validates the list of LDAP servers; `Server` is set to
+// the first of them if it's empty, for clients which only know about one server.
+// params:
+//  ldapConfig: config to be validated
+// return values:
+//  error if validation fails, otherwise nil
+func validateLdapServers(ldapConfig *types.LdapConfiguration) []byte {
+	for _, server := range ldapConfig.Servers {
+		host := server
+		if h, _, err := net.SplitHostPort(server); err == nil {
+			host = h
+		}
+
+		if common.IsEmpty(host) || strings.ContainsAny(host, "/ ") {
+			return []byte(fmt.Sprintf("Invalid server %q", server))
+		}
+	}
+
+	if common.IsEmpty(ldapConfig.Server) && len(ldapConfig.Servers) > 0 {
+		ldapConfig.Server = ldapServerHosts(ldapConfig)[0]
+	}
+
+	return nil
+}
+
+// ldapServerHosts returns the host names or IP addresses of the configured LDAP servers
+func ldapServerHosts(ldapConfig *types.LdapConfiguration) []string {
+	if len(ldapConfig.Servers) == 0 {
+		return []string{ldapConfig.Server}
+	}
+
+	hosts := []string{}
+	for _, server := range ldapConfig.Servers {
+		if host, _, err := net.SplitHostPort(server); err == nil {
+			server = host
+		}
+
+		hosts = append(hosts, server)
+	}
+
+	return hosts
+}
+
+// validateLdapTimeouts validates the LDAP timeouts; 0 stands for the default
+// params:
+//  ldapConfig: config to be validated
+// return values:
+//  error if validation fails, otherwise nil
+func validateLdapTimeouts(ldapConfig *types.LdapConfiguration) []byte {
+	if ldapConfig.ConnectTimeout < 0 || ldapConfig.SearchTimeout < 0 {
+		return []byte("Invalid ConnectTimeout/SearchTimeout: must be >= 0 seconds")
+	}
+
+	return nil
+}
+
+// validateGroupSchema validates the schema of the LDAP users and groups; the
+// membership attributes of user entries and group entries can't be mixed up.
+// params:
+//  ldapConfig: config to be validated
+// return values:
+//  error if validation fails, otherwise nil
+func validateGroupSchema(ldapConfig *types.LdapConfiguration) []byte {
+	for _, name := range []string{ldapConfig.UserObjectClass, ldapConfig.GroupObjectClass, ldapConfig.GroupMembershipAttribute} {
+		if !common.IsEmpty(name) && !ldapDescriptorPattern.MatchString(name) {
+			return []byte(fmt.Sprintf("Invalid LDAP attribute/object class %q", name))
+		}
+	}
+
+	attribute := strings.ToLower(ldapConfig.GroupMembershipAttribute)
+
+	switch ldapConfig.GroupMembership {
+	case "", types.LdapGroupMembershipUser:
+		if attribute == "member" || attribute == "uniquemember" || attribute == "memberuid" {
+			return []byte(fmt.Sprintf("%s is recorded on group entries; set GroupMembership to %q",
+				ldapConfig.GroupMembershipAttribute, types.LdapGroupMembershipGroup))
+		}
+	case types.LdapGroupMembershipGroup:
+		if common.IsEmpty(ldapConfig.GroupObjectClass) || common.IsEmpty(attribute) {
+			return []byte("GroupObjectClass and GroupMembershipAttribute must be provided when the membership is recorded on group entries")
+		}
+
+		if attribute == "memberof" {
+			return []byte(fmt.Sprintf("%s is recorded on user entries; set GroupMembership to %q",
+				ldapConfig.GroupMembershipAttribute, types.LdapGroupMembershipUser))
+		}
+	default:
+		return []byte(fmt.Sprintf("Invalid GroupMembership %q: must be %q or %q",
+			ldapConfig.GroupMembership, types.LdapGroupMembershipUser, types.LdapGroupMembershipGroup))
+	}
+
+	return nil
+}
+
+// validateLdapReferrals validates the domains which LDAP referrals may be
+// followed to; there must be some if referrals are followed.
+// params:
+//  ldapConfig: config to be validated
+// return values:
+//  error if validation fails, otherwise nil
+func validateLdapReferrals(ldapConfig *types.LdapConfiguration) []byte {
+	for _, domain := range ldapConfig.ReferralDomains {
+		if common.IsEmpty(strings.Trim(domain, ".")) || strings.ContainsAny(domain, "/: ") {
+			return []byte(fmt.Sprintf("Invalid referral domain %q", domain))
+		}
+	}
+
+	if ldapConfig.FollowReferrals && len(ldapConfig.ReferralDomains) == 0 {
+		return []byte("ReferralDomains must be provided when referrals are followed")
+	}
+
+	return nil
+}
+
+// maxUserAttributes is the number of LDAP attributes which can be carried in
+// the users' tokens; their values are capped at ldap.MaxAttributeLength bytes
+const maxUserAttributes = 10
+
+// validateUserAttributes validates the LDAP attributes carried in the users' tokens
+// params:
+//  ldapConfig: config to be validated
+// return values:
+//  error if validation fails, otherwise nil
+func validateUserAttributes(ldapConfig *types.LdapConfiguration) []byte {
+	if len(ldapConfig.UserAttributes) > maxUserAttributes {
+		return []byte(fmt.Sprintf("Too many UserAttributes: at most %d can be carried in tokens", maxUserAttributes))
+	}
+
+	for _, name := range ldapConfig.UserAttributes {
+		if !ldapDescriptorPattern.MatchString(name) {
+			return []byte(fmt.Sprintf("Invalid LDAP attribute %q", name))
+		}
+	}
+
+	return nil
+}
+
+// validateLoginAttribute validates the LDAP attributes users log in with; any
+// attribute is accepted as long as it can't alter the user search filter
+// params:
+//  ldapConfig: config to be validated
+// return values:
+//  error if validation fails, otherwise nil
+func validateLoginAttribute(ldapConfig *types.LdapConfiguration) []byte {
+	for _, name := range ldapConfig.LoginAttribute {
+		if !ldapDescriptorPattern.MatchString(name) {
+			return []byte(fmt.Sprintf("Invalid LDAP attribute %q", name))
+		}
+	}
+
+	return nil
+}
+
+// validateGroupRoles validates the mapping of LDAP groups to base roles
+// params:
+//  ldapConfig: config to be validated
+// return values:
+//  error if validation fails, otherwise nil
+func validateGroupRoles(ldapConfig *types.LdapConfiguration) []byte {
+	found := map[string]bool{}
+	for dn, role := range ldapConfig.GroupRoles {
+		// DNs can't be mistaken for local usernames, which are principals as well
+		if !ldap.IsDN(dn) {
+			return []byte(fmt.Sprintf("Invalid LDAP group DN %q", dn))
+		}
+
+		// groups are matched case-insensitively
+		if found[strings.ToLower(dn)] {
+			return []byte(fmt.Sprintf("LDAP group %q is mapped more than once", dn))
+		}
+
+		found[strings.ToLower(dn)] = true
+
+		if _, err := types.Role(role); err != nil {
+			return []byte(fmt.Sprintf("Invalid role %q of LDAP group %q", role, dn))
+		}
+	}
+
+	return nil
+}
+
 // validateTLSParams validates TLS config parameters
 // params:
 //  ldapConfig: config to be validated
 // return values:
 //  error if validation fails, otherwise nil
 func validateTLSParams(ldapConfig *types.LdapConfiguration) []byte {
-	if !ldapConfig.StartTLS { // if StartTLS == false, then the below attrs are ignored
+	if ldapConfig.StartTLS && ldapConfig.UseLDAPS {
+		return []byte("StartTLS and UseLDAPS can't both be enabled")
+	}
+
+	tlsEnabled := ldapConfig.StartTLS || ldapConfig.UseLDAPS
+	if !tlsEnabled { // if neither is set, then the below attrs are ignored
 		ldapConfig.InsecureSkipVerify = false
 		ldapConfig.TLSCertIssuedTo = ""
+		ldapConfig.CACertificate = ""
 	}
 
 	if ldapConfig.InsecureSkipVerify { // either InsecureSkipVerify or TLSCertIssuedTo is required
@@ -455,14 +1429,30 @@ func validateTLSParams(ldapConfig *types.LdapConfiguration) []byte {
 	}
 
 	// if ldapConfig.TLSCertIssuedTo is not empty, then it will be honored
-	if ldapConfig.StartTLS && common.IsEmpty(ldapConfig.TLSCertIssuedTo) {
+	if tlsEnabled && common.IsEmpty(ldapConfig.TLSCertIssuedTo) {
 		if !ldapConfig.InsecureSkipVerify {
-			if re.MatchString(ldapConfig.Server) {
-				return []byte("InsecureSkipVerify or TLSCertIssuedTo must be provided for TLS/SSL connection")
+			// the certificate of a server given by IP address may be issued to it
+			// by a private CA, but public CAs don't do that
+			for _, host := range ldapServerHosts(ldapConfig) {
+				if re.MatchString(host) && common.IsEmpty(ldapConfig.CACertificate) {
+					return []byte("InsecureSkipVerify or TLSCertIssuedTo must be provided for TLS/SSL connection")
+				}
+			}
+
+			// ldapConfigurationUpdateObj.Server is FQDN; several servers are
+			// each verified against their own name
+			if len(ldapConfig.Servers) == 0 {
+				ldapConfig.TLSCertIssuedTo = ldapConfig.Server
 			}
+		}
+	}
 
-			// ldapConfigurationUpdateObj.Server is FQDN
-			ldapConfig.TLSCertIssuedTo = ldapConfig.Server
+	// a bad CA certificate is rejected now rather than at the next login
+	if tlsEnabled {
+		for _, host := range ldapServerHosts(ldapConfig) {
+			if _, err := ldap.TLSConfig(ldapConfig, host); err != nil {
+				return []byte("Invalid TLS configuration: " + err.Error())
+			}
 		}
 	}
 
@@ -479,15 +1469,23 @@ func validateTLSParams(ldapConfig *types.LdapConfiguration) []byte {
 //  bool: boolean representing the token validatity
 func validateToken(w http.ResponseWriter, req *http.Request) (*auth.Token, bool) {
 
-	if _, ok := req.Header["X-Auth-Token"]; !ok {
-		authError(w, http.StatusBadRequest, "X-Auth-Token header is missing")
+	tokenStr, found, err := tokenFromHeaders(req.Header)
+	if err != nil {
+		authError(w, http.StatusBadRequest, types.ErrorCodeBadRequest, err.Error())
 		return nil, false
 	}
 
-	tokenStr := req.Header.Get("X-Auth-Token")
+	if !found {
+		if username, ok := clientCertIdentity(req); ok {
+			return clientCertToken(w, username)
+		}
+
+		authError(w, http.StatusBadRequest, types.ErrorCodeMissingToken, "X-Auth-Token or Authorization header is missing")
+		return nil, false
+	}
 
 	if common.IsEmpty(tokenStr) {
-		authError(w, http.StatusBadRequest, "Empty auth token")
+		authError(w, http.StatusBadRequest, types.ErrorCodeMissingToken, "Empty auth token")
 		return nil, false
 	}
 
@@ -495,41 +1493,243 @@ func validateToken(w http.ResponseWriter, req *http.Request) (*auth.Token, bool)
 	// this is mainly to provide some basic difference between two users
 	// this needs to be fine-grained once we have the backend and capabilities defined
 
-	token, err := auth.ParseToken(tokenStr)
+	token, err := parseRequestToken(tokenStr)
 	if err != nil {
-		authError(w, http.StatusBadRequest, "Bad token")
+		switch err {
+		case auth_errors.ErrKubernetesAccessDenied:
+			authError(w, http.StatusUnauthorized, types.ErrorCodeInvalidToken, "Invalid ServiceAccount token")
+		case auth_errors.ErrKubernetesUnavailable:
+			authError(w, http.StatusServiceUnavailable, types.ErrorCodeUnavailable, "Failed to verify ServiceAccount token: "+err.Error())
+		case auth_errors.ErrAccessDenied:
+			authError(w, http.StatusUnauthorized, types.ErrorCodeInvalidToken, "Unknown or revoked access token")
+		case auth_errors.ErrLDAPConnectionFailed:
+			authError(w, http.StatusServiceUnavailable, types.ErrorCodeUnavailable, "Failed to look up access token user: "+err.Error())
+		case auth_errors.ErrTokenExpired:
+			authError(w, http.StatusBadRequest, types.ErrorCodeTokenExpired, "Bad token: expired")
+		case auth_errors.ErrTokenWrongIssuer:
+			authError(w, http.StatusBadRequest, types.ErrorCodeTokenWrongIssuer, "Bad token: wrong issuer")
+		case auth_errors.ErrTokenWrongAudience:
+			authError(w, http.StatusBadRequest, types.ErrorCodeTokenWrongAudience, "Bad token: wrong audience")
+		default:
+			authError(w, http.StatusBadRequest, types.ErrorCodeInvalidToken, "Bad token")
+		}
+
 		return nil, false
 	}
 
 	username := token.GetClaim("username")
 	if common.IsEmpty(username) {
-		authError(w, http.StatusBadRequest, "Bad token")
+		authError(w, http.StatusBadRequest, types.ErrorCodeInvalidToken, "Bad token")
 		return nil, false
 	}
 
-	if usernamePattern.MatchString(username) { // Local user
-		// when the user is deleted, after the token is issued
-		if user, err := db.GetLocalUser(username); err != nil {
-			if err == auth_errors.ErrKeyNotFound { // User not found (i.e, deleted)
-				authError(w, http.StatusUnauthorized, "Invalid user")
-				return nil, false
-			}
-			serverError(w, err)
-		} else if user.Disable {
-			authError(w, http.StatusUnauthorized, "User account disabled")
+	if err := checkTokenUser(username); err != nil {
+		if err == errInvalidUser || err == errUserDisabled {
+			authError(w, http.StatusUnauthorized, types.ErrorCodeUnauthorized, err.Error())
+			return nil, false
+		}
+
+		serverError(w, err)
+		return nil, false
+	}
+
+	if err := checkTokenRevoked(token); err != nil {
+		if err == errTokenRevoked {
+			authError(w, http.StatusUnauthorized, types.ErrorCodeTokenRevoked, err.Error())
 			return nil, false
 		}
+
+		serverError(w, err)
+		return nil, false
+	}
+
+	if token.PasswordChangeOnly() && !passwordChangeRequest(req, username) {
+		authError(w, http.StatusForbidden, types.ErrorCodePasswordChangeRequired, errPasswordChangeRequired.Error())
+		return nil, false
 	}
 
 	return token, true
 }
 
+// passwordChangeRequest checks whether the request is one of the few which are
+// allowed with a password change token (see auth.Token.PasswordChangeOnly()):
+// looking up the caller, updating the caller's own user, changing the
+// password and logging out.
+// params:
+//  req: http request
+//  username: value of the token's username claim
+// return values:
+//  bool: true if the request can be made using a password change token
+func passwordChangeRequest(req *http.Request, username string) bool {
+	switch {
+	case req.Method == "GET" && req.URL.Path == WhoamiPath:
+		return true
+	case req.Method == "PATCH" && req.URL.Path == V1Prefix+"/local_users/"+username+"/":
+		return true
+	case req.Method == "PUT" && req.URL.Path == PasswordPath:
+		return true
+	case req.Method == "POST" && req.URL.Path == LogoutPath:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseRequestToken parses one of our tokens, authenticates a personal access
+// token or, if Kubernetes authentication is enabled, authenticates a Kubernetes
+// ServiceAccount token.
+// params:
+//  tokenStr: token sent with the request; see tokenFromHeaders()
+// return values:
+//  *auth.Token: token object parsed from tokenStr
+//  error: as returned by auth.ParseToken(), auth.AuthenticateAccessToken() or
+//         auth.AuthenticateServiceAccount()
+func parseRequestToken(tokenStr string) (*auth.Token, error) {
+	if auth.IsAccessToken(tokenStr) {
+		return auth.AuthenticateAccessToken(tokenStr)
+	}
+
+	if kubernetes.Enabled() && auth.IsForeignToken(tokenStr) {
+		return auth.AuthenticateServiceAccount(tokenStr)
+	}
+
+	return auth.ParseToken(tokenStr)
+}
+
+// bearerScheme prefixes tokens sent in the Authorization header; it's case-insensitive
+const bearerScheme = "bearer "
+
+// tokenFromHeaders returns the token sent with a request: the bearer token of
+// the Authorization header or else the X-Auth-Token header. Authorization
+// headers using other schemes, e.g. the introspection credential, are ignored.
+// params:
+//  header: headers of the request
+// return values:
+//  string: the token; empty if the request carries none
+//  bool: true if either header carries a token, even an empty one
+//  error: errConflictingTokens if both headers carry different tokens
+func tokenFromHeaders(header http.Header) (string, bool, error) {
+	authorization := header.Get("Authorization")
+	bearer := len(authorization) >= len(bearerScheme) && strings.EqualFold(authorization[:len(bearerScheme)], bearerScheme)
+
+	xAuthToken, hasXAuthToken := header.Get("X-Auth-Token"), len(header["X-Auth-Token"]) > 0
+
+	switch {
+	case !bearer:
+		return xAuthToken, hasXAuthToken, nil
+	case hasXAuthToken && xAuthToken != strings.TrimSpace(authorization[len(bearerScheme):]):
+		return "", true, errConflictingTokens
+	default:
+		return strings.TrimSpace(authorization[len(bearerScheme):]), true, nil
+	}
+}
+
+// requestTokenString returns the token of a request which passed validateToken() already.
+// params:
+//  req: http request
+// return values:
+//  string: the token as returned by tokenFromHeaders()
+func requestTokenString(req *http.Request) string {
+	tokenStr, _, _ := tokenFromHeaders(req.Header)
+	return tokenStr
+}
+
+// requestToken parses the token of a request which passed validateToken() already.
+// params:
+//  req: http request
+// return values:
+//  *auth.Token: token object parsed from the request's token header, or standing
+//               in for its client certificate if it carries no token
+//  error: as returned by parseRequestToken() or auth.AuthenticateClientCertificate()
+func requestToken(req *http.Request) (*auth.Token, error) {
+	tokenStr, found, _ := tokenFromHeaders(req.Header)
+	if username, ok := clientCertIdentity(req); ok && !found {
+		return auth.AuthenticateClientCertificate(username)
+	}
+
+	return parseRequestToken(tokenStr)
+}
+
+// checkTokenUser checks that the local user a token was issued to still exists
+// and is enabled. Tokens of LDAP users are not checked.
+// params:
+//  username: value of the token's username claim
+// return values:
+//  error: nil if the user can use the token, errInvalidUser if the user was deleted
+//    after the token was issued, errUserDisabled if the user was disabled, or any
+//    other error encountered while looking up the user
+func checkTokenUser(username string) error {
+	if !common.LocalUsernamePattern.MatchString(username) { // not a local user
+		return nil
+	}
+
+	user, err := db.GetLocalUser(username)
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound { // User not found (i.e, deleted)
+			return errInvalidUser
+		}
+
+		return err
+	}
+
+	if user.DeletedAt != 0 {
+		return errInvalidUser
+	}
+
+	if user.Disable {
+		return errUserDisabled
+	}
+
+	return nil
+}
+
+// checkTokenRevoked checks that neither the token nor, if it was issued before
+// they were revoked, the tokens of its user or principals have been revoked.
+// params:
+//  token: token to be checked
+// return values:
+//  error: nil if the token was not revoked, errTokenRevoked if it was, or any
+//    other error encountered while checking
+func checkTokenRevoked(token *auth.Token) error {
+	if id := token.ID(); !common.IsEmpty(id) { // tokens without an ID can't be revoked individually
+		revoked, err := db.IsTokenRevoked(id)
+		if err != nil {
+			return err
+		}
+
+		if revoked {
+			return errTokenRevoked
+		}
+	}
+
+	issuedAt := token.IssuedAt()
+	checked := map[string]bool{}
+
+	for _, principal := range append([]string{token.GetClaim("username")}, token.Principals()...) {
+		if common.IsEmpty(principal) || checked[principal] {
+			continue
+		}
+		checked[principal] = true
+
+		revokedAt, err := db.PrincipalTokensRevokedAt(principal)
+		if err != nil {
+			return err
+		}
+
+		if issuedAt <= revokedAt {
+			return errTokenRevoked
+		}
+	}
+
+	return nil
+}
+
 //
 // processStatusCodes processes the given statusCode and
 // writes the respective http response using the given writer.
 // params:
 //  statusCode: integer representing the http status code
-//  resp: response to be written along with statusCode
+//  resp: response to be written along with statusCode; the error message for error codes
 //  w: http response writer
 //
 func processStatusCodes(statusCode int, resp []byte, w http.ResponseWriter) {
@@ -538,14 +1738,30 @@ func processStatusCodes(statusCode int, resp []byte, w http.ResponseWriter) {
 	case http.StatusCreated, http.StatusOK:
 		w.WriteHeader(statusCode)
 		w.Write(resp)
-	case http.StatusNotFound, http.StatusNoContent:
+	case http.StatusNoContent:
 		w.WriteHeader(statusCode)
+	case http.StatusNotFound:
+		msg := string(resp)
+		if common.IsEmpty(msg) {
+			msg = "Not found"
+		}
+		writeError(w, statusCode, types.ErrorCodeNotFound, msg, nil)
 	default: //InternalServerError, BadRequest, etc..
 		respStr := string(resp)
 		log.Println(respStr)
-		w.WriteHeader(statusCode)
-		writeJSONResponse(w, errorResponse{Error: respStr})
+		writeError(w, statusCode, errorCode(statusCode), respStr, nil)
+	}
+}
+
+// datastoreStatusCode returns the HTTP status code of an internal error: 503
+// if it was caused by the datastore's circuit breaker being open, which tells
+// clients to retry later, and 500 otherwise.
+func datastoreStatusCode(err error) int {
+	if err == auth_errors.ErrDatastoreUnavailable {
+		return http.StatusServiceUnavailable
 	}
+
+	return http.StatusInternalServerError
 }
 
 // writeJSONResponse writes the given data in JSON format.
@@ -576,12 +1792,1823 @@ func convertAuthz(authz types.Authorization) GetAuthorizationReply {
 		PrincipalName: authz.PrincipalName,
 		Local:         authz.Local,
 		Role:          authz.ClaimValue,
+		ExpiresAt:     authz.ExpiresAt,
+		Expired:       authz.Expired(time.Now().Unix()),
+		CreatedAt:     authz.CreatedAt,
+		UpdatedAt:     authz.UpdatedAt,
+		GrantedBy:     authz.GrantedBy,
 	}
 
+	getAuthzReply.CustomRole = strings.HasPrefix(authz.ClaimKey, types.CustomRoleClaimKey)
+
 	// Fill in tenant name only for tenant claim key
 	if strings.HasPrefix(authz.ClaimKey, types.TenantClaimKey) {
 		getAuthzReply.TenantName = strings.TrimPrefix(authz.ClaimKey, types.TenantClaimKey)
+		getAuthzReply.AllTenants = getAuthzReply.TenantName == string(types.AllTenants)
 	}
 
 	return getAuthzReply
 }
+
+// tenantAdminScope limits the authorizations a token's holder can manage:
+// admins can manage all of them, tenant admins only the tenant authorizations
+// of the tenants they administer. Wildcard authorizations (see
+// types.AllTenants) can only be managed by admins.
+type tenantAdminScope struct {
+	token     *auth.Token
+	superuser bool
+	tenants   map[string]bool // tenant => administered; filled in as tenants are checked
+}
+
+// newTenantAdminScope returns the scope of the request's token.
+// params:
+//  req: request which passed tenantAdminOnly()
+// return values:
+//  *tenantAdminScope: the token's scope
+//  error: nil if successful, else the error from parsing the token
+func newTenantAdminScope(req *http.Request) (*tenantAdminScope, error) {
+	token, err := requestToken(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tenantAdminScope{token: token, superuser: token.IsSuperuser(), tenants: map[string]bool{}}, nil
+}
+
+// allows returns true if the token's holder can manage authorizations for the given tenant
+func (s *tenantAdminScope) allows(tenant string) bool {
+	if s.superuser {
+		return true
+	}
+
+	if common.IsEmpty(tenant) || tenant == string(types.AllTenants) {
+		return false
+	}
+
+	allowed, found := s.tenants[tenant]
+	if !found {
+		allowed = s.token.CheckClaims(types.Tenant(tenant), types.TenantAdmin) == nil
+		s.tenants[tenant] = allowed
+	}
+
+	return allowed
+}
+
+// username returns the name of the token's holder, who's recorded as the
+// granter of the authorizations they add
+func (s *tenantAdminScope) username() string {
+	return s.token.GetClaim(auth.UsernameClaimKey)
+}
+
+// deny logs an attempt to manage authorizations outside the scope and returns a 403
+func (s *tenantAdminScope) deny(format string, args ...interface{}) (int, []byte) {
+	log.Warnf("audit: denied %q: %s", s.username(), fmt.Sprintf(format, args...))
+
+	return http.StatusForbidden, []byte("access denied")
+}
+
+// checkGrant checks that the token's holder can grant `role` on `tenant`;
+// tenant admins can't grant the admin role or roles on other tenants.
+// return values:
+//  int: http.StatusOK if the grant is allowed, else http.StatusForbidden
+//  []byte: http response message if the grant is denied
+func (s *tenantAdminScope) checkGrant(role types.RoleType, tenant, principal string) (int, []byte) {
+	if s.superuser {
+		return http.StatusOK, nil
+	}
+
+	if role == types.Admin || !s.allows(tenant) {
+		return s.deny("granting %s on tenant %q to %q", role, tenant, principal)
+	}
+
+	return http.StatusOK, nil
+}
+
+// checkAuthorization checks that the token's holder can manage an existing authorization.
+// params:
+//  authzUUID: UUID of the authorization
+//  action: what the caller is about to do, for the audit log, e.g. "deleting"
+// return values:
+//  int: http.StatusOK if the authorization can be managed, else an http status code
+//  []byte: http response message if it can't be managed
+func (s *tenantAdminScope) checkAuthorization(authzUUID, action string) (int, []byte) {
+	if s.superuser {
+		return http.StatusOK, nil
+	}
+
+	authz, err := auth.GetAuthorization(authzUUID)
+	switch err {
+	case nil:
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	default:
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	if !s.allows(convertAuthz(authz).TenantName) {
+		return s.deny("%s authorization %s (%s=%s for principal %q)",
+			action, authz.UUID, authz.ClaimKey, authz.ClaimValue, authz.PrincipalName)
+	}
+
+	return http.StatusOK, nil
+}
+
+// checkAuthorizationScope checks that the request's caller can manage the given authorization
+func checkAuthorizationScope(req *http.Request, authzUUID, action string) (int, []byte) {
+	scope, err := newTenantAdminScope(req)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return scope.checkAuthorization(authzUUID, action)
+}
+
+// validateAuthzExpiry checks the expiry time of a new or updated authorization.
+// params:
+//  expiresAt: time in seconds since the epoch; 0 if the authorization never expires
+// return values:
+//  error: nil if the expiry time is 0 or in the future
+func validateAuthzExpiry(expiresAt int64) error {
+	if expiresAt != 0 && expiresAt <= time.Now().Unix() {
+		return errors.New("expires_at must be in the future")
+	}
+
+	return nil
+}
+
+// updateAuthorizationHelper helper function to update an authorization in place.
+// params:
+//  authzUUID: UUID of the authorization to be updated
+//  updateAuthzReq: the fields of the authorization to change
+//  username: user making the update; recorded as the granter of a new role or tenant
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful update, it contains the `GetAuthorizationReply` object
+func updateAuthorizationHelper(authzUUID string, updateAuthzReq *UpdateAuthorizationRequest, username string) (int, []byte) {
+	if updateAuthzReq.Role != nil || updateAuthzReq.TenantName != nil {
+		return updateAuthorizationGrantHelper(authzUUID, updateAuthzReq, username)
+	}
+
+	if updateAuthzReq.ExpiresAt == nil {
+		return http.StatusBadRequest, []byte("expires_at, role or tenantName is required")
+	}
+
+	if err := validateAuthzExpiry(*updateAuthzReq.ExpiresAt); err != nil {
+		return http.StatusBadRequest, []byte(err.Error())
+	}
+
+	var authz types.Authorization
+	update := func() error {
+		var err error
+		authz, err = auth.UpdateAuthorizationExpiry(authzUUID, *updateAuthzReq.ExpiresAt)
+		return err
+	}
+
+	// admins which expire don't count as the last admin
+	var err error
+	if *updateAuthzReq.ExpiresAt != 0 {
+		err = auth.GuardLastAdmin(withUUID(authzUUID), update)
+	} else {
+		err = update()
+	}
+
+	switch err {
+	case nil:
+		jData, err := json.Marshal(convertAuthz(authz))
+		if err != nil {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+
+		return http.StatusOK, jData
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	case auth_errors.ErrIllegalOperation:
+		return http.StatusBadRequest, []byte(err.Error())
+	case auth_errors.ErrLastAdmin:
+		return http.StatusConflict, []byte(fmt.Sprintf("Cannot make authorization %q expire, it's held by the last admin", authzUUID))
+	case auth_errors.ErrConcurrentUpdate: // from auth.GuardLastAdmin()
+		return http.StatusConflict, []byte(fmt.Sprintf("Another proxy is removing an admin; retry updating authorization %q", authzUUID))
+	default:
+		log.Debugf("Failed to update authorization %q: %#v", authzUUID, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to update authorization %q", authzUUID))
+	}
+}
+
+// updateAuthorizationGrantHelper helper function to change the role and/or
+// tenant of a tenant authorization; the update is validated like a new
+// authorization (see parseGrant()).
+// params:
+//  authzUUID: UUID of the authorization to be updated
+//  updateAuthzReq: the fields of the authorization to change
+//  username: user making the update; recorded as the granter
+// return values:
+//  int: http status code; http.StatusConflict if the authorization changed concurrently
+//  []byte: http response message; this goes along with status code
+//          on successful update, it contains the `GetAuthorizationReply` object
+func updateAuthorizationGrantHelper(authzUUID string, updateAuthzReq *UpdateAuthorizationRequest, username string) (int, []byte) {
+	current, err := auth.GetAuthorization(authzUUID)
+	switch {
+	case err == auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	case err != nil:
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to update authorization %q", authzUUID))
+	}
+
+	reply := convertAuthz(current)
+	if common.IsEmpty(reply.TenantName) {
+		return http.StatusBadRequest, []byte("only the role and tenant of tenant authorizations can be changed")
+	}
+
+	grant, err := parseGrant(updatedAuthorizationRequest(reply, updateAuthzReq))
+	switch {
+	case err != nil:
+		return http.StatusBadRequest, []byte(err.Error())
+	case grant.Role == types.Admin:
+		return http.StatusBadRequest, []byte("the admin role can't be granted on a tenant")
+	case updateAuthzReq.ExpiresAt == nil:
+		grant.ExpiresAt = current.ExpiresAt
+	}
+
+	if grant.TenantName != reply.TenantName {
+		if status, resp := checkTenantMove(grant); status != http.StatusOK {
+			return status, resp
+		}
+	}
+
+	authz, err := auth.UpdateAuthorization(current, grant.TenantName, grant.Role, grant.ExpiresAt, username)
+	switch err {
+	case nil:
+		jData, err := json.Marshal(convertAuthz(authz))
+		if err != nil {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+
+		return http.StatusOK, jData
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	case auth_errors.ErrIllegalOperation:
+		return http.StatusBadRequest, []byte(err.Error())
+	case auth_errors.ErrConcurrentUpdate:
+		return http.StatusConflict, []byte(fmt.Sprintf("Authorization %q was updated concurrently; read it again and retry", authzUUID))
+	default:
+		log.Debugf("Failed to update authorization %q: %#v", authzUUID, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to update authorization %q", authzUUID))
+	}
+}
+
+// addCustomRoleAuthorizationHelper helper function to grant a custom role;
+// custom roles aren't granted on a tenant and only admins can grant them.
+// params:
+//  scope: tenants the caller can manage authorizations for
+//  addAuthzReq: the authorization to add; its role names a custom role
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains the `GetAuthorizationReply` object
+func addCustomRoleAuthorizationHelper(scope *tenantAdminScope, addAuthzReq *AddAuthorizationRequest) (int, []byte) {
+	if !scope.superuser {
+		return scope.deny("granting custom role %q to %q", addAuthzReq.Role, addAuthzReq.PrincipalName)
+	}
+
+	if common.IsEmpty(addAuthzReq.PrincipalName) {
+		return http.StatusBadRequest, []byte("principal name is missing")
+	}
+
+	if !common.IsEmpty(addAuthzReq.TenantName) {
+		return http.StatusBadRequest, []byte("custom roles apply to all tenants; no tenant can be specified")
+	}
+
+	if err := validateAuthzExpiry(addAuthzReq.ExpiresAt); err != nil {
+		return http.StatusBadRequest, []byte(err.Error())
+	}
+
+	authz, err := auth.AddCustomRoleAuthorization(addAuthzReq.Role, addAuthzReq.PrincipalName,
+		addAuthzReq.Local, addAuthzReq.ExpiresAt, scope.username())
+	switch err {
+	case nil:
+		jData, err := json.Marshal(convertAuthz(authz))
+		if err != nil {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+
+		return http.StatusCreated, jData
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusBadRequest, []byte("illegal role specified")
+	case auth_errors.ErrKeyExists:
+		return http.StatusBadRequest, []byte(fmt.Sprintf("%q already has the %q role", addAuthzReq.PrincipalName, addAuthzReq.Role))
+	case auth_errors.ErrIllegalOperation:
+		return http.StatusBadRequest, []byte(err.Error())
+	default:
+		log.Debugf("Failed to grant custom role %q to %q: %#v", addAuthzReq.Role, addAuthzReq.PrincipalName, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to grant role %q", addAuthzReq.Role))
+	}
+}
+
+// updatedAuthorizationRequest returns the request adding the authorization an
+// update results in, so that the update is validated like a new authorization.
+// params:
+//  current: the authorization to be updated
+//  updateAuthzReq: the fields of the authorization to change
+func updatedAuthorizationRequest(current GetAuthorizationReply, updateAuthzReq *UpdateAuthorizationRequest) *AddAuthorizationRequest {
+	addAuthzReq := &AddAuthorizationRequest{
+		PrincipalName: current.PrincipalName,
+		Local:         current.Local,
+		Role:          current.Role,
+		TenantName:    current.TenantName,
+	}
+
+	if updateAuthzReq.Role != nil {
+		addAuthzReq.Role = *updateAuthzReq.Role
+	}
+
+	if updateAuthzReq.TenantName != nil {
+		addAuthzReq.TenantName = *updateAuthzReq.TenantName
+	}
+
+	if updateAuthzReq.ExpiresAt != nil {
+		addAuthzReq.ExpiresAt = *updateAuthzReq.ExpiresAt
+	}
+
+	return addAuthzReq
+}
+
+// checkTenantMove checks that the principal of an authorization moved to
+// another tenant doesn't have a role on that tenant already.
+// params:
+//  grant: the authorization after the update
+// return values:
+//  int: http.StatusOK if the authorization can be moved, else an http status code
+//  []byte: http response message if it can't be moved
+func checkTenantMove(grant *auth.AuthorizationGrant) (int, []byte) {
+	existing, err := auth.ExistingGrant(grant)
+	switch {
+	case err != nil:
+		return datastoreStatusCode(err), []byte(err.Error())
+	case !common.IsEmpty(existing):
+		return http.StatusBadRequest, []byte(fmt.Sprintf("%q already has a role on tenant %q (authorization %s)",
+			grant.PrincipalName, grant.TenantName, existing))
+	}
+
+	return http.StatusOK, nil
+}
+
+// getEndpointPolicyRulesHelper helper function to list all the endpoint policy rules.
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful fetch from data store, it contains the list of rules
+func getEndpointPolicyRulesHelper() (int, []byte) {
+	rules, err := db.ListEndpointPolicyRules()
+	if err != nil {
+		log.Debugf("Failed to list endpoint policy rules: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to fetch endpoint policy rules")
+	}
+
+	jData, err := json.Marshal(rules)
+	if err != nil {
+		log.Debugf("Failed to marshal %#v: %#v", rules, err)
+		return http.StatusInternalServerError, []byte("Failed to fetch endpoint policy rules")
+	}
+
+	return http.StatusOK, jData
+}
+
+// getEndpointPolicyRuleHelper helper function to get the given endpoint policy rule.
+// params:
+//  id: of the rule to fetch from the data store
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful fetch from data store, it contains `types.EndpointPolicyRule` object
+func getEndpointPolicyRuleHelper(id string) (int, []byte) {
+	rule, err := db.GetEndpointPolicyRule(id)
+
+	switch err {
+	case nil:
+		jData, err := json.Marshal(rule)
+		if err != nil {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+
+		return http.StatusOK, jData
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	default:
+		log.Debugf("Failed to fetch endpoint policy rule %q: %#v", id, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to fetch endpoint policy rule %q", id))
+	}
+}
+
+// addEndpointPolicyRuleHelper helper function to add the given endpoint policy rule to the data store.
+// params:
+//  rule: rule to be added; its ID is generated
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+func addEndpointPolicyRuleHelper(rule *types.EndpointPolicyRule) (int, []byte) {
+	if err := auth.ValidateEndpointPolicyRule(rule); err != nil {
+		return http.StatusBadRequest, []byte(err.Error())
+	}
+
+	rule.ID = uuid.NewV4().String()
+
+	if err := db.AddEndpointPolicyRule(rule); err != nil {
+		log.Debugf("Failed to add endpoint policy rule %#v: %#v", rule, err)
+		return http.StatusInternalServerError, []byte("Failed to add endpoint policy rule")
+	}
+
+	jData, err := json.Marshal(rule)
+	if err != nil {
+		log.Debugf("Failed to marshal %#v: %#v", rule, err)
+		return http.StatusInternalServerError, []byte("Failed to add endpoint policy rule")
+	}
+
+	return http.StatusCreated, jData
+}
+
+// updateEndpointPolicyRuleHelper helper function to replace the given endpoint policy rule.
+// params:
+//  id: of the rule to be updated
+//  rule: new definition of the rule
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+func updateEndpointPolicyRuleHelper(id string, rule *types.EndpointPolicyRule) (int, []byte) {
+	if err := auth.ValidateEndpointPolicyRule(rule); err != nil {
+		return http.StatusBadRequest, []byte(err.Error())
+	}
+
+	rule.ID = id
+
+	switch err := db.UpdateEndpointPolicyRule(rule); err {
+	case nil:
+		jData, err := json.Marshal(rule)
+		if err != nil {
+			log.Debugf("Failed to marshal %#v: %#v", rule, err)
+			return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to update endpoint policy rule %q", id))
+		}
+
+		return http.StatusOK, jData
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	default:
+		log.Debugf("Failed to update endpoint policy rule %q: %#v", id, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to update endpoint policy rule %q", id))
+	}
+}
+
+// deleteEndpointPolicyRuleHelper helper function to delete the given endpoint policy rule.
+// params:
+//  id: of the rule to be deleted
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+func deleteEndpointPolicyRuleHelper(id string) (int, []byte) {
+	switch err := db.DeleteEndpointPolicyRule(id); err {
+	case nil:
+		return http.StatusNoContent, nil
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	default:
+		log.Debugf("Failed to delete endpoint policy rule %q: %#v", id, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to delete endpoint policy rule %q", id))
+	}
+}
+
+// getCustomRolesHelper helper function to list all the custom roles.
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful fetch from data store, it contains the list of roles
+func getCustomRolesHelper() (int, []byte) {
+	roles, err := db.ListCustomRoles()
+	if err != nil {
+		log.Debugf("Failed to list custom roles: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to fetch custom roles")
+	}
+
+	jData, err := json.Marshal(roles)
+	if err != nil {
+		log.Debugf("Failed to marshal %#v: %#v", roles, err)
+		return http.StatusInternalServerError, []byte("Failed to fetch custom roles")
+	}
+
+	return http.StatusOK, jData
+}
+
+// getCustomRoleHelper helper function to get the given custom role.
+// params:
+//  name: of the role to fetch from the data store
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful fetch from data store, it contains `types.CustomRole` object
+func getCustomRoleHelper(name string) (int, []byte) {
+	role, err := db.GetCustomRole(name)
+
+	switch err {
+	case nil:
+		jData, err := json.Marshal(role)
+		if err != nil {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+
+		return http.StatusOK, jData
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	default:
+		log.Debugf("Failed to fetch custom role %q: %#v", name, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to fetch custom role %q", name))
+	}
+}
+
+// addCustomRoleHelper helper function to add the given custom role to the data store.
+// params:
+//  role: role to be added
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+func addCustomRoleHelper(role *types.CustomRole) (int, []byte) {
+	if err := auth.ValidateCustomRole(role); err != nil {
+		return http.StatusBadRequest, []byte(err.Error())
+	}
+
+	switch err := db.AddCustomRole(role); err {
+	case nil:
+	case auth_errors.ErrKeyExists:
+		return http.StatusBadRequest, []byte(fmt.Sprintf("Role %q exists already", role.Name))
+	default:
+		log.Debugf("Failed to add custom role %#v: %#v", role, err)
+		return http.StatusInternalServerError, []byte("Failed to add custom role")
+	}
+
+	jData, err := json.Marshal(role)
+	if err != nil {
+		log.Debugf("Failed to marshal %#v: %#v", role, err)
+		return http.StatusInternalServerError, []byte("Failed to add custom role")
+	}
+
+	return http.StatusCreated, jData
+}
+
+// deleteCustomRoleHelper helper function to delete the given custom role.
+// params:
+//  name: of the role to be deleted
+// return values:
+//  int: http status code; http.StatusConflict if the role is still granted
+//  []byte: http response message; this goes along with status code
+func deleteCustomRoleHelper(name string) (int, []byte) {
+	switch err := auth.DeleteCustomRole(name); err {
+	case nil:
+		return http.StatusNoContent, nil
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	case auth_errors.ErrIllegalOperation:
+		return http.StatusBadRequest, []byte(fmt.Sprintf("%q is a built-in role and can't be deleted", name))
+	case auth_errors.ErrRoleInUse:
+		return http.StatusConflict, []byte(fmt.Sprintf("Role %q is still granted; delete its authorizations first", name))
+	default:
+		log.Debugf("Failed to delete custom role %q: %#v", name, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to delete custom role %q", name))
+	}
+}
+
+// endpointPolicyDryRunHelper helper function to evaluate the endpoint policy
+// for the given user and request without proxying anything.
+// params:
+//  dryRunReq: user and request to evaluate the policy for
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains `auth.EndpointPolicyDecision` object
+func endpointPolicyDryRunHelper(dryRunReq *EndpointPolicyDryRunRequest) (int, []byte) {
+	principals := dryRunReq.Principals
+	if len(principals) == 0 && !common.IsEmpty(dryRunReq.Username) {
+		principals = []string{dryRunReq.Username}
+	}
+
+	if len(principals) == 0 || common.IsEmpty(dryRunReq.Method) || !strings.HasPrefix(dryRunReq.Path, "/") {
+		return http.StatusBadRequest, []byte("username or principals, method and path must be provided")
+	}
+
+	rules, err := db.ListEndpointPolicyRules()
+	if err != nil {
+		log.Debugf("Failed to list endpoint policy rules: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to fetch endpoint policy rules")
+	}
+
+	// the token is never signed or handed out; it's only used to look up the principals' authorizations
+	token, err := auth.NewTokenWithClaims(principals)
+	if err != nil {
+		log.Debugf("Failed to create token for %v: %#v", principals, err)
+		return http.StatusInternalServerError, []byte("Failed to evaluate endpoint policy")
+	}
+
+	role := types.Ops
+	if token.IsSuperuser() {
+		role = types.Admin
+	}
+
+	decision := auth.EvaluateEndpointPolicy(rules, role, dryRunReq.Method, dryRunReq.Path)
+	if role != types.Admin {
+		restrictDryRunDecision(&decision, token, dryRunReq)
+	}
+
+	jData, err := json.Marshal(decision)
+	if err != nil {
+		log.Debugf("Failed to marshal %#v: %#v", decision, err)
+		return http.StatusInternalServerError, []byte("Failed to evaluate endpoint policy")
+	}
+
+	return http.StatusOK, jData
+}
+
+// restrictDryRunDecision applies the checks enforceRBAC() makes on top of the
+// endpoint policy for users who aren't superusers.
+// params:
+//  decision: endpoint policy decision; denied if any of the checks fails
+//  token: carries the principals of the user
+//  dryRunReq: request to evaluate the policy for
+func restrictDryRunDecision(decision *auth.EndpointPolicyDecision, token *auth.Token, dryRunReq *EndpointPolicyDryRunRequest) {
+	if decision.Allowed && guestWrite(token, dryRunReq.Method) {
+		decision.Allowed = false
+		decision.Reason += "; guests can only read"
+	}
+
+	if decision.TenantScoped && !common.IsEmpty(dryRunReq.TenantName) {
+		if err := token.CheckClaims(types.Tenant(dryRunReq.TenantName), tenantRole(dryRunReq.Method)); err != nil {
+			decision.Allowed = false
+			decision.Reason += fmt.Sprintf("; not authorized for tenant %q", dryRunReq.TenantName)
+		}
+	}
+}
+
+// validIntrospectionCredential checks the given client ID and secret against the
+// introspection credential from the settings.
+// params:
+//  clientID: client ID sent by the caller
+//  secret: client secret sent by the caller
+// return values:
+//  bool: true if both match; always false if no introspection credential is configured
+func validIntrospectionCredential(clientID, secret string) bool {
+	expectedID, _ := common.Global().Get(common.IntrospectionClientIDKey)
+	expectedSecret, _ := common.Global().Get(common.IntrospectionClientSecretKey)
+
+	if common.IsEmpty(expectedID) || common.IsEmpty(expectedSecret) {
+		return false
+	}
+
+	idMatches := subtle.ConstantTimeCompare([]byte(clientID), []byte(expectedID)) == 1
+	secretMatches := subtle.ConstantTimeCompare([]byte(secret), []byte(expectedSecret)) == 1
+
+	return idMatches && secretMatches
+}
+
+// introspectionRateLimit returns the number of introspection requests per second
+// allowed for each client IP from the settings.
+func introspectionRateLimit() float64 {
+	if value, err := common.Global().Get(common.IntrospectionRateLimitKey); err == nil {
+		if limit, err := strconv.ParseFloat(value, 64); err == nil && limit >= 0 {
+			return limit
+		}
+	}
+
+	return defaultIntrospectionRateLimit
+}
+
+// describeToken checks whether the given token is currently valid and describes it.
+// params:
+//  tokenStr: token to be introspected
+// return values:
+//  *IntrospectionResponse: description of the token; only `Active: false` if the token is
+//    invalid, expired, revoked or belongs to a deleted or disabled user, plus
+//    `Revoked: true` if it was revoked
+//  error: any error encountered while checking the token against the data store
+func describeToken(tokenStr string) (*IntrospectionResponse, error) {
+	inactive := &IntrospectionResponse{Active: false}
+
+	if common.IsEmpty(tokenStr) {
+		return inactive, nil
+	}
+
+	token, err := auth.ParseToken(tokenStr)
+	if err != nil {
+		return inactive, nil
+	}
+
+	username := token.GetClaim(auth.UsernameClaimKey)
+	if common.IsEmpty(username) {
+		return inactive, nil
+	}
+
+	if err := checkTokenUser(username); err != nil {
+		if err == errInvalidUser || err == errUserDisabled {
+			return inactive, nil
+		}
+
+		return nil, err
+	}
+
+	if err := checkTokenRevoked(token); err != nil {
+		if err == errTokenRevoked {
+			return &IntrospectionResponse{Active: false, Revoked: true}, nil
+		}
+
+		return nil, err
+	}
+
+	// the token doesn't give access to anything other services care about
+	if token.PasswordChangeOnly() {
+		return inactive, nil
+	}
+
+	tenants, err := token.Tenants()
+	if err != nil {
+		return nil, err
+	}
+
+	role := types.Ops
+	if token.IsSuperuser() {
+		role = types.Admin
+	}
+
+	return &IntrospectionResponse{
+		Active:     true,
+		Username:   username,
+		Principals: token.Principals(),
+		Role:       role.String(),
+		Tenants:    tenants,
+		Iat:        token.IssuedAt(),
+		Exp:        token.ExpiresAt(),
+	}, nil
+}
+
+// introspectTokenHelper helper function for `introspectToken`.
+// params:
+//  introspectionReq: request holding the token to be introspected
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON response based on the execution flow
+func introspectTokenHelper(introspectionReq *IntrospectionRequest) (int, []byte) {
+	introspection, err := describeToken(introspectionReq.Token)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	jsonData, err := json.Marshal(introspection)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jsonData
+}
+
+// logoutHelper helper function for `logoutHandler`; it records the token's ID
+// along with its expiry, after which the record can be pruned.
+// params:
+//  token: the caller's token
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or empty based on the execution flow
+func logoutHelper(token *auth.Token) (int, []byte) {
+	if token.AccessToken() {
+		return http.StatusBadRequest, []byte("Personal access tokens are revoked by deleting them at " + AccessTokensPath)
+	}
+
+	if token.ClientCertificate() {
+		return http.StatusBadRequest, []byte("Requests authenticated with a client certificate carry no token to revoke")
+	}
+
+	id := token.ID()
+	if common.IsEmpty(id) {
+		return http.StatusBadRequest, []byte("Token has no ID and can't be revoked; it expires at " +
+			time.Unix(token.ExpiresAt(), 0).UTC().Format(time.RFC3339))
+	}
+
+	if err := db.RevokeToken(id, token.ExpiresAt()); err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	if err := db.DeleteSession(id); err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	log.Infof("user %q logged out; revoked token %q", token.GetClaim(auth.UsernameClaimKey), id)
+
+	return http.StatusNoContent, nil
+}
+
+// changePasswordHelper helper function for `changePassword`; it checks the
+// old password the same way local.Authenticate() does before storing the new one.
+// params:
+//  username: of the calling user
+//  changeReq: the caller's old and new password
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or empty based on the execution flow
+func changePasswordHelper(username string, changeReq *changePasswordRequest) (int, []byte) {
+	if common.IsEmpty(changeReq.OldPassword) || common.IsEmpty(changeReq.NewPassword) {
+		return http.StatusBadRequest, []byte("Both old_password and new_password must be provided")
+	}
+
+	if changeReq.OldPassword == changeReq.NewPassword {
+		return http.StatusBadRequest, []byte("The new password must differ from the old one")
+	}
+
+	user, err := db.GetLocalUser(username)
+	if err == nil && user.DeletedAt != 0 {
+		err = auth_errors.ErrKeyNotFound
+	}
+
+	switch err {
+	case nil:
+	case auth_errors.ErrKeyNotFound: // e.g. LDAP users; their password is managed by the directory
+		return http.StatusBadRequest, []byte("Only local users can change their password")
+	default:
+		log.Debugf("Failed to get local user %q: %#v", username, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to change the password of %q", username))
+	}
+
+	if user.Disable || !common.ValidatePassword(changeReq.OldPassword, user.PasswordHash) {
+		log.Debugf("Incorrect old password for user %q", username)
+		return http.StatusForbidden, []byte("access denied")
+	}
+
+	user.Password = changeReq.NewPassword
+	user.PasswordResetRequired = false
+	if err := db.UpdateLocalUser(username, user); err != nil {
+		log.Debugf("Failed to change the password of %q: %#v", username, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to change the password of %q", username))
+	}
+
+	log.Infof("user %q changed their password", username)
+
+	return http.StatusNoContent, nil
+}
+
+// passwordResetRequired checks whether an admin requires the given local user
+// to reset their password, telling such users apart from users whose password
+// expired when they're issued a password change token.
+// params:
+//  username: of the local user
+// return values:
+//  bool: true if the user's `password_reset_required` is set; false if the user
+//        can't be fetched, so that the password is reported as expired instead
+func passwordResetRequired(username string) bool {
+	user, err := db.GetLocalUser(username)
+	if err != nil {
+		log.Debugf("Failed to get local user %q: %#v", username, err)
+		return false
+	}
+
+	return user.PasswordResetRequired
+}
+
+// sessionOf checks whether a session belongs to the given principal, like
+// checkTokenRevoked() does for the session's token.
+// params:
+//  session: session to be checked
+//  principal: name of a user or one of the principals of users
+// return values:
+//  bool: true if the session's user or one of its principals is `principal`
+func sessionOf(session *types.Session, principal string) bool {
+	if common.SamePrincipal(session.Username, principal) {
+		return true
+	}
+
+	for _, p := range session.Principals {
+		if common.SamePrincipal(p, principal) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// recordSession adds the session of a token which was just issued, along with
+// the authorizations its principals matched.
+// params:
+//  req: http request the token was issued for
+//  token: the new token
+// return values:
+//  error: as returned by matchedAuthorizationUUIDs() or db.AddSession()
+func recordSession(req *http.Request, token *auth.Token) error {
+	matched, err := matchedAuthorizationUUIDs(token)
+	if err != nil {
+		return err
+	}
+
+	return db.AddSession(&types.Session{
+		ID:                    token.ID(),
+		Username:              token.GetClaim(auth.UsernameClaimKey),
+		Principals:            token.Principals(),
+		IssuedAt:              token.IssuedAt(),
+		ExpiresAt:             token.ExpiresAt(),
+		SourceIP:              common.RealIP(req),
+		MatchedAuthorizations: matched,
+	})
+}
+
+// matchedAuthorizationUUIDs returns the UUIDs of the authorizations the
+// principals of a token currently match (see auth.MatchedAuthorizations())
+// params:
+//  token: token of a user
+// return values:
+//  []string: the UUIDs, sorted
+//  error: as returned by auth.MatchedAuthorizations()
+func matchedAuthorizationUUIDs(token *auth.Token) ([]string, error) {
+	authzs, err := auth.MatchedAuthorizations(token.Principals())
+	if err != nil {
+		return nil, err
+	}
+
+	uuids := []string{}
+	for _, authz := range authzs {
+		uuids = append(uuids, authz.UUID)
+	}
+
+	return uuids, nil
+}
+
+// listSessionsHelper helper function for `listSessions`.
+// params:
+//  token: the caller's token
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON response based on the execution flow
+func listSessionsHelper(token *auth.Token) (int, []byte) {
+	sessions, err := db.ListSessions(time.Now().Unix())
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	if !token.IsSuperuser() {
+		username := token.GetClaim(auth.UsernameClaimKey)
+
+		own := []*types.Session{}
+		for _, session := range sessions {
+			if session.Username == username {
+				own = append(own, session)
+			}
+		}
+
+		sessions = own
+	}
+
+	jsonData, err := json.Marshal(sessions)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jsonData
+}
+
+// deleteSessionHelper helper function for `deleteSession`; it revokes the
+// session's token and deletes the session.
+// params:
+//  token: the caller's token
+//  id: ID of the session to be revoked
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or empty based on the execution flow
+func deleteSessionHelper(token *auth.Token, id string) (int, []byte) {
+	session, err := db.GetSession(id)
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return http.StatusNotFound, []byte("Session not found")
+		}
+
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	username := token.GetClaim(auth.UsernameClaimKey)
+	if session.Username != username && !token.IsSuperuser() { // don't tell others' sessions apart from missing ones
+		return http.StatusNotFound, []byte("Session not found")
+	}
+
+	if err := db.RevokeToken(session.ID, session.ExpiresAt); err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	if err := db.DeleteSession(session.ID); err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	log.Infof("audit: %q revoked session %q of %q", username, session.ID, session.Username)
+
+	return http.StatusNoContent, nil
+}
+
+// revokeUserSessionsHelper helper function for `revokeUserSessions`.
+// params:
+//  token: the caller's (admin) token
+//  username: user or principal whose tokens are to be revoked
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON RevokeSessionsReply
+func revokeUserSessionsHelper(token *auth.Token, username string) (int, []byte) {
+	if common.IsEmpty(username) {
+		return http.StatusBadRequest, []byte("username must be provided")
+	}
+
+	sessions, accessTokens, err := revokePrincipalTokens(username)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	log.Infof("audit: %q revoked all the tokens of %q: %d session(s), %d access token(s)",
+		token.GetClaim(auth.UsernameClaimKey), username, sessions, accessTokens)
+
+	jsonData, err := json.Marshal(RevokeSessionsReply{Username: username, Sessions: sessions, AccessTokens: accessTokens})
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jsonData
+}
+
+// accessTokenReply describes a personal access token without revealing it
+func accessTokenReply(record *types.AccessToken) AccessTokenReply {
+	return AccessTokenReply{
+		ID:        record.ID,
+		Name:      record.Name,
+		Username:  record.Username,
+		Prefix:    record.Prefix,
+		CreatedAt: record.CreatedAt,
+	}
+}
+
+// addAccessTokenHelper helper function for `addAccessToken`.
+// params:
+//  token: the caller's token; the new access token gets its user and principals
+//  addReq: the new access token's name
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON response based on the execution flow
+func addAccessTokenHelper(token *auth.Token, addReq *addAccessTokenRequest) (int, []byte) {
+	if common.IsEmpty(addReq.Name) {
+		return http.StatusBadRequest, []byte("Access token name must be provided")
+	}
+
+	// otherwise a leaked access token could be used to outlive its revocation
+	if token.AccessToken() {
+		return http.StatusBadRequest, []byte("Access tokens can't be created using an access token")
+	}
+
+	record, tokenStr, err := auth.NewAccessToken(addReq.Name, token, time.Now())
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	reply := accessTokenReply(record)
+	reply.Token = tokenStr
+
+	jsonData, err := json.Marshal(reply)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusCreated, jsonData
+}
+
+// listAccessTokensHelper helper function for `listAccessTokens`.
+// params:
+//  token: the caller's token
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON response based on the execution flow
+func listAccessTokensHelper(token *auth.Token) (int, []byte) {
+	records, err := db.ListAccessTokens()
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	superuser := token.IsSuperuser()
+	username := token.GetClaim(auth.UsernameClaimKey)
+
+	reply := []AccessTokenReply{}
+	for _, record := range records {
+		if superuser || record.Username == username {
+			reply = append(reply, accessTokenReply(record))
+		}
+	}
+
+	jsonData, err := json.Marshal(reply)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jsonData
+}
+
+// deleteAccessTokenHelper helper function for `deleteAccessToken`.
+// params:
+//  token: the caller's token
+//  id: ID of the access token to be revoked
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or empty based on the execution flow
+func deleteAccessTokenHelper(token *auth.Token, id string) (int, []byte) {
+	record, err := db.GetAccessToken(id)
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return http.StatusNotFound, []byte("Access token not found")
+		}
+
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	username := token.GetClaim(auth.UsernameClaimKey)
+	if record.Username != username && !token.IsSuperuser() { // don't tell others' access tokens apart from missing ones
+		return http.StatusNotFound, []byte("Access token not found")
+	}
+
+	if err := db.DeleteAccessToken(record.ID); err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	log.Infof("audit: %q revoked access token %q (%q) of %q", username, record.ID, record.Name, record.Username)
+
+	return http.StatusNoContent, nil
+}
+
+// tokenRole returns the highest role of a token's principals; unlike netmaster,
+// users are told whether they can manage their tenants.
+// params:
+//  token: token carrying principals, i.e. not a password change token
+// return values:
+//  types.RoleType: Admin, TenantAdmin, Ops or Guest; Ops if the token carries no role
+func tokenRole(token *auth.Token) types.RoleType {
+	switch {
+	case token.IsSuperuser():
+		return types.Admin
+	case token.CheckClaims(types.TenantAdmin) == nil:
+		return types.TenantAdmin
+	case token.CheckClaims(types.Ops) != nil && token.CheckClaims(types.Guest) == nil:
+		return types.Guest
+	default:
+		return types.Ops
+	}
+}
+
+// whoamiHelper helper function for `whoami`.
+// params:
+//  token: the caller's token
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON response based on the execution flow
+func whoamiHelper(token *auth.Token) (int, []byte) {
+	whoami := &WhoamiResponse{
+		Username:           token.GetClaim(auth.UsernameClaimKey),
+		PasswordChangeOnly: token.PasswordChangeOnly(),
+		CachedAuth:         token.CachedAuth(),
+		AccessToken:        token.AccessToken(),
+		ClientCertificate:  token.ClientCertificate(),
+	}
+
+	// password change tokens carry no principals, hence no role or tenants
+	if !whoami.PasswordChangeOnly {
+		tenants, err := token.Tenants()
+		if err != nil {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+
+		whoami.Role = tokenRole(token).String()
+		whoami.Tenants = tenants
+	}
+
+	jsonData, err := json.Marshal(whoami)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jsonData
+}
+
+// principalTypeServiceAccount is the principal type of Kubernetes ServiceAccounts
+const principalTypeServiceAccount = "serviceaccount"
+
+// principalType returns the type of the user a token was issued to: a
+// ServiceAccount, a local user or else an LDAP user.
+// params:
+//  token: the caller's token
+// return values:
+//  string: principalTypeServiceAccount, principalTypeLocal or principalTypeLDAP
+//  error: as returned by db.GetLocalUser() if it fails for other reasons than
+//         the user not being found
+func principalType(token *auth.Token) (string, error) {
+	username := token.GetClaim(auth.UsernameClaimKey)
+	switch {
+	case strings.HasPrefix(username, kubernetes.ServiceAccountPrefix):
+		return principalTypeServiceAccount, nil
+	case token.CachedAuth():
+		return principalTypeLDAP, nil
+	}
+
+	user, err := db.GetLocalUser(username)
+	switch {
+	case err == nil && user.DeletedAt == 0:
+		return principalTypeLocal, nil
+	case err == nil || err == auth_errors.ErrKeyNotFound:
+		return principalTypeLDAP, nil
+	default:
+		return "", err
+	}
+}
+
+// meHelper helper function for `me`.
+// params:
+//  token: the caller's token
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON response based on the execution flow
+func meHelper(token *auth.Token) (int, []byte) {
+	pType, err := principalType(token)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	roles, err := token.TenantRoles()
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	tenants := []string{}
+	for tenant := range roles {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	matched, err := matchedAuthorizationUUIDs(token)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	me := &MeResponse{
+		PrincipalName:         token.GetClaim(auth.UsernameClaimKey),
+		PrincipalType:         pType,
+		Principals:            token.Principals(),
+		Role:                  tokenRole(token).String(),
+		Tenants:               []TenantRoleRef{},
+		Attributes:            token.Attributes(),
+		MatchedAuthorizations: matched,
+	}
+
+	// the UI tells users who have no tenants to ask for access
+	me.StrictAuthorization = strictAuthorization() && !token.IsSuperuser()
+
+	for _, tenant := range tenants {
+		me.Tenants = append(me.Tenants, TenantRoleRef{TenantName: tenant, Role: roles[tenant].String()})
+	}
+
+	if expiresAt := token.ExpiresAt(); expiresAt != 0 {
+		me.ExpiresAt = time.Unix(expiresAt, 0).UTC().Format(time.RFC3339)
+	}
+
+	if pType == principalTypeLocal {
+		user, err := db.GetLocalUser(me.PrincipalName)
+		if err != nil {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+
+		me.Email, me.FullName = user.Email, user.FullName
+	}
+
+	jsonData, err := json.Marshal(me)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jsonData
+}
+
+// getTenantStatsHelper helper function for `getTenantStats`.
+// params:
+//  token: the caller's token; non-admins only get the statistics of their tenants
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON list of types.TenantStats
+func getTenantStatsHelper(token *auth.Token) (int, []byte) {
+	stats, err := tenantStats.snapshot()
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	if !token.IsSuperuser() {
+		tenants, err := token.Tenants()
+		if err != nil {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+
+		authorized := map[string]bool{}
+		for _, tenant := range tenants {
+			authorized[tenant] = true
+		}
+
+		filtered := []types.TenantStats{}
+		for _, s := range stats {
+			if authorized[s.Tenant] {
+				filtered = append(filtered, s)
+			}
+		}
+
+		stats = filtered
+	}
+
+	jsonData, err := json.Marshal(stats)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jsonData
+}
+
+// purgePrincipalHelper helper function for `purgePrincipal`; removes every trace
+// of a principal. The state driver has no transactions, so the steps are ordered
+// to fail safe: the principal's tokens are revoked first, and a purge which
+// failed half-way can simply be repeated.
+// params:
+//  name: local user, LDAP user or group, or ServiceAccount to be purged
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON PurgePrincipalReply
+func purgePrincipalHelper(name string) (int, []byte) {
+	if common.IsEmpty(name) {
+		return http.StatusBadRequest, []byte("Empty principal name")
+	}
+
+	if common.SamePrincipal(name, types.Admin.String()) || common.SamePrincipal(name, types.Ops.String()) {
+		return http.StatusBadRequest, []byte(fmt.Sprintf("Cannot purge built-in user %q", name))
+	}
+
+	authzs, err := db.ListAuthorizationsByPrincipal(name)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	// refuse to purge the last admin
+	for _, authz := range authzs {
+		if authz.ClaimKey != types.RoleClaimKey || authz.ClaimValue != types.Admin.String() {
+			continue
+		}
+
+		roles, err := db.ListAuthorizationsByClaim(types.RoleClaimKey)
+		if err != nil {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+
+		admins := 0
+		for _, role := range roles {
+			if !common.SamePrincipal(role.PrincipalName, name) && role.ClaimValue == types.Admin.String() {
+				admins++
+			}
+		}
+
+		if admins == 0 {
+			return http.StatusBadRequest, []byte(fmt.Sprintf("Cannot purge %q, the last admin", name))
+		}
+
+		break
+	}
+
+	reply := PurgePrincipalReply{Principal: name}
+
+	sessions, accessTokens, err := revokePrincipalTokens(name)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+	reply.TokensRevoked = true
+	reply.Sessions = sessions
+	reply.AccessTokens = accessTokens
+
+	for _, authz := range authzs {
+		if err := db.DeleteAuthorization(authz.UUID); err != nil && err != auth_errors.ErrKeyNotFound {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+		reply.Authorizations++
+	}
+	auth.InvalidateAuthorizationCache()
+
+	if _, err := db.GetLocalUser(name); err == nil {
+		if err := db.DeleteLocalUser(name); err != nil && err != auth_errors.ErrKeyNotFound {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+		reply.LocalUser = 1
+	} else if err != auth_errors.ErrKeyNotFound {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	// the last login of an LDAP user purged by DN
+	if err := db.DeletePrincipalLogin(name); err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	// LDAP users are purged by username or DN; they must not be able to log in
+	// using their cached login while the directory is unreachable
+	logins, err := db.ListCachedLdapLogins()
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	// the login audit trail records usernames; an LDAP user purged by DN is
+	// found there under the username of its cached login
+	usernames := []string{name}
+
+	for _, login := range logins {
+		if !strings.EqualFold(login.Username, name) && !strings.EqualFold(login.DN, name) {
+			continue
+		}
+		usernames = append(usernames, login.Username)
+
+		if err := db.DeleteCachedLdapLogin(login.Username); err != nil {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+		reply.CachedLogins++
+
+		if err := db.DeletePrincipalLogin(login.DN); err != nil {
+			return datastoreStatusCode(err), []byte(err.Error())
+		}
+	}
+
+	reply.AuditRecords, err = deleteLoginAuditRecordsOf(usernames)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	log.Infof("Purged principal %q: %d local user(s), %d authorization(s), %d cached login(s), %d session(s), %d access token(s), %d login audit record(s)",
+		name, reply.LocalUser, reply.Authorizations, reply.CachedLogins, reply.Sessions, reply.AccessTokens, reply.AuditRecords)
+
+	jsonData, err := json.Marshal(reply)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jsonData
+}
+
+// revokePrincipalTokens revokes all the tokens issued to a principal so far and
+// deletes its sessions, which are over, and its personal access tokens, which
+// would otherwise be accepted again once the revocation expires.
+// params:
+//  name: name of a user or one of the principals of users
+// return values:
+//  int: number of sessions deleted
+//  int: number of access tokens deleted
+//  error: as returned by consecutive func calls
+func revokePrincipalTokens(name string) (int, int, error) {
+	// tokens issued under a longer TTL than the current one may still be valid
+	maxTTL, err := auth.MaxTokenTTL()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	now := time.Now()
+	if err := db.RevokePrincipalTokens(name, now.Unix(), now.Add(maxTTL).Unix()); err != nil {
+		return 0, 0, err
+	}
+
+	sessions, err := db.ListSessions(now.Unix())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	deleted := 0
+	for _, session := range sessions {
+		if !sessionOf(session, name) {
+			continue
+		}
+
+		if err := db.DeleteSession(session.ID); err != nil {
+			return deleted, 0, err
+		}
+		deleted++
+	}
+
+	accessTokens, err := deleteAccessTokensOf(name)
+	return deleted, accessTokens, err
+}
+
+// deleteAccessTokensOf deletes the personal access tokens of a principal, i.e.
+// those created by it or carrying it as a principal.
+// params:
+//  name: name of the principal
+// return values:
+//  int: number of access tokens deleted
+//  error: as returned by consecutive func calls
+func deleteAccessTokensOf(name string) (int, error) {
+	records, err := db.ListAccessTokens()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, record := range records {
+		if !sessionOf(&types.Session{Username: record.Username, Principals: record.Principals}, name) {
+			continue
+		}
+
+		if err := db.DeleteAccessToken(record.ID); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// deleteLoginAuditRecordsOf deletes the login audit records of the given usernames.
+// params:
+//  usernames: usernames whose records are deleted, ignoring case
+// return values:
+//  int: number of records deleted
+//  error: as returned by consecutive func calls
+func deleteLoginAuditRecordsOf(usernames []string) (int, error) {
+	records, err := db.ListLoginAuditRecords()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, record := range records {
+		for _, username := range usernames {
+			if !strings.EqualFold(record.Username, username) {
+				continue
+			}
+
+			if err := db.DeleteLoginAuditRecord(record.ID); err != nil {
+				return deleted, err
+			}
+			deleted++
+			break
+		}
+	}
+
+	return deleted, nil
+}
+
+// getLoginAuditHelper helper function for `getLoginAudit`.
+// params:
+//  since: only records of logins at or after this time (seconds since the epoch) are returned
+//  username: only records of this username are returned, ignoring case; all if empty
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON list of types.LoginAuditRecord
+func getLoginAuditHelper(since int64, username string) (int, []byte) {
+	records, err := db.ListLoginAuditRecords()
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	matching := []*types.LoginAuditRecord{}
+	for _, record := range records {
+		if record.Time < since || (!common.IsEmpty(username) && !strings.EqualFold(record.Username, username)) {
+			continue
+		}
+
+		matching = append(matching, record)
+	}
+
+	jsonData, err := json.Marshal(matching)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jsonData
+}
+
+// listSigningKeysHelper helper function for `listSigningKeys`.
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON response based on the execution flow
+func listSigningKeysHelper() (int, []byte) {
+	current, err := auth.CurrentSigningKeyID()
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	retiredKeys, err := db.ListRetiredSigningKeys(time.Now().Unix())
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	reply := SigningKeysReply{Current: current, Retired: []RetiredSigningKeyReply{}}
+	for _, retired := range retiredKeys {
+		reply.Retired = append(reply.Retired, RetiredSigningKeyReply{
+			ID:        retired.ID,
+			RetiredAt: retired.RetiredAt,
+			ExpiresAt: retired.ExpiresAt,
+		})
+	}
+
+	jsonData, err := json.Marshal(reply)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jsonData
+}
+
+// rotateSigningKeyHelper helper function for `rotateSigningKey`.
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON response based on the execution flow
+func rotateSigningKeyHelper() (int, []byte) {
+	if _, err := auth.RotateSigningKey(time.Now()); err != nil {
+		if err == auth_errors.ErrSigningKeyManaged {
+			return http.StatusBadRequest, []byte("The token signing key is held by the secrets backend or a key file and has to be rotated there")
+		}
+
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	statusCode, resp := listSigningKeysHelper()
+	if statusCode == http.StatusOK {
+		statusCode = http.StatusCreated
+	}
+
+	return statusCode, resp
+}
+
+// retireSigningKeyHelper helper function for `retireSigningKey`.
+// params:
+//  id: ID of the retired key which is no longer to be accepted
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or empty based on the execution flow
+func retireSigningKeyHelper(id string) (int, []byte) {
+	current, err := auth.CurrentSigningKeyID()
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	if id == current {
+		return http.StatusBadRequest, []byte("The current token signing key can't be retired; rotate it first")
+	}
+
+	if _, err := db.GetRetiredSigningKey(id); err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return http.StatusNotFound, []byte("Signing key not found")
+		}
+
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	if err := db.DeleteRetiredSigningKey(id); err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	log.Infof("Retired token signing key %q is no longer accepted", id)
+
+	return http.StatusNoContent, nil
+}
+
+// mfaUser fetches the local user enrolling for MFA.
+// params:
+//  token: the caller's token
+// return values:
+//  *types.LocalUser: the caller's local user; nil if the caller can't enroll
+//  int: http status code if the caller can't enroll
+//  []byte: http response message; this goes along with status code
+func mfaUser(token *auth.Token) (*types.LocalUser, int, []byte) {
+	// otherwise a leaked access token could be used to lock its user out
+	if token.AccessToken() {
+		return nil, http.StatusBadRequest, []byte("MFA can't be enrolled using an access token")
+	}
+
+	username := token.GetClaim(auth.UsernameClaimKey)
+
+	user, err := db.GetLocalUser(username)
+	if err == nil && user.DeletedAt != 0 {
+		err = auth_errors.ErrKeyNotFound
+	}
+
+	switch err {
+	case nil:
+	case auth_errors.ErrKeyNotFound: // e.g. LDAP users; the directory handles their authentication
+		return nil, http.StatusBadRequest, []byte("Only local users can enroll for MFA")
+	default:
+		return nil, http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	if user.MFAEnabled {
+		return nil, http.StatusConflict, []byte(fmt.Sprintf("MFA is enabled for %q already", username))
+	}
+
+	return user, 0, nil
+}
+
+// enrollMFAHelper helper function for `enrollMFA`.
+// params:
+//  token: the caller's token
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON response based on the execution flow
+func enrollMFAHelper(token *auth.Token) (int, []byte) {
+	user, statusCode, resp := mfaUser(token)
+	if user == nil {
+		return statusCode, resp
+	}
+
+	secret, err := local.NewTOTPSecret()
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	if err := db.SetLocalUserMFASecret(user, secret); err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	jsonData, err := json.Marshal(MFAEnrollmentReply{
+		Secret: secret,
+		URL:    local.TOTPURL(user.Username, secret),
+	})
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jsonData
+}
+
+// confirmMFAHelper helper function for `confirmMFA`.
+// params:
+//  token: the caller's token
+//  confirmReq: the one-time password confirming the enrollment
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+func confirmMFAHelper(token *auth.Token, confirmReq *confirmMFARequest) (int, []byte) {
+	if common.IsEmpty(confirmReq.OTP) {
+		return http.StatusBadRequest, []byte("A one-time password must be provided")
+	}
+
+	user, statusCode, resp := mfaUser(token)
+	if user == nil {
+		return statusCode, resp
+	}
+
+	if common.IsEmpty(user.MFASecret) {
+		return http.StatusBadRequest, []byte("MFA enrollment has to be started first")
+	}
+
+	if !local.ValidateUserTOTP(user, confirmReq.OTP, time.Now()) {
+		return http.StatusBadRequest, []byte("Invalid one-time password")
+	}
+
+	user.MFAEnabled = true
+	if err := db.UpdateLocalUser(user.Username, user); err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	log.Infof("Enabled MFA for local user %q", user.Username)
+
+	return http.StatusNoContent, nil
+}
+
+// jwksHelper helper function for `jwksHandler`.
+// params:
+//  key: public key verifying our tokens; nil if they're signed with HS256
+//  kid: ID of the key
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON response based on the execution flow
+func jwksHelper(key *rsa.PublicKey, kid string) (int, []byte) {
+	keySet := JSONWebKeySet{Keys: []JSONWebKey{}}
+
+	if key != nil {
+		keySet.Keys = append(keySet.Keys, JSONWebKey{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: common.TokenSigningRS256,
+			Kid: kid,
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+
+	jsonData, err := json.Marshal(keySet)
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jsonData
+}
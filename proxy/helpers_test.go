@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestValidateLocalUserProfile tests checking the optional email and full name of local users
+func TestValidateLocalUserProfile(t *testing.T) {
+	testCases := []struct {
+		email    string
+		fullName string
+		valid    bool
+	}{
+		{"", "", true},
+		{"jdoe@example.com", "John Doe", true},
+		{"j.doe+ops@mail.example.com", "Jöhn Döe", true},
+		{"", strings.Repeat("ü", maxFullNameLength), true},
+		{"jdoe", "", false},
+		{"jdoe@", "", false},
+		{"John Doe <jdoe@example.com>", "", false},
+		{" jdoe@example.com", "", false},
+		{"jdoe@example.com, jane@example.com", "", false},
+		{strings.Repeat("a", maxEmailLength) + "@example.com", "", false},
+		{"", strings.Repeat("a", maxFullNameLength+1), false},
+		{"", "John\nDoe", false},
+	}
+
+	for _, tc := range testCases {
+		err := validateLocalUserProfile(&types.LocalUser{Email: tc.email, FullName: tc.fullName})
+		if (err == nil) != tc.valid {
+			t.Errorf("%q, %q: expected valid: %v, got %v", tc.email, tc.fullName, tc.valid, err)
+		}
+	}
+}
+
+// TestValidateLocalUserLabels tests checking the labels of local users
+func TestValidateLocalUserLabels(t *testing.T) {
+	tooMany := map[string]string{}
+	for i := 0; i <= maxLabels; i++ {
+		tooMany[fmt.Sprintf("key%d", i)] = "value"
+	}
+
+	testCases := []struct {
+		labels map[string]string
+		valid  bool
+	}{
+		{nil, true},
+		{map[string]string{}, true},
+		{map[string]string{"team": "infra", "cost-center": "1234", "example.com/kind": "service-account"}, true},
+		{map[string]string{"team": ""}, true},
+		{map[string]string{"team": strings.Repeat("a", maxLabelLength)}, true},
+		{map[string]string{"team": strings.Repeat("ü", maxLabelLength/2+1)}, false},
+		{map[string]string{"team": "in\tfra"}, false},
+		{map[string]string{"": "infra"}, false},
+		{map[string]string{"team=a": "infra"}, false},
+		{map[string]string{"-team": "infra"}, false},
+		{map[string]string{strings.Repeat("k", maxLabelKeyLength+1): "infra"}, false},
+		{tooMany, false},
+	}
+
+	for _, tc := range testCases {
+		err := validateLocalUserProfile(&types.LocalUser{Labels: tc.labels})
+		if (err == nil) != tc.valid {
+			t.Errorf("%v: expected valid: %v, got %v", tc.labels, tc.valid, err)
+		}
+	}
+}
+
+// TestUpdatedLocalUserKeepsDisable tests that updates which leave out `disable`
+// don't change it
+func TestUpdatedLocalUserKeepsDisable(t *testing.T) {
+	testCases := []struct {
+		body     string
+		email    string
+		disabled bool
+	}{
+		{`{"email": "jdoe@example.com"}`, "jdoe@example.com", true},
+		{`{"email": "jdoe@example.com", "disable": true}`, "jdoe@example.com", true},
+		{`{"disable": false}`, "john@example.com", false},
+	}
+
+	for _, tc := range testCases {
+		// parsed like updateLocalUser() does
+		updateReq, flags := &types.LocalUser{}, &localUserFlagsRequest{}
+		if err := json.Unmarshal([]byte(tc.body), updateReq); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := json.Unmarshal([]byte(tc.body), flags); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := &types.LocalUser{Username: "jdoe", Email: "john@example.com", Disable: true}
+
+		updated := updatedLocalUser(updateReq, flags, actual)
+		if updated.Disable != tc.disabled {
+			t.Errorf("%s: expected disable: %v, got %v", tc.body, tc.disabled, updated.Disable)
+		}
+
+		if updated.Email != tc.email {
+			t.Errorf("%s: expected email %q, got %q", tc.body, tc.email, updated.Email)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/identity"
+)
+
+// TestIdentityHeaders tests that netmaster only receives the identity headers we sign
+func TestIdentityHeaders(t *testing.T) {
+	var received *http.Request
+	netmaster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = req
+		w.Write([]byte("[]"))
+	}))
+	defer netmaster.Close()
+
+	s := newUpstreamTestServer(netmaster.Listener.Addr().String(), 1)
+	path := "/api/v1/networks/t1:n1/"
+	id := &identity.Identity{User: "user1", Role: "ops", Tenants: []string{"t1"}}
+
+	defer common.Global().Set(common.IdentityHeaderSecretKey, "")
+
+	testCases := []struct {
+		description string
+		secret      string
+		id          *identity.Identity
+		signed      bool
+	}{
+		{"no identity", "secret", nil, false},
+		{"no secret", "", id, false},
+		{"signed identity", "secret", id, true},
+	}
+
+	for _, tc := range testCases {
+		common.Global().Set(common.IdentityHeaderSecretKey, tc.secret)
+
+		req := httptest.NewRequest("GET", path, nil)
+		req.RequestURI = path
+		for _, name := range identity.Headers {
+			req.Header.Set(name, "forged")
+		}
+
+		if _, _, err := s.ProxyRequest(httptest.NewRecorder(), req, tc.id); err != nil {
+			t.Fatalf("%s: failed to proxy request: %s", tc.description, err)
+		}
+
+		verified, err := identity.Verify(received.Header, []byte("secret"), received.URL.Path)
+		if !tc.signed {
+			for _, name := range identity.Headers {
+				if value := received.Header.Get(name); value != "" {
+					t.Errorf("%s: expected %s to be stripped, got %q", tc.description, name, value)
+				}
+			}
+
+			if err != identity.ErrMissingSignature {
+				t.Errorf("%s: expected no signature, got %v", tc.description, err)
+			}
+
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(verified, tc.id) {
+			t.Errorf("%s: expected %#v, got %#v (%v)", tc.description, tc.id, verified, err)
+		}
+	}
+}
+
+// TestTokenIdentity tests that requests without a token don't carry an identity
+func TestTokenIdentity(t *testing.T) {
+	defer common.Global().Set(common.IdentityHeaderSecretKey, "")
+	common.Global().Set(common.IdentityHeaderSecretKey, "secret")
+
+	if id, err := tokenIdentity(nil); id != nil || err != nil {
+		t.Errorf("expected no identity, got %#v (%v)", id, err)
+	}
+}
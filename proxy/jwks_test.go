@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"testing"
+)
+
+// TestJWKS tests that the JWK Set holds the RSA public key, and nothing with HS256
+func TestJWKS(t *testing.T) {
+	statusCode, resp := jwksHelper(nil, "")
+	if statusCode != http.StatusOK || string(resp) != `{"keys":[]}` {
+		t.Errorf("expected an empty key set, got %d %s", statusCode, resp)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	statusCode, resp = jwksHelper(&key.PublicKey, "key1")
+	if statusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", statusCode, resp)
+	}
+
+	keySet := JSONWebKeySet{}
+	if err := json.Unmarshal(resp, &keySet); err != nil {
+		t.Fatalf("failed to unmarshal %s: %s", resp, err)
+	}
+
+	if len(keySet.Keys) != 1 {
+		t.Fatalf("expected one key, got %s", resp)
+	}
+
+	jwk := keySet.Keys[0]
+	if jwk.Kty != "RSA" || jwk.Use != "sig" || jwk.Alg != "RS256" || jwk.Kid != "key1" {
+		t.Errorf("unexpected key %#v", jwk)
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil || new(big.Int).SetBytes(n).Cmp(key.N) != 0 {
+		t.Errorf("modulus %q doesn't match the key: %v", jwk.N, err)
+	}
+
+	if jwk.E != "AQAB" { // 65537
+		t.Errorf("unexpected exponent %q", jwk.E)
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// leaseStateDriver is an in-memory state driver which only implements leases;
+// all the keys share a single lease.
+type leaseStateDriver struct {
+	types.StateDriver
+
+	mutex   sync.Mutex
+	holder  string
+	expires time.Time
+}
+
+func (d *leaseStateDriver) AcquireLease(key, holder string, ttl time.Duration) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	if d.holder != "" && d.holder != holder && now.Before(d.expires) {
+		return false, nil
+	}
+
+	d.holder, d.expires = holder, now.Add(ttl)
+	return true, nil
+}
+
+func (d *leaseStateDriver) ReleaseLease(key, holder string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.holder == holder {
+		d.holder = ""
+	}
+
+	return nil
+}
+
+// TestLeaderRunsSweepers tests that of two proxies sharing a datastore, only
+// the leader runs the background sweepers, and that the other one takes over
+// once the leader's lease expired
+func TestLeaderRunsSweepers(t *testing.T) {
+	ttl := 500 * time.Millisecond
+	store := &leaseStateDriver{}
+
+	newLeaderTestServer := func(id string) *Server {
+		return NewServer(&Config{
+			NetmasterAddress:        "localhost:9999",
+			NetmasterRequestTimeout: DefaultNetmasterRequestTimeout,
+			ClientReadTimeout:       DefaultClientReadTimeout,
+			ClientWriteTimeout:      DefaultClientWriteTimeout,
+			Leader:                  state.NewLeaderElector(store, "leader", id, ttl),
+		})
+	}
+
+	a, b := newLeaderTestServer("a"), newLeaderTestServer("b")
+
+	if !a.config.Leader.Campaign() || b.config.Leader.Campaign() {
+		t.Fatal("expected the first proxy to become the leader")
+	}
+
+	// both proxies run the sweeper like Serve() does; each sweep reports the proxy running it
+	sweeps := make(chan string, 1000)
+	done := make(chan bool)
+	defer close(done)
+
+	for id, s := range map[string]*Server{"a": a, "b": b} {
+		go func(id string, s *Server) {
+			runAsLeader(10*time.Millisecond, s.isLeader, done, func(time.Time) { sweeps <- id })
+		}(id, s)
+	}
+
+	collect := func(d time.Duration) map[string]int {
+		counts := map[string]int{}
+		deadline := time.After(d)
+
+		for {
+			select {
+			case id := <-sweeps:
+				counts[id]++
+			case <-deadline:
+				return counts
+			}
+		}
+	}
+
+	if counts := collect(100 * time.Millisecond); counts["a"] == 0 || counts["b"] != 0 {
+		t.Fatalf("expected only the leader to sweep, got %v", counts)
+	}
+
+	// the leader stops renewing its lease, e.g. because it went away
+	time.Sleep(ttl)
+
+	if !b.config.Leader.Campaign() {
+		t.Fatal("expected the second proxy to take over once the lease expired")
+	}
+
+	collect(20 * time.Millisecond) // sweeps which started before the takeover
+
+	if counts := collect(100 * time.Millisecond); counts["a"] != 0 || counts["b"] == 0 {
+		t.Fatalf("expected only the new leader to sweep, got %v", counts)
+	}
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains the filters of the local users list. Like the filters of
+// the authorizations list, they're applied to the users read from the data
+// store in one go. The list is sorted by username and can be paginated.
+
+// maxLocalUserPageSize caps the `limit` of a page of the local users list
+const maxLocalUserPageSize = 1000
+
+// includeAuthorizations is the value of `include` which embeds the users'
+// authorizations in the local users list and in a single user
+const includeAuthorizations = "authorizations"
+
+// localUserListFilter selects the local users returned by getLocalUsersHelper();
+// all the given filters have to match, empty ones match any user.
+type localUserListFilter struct {
+	includeDeleted   bool              // if soft-deleted users are listed too
+	inactiveSince    int64             // users who logged in since this time aren't listed; 0 if all are
+	usernameContains string            // part of the username, in any case
+	role             string            // built-in or custom role the user is granted, on any tenant
+	labels           map[string]string // labels the user has, with the same values
+	limit            int               // size of the page to return; 0 if the list isn't paginated
+	offset           int               // index of the first user of the page
+	authorizations   bool              // if the users' authorizations are embedded; not a filter
+}
+
+// parseInclude parses the `include` query parameter of the local users list
+// and of a single user.
+// params:
+//  query: query parameters of the request
+// return values:
+//  bool: true if the users' authorizations are to be embedded
+//  error: if `include` has an unknown value
+func parseInclude(query url.Values) (bool, error) {
+	include, found := query["include"]
+	if !found {
+		return false, nil
+	}
+
+	if len(include) != 1 || include[0] != includeAuthorizations {
+		return false, fmt.Errorf("include must be %q", includeAuthorizations)
+	}
+
+	return true, nil
+}
+
+// parseLocalUserListFilter parses the query parameters of the local users list.
+// params:
+//  query: query parameters of the request
+//  now: current time; `inactive_since` is relative to it
+// return values:
+//  *localUserListFilter: the filter to apply
+//  error: if a parameter is unknown or has an invalid value
+func parseLocalUserListFilter(query url.Values, now time.Time) (*localUserListFilter, error) {
+	for key := range query {
+		switch key {
+		case "include_deleted", "username_contains":
+		case "inactive_since":
+			if _, err := parseDays(query.Get(key)); err != nil {
+				return nil, fmt.Errorf("%s must be a positive duration, e.g. 90d or 2160h", key)
+			}
+		case "role":
+			if common.IsEmpty(query.Get(key)) {
+				return nil, fmt.Errorf("%s must name a role", key)
+			}
+		case "label":
+			for _, label := range query[key] {
+				if strings.Index(label, "=") <= 0 {
+					return nil, fmt.Errorf("%s must be given as key=value, e.g. label=team=infra", key)
+				}
+			}
+		case "include":
+			if _, err := parseInclude(query); err != nil {
+				return nil, err
+			}
+		case "limit", "offset":
+			if n, err := strconv.Atoi(query.Get(key)); err != nil || n < 0 || key == "limit" && n == 0 {
+				return nil, fmt.Errorf("%s must be a positive number", key)
+			}
+		default:
+			return nil, fmt.Errorf("unknown query parameter %q", key)
+		}
+	}
+
+	filter := &localUserListFilter{
+		includeDeleted:   query.Get("include_deleted") == "true",
+		usernameContains: strings.ToLower(query.Get("username_contains")),
+		role:             query.Get("role"),
+	}
+
+	filter.authorizations, _ = parseInclude(query)
+
+	// several labels can be given; the user must have all of them
+	for _, label := range query["label"] {
+		if filter.labels == nil {
+			filter.labels = map[string]string{}
+		}
+
+		kv := strings.SplitN(label, "=", 2)
+		filter.labels[kv[0]] = kv[1]
+	}
+
+	if _, found := query["inactive_since"]; found {
+		inactivity, _ := parseDays(query.Get("inactive_since"))
+		filter.inactiveSince = now.Add(-inactivity).Unix()
+	}
+
+	// pages are at most maxLocalUserPageSize long, also if only an offset is given
+	filter.offset, _ = strconv.Atoi(query.Get("offset"))
+	filter.limit, _ = strconv.Atoi(query.Get("limit"))
+	if _, found := query["offset"]; found && filter.limit == 0 || filter.limit > maxLocalUserPageSize {
+		filter.limit = maxLocalUserPageSize
+	}
+
+	return filter, nil
+}
+
+// matches returns true if the user passes all the filters
+// params:
+//  user: local user to check
+//  withRole: normalized names of the principals granted the filtered role; ignored
+//            unless the list is filtered by role
+func (f *localUserListFilter) matches(user *types.LocalUser, withRole map[string]bool) bool {
+	switch {
+	case user.DeletedAt != 0 && !f.includeDeleted:
+		return false
+	case f.inactiveSince != 0 && user.LastLogin >= f.inactiveSince:
+		return false
+	case !strings.Contains(strings.ToLower(user.Username), f.usernameContains):
+		return false
+	case !common.IsEmpty(f.role) && !withRole[common.NormalizeUsername(user.Username)]:
+		return false
+	default:
+		return f.matchesLabels(user.Labels)
+	}
+}
+
+// matchesLabels returns true if the given labels include all the filtered ones
+func (f *localUserListFilter) matchesLabels(labels map[string]string) bool {
+	for key, value := range f.labels {
+		if actual, found := labels[key]; !found || actual != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// byUsername sorts local users by username
+type byUsername []types.LocalUser
+
+func (u byUsername) Len() int           { return len(u) }
+func (u byUsername) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u byUsername) Less(i, j int) bool { return u[i].Username < u[j].Username }
+
+// paginated returns true if only a page of the list is requested
+func (f *localUserListFilter) paginated() bool {
+	return f.limit > 0
+}
+
+// page returns the requested page of the sorted users; it's empty if the
+// offset is beyond the end of the list.
+func (f *localUserListFilter) page(users []types.LocalUser) []types.LocalUser {
+	if !f.paginated() {
+		return users
+	}
+
+	if f.offset >= len(users) {
+		return []types.LocalUser{}
+	}
+
+	end := f.offset + f.limit
+	if end > len(users) {
+		end = len(users)
+	}
+
+	return users[f.offset:end]
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestLocalUserListFilter tests parsing and applying the filters of the local users list
+func TestLocalUserListFilter(t *testing.T) {
+	for _, invalid := range []string{"user=alice", "limit=0", "limit=ten", "offset=-1", "role=",
+		"inactive_since=90", "inactive_since=0d", "username_contains=a&foo=bar", "label=team", "label==infra", "include=tenants",
+		"include=authorizations&include=authorizations"} {
+		query, _ := url.ParseQuery(invalid)
+		if _, err := parseLocalUserListFilter(query, time.Now()); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+
+	now := time.Now()
+	users := []*types.LocalUser{
+		{Username: "alice", LastLogin: now.Unix(), Labels: map[string]string{"team": "infra", "kind": "person"}},
+		{Username: "Bob", LastLogin: now.Add(-100 * 24 * time.Hour).Unix(), Labels: map[string]string{"team": "ops"}},
+		{Username: "carol", Labels: map[string]string{"team": "infra", "note": "a=b"}},
+		{Username: "dave", DeletedAt: 1},
+	}
+	withRole := map[string]bool{"alice": true, "dave": true}
+
+	testCases := []struct {
+		query    string
+		expected string
+	}{
+		{"", "alice,Bob,carol,"},
+		{"include_deleted=true", "alice,Bob,carol,dave,"},
+		{"include_deleted=false", "alice,Bob,carol,"},
+		{"username_contains=a", "alice,carol,"},
+		{"username_contains=B", "Bob,"},
+		{"username_contains=xyz", ""},
+		{"role=ops", "alice,"},
+		{"role=ops&include_deleted=true", "alice,dave,"},
+		{"inactive_since=90d", "Bob,carol,"},
+		{"inactive_since=120d", "carol,"},
+		{"inactive_since=90d&username_contains=o", "Bob,carol,"},
+		{"label=team=infra", "alice,carol,"},
+		{"label=team=infra&label=kind=person", "alice,"},
+		{"label=team=", ""},
+		{"label=note=a=b", "carol,"},
+		{"label=team=infra&inactive_since=90d", "carol,"},
+		{"include=authorizations", "alice,Bob,carol,"},
+	}
+
+	for _, tc := range testCases {
+		query, _ := url.ParseQuery(tc.query)
+		filter, err := parseLocalUserListFilter(query, now)
+		if err != nil {
+			t.Fatalf("%q: unexpected error %v", tc.query, err)
+		}
+
+		matched := ""
+		for _, user := range users {
+			if filter.matches(user, withRole) {
+				matched += user.Username + ","
+			}
+		}
+
+		if matched != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.query, tc.expected, matched)
+		}
+	}
+}
+
+// TestLocalUserListPage tests paginating the local users list
+func TestLocalUserListPage(t *testing.T) {
+	users := []types.LocalUser{{Username: "a"}, {Username: "b"}, {Username: "c"}, {Username: "d"}}
+
+	testCases := []struct {
+		query    string
+		limit    int
+		expected string
+	}{
+		{"", 0, "abcd"},
+		{"limit=2", 2, "ab"},
+		{"limit=2&offset=2", 2, "cd"},
+		{"limit=10&offset=3", 10, "d"},
+		{"limit=2&offset=4", 2, ""},
+		{"offset=1", maxLocalUserPageSize, "bcd"},
+		{"limit=100000", maxLocalUserPageSize, "abcd"},
+	}
+
+	for _, tc := range testCases {
+		query, _ := url.ParseQuery(tc.query)
+		filter, err := parseLocalUserListFilter(query, time.Now())
+		if err != nil {
+			t.Fatalf("%q: unexpected error %v", tc.query, err)
+		}
+
+		if filter.limit != tc.limit {
+			t.Errorf("%q: expected a limit of %d, got %d", tc.query, tc.limit, filter.limit)
+		}
+
+		page := ""
+		for _, user := range filter.page(users) {
+			page += user.Username
+		}
+
+		if page != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.query, tc.expected, page)
+		}
+	}
+}
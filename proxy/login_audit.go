@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains the login audit trail: every call to the login endpoint
+// is recorded, successful or not, and the records are pruned once they're
+// older than common.LoginAuditMaxAgeKey or exceed common.LoginAuditMaxEntriesKey.
+// Clients are never told whether the username or the password was wrong; only
+// the audit trail is.
+
+// failure reasons of login audit records
+const (
+	// loginFailureBadRequest: the request was malformed or lacked credentials
+	loginFailureBadRequest = "bad_request"
+
+	// loginFailureUnknownUser: there's no such local user, and LDAP/AD (if
+	// configured) didn't authenticate the user either
+	loginFailureUnknownUser = "unknown_user"
+
+	// loginFailureInvalidCredentials: the password was wrong
+	loginFailureInvalidCredentials = "invalid_credentials"
+
+	// loginFailureUserDisabled: the password was right, but the local user is disabled
+	loginFailureUserDisabled = "user_disabled"
+
+	// loginFailureOTPRequired: the password was right, but the user has MFA
+	// enabled and gave no one-time password
+	loginFailureOTPRequired = "otp_required"
+
+	// loginFailureInvalidOTP: the password was right, but the one-time password was wrong
+	loginFailureInvalidOTP = "invalid_otp"
+
+	// loginFailureLDAPTLS: LDAP/AD couldn't be reached securely, e.g. because
+	// StartTLS failed or its certificate couldn't be verified
+	loginFailureLDAPTLS = "ldap_tls_failed"
+
+	// loginFailureLDAPUnavailable: LDAP/AD couldn't be reached or didn't respond in time,
+	// and the user had no cached login to fall back to
+	loginFailureLDAPUnavailable = "ldap_unavailable"
+
+	// loginFailureInternal: the user couldn't be authenticated because something broke
+	loginFailureInternal = "internal_error"
+)
+
+// loginAuditPruneInterval is how often old login audit records are pruned
+const loginAuditPruneInterval = 10 * time.Minute
+
+// loginFailureReason returns the failure reason of a login which auth.Authenticate() rejected.
+// params:
+//  err: as returned by auth.Authenticate()
+// return values:
+//  string: one of the loginFailure* constants
+func loginFailureReason(err error) string {
+	switch err {
+	case auth_errors.ErrUserNotFound:
+		return loginFailureUnknownUser
+	case auth_errors.ErrAccessDenied, auth_errors.ErrLDAPAccessDenied, auth_errors.ErrLocalAuthenticationFailed:
+		return loginFailureInvalidCredentials
+	case auth_errors.ErrUserDisabled:
+		return loginFailureUserDisabled
+	case auth_errors.ErrOTPRequired:
+		return loginFailureOTPRequired
+	case auth_errors.ErrInvalidOTP:
+		return loginFailureInvalidOTP
+	case auth_errors.ErrLDAPTLSFailed:
+		return loginFailureLDAPTLS
+	case auth_errors.ErrLDAPConnectionFailed:
+		return loginFailureLDAPUnavailable
+	default:
+		return loginFailureInternal
+	}
+}
+
+// auditLogin records a call to the login endpoint. Failing to record it doesn't
+// fail the login; it's logged instead.
+// params:
+//  req: the login request
+//  username: username given by the client; empty if there was none
+//  failureReason: one of the loginFailure* constants; empty if the login succeeded
+//  cachedAuth: true if the user was authenticated using their cached LDAP login
+func auditLogin(req *http.Request, username, failureReason string, cachedAuth bool) {
+	record := &types.LoginAuditRecord{
+		ID:            uuid.NewV4().String(),
+		Time:          time.Now().Unix(),
+		Username:      username,
+		Success:       common.IsEmpty(failureReason),
+		FailureReason: failureReason,
+		SourceIP:      common.RealIP(req),
+		UserAgent:     req.UserAgent(),
+		CachedAuth:    cachedAuth,
+	}
+
+	if err := db.AddLoginAuditRecord(record); err != nil {
+		log.Errorf("failed to record the login of %q from %s: %s", username, record.SourceIP, err)
+	}
+}
+
+// loginAuditLimit returns the value of the given login audit retention setting;
+// 0 if the limit is disabled.
+func loginAuditLimit(key string) int64 {
+	value, err := common.Global().Get(key)
+	if err != nil {
+		return 0
+	}
+
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit <= 0 {
+		return 0
+	}
+
+	return limit
+}
+
+// pruneLoginAudit deletes the login audit records which are older than
+// common.LoginAuditMaxAgeKey, and then the oldest records exceeding
+// common.LoginAuditMaxEntriesKey.
+// params:
+//  now: current time
+// return values:
+//  int: number of records deleted
+//  error: as returned by consecutive func calls
+func pruneLoginAudit(now time.Time) (int, error) {
+	maxAge, maxEntries := loginAuditLimit(common.LoginAuditMaxAgeKey), loginAuditLimit(common.LoginAuditMaxEntriesKey)
+	if maxAge == 0 && maxEntries == 0 {
+		return 0, nil
+	}
+
+	records, err := db.ListLoginAuditRecords()
+	if err != nil {
+		return 0, err
+	}
+
+	excess := 0 // the oldest records beyond the maximum number of entries
+	if maxEntries > 0 && int64(len(records)) > maxEntries {
+		excess = len(records) - int(maxEntries)
+	}
+
+	cutoff := now.Add(-time.Duration(maxAge) * 24 * time.Hour).Unix()
+
+	pruned := 0
+	for i, record := range records { // oldest first
+		if i >= excess && (maxAge == 0 || record.Time >= cutoff) {
+			break
+		}
+
+		if err := db.DeleteLoginAuditRecord(record.ID); err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+
+	if pruned > 0 {
+		log.Infof("Pruned %d login audit record(s)", pruned)
+	}
+
+	return pruned, nil
+}
+
+// runLoginAuditPruner prunes the login audit trail every `interval` until
+// `done` is closed, as long as `leader` returns true.
+func runLoginAuditPruner(interval time.Duration, leader func() bool, done chan bool) {
+	runAsLeader(interval, leader, done, func(now time.Time) {
+		if _, err := pruneLoginAudit(now); err != nil {
+			log.Warnf("Failed to prune the login audit trail: %s", err.Error())
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+)
+
+// TestLoginAuditLimit tests parsing of the login audit retention limits
+func TestLoginAuditLimit(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected int64
+	}{
+		{"", 0},
+		{"0", 0},
+		{"-1", 0},
+		{"abc", 0},
+		{"90", 90},
+	}
+
+	defer common.Global().Set(common.LoginAuditMaxAgeKey, "")
+	defer common.Global().Set(common.LoginAuditMaxEntriesKey, "")
+
+	for _, tc := range testCases {
+		common.Global().Set(common.LoginAuditMaxAgeKey, tc.value)
+
+		if limit := loginAuditLimit(common.LoginAuditMaxAgeKey); limit != tc.expected {
+			t.Errorf("%q: expected %d, got %d", tc.value, tc.expected, limit)
+		}
+	}
+
+	// nothing is pruned, and the datastore isn't needed, if both limits are disabled
+	common.Global().Set(common.LoginAuditMaxAgeKey, "0")
+	common.Global().Set(common.LoginAuditMaxEntriesKey, "0")
+
+	if pruned, err := pruneLoginAudit(time.Now()); err != nil || pruned != 0 {
+		t.Errorf("expected nothing to be pruned, got %d (%v)", pruned, err)
+	}
+}
+
+// TestLoginFailureReason tests the categorization of failed logins
+func TestLoginFailureReason(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected string
+	}{
+		{auth_errors.ErrUserNotFound, loginFailureUnknownUser},
+		{auth_errors.ErrAccessDenied, loginFailureInvalidCredentials},
+		{auth_errors.ErrLDAPAccessDenied, loginFailureInvalidCredentials},
+		{auth_errors.ErrOTPRequired, loginFailureOTPRequired},
+		{auth_errors.ErrInvalidOTP, loginFailureInvalidOTP},
+		{auth_errors.ErrLDAPTLSFailed, loginFailureLDAPTLS},
+		{auth_errors.ErrLDAPConnectionFailed, loginFailureLDAPUnavailable},
+		{errors.New("datastore unavailable"), loginFailureInternal},
+	}
+
+	for _, tc := range testCases {
+		if reason := loginFailureReason(tc.err); reason != tc.expected {
+			t.Errorf("%v: expected %q, got %q", tc.err, tc.expected, reason)
+		}
+	}
+}
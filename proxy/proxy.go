@@ -1,18 +1,23 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/identity"
+	"github.com/contiv/auth_proxy/state"
 	"github.com/gorilla/mux"
 )
 
@@ -23,15 +28,82 @@ const (
 	// LoginPath is the authentication endpoint on the proxy
 	LoginPath = V1Prefix + "/login/"
 
+	// RefreshPath is the endpoint exchanging a token which is about to expire for a new one
+	RefreshPath = V1Prefix + "/refresh/"
+
+	// LogoutPath is the endpoint revoking the caller's token
+	LogoutPath = V1Prefix + "/logout/"
+
+	// PasswordPath is the endpoint local users change their own password at
+	PasswordPath = V1Prefix + "/password/"
+
+	// BulkAuthorizationsPath is the endpoint adding several authorizations at once
+	BulkAuthorizationsPath = V1Prefix + "/authorizations/bulk/"
+
+	// BulkLocalUsersPath is the endpoint adding several local users at once
+	BulkLocalUsersPath = V1Prefix + "/local_users/bulk/"
+
+	// SessionsPath is the endpoint listing the sessions of logged in users
+	SessionsPath = V1Prefix + "/sessions/"
+
+	// AccessTokensPath is the endpoint managing personal access tokens
+	AccessTokensPath = V1Prefix + "/access_tokens/"
+
+	// MFAEnrollPath is the endpoint local users start enrolling for MFA at, and
+	// MFAConfirmPath the endpoint they confirm the enrollment at
+	MFAEnrollPath  = V1Prefix + "/mfa/enroll"
+	MFAConfirmPath = V1Prefix + "/mfa/confirm"
+
+	// SigningKeysPath is the endpoint listing and rotating the token signing keys
+	SigningKeysPath = V1Prefix + "/signing_keys/"
+
+	// LdapConfigurationTestPath is the endpoint testing a LDAP configuration without saving it
+	LdapConfigurationTestPath = V1Prefix + "/ldap_configuration/test"
+
+	// LdapConfigurationReencryptPath is the endpoint re-encrypting the LDAP
+	// service account password with the current TLS key
+	LdapConfigurationReencryptPath = V1Prefix + "/ldap_configuration/reencrypt"
+
+	// LdapGroupsPath is the endpoint searching the LDAP/AD groups by name
+	LdapGroupsPath = V1Prefix + "/ldap_groups"
+
+	// LoginAuditPath is the endpoint admins query the login audit trail at
+	LoginAuditPath = V1Prefix + "/audit/logins"
+
+	// JWKSPath is the endpoint publishing the public key verifying RS256 tokens
+	JWKSPath = V1Prefix + "/jwks"
+
 	// HealthCheckPath is the health check endpoint on the proxy
 	HealthCheckPath = V1Prefix + "/health/"
 
 	// VersionPath is the version endpoint on the proxy
 	VersionPath = V1Prefix + "/version/"
 
-	// uiDirectory is the location in the container where the baked-in UI lives
+	// ReloadPath is the endpoint which reloads the global settings
+	ReloadPath = V1Prefix + "/reload/"
+
+	// IntrospectionPath is the token introspection endpoint for other services
+	IntrospectionPath = V1Prefix + "/introspect/"
+
+	// RoutesPath is the endpoint listing all the routes served by the proxy
+	RoutesPath = V1Prefix + "/routes/"
+
+	// WhoamiPath is the endpoint describing the caller
+	WhoamiPath = V1Prefix + "/whoami/"
+
+	// MePath is the endpoint describing the caller's identity and permissions
+	MePath = V1Prefix + "/me"
+
+	// DebugPrincipalPath is the endpoint resolving the groups and roles of a LDAP
+	// user live, followed by the user's name
+	DebugPrincipalPath = V1Prefix + "/debug/principal/"
+
+	// TenantStatsPath is the endpoint returning the usage statistics of the tenants
+	TenantStatsPath = V1Prefix + "/stats/tenants/"
+
+	// DefaultUIAssetsPath is the location in the container where the baked-in UI lives
 	// and where an external UI directory can be bindmounted over using -v
-	uiDirectory = "/ui"
+	DefaultUIAssetsPath = "/ui"
 
 	// DefaultNetmasterRequestTimeout is the default value for proxy.Config's NetmasterRequestTimeout
 	DefaultNetmasterRequestTimeout = 10
@@ -41,8 +113,16 @@ const (
 
 	// DefaultClientWriteTimeout is the default value for proxy.Config's ClientWriteTimeout
 	DefaultClientWriteTimeout = 11 // DefaultNetmasterRequestTimeout + 1
+
+	// defaultIntrospectionRateLimit is the number of introspection requests per
+	// second allowed for each client IP unless introspection_rate_limit is set
+	defaultIntrospectionRateLimit = 100
 )
 
+// introspectionLimiter rate limits the token introspection endpoint independently of
+// everything else; its limit is updated from the settings on every request
+var introspectionLimiter = common.NewRateLimiter(defaultIntrospectionRateLimit, defaultIntrospectionRateLimit)
+
 // NewServer returns a new server with the specified config
 func NewServer(c *Config) *Server {
 	s := &Server{config: c}
@@ -62,10 +142,6 @@ type Config struct {
 	// ListenAddress is the interface and port the proxy binds to and listens on
 	ListenAddress string
 
-	// TLSCertificate and TLSKeyFile are the cert and key we use to expose the HTTPS server
-	TLSCertificate string
-	TLSKeyFile     string
-
 	// NetmasterRequestTimeout is how long we allow for the whole request cycle when talking to
 	// out upstream netmaster.
 	NetmasterRequestTimeout int64
@@ -78,6 +154,43 @@ type Config struct {
 	// response, and write it back to the client socket.  This must be longer than the
 	// NetmasterRequestTimeout (default is 1 second longer).
 	ClientWriteTimeout int64
+
+	// UIAssetsPath is the directory containing the UI which is served from /.
+	// The UI is not served if it's empty.
+	UIAssetsPath string
+
+	// RoutesListingForAllUsers opens the routes listing endpoint to all
+	// authenticated users; it's admin-only otherwise.
+	RoutesListingForAllUsers bool
+
+	// NetmasterMaxIdleConnsPerHost is how many idle connections to netmaster we keep open for reuse.
+	// Increase this if the proxy opens new connections under load (see the connection pool in /health).
+	NetmasterMaxIdleConnsPerHost int
+
+	// NetmasterIdleConnTimeout is how long (in seconds) an idle connection to netmaster is kept open.
+	NetmasterIdleConnTimeout int64
+
+	// NetmasterTLSHandshakeTimeout is how long (in seconds) we allow for the TLS handshake with netmaster.
+	NetmasterTLSHandshakeTimeout int64
+
+	// HTTP2Enabled offers HTTP/2 to clients during the TLS handshake (ALPN).
+	// Clients which don't ask for it, e.g. WebSocket clients, keep using HTTP/1.1.
+	HTTP2Enabled bool
+
+	// NetmasterH2C sends the requests to netmaster using HTTP/2 over cleartext
+	// (h2c) with prior knowledge, so that they share a connection; netmaster
+	// must support it. NetmasterMaxIdleConnsPerHost and NetmasterIdleConnTimeout
+	// don't apply then.
+	NetmasterH2C bool
+
+	// Leader elects the instance which runs the background sweepers among the
+	// instances sharing the data store. If it's nil, every instance runs them.
+	Leader *state.LeaderElector
+
+	// ClientCAs holds the CAs whose client certificates authenticate requests.
+	// Clients are only asked for a certificate if it's set, and requests
+	// without one are authenticated as usual.
+	ClientCAs *x509.CertPool
 }
 
 // Server represents a proxy server which can be running.
@@ -88,6 +201,9 @@ type Server struct {
 	useKeepalives   bool           // controls whether the HTTPS server supports keepalives
 	wg              sync.WaitGroup // used to avoid a race condition when shutting down
 	netmasterClient *http.Client   // used when talking to the upstream netmaster
+	netmasterPool   *upstreamPool  // connections used by netmasterClient
+
+	datastoreLiveness *datastoreLiveness // pings the datastore for /health
 }
 
 // Init initializes anything the server requires before it can be used.
@@ -107,9 +223,11 @@ func (s *Server) Init() {
 		log.Fatalf("ClientWriteTimeout must be > 0 (got: %d)", s.config.ClientWriteTimeout)
 	}
 
-	s.netmasterClient = &http.Client{
-		Timeout: time.Duration(s.config.NetmasterRequestTimeout) * time.Second,
-	}
+	// the timeout is applied per request (see netmasterRequestTimeout())
+	// so that it can be changed by reloading the settings.
+	s.netmasterPool = newUpstreamPool(s.config)
+	s.netmasterClient = s.netmasterPool.client()
+	s.datastoreLiveness = newDatastoreLiveness()
 
 	if s.config.ClientWriteTimeout <= s.config.NetmasterRequestTimeout {
 		log.Fatalf(
@@ -121,10 +239,69 @@ func (s *Server) Init() {
 
 }
 
+// unforwardedHeaders are the headers of netmaster's responses which aren't
+// copied to our responses: the body may be filtered and we never allow caching
+var unforwardedHeaders = map[string]bool{
+	"Cache-Control":  true,
+	"Connection":     true,
+	"Content-Length": true,
+}
+
+// netmasterRequestTimeout returns how long we allow for a request to netmaster.
+// the current netmaster_timeout setting takes precedence over the config.
+func (s *Server) netmasterRequestTimeout() time.Duration {
+	timeout := s.config.NetmasterRequestTimeout
+
+	if value, err := common.Global().Get(common.NetmasterTimeoutKey); err == nil {
+		if t, err := strconv.ParseInt(value, 10, 64); err == nil && t > 0 {
+			timeout = t
+		}
+	}
+
+	return time.Duration(timeout) * time.Second
+}
+
 // ProxyRequest takes a HTTP request we've received, duplicates it, adds a few
 // request headers, and sends the duplicated request to netmaster. It returns
-// the response + the response's body.
-func (s *Server) ProxyRequest(w http.ResponseWriter, req *http.Request) (*http.Response, []byte, error) {
+// the response + the response's body, or an *upstreamError if netmaster
+// couldn't be reached. Identity headers sent by the client are always removed;
+// the given identity, if any, is signed and added instead (see package identity).
+// netmaster's response headers are copied to `w`, but writing the status code
+// and body is left to the caller.
+func (s *Server) ProxyRequest(w http.ResponseWriter, req *http.Request, id *identity.Identity) (*http.Response, []byte, error) {
+	resp, err := s.forwardRequest(w, req, id)
+	if err != nil {
+		return nil, []byte{}, err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, []byte{}, newUpstreamError(resp.Request.Context(), errors.New("Failed to read body from response: "+err.Error()))
+	}
+
+	return resp, data, nil
+}
+
+// cancelOnClose is the body of a netmaster response which cancels the
+// request's context once it's closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the body and cancels the request's context.
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// forwardRequest is ProxyRequest without reading the response's body, which
+// lets callers stream it. The body is read from netmaster while the caller
+// reads it and has to be closed. The request's body, whatever its content
+// type, is streamed to netmaster as it is.
+func (s *Server) forwardRequest(w http.ResponseWriter, req *http.Request, id *identity.Identity) (*http.Response, error) {
 	copy := new(http.Request)
 	*copy = *req
 
@@ -147,30 +324,40 @@ func (s *Server) ProxyRequest(w http.ResponseWriter, req *http.Request) (*http.R
 	req.Header.Add("X-Forwarded-For", req.RemoteAddr)
 	req.Header.Add("X-Forwarder", s.config.Name+" "+s.config.Version)
 
+	// only we can assert the identity of the user
+	identity.StripHeaders(req.Header)
+	if secret, _ := common.Global().Get(common.IdentityHeaderSecretKey); id != nil && !common.IsEmpty(secret) {
+		identity.SetHeaders(req.Header, []byte(secret), *id, copy.URL.Path)
+	}
+
 	log.Debugf("Proxying request upstream to %s%s", copy.URL.Host, copy.URL.Path)
 
-	resp, err := s.netmasterClient.Do(copy)
-	if err != nil {
-		return nil, []byte{}, errors.New("Failed to perform duplicate request: " + err.Error())
-	}
+	// the timeout covers the whole request cycle including reading the body
+	ctx, cancel := context.WithTimeout(context.Background(), s.netmasterRequestTimeout())
 
-	defer resp.Body.Close()
+	copy = copy.WithContext(ctx)
 
-	data, err := ioutil.ReadAll(resp.Body)
+	resp, err := s.netmasterClient.Do(copy)
 	if err != nil {
-		return nil, []byte{}, errors.New("Failed to read body from response: " + err.Error())
+		cancel()
+		return nil, newUpstreamError(ctx, errors.New("Failed to perform duplicate request: "+err.Error()))
 	}
 
-	// copy the response code + headers from netmaster to our response
-	w.WriteHeader(resp.StatusCode)
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
 
+	// copy the response headers from netmaster to our response; the status
+	// code is written by the caller since the body may still be changed
 	for name, headers := range resp.Header {
+		if unforwardedHeaders[name] {
+			continue
+		}
+
 		for _, header := range headers {
 			w.Header().Set(name, header)
 		}
 	}
 
-	return resp, data, nil
+	return resp, nil
 }
 
 // DisableKeepalives turns off keepalives for the proxy.  This should only be
@@ -183,11 +370,12 @@ func (s *Server) DisableKeepalives() {
 // Serve creates a HTTP proxy listener and runs it in a goroutine.
 func (s *Server) Serve() {
 	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(notFound)
 
 	addRoutes(s, router)
 
 	server := &http.Server{
-		Handler:      router,
+		Handler:      withRequestID(recoverPanics(limitBodySize(router))),
 		ReadTimeout:  time.Duration(s.config.ClientReadTimeout) * time.Second,
 		WriteTimeout: time.Duration(s.config.ClientWriteTimeout) * time.Second,
 	}
@@ -196,23 +384,25 @@ func (s *Server) Serve() {
 		server.SetKeepAlivesEnabled(false)
 	}
 
-	cert, err := tls.LoadX509KeyPair(s.config.TLSCertificate, s.config.TLSKeyFile)
-	if err != nil {
+	// the key pair comes from the secrets backend and is looked up on every
+	// handshake, so that rotated certificates are used without a restart
+	if _, err := common.TLSCertificate(); err != nil {
 		log.Fatalln("Failed to load TLS key pair:", err)
 		return
 	}
 
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS11,
-	}
+	tlsConfig := s.configureTLS(server, func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return common.TLSCertificate()
+	})
 
-	s.listener, err = tls.Listen("tcp", s.config.ListenAddress, tlsConfig)
+	listener, err := tls.Listen("tcp", s.config.ListenAddress, tlsConfig)
 	if err != nil {
 		log.Fatalln("Failed to listen:", err)
 		return
 	}
 
+	s.listener = listener
+
 	log.Println("Proxying requests to netmaster at", s.config.NetmasterAddress)
 	log.Println("Listening for secure HTTPS requests on", s.config.ListenAddress)
 
@@ -226,146 +416,126 @@ func (s *Server) Serve() {
 		s.wg.Done()
 	}()
 
-	log.Debug("Server started, waiting for stop message")
-	<-s.stopChan
-	log.Debug("Received stop message, shutting down proxy")
-	s.listener.Close()
-}
-
-// Stop stops a running HTTP proxy listener.
-func (s *Server) Stop() {
-	s.stopChan <- true
+	// persist the tenant statistics in the background; once more when stopping
+	done := make(chan bool)
 
-	// wait until the listener has actually been stopped
-	s.wg.Wait()
-}
+	s.wg.Add(1)
+	go func() {
+		tenantStats.run(tenantStatsFlushInterval, done)
+		s.wg.Done()
+	}()
 
-type dirWithoutIndex struct {
-	fs http.FileSystem
-}
+	// campaign for the leader lease until we stop, and resign then
+	if s.config.Leader != nil {
+		s.wg.Add(1)
+		go func() {
+			s.config.Leader.Run(done)
+			s.wg.Done()
+		}()
+	}
 
-func (d dirWithoutIndex) Open(name string) (http.File, error) {
-	f, err := d.fs.Open(name)
+	// permanently delete users once their retention period is over
+	s.wg.Add(1)
+	go func() {
+		runDeletedUserGC(deletedUserGCInterval, s.isLeader, done)
+		s.wg.Done()
+	}()
 
-	if err != nil {
-		return nil, err
-	}
+	// delete authorizations once they've expired
+	s.wg.Add(1)
+	go func() {
+		runExpiredAuthzSweeper(expiredAuthzSweepInterval, s.isLeader, done)
+		s.wg.Done()
+	}()
 
-	if name == "/" {
-		return f, nil
-	}
+	// delete sessions once they've expired
+	s.wg.Add(1)
+	go func() {
+		runExpiredSessionSweeper(expiredSessionSweepInterval, s.isLeader, done)
+		s.wg.Done()
+	}()
 
-	stat, _ := f.Stat()
-	if stat.IsDir() {
-		return nil, os.ErrNotExist
-	}
+	// keep the login audit trail within its retention limits
+	s.wg.Add(1)
+	go func() {
+		runLoginAuditPruner(loginAuditPruneInterval, s.isLeader, done)
+		s.wg.Done()
+	}()
 
-	return f, nil
-}
+	// delete revocation records once the tokens they revoke have expired
+	s.wg.Add(1)
+	go func() {
+		runRevocationJanitor(s.isLeader, done)
+		s.wg.Done()
+	}()
 
-func newDirWithoutIndexes(dir string) dirWithoutIndex {
-	return dirWithoutIndex{fs: http.Dir(dir)}
+	log.Debug("Server started, waiting for stop message")
+	<-s.stopChan
+	log.Debug("Received stop message, shutting down proxy")
+	s.listener.Close()
+	close(done)
 }
 
-//
-// staticFileServer returns a staticFileHandler which serves the UI and its assets.
-// this is necessary so that we can set response headers.
-//
-func staticFileServer(root http.FileSystem) http.Handler {
-	return &staticFileHandler{
-		fileServer: http.FileServer(root),
+// configureTLS returns the TLS config of our listener and sets up HTTP/2 on the
+// server if it's enabled; the protocol is negotiated using ALPN.
+// params:
+//  server: the server which is going to serve the listener
+//  getCertificate: returns our TLS certificate
+// return values:
+//  *tls.Config: to be used by the listener
+func (s *Server) configureTLS(server *http.Server, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	tlsConfig := &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     tls.VersionTLS11,
+		NextProtos:     []string{"http/1.1"},
 	}
-}
 
-type staticFileHandler struct {
-	fileServer http.Handler
-}
-
-func (sfh *staticFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	common.EnableHSTS(w)
+	if s.config.ClientCAs != nil {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = s.config.ClientCAs
+	}
 
-	// TODO: here is a good spot to look for asset requests (.js, .css, etc.)
-	//       and append .gz and serve a gzipped version instead by rewriting
-	//       the requested path.
+	if s.config.HTTP2Enabled {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	} else {
+		// a non-nil, empty map keeps net/http from setting up HTTP/2
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
 
-	sfh.fileServer.ServeHTTP(w, r)
-}
+	// net/http only serves HTTP/2 on a listener with the server's TLS config
+	server.TLSConfig = tlsConfig
 
-func addRoutes(s *Server, router *mux.Router) {
-
-	//
-	// Version endpoint
-	//
-	router.Path(VersionPath).Methods("GET").HandlerFunc(versionHandler(s.config.Version))
-
-	//
-	// Health check endpoint
-	//
-	router.Path(HealthCheckPath).Methods("GET").HandlerFunc(healthCheckHandler(s.config))
-
-	//
-	// Authentication endpoint
-	//
-	router.Path(LoginPath).Methods("POST").HandlerFunc(loginHandler)
-
-	//
-	// User management endpoints
-	//
-	addUserMgmtRoutes(router)
-
-	// Authorization endpoints
-	//
-	addAuthorizationRoutes(router)
-
-	//
-	// LDAP configuration management endpoints
-	//
-	addLdapConfigurationMgmtRoutes(router)
-
-	//
-	// Netmaster endpoints
-	//
-	addNetmasterRoutes(s, router)
-
-	//
-	// UI: static files which are served from the root
-	//
-	root := "/"
-	staticHandler := staticFileServer(newDirWithoutIndexes(uiDirectory))
-
-	router.PathPrefix(root).Handler(http.StripPrefix(root, staticHandler))
+	return tlsConfig
 }
 
-// addNetmasterRoutes adds all netmaster routes to mux.Router
-func addNetmasterRoutes(s *Server, router *mux.Router) {
-	router.Path("/api/v1/{resource}/").Methods("GET").HandlerFunc(enforceRBAC(s))
-	router.Path("/api/v1/{resource}/{name}/").Methods("GET", "POST", "PUT", "DELETE").HandlerFunc(enforceRBAC(s))
-	router.Path("/api/v1/inspect/{resource}/{name}/").Methods("GET").HandlerFunc(enforceRBAC(s))
+// isLeader returns true if this instance runs the background sweepers, i.e.
+// if it's the leader or leader election is disabled
+func (s *Server) isLeader() bool {
+	return s.config.Leader == nil || s.config.Leader.IsLeader()
 }
 
-// addUserMgmtRoutes adds user management routes to the mux.Router.
-// All user management routes are admin-only.
-func addUserMgmtRoutes(router *mux.Router) {
-	router.Path(V1Prefix + "/local_users/").Methods("POST").HandlerFunc(adminOnly(addLocalUser))
-	router.Path(V1Prefix + "/local_users/{username}/").Methods("DELETE").HandlerFunc(adminOnly(deleteLocalUser))
-	router.Path(V1Prefix + "/local_users/{username}/").Methods("PATCH").HandlerFunc(authorizedUserOnly(updateLocalUser))
-	router.Path(V1Prefix + "/local_users/{username}/").Methods("GET").HandlerFunc(authorizedUserOnly(getLocalUser))
-	router.Path(V1Prefix + "/local_users/").Methods("GET").HandlerFunc(adminOnly(getLocalUsers))
+// runAsLeader calls `task` every `interval` until `done` is closed, as long as
+// `leader` returns true.
+func runAsLeader(interval time.Duration, leader func() bool, done chan bool, task func(now time.Time)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if leader() {
+				task(now)
+			}
+		case <-done:
+			return
+		}
+	}
 }
 
-// addAuthorizationRoutes adds authorization routes to the mux.Router
-// All authorization management routes are admin-only.
-func addAuthorizationRoutes(router *mux.Router) {
-	router.Path(V1Prefix + "/authorizations/").Methods("POST").HandlerFunc(adminOnly(addAuthorization))
-	router.Path(V1Prefix + "/authorizations/{authzUUID}/").Methods("DELETE").HandlerFunc(adminOnly(deleteAuthorization))
-	router.Path(V1Prefix + "/authorizations/{authzUUID}/").Methods("GET").HandlerFunc(adminOnly(getAuthorization))
-	router.Path(V1Prefix + "/authorizations/").Methods("GET").HandlerFunc(adminOnly(listAuthorizations))
-}
+// Stop stops a running HTTP proxy listener.
+func (s *Server) Stop() {
+	s.stopChan <- true
 
-// addLdapConfigurationMgmtRoutes adds LDAP configuration management routes to mux.Router.
-func addLdapConfigurationMgmtRoutes(router *mux.Router) {
-	router.Path(V1Prefix + "/ldap_configuration/").Methods("PUT").HandlerFunc(adminOnly(addLdapConfiguration))
-	router.Path(V1Prefix + "/ldap_configuration/").Methods("GET").HandlerFunc(adminOnly(getLdapConfiguration))
-	router.Path(V1Prefix + "/ldap_configuration/").Methods("DELETE").HandlerFunc(adminOnly(deleteLdapConfiguration))
-	router.Path(V1Prefix + "/ldap_configuration/").Methods("PATCH").HandlerFunc(adminOnly(updateLdapConfiguration))
+	// wait until the listener has actually been stopped
+	s.wg.Wait()
 }
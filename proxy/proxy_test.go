@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newTestCertificate returns a self-signed certificate for 127.0.0.1
+func newTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "auth_proxy test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startTLSListener serves the handler like Serve() does and returns the listener's address
+func startTLSListener(t *testing.T, config *Config, handler http.Handler) (string, func()) {
+	s := &Server{config: config}
+	server := &http.Server{Handler: handler}
+
+	cert := newTestCertificate(t)
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &cert, nil }
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", s.configureTLS(server, getCertificate))
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	go server.Serve(listener)
+
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+// dialTLS connects to the address offering the given protocols
+func dialTLS(t *testing.T, address string, protocols ...string) *tls.Conn {
+	conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true, NextProtos: protocols})
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	return conn
+}
+
+// TestHTTP2Negotiation tests that HTTP/2 is only negotiated if it's enabled
+func TestHTTP2Negotiation(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		address, stop := startTLSListener(t, &Config{HTTP2Enabled: enabled}, http.NotFoundHandler())
+
+		expected := "http/1.1"
+		if enabled {
+			expected = "h2"
+		}
+
+		conn := dialTLS(t, address, "h2", "http/1.1")
+		if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != expected {
+			t.Errorf("HTTP/2 enabled: %t: expected protocol %q, got %q", enabled, expected, protocol)
+		}
+
+		if enabled {
+			// send the client preface and an empty SETTINGS frame; the server
+			// has to answer with its own SETTINGS frame
+			io.WriteString(conn, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+			conn.Write([]byte{0, 0, 0, 0x4, 0, 0, 0, 0, 0})
+
+			header := make([]byte, 9)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(conn, header); err != nil {
+				t.Errorf("failed to read HTTP/2 frame: %s", err)
+			} else if header[3] != 0x4 {
+				t.Errorf("expected a SETTINGS frame, got type %d", header[3])
+			}
+		}
+
+		conn.Close()
+
+		// clients which don't know about HTTP/2 keep using HTTP/1.1
+		conn = dialTLS(t, address)
+		if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != "" {
+			t.Errorf("HTTP/2 enabled: %t: expected no protocol, got %q", enabled, protocol)
+		}
+		conn.Close()
+
+		stop()
+	}
+}
+
+// TestWebSocketUpgradeWithHTTP2 tests that a WebSocket client (which only
+// offers HTTP/1.1) can still upgrade its connection when HTTP/2 is enabled
+func TestWebSocketUpgradeWithHTTP2(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "websocket" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+	})
+
+	address, stop := startTLSListener(t, &Config{HTTP2Enabled: true}, handler)
+	defer stop()
+
+	conn := dialTLS(t, address, "http/1.1")
+	defer conn.Close()
+
+	if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != "http/1.1" {
+		t.Fatalf("expected protocol %q, got %q", "http/1.1", protocol)
+	}
+
+	req, err := http.NewRequest("GET", "https://"+address+"/ws", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("expected status %d, got %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+}
+
+// TestTokenFromHeaders tests reading the token from the Authorization and X-Auth-Token headers
+func TestTokenFromHeaders(t *testing.T) {
+	testCases := []struct {
+		description   string
+		authorization string
+		xAuthToken    []string
+		token         string
+		found         bool
+		err           error
+	}{
+		{"no token", "", nil, "", false, nil},
+		{"X-Auth-Token", "", []string{"abc"}, "abc", true, nil},
+		{"empty X-Auth-Token", "", []string{""}, "", true, nil},
+		{"bearer token", "Bearer abc", nil, "abc", true, nil},
+		{"lower case scheme", "bearer abc", nil, "abc", true, nil},
+		{"empty bearer token", "Bearer ", nil, "", true, nil},
+		{"same token in both", "Bearer abc", []string{"abc"}, "abc", true, nil},
+		{"different tokens", "Bearer abc", []string{"def"}, "", true, errConflictingTokens},
+		{"basic auth", "Basic YmlsbGluZzpzZWNyZXQ=", nil, "", false, nil},
+		{"basic auth and X-Auth-Token", "Basic YmlsbGluZzpzZWNyZXQ=", []string{"abc"}, "abc", true, nil},
+		{"other scheme", "Bearerabc", nil, "", false, nil},
+	}
+
+	for _, tc := range testCases {
+		header := http.Header{}
+		if tc.authorization != "" {
+			header.Set("Authorization", tc.authorization)
+		}
+		if tc.xAuthToken != nil {
+			header["X-Auth-Token"] = tc.xAuthToken
+		}
+
+		token, found, err := tokenFromHeaders(header)
+		if token != tc.token || found != tc.found || err != tc.err {
+			t.Errorf("%s: expected %q/%t/%v, got %q/%t/%v", tc.description, tc.token, tc.found, tc.err, token, found, err)
+		}
+	}
+}
@@ -2,16 +2,20 @@ package proxy
 
 import (
 	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/contiv/auth_proxy/auth"
 	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/identity"
 	"github.com/contiv/auth_proxy/common/types"
-	"github.com/contiv/contivmodel/client"
+	"github.com/contiv/auth_proxy/db"
 	"github.com/gorilla/mux"
 
 	log "github.com/Sirupsen/logrus"
@@ -22,109 +26,112 @@ import (
 // allowed to see.
 type rbacFilter func(*auth.Token, []byte) []byte
 
-// rbacData struct that holds the filter and contivmodel object reference for
-// each of the netmaster resource.
-type rbacData struct {
-	filter rbacFilter
-	newObj func() interface{}
-}
-
-var (
-	// rbacDetails map containing the details of all netmaster resources
-	rbacDetails = map[string]rbacData{
-		"appProfiles": {
-			filter: auth.FilterAppProfiles,
-			newObj: func() interface{} { return &client.AppProfile{} },
-		},
-		"endpointGroups": {
-			filter: auth.FilterEndpointGroups,
-			newObj: func() interface{} { return &client.EndpointGroup{} },
-		},
-		"extContractsGroups": {
-			filter: auth.FilterExtContractsGroups,
-			newObj: func() interface{} { return &client.ExtContractsGroup{} },
-		},
-		"netprofiles": {
-			filter: auth.FilterNetProfiles,
-			newObj: func() interface{} { return &client.Netprofile{} },
-		},
-		"networks": {
-			filter: auth.FilterNetworks,
-			newObj: func() interface{} { return &client.Network{} },
-		},
-		// NOTE: "policys" is misspelled in netmaster's routes
-		"policys": {
-			filter: auth.FilterPolicies,
-			newObj: func() interface{} { return &client.Policy{} },
-		},
-		"rules": {
-			filter: auth.FilterRules,
-			newObj: func() interface{} { return &client.Rule{} },
-		},
-		"serviceLBs": {
-			filter: auth.FilterServiceLBs,
-			newObj: func() interface{} { return &client.ServiceLB{} },
-		},
-	}
-)
-
 // enforceRBAC interprets the incoming `netmaster` request and
 // proxy only the requests that the user is authorized to perform,
 // other requests are dropped with `Unauthorized` status.
 // NOTE:
 //    1. RBAC on list operations (/api/v1/networks, /api/v1/tenants/, etc..)
 //       is enforced by filtereing the results from netmaster based on user authorization.
-//    2. Certain netmaster endpoints(aciGws, Bgps, globals) can only be acessed by admins
-//       and their responses are never filtered.
+//    2. The minimum role required for each endpoint is decided by the endpoint policy rules
+//       (see auth.EvaluateEndpointPolicy). By default, certain netmaster endpoints (aciGws, Bgps,
+//       globals) can only be acessed by admins and their responses are never filtered.
 //    3. Since our RBAC system works only at the tenant level, each incoming request (GET, POST, etc.)
 //       needs to mapped to a tenant name to enfore access control. More details below.
 //       POST: tenant name is obtained from the payload
 //       GET, PUT, DELETE: tenant name is obtained by querying (http.GET) netmaster for the named resource
-//    4. Responses of superuser's request is never filtered (auth.NullFilter)
+//    4. Responses of superuser's request is never filtered, they're streamed to the client as they are
+//    5. The summaries of all tenants' objects returned by the aggregated inspect endpoints (see aggregates)
+//       are recomputed from the user's objects, whatever the scope of the endpoint policy rule.
+//    6. Guests can only read; any other request of theirs is denied, whatever the endpoint policy says.
+//    7. Requests allowed by a custom role granted to the user (see auth.Token.CustomRolesAllow) are proxied
+//       before the endpoint policy is evaluated, and their responses aren't filtered.
+//    8. If strict authorization is enabled (see common.StrictAuthorizationKey), any other request of a user
+//       who isn't authorized for any tenant is denied, instead of e.g. returning an empty list.
 func enforceRBAC(s *Server) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		vars := mux.Vars(req)
 
 		common.SetDefaultResponseHeaders(w)
 
-		token, valid := validateToken(w, req)
+		token, valid := proxiedRequestToken(w, req)
 		if !valid {
 			return
 		}
 
 		if token.IsSuperuser() {
-			proxyRequest(s, req, w, token, auth.NullFilter)
+			proxyRequest(s, req, w, token, nil, "")
 			return
 		}
 
-		resource := vars["resource"]
-		switch resource {
-		// admin-only netmaster resources
-		case "aciGws", "Bgps":
-			authError(w, http.StatusForbidden, "Insufficient privileges")
-		case "globals":
-			rName := vars["name"]
-			// allow GET access on /inspect/globals/global to everyone
-			if strings.Contains(req.RequestURI, "/inspect/") && req.Method == "GET" && !common.IsEmpty(rName) && rName == "global" {
-				proxyRequest(s, req, w, token, auth.NullFilter)
+		allowed, err := token.CustomRolesAllow(req.Method, req.URL.Path)
+		if err != nil {
+			log.Errorf("Failed to evaluate custom roles: %#v", err)
+			serverError(w, fmt.Errorf("Failed to process request"))
+			return
+		}
+
+		if allowed {
+			proxyRequest(s, req, w, token, nil, "")
+			return
+		}
+
+		if strictAuthorization() {
+			tenants, err := token.Tenants()
+			if err != nil {
+				serverError(w, err)
 				return
 			}
 
-			authError(w, http.StatusForbidden, "Insufficient privileges")
-		case "tenants":
-			if req.Method == "GET" {
-				rbacUsingTenant(s, req, w, token, vars)
+			if len(tenants) == 0 {
+				authError(w, http.StatusForbidden, types.ErrorCodeNoTenants, "No tenants are assigned to you; ask your admin for access")
 				return
 			}
+		}
 
-			authError(w, http.StatusForbidden, "Insufficient privileges")
-		default:
+		rules, err := db.ListEndpointPolicyRules()
+		if err != nil {
+			log.Errorf("Failed to read endpoint policy rules: %#v", err)
+			serverError(w, fmt.Errorf("Failed to process request"))
+			return
+		}
+
+		if guestWrite(token, req.Method) {
+			authError(w, http.StatusForbidden, types.ErrorCodeForbidden, "Insufficient privileges")
+			return
+		}
+
+		// everyone who isn't a superuser is treated as ops
+		decision := auth.EvaluateEndpointPolicy(rules, types.Ops, req.Method, req.URL.Path)
+		log.Debugf("Endpoint policy for %s %s: %s", req.Method, req.URL.Path, decision.Reason)
+
+		aggregate, isAggregate := aggregateFor(req, vars["resource"])
+
+		switch {
+		case !decision.Allowed:
+			authError(w, http.StatusForbidden, types.ErrorCodeForbidden, "Insufficient privileges")
+		case isAggregate:
+			proxyAggregate(s, req, w, token, aggregate)
+		case decision.TenantScoped:
 			rbacUsingTenant(s, req, w, token, vars)
+		default:
+			proxyRequest(s, req, w, token, nil, "")
 		}
 
 	}
 }
 
+// strictAuthorization returns true if users without tenant authorizations are
+// denied all netmaster requests (see common.StrictAuthorizationKey)
+func strictAuthorization() bool {
+	value, err := common.Global().Get(common.StrictAuthorizationKey)
+	if err != nil {
+		return false
+	}
+
+	strict, _ := strconv.ParseBool(value) // already validated
+	return strict
+}
+
 // rbacUsingTenant enforces RBAC using tenant authorizations;
 // User can access only tenants that he/she is authorized to.
 // params:
@@ -138,44 +145,48 @@ func enforceRBAC(s *Server) func(http.ResponseWriter, *http.Request) {
 //       others do not require filtering as those requests are proxied only after authorization.
 //    2. If the rName(resource name) is empty, then the request is considered as `list` request. (/networks/, /tenants/, etc.)
 //       otherwise the requests (GET, POST, etc. on one of the collection's members. e.g., /networks/n1/) are proxied after authZ.
+//    3. Tenant-scoped endpoint policy rules only work for the resources whose objects name their tenant
+//       (see auth.IsTenantScopedResource), plus endpoints and tenants; we don't know how to map the objects
+//       of any other resource to a tenant, so such requests are denied.
+//    4. Requests on (and denials of) a tenant's objects are counted in the tenant's usage statistics (see tenantStats).
+//       List requests aren't attributed to any tenant.
 func rbacUsingTenant(s *Server, req *http.Request, w http.ResponseWriter, token *auth.Token, vars map[string]string) {
 	resource := vars["resource"]
 	rName := vars["name"]
 
-	switch resource {
-	case "appProfiles", "endpointGroups", "extContractsGroups", "netprofiles", "networks", "policys", "rules", "serviceLBs":
+	switch {
+	case auth.IsTenantScopedResource(resource):
 		if common.IsEmpty(rName) {
-			proxyRequest(s, req, w, token, rbacDetails[resource].filter)
+			proxyFilteredRequest(s, req, w, token, auth.FilterByTenant, "")
 			return
 		}
 
-		if authorized(s, req, w, token, resource, rName, rbacDetails[resource].newObj()) {
-			proxyRequest(s, req, w, token, auth.NullFilter)
+		if tenant, ok := authorized(s, req, w, token, resource, rName); ok {
+			proxyRequest(s, req, w, token, nil, tenant)
 		}
-	case "endpoints":
+	case resource == "endpoints":
 		// XXX: This is one of the inspect endpoints; different than normal inspect on the object.
 		//      /api/v1/inspect/endpoints/{epg_name}/ -> returns the list of containers attached to this EPG
 		if common.IsEmpty(rName) {
 			// there is no such endpoint as /api/v1/inspect/endpoints/ -> 404
-			proxyRequest(s, req, w, token, auth.NullFilter)
+			proxyRequest(s, req, w, token, nil, "")
 			return
 		}
 
-		epg := &client.EndpointGroup{}
-		if authorized(s, req, w, token, resource, rName, epg) {
-			proxyRequest(s, req, w, token, auth.NullFilter)
+		if tenant, ok := authorized(s, req, w, token, resource, rName); ok {
+			proxyRequest(s, req, w, token, nil, tenant)
 		}
-	case "tenants":
+	case resource == "tenants":
 		if common.IsEmpty(rName) {
-			proxyRequest(s, req, w, token, auth.FilterTenants)
+			proxyFilteredRequest(s, req, w, token, auth.FilterByTenant, "")
 			return
 		}
 
-		if checkClaims(w, token, types.Tenant(rName)) {
-			proxyRequest(s, req, w, token, auth.NullFilter)
+		if checkClaims(w, req, token, types.Tenant(rName)) {
+			proxyRequest(s, req, w, token, nil, types.Tenant(rName))
 		}
 	default:
-		authError(w, http.StatusForbidden, "Insufficient privileges")
+		authError(w, http.StatusForbidden, types.ErrorCodeForbidden, "Insufficient privileges")
 	}
 
 }
@@ -186,45 +197,27 @@ func rbacUsingTenant(s *Server, req *http.Request, w http.ResponseWriter, token
 //  req:          http request object
 //  w:            http response writer
 //  token:        user token; carries the embebbed authZs of the user
-//  resource:     resource obtained from the http endpoint. e.g. networks, tenants, etc.
-//  rName:        name/ID of the resource obtained from the http endpoint. e.g. n1, t1, etc.
-//  resourceObj:  interface representing *client.Networks, *client.Tenants based on the named resource
+//  resource:     resource obtained from the http endpoint. e.g. networks, endpoints, etc.
+//  rName:        name/ID of the resource obtained from the http endpoint. e.g. n1, epg1, etc.
 // return values:
+//  types.Tenant: tenant of the named resource
 //  bool: true if the user is authorized, otherwise false
 //  errors are written using http response writer
 func authorized(s *Server, req *http.Request, w http.ResponseWriter, token *auth.Token,
-	resource, rName string, resourceObj interface{}) bool {
-	if data := getResourceDetails(req, w, getNetmasterEndpoint(s, resource, rName), rName); data != nil {
-		if err := json.Unmarshal(data, resourceObj); err != nil {
-			log.Debugf("Failed to unmarshal %#v: %#v", data, resourceObj)
-			serverError(w, fmt.Errorf("Failed to process request"))
-			return false
-		}
-
-		tenantName := ""
-		switch resourceObj.(type) {
-		case *client.AppProfile:
-			tenantName = resourceObj.(*client.AppProfile).TenantName
-		case *client.EndpointGroup:
-			tenantName = resourceObj.(*client.EndpointGroup).TenantName
-		case *client.ExtContractsGroup:
-			tenantName = resourceObj.(*client.ExtContractsGroup).TenantName
-		case *client.Netprofile:
-			tenantName = resourceObj.(*client.Netprofile).TenantName
-		case *client.Network:
-			tenantName = resourceObj.(*client.Network).TenantName
-		case *client.Policy:
-			tenantName = resourceObj.(*client.Policy).TenantName
-		case *client.Rule:
-			tenantName = resourceObj.(*client.Rule).TenantName
-		case *client.ServiceLB:
-			tenantName = resourceObj.(*client.ServiceLB).TenantName
+	resource, rName string) (types.Tenant, bool) {
+	if data := getResourceDetails(s, req, w, getNetmasterEndpoint(s, resource, rName), rName); data != nil {
+		// objects which don't name their tenant can't be authorized
+		tenantName, err := auth.TenantOf(data)
+		if err != nil {
+			log.Debugf("Failed to find the tenant of %s %q: %s", resource, rName, data)
+			authError(w, http.StatusForbidden, types.ErrorCodeForbidden, "Insufficient privileges")
+			return "", false
 		}
 
-		return checkClaims(w, token, types.Tenant(tenantName))
+		return types.Tenant(tenantName), checkClaims(w, req, token, types.Tenant(tenantName))
 	}
 
-	return false
+	return "", false
 }
 
 // getResourceDetails retrieves the details of the named resource
@@ -232,6 +225,7 @@ func authorized(s *Server, req *http.Request, w http.ResponseWriter, token *auth
 // If the GET request (made to obtain resource (network, endpointGroup, etc.) details) fails,
 // then the same response and status code is returned back.
 // params:
+//  s:            server object; its netmaster client is used for the GET request
 //  req:          http request object
 //  w:            http response writer
 //  endpoint:     to make GET request; constructed using the resource and its name
@@ -239,12 +233,15 @@ func authorized(s *Server, req *http.Request, w http.ResponseWriter, token *auth
 // return values:
 //  []byte: byte array of the requested/posted object (network, endpointGroup, appProfile, etc.) containing the tenant name
 //  errors are written using http response writer
-func getResourceDetails(req *http.Request, w http.ResponseWriter, endpoint, rName string) []byte {
+func getResourceDetails(s *Server, req *http.Request, w http.ResponseWriter, endpoint, rName string) []byte {
 	if req.Method == "POST" {
 		defer req.Body.Close()
 
 		data, err := ioutil.ReadAll(req.Body)
-		if err != nil {
+		if bodyExceededLimit(req) {
+			bodyTooLarge(w)
+			return nil
+		} else if err != nil {
 			log.Debugf("Failed to read POST request body %q: %#v", rName, err)
 			serverError(w, fmt.Errorf("Failed to process request"))
 			return nil
@@ -256,15 +253,15 @@ func getResourceDetails(req *http.Request, w http.ResponseWriter, endpoint, rNam
 		return data
 	}
 
-	resp, err := http.Get(endpoint)
-	defer resp.Body.Close()
-
+	resp, err := s.netmasterClient.Get(endpoint)
 	if err != nil {
 		log.Debugf("Failed to read GET resource %q: %#v", rName, err)
-		serverError(w, fmt.Errorf("Failed to process request"))
+		upstreamFailure(w, &upstreamError{err: fmt.Errorf("Failed to process request")})
 		return nil
 	}
 
+	defer resp.Body.Close()
+
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Debugf("Failed to read GET response body %q: %#v", rName, err)
@@ -274,26 +271,58 @@ func getResourceDetails(req *http.Request, w http.ResponseWriter, endpoint, rNam
 
 	if resp.StatusCode != http.StatusOK {
 		// GET failed; return the same response back
-		w.WriteHeader(resp.StatusCode)
-		w.Write(data)
+		if contentType := resp.Header.Get("Content-Type"); !common.IsEmpty(contentType) {
+			w.Header().Set("Content-Type", contentType)
+		}
+
+		writeUpstreamError(w, req, resp.StatusCode, data)
 		return nil
 	}
 
 	return data
 }
 
+// readOnlyMethod returns true if requests with the given method only read
+func readOnlyMethod(method string) bool {
+	return method == "GET" || method == "HEAD"
+}
+
+// tenantRole returns the minimum role on a tenant required for a request with
+// the given method; guests can only read.
+func tenantRole(method string) types.RoleType {
+	if readOnlyMethod(method) {
+		return types.Guest
+	}
+
+	return types.Ops
+}
+
+// guestWrite returns true if the token only carries the guest role and the
+// request with the given method isn't read-only.
+// params:
+//  token:  user token; not a superuser's
+//  method: http method of the request
+func guestWrite(token *auth.Token, method string) bool {
+	return !readOnlyMethod(method) && tokenRole(token) == types.Guest
+}
+
 // checkClaims checks given tentant claims on the token
 // params:
 //  w:          http response writer
+//  req:        http request object; its method decides the required role
 //  token:      containing claims
 //  tenantName: of the requested resource
 // return values:
 //  bool: true if the user is authorized on given tenant, otherwise false
 //  errors are written using response writer
-func checkClaims(w http.ResponseWriter, token *auth.Token, tenant types.Tenant) bool {
+func checkClaims(w http.ResponseWriter, req *http.Request, token *auth.Token, tenant types.Tenant) bool {
 	log.Debugf("Tenant name of the requested resource %q, checking authZ...", tenant)
-	if err := token.CheckClaims(tenant, types.Ops); err != nil {
-		authError(w, http.StatusForbidden, "Insufficient privileges")
+	if err := token.CheckClaims(tenant, tenantRole(req.Method)); err != nil {
+		if !common.IsEmpty(string(tenant)) {
+			tenantStats.recordDenial(string(tenant))
+		}
+
+		authError(w, http.StatusForbidden, types.ErrorCodeForbidden, "Insufficient privileges")
 		return false
 	}
 
@@ -306,21 +335,163 @@ func checkClaims(w http.ResponseWriter, token *auth.Token, tenant types.Tenant)
 //  s:      proxy server object
 //  req:    http request object
 //  w:      http response writer
-//  token:  user token
-//  filter: to be applied on the response
-func proxyRequest(s *Server, req *http.Request, w http.ResponseWriter, token *auth.Token, filter rbacFilter) {
-	resp, body, err := s.ProxyRequest(w, req)
+//  token:  user token; may be nil
+//  filter: to be applied on successful responses; nil if they aren't filtered
+//  tenant: tenant the request is counted against (see tenantStats); empty if unknown
+func proxyRequest(s *Server, req *http.Request, w http.ResponseWriter, token *auth.Token, filter rbacFilter, tenant types.Tenant) {
+	if filter == nil {
+		proxyFilteredRequest(s, req, w, token, nil, tenant)
+		return
+	}
+
+	proxyFilteredRequest(s, req, w, token, func(t *auth.Token, body []byte) ([]byte, error) {
+		return filter(t, body), nil
+	}, tenant)
+}
+
+// proxyFilteredRequest is proxyRequest for filters which can fail; if the
+// filter fails, the response is denied rather than returned unfiltered.
+// Responses which aren't filtered are streamed to the client as they are,
+// whatever their content type; only filtered responses are read as a whole.
+// params:
+//  s:      proxy server object
+//  req:    http request object
+//  w:      http response writer
+//  token:  user token; may be nil
+//  filter: to be applied on successful responses; nil if they aren't filtered
+//  tenant: tenant the request is counted against (see tenantStats); empty if unknown
+func proxyFilteredRequest(s *Server, req *http.Request, w http.ResponseWriter, token *auth.Token,
+	filter func(*auth.Token, []byte) ([]byte, error), tenant types.Tenant) {
+	id, err := tokenIdentity(token)
 	if err != nil {
-		serverError(w, err)
+		log.Errorf("Failed to get the identity of %q: %v", token.GetClaim(auth.UsernameClaimKey), err)
+		serverError(w, fmt.Errorf("Failed to process request"))
 		return
 	}
 
-	if resp.StatusCode/100 != 2 {
-		w.Write(body)
+	username := ""
+	if token != nil {
+		username = token.GetClaim(auth.UsernameClaimKey)
+	}
+
+	start := time.Now()
+	size := uint64(0)
+
+	resp, err := s.forwardRequest(w, req, id)
+	if err == nil {
+		defer resp.Body.Close()
+
+		log.Infof("%s %s (request %s) by %q: netmaster returned %d in %s", req.Method, req.URL.Path,
+			w.Header().Get(requestIDHeader), username, resp.StatusCode, time.Since(start))
+
+		size, err = writeResponse(w, req, resp, token, filter)
+	}
+
+	// the tenant comes from the path; only count it once netmaster found it
+	if !common.IsEmpty(string(tenant)) && resp != nil && resp.StatusCode != http.StatusNotFound {
+		if req.ContentLength > 0 {
+			size += uint64(req.ContentLength)
+		}
+
+		tenantStats.recordRequest(string(tenant), req.Method, size)
+	}
+
+	if err == nil {
 		return
 	}
 
-	w.Write(filter(token, body))
+	switch {
+	case bodyExceededLimit(req):
+		bodyTooLarge(w)
+	case err == errUnfilterable:
+		atomic.AddUint64(&unfilterableResponses, 1)
+		authError(w, http.StatusForbidden, types.ErrorCodeForbidden, "Insufficient privileges")
+	case err != nil:
+		upstreamFailure(w, err)
+	}
+}
+
+// errUnfilterable is returned by writeResponse() if the filter failed
+var errUnfilterable = errors.New("failed to filter the response")
+
+// writeResponse writes netmaster's response, filtered if it's successful and a filter is given.
+// params:
+//  w:      http response writer
+//  req:    http request object
+//  resp:   netmaster's response
+//  token:  user token; may be nil
+//  filter: to be applied on successful responses; nil if they aren't filtered
+// return values:
+//  uint64: number of bytes of the response body read from netmaster
+//  error: nil if the response was written, errUnfilterable if the filter failed
+//         or an *upstreamError if the response couldn't be read. Nothing is
+//         written in case of an error, unless it happens while streaming the
+//         body, in which case the connection is cut short.
+func writeResponse(w http.ResponseWriter, req *http.Request, resp *http.Response, token *auth.Token,
+	filter func(*auth.Token, []byte) ([]byte, error)) (uint64, error) {
+	// only successful responses carry data which has to be filtered
+	if filter == nil && resp.StatusCode/100 == 2 {
+		if resp.ContentLength >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		}
+
+		w.WriteHeader(resp.StatusCode)
+
+		n, err := io.Copy(w, resp.Body)
+		if err != nil {
+			log.Warnf("Failed to stream the response to %s %s (request %s): %v", req.Method, req.URL.Path,
+				w.Header().Get(requestIDHeader), err)
+		}
+
+		return uint64(n), nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return uint64(len(body)), newUpstreamError(resp.Request.Context(), errors.New("Failed to read body from response: "+err.Error()))
+	}
+
+	if resp.StatusCode/100 != 2 {
+		writeUpstreamError(w, req, resp.StatusCode, body)
+		return uint64(len(body)), nil
+	}
+
+	filtered, err := filter(token, body)
+	if err != nil {
+		log.Warnf("Denying %s %s (request %s): failed to filter the response: %v", req.Method, req.URL.Path,
+			w.Header().Get(requestIDHeader), err)
+		return uint64(len(body)), errUnfilterable
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	w.Write(filtered)
+
+	return uint64(len(body)), nil
+}
+
+// tokenIdentity returns the identity asserted to netmaster for the given token.
+// params:
+//  token: user token; may be nil
+// return values:
+//  *identity.Identity: identity of the user; nil if no token is given or no
+//                      identity header secret is configured
+//  error: as returned by token.Tenants()
+func tokenIdentity(token *auth.Token) (*identity.Identity, error) {
+	if secret, _ := common.Global().Get(common.IdentityHeaderSecretKey); token == nil || common.IsEmpty(secret) {
+		return nil, nil
+	}
+
+	// everyone who isn't a superuser is treated as ops; admins aren't limited to tenants
+	if token.IsSuperuser() {
+		return &identity.Identity{User: token.GetClaim(auth.UsernameClaimKey), Role: types.Admin.String(), Tenants: []string{}}, nil
+	}
+
+	tenants, err := token.Tenants()
+	if err != nil {
+		return nil, err
+	}
+
+	return &identity.Identity{User: token.GetClaim(auth.UsernameClaimKey), Role: types.Ops.String(), Tenants: tenants}, nil
 }
 
 // getNetmasterEndpoint isolates the messy string construction
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains the revocation janitor: revoked tokens and principals are
+// only needed until the tokens they revoke have expired, so they're deleted
+// afterwards to keep the data store from growing forever. Each wait is
+// jittered so that several proxies don't scan the data store in lockstep.
+// There are no lockout records yet; they'd be pruned here as well.
+
+// defaultRevocationCleanupInterval is used when common.RevocationCleanupIntervalKey
+// isn't set, and to check again whether the cleanup was re-enabled
+const defaultRevocationCleanupInterval = 10 * time.Minute
+
+// revocationCleanupJitter is the fraction by which each wait may be shortened or lengthened
+const revocationCleanupJitter = 0.1
+
+// prunedRevocations counts the revocation records deleted since startup
+var prunedRevocations int64
+
+// revocationCleanupInterval returns the time between two cleanups of expired
+// revocation records; 0 if they're disabled.
+func revocationCleanupInterval() time.Duration {
+	value, err := common.Global().Get(common.RevocationCleanupIntervalKey)
+	if err != nil {
+		return defaultRevocationCleanupInterval
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return defaultRevocationCleanupInterval
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// jittered returns `interval` shortened or lengthened by up to revocationCleanupJitter.
+func jittered(interval time.Duration) time.Duration {
+	return interval + time.Duration((rand.Float64()*2-1)*revocationCleanupJitter*float64(interval))
+}
+
+// cleanupExpiredRevocations deletes the revoked tokens and principals whose
+// tokens have all expired, and logs how many were deleted.
+// params:
+//  now: current time
+// return values:
+//  int: number of deleted records
+//  error: as returned by consecutive func calls
+func cleanupExpiredRevocations(now time.Time) (int, error) {
+	tokens, err := db.DeleteExpiredRevokedTokens(now.Unix())
+	if err != nil {
+		return tokens, err
+	}
+
+	principals, err := db.DeleteExpiredRevokedPrincipals(now.Unix())
+	if err != nil {
+		return tokens + principals, err
+	}
+
+	total := atomic.AddInt64(&prunedRevocations, int64(tokens+principals))
+	if tokens+principals > 0 {
+		log.Infof("Deleted %d expired revoked tokens and %d expired revoked principals (%d since startup)",
+			tokens, principals, total)
+	}
+
+	return tokens + principals, nil
+}
+
+// runRevocationJanitor cleans up expired revocation records every
+// common.RevocationCleanupIntervalKey (jittered) until `done` is closed, as
+// long as `leader` returns true. Failures are logged and retried next time.
+func runRevocationJanitor(leader func() bool, done chan bool) {
+	for {
+		interval := revocationCleanupInterval()
+		enabled := interval > 0
+		if !enabled {
+			interval = defaultRevocationCleanupInterval
+		}
+
+		select {
+		case now := <-time.After(jittered(interval)):
+			if !enabled || !leader() {
+				continue
+			}
+
+			if _, err := cleanupExpiredRevocations(now); err != nil {
+				log.Warnf("Failed to delete expired revocation records: %s", err.Error())
+			}
+		case <-done:
+			return
+		}
+	}
+}
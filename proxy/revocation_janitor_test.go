@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/contiv/auth_proxy/common"
+)
+
+// TestRevocationCleanupInterval tests parsing common.RevocationCleanupIntervalKey
+// and jittering the interval
+func TestRevocationCleanupInterval(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", defaultRevocationCleanupInterval},
+		{"abc", defaultRevocationCleanupInterval},
+		{"-1", defaultRevocationCleanupInterval},
+		{"0", 0},
+		{"60", time.Minute},
+	}
+
+	defer common.Global().Set(common.RevocationCleanupIntervalKey, "")
+
+	for _, tc := range testCases {
+		common.Global().Set(common.RevocationCleanupIntervalKey, tc.value)
+
+		if interval := revocationCleanupInterval(); interval != tc.expected {
+			t.Errorf("%q: expected %s, got %s", tc.value, tc.expected, interval)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if wait := jittered(time.Minute); wait < 54*time.Second || wait > 66*time.Second {
+			t.Fatalf("expected a wait within 10%% of a minute, got %s", wait)
+		}
+	}
+}
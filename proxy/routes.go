@@ -0,0 +1,445 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+
+	"github.com/contiv/auth_proxy/auth"
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains the table of all the routes served by the proxy. The
+// mux.Router and the routes listing endpoint are both built from it.
+
+// netmasterCatchAll is the endpoint policy path pattern matching all netmaster endpoints
+const netmasterCatchAll = "/api/v1/**"
+
+// accessLevel describes who is allowed to access a route.
+type accessLevel string
+
+const (
+	// accessPublic routes don't require a token
+	accessPublic accessLevel = "none"
+
+	// accessAuthenticated routes require a valid token
+	accessAuthenticated accessLevel = "authenticated"
+
+	// accessSelfOrAdmin routes require an admin token or the token of the user named in the path
+	accessSelfOrAdmin accessLevel = "self_or_admin"
+
+	// accessAdmin routes require an admin token
+	accessAdmin accessLevel = "admin"
+
+	// accessTenantAdmin routes require an admin or tenant admin token; handlers
+	// limit tenant admins to the tenants they administer
+	accessTenantAdmin accessLevel = "admin_or_tenant_admin"
+
+	// accessIntrospection routes require an admin token or the introspection credential
+	accessIntrospection accessLevel = "admin_or_introspection_client"
+
+	// accessEndpointPolicy routes are proxied to netmaster; the required role
+	// is determined by the endpoint policy rules
+	accessEndpointPolicy accessLevel = "endpoint_policy"
+)
+
+// route describes an endpoint served by the proxy.
+//
+// Fields:
+//  path: mux path template, e.g. /api/v1/auth_proxy/local_users/{username}/
+//  prefix: true if the route matches all paths starting with `path`
+//  methods: allowed HTTP methods; all methods if empty (prefix routes only)
+//  access: who is allowed to access the route; determines the middleware wrapping `handler`
+//  tenantScoped: true if access is further limited to the tenants the user is authorized for
+//  handler: handles the request once access has been granted
+//
+type route struct {
+	path         string
+	prefix       bool
+	methods      []string
+	access       accessLevel
+	tenantScoped bool
+	handler      func(http.ResponseWriter, *http.Request)
+}
+
+// routes returns the table of all the routes served by the proxy, in the
+// order they're matched.
+func routes(s *Server) []route {
+	routesAccess := accessAdmin
+	if s.config.RoutesListingForAllUsers {
+		routesAccess = accessAuthenticated
+	}
+
+	table := []route{
+		{path: VersionPath, methods: []string{"GET"}, access: accessPublic, handler: versionHandler(s.config.Version)},
+		{path: HealthCheckPath, methods: []string{"GET"}, access: accessPublic, handler: healthCheckHandler(s)},
+		{path: LoginPath, methods: []string{"POST"}, access: accessPublic, handler: loginHandler},
+		{path: JWKSPath, methods: []string{"GET"}, access: accessPublic, handler: jwksHandler},
+		{path: RefreshPath, methods: []string{"POST"}, access: accessAuthenticated, handler: refreshHandler},
+		{path: LogoutPath, methods: []string{"POST"}, access: accessAuthenticated, handler: logoutHandler},
+		{path: PasswordPath, methods: []string{"PUT"}, access: accessAuthenticated, handler: changePassword},
+		{path: ReloadPath, methods: []string{"POST"}, access: accessAdmin, handler: reloadSettings},
+		{path: IntrospectionPath, methods: []string{"POST"}, access: accessIntrospection, handler: introspectToken},
+		{path: RoutesPath, methods: []string{"GET"}, access: routesAccess, handler: getRoutes(s)},
+		{path: WhoamiPath, methods: []string{"GET"}, access: accessAuthenticated, handler: whoami},
+		{path: MePath, methods: []string{"GET"}, access: accessAuthenticated, handler: me},
+		{path: TenantStatsPath, methods: []string{"GET"}, access: accessAuthenticated, handler: getTenantStats},
+	}
+
+	table = append(table, userMgmtRoutes()...)
+	table = append(table, authorizationRoutes()...)
+	table = append(table, sessionRoutes()...)
+	table = append(table, accessTokenRoutes()...)
+	table = append(table, mfaRoutes()...)
+	table = append(table, auditRoutes()...)
+	table = append(table, signingKeyRoutes()...)
+	table = append(table, ldapConfigurationMgmtRoutes()...)
+	table = append(table, endpointPolicyRoutes()...)
+	table = append(table, customRoleRoutes()...)
+	table = append(table, netmasterRoutes(s)...)
+
+	//
+	// UI: static files which are served from the root
+	//
+	if !common.IsEmpty(s.config.UIAssetsPath) {
+		table = append(table, route{
+			path:    "/",
+			prefix:  true,
+			methods: []string{"GET", "HEAD"},
+			access:  accessPublic,
+			handler: staticFileServer(http.Dir(s.config.UIAssetsPath)).ServeHTTP,
+		})
+	}
+
+	return table
+}
+
+// netmasterRoutes returns all netmaster routes; they're all proxied to netmaster.
+func netmasterRoutes(s *Server) []route {
+	return []route{
+		{path: "/api/v1/{resource}/", methods: []string{"GET"}, access: accessEndpointPolicy, handler: enforceRBAC(s)},
+		{path: "/api/v1/{resource}/{name}/", methods: []string{"GET", "POST", "PUT", "DELETE"}, access: accessEndpointPolicy, handler: enforceRBAC(s)},
+		{path: "/api/v1/inspect/{resource}/{name}/", methods: []string{"GET"}, access: accessEndpointPolicy, handler: enforceRBAC(s)},
+	}
+}
+
+// userMgmtRoutes returns user management routes.
+// Users can read and update their own account and tenant admins can list
+// users, everything else (including purging any principal, local or not) is
+// admin-only.
+func userMgmtRoutes() []route {
+	return []route{
+		{path: V1Prefix + "/local_users/", methods: []string{"POST"}, access: accessAdmin, handler: addLocalUser},
+		{path: BulkLocalUsersPath, methods: []string{"POST"}, access: accessAdmin, handler: addLocalUsers},
+		{path: V1Prefix + "/local_users/{username}/", methods: []string{"DELETE"}, access: accessAdmin, handler: deleteLocalUser},
+		{path: V1Prefix + "/local_users/{username}/restore/", methods: []string{"POST"}, access: accessAdmin, handler: restoreLocalUser},
+		{path: V1Prefix + "/local_users/{username}/", methods: []string{"PATCH"}, access: accessSelfOrAdmin, handler: updateLocalUser},
+		{path: V1Prefix + "/local_users/{username}/", methods: []string{"GET"}, access: accessSelfOrAdmin, handler: getLocalUser},
+		{path: V1Prefix + "/local_users/", methods: []string{"GET"}, access: accessTenantAdmin, handler: getLocalUsers},
+		{path: V1Prefix + "/principals/{name}/", methods: []string{"DELETE"}, access: accessAdmin, handler: purgePrincipal},
+	}
+}
+
+// authorizationRoutes returns authorization routes.
+// Tenant admins can add, read, list and delete the authorizations of the
+// tenants they administer; changing expiry times and deleting all the
+// authorizations of a principal is admin-only.
+func authorizationRoutes() []route {
+	return []route{
+		{path: V1Prefix + "/authorizations/", methods: []string{"POST"}, access: accessTenantAdmin, handler: addAuthorization},
+		{path: BulkAuthorizationsPath, methods: []string{"POST"}, access: accessTenantAdmin, handler: addAuthorizations},
+		{path: V1Prefix + "/authorizations/{authzUUID}/", methods: []string{"DELETE"}, access: accessTenantAdmin, handler: deleteAuthorization},
+		{path: V1Prefix + "/authorizations/{authzUUID}/", methods: []string{"GET"}, access: accessTenantAdmin, handler: getAuthorization},
+		{path: V1Prefix + "/authorizations/{authzUUID}/", methods: []string{"PATCH"}, access: accessAdmin, handler: updateAuthorization},
+		{path: V1Prefix + "/authorizations/", methods: []string{"GET"}, access: accessTenantAdmin, handler: listAuthorizations},
+		{path: V1Prefix + "/authorizations/", methods: []string{"DELETE"}, access: accessAdmin, handler: deleteAuthorizations},
+	}
+}
+
+// sessionRoutes returns session routes. Admins can list and revoke all the
+// sessions, everyone else only their own. Revoking all the sessions of a user
+// is admin-only.
+func sessionRoutes() []route {
+	return []route{
+		{path: SessionsPath, methods: []string{"GET"}, access: accessAuthenticated, handler: listSessions},
+		{path: SessionsPath, methods: []string{"DELETE"}, access: accessAdmin, handler: revokeUserSessions},
+		{path: SessionsPath + "{id}/", methods: []string{"DELETE"}, access: accessAuthenticated, handler: deleteSession},
+	}
+}
+
+// auditRoutes returns audit trail routes.
+// All audit trail routes are admin-only.
+func auditRoutes() []route {
+	return []route{
+		{path: LoginAuditPath, methods: []string{"GET"}, access: accessAdmin, handler: getLoginAudit},
+	}
+}
+
+// accessTokenRoutes returns personal access token routes. Admins can list and
+// delete all the access tokens, everyone else only their own.
+func accessTokenRoutes() []route {
+	return []route{
+		{path: AccessTokensPath, methods: []string{"POST"}, access: accessAuthenticated, handler: addAccessToken},
+		{path: AccessTokensPath, methods: []string{"GET"}, access: accessAuthenticated, handler: listAccessTokens},
+		{path: AccessTokensPath + "{id}/", methods: []string{"DELETE"}, access: accessAuthenticated, handler: deleteAccessToken},
+	}
+}
+
+// mfaRoutes returns MFA enrollment routes. Local users enroll themselves;
+// admins can only disable MFA, through the local user routes.
+func mfaRoutes() []route {
+	return []route{
+		{path: MFAEnrollPath, methods: []string{"POST"}, access: accessAuthenticated, handler: enrollMFA},
+		{path: MFAConfirmPath, methods: []string{"POST"}, access: accessAuthenticated, handler: confirmMFA},
+	}
+}
+
+// signingKeyRoutes returns token signing key routes.
+// All token signing key routes are admin-only.
+func signingKeyRoutes() []route {
+	return []route{
+		{path: SigningKeysPath, methods: []string{"GET"}, access: accessAdmin, handler: listSigningKeys},
+		{path: SigningKeysPath, methods: []string{"POST"}, access: accessAdmin, handler: rotateSigningKey},
+		{path: SigningKeysPath + "{id}/", methods: []string{"DELETE"}, access: accessAdmin, handler: retireSigningKey},
+	}
+}
+
+// ldapConfigurationMgmtRoutes returns LDAP configuration management routes.
+// All LDAP configuration management routes are admin-only.
+func ldapConfigurationMgmtRoutes() []route {
+	return []route{
+		{path: V1Prefix + "/ldap_configuration/", methods: []string{"PUT"}, access: accessAdmin, handler: addLdapConfiguration},
+		{path: V1Prefix + "/ldap_configuration/", methods: []string{"GET"}, access: accessAdmin, handler: getLdapConfiguration},
+		{path: V1Prefix + "/ldap_configuration/", methods: []string{"DELETE"}, access: accessAdmin, handler: deleteLdapConfiguration},
+		{path: V1Prefix + "/ldap_configuration/", methods: []string{"PATCH"}, access: accessAdmin, handler: updateLdapConfiguration},
+		{path: LdapConfigurationTestPath, methods: []string{"POST"}, access: accessAdmin, handler: testLdapConfiguration},
+		{path: LdapConfigurationReencryptPath, methods: []string{"POST"}, access: accessAdmin, handler: reencryptLdapConfiguration},
+		{path: LdapGroupsPath, methods: []string{"GET"}, access: accessAdmin, handler: searchLdapGroups},
+		{path: DebugPrincipalPath + "{name}", methods: []string{"GET"}, access: accessAdmin, handler: debugPrincipal},
+	}
+}
+
+// endpointPolicyRoutes returns endpoint policy management routes.
+// All endpoint policy management routes are admin-only.
+func endpointPolicyRoutes() []route {
+	return []route{
+		{path: V1Prefix + "/endpoint_policy/dry_run/", methods: []string{"POST"}, access: accessAdmin, handler: endpointPolicyDryRun},
+		{path: V1Prefix + "/endpoint_policy/", methods: []string{"POST"}, access: accessAdmin, handler: addEndpointPolicyRule},
+		{path: V1Prefix + "/endpoint_policy/", methods: []string{"GET"}, access: accessAdmin, handler: getEndpointPolicyRules},
+		{path: V1Prefix + "/endpoint_policy/{ruleID}/", methods: []string{"GET"}, access: accessAdmin, handler: getEndpointPolicyRule},
+		{path: V1Prefix + "/endpoint_policy/{ruleID}/", methods: []string{"PUT"}, access: accessAdmin, handler: updateEndpointPolicyRule},
+		{path: V1Prefix + "/endpoint_policy/{ruleID}/", methods: []string{"DELETE"}, access: accessAdmin, handler: deleteEndpointPolicyRule},
+	}
+}
+
+// customRoleRoutes returns custom role management routes.
+// All custom role management routes are admin-only.
+func customRoleRoutes() []route {
+	return []route{
+		{path: V1Prefix + "/roles/", methods: []string{"POST"}, access: accessAdmin, handler: addCustomRole},
+		{path: V1Prefix + "/roles/", methods: []string{"GET"}, access: accessAdmin, handler: getCustomRoles},
+		{path: V1Prefix + "/roles/{roleName}/", methods: []string{"GET"}, access: accessAdmin, handler: getCustomRole},
+		{path: V1Prefix + "/roles/{roleName}/", methods: []string{"DELETE"}, access: accessAdmin, handler: deleteCustomRole},
+	}
+}
+
+// validateRoutes checks that every route carries the metadata needed to
+// register it and to describe it in the routes listing.
+// params:
+//  table: routes to be validated
+// return values:
+//  error: nil if all the routes are valid, otherwise an error naming the first invalid route
+func validateRoutes(table []route) error {
+	for i, r := range table {
+		if common.IsEmpty(r.path) {
+			return fmt.Errorf("route #%d has no path", i)
+		}
+
+		if len(r.methods) == 0 && !r.prefix {
+			return fmt.Errorf("route %q has no methods", r.path)
+		}
+
+		if r.handler == nil {
+			return fmt.Errorf("route %q has no handler", r.path)
+		}
+
+		switch r.access {
+		case accessPublic, accessAuthenticated, accessSelfOrAdmin, accessAdmin, accessTenantAdmin, accessIntrospection, accessEndpointPolicy:
+		default:
+			return fmt.Errorf("route %q has an invalid access level %q", r.path, r.access)
+		}
+
+		if r.tenantScoped && r.access != accessEndpointPolicy {
+			return fmt.Errorf("route %q is tenant-scoped but tenants are only checked for netmaster routes", r.path)
+		}
+	}
+
+	return nil
+}
+
+// protect wraps the route's handler in the middleware enforcing its access level.
+func (r route) protect() func(http.ResponseWriter, *http.Request) {
+	switch r.access {
+	case accessAuthenticated:
+		return authenticatedOnly(r.handler)
+	case accessSelfOrAdmin:
+		return authorizedUserOnly(r.handler)
+	case accessAdmin:
+		return adminOnly(r.handler)
+	case accessTenantAdmin:
+		return tenantAdminOnly(r.handler)
+	case accessIntrospection:
+		return rateLimited(introspectionLimiter, introspectionRateLimit, introspectionCallerOnly(r.handler))
+	default: // public routes and netmaster routes which enforce the endpoint policy themselves
+		return r.handler
+	}
+}
+
+// management returns true for the proxy's own API, which can be restricted to
+// the management network; see common.ManagementAccessAllowed().
+func (r route) management() bool {
+	return strings.HasPrefix(r.path, V1Prefix+"/")
+}
+
+// addRoutes registers all the routes from the route table with the mux.Router.
+func addRoutes(s *Server, router *mux.Router) {
+	table := routes(s)
+	if err := validateRoutes(table); err != nil {
+		log.Fatalln("Invalid route table:", err)
+	}
+
+	for _, r := range table {
+		var muxRoute *mux.Route
+		if r.prefix {
+			muxRoute = router.PathPrefix(r.path)
+		} else {
+			muxRoute = router.Path(r.path)
+		}
+
+		if len(r.methods) > 0 {
+			muxRoute = muxRoute.Methods(r.methods...)
+		}
+
+		handler := r.protect()
+		if r.management() {
+			handler = managementNetworkOnly(r.path == LoginPath, handler)
+		}
+
+		muxRoute.HandlerFunc(handler)
+	}
+}
+
+// describeRoutes converts the route table into the routes listing. Netmaster
+// routes are described by the endpoint policy rules deciding access to them.
+// params:
+//  table: route table
+//  rules: endpoint policy rules
+// return values:
+//  []RouteInfo: proxy-local routes in the order they're matched, followed by the proxied path prefixes
+func describeRoutes(table []route, rules []*types.EndpointPolicyRule) []RouteInfo {
+	infos := []RouteInfo{}
+	proxiedMethods := []string{}
+	found := map[string]bool{}
+
+	for _, r := range table {
+		if r.access == accessEndpointPolicy {
+			for _, method := range r.methods {
+				if !found[method] {
+					found[method] = true
+					proxiedMethods = append(proxiedMethods, method)
+				}
+			}
+
+			continue
+		}
+
+		path := r.path
+		if r.prefix {
+			path += "**"
+		}
+
+		infos = append(infos, RouteInfo{
+			Path:         path,
+			Methods:      r.methods,
+			Role:         string(r.access),
+			TenantScoped: r.tenantScoped,
+		})
+	}
+
+	sort.Strings(proxiedMethods)
+
+	sorted := make([]*types.EndpointPolicyRule, len(rules))
+	copy(sorted, rules)
+	sort.Sort(byPath(sorted))
+
+	hasCatchAll := false
+	for _, rule := range sorted {
+		methods := rule.Methods
+		if len(methods) == 0 {
+			methods = proxiedMethods
+		}
+
+		hasCatchAll = hasCatchAll || rule.Path == netmasterCatchAll
+
+		infos = append(infos, RouteInfo{
+			Path:         rule.Path,
+			Methods:      methods,
+			Role:         rule.Role,
+			TenantScoped: rule.Role != types.Admin.String() && rule.Scope == types.ScopeTenant,
+			Proxied:      true,
+		})
+	}
+
+	// endpoints which aren't matched by any rule require the default role
+	if !hasCatchAll {
+		infos = append(infos, RouteInfo{
+			Path:    netmasterCatchAll,
+			Methods: proxiedMethods,
+			Role:    auth.DefaultEndpointRole().String(),
+			Proxied: true,
+		})
+	}
+
+	return infos
+}
+
+// byPath sorts endpoint policy rules by path, then by ID
+type byPath []*types.EndpointPolicyRule
+
+func (p byPath) Len() int      { return len(p) }
+func (p byPath) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byPath) Less(i, j int) bool {
+	if p[i].Path != p[j].Path {
+		return p[i].Path < p[j].Path
+	}
+
+	return p[i].ID < p[j].ID
+}
+
+// getRoutesHelper helper function for `getRoutes`.
+// params:
+//  s: server whose routes are listed
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON response based on the execution flow
+func getRoutesHelper(s *Server) (int, []byte) {
+	rules, err := db.ListEndpointPolicyRules()
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	jsonData, err := json.Marshal(describeRoutes(routes(s), rules))
+	if err != nil {
+		return datastoreStatusCode(err), []byte(err.Error())
+	}
+
+	return http.StatusOK, jsonData
+}
@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// newTestServer returns a server which is never started; enough to build the route table
+func newTestServer(routesForAll bool) *Server {
+	return &Server{config: &Config{
+		Version:                  "test",
+		UIAssetsPath:             "/ui",
+		RoutesListingForAllUsers: routesForAll,
+	}}
+}
+
+// findRoute returns the route in the table handling the given path and method
+func findRoute(table []route, path, method string) *route {
+	for i, r := range table {
+		if r.path != path {
+			continue
+		}
+
+		for _, m := range r.methods {
+			if m == method {
+				return &table[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// TestRouteTable tests that the well-known routes are in the route table with the right metadata
+func TestRouteTable(t *testing.T) {
+	table := routes(newTestServer(false))
+
+	if err := validateRoutes(table); err != nil {
+		t.Fatalf("invalid route table: %s", err)
+	}
+
+	testCases := []struct {
+		path   string
+		method string
+		access accessLevel
+	}{
+		{LoginPath, "POST", accessPublic},
+		{JWKSPath, "GET", accessPublic},
+		{RefreshPath, "POST", accessAuthenticated},
+		{LogoutPath, "POST", accessAuthenticated},
+		{PasswordPath, "PUT", accessAuthenticated},
+		{SessionsPath, "GET", accessAuthenticated},
+		{SessionsPath, "DELETE", accessAdmin},
+		{SessionsPath + "{id}/", "DELETE", accessAuthenticated},
+		{AccessTokensPath, "POST", accessAuthenticated},
+		{AccessTokensPath, "GET", accessAuthenticated},
+		{AccessTokensPath + "{id}/", "DELETE", accessAuthenticated},
+		{MFAEnrollPath, "POST", accessAuthenticated},
+		{MFAConfirmPath, "POST", accessAuthenticated},
+		{LoginAuditPath, "GET", accessAdmin},
+		{SigningKeysPath, "GET", accessAdmin},
+		{SigningKeysPath, "POST", accessAdmin},
+		{SigningKeysPath + "{id}/", "DELETE", accessAdmin},
+		{LdapConfigurationTestPath, "POST", accessAdmin},
+		{LdapConfigurationReencryptPath, "POST", accessAdmin},
+		{LdapGroupsPath, "GET", accessAdmin},
+		{DebugPrincipalPath + "{name}", "GET", accessAdmin},
+		{RoutesPath, "GET", accessAdmin},
+		{WhoamiPath, "GET", accessAuthenticated},
+		{TenantStatsPath, "GET", accessAuthenticated},
+		{V1Prefix + "/local_users/", "GET", accessTenantAdmin},
+		{V1Prefix + "/local_users/", "POST", accessAdmin},
+		{V1Prefix + "/principals/{name}/", "DELETE", accessAdmin},
+		{V1Prefix + "/local_users/{username}/", "GET", accessSelfOrAdmin},
+		{V1Prefix + "/local_users/{username}/", "PATCH", accessSelfOrAdmin},
+		{V1Prefix + "/local_users/{username}/", "DELETE", accessAdmin},
+		{V1Prefix + "/local_users/{username}/restore/", "POST", accessAdmin},
+		{V1Prefix + "/authorizations/", "GET", accessTenantAdmin},
+		{V1Prefix + "/authorizations/", "POST", accessTenantAdmin},
+		{V1Prefix + "/authorizations/", "DELETE", accessAdmin},
+		{BulkAuthorizationsPath, "POST", accessTenantAdmin},
+		{BulkLocalUsersPath, "POST", accessAdmin},
+		{V1Prefix + "/authorizations/{authzUUID}/", "GET", accessTenantAdmin},
+		{V1Prefix + "/authorizations/{authzUUID}/", "DELETE", accessTenantAdmin},
+		{V1Prefix + "/authorizations/{authzUUID}/", "PATCH", accessAdmin},
+		{"/api/v1/{resource}/{name}/", "POST", accessEndpointPolicy},
+	}
+
+	for _, tc := range testCases {
+		r := findRoute(table, tc.path, tc.method)
+		if r == nil {
+			t.Errorf("%s %s is missing from the route table", tc.method, tc.path)
+			continue
+		}
+
+		if r.access != tc.access {
+			t.Errorf("%s %s: expected access %q, got %q", tc.method, tc.path, tc.access, r.access)
+		}
+
+		if r.tenantScoped {
+			t.Errorf("%s %s: unexpectedly tenant-scoped", tc.method, tc.path)
+		}
+	}
+
+	// the flag opens the listing to all users
+	if r := findRoute(routes(newTestServer(true)), RoutesPath, "GET"); r == nil || r.access != accessAuthenticated {
+		t.Errorf("expected the routes listing to be open to all authenticated users, got %#v", r)
+	}
+}
+
+// TestRouteTableMatchesRouter tests that the mux.Router is built from the route table
+// and nothing else, i.e. that every registered route shows up in the routes listing.
+func TestRouteTableMatchesRouter(t *testing.T) {
+	s := newTestServer(false)
+	table := routes(s)
+
+	router := mux.NewRouter()
+	addRoutes(s, router)
+
+	i := 0
+	err := router.Walk(func(muxRoute *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := muxRoute.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+
+		if i >= len(table) {
+			t.Errorf("route %q was registered without being in the route table", template)
+		} else if template != table[i].path {
+			t.Errorf("route #%d: expected %q, got %q", i, table[i].path, template)
+		}
+
+		i++
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("failed to walk the routes: %s", err)
+	}
+
+	if i != len(table) {
+		t.Errorf("expected %d routes to be registered, got %d", len(table), i)
+	}
+}
+
+// TestValidateRoutes tests that routes without metadata are rejected
+func TestValidateRoutes(t *testing.T) {
+	handler := func(http.ResponseWriter, *http.Request) {}
+
+	for _, invalid := range []route{
+		{path: "/x/", methods: []string{"GET"}, handler: handler},
+		{path: "/x/", methods: []string{"GET"}, access: "root", handler: handler},
+		{path: "/x/", access: accessAdmin, handler: handler},
+		{path: "/x/", methods: []string{"GET"}, access: accessAdmin},
+		{methods: []string{"GET"}, access: accessAdmin, handler: handler},
+		{path: "/x/", methods: []string{"GET"}, access: accessAdmin, tenantScoped: true, handler: handler},
+	} {
+		if err := validateRoutes([]route{invalid}); err == nil {
+			t.Errorf("expected an error for %#v", invalid)
+		}
+	}
+}
+
+// TestDescribeRoutes tests the routes listing
+func TestDescribeRoutes(t *testing.T) {
+	table := routes(newTestServer(false))
+	rules := []*types.EndpointPolicyRule{
+		{ID: "b", Path: "/api/v1/networks/**", Role: "ops", Scope: types.ScopeTenant},
+		{ID: "a", Path: "/api/v1/aciGws/**", Methods: []string{"GET"}, Role: "admin", Scope: types.ScopeGlobal},
+	}
+
+	infos := describeRoutes(table, rules)
+
+	expected := RouteInfo{Path: LoginPath, Methods: []string{"POST"}, Role: "none"}
+	if !reflect.DeepEqual(infos[2], expected) {
+		t.Errorf("expected %#v, got %#v", expected, infos[2])
+	}
+
+	proxied := []RouteInfo{}
+	for _, info := range infos {
+		if info.Proxied {
+			proxied = append(proxied, info)
+		} else if info.Path == "/api/v1/{resource}/{name}/" {
+			t.Errorf("netmaster route %q should be described by the endpoint policy", info.Path)
+		}
+	}
+
+	all := []string{"DELETE", "GET", "POST", "PUT"}
+	expectedProxied := []RouteInfo{
+		{Path: "/api/v1/aciGws/**", Methods: []string{"GET"}, Role: "admin", Proxied: true},
+		{Path: "/api/v1/networks/**", Methods: all, Role: "ops", TenantScoped: true, Proxied: true},
+		{Path: netmasterCatchAll, Methods: all, Role: "admin", Proxied: true},
+	}
+
+	if !reflect.DeepEqual(proxied, expectedProxied) {
+		t.Errorf("expected proxied routes %#v, got %#v", expectedProxied, proxied)
+	}
+}
+
+// TestManagementNetworkOnly tests that the management allow/deny lists are
+// enforced on the proxy's own API only
+func TestManagementNetworkOnly(t *testing.T) {
+	for _, r := range routes(newTestServer(false)) {
+		expected := strings.HasPrefix(r.path, V1Prefix)
+		if r.management() != expected {
+			t.Errorf("%s: expected management to be %t", r.path, expected)
+		}
+	}
+
+	defer common.Global().Set(common.ManagementAllowedCIDRsKey, "")
+	defer common.Global().Set(common.ManagementRestrictLoginKey, "")
+
+	common.Global().Set(common.ManagementAllowedCIDRsKey, "10.0.0.0/8, fd00::/8")
+
+	router := mux.NewRouter()
+	addRoutes(newTestServer(false), router)
+
+	ok := func(w http.ResponseWriter, req *http.Request) { w.Write([]byte("ok")) }
+
+	testCases := []struct {
+		description   string
+		handler       http.Handler
+		remoteAddr    string
+		restrictLogin string
+		status        int
+	}{
+		{"allowed client", router, "10.1.2.3:1234", "", 200},
+		{"allowed IPv6 client", router, "[fd00::1]:1234", "", 200},
+		{"denied client", router, "1.2.3.4:1234", "", 403},
+		{"denied IPv6 client", router, "[2001:db8::1]:1234", "", 403},
+		{"login is exempted", http.HandlerFunc(managementNetworkOnly(true, ok)), "1.2.3.4:1234", "", 200},
+		{"login is restricted", http.HandlerFunc(managementNetworkOnly(true, ok)), "1.2.3.4:1234", "true", 403},
+		{"restricted login from an allowed client", http.HandlerFunc(managementNetworkOnly(true, ok)), "10.1.2.3:1234", "true", 200},
+	}
+
+	for _, tc := range testCases {
+		common.Global().Set(common.ManagementRestrictLoginKey, tc.restrictLogin)
+
+		req := httptest.NewRequest("GET", "https://localhost"+VersionPath, nil)
+		req.RemoteAddr = tc.remoteAddr
+
+		w := httptest.NewRecorder()
+		tc.handler.ServeHTTP(w, req)
+
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.description, tc.status, w.Code)
+		}
+
+		// the error doesn't reveal anything about the management network
+		if expected := `{"code":"forbidden","message":"Forbidden"}`; tc.status == 403 && w.Body.String() != expected {
+			t.Errorf("%s: expected %q, got %q", tc.description, expected, w.Body.String())
+		}
+	}
+}
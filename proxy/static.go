@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains the handler which serves the UI and its assets.
+
+const (
+	// uiIndex is served for / and for client-side routes of the UI
+	uiIndex = "/index.html"
+
+	// apiPrefix is never served by the static file handler; unknown API endpoints are 404s
+	apiPrefix = "/api"
+
+	// indexCacheControl makes browsers revalidate index.html on every load so that
+	// new UI releases are picked up right away
+	indexCacheControl = "no-cache"
+
+	// assetCacheControl lets browsers cache assets for a while; they're
+	// revalidated using their ETag afterwards
+	assetCacheControl = "public, max-age=3600"
+)
+
+var errIsDirectory = errors.New("is a directory")
+
+//
+// staticFileServer returns a staticFileHandler which serves the UI and its assets.
+// this is necessary so that we can set response headers.
+//
+func staticFileServer(root http.FileSystem) http.Handler {
+	return &staticFileHandler{root: root}
+}
+
+// staticFileHandler serves files from `root`. Requests for paths which don't
+// exist and don't look like a file (i.e., have no extension) are client-side
+// routes of the UI and get index.html. Directory listings are never served.
+type staticFileHandler struct {
+	root http.FileSystem
+}
+
+func (sfh *staticFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	common.EnableHSTS(w)
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, types.ErrorCodeMethodNotAllowed, "Only GET and HEAD are allowed", nil)
+		return
+	}
+
+	// path.Clean() on a rooted path removes all `..` elements, so the
+	// resulting path can't point outside of `root`
+	name := path.Clean("/" + r.URL.Path)
+
+	// the API is handled by other routes; don't shadow missing endpoints with the UI
+	if name == apiPrefix || strings.HasPrefix(name, apiPrefix+"/") {
+		notFound(w, r)
+		return
+	}
+
+	if name == "/" {
+		name = uiIndex
+	}
+
+	f, stat, err := sfh.open(name)
+	if os.IsNotExist(err) && path.Ext(name) == "" {
+		name = uiIndex
+		f, stat, err = sfh.open(name)
+	}
+
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	if name == uiIndex {
+		w.Header().Set("Cache-Control", indexCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", assetCacheControl)
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size()))
+
+	// handles If-None-Match, If-Modified-Since, Range and Content-Type
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
+}
+
+// open opens the given file for reading. Opening a directory fails so that
+// directory contents are never listed.
+func (sfh *staticFileHandler) open(name string) (http.File, os.FileInfo, error) {
+	f, err := sfh.root.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	if stat.IsDir() {
+		f.Close()
+		return nil, nil, errIsDirectory
+	}
+
+	return f, stat, nil
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// newUIDirectory creates a UI directory inside a parent directory which also
+// holds a file that must never be served.
+// return values:
+//  string: path of the UI directory
+//  func(): removes everything again
+func newUIDirectory(t *testing.T) (string, func()) {
+	parent, err := ioutil.TempDir("", "auth_proxy_ui")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+
+	ui := filepath.Join(parent, "ui")
+
+	files := map[string]string{
+		filepath.Join(parent, "local.key"):          "secret key",
+		filepath.Join(ui, "index.html"):             "<html>index</html>",
+		filepath.Join(ui, "app.js"):                 "console.log('app');",
+		filepath.Join(ui, "assets", "logo.svg"):     "<svg></svg>",
+		filepath.Join(ui, "assets", "fonts", "a.f"): "font",
+	}
+
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatalf("failed to create directory for %q: %s", name, err)
+		}
+
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %q: %s", name, err)
+		}
+	}
+
+	return ui, func() { os.RemoveAll(parent) }
+}
+
+// serveStatic sends a request for the given (raw) path to a static file handler
+func serveStatic(handler http.Handler, method, rawPath string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "https://localhost"+rawPath, nil)
+
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	return w
+}
+
+// TestStaticFileServer tests asset serving, cache headers and the SPA fallback
+func TestStaticFileServer(t *testing.T) {
+	ui, cleanup := newUIDirectory(t)
+	defer cleanup()
+
+	handler := staticFileServer(http.Dir(ui))
+
+	testCases := []struct {
+		path         string
+		status       int
+		body         string
+		cacheControl string
+	}{
+		{"/", 200, "<html>index</html>", indexCacheControl},
+		{"/index.html", 200, "<html>index</html>", indexCacheControl},
+		{"/app.js", 200, "console.log('app');", assetCacheControl},
+		{"/assets/logo.svg", 200, "<svg></svg>", assetCacheControl},
+
+		// client-side routes of the UI
+		{"/networks", 200, "<html>index</html>", indexCacheControl},
+		{"/networks/n1/details", 200, "<html>index</html>", indexCacheControl},
+
+		// missing assets
+		{"/missing.js", 404, "", ""},
+		{"/assets/missing.png", 404, "", ""},
+
+		// no directory listings
+		{"/assets", 404, "", ""},
+		{"/assets/", 404, "", ""},
+		{"/assets/fonts/", 404, "", ""},
+
+		// API paths never fall through to the UI
+		{"/api", 404, "", ""},
+		{"/api/v1/networks", 404, "", ""},
+		{"/api/v1/auth_proxy/unknown/", 404, "", ""},
+		{"/api/v1/inspect/networks/n1/x/", 404, "", ""},
+	}
+
+	for _, tc := range testCases {
+		w := serveStatic(handler, "GET", tc.path, nil)
+
+		if w.Code != tc.status {
+			t.Errorf("GET %s: expected status %d, got %d", tc.path, tc.status, w.Code)
+			continue
+		}
+
+		// missing files get the same error response as missing endpoints
+		if tc.status == 404 {
+			errResp := types.ErrorResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &errResp); err != nil || errResp.Code != types.ErrorCodeNotFound {
+				t.Errorf("GET %s: expected a %q error response, got %q", tc.path, types.ErrorCodeNotFound, w.Body.String())
+			}
+		}
+
+		if tc.status != 200 {
+			continue
+		}
+
+		if w.Body.String() != tc.body {
+			t.Errorf("GET %s: expected body %q, got %q", tc.path, tc.body, w.Body.String())
+		}
+
+		if cc := w.Header().Get("Cache-Control"); cc != tc.cacheControl {
+			t.Errorf("GET %s: expected Cache-Control %q, got %q", tc.path, tc.cacheControl, cc)
+		}
+
+		if w.Header().Get("Strict-Transport-Security") == "" {
+			t.Errorf("GET %s: HSTS header is missing", tc.path)
+		}
+	}
+
+	// only GET and HEAD are allowed
+	if w := serveStatic(handler, "POST", "/app.js", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+// TestStaticFileServerETag tests conditional requests
+func TestStaticFileServerETag(t *testing.T) {
+	ui, cleanup := newUIDirectory(t)
+	defer cleanup()
+
+	handler := staticFileServer(http.Dir(ui))
+
+	w := serveStatic(handler, "GET", "/app.js", nil)
+
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("ETag header is missing")
+	}
+
+	w = serveStatic(handler, "GET", "/app.js", map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected status %d for matching ETag, got %d", http.StatusNotModified, w.Code)
+	}
+
+	w = serveStatic(handler, "GET", "/app.js", map[string]string{"If-None-Match": `"stale"`})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d for stale ETag, got %d", http.StatusOK, w.Code)
+	}
+
+	// different files have different ETags
+	if other := serveStatic(handler, "GET", "/assets/logo.svg", nil).Header().Get("ETag"); other == etag {
+		t.Errorf("expected different ETags, got %q for both", etag)
+	}
+}
+
+// TestStaticFileServerTraversal tests that files outside of the UI directory can't be read
+func TestStaticFileServerTraversal(t *testing.T) {
+	ui, cleanup := newUIDirectory(t)
+	defer cleanup()
+
+	handler := staticFileServer(http.Dir(ui))
+
+	for _, path := range []string{
+		"/../local.key",
+		"/assets/../../local.key",
+		"/%2e%2e/local.key",
+		"/..%2flocal.key",
+		"/%2e%2e%2flocal.key",
+		"/assets/..%2f..%2flocal.key",
+		"/..\\local.key",
+		"/./../local.key",
+	} {
+		w := serveStatic(handler, "GET", path, nil)
+
+		if strings.Contains(w.Body.String(), "secret key") {
+			t.Errorf("GET %s: served a file outside of the UI directory", path)
+		}
+
+		if w.Code == 200 && w.Body.String() != "<html>index</html>" {
+			t.Errorf("GET %s: unexpected response %d %q", path, w.Code, w.Body.String())
+		}
+	}
+}
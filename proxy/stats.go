@@ -0,0 +1,376 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains the per-tenant usage statistics which are accumulated
+// from the requests proxied to netmaster (see rbacUsingTenant()). Counting a
+// request only takes a few atomic increments; the counters are added to the
+// totals in the data store in the background.
+//
+// Unlike the sweepers, the flush isn't leader-gated on purpose: every instance
+// counts the requests it proxied, so every instance persists its own counters,
+// into a key which only it writes (see db.AddTenantStats()).
+//
+// The tenant of a request comes from its path, so it may not exist. Requests
+// are only counted once netmaster answered them with something other than a
+// 404, and denials are only kept for tenants which are known (see
+// knownTenants()). Counters are dropped from memory once they're persisted,
+// and at most maxPendingTenants tenants are counted between two flushes.
+
+// tenantStatsFlushInterval is how often the counters are persisted
+const tenantStatsFlushInterval = 30 * time.Second
+
+// maxPendingTenants is how many tenants are counted between two flushes;
+// requests on further tenants aren't counted
+const maxPendingTenants = 10000
+
+// tenantCounters are the counters of a tenant since the last flush; they're
+// only accessed using sync/atomic
+type tenantCounters struct {
+	requests uint64
+	writes   uint64
+	denials  uint64
+	bytes    uint64
+}
+
+// zero returns true if nothing was counted
+func (t *tenantCounters) zero() bool {
+	return atomic.LoadUint64(&t.requests) == 0 && atomic.LoadUint64(&t.denials) == 0
+}
+
+// tenantStatsCollector accumulates tenantCounters and flushes them to a store
+type tenantStatsCollector struct {
+	mutex      sync.RWMutex               // guards the `pending` map; held for reading while counting
+	pending    map[string]*tenantCounters // by tenant name
+	maxPending int                        // number of tenants in `pending`
+	dropped    uint64                     // requests and denials not counted since `pending` was full
+
+	flushMutex sync.Mutex // serializes flush() and snapshot()
+
+	// the persisted totals and the known tenants; replaced by tests
+	list  func() ([]*types.TenantStats, error)
+	add   func([]*types.TenantStats) error
+	known func() (map[string]bool, error)
+}
+
+// tenantStats collects the statistics of all the tenants
+var tenantStats = newTenantStatsCollector(db.ListTenantStats, addInstanceTenantStats, knownTenants)
+
+// newTenantStatsCollector returns a collector persisting its counters using the given functions.
+// params:
+//  list: returns the persisted totals of all tenants
+//  add: adds counters to the persisted totals of the tenants
+//  known: returns the names of the tenants which denials are kept for
+// return values:
+//  *tenantStatsCollector: collector without any counters
+func newTenantStatsCollector(list func() ([]*types.TenantStats, error),
+	add func([]*types.TenantStats) error, known func() (map[string]bool, error)) *tenantStatsCollector {
+
+	return &tenantStatsCollector{
+		pending:    map[string]*tenantCounters{},
+		maxPending: maxPendingTenants,
+		list:       list,
+		add:        add,
+		known:      known,
+	}
+}
+
+// addInstanceTenantStats adds counters to the persisted totals of this instance
+func addInstanceTenantStats(deltas []*types.TenantStats) error {
+	instance, err := common.Global().Get(common.InstanceIDKey)
+	if err != nil || instance == "" {
+		instance = fmt.Sprintf("auth_proxy-%d", os.Getpid())
+	}
+
+	return db.AddTenantStats(instance, deltas)
+}
+
+// knownTenants returns the tenants which exist as far as the proxy can tell:
+// those with authorizations, and those netmaster answered requests on.
+// return values:
+//  map[string]bool: set of tenant names
+//  error: as returned by db.ListAuthorizations() and db.ListTenantStats()
+func knownTenants() (map[string]bool, error) {
+	authzs, err := db.ListAuthorizations()
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, authz := range authzs {
+		if strings.HasPrefix(authz.ClaimKey, types.TenantClaimKey) {
+			known[strings.TrimPrefix(authz.ClaimKey, types.TenantClaimKey)] = true
+		}
+	}
+
+	stats, err := db.ListTenantStats()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range stats {
+		if s.Requests > 0 {
+			known[s.Tenant] = true
+		}
+	}
+
+	return known, nil
+}
+
+// count calls `f` with the counters of a tenant, creating them if needed. The
+// counters are only removed while holding the write lock (see flush()), so
+// `f` is called while holding the read lock.
+func (c *tenantStatsCollector) count(tenant string, f func(*tenantCounters)) {
+	c.mutex.RLock()
+	counters, found := c.pending[tenant]
+	if found {
+		f(counters)
+	}
+	c.mutex.RUnlock()
+
+	if found {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if counters, found = c.pending[tenant]; !found {
+		if len(c.pending) >= c.maxPending {
+			atomic.AddUint64(&c.dropped, 1)
+			return
+		}
+
+		counters = &tenantCounters{}
+		c.pending[tenant] = counters
+	}
+
+	f(counters)
+}
+
+// counters returns the counters of a tenant; nil if there are none. They're
+// only removed by flush(), so they can be used until the next flush.
+func (c *tenantStatsCollector) counters(tenant string) *tenantCounters {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.pending[tenant]
+}
+
+// recordRequest counts a request proxied to netmaster on behalf of a tenant.
+// params:
+//  tenant: name of the tenant
+//  method: HTTP method of the request; everything but GET counts as a write
+//  bytes: size of the request and response bodies
+func (c *tenantStatsCollector) recordRequest(tenant, method string, bytes uint64) {
+	c.count(tenant, func(counters *tenantCounters) {
+		atomic.AddUint64(&counters.requests, 1)
+		if method != "GET" {
+			atomic.AddUint64(&counters.writes, 1)
+		}
+		atomic.AddUint64(&counters.bytes, bytes)
+	})
+}
+
+// recordDenial counts a request which was denied access to a tenant; it's
+// dropped when flushing unless the tenant is known
+func (c *tenantStatsCollector) recordDenial(tenant string) {
+	c.count(tenant, func(counters *tenantCounters) {
+		atomic.AddUint64(&counters.denials, 1)
+	})
+}
+
+// tenants returns the names of all the tenants with counters
+func (c *tenantStatsCollector) tenants() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	tenants := make([]string, 0, len(c.pending))
+	for tenant := range c.pending {
+		tenants = append(tenants, tenant)
+	}
+
+	return tenants
+}
+
+// flush adds the counters to the persisted totals and resets them; denials of
+// tenants which aren't known are dropped. Counters which couldn't be persisted
+// are kept for the next flush, the others are removed from memory.
+// return values:
+//  error: as returned by `known` or `add`, if any
+func (c *tenantStatsCollector) flush() error {
+	c.flushMutex.Lock()
+	defer c.flushMutex.Unlock()
+
+	if dropped := atomic.SwapUint64(&c.dropped, 0); dropped > 0 {
+		log.Warnf("Didn't count %d requests and denials in the tenant statistics since more than %d tenants were counted", dropped, c.maxPending)
+	}
+
+	deltas := []*types.TenantStats{}
+	for _, tenant := range c.tenants() {
+		counters := c.counters(tenant)
+
+		delta := &types.TenantStats{
+			Tenant:   tenant,
+			Requests: atomic.SwapUint64(&counters.requests, 0),
+			Writes:   atomic.SwapUint64(&counters.writes, 0),
+			Denials:  atomic.SwapUint64(&counters.denials, 0),
+			Bytes:    atomic.SwapUint64(&counters.bytes, 0),
+		}
+
+		if delta.Requests != 0 || delta.Denials != 0 {
+			deltas = append(deltas, delta)
+		}
+	}
+
+	err := c.persist(deltas)
+	if err != nil {
+		for _, delta := range deltas {
+			counters := c.counters(delta.Tenant)
+
+			atomic.AddUint64(&counters.requests, delta.Requests)
+			atomic.AddUint64(&counters.writes, delta.Writes)
+			atomic.AddUint64(&counters.denials, delta.Denials)
+			atomic.AddUint64(&counters.bytes, delta.Bytes)
+		}
+	}
+
+	// counters which were reset and not counted on since are removed
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for tenant, counters := range c.pending {
+		if counters.zero() {
+			delete(c.pending, tenant)
+		}
+	}
+
+	return err
+}
+
+// persist adds counters to the persisted totals; the denials of tenants without
+// requests are only kept if the tenant is known.
+func (c *tenantStatsCollector) persist(deltas []*types.TenantStats) error {
+	var known map[string]bool
+
+	kept := []*types.TenantStats{}
+	for _, delta := range deltas {
+		if delta.Requests == 0 {
+			if known == nil {
+				var err error
+				if known, err = c.known(); err != nil {
+					return err
+				}
+			}
+
+			if !known[delta.Tenant] {
+				log.Debugf("Dropping %d denials of unknown tenant %q", delta.Denials, delta.Tenant)
+				continue
+			}
+		}
+
+		kept = append(kept, delta)
+	}
+
+	if len(kept) == 0 {
+		return nil
+	}
+
+	return c.add(kept)
+}
+
+// run flushes the counters every `interval` until `done` is closed, and once more after that.
+func (c *tenantStatsCollector) run(interval time.Duration, done chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.flush(); err != nil {
+				log.Warnf("Failed to persist tenant statistics: %s", err.Error())
+			}
+		case <-done:
+			if err := c.flush(); err != nil {
+				log.Warnf("Failed to persist tenant statistics: %s", err.Error())
+			}
+			return
+		}
+	}
+}
+
+// snapshot returns the persisted totals plus the counters which weren't flushed
+// yet, except for the denials which flush() would drop.
+// return values:
+//  []types.TenantStats: statistics of all tenants, sorted by tenant name
+//  error: as returned by `list` and `known`
+func (c *tenantStatsCollector) snapshot() ([]types.TenantStats, error) {
+	c.flushMutex.Lock()
+	defer c.flushMutex.Unlock()
+
+	persisted, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := map[string]*types.TenantStats{}
+	for _, s := range persisted {
+		stats[s.Tenant] = s
+	}
+
+	var known map[string]bool
+
+	for _, tenant := range c.tenants() {
+		counters := c.counters(tenant)
+
+		s, found := stats[tenant]
+		if !found {
+			if atomic.LoadUint64(&counters.requests) == 0 {
+				if known == nil {
+					if known, err = c.known(); err != nil {
+						return nil, err
+					}
+				}
+
+				if !known[tenant] {
+					continue
+				}
+			}
+
+			s = &types.TenantStats{Tenant: tenant}
+			stats[tenant] = s
+		}
+
+		s.Requests += atomic.LoadUint64(&counters.requests)
+		s.Writes += atomic.LoadUint64(&counters.writes)
+		s.Denials += atomic.LoadUint64(&counters.denials)
+		s.Bytes += atomic.LoadUint64(&counters.bytes)
+	}
+
+	tenants := make([]string, 0, len(stats))
+	for tenant := range stats {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	result := make([]types.TenantStats, 0, len(tenants))
+	for _, tenant := range tenants {
+		result = append(result, *stats[tenant])
+	}
+
+	return result, nil
+}
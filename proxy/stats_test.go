@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// memoryTenantStats is an in-memory replacement of the tenant statistics in the data store
+type memoryTenantStats struct {
+	mutex sync.Mutex
+	stats map[string]types.TenantStats
+	err   error // returned by all calls if set
+}
+
+func (m *memoryTenantStats) list() ([]*types.TenantStats, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	stats := []*types.TenantStats{}
+	for _, s := range m.stats {
+		s := s
+		stats = append(stats, &s)
+	}
+
+	return stats, nil
+}
+
+func (m *memoryTenantStats) add(deltas []*types.TenantStats) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	for _, delta := range deltas {
+		s := m.stats[delta.Tenant]
+		s.Tenant = delta.Tenant
+		s.Requests += delta.Requests
+		s.Writes += delta.Writes
+		s.Denials += delta.Denials
+		s.Bytes += delta.Bytes
+		m.stats[delta.Tenant] = s
+	}
+
+	return nil
+}
+
+// known returns the tenants with statistics, plus "t1" and "t2"
+func (m *memoryTenantStats) known() (map[string]bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	known := map[string]bool{"t1": true, "t2": true}
+	for tenant := range m.stats {
+		known[tenant] = true
+	}
+
+	return known, nil
+}
+
+// checkSnapshot compares the collector's snapshot with the expected statistics
+func checkSnapshot(t *testing.T, collector *tenantStatsCollector, expected []types.TenantStats) {
+	stats, err := collector.snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("expected %#v, got %#v", expected, stats)
+	}
+}
+
+// TestTenantStatsCollector tests counting, flushing and reloading tenant statistics
+func TestTenantStatsCollector(t *testing.T) {
+	store := &memoryTenantStats{stats: map[string]types.TenantStats{}}
+	collector := newTenantStatsCollector(store.list, store.add, store.known)
+
+	collector.recordRequest("t1", "GET", 100)
+	collector.recordRequest("t1", "POST", 50)
+	collector.recordDenial("t1")
+	collector.recordRequest("t2", "DELETE", 0)
+
+	expected := []types.TenantStats{
+		{Tenant: "t1", Requests: 2, Writes: 1, Denials: 1, Bytes: 150},
+		{Tenant: "t2", Requests: 1, Writes: 1},
+	}
+
+	// unflushed counters are included
+	checkSnapshot(t, collector, expected)
+
+	if err := collector.flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	checkSnapshot(t, collector, expected)
+
+	// counters which can't be persisted are kept for the next flush
+	collector.recordRequest("t2", "GET", 10)
+
+	store.err = errors.New("datastore unavailable")
+	if err := collector.flush(); err == nil {
+		t.Error("expected the flush to fail")
+	}
+
+	if _, err := collector.snapshot(); err == nil {
+		t.Error("expected the snapshot to fail")
+	}
+
+	store.err = nil
+	if err := collector.flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected[1] = types.TenantStats{Tenant: "t2", Requests: 2, Writes: 1, Bytes: 10}
+	checkSnapshot(t, collector, expected)
+
+	// a new collector (i.e. after a restart) starts from the persisted totals
+	restarted := newTenantStatsCollector(store.list, store.add, store.known)
+	checkSnapshot(t, restarted, expected)
+
+	restarted.recordRequest("t1", "GET", 1)
+	expected[0].Requests++
+	expected[0].Bytes++
+	checkSnapshot(t, restarted, expected)
+}
+
+// TestTenantStatsConcurrency counts requests while flushing; run with -race
+func TestTenantStatsConcurrency(t *testing.T) {
+	store := &memoryTenantStats{stats: map[string]types.TenantStats{}}
+	collector := newTenantStatsCollector(store.list, store.add, store.known)
+
+	done := make(chan bool)
+	flushed := make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				close(flushed)
+				return
+			default:
+				collector.flush()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, tenant := range []string{"t1", "t2", "t3", "t4"} {
+		wg.Add(1)
+		go func(tenant string) {
+			defer wg.Done()
+
+			for i := 0; i < 1000; i++ {
+				collector.recordRequest(tenant, "PUT", 2)
+			}
+		}(tenant)
+	}
+
+	wg.Wait()
+	close(done)
+	<-flushed
+
+	if err := collector.flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, s := range store.stats {
+		if s.Requests != 1000 || s.Writes != 1000 || s.Bytes != 2000 {
+			t.Errorf("expected 1000 requests of 2 bytes, got %#v", s)
+		}
+	}
+
+	if len(store.stats) != 4 {
+		t.Errorf("expected 4 tenants, got %d", len(store.stats))
+	}
+}
+
+// TestTenantStatsUnknownTenants tests that denials of unknown tenants are dropped
+func TestTenantStatsUnknownTenants(t *testing.T) {
+	store := &memoryTenantStats{stats: map[string]types.TenantStats{}}
+	collector := newTenantStatsCollector(store.list, store.add, store.known)
+
+	collector.recordDenial("t1")
+	collector.recordDenial("nonexistent")
+	collector.recordRequest("t3", "GET", 10) // netmaster found it
+	collector.recordDenial("t3")
+
+	expected := []types.TenantStats{
+		{Tenant: "t1", Denials: 1},
+		{Tenant: "t3", Requests: 1, Denials: 1, Bytes: 10},
+	}
+
+	checkSnapshot(t, collector, expected)
+
+	if err := collector.flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, found := store.stats["nonexistent"]; found {
+		t.Error("expected the denials of the unknown tenant to be dropped")
+	}
+
+	checkSnapshot(t, collector, expected)
+
+	// the counters are removed from memory once persisted
+	if tenants := collector.tenants(); len(tenants) != 0 {
+		t.Errorf("expected no counters after the flush, got %v", tenants)
+	}
+}
+
+// TestTenantStatsBound tests that the number of tenants counted between two flushes is bounded
+func TestTenantStatsBound(t *testing.T) {
+	store := &memoryTenantStats{stats: map[string]types.TenantStats{}}
+	collector := newTenantStatsCollector(store.list, store.add, store.known)
+	collector.maxPending = 10
+
+	for i := 0; i < 100; i++ {
+		collector.recordDenial(fmt.Sprintf("tenant%d", i))
+	}
+
+	// counters of tenants which are already counted still go up
+	collector.recordRequest("tenant0", "GET", 0)
+
+	if tenants := collector.tenants(); len(tenants) != 10 {
+		t.Errorf("expected 10 tenants to be counted, got %d", len(tenants))
+	}
+
+	if counters := collector.counters("tenant0"); counters.requests != 1 || counters.denials != 1 {
+		t.Errorf("expected the first tenant to be counted, got %#v", counters)
+	}
+
+	if err := collector.flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// there's room for new tenants after a flush
+	collector.recordDenial("tenant99")
+
+	if tenants := collector.tenants(); len(tenants) != 1 {
+		t.Errorf("expected 1 tenant to be counted, got %v", tenants)
+	}
+}
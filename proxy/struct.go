@@ -1,16 +1,360 @@
 package proxy
 
+import (
+	"github.com/contiv/auth_proxy/auth/ldap"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
 // This file contains the list of structs used in the HTTP handlers.
 
 // this is to maintain uniformity in UI. Right now, all the requests are sent as JSON
 type loginReq struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	OTP      string `json:"otp"` // one-time password; only required if the user has MFA enabled
 }
 
 // LoginResponse holds the token returned upon successful login.
+// If PasswordExpired or PasswordResetRequired is set, the token can only be used
+// to change the password; the latter is set if an admin requires the user to
+// change it, e.g. after setting a temporary password.
+// ExpiresAt is the token's expiry as a RFC3339 timestamp, so that clients can
+// refresh it in time. Username, Role and Tenants describe the token like
+// WhoamiResponse does; Role and Tenants are empty for password change tokens.
+// StrictAuthorization is set if netmaster requests are denied while Tenants is
+// empty (see common.StrictAuthorizationKey); it's never set for admins.
+// Attributes holds the attributes of LDAP users read from the directory, e.g.
+// their displayName and mail; see ldap.UserAttributes().
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token                 string            `json:"token"`
+	ExpiresAt             string            `json:"expires_at"`
+	PasswordExpired       bool              `json:"password_expired,omitempty"`
+	PasswordResetRequired bool              `json:"password_reset_required,omitempty"`
+	Username              string            `json:"username"`
+	Role                  string            `json:"role,omitempty"`
+	Tenants               []string          `json:"tenants,omitempty"`
+	StrictAuthorization   bool              `json:"strict_authorization,omitempty"`
+	Attributes            map[string]string `json:"attributes,omitempty"`
+}
+
+// changePasswordRequest holds the caller's current and new password
+type changePasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// localUserFlagsRequest holds the optional `disable`, `password_expiry_exempt`,
+// `password_reset_required` and `mfa_enabled` of a local user update
+type localUserFlagsRequest struct {
+	Disable               *bool `json:"disable"`
+	PasswordExpiryExempt  *bool `json:"password_expiry_exempt"`
+	PasswordResetRequired *bool `json:"password_reset_required"`
+	MFAEnabled            *bool `json:"mfa_enabled"`
+}
+
+//
+// BulkLocalUserRequest describes one of the local users added at BulkLocalUsersPath.
+//
+// Fields:
+//  Username, Password, FirstName, LastName, Email, FullName, Labels, Disable,
+//  PasswordResetRequired: as in types.LocalUser
+//  Role: built-in role granted to the user; no authorization is added if empty
+//  TenantName: tenant the role is granted on; ignored for the admin role
+//
+type BulkLocalUserRequest struct {
+	Username              string            `json:"username"`
+	Password              string            `json:"password"`
+	FirstName             string            `json:"first_name"`
+	LastName              string            `json:"last_name"`
+	Email                 string            `json:"email,omitempty"`
+	FullName              string            `json:"full_name,omitempty"`
+	Labels                map[string]string `json:"labels,omitempty"`
+	Disable               bool              `json:"disable"`
+	PasswordResetRequired bool              `json:"password_reset_required,omitempty"`
+	Role                  string            `json:"role,omitempty"`
+	TenantName            string            `json:"tenantName,omitempty"`
+}
+
+//
+// LocalUserWithAuthorizations is a local user along with the authorizations
+// granted to it, as returned with `?include=authorizations`.
+//
+// Fields:
+//  LocalUser: the user, as listed without `include`
+//  Authorizations: the user's authorizations, sorted by UUID; empty if it has none
+//
+type LocalUserWithAuthorizations struct {
+	types.LocalUser
+	Authorizations []GetAuthorizationReply `json:"authorizations"`
+}
+
+//
+// BulkLocalUsersResponse lists the local users added, or validated if DryRun
+// is set, at BulkLocalUsersPath; it's only returned if all of them were.
+//
+// Fields:
+//  DryRun: true if the users were only validated
+//  Users: the users, in the order of the request
+//
+type BulkLocalUsersResponse struct {
+	DryRun bool                  `json:"dry_run"`
+	Users  []BulkLocalUserStatus `json:"users"`
+}
+
+//
+// BulkLocalUserStatus describes one of the users of a BulkLocalUsersResponse;
+// passwords are never returned.
+//
+// Fields:
+//  Username: the user's name, normalized if usernames are (see common.NormalizeUsername())
+//  Status: "created", or "valid" on a dry run
+//  Role: role granted to the user, if any
+//  TenantName: tenant the role is granted on; empty for the admin role
+//
+type BulkLocalUserStatus struct {
+	Username   string `json:"username"`
+	Status     string `json:"status"`
+	Role       string `json:"role,omitempty"`
+	TenantName string `json:"tenantName,omitempty"`
+}
+
+//
+// JSONWebKeySet is the JWK Set (RFC 7517) published at JWKSPath.
+//
+// Fields:
+//  Keys: public keys verifying our tokens; empty unless they're signed with RS256
+//
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+//
+// JSONWebKey describes an RSA public key verifying our tokens (RFC 7518, section 6.3).
+//
+// Fields:
+//  Kty: key type, always "RSA"
+//  Use: intended use, always "sig"
+//  Alg: signing algorithm, always "RS256"
+//  Kid: key ID, as found in the `kid` header of the tokens
+//  N: base64url encoded modulus
+//  E: base64url encoded exponent
+//
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// addAccessTokenRequest holds the name of a new personal access token
+type addAccessTokenRequest struct {
+	Name string `json:"name"`
+}
+
+//
+// AccessTokenReply describes a personal access token without revealing it.
+//
+// Fields:
+//  ID: unique ID of the token
+//  Name: name given by its owner
+//  Username: user who created the token
+//  Prefix: the non-secret beginning of the token value
+//  CreatedAt: creation time in seconds since the epoch
+//  Token: the token value; only returned when the token is created
+//
+type AccessTokenReply struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Username  string `json:"username"`
+	Prefix    string `json:"prefix"`
+	CreatedAt int64  `json:"created_at"`
+	Token     string `json:"token,omitempty"`
+}
+
+// confirmMFARequest holds the one-time password confirming an MFA enrollment
+type confirmMFARequest struct {
+	OTP string `json:"otp"`
+}
+
+//
+// MFAEnrollmentReply holds the TOTP secret of an MFA enrollment.
+//
+// Fields:
+//  Secret: base32 encoded TOTP secret, for entering it into an authenticator app
+//  URL: otpauth:// URL of the secret, for scanning it as a QR code
+//
+type MFAEnrollmentReply struct {
+	Secret string `json:"secret"`
+	URL    string `json:"otpauth_url"`
+}
+
+//
+// SigningKeysReply lists the token signing keys which are accepted.
+//
+// Fields:
+//  Current: ID of the key new tokens are signed with
+//  Retired: keys which were replaced, but are accepted until they expire
+//
+type SigningKeysReply struct {
+	Current string                   `json:"current"`
+	Retired []RetiredSigningKeyReply `json:"retired"`
+}
+
+//
+// RetiredSigningKeyReply describes a retired token signing key without
+// revealing it.
+//
+// Fields:
+//  ID: key ID (`kid` header) of the tokens signed with it
+//  RetiredAt: time it was replaced in seconds since the epoch
+//  ExpiresAt: time from which it's no longer accepted in seconds since the epoch
+//
+type RetiredSigningKeyReply struct {
+	ID        string `json:"id"`
+	RetiredAt int64  `json:"retired_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+//
+// WhoamiResponse describes the caller's token.
+//
+// Fields:
+//  Username: user the token was issued to
+//  Role: highest role of the user; admin, tenant_admin or ops. empty for password change tokens
+//  Tenants: tenants the user is currently authorized for
+//  PasswordChangeOnly: true if the token can only be used to change the password
+//  CachedAuth: true if the token was issued using a cached LDAP login
+//  AccessToken: true if the caller used a personal access token
+//  ClientCertificate: true if the caller was authenticated by a TLS client certificate
+//
+type WhoamiResponse struct {
+	Username           string   `json:"username"`
+	Role               string   `json:"role,omitempty"`
+	Tenants            []string `json:"tenants,omitempty"`
+	PasswordChangeOnly bool     `json:"password_change_only,omitempty"`
+	CachedAuth         bool     `json:"cached_auth,omitempty"`
+	AccessToken        bool     `json:"access_token,omitempty"`
+	ClientCertificate  bool     `json:"client_certificate,omitempty"`
+}
+
+//
+// MeResponse describes the caller's identity and what it's allowed to do.
+//
+// Fields:
+//  PrincipalName: user the token was issued to; the DN of LDAP users
+//  PrincipalType: "local", "ldap" or "serviceaccount"
+//  Principals: principals the token was issued for, e.g. an LDAP user and its
+//    groups as resolved at login
+//  Role: highest role of the user
+//  Tenants: tenants the principals are currently authorized for, with the
+//    highest role granted on each; sorted by tenant name
+//  ExpiresAt: expiry of the token as a RFC3339 timestamp; empty if it doesn't
+//    expire, e.g. for personal access tokens
+//  StrictAuthorization: true if netmaster requests are denied while Tenants is
+//    empty (see common.StrictAuthorizationKey); always false for admins
+//  Attributes: attributes of LDAP users read from the directory at login, e.g.
+//    their displayName and mail
+//  Email, FullName: optional email address and full name of local users
+//  MatchedAuthorizations: UUIDs of the unexpired authorizations of Principals,
+//    which Role and Tenants come from (besides the group role of LDAP users)
+//
+type MeResponse struct {
+	PrincipalName         string            `json:"principal_name"`
+	PrincipalType         string            `json:"principal_type"`
+	Principals            []string          `json:"principals"`
+	Role                  string            `json:"role"`
+	Tenants               []TenantRoleRef   `json:"tenants"`
+	ExpiresAt             string            `json:"expires_at,omitempty"`
+	StrictAuthorization   bool              `json:"strict_authorization,omitempty"`
+	Attributes            map[string]string `json:"attributes,omitempty"`
+	Email                 string            `json:"email,omitempty"`
+	FullName              string            `json:"full_name,omitempty"`
+	MatchedAuthorizations []string          `json:"matched_authorizations"`
+}
+
+// DebugPrincipalResponse describes how a LDAP user's roles are resolved right
+// now, as returned by DebugPrincipalPath; the directory is queried live.
+//
+// Fields:
+//  Name: name of the user as given
+//  DN: distinguished name of the user, i.e. its principal name in tokens
+//  Groups: groups of the user, including nested ones; its principals
+//  GroupRole: base role the groups are mapped to; empty if none is
+//  Role: highest role the user would get at login
+//  Tenants: tenants the user would be authorized for, with the highest role
+//    granted on each; sorted by tenant name
+//  MatchedAuthorizations: the unexpired authorizations of the groups
+//  LocalUser: true if a local user with the same name exists; it's tried first
+//    at login, so the LDAP user only logs in if the local password doesn't match
+//
+type DebugPrincipalResponse struct {
+	Name                  string                  `json:"name"`
+	DN                    string                  `json:"dn"`
+	Groups                []string                `json:"groups"`
+	GroupRole             string                  `json:"group_role,omitempty"`
+	Role                  string                  `json:"role"`
+	Tenants               []TenantRoleRef         `json:"tenants"`
+	MatchedAuthorizations []GetAuthorizationReply `json:"matched_authorizations"`
+	LocalUser             bool                    `json:"local_user,omitempty"`
+}
+
+// TenantRoleRef is a tenant along with the role the caller has on it.
+type TenantRoleRef struct {
+	TenantName string `json:"tenantName"`
+	Role       string `json:"role"`
+}
+
+//
+// PurgePrincipalReply summarizes what was removed by purging a principal.
+//
+// Fields:
+//  Principal: name of the purged principal
+//  LocalUser: number of local user records deleted; 0 or 1
+//  Authorizations: number of authorizations deleted
+//  TokensRevoked: true if all the tokens issued to the principal so far were revoked
+//  CachedLogins: number of cached LDAP logins deleted
+//  Sessions: number of sessions deleted
+//  AccessTokens: number of personal access tokens deleted
+//  AuditRecords: number of login audit records deleted
+//
+type PurgePrincipalReply struct {
+	Principal      string `json:"principal"`
+	LocalUser      int    `json:"local_user"`
+	Authorizations int    `json:"authorizations"`
+	TokensRevoked  bool   `json:"tokens_revoked"`
+	CachedLogins   int    `json:"cached_logins"`
+	Sessions       int    `json:"sessions"`
+	AccessTokens   int    `json:"access_tokens"`
+	AuditRecords   int    `json:"audit_records"`
+}
+
+//
+// DeleteAuthorizationsReply lists the authorizations deleted by deleting all
+// the authorizations of a principal.
+//
+// Fields:
+//  Count: number of deleted authorizations
+//  AuthzUUIDs: UUIDs of the deleted authorizations
+//
+type DeleteAuthorizationsReply struct {
+	Count      int      `json:"count"`
+	AuthzUUIDs []string `json:"authz_uuids"`
+}
+
+//
+// RevokeSessionsReply summarizes what was revoked by revoking all the sessions of a user.
+//
+// Fields:
+//  Username: user or principal whose tokens were revoked
+//  Sessions: number of sessions deleted
+//  AccessTokens: number of personal access tokens deleted
+//
+type RevokeSessionsReply struct {
+	Username     string `json:"username"`
+	Sessions     int    `json:"sessions"`
+	AccessTokens int    `json:"access_tokens"`
 }
 
 //
@@ -19,17 +363,35 @@ type LoginResponse struct {
 //
 // Fields:
 //  PrincipalName: name of a security principal for whom an authorization needs to be added. This
-//    can be a local user or an LDAP group
+//    can be a local user, an LDAP group or a Kubernetes ServiceAccount (system:serviceaccount:<namespace>:<name>)
 //  Local: true if the name corresponds to a local user, false if it's an LDAP
 //    group.
-//  Role:  Level of access granted to principal
+//  Role:  Level of access granted to principal; a built-in role or the name of a custom role (see types.CustomRole)
 //  TenantName: Tenant name that the above principal will have access to. Based on role type, this may not be set. For example, a tenant name is ignored if role is admin.
+//  ExpiresAt: time (in seconds since the epoch) at which the authorization expires; it never expires if 0.
 //
 type AddAuthorizationRequest struct {
 	PrincipalName string `json:"principalName"`
 	Local         bool   `json:"local"`
 	Role          string `json:"role"`
 	TenantName    string `json:"tenantName"`
+	ExpiresAt     int64  `json:"expires_at,omitempty"`
+}
+
+//
+// UpdateAuthorizationRequest message is sent for UpdateAuthorization
+// operation.
+//
+// Fields:
+//  ExpiresAt: new expiry time (in seconds since the epoch) of the authorization; 0 makes it permanent.
+//  Role: new role of a tenant authorization; not admin.
+//  TenantName: tenant a tenant authorization is moved to.
+//  Fields which aren't set are left unchanged.
+//
+type UpdateAuthorizationRequest struct {
+	ExpiresAt  *int64  `json:"expires_at"`
+	Role       *string `json:"role"`
+	TenantName *string `json:"tenantName"`
 }
 
 //
@@ -43,7 +405,14 @@ type AddAuthorizationRequest struct {
 //  Local: true if the name corresponds to a local user, false if it's an LDAP
 //    group.
 //  Role:  Level of access to the tenant specified by TenantName
-//  TenantName: Tenant name that the above user will have access to
+//  TenantName: Tenant name that the above user will have access to; "*" for all tenants
+//  AllTenants: true if the authorization grants the role on all tenants
+//  ExpiresAt: time (in seconds since the epoch) at which the authorization expires; 0 if never
+//  Expired: true if the authorization expired and is about to be deleted
+//  CreatedAt: time (in seconds since the epoch) the authorization was added; 0 if unknown
+//  UpdatedAt: time (in seconds since the epoch) the authorization was last changed; 0 if unknown
+//  GrantedBy: user who granted the role; empty if unknown
+//  CustomRole: true if Role names a custom role rather than a built-in one
 //
 type GetAuthorizationReply struct {
 	AuthzUUID     string
@@ -51,6 +420,13 @@ type GetAuthorizationReply struct {
 	Local         bool
 	Role          string
 	TenantName    string
+	AllTenants    bool   `json:"all_tenants,omitempty"`
+	ExpiresAt     int64  `json:"expires_at,omitempty"`
+	Expired       bool   `json:"expired,omitempty"`
+	CreatedAt     int64  `json:"created_at,omitempty"`
+	UpdatedAt     int64  `json:"updated_at,omitempty"`
+	GrantedBy     string `json:"granted_by,omitempty"`
+	CustomRole    bool   `json:"custom_role,omitempty"`
 }
 
 //
@@ -65,7 +441,109 @@ type ListAuthorizationsReply struct {
 	AuthList []GetAuthorizationReply
 }
 
-// errorResponse represent error response; used to write error messages to http response.
-type errorResponse struct {
-	Error string `json:"error"`
+//
+// EndpointPolicyDryRunRequest asks whether a user would be allowed to access
+// a netmaster endpoint.
+//
+// Fields:
+//  Username: local user to evaluate the policy for
+//  Principals: security principals (local user or LDAP groups) to evaluate the policy for;
+//    takes precedence over Username
+//  Method: HTTP method of the request, e.g. GET
+//  Path: path of the request, e.g. /api/v1/networks/n1/
+//  TenantName: optional tenant of the requested object; if set, tenant-scoped
+//    rules also check the user's authorization for this tenant
+//
+type EndpointPolicyDryRunRequest struct {
+	Username   string   `json:"username"`
+	Principals []string `json:"principals"`
+	Method     string   `json:"method"`
+	Path       string   `json:"path"`
+	TenantName string   `json:"tenantName"`
+}
+
+//
+// LdapConfigurationTestRequest asks to test a LDAP configuration without saving it.
+//
+// Fields:
+//  Configuration: configuration to test; the stored one if nil. The stored
+//    service account password is used if it has none.
+//  Username: optional user to look up with the configuration
+//
+type LdapConfigurationTestRequest struct {
+	Configuration *types.LdapConfiguration `json:"configuration,omitempty"`
+	Username      string                   `json:"username,omitempty"`
+}
+
+// LdapConfigurationReencryptResponse is the result of re-encrypting the LDAP
+// service account password.
+//
+// Fields:
+//  Reencrypted: true if the password was encrypted with a previous TLS key
+//    and is now encrypted with the current one; false if it already was
+//
+type LdapConfigurationReencryptResponse struct {
+	Reencrypted bool `json:"reencrypted"`
+}
+
+// LdapGroupsResponse holds the LDAP/AD groups matching a search.
+//
+// Fields:
+//  Groups: groups found, sorted by display name
+//  Truncated: true if more groups match; the search should be refined
+//
+type LdapGroupsResponse struct {
+	Groups    []ldap.Group `json:"groups"`
+	Truncated bool         `json:"truncated"`
+}
+
+// IntrospectionRequest holds the token to be introspected.
+type IntrospectionRequest struct {
+	Token string `json:"token"`
+}
+
+//
+// IntrospectionResponse describes an introspected token (see RFC 7662).
+// Only `active` is set for tokens which are invalid, expired or revoked, or
+// which belong to a deleted or disabled user; `revoked` tells revoked tokens
+// apart from the others.
+//
+// Fields:
+//  Active: true if the token is currently valid
+//  Revoked: true if the token, or all the tokens of its user, were revoked
+//  Username: user the token was issued to
+//  Principals: security principals the token was issued for, e.g. the user's LDAP groups
+//  Role: highest role of the user; admin or ops
+//  Tenants: tenants the user is currently authorized for
+//  Iat: issue time of the token in seconds since the epoch
+//  Exp: expiry time of the token in seconds since the epoch
+//
+type IntrospectionResponse struct {
+	Active     bool     `json:"active"`
+	Revoked    bool     `json:"revoked,omitempty"`
+	Username   string   `json:"username,omitempty"`
+	Principals []string `json:"principals,omitempty"`
+	Role       string   `json:"role,omitempty"`
+	Tenants    []string `json:"tenants,omitempty"`
+	Iat        int64    `json:"iat,omitempty"`
+	Exp        int64    `json:"exp,omitempty"`
+}
+
+//
+// RouteInfo describes an endpoint served by the proxy.
+//
+// Fields:
+//  Path: path template of a proxy-local route, e.g. /api/v1/auth_proxy/local_users/{username}/,
+//    or an endpoint policy path pattern for proxied routes, e.g. /api/v1/networks/**
+//  Methods: allowed HTTP methods
+//  Role: who is allowed to access the route, e.g. none, authenticated, admin or ops
+//  TenantScoped: true if access is limited to the tenants the user is authorized for
+//  Proxied: true if requests are proxied to netmaster
+//
+type RouteInfo struct {
+	Path         string   `json:"path"`
+	Methods      []string `json:"methods"`
+	Role         string   `json:"role"`
+	TenantScoped bool     `json:"tenantScoped"`
+	Proxied      bool     `json:"proxied"`
 }
@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// This file contains the connection pool used for all requests to netmaster.
+// http.DefaultTransport only keeps 2 idle connections per host, so under load
+// most requests used to open a new connection and netmaster ran out of
+// ephemeral ports.
+
+const (
+	// DefaultNetmasterMaxIdleConnsPerHost is the default value for proxy.Config's NetmasterMaxIdleConnsPerHost
+	DefaultNetmasterMaxIdleConnsPerHost = 64
+
+	// DefaultNetmasterIdleConnTimeout is the default value for proxy.Config's NetmasterIdleConnTimeout
+	DefaultNetmasterIdleConnTimeout = 90
+
+	// DefaultNetmasterTLSHandshakeTimeout is the default value for proxy.Config's NetmasterTLSHandshakeTimeout
+	DefaultNetmasterTLSHandshakeTimeout = 10
+
+	// upstreamDialTimeout is how long we allow for connecting to netmaster
+	upstreamDialTimeout = 5 * time.Second
+)
+
+// ConnectionPoolMetrics describes the state of the connections to netmaster
+type ConnectionPoolMetrics struct {
+	Open   int64  `json:"open"`   // connections currently open
+	InUse  int64  `json:"in_use"` // connections currently serving a request
+	Idle   int64  `json:"idle"`   // open connections waiting for a request
+	Dialed uint64 `json:"dialed"` // connections opened since startup
+	Reused uint64 `json:"reused"` // requests which reused an open connection
+}
+
+// UpstreamResponseMetrics counts the responses received from netmaster by status class
+type UpstreamResponseMetrics struct {
+	Success     uint64 `json:"2xx"`
+	Redirect    uint64 `json:"3xx"`
+	ClientError uint64 `json:"4xx"`
+	ServerError uint64 `json:"5xx"`
+	Failed      uint64 `json:"failed"` // requests which didn't get a response at all
+}
+
+// upstreamPool is a http.Transport, or a http2.Transport if netmaster is
+// talked to using h2c, which counts its connections; the counters are only
+// accessed using sync/atomic
+type upstreamPool struct {
+	transport http.RoundTripper
+
+	open   int64
+	inUse  int64
+	dialed uint64
+	reused uint64
+
+	responses [6]uint64 // by status class, e.g. responses[4] counts 4xx
+	failed    uint64
+}
+
+// pooledConn decrements the pool's open connections when it's closed
+type pooledConn struct {
+	net.Conn
+	pool *upstreamPool
+	once sync.Once
+}
+
+// Close closes the connection; it's only counted once no matter how often it's called
+func (c *pooledConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.pool.open, -1)
+	})
+
+	return c.Conn.Close()
+}
+
+// newUpstreamPool returns a pool configured by the given config.
+// params:
+//  c: config holding the pool's limits and timeouts; zero values are replaced by the defaults
+// return values:
+//  *upstreamPool: pool without any connections
+func newUpstreamPool(c *Config) *upstreamPool {
+	maxIdle := c.NetmasterMaxIdleConnsPerHost
+	if maxIdle <= 0 {
+		maxIdle = DefaultNetmasterMaxIdleConnsPerHost
+	}
+
+	idleTimeout := c.NetmasterIdleConnTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultNetmasterIdleConnTimeout
+	}
+
+	handshakeTimeout := c.NetmasterTLSHandshakeTimeout
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = DefaultNetmasterTLSHandshakeTimeout
+	}
+
+	p := &upstreamPool{}
+
+	dialer := &net.Dialer{
+		Timeout:   upstreamDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	dial := func(network, addr string) (net.Conn, error) {
+		conn, err := dialer.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		atomic.AddInt64(&p.open, 1)
+		atomic.AddUint64(&p.dialed, 1)
+
+		return &pooledConn{Conn: conn, pool: p}, nil
+	}
+
+	if c.NetmasterH2C {
+		// HTTP/2 with prior knowledge: the "TLS" connection is a plain one
+		p.transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(network, addr)
+			},
+		}
+
+		return p
+	}
+
+	p.transport = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		Dial:                dial,
+		MaxIdleConns:        maxIdle,
+		MaxIdleConnsPerHost: maxIdle,
+		IdleConnTimeout:     time.Duration(idleTimeout) * time.Second,
+		TLSHandshakeTimeout: time.Duration(handshakeTimeout) * time.Second,
+	}
+
+	return p
+}
+
+// client returns a http.Client sending its requests through the pool
+func (p *upstreamPool) client() *http.Client {
+	return &http.Client{Transport: p}
+}
+
+// pooledBody marks the connection of a response as no longer in use when it's closed
+type pooledBody struct {
+	io.ReadCloser
+	pool *upstreamPool
+	once sync.Once
+}
+
+// Close closes the body; the connection is only released once no matter how often it's called
+func (b *pooledBody) Close() error {
+	b.once.Do(b.pool.release)
+
+	return b.ReadCloser.Close()
+}
+
+// release marks a connection as no longer in use
+func (p *upstreamPool) release() {
+	atomic.AddInt64(&p.inUse, -1)
+}
+
+// RoundTrip implements http.RoundTripper; a connection is in use from the time
+// it's obtained until the response body is closed.
+func (p *upstreamPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	gotConn := int32(0)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			atomic.StoreInt32(&gotConn, 1)
+			atomic.AddInt64(&p.inUse, 1)
+
+			if info.Reused {
+				atomic.AddUint64(&p.reused, 1)
+			}
+		},
+	}
+
+	resp, err := p.transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+
+	if err != nil {
+		atomic.AddUint64(&p.failed, 1)
+	} else if class := resp.StatusCode / 100; class > 0 && class < len(p.responses) {
+		atomic.AddUint64(&p.responses[class], 1)
+	}
+
+	if atomic.LoadInt32(&gotConn) == 1 {
+		if err != nil {
+			p.release()
+		} else {
+			resp.Body = &pooledBody{ReadCloser: resp.Body, pool: p}
+		}
+	}
+
+	return resp, err
+}
+
+// metrics returns a snapshot of the pool's counters
+func (p *upstreamPool) metrics() ConnectionPoolMetrics {
+	m := ConnectionPoolMetrics{
+		Open:   atomic.LoadInt64(&p.open),
+		InUse:  atomic.LoadInt64(&p.inUse),
+		Dialed: atomic.LoadUint64(&p.dialed),
+		Reused: atomic.LoadUint64(&p.reused),
+	}
+
+	// the counters aren't updated together, so in-use can exceed open for a moment
+	if m.Idle = m.Open - m.InUse; m.Idle < 0 {
+		m.Idle = 0
+	}
+
+	return m
+}
+
+// responseMetrics returns a snapshot of the pool's response counters
+func (p *upstreamPool) responseMetrics() UpstreamResponseMetrics {
+	return UpstreamResponseMetrics{
+		Success:     atomic.LoadUint64(&p.responses[2]),
+		Redirect:    atomic.LoadUint64(&p.responses[3]),
+		ClientError: atomic.LoadUint64(&p.responses[4]),
+		ServerError: atomic.LoadUint64(&p.responses[5]),
+		Failed:      atomic.LoadUint64(&p.failed),
+	}
+}
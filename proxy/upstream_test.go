@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// newUpstreamTestServer returns a server proxying to the given netmaster address
+func newUpstreamTestServer(address string, maxIdleConnsPerHost int) *Server {
+	return NewServer(&Config{
+		NetmasterAddress:             address,
+		NetmasterRequestTimeout:      DefaultNetmasterRequestTimeout,
+		ClientReadTimeout:            DefaultClientReadTimeout,
+		ClientWriteTimeout:           DefaultClientWriteTimeout,
+		NetmasterMaxIdleConnsPerHost: maxIdleConnsPerHost,
+	})
+}
+
+// proxyTestRequest proxies a GET request for the given path; safe to call from any goroutine
+func proxyTestRequest(t testing.TB, s *Server, path string) {
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Errorf("failed to create request: %s", err)
+		return
+	}
+	req.RequestURI = path
+
+	if _, _, err := s.ProxyRequest(httptest.NewRecorder(), req, nil); err != nil {
+		t.Errorf("failed to proxy request: %s", err)
+	}
+}
+
+// TestUpstreamPool tests that connections to netmaster are reused and counted
+func TestUpstreamPool(t *testing.T) {
+	netmaster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer netmaster.Close()
+
+	s := newUpstreamTestServer(netmaster.Listener.Addr().String(), 8)
+
+	if m := s.netmasterPool.metrics(); m != (ConnectionPoolMetrics{}) {
+		t.Fatalf("expected no connections, got %#v", m)
+	}
+
+	// a connection is in use until the response body is closed
+	resp, err := s.netmasterClient.Get(netmaster.URL + "/api/v1/networks/")
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+
+	if m := s.netmasterPool.metrics(); m.Open != 1 || m.InUse != 1 || m.Idle != 0 {
+		t.Errorf("expected 1 connection in use, got %#v", m)
+	}
+
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if m := s.netmasterPool.metrics(); m.Open != 1 || m.InUse != 0 || m.Idle != 1 {
+		t.Errorf("expected 1 idle connection, got %#v", m)
+	}
+
+	// concurrent requests open at most one connection each; they're kept for reuse
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			proxyTestRequest(t, s, "/api/v1/networks/")
+		}()
+	}
+	wg.Wait()
+
+	m := s.netmasterPool.metrics()
+	if m.Dialed > 8 || m.InUse != 0 || m.Idle != m.Open {
+		t.Errorf("expected at most 8 idle connections, got %#v", m)
+	}
+
+	dialed := m.Dialed
+	for i := 0; i < 10; i++ {
+		proxyTestRequest(t, s, "/api/v1/networks/")
+	}
+
+	if m := s.netmasterPool.metrics(); m.Dialed != dialed || m.Reused < 10 {
+		t.Errorf("expected the connections to be reused, got %#v", m)
+	}
+}
+
+// TestUpstreamH2C tests that requests to netmaster share a single HTTP/2
+// connection if it's talked to using h2c
+func TestUpstreamH2C(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer listener.Close()
+
+	protos := make(chan string, 10)
+	netmaster := &http2.ServeConnOpts{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		protos <- req.Proto
+		w.Write([]byte("[]"))
+	})}
+
+	// netmaster speaks HTTP/2 right away, without being asked to upgrade
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go (&http2.Server{}).ServeConn(conn, netmaster)
+		}
+	}()
+
+	s := NewServer(&Config{
+		NetmasterAddress:        listener.Addr().String(),
+		NetmasterRequestTimeout: DefaultNetmasterRequestTimeout,
+		ClientReadTimeout:       DefaultClientReadTimeout,
+		ClientWriteTimeout:      DefaultClientWriteTimeout,
+		NetmasterH2C:            true,
+	})
+
+	for i := 0; i < cap(protos); i++ {
+		proxyTestRequest(t, s, "/api/v1/networks/")
+	}
+
+	for i := 0; i < cap(protos); i++ {
+		if proto := <-protos; proto != "HTTP/2.0" {
+			t.Errorf("expected netmaster to get HTTP/2.0, got %s", proto)
+		}
+	}
+
+	if m := s.netmasterPool.metrics(); m.Dialed != 1 || m.Open != 1 || m.InUse != 0 {
+		t.Errorf("expected all requests to share one connection, got %#v", m)
+	}
+}
+
+// benchmarkUpstream proxies b.N requests from many concurrent clients to a
+// netmaster keeping connections open and reports the number of connections opened to it and the
+// p99 latency. The difference between the pools only shows with more than
+// one CPU, e.g. go test -run X -bench Upstream -benchtime 5000x -cpu 4 ./proxy/
+func benchmarkUpstream(b *testing.B, maxIdleConnsPerHost int) {
+	netmaster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer netmaster.Close()
+
+	s := newUpstreamTestServer(netmaster.Listener.Addr().String(), maxIdleConnsPerHost)
+
+	var mutex sync.Mutex
+	latencies := make([]time.Duration, 0, b.N)
+
+	b.SetParallelism(32) // goroutines per CPU
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			start := time.Now()
+			proxyTestRequest(b, s, "/api/v1/networks/")
+			latency := time.Since(start)
+
+			mutex.Lock()
+			latencies = append(latencies, latency)
+			mutex.Unlock()
+		}
+	})
+
+	b.StopTimer()
+
+	sort.Sort(durations(latencies))
+	p99 := latencies[len(latencies)*99/100]
+
+	m := s.netmasterPool.metrics()
+	b.Logf("%d requests: %d connections opened, %d reused, p99 latency %s", len(latencies), m.Dialed, m.Reused, p99)
+}
+
+// durations sorts latencies
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// BenchmarkUpstreamDefaultPool uses the 2 idle connections per host of http.DefaultTransport,
+// i.e. how we used to talk to netmaster. Keep -benchtime short, every request which can't
+// reuse a connection leaves a socket in TIME_WAIT.
+func BenchmarkUpstreamDefaultPool(b *testing.B) {
+	benchmarkUpstream(b, 2)
+}
+
+// BenchmarkUpstreamPool uses the default size of our connection pool
+func BenchmarkUpstreamPool(b *testing.B) {
+	benchmarkUpstream(b, DefaultNetmasterMaxIdleConnsPerHost)
+}
@@ -10,6 +10,9 @@ find . -type f -name "*.sh" -and -not -path "./vendor/*" -and -not -path "./buil
 dirs=$(go list ./... | sed -e 's!github.com/contiv/auth_proxy!.!g' | grep -v ./vendor)
 files=$(find . -type f -name '*.go' | grep -v ./vendor)
 
+echo "Building with $(go version)..."
+go build ./...
+
 echo "Running gofmt..."
 set +e
 out=$(gofmt -s -l ${files})
@@ -38,7 +41,7 @@ fi
 
 echo "Running govet..."
 set +e
-out=$(go tool vet -composites=false ${dirs} 2>&1 | grep -v vendor)
+out=$(go vet -composites=false ${dirs} 2>&1 | grep -v vendor)
 set -e
 
 if [ "${#out}" -gt 0 ]; then
@@ -9,19 +9,22 @@
 #
 #  1. builds a systemtests container
 #  2. creates a docker network (all containers are attached to it)
-#  3. starts an etcd container
-#  4. starts a consul container
-#  5. starts a systemtests container (does nothing by default)
-#  6. starts a auth_proxy container on port 10000 linked to etcd
-#  7. starts a auth_proxy container on port 10001 linked to consul
-#  8. executes ./scripts/systemtests_in_container.sh which runs all the systemtests
-#     against the etcd proxy and consul proxy
-#  9. stops etcd proxy container
-# 10. stops consul proxy container
-# 11. stops systemtests container
-# 12. stops etcd container
-# 13. stops consul container
-# 14. destroys the docker network
+#  3. starts an etcd container serving the v2 API
+#  4. starts an etcd container serving the v3 API
+#  5. starts a consul container
+#  6. starts a consul container with ACLs enabled and a token for auth_proxy
+#  7. starts a systemtests container (does nothing by default)
+#  8. starts a auth_proxy container on port 10000 linked to etcd (v2 API)
+#  9. starts a auth_proxy container on port 10001 linked to consul
+# 10. starts a auth_proxy container on port 10002 linked to etcd (v3 API)
+# 11. starts a auth_proxy container on port 10003 linked to consul with ACLs
+# 12. executes ./scripts/systemtests_in_container.sh which runs all the systemtests
+#     against the etcd proxy, etcd v3 proxy, consul proxy and consul ACL proxy
+# 13. stops etcd, etcd v3, consul and consul ACL proxy containers
+# 14. stops systemtests container
+# 15. stops etcd containers
+# 16. stops consul containers
+# 17. destroys the docker network
 #
 
 set -euo pipefail
@@ -57,6 +60,20 @@ ETCD_CONTAINER_ID=$(
 ETCD_CONTAINER_IP=$(ip_for_container $ETCD_CONTAINER_ID)
 echo "etcd running @ $ETCD_CONTAINER_IP:2379"
 
+echo "Starting etcd v3 container..."
+ETCDV3_CONTAINER_NAME="etcdv3_auth_proxy_systemtests"
+ETCDV3_CONTAINER_ID=$(
+	docker run -d \
+		--name $ETCDV3_CONTAINER_NAME \
+		--network $NETWORK_NAME \
+		quay.io/coreos/etcd:v3.4.13 \
+		etcd \
+		--listen-client-urls http://0.0.0.0:2379 \
+		--advertise-client-urls http://0.0.0.0:2379
+)
+ETCDV3_CONTAINER_IP=$(ip_for_container $ETCDV3_CONTAINER_ID)
+echo "etcd v3 running @ $ETCDV3_CONTAINER_IP:2379"
+
 echo "Starting consul container..."
 CONSUL_CONTAINER_NAME="consul_auth_proxy_systemtests"
 CONSUL_CONTAINER_ID=$(
@@ -70,6 +87,32 @@ CONSUL_CONTAINER_ID=$(
 CONSUL_CONTAINER_IP=$(ip_for_container $CONSUL_CONTAINER_ID)
 echo "consul running @ $CONSUL_CONTAINER_IP:8500"
 
+echo "Starting consul container with ACLs..."
+CONSUL_ACL_CONTAINER_NAME="consul_acl_auth_proxy_systemtests"
+CONSUL_ACL_MASTER_TOKEN=$(cat /proc/sys/kernel/random/uuid)
+CONSUL_ACL_TOKEN=$(cat /proc/sys/kernel/random/uuid)
+CONSUL_ACL_CONTAINER_ID=$(
+	docker run -d \
+		--name $CONSUL_ACL_CONTAINER_NAME \
+		--network $NETWORK_NAME \
+		-e CONSUL_LOCAL_CONFIG='{"acl": {"enabled": true, "default_policy": "deny", "tokens": {"master": "'$CONSUL_ACL_MASTER_TOKEN'"}}}' \
+		consul:1.9.17 \
+		agent -dev -client 0.0.0.0
+)
+
+# auth_proxy's token may only use its keys and sessions (used for leases)
+until docker exec -e CONSUL_HTTP_TOKEN=$CONSUL_ACL_MASTER_TOKEN $CONSUL_ACL_CONTAINER_NAME consul acl policy list >/dev/null 2>&1; do
+	sleep 1
+done
+docker exec -e CONSUL_HTTP_TOKEN=$CONSUL_ACL_MASTER_TOKEN $CONSUL_ACL_CONTAINER_NAME \
+	consul acl policy create -name auth_proxy \
+	-rules 'key_prefix "auth_proxy/" { policy = "write" } session_prefix "" { policy = "write" } node_prefix "" { policy = "read" }'
+docker exec -e CONSUL_HTTP_TOKEN=$CONSUL_ACL_MASTER_TOKEN $CONSUL_ACL_CONTAINER_NAME \
+	consul acl token create -policy-name auth_proxy -secret $CONSUL_ACL_TOKEN
+
+CONSUL_ACL_CONTAINER_IP=$(ip_for_container $CONSUL_ACL_CONTAINER_ID)
+echo "consul with ACLs running @ $CONSUL_ACL_CONTAINER_IP:8500"
+
 #
 # NOTE: we start the systemtests container and then later use `docker exec` to
 #       run the tests against etcd and consul.  The reason for starting it like
@@ -84,7 +127,10 @@ SYSTEMTESTS_CONTAINER_ID=$(
 	docker run -d -t \
 		-e DEBUG="${DEBUG-}" \
 		-e ETCD_CONTAINER_IP="$ETCD_CONTAINER_IP" \
+		-e ETCDV3_CONTAINER_IP="$ETCDV3_CONTAINER_IP" \
 		-e CONSUL_CONTAINER_IP="$CONSUL_CONTAINER_IP" \
+		-e CONSUL_ACL_CONTAINER_IP="$CONSUL_ACL_CONTAINER_IP" \
+		-e CONSUL_ACL_TOKEN="$CONSUL_ACL_TOKEN" \
 		--network $NETWORK_NAME \
 		auth_proxy_systemtests
 )
@@ -101,7 +147,7 @@ ETCD_PROXY_CONTAINER_ID=$(
 		-e NO_NETMASTER_STARTUP_CHECK=true \
 		--network $NETWORK_NAME \
 		$PROXY_IMAGE \
-		--data-store-address="etcd://$ETCD_CONTAINER_IP:2379" \
+		--data-store-address="etcd://127.0.0.1:2379,etcd://$ETCD_CONTAINER_IP:2379" \
 		--tls-certificate=/local_certs/cert.pem \
 		--tls-key-file=/local_certs/local.key \
 		--listen-address=0.0.0.0:10000 \
@@ -121,6 +167,8 @@ CONSUL_PROXY_CONTAINER_ID=$(
 		-e NO_NETMASTER_STARTUP_CHECK=true \
 		$PROXY_IMAGE \
 		--data-store-address="consul://$CONSUL_CONTAINER_IP:8500" \
+		--consul-datacenter=dc1 \
+		--consul-allow-stale-reads \
 		--tls-certificate=/local_certs/cert.pem \
 		--tls-key-file=/local_certs/local.key \
 		--listen-address=0.0.0.0:10001 \
@@ -130,6 +178,45 @@ CONSUL_PROXY_CONTAINER_IP=$(ip_for_container $CONSUL_PROXY_CONTAINER_ID)
 CONSUL_PROXY_ADDRESS="$CONSUL_PROXY_CONTAINER_IP:10001"
 echo "consul proxy container running @ $CONSUL_PROXY_CONTAINER_IP:10001"
 
+echo "Starting etcd v3 proxy container..."
+ETCDV3_PROXY_CONTAINER_ID=$(
+	docker run -d \
+		-p 10002:10002 \
+		-v $(pwd)/test/active_directory/win2008R2_ROOT_CA.crt:/etc/ssl/certs/ca-certificate.crt \
+		-v $(pwd)/local_certs:/local_certs:ro \
+		-e NO_NETMASTER_STARTUP_CHECK=true \
+		--network $NETWORK_NAME \
+		$PROXY_IMAGE \
+		--data-store-address="etcdv3://127.0.0.1:2379,etcdv3://$ETCDV3_CONTAINER_IP:2379" \
+		--tls-certificate=/local_certs/cert.pem \
+		--tls-key-file=/local_certs/local.key \
+		--listen-address=0.0.0.0:10002 \
+		--netmaster-address="$SYSTEMTESTS_CONTAINER_IP:9999"
+)
+ETCDV3_PROXY_CONTAINER_IP=$(ip_for_container $ETCDV3_PROXY_CONTAINER_ID)
+ETCDV3_PROXY_ADDRESS="$ETCDV3_PROXY_CONTAINER_IP:10002"
+echo "etcd v3 proxy container running @ $ETCDV3_PROXY_CONTAINER_IP:10002"
+
+echo "Starting consul ACL proxy container..."
+CONSUL_ACL_PROXY_CONTAINER_ID=$(
+	docker run -d \
+		-p 10003:10003 \
+		-v $(pwd)/test/active_directory/win2008R2_ROOT_CA.crt:/etc/ssl/certs/ca-certificate.crt \
+		-v $(pwd)/local_certs:/local_certs:ro \
+		-e NO_NETMASTER_STARTUP_CHECK=true \
+		-e CONSUL_HTTP_TOKEN="$CONSUL_ACL_TOKEN" \
+		--network $NETWORK_NAME \
+		$PROXY_IMAGE \
+		--data-store-address="consul://$CONSUL_ACL_CONTAINER_IP:8500" \
+		--tls-certificate=/local_certs/cert.pem \
+		--tls-key-file=/local_certs/local.key \
+		--listen-address=0.0.0.0:10003 \
+		--netmaster-address="$SYSTEMTESTS_CONTAINER_IP:9999"
+)
+CONSUL_ACL_PROXY_CONTAINER_IP=$(ip_for_container $CONSUL_ACL_PROXY_CONTAINER_ID)
+CONSUL_ACL_PROXY_ADDRESS="$CONSUL_ACL_PROXY_CONTAINER_IP:10003"
+echo "consul ACL proxy container running @ $CONSUL_ACL_PROXY_CONTAINER_IP:10003"
+
 # ----- TEST EXECUTION ----------------------------------------------------------
 
 echo "Executing systemtests..."
@@ -138,7 +225,7 @@ set +e
 
 # you can't pass in envvars to docker exec and we didn't know the IPs of the proxy
 # containers when we started this container, so pass them in as arguments here.
-docker exec $SYSTEMTESTS_CONTAINER_ID bash ./scripts/systemtests_in_container.sh $ETCD_PROXY_ADDRESS $CONSUL_PROXY_ADDRESS
+docker exec $SYSTEMTESTS_CONTAINER_ID bash ./scripts/systemtests_in_container.sh $ETCD_PROXY_ADDRESS $CONSUL_PROXY_ADDRESS $ETCDV3_PROXY_ADDRESS $CONSUL_ACL_PROXY_ADDRESS
 test_exit_code=$?
 
 set -e
@@ -151,15 +238,27 @@ docker rm -f -v $ETCD_PROXY_CONTAINER_ID
 echo "Stopping consul proxy container..."
 docker rm -f -v $CONSUL_PROXY_CONTAINER_ID
 
+echo "Stopping etcd v3 proxy container..."
+docker rm -f -v $ETCDV3_PROXY_CONTAINER_ID
+
+echo "Stopping consul ACL proxy container..."
+docker rm -f -v $CONSUL_ACL_PROXY_CONTAINER_ID
+
 echo "Shutting down systemtests container..."
 docker rm -f -v $SYSTEMTESTS_CONTAINER_ID
 
 echo "Shutting down etcd container..."
 docker rm -f -v $ETCD_CONTAINER_NAME
 
+echo "Shutting down etcd v3 container..."
+docker rm -f -v $ETCDV3_CONTAINER_NAME
+
 echo "Shutting down consul container..."
 docker rm -f -v $CONSUL_CONTAINER_NAME
 
+echo "Shutting down consul container with ACLs..."
+docker rm -f -v $CONSUL_ACL_CONTAINER_NAME
+
 echo "Destroying docker network $NETWORK_NAME"
 docker network rm $NETWORK_NAME
 
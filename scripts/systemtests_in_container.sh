@@ -8,8 +8,20 @@ echo ""
 echo "Running systemtests against etcd"
 echo ""
 
+# the first endpoint of the etcd clusters can't be reached, so the clients must
+# fail over to the second one
+
+set -x
+PROXY_ADDRESS=$1 DATASTORE_ADDRESS="etcd://127.0.0.1:2379,etcd://$ETCD_CONTAINER_IP:2379" go test -v -timeout 5m ./systemtests -check.v
+EXIT_CODES+=($?)
+set +x
+
+echo ""
+echo "Running systemtests against etcd v3"
+echo ""
+
 set -x
-PROXY_ADDRESS=$1 DATASTORE_ADDRESS="etcd://$ETCD_CONTAINER_IP:2379" go test -v -timeout 5m ./systemtests -check.v
+PROXY_ADDRESS=$3 DATASTORE_ADDRESS="etcdv3://127.0.0.1:2379,etcdv3://$ETCDV3_CONTAINER_IP:2379" go test -v -timeout 5m ./systemtests -check.v
 EXIT_CODES+=($?)
 set +x
 
@@ -22,6 +34,15 @@ PROXY_ADDRESS=$2 DATASTORE_ADDRESS="consul://$CONSUL_CONTAINER_IP:8500" go test
 EXIT_CODES+=($?)
 set +x
 
+echo ""
+echo "Running systemtests against consul with ACLs"
+echo ""
+
+set -x
+PROXY_ADDRESS=$4 DATASTORE_ADDRESS="consul://$CONSUL_ACL_CONTAINER_IP:8500" CONSUL_HTTP_TOKEN="$CONSUL_ACL_TOKEN" go test -v -timeout 5m ./systemtests -check.v
+EXIT_CODES+=($?)
+set +x
+
 for exit_code in $EXIT_CODES; do
 	if [[ "$exit_code" != "0" ]]; then
 		exit 1
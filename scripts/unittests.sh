@@ -9,13 +9,14 @@
 #
 # 1. builds a unit tests container
 # 2. creates a docker network (all containers are attached to it)
-# 3. starts an etcd container
-# 4. starts a consul container
-# 5. executes ./scripts/unittests_in_container.sh which runs all the unit test
+# 3. starts an etcd container serving the v2 API
+# 4. starts an etcd container serving the v3 API
+# 5. starts a consul container
+# 6. executes ./scripts/unittests_in_container.sh which runs all the unit test
 #    suites against the etcd and consul containers
-# 6. stops etcd container
-# 7. stops consul container
-# 8. destroys the docker network
+# 7. stops etcd containers
+# 8. stops consul container
+# 9. destroys the docker network
 
 set -euo pipefail
 
@@ -50,6 +51,20 @@ ETCD_CONTAINER_ID=$(
 ETCD_CONTAINER_IP=$(ip_for_container $ETCD_CONTAINER_ID)
 echo "etcd running @ $ETCD_CONTAINER_IP:2379"
 
+echo "Starting etcd v3 container..."
+ETCDV3_CONTAINER_NAME="etcdv3_auth_proxy_unittests"
+ETCDV3_CONTAINER_ID=$(
+	docker run -d \
+		--name $ETCDV3_CONTAINER_NAME \
+		--network $NETWORK_NAME \
+		quay.io/coreos/etcd:v3.4.13 \
+		etcd \
+		--listen-client-urls http://0.0.0.0:2379 \
+		--advertise-client-urls http://0.0.0.0:2379
+)
+ETCDV3_CONTAINER_IP=$(ip_for_container $ETCDV3_CONTAINER_ID)
+echo "etcd v3 running @ $ETCDV3_CONTAINER_IP:2379"
+
 echo "Starting consul container..."
 CONSUL_CONTAINER_NAME="consul_auth_proxy_unittests"
 CONSUL_CONTAINER_ID=$(
@@ -76,6 +91,8 @@ docker run --rm \
 	-e CONSUL_CONTAINER_NAME="$CONSUL_CONTAINER_NAME" \
 	-e ETCD_CONTAINER_IP="$ETCD_CONTAINER_IP" \
 	-e ETCD_CONTAINER_NAME="$ETCD_CONTAINER_NAME" \
+	-e ETCDV3_CONTAINER_IP="$ETCDV3_CONTAINER_IP" \
+	-e ETCDV3_CONTAINER_NAME="$ETCDV3_CONTAINER_NAME" \
 	$IMAGE_NAME
 test_exit_code=$?
 
@@ -86,6 +103,9 @@ set -e
 echo "Shutting down etcd container..."
 docker rm -f -v $ETCD_CONTAINER_NAME
 
+echo "Shutting down etcd v3 container..."
+docker rm -f -v $ETCDV3_CONTAINER_NAME
+
 echo "Shutting down consul container..."
 docker rm -f -v $CONSUL_CONTAINER_NAME
 
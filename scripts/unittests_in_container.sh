@@ -3,23 +3,60 @@
 set -uo pipefail
 
 ETCD_ADDRESS="etcd://$ETCD_CONTAINER_IP:2379"
+ETCDV3_ADDRESS="etcdv3://$ETCDV3_CONTAINER_IP:2379"
 CONSUL_ADDRESS="consul://$CONSUL_CONTAINER_IP:8500"
 
 EXIT_CODES=()
 
+echo ""
+echo "===== COMMON TESTS ========================================================"
+echo ""
+
+go test -race -v -timeout 1m ./common/...
+EXIT_CODES+=($?)
+echo ""
+
+echo ""
+echo "===== AUTH TESTS =========================================================="
+echo ""
+
+go test -race -v -timeout 1m ./auth
+EXIT_CODES+=($?)
+go test -race -v -timeout 1m ./auth/local
+EXIT_CODES+=($?)
+go test -race -v -timeout 1m ./auth/kubernetes
+EXIT_CODES+=($?)
+go test -race -v -timeout 1m ./auth/ldap
+EXIT_CODES+=($?)
+echo ""
+
+echo ""
+echo "===== PROXY TESTS ========================================================="
+echo ""
+
+go test -race -v -timeout 1m ./proxy
+EXIT_CODES+=($?)
+echo ""
+
 echo ""
 echo "===== DB TESTS ============================================================"
 echo ""
 
 echo "consul:"
 echo ""
-DATASTORE_ADDRESS=$CONSUL_ADDRESS go test -v -timeout 1m ./db -check.v
+DATASTORE_ADDRESS=$CONSUL_ADDRESS go test -race -v -timeout 1m ./db -check.v
 EXIT_CODES+=($?)
 echo ""
 
 echo "etcd:"
 echo ""
-DATASTORE_ADDRESS=$ETCD_ADDRESS go test -v -timeout 1m ./db -check.v
+DATASTORE_ADDRESS=$ETCD_ADDRESS go test -race -v -timeout 1m ./db -check.v
+EXIT_CODES+=($?)
+echo ""
+
+echo "etcd v3:"
+echo ""
+DATASTORE_ADDRESS=$ETCDV3_ADDRESS go test -race -v -timeout 1m ./db -check.v
 EXIT_CODES+=($?)
 echo ""
 
@@ -27,17 +64,27 @@ echo ""
 echo "===== STATE TESTS ========================================================="
 echo ""
 
+go test -race -run 'TestStateDriver|TestCircuitBreaker|TestLeader' -v -timeout 1m ./state
+EXIT_CODES+=($?)
+echo ""
+
 echo "etcd:"
 echo ""
-DATASTORE_ADDRESS=$ETCD_ADDRESS go test -run TestAuthZ* -v -timeout 1m ./state -check.v
+DATASTORE_ADDRESS=$ETCD_ADDRESS go test -race -run TestAuthZ* -v -timeout 1m ./state -check.v
 EXIT_CODES+=($?)
-DATASTORE_ADDRESS=$ETCD_ADDRESS go test -run TestEtcd* -v -timeout 1m ./state -check.v
+DATASTORE_ADDRESS=$ETCD_ADDRESS go test -race -run TestEtcdStateDriver -v -timeout 1m ./state -check.v
+EXIT_CODES+=($?)
+echo ""
+
+echo "etcd v3:"
+echo ""
+DATASTORE_ADDRESS=$ETCDV3_ADDRESS go test -race -run TestEtcdV3StateDriver -v -timeout 1m ./state -check.v
 EXIT_CODES+=($?)
 echo ""
 
 echo "consul:"
 echo ""
-DATASTORE_ADDRESS=$CONSUL_ADDRESS go test -run TestConsul* -v -timeout 1m ./state -check.v
+DATASTORE_ADDRESS=$CONSUL_ADDRESS go test -race -run TestConsul* -v -timeout 2m ./state -check.v
 EXIT_CODES+=($?)
 echo ""
 
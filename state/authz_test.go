@@ -11,6 +11,7 @@ import (
 
 var (
 	config      types.KVStoreConfig
+	authzDriver types.StateDriver
 	commonState types.CommonState
 	a1, a2      types.Authorization
 )
@@ -24,7 +25,7 @@ func TestAuthZInit(t *testing.T) {
 
 	// create a state driver
 	var err error
-	stateDriver, err = NewStateDriver(EtcdName, &config)
+	authzDriver, err = NewStateDriver(EtcdName, &config)
 	if err != nil {
 		t.Fatal("failed to create a new state driver, err:", err)
 	}
@@ -32,7 +33,7 @@ func TestAuthZInit(t *testing.T) {
 	// create common state
 	commonState = types.CommonState{
 		ID:          "0000",
-		StateDriver: stateDriver,
+		StateDriver: authzDriver,
 	}
 
 	// create two authorizations
@@ -62,7 +63,7 @@ func TestAuthZWrite(t *testing.T) {
 
 	// read authorization
 	readAuthz := &types.Authorization{}
-	readAuthz.StateDriver = stateDriver
+	readAuthz.StateDriver = authzDriver
 	(*readAuthz).Read(a1.UUID)
 
 	// check if the read authz matches the one written
@@ -80,7 +81,7 @@ func TestAuthZClear(t *testing.T) {
 
 	// read the written authz
 	readAuthz := &types.Authorization{}
-	readAuthz.StateDriver = stateDriver
+	readAuthz.StateDriver = authzDriver
 	(*readAuthz).Read(a1.UUID)
 
 	// check if the read authz matches the one written
@@ -94,7 +95,7 @@ func TestAuthZClear(t *testing.T) {
 
 	// try to read the cleared authz
 	readAuthz2 := &types.Authorization{}
-	readAuthz2.StateDriver = stateDriver
+	readAuthz2.StateDriver = authzDriver
 	(*readAuthz2).Read(a1.UUID)
 
 	// expecting read to fail
@@ -114,7 +115,7 @@ func TestAuthZReadAll(t *testing.T) {
 
 	// read all authorizations
 	readAuthz := &types.Authorization{}
-	readAuthz.StateDriver = stateDriver
+	readAuthz.StateDriver = authzDriver
 	aList, err := (*readAuthz).ReadAll()
 	if err != nil {
 		t.Fatal("ReadAll operation failed, err:", err)
@@ -0,0 +1,447 @@
+package state
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains a state driver which wraps another one in a circuit
+// breaker so that requests fail fast while the datastore is unreachable,
+// rather than each of them waiting for the datastore's timeouts.
+
+const (
+	// defaultBreakerThreshold is the number of consecutive failures which opens the breaker
+	defaultBreakerThreshold = 5
+
+	// defaultBreakerCooldown is how long the breaker stays open before a probe is let through
+	defaultBreakerCooldown = 10 * time.Second
+
+	// defaultBreakerCacheEntries is the number of keys, and of ReadAll()
+	// results, which are cached at most; the least recently used ones are
+	// evicted first
+	defaultBreakerCacheEntries = 1024
+)
+
+// BreakerState is the state of a circuit breaker
+type BreakerState string
+
+const (
+	// BreakerClosed means that all calls go to the datastore
+	BreakerClosed BreakerState = "closed"
+
+	// BreakerOpen means that calls fail fast; reads are served from the cache if possible
+	BreakerOpen BreakerState = "open"
+
+	// BreakerHalfOpen means that a single probe call is checking whether the datastore recovered
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// BreakerMetrics describes the state and history of a circuit breaker
+type BreakerMetrics struct {
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	Failures            uint64       `json:"failures"`   // calls which failed because of the datastore
+	Opened              uint64       `json:"opened"`     // number of times the breaker opened
+	Rejected            uint64       `json:"rejected"`   // calls which failed fast
+	CacheHits           uint64       `json:"cache_hits"` // rejected reads which were served from the cache
+}
+
+// CircuitBreakerDriver is a types.StateDriver which passes all calls on to
+// another driver until `threshold` consecutive calls failed. From then on, the
+// breaker is open: writes fail with auth_errors.ErrDatastoreUnavailable and
+// reads return the last value read or written, if there is one. After
+// `cooldown`, a single call is let through to probe the datastore; the breaker
+// closes if it succeeds and opens again otherwise.
+//
+// Only errors which isTransientError() considers transient count as failures;
+// anything else (e.g. ErrKeyNotFound or a value which can't be unmarshalled)
+// is an answer from a working datastore.
+type CircuitBreakerDriver struct {
+	types.StateDriver
+
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time // replaced by tests
+
+	mutex    sync.Mutex
+	metrics  BreakerMetrics
+	openedAt time.Time
+
+	// values of the keys which were read or written through this driver, by
+	// Read() and ReadAll() respectively. they're only used while the breaker
+	// is open; the datastore remains the source of truth otherwise.
+	cache    *lruCache
+	cacheAll *lruCache
+}
+
+// NewCircuitBreakerDriver wraps the given state driver in a circuit breaker.
+// params:
+//  driver: state driver to wrap; it must be initialized already
+//  threshold: number of consecutive failures which opens the breaker
+//  cooldown: time after which an open breaker lets a probe call through
+// return values:
+//  *CircuitBreakerDriver: the wrapping driver, initially closed
+func NewCircuitBreakerDriver(driver types.StateDriver, threshold int, cooldown time.Duration) *CircuitBreakerDriver {
+	return &CircuitBreakerDriver{
+		StateDriver: driver,
+		threshold:   threshold,
+		cooldown:    cooldown,
+		now:         time.Now,
+		metrics:     BreakerMetrics{State: BreakerClosed},
+		cache:       newLRUCache(defaultBreakerCacheEntries),
+		cacheAll:    newLRUCache(defaultBreakerCacheEntries),
+	}
+}
+
+// CircuitBreaker returns the circuit breaker of a state driver as returned by NewStateDriver().
+// params:
+//  drv: state driver; either a CircuitBreakerDriver or a SingleFlightDriver wrapping one
+// return values:
+//  *CircuitBreakerDriver: the circuit breaker
+//  bool: false if the driver has no circuit breaker
+func CircuitBreaker(drv types.StateDriver) (*CircuitBreakerDriver, bool) {
+	if sf, ok := drv.(*SingleFlightDriver); ok {
+		drv = sf.StateDriver
+	}
+
+	breaker, ok := drv.(*CircuitBreakerDriver)
+	return breaker, ok
+}
+
+// Metrics returns a snapshot of the breaker's metrics
+func (b *CircuitBreakerDriver) Metrics() BreakerMetrics {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.metrics
+}
+
+// setState changes the state of the breaker and logs the transition.
+// must be called with the mutex held.
+func (b *CircuitBreakerDriver) setState(state BreakerState) {
+	if b.metrics.State == state {
+		return
+	}
+
+	if state == BreakerClosed {
+		log.Infof("Datastore circuit breaker %s -> %s", b.metrics.State, state)
+	} else {
+		log.Warnf("Datastore circuit breaker %s -> %s after %d consecutive failures",
+			b.metrics.State, state, b.metrics.ConsecutiveFailures)
+	}
+
+	b.metrics.State = state
+}
+
+// allow returns true if a call may go to the datastore; false if it must fail fast
+func (b *CircuitBreakerDriver) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.metrics.State {
+	case BreakerClosed:
+		return true
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) >= b.cooldown {
+			// this call is the probe; everything else fails fast until it's done
+			b.setState(BreakerHalfOpen)
+			return true
+		}
+	}
+
+	b.metrics.Rejected++
+	return false
+}
+
+// done records the outcome of a call which was allowed by allow()
+func (b *CircuitBreakerDriver) done(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !isTransientError(err) {
+		b.metrics.ConsecutiveFailures = 0
+		b.setState(BreakerClosed)
+		return
+	}
+
+	b.metrics.Failures++
+	b.metrics.ConsecutiveFailures++
+
+	if b.metrics.State == BreakerHalfOpen ||
+		(b.metrics.State == BreakerClosed && b.metrics.ConsecutiveFailures >= b.threshold) {
+		b.setState(BreakerOpen)
+		b.openedAt = b.now()
+		b.metrics.Opened++
+	}
+}
+
+// call runs `f` against the datastore unless the breaker is open
+func (b *CircuitBreakerDriver) call(f func() error) error {
+	if !b.allow() {
+		return auth_errors.ErrDatastoreUnavailable
+	}
+
+	err := f()
+	b.done(err)
+
+	return err
+}
+
+// cached returns the cached value of `key`; used when a read was rejected
+func (b *CircuitBreakerDriver) cached(key string) ([]byte, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	value, found := b.cache.get(key)
+	if !found {
+		return nil, false
+	}
+
+	b.metrics.CacheHits++
+	return value.([]byte), true
+}
+
+// cachedAll returns the cached values under `baseKey`; used when a read was rejected
+func (b *CircuitBreakerDriver) cachedAll(baseKey string) ([][]byte, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	values, found := b.cacheAll.get(baseKey)
+	if !found {
+		return nil, false
+	}
+
+	b.metrics.CacheHits++
+	return values.([][]byte), true
+}
+
+// invalidate drops `key` from the cache, along with all the cached ReadAll()
+// results which could contain it. if `value` is not nil, it's cached as the
+// new value of `key`.
+func (b *CircuitBreakerDriver) invalidate(key string, value []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.cache.remove(key)
+	if value != nil {
+		b.cache.put(key, append([]byte{}, value...))
+	}
+
+	b.cacheAll.removeIf(func(baseKey string) bool { return strings.HasPrefix(key, baseKey) })
+}
+
+// Mkdir creates a directory unless the breaker is open
+func (b *CircuitBreakerDriver) Mkdir(key string) error {
+	return b.call(func() error { return b.StateDriver.Mkdir(key) })
+}
+
+// Read returns the value of `key`; the cached value if the breaker is open
+func (b *CircuitBreakerDriver) Read(key string) ([]byte, error) {
+	var value []byte
+
+	err := b.call(func() error {
+		var err error
+		value, err = b.StateDriver.Read(key)
+		return err
+	})
+
+	switch err {
+	case nil:
+		b.invalidate(key, value)
+	case auth_errors.ErrKeyNotFound:
+		b.invalidate(key, nil)
+	case auth_errors.ErrDatastoreUnavailable:
+		if cached, found := b.cached(key); found {
+			return cached, nil
+		}
+	}
+
+	return value, err
+}
+
+// ReadAll returns all values under `baseKey`; the cached values if the breaker is open
+func (b *CircuitBreakerDriver) ReadAll(baseKey string) ([][]byte, error) {
+	var values [][]byte
+
+	err := b.call(func() error {
+		var err error
+		values, err = b.StateDriver.ReadAll(baseKey)
+		return err
+	})
+
+	switch err {
+	case nil:
+		b.mutex.Lock()
+		b.cacheAll.put(baseKey, values)
+		b.mutex.Unlock()
+	case auth_errors.ErrDatastoreUnavailable:
+		if cached, found := b.cachedAll(baseKey); found {
+			return cached, nil
+		}
+	}
+
+	return values, err
+}
+
+// Write writes `value` to `key` unless the breaker is open
+func (b *CircuitBreakerDriver) Write(key string, value []byte) error {
+	err := b.call(func() error { return b.StateDriver.Write(key, value) })
+
+	switch err {
+	case nil:
+		b.invalidate(key, value)
+	case auth_errors.ErrDatastoreUnavailable:
+		// nothing was written
+	default:
+		// the write may or may not have made it
+		b.invalidate(key, nil)
+	}
+
+	return err
+}
+
+// Clear removes `key` unless the breaker is open
+func (b *CircuitBreakerDriver) Clear(key string) error {
+	err := b.call(func() error { return b.StateDriver.Clear(key) })
+	if err != auth_errors.ErrDatastoreUnavailable {
+		b.invalidate(key, nil)
+	}
+
+	return err
+}
+
+// ReadState reads `key` into `value` unless the breaker is open
+func (b *CircuitBreakerDriver) ReadState(key string, value types.State,
+	unmarshal func([]byte, interface{}) error) error {
+
+	return b.call(func() error { return b.StateDriver.ReadState(key, value, unmarshal) })
+}
+
+// ReadAllState reads all states under `baseKey` unless the breaker is open
+func (b *CircuitBreakerDriver) ReadAllState(baseKey string, stateType types.State,
+	unmarshal func([]byte, interface{}) error) ([]types.State, error) {
+
+	var states []types.State
+
+	err := b.call(func() error {
+		var err error
+		states, err = b.StateDriver.ReadAllState(baseKey, stateType, unmarshal)
+		return err
+	})
+
+	return states, err
+}
+
+// WriteState writes `value` to `key` unless the breaker is open
+func (b *CircuitBreakerDriver) WriteState(key string, value types.State,
+	marshal func(interface{}) ([]byte, error)) error {
+
+	err := b.call(func() error { return b.StateDriver.WriteState(key, value, marshal) })
+	if err != auth_errors.ErrDatastoreUnavailable {
+		b.invalidate(key, nil)
+	}
+
+	return err
+}
+
+// ClearState removes `key` unless the breaker is open
+func (b *CircuitBreakerDriver) ClearState(key string) error {
+	err := b.call(func() error { return b.StateDriver.ClearState(key) })
+	if err != auth_errors.ErrDatastoreUnavailable {
+		b.invalidate(key, nil)
+	}
+
+	return err
+}
+
+// AcquireLease acquires or renews the lease `key` unless the breaker is open
+func (b *CircuitBreakerDriver) AcquireLease(key, holder string, ttl time.Duration) (bool, error) {
+	var acquired bool
+
+	err := b.call(func() error {
+		var err error
+		acquired, err = b.StateDriver.AcquireLease(key, holder, ttl)
+		return err
+	})
+
+	return acquired, err
+}
+
+// ReleaseLease releases the lease `key` unless the breaker is open
+func (b *CircuitBreakerDriver) ReleaseLease(key, holder string) error {
+	return b.call(func() error { return b.StateDriver.ReleaseLease(key, holder) })
+}
+
+// lruCache is a map holding at most `max` entries; the least recently used
+// entry is evicted to make room for a new one. it's not safe for concurrent use.
+type lruCache struct {
+	max     int
+	order   *list.List // of *lruEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+// newLRUCache returns an empty cache holding at most `max` entries
+func newLRUCache(max int) *lruCache {
+	return &lruCache{
+		max:     max,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// get returns the value of `key` and marks it as recently used
+func (c *lruCache) get(key string) (interface{}, bool) {
+	elem, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).value, true
+}
+
+// put sets the value of `key`, evicting the least recently used entry if the cache is full
+func (c *lruCache) put(key string, value interface{}) {
+	if elem, found := c.entries[key]; found {
+		elem.Value.(*lruEntry).value = value
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	if c.order.Len() >= c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value})
+}
+
+// remove drops `key` from the cache
+func (c *lruCache) remove(key string) {
+	if elem, found := c.entries[key]; found {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// removeIf drops all keys for which `match` returns true
+func (c *lruCache) removeIf(match func(key string) bool) {
+	for key := range c.entries {
+		if match(key) {
+			c.remove(key)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package state
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+var errConnectionRefused = errors.New("connection refused")
+
+// flakyStateDriver is an in-memory state driver which fails all calls while
+// `down` is set, with `downErr` if set and errConnectionRefused otherwise.
+// `onCall` is called at the start of every call.
+type flakyStateDriver struct {
+	types.StateDriver
+
+	down    bool
+	downErr error
+	calls   int
+	onCall  func()
+	values  map[string][]byte
+}
+
+func newFlakyStateDriver() *flakyStateDriver {
+	return &flakyStateDriver{values: map[string][]byte{}}
+}
+
+func (d *flakyStateDriver) begin() error {
+	d.calls++
+
+	if d.onCall != nil {
+		d.onCall()
+	}
+
+	if d.down && d.downErr != nil {
+		return d.downErr
+	}
+
+	if d.down {
+		return errConnectionRefused
+	}
+
+	return nil
+}
+
+func (d *flakyStateDriver) Read(key string) ([]byte, error) {
+	if err := d.begin(); err != nil {
+		return nil, err
+	}
+
+	value, found := d.values[key]
+	if !found {
+		return nil, auth_errors.ErrKeyNotFound
+	}
+
+	return value, nil
+}
+
+func (d *flakyStateDriver) ReadAll(baseKey string) ([][]byte, error) {
+	if err := d.begin(); err != nil {
+		return nil, err
+	}
+
+	values := [][]byte{}
+	for key, value := range d.values {
+		if strings.HasPrefix(key, baseKey) {
+			values = append(values, value)
+		}
+	}
+
+	return values, nil
+}
+
+func (d *flakyStateDriver) Write(key string, value []byte) error {
+	if err := d.begin(); err != nil {
+		return err
+	}
+
+	d.values[key] = value
+	return nil
+}
+
+func (d *flakyStateDriver) Clear(key string) error {
+	if err := d.begin(); err != nil {
+		return err
+	}
+
+	delete(d.values, key)
+	return nil
+}
+
+// newTestBreaker returns a breaker opening after 3 failures around a flaky
+// driver, and a function to advance the breaker's clock.
+func newTestBreaker() (*CircuitBreakerDriver, *flakyStateDriver, func(time.Duration)) {
+	flaky := newFlakyStateDriver()
+	breaker := NewCircuitBreakerDriver(flaky, 3, 10*time.Second)
+
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	return breaker, flaky, func(d time.Duration) { now = now.Add(d) }
+}
+
+// TestCircuitBreakerTransitions drives the breaker through closed -> open ->
+// half-open -> open -> half-open -> closed.
+func TestCircuitBreakerTransitions(t *testing.T) {
+	breaker, flaky, advance := newTestBreaker()
+
+	if err := breaker.Write("/k", []byte("v")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// missing keys are answers from a working datastore, not failures
+	for i := 0; i < 5; i++ {
+		if _, err := breaker.Read("/missing"); err != auth_errors.ErrKeyNotFound {
+			t.Fatalf("expected ErrKeyNotFound, got %v", err)
+		}
+	}
+
+	if state := breaker.Metrics().State; state != BreakerClosed {
+		t.Fatalf("expected the breaker to be closed, got %q", state)
+	}
+
+	// closed -> open
+	flaky.down = true
+
+	for i := 0; i < 3; i++ {
+		if _, err := breaker.Read("/other"); err != errConnectionRefused {
+			t.Fatalf("expected the driver's error, got %v", err)
+		}
+	}
+
+	metrics := breaker.Metrics()
+	if metrics.State != BreakerOpen || metrics.Opened != 1 || metrics.ConsecutiveFailures != 3 {
+		t.Fatalf("expected the breaker to be open after 3 failures, got %#v", metrics)
+	}
+
+	// open: reads are served from the cache, everything else fails fast
+	calls := flaky.calls
+
+	if value, err := breaker.Read("/k"); err != nil || string(value) != "v" {
+		t.Errorf("expected the cached value, got %q, %v", value, err)
+	}
+
+	if _, err := breaker.Read("/other"); err != auth_errors.ErrDatastoreUnavailable {
+		t.Errorf("expected ErrDatastoreUnavailable for an uncached key, got %v", err)
+	}
+
+	if err := breaker.Write("/k", []byte("new")); err != auth_errors.ErrDatastoreUnavailable {
+		t.Errorf("expected ErrDatastoreUnavailable for a write, got %v", err)
+	}
+
+	if flaky.calls != calls {
+		t.Errorf("expected no calls to the datastore while open, got %d", flaky.calls-calls)
+	}
+
+	metrics = breaker.Metrics()
+	if metrics.Rejected != 3 || metrics.CacheHits != 1 {
+		t.Errorf("expected 3 rejected calls and 1 cache hit, got %#v", metrics)
+	}
+
+	// open -> half-open -> open: the probe fails
+	advance(10 * time.Second)
+
+	if _, err := breaker.Read("/other"); err != errConnectionRefused {
+		t.Fatalf("expected the probe to reach the driver, got %v", err)
+	}
+
+	metrics = breaker.Metrics()
+	if metrics.State != BreakerOpen || metrics.Opened != 2 {
+		t.Fatalf("expected the breaker to open again after a failed probe, got %#v", metrics)
+	}
+
+	// open -> half-open -> closed: the probe succeeds. other calls fail fast
+	// while the probe is in flight.
+	advance(10 * time.Second)
+	flaky.down = false
+
+	probing := true
+	flaky.onCall = func() {
+		if !probing {
+			return
+		}
+		probing = false
+
+		if state := breaker.Metrics().State; state != BreakerHalfOpen {
+			t.Errorf("expected the breaker to be half-open during the probe, got %q", state)
+		}
+
+		if err := breaker.Write("/k", []byte("new")); err != auth_errors.ErrDatastoreUnavailable {
+			t.Errorf("expected ErrDatastoreUnavailable during the probe, got %v", err)
+		}
+	}
+
+	if _, err := breaker.Read("/k"); err != nil {
+		t.Fatalf("expected the probe to succeed, got %v", err)
+	}
+
+	metrics = breaker.Metrics()
+	if metrics.State != BreakerClosed || metrics.ConsecutiveFailures != 0 {
+		t.Fatalf("expected the breaker to be closed after a successful probe, got %#v", metrics)
+	}
+
+	if err := breaker.Write("/k", []byte("new")); err != nil {
+		t.Errorf("expected writes to work again, got %v", err)
+	}
+}
+
+// TestCircuitBreakerCache tests that the cache never returns values which
+// were changed through the breaker
+func TestCircuitBreakerCache(t *testing.T) {
+	breaker, flaky, _ := newTestBreaker()
+
+	breaker.Write("/dir/a", []byte("a"))
+	breaker.Write("/dir/b", []byte("b"))
+	breaker.Write("/gone", []byte("gone"))
+
+	if values, err := breaker.ReadAll("/dir/"); err != nil || len(values) != 2 {
+		t.Fatalf("expected 2 values, got %q, %v", values, err)
+	}
+
+	// changes under a directory invalidate its cached listing
+	breaker.Write("/dir/c", []byte("c"))
+	breaker.Clear("/gone")
+
+	flaky.down = true
+	for i := 0; i < 3; i++ {
+		breaker.Read("/other")
+	}
+
+	if _, err := breaker.ReadAll("/dir/"); err != auth_errors.ErrDatastoreUnavailable {
+		t.Errorf("expected the stale listing to be dropped, got %v", err)
+	}
+
+	if value, err := breaker.Read("/dir/c"); err != nil || string(value) != "c" {
+		t.Errorf("expected the written value, got %q, %v", value, err)
+	}
+
+	if _, err := breaker.Read("/gone"); err != auth_errors.ErrDatastoreUnavailable {
+		t.Errorf("expected the cleared key to be dropped, got %v", err)
+	}
+}
+
+// TestCircuitBreakerPermanentErrors tests that errors which retrying can't fix
+// don't open the breaker
+func TestCircuitBreakerPermanentErrors(t *testing.T) {
+	breaker, flaky, _ := newTestBreaker()
+
+	flaky.down = true
+	flaky.downErr = errors.New("invalid character 'x' looking for beginning of value")
+
+	for i := 0; i < 5; i++ {
+		if _, err := breaker.Read("/k"); err != flaky.downErr {
+			t.Fatalf("expected the driver's error, got %v", err)
+		}
+	}
+
+	metrics := breaker.Metrics()
+	if metrics.State != BreakerClosed || metrics.Failures != 0 {
+		t.Fatalf("expected the breaker to stay closed, got %#v", metrics)
+	}
+}
+
+// TestCircuitBreakerCacheBound tests that the cache evicts the least recently
+// used keys once it's full
+func TestCircuitBreakerCacheBound(t *testing.T) {
+	breaker, flaky, _ := newTestBreaker()
+	breaker.cache = newLRUCache(2)
+
+	breaker.Write("/a", []byte("a"))
+	breaker.Write("/b", []byte("b"))
+	breaker.Read("/a")
+	breaker.Write("/c", []byte("c"))
+
+	flaky.down = true
+	for i := 0; i < 3; i++ {
+		breaker.Read("/other")
+	}
+
+	for key, cached := range map[string]bool{"/a": true, "/b": false, "/c": true} {
+		_, err := breaker.Read(key)
+		if cached && err != nil {
+			t.Errorf("expected %s to be cached, got %v", key, err)
+		} else if !cached && err != auth_errors.ErrDatastoreUnavailable {
+			t.Errorf("expected %s to be evicted, got %v", key, err)
+		}
+	}
+}
@@ -3,12 +3,17 @@ package state
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/hashicorp/consul/api"
+	"golang.org/x/net/context"
 
+	"github.com/contiv/auth_proxy/common"
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
 	"github.com/contiv/auth_proxy/common/types"
 )
@@ -16,6 +21,21 @@ import (
 // Max times to retry in case of failure
 const maxConsulRetries = 10
 
+// consul doesn't accept session TTLs shorter than this
+const minConsulSessionTTL = 10 * time.Second
+
+// consulWatchWaitTime bounds the blocking queries of Watch(), so that stopped
+// watches end within this time
+const consulWatchWaitTime = 30 * time.Second
+
+// consulTokenEnv names the environment variable consul's own tools read their
+// ACL token from; it's used if no token is configured
+const consulTokenEnv = "CONSUL_HTTP_TOKEN"
+
+// consul answers requests denied by its ACLs with a 403; the client only
+// reports it in the error message
+const consulPermissionDenied = "Unexpected response code: 403"
+
 // ConsulStateDriver implements the StateDriver interface for a
 // consul-based distributed key-value store used to store any
 // state information needed by auth_proxy
@@ -23,6 +43,13 @@ type ConsulStateDriver struct {
 
 	// client used to access consul
 	Client *api.Client
+
+	// if set, reads may be answered by any consul server (see queryOptions())
+	allowStaleReads bool
+
+	// sessions holding (or trying to acquire) leases, by lease key and holder
+	sessionsMutex sync.Mutex
+	sessions      map[string]string
 }
 
 //
@@ -41,8 +68,32 @@ func (d *ConsulStateDriver) Init(config *types.KVStoreConfig) error {
 		return errors.New("Invalid consul config")
 	}
 
+	hostPorts, ok := storeHostPorts(config, "consul://")
+	if !ok {
+		return errors.New("Invalid consul config")
+	}
+
+	// the client only knows of one address; its requests go to whichever
+	// endpoint can be reached
+	// the datacenter applies to reads and writes alike
 	cfg := api.Config{
-		Address: strings.TrimPrefix(config.StoreURL, "consul://"),
+		Address:    hostPorts[0],
+		Token:      config.Token,
+		Datacenter: config.Datacenter,
+	}
+
+	d.allowStaleReads = config.AllowStaleReads
+
+	if common.IsEmpty(cfg.Token) {
+		cfg.Token = os.Getenv(consulTokenEnv)
+	}
+
+	if config.TLS != nil {
+		cfg.Scheme = "https"
+	}
+
+	if config.TLS != nil || len(hostPorts) > 1 {
+		cfg.HttpClient = &http.Client{Transport: newFailoverTransport(hostPorts, dataStoreTransport(config))}
 	}
 
 	// create a consul client
@@ -52,8 +103,12 @@ func (d *ConsulStateDriver) Init(config *types.KVStoreConfig) error {
 	}
 
 	for _, dir := range types.DatastoreDirectories {
-		// consul directories are created by appending a slash
-		d.Mkdir(dir + "/")
+		// consul directories are created by appending a slash; nothing works
+		// if consul's ACLs deny it, so fail right away
+		if err := d.Mkdir(dir + "/"); err == auth_errors.ErrDatastoreAccessDenied {
+			return fmt.Errorf("consul %s denied access to %q: check that its ACL token (--consul-token or %s) grants write access to the %q key prefix",
+				cfg.Address, dir+"/", consulTokenEnv, dir+"/")
+		}
 	}
 
 	return nil
@@ -63,6 +118,17 @@ func (d *ConsulStateDriver) Init(config *types.KVStoreConfig) error {
 func (d *ConsulStateDriver) Deinit() {
 }
 
+//
+// queryOptions returns the options of reads; writes use the defaults, so they
+// are always handled by the leader
+//
+// Return values:
+//   *api.QueryOptions: options allowing stale reads if so configured
+//
+func (d *ConsulStateDriver) queryOptions() *api.QueryOptions {
+	return &api.QueryOptions{AllowStale: d.allowStaleReads}
+}
+
 // Mkdir creates a directory.  If it already exists, this is a no-op.
 //
 // Parameters:
@@ -99,7 +165,7 @@ func (d *ConsulStateDriver) Mkdir(key string) error {
 			}
 		}
 
-		return err
+		return consulError(key, err)
 	}
 
 }
@@ -145,7 +211,7 @@ func (d *ConsulStateDriver) Write(key string, value []byte) error {
 		}
 	}
 
-	return err
+	return consulError(key, err)
 }
 
 //
@@ -161,12 +227,12 @@ func (d *ConsulStateDriver) Write(key string, value []byte) error {
 //
 func (d *ConsulStateDriver) Read(key string) ([]byte, error) {
 	key = processKey(key)
-	kv, _, err := d.Client.KV().Get(key, nil)
+	kv, _, err := d.Client.KV().Get(key, d.queryOptions())
 	if err != nil {
 		if api.IsServerError(err) || strings.Contains(err.Error(), "EOF") ||
 			strings.Contains(err.Error(), "connection refused") {
 			for i := 0; i < maxConsulRetries; i++ {
-				kv, _, err = d.Client.KV().Get(key, nil)
+				kv, _, err = d.Client.KV().Get(key, d.queryOptions())
 				if err == nil {
 					break
 				}
@@ -175,7 +241,7 @@ func (d *ConsulStateDriver) Read(key string) ([]byte, error) {
 				time.Sleep(time.Second)
 			}
 		} else {
-			return []byte{}, err
+			return []byte{}, consulError(key, err)
 		}
 	}
 
@@ -202,9 +268,9 @@ func (d *ConsulStateDriver) Read(key string) ([]byte, error) {
 func (d *ConsulStateDriver) ReadAll(baseKey string) ([][]byte, error) {
 	baseKey = processKey(baseKey)
 
-	kvs, _, err := d.Client.KV().List(baseKey, nil)
+	kvs, _, err := d.Client.KV().List(baseKey, d.queryOptions())
 	if err != nil {
-		return nil, err
+		return nil, consulError(baseKey, err)
 	}
 	// Consul returns success and a nil kv when a key is not found,
 	// translate it to 'Key not found' error
@@ -321,10 +387,10 @@ func (d *ConsulStateDriver) WatchAll(baseKey string, chValueChanges chan [2][]by
 
 	// read with index=0 to fetch all existing keys
 	var waitIndex uint64
-	kvs, qm, err := d.Client.KV().List(baseKey, &api.QueryOptions{WaitIndex: waitIndex})
+	kvs, qm, err := d.Client.KV().List(baseKey, &api.QueryOptions{WaitIndex: waitIndex, AllowStale: d.allowStaleReads})
 	if err != nil {
 		log.Errorf("consul read failed for key %q. Error: %s", baseKey, err)
-		return err
+		return consulError(baseKey, err)
 	}
 
 	// Consul returns success and a nil kv when a key is not found.
@@ -345,7 +411,7 @@ func (d *ConsulStateDriver) WatchAll(baseKey string, chValueChanges chan [2][]by
 		case err := <-chErr:
 			return err
 		default:
-			kvs, qm, err := d.Client.KV().List(baseKey, &api.QueryOptions{WaitIndex: waitIndex})
+			kvs, qm, err := d.Client.KV().List(baseKey, &api.QueryOptions{WaitIndex: waitIndex, AllowStale: d.allowStaleReads})
 			if err != nil {
 				if api.IsServerError(err) || strings.Contains(err.Error(), "EOF") || strings.Contains(err.Error(), "connection refused") {
 					log.Warnf("Consul watch: server error: %v for %s. Retrying..", err, baseKey)
@@ -354,7 +420,7 @@ func (d *ConsulStateDriver) WatchAll(baseKey string, chValueChanges chan [2][]by
 				} else {
 					log.Errorf("consul watch failed for key %q. Error: %s. stopping watch..", baseKey, err)
 					chStop <- true
-					return err
+					return consulError(baseKey, err)
 				}
 			}
 			// Consul returns success and a nil kv when a key is not found.
@@ -383,7 +449,7 @@ func (d *ConsulStateDriver) WatchAll(baseKey string, chValueChanges chan [2][]by
 func (d *ConsulStateDriver) Clear(key string) error {
 	key = processKey(key)
 	_, err := d.Client.KV().Delete(key, nil)
-	return err
+	return consulError(key, err)
 }
 
 //
@@ -480,6 +546,108 @@ func (d *ConsulStateDriver) WatchAllState(baseKey string, sType types.State,
 
 }
 
+//
+// Watch streams the changes to the keys below a directory in consul; see
+// types.StateDriver. The changes are followed with blocking queries.
+//
+// Parameters:
+//   prefix: directory whose keys are watched
+//
+// Return values:
+//   <-chan types.WatchEvent: the changes; closed once the watch stopped
+//   func():                  stops the watch
+//
+func (d *ConsulStateDriver) Watch(prefix string) (<-chan types.WatchEvent, func()) {
+	return watchPrefix(d, context.Background(), strings.Trim(processKey(prefix), "/")+"/")
+}
+
+//
+// consulValues returns the values of the given keys by key, leaving out directories
+//
+// Parameters:
+//   kvs: keys returned by consul
+//
+// Return values:
+//   map[string][]byte: the values by key (see watchEventKey())
+//
+func consulValues(kvs api.KVPairs) map[string][]byte {
+	values := map[string][]byte{}
+
+	for _, kv := range kvs {
+		if !strings.HasSuffix(kv.Key, "/") {
+			values[watchEventKey(kv.Key)] = kv.Value
+		}
+	}
+
+	return values
+}
+
+//
+// listPrefix returns the values of the keys below a directory, see prefixWatcher
+//
+// Parameters:
+//   prefix: prefix of the keys, ending with a slash
+//
+// Return values:
+//   map[string][]byte: the values by key
+//   uint64:            consul's index when they were read
+//   error:             Error when reading from consul
+//
+func (d *ConsulStateDriver) listPrefix(prefix string) (map[string][]byte, uint64, error) {
+	kvs, qm, err := d.Client.KV().List(prefix, d.queryOptions())
+	if err != nil {
+		return nil, 0, consulError(prefix, err)
+	}
+
+	return consulValues(kvs), qm.LastIndex, nil
+}
+
+//
+// followPrefix reports the changes to the keys below a directory, see
+// prefixWatcher. Blocking queries only tell the current values of the keys,
+// so the changes are the differences with the values known.
+//
+// Parameters:
+//   ctx:    stops following the changes when done; a blocking query which is
+//           running finishes first, within consulWatchWaitTime
+//   prefix: prefix of the keys, ending with a slash
+//   index:  consul index after which the changes are reported
+//   known:  values reported so far by key
+//   change: called with each change; nil values for deletions
+//
+// Return values:
+//   uint64: index to resume from
+//   error:  Error when reading from consul
+//
+func (d *ConsulStateDriver) followPrefix(ctx context.Context, prefix string, index uint64, known map[string][]byte,
+	change func(key string, value []byte) bool) (uint64, error) {
+
+	for ctx.Err() == nil {
+		kvs, qm, err := d.Client.KV().List(prefix, &api.QueryOptions{
+			WaitIndex:  index,
+			WaitTime:   consulWatchWaitTime,
+			AllowStale: d.allowStaleReads,
+		})
+		if err != nil {
+			return index, consulError(prefix, err)
+		}
+
+		// consul's index may go backwards, e.g. when its servers were
+		// restored; the next query then returns right away
+		if qm.LastIndex < index {
+			index = 0
+		} else {
+			index = qm.LastIndex
+		}
+
+		if !reportDifferences(known, consulValues(kvs), change) {
+			break
+		}
+	}
+
+	return index, nil
+}
+
 //
 // WriteState writes state for a key into the consul KV store
 //
@@ -504,3 +672,132 @@ func (d *ConsulStateDriver) WriteState(key string, value types.State,
 
 	return d.Write(key, encodedState)
 }
+
+//
+// AcquireLease acquires `key` using a session with a TTL, which is renewed if
+// it exists already. The key is deleted once the session expires.
+// Consul doesn't accept TTLs shorter than 10 seconds, and only removes the
+// key up to twice the TTL after the session was last renewed.
+//
+// Parameters:
+//   key:    key of the lease
+//   holder: value identifying the holder of the lease
+//   ttl:    time after which the key is removed unless it's acquired again
+//
+// Return values:
+//   bool:  true if `holder` holds the lease
+//   error: Error returned by consul client when renewing or creating the
+//          session, or when acquiring the key
+//
+func (d *ConsulStateDriver) AcquireLease(key, holder string, ttl time.Duration) (bool, error) {
+	key = processKey(key)
+
+	d.sessionsMutex.Lock()
+	defer d.sessionsMutex.Unlock()
+
+	session, err := d.leaseSession(key, holder, ttl)
+	if err != nil {
+		return false, consulError(key, err)
+	}
+
+	acquired, _, err := d.Client.KV().Acquire(&api.KVPair{Key: key, Value: []byte(holder), Session: session}, nil)
+	return acquired, consulError(key, err)
+}
+
+//
+// leaseSession renews the session used by `holder` to hold `key`, or creates
+// a new one if there's none or it expired; sessionsMutex must be held
+//
+// Parameters:
+//   key:    key of the lease
+//   holder: value identifying the holder of the lease
+//   ttl:    TTL of the session
+//
+// Return values:
+//   string: ID of the session
+//   error:  Error returned by consul client when renewing or creating the session
+//
+func (d *ConsulStateDriver) leaseSession(key, holder string, ttl time.Duration) (string, error) {
+	if d.sessions == nil {
+		d.sessions = map[string]string{}
+	}
+
+	id, found := d.sessions[key+"/"+holder]
+	if found {
+		entry, _, err := d.Client.Session().Renew(id, nil)
+		if err != nil {
+			return "", err
+		} else if entry != nil {
+			return id, nil
+		}
+	}
+
+	if ttl < minConsulSessionTTL {
+		ttl = minConsulSessionTTL
+	}
+
+	// a zero lock delay means consul's default of 15 seconds, which would keep
+	// others from acquiring the key for that long after the session expired
+	id, _, err := d.Client.Session().Create(&api.SessionEntry{
+		Name:      holder,
+		TTL:       ttl.String(),
+		Behavior:  api.SessionBehaviorDelete,
+		LockDelay: time.Millisecond,
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	d.sessions[key+"/"+holder] = id
+	return id, nil
+}
+
+//
+// ReleaseLease destroys the session used by `holder` to hold `key`, which
+// deletes the key if it's held by the session
+//
+// Parameters:
+//   key:    key of the lease
+//   holder: value identifying the holder of the lease
+//
+// Return value:
+//   error: Error returned by consul client when destroying the session
+//
+func (d *ConsulStateDriver) ReleaseLease(key, holder string) error {
+	key = processKey(key)
+
+	d.sessionsMutex.Lock()
+	defer d.sessionsMutex.Unlock()
+
+	id, found := d.sessions[key+"/"+holder]
+	if !found {
+		return nil
+	}
+
+	delete(d.sessions, key+"/"+holder)
+
+	_, err := d.Client.Session().Destroy(id, nil)
+	return consulError(key, err)
+}
+
+//
+// consulError turns the error of a request denied by consul's ACLs into
+// auth_errors.ErrDatastoreAccessDenied, after logging which key it was about
+//
+// Parameters:
+//   key: key the request was about
+//   err: error returned by the consul client
+//
+// Return value:
+//   error: auth_errors.ErrDatastoreAccessDenied if consul's ACLs denied the
+//          request, else `err`
+//
+func consulError(key string, err error) error {
+	if err == nil || !strings.Contains(err.Error(), consulPermissionDenied) {
+		return err
+	}
+
+	log.Errorf("consul denied access to key %q (%s): check that its ACL token (--consul-token or %s) grants access to it",
+		key, err, consulTokenEnv)
+	return auth_errors.ErrDatastoreAccessDenied
+}
@@ -1,9 +1,14 @@
 package state
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
 	"github.com/contiv/auth_proxy/common/types"
 )
 
@@ -31,6 +36,116 @@ func TestConsulStateDriverInitInvalidConfig(t *testing.T) {
 	commonTestStateDriverInitInvalidConfig(t, driver)
 }
 
+// Test that requests denied by consul's ACLs fail with a distinct error, and
+// that the ACL token is taken from the configuration or the environment
+func TestConsulStateDriverAccessDenied(t *testing.T) {
+	const token = "s3cr3t"
+
+	// a consul which only knows the keys created by Init()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("X-Consul-Token") != token:
+			http.Error(w, "Permission denied", http.StatusForbidden)
+		case r.Method == "PUT":
+			w.Write([]byte("true"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	storeURL := "consul://" + strings.TrimPrefix(server.URL, "http://")
+
+	defer os.Setenv(consulTokenEnv, os.Getenv(consulTokenEnv))
+	os.Unsetenv(consulTokenEnv)
+
+	driver := &ConsulStateDriver{}
+	if err := driver.Init(&types.KVStoreConfig{StoreURL: storeURL}); err == nil || !strings.Contains(err.Error(), "ACL token") {
+		t.Fatalf("expected driver init without a token to fail pointing at the ACL token, got %v", err)
+	}
+
+	if err := driver.Init(&types.KVStoreConfig{StoreURL: storeURL, Token: "wrong"}); err == nil {
+		t.Fatalf("driver init succeeded with the wrong token, should have failed.")
+	}
+
+	if _, err := driver.Read("/auth_proxy/local_users/admin"); err != auth_errors.ErrDatastoreAccessDenied {
+		t.Fatalf("expected reads with the wrong token to be denied, got %v", err)
+	}
+
+	if err := driver.Write("/auth_proxy/local_users/admin", []byte("{}")); err != auth_errors.ErrDatastoreAccessDenied {
+		t.Fatalf("expected writes with the wrong token to be denied, got %v", err)
+	}
+
+	if err := driver.Init(&types.KVStoreConfig{StoreURL: storeURL, Token: token}); err != nil {
+		t.Fatalf("driver init failed with the right token, err: %s", err)
+	}
+
+	if _, err := driver.Read("/auth_proxy/local_users/admin"); err != auth_errors.ErrKeyNotFound {
+		t.Fatalf("expected reads with the right token to be allowed, got %v", err)
+	}
+
+	os.Setenv(consulTokenEnv, token)
+
+	if err := driver.Init(&types.KVStoreConfig{StoreURL: storeURL}); err != nil {
+		t.Fatalf("driver init failed with the token set in %s, err: %s", consulTokenEnv, err)
+	}
+}
+
+// Test that the datacenter applies to all requests and stale reads only to
+// reads, and that neither is set by default
+func TestConsulStateDriverQueryOptions(t *testing.T) {
+	// a consul recording the query of the last request by method
+	queries := map[string]url.Values{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries[r.Method] = r.URL.Query()
+
+		if r.Method == "PUT" {
+			w.Write([]byte("true"))
+		} else {
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	storeURL := "consul://" + strings.TrimPrefix(server.URL, "http://")
+
+	driver := &ConsulStateDriver{}
+	if err := driver.Init(&types.KVStoreConfig{StoreURL: storeURL, Datacenter: "dc2", AllowStaleReads: true}); err != nil {
+		t.Fatalf("driver init failed, err: %s", err)
+	}
+
+	driver.Read("/auth_proxy/local_users/admin")
+	if queries["GET"].Get("dc") != "dc2" || !hasQueryParam(queries["GET"], "stale") {
+		t.Errorf("expected reads to be pinned to dc2 and allowed to be stale, got %v", queries["GET"])
+	}
+
+	driver.ReadAll("/auth_proxy/local_users")
+	if !hasQueryParam(queries["GET"], "stale") {
+		t.Errorf("expected lists to be allowed to be stale, got %v", queries["GET"])
+	}
+
+	driver.Write("/auth_proxy/local_users/admin", []byte("{}"))
+	if queries["PUT"].Get("dc") != "dc2" || hasQueryParam(queries["PUT"], "stale") {
+		t.Errorf("expected writes to be pinned to dc2 and consistent, got %v", queries["PUT"])
+	}
+
+	// by default, consul picks the datacenter and reads are consistent
+	if err := driver.Init(&types.KVStoreConfig{StoreURL: storeURL}); err != nil {
+		t.Fatalf("driver init failed, err: %s", err)
+	}
+
+	driver.Read("/auth_proxy/local_users/admin")
+	if hasQueryParam(queries["GET"], "dc") || hasQueryParam(queries["GET"], "stale") {
+		t.Errorf("expected reads without datacenter and consistent by default, got %v", queries["GET"])
+	}
+}
+
+// hasQueryParam returns true if the given query has the parameter, even without a value
+func hasQueryParam(query url.Values, param string) bool {
+	_, found := query[param]
+	return found
+}
+
 // Test to check directory creation in KV store
 func TestConsulStateDriverMkdir(t *testing.T) {
 	driver := setupConsulDriver(t)
@@ -107,3 +222,21 @@ func TestConsulStateDriverWatchAllStateDelete(t *testing.T) {
 	driver := setupConsulDriver(t)
 	commonTestStateDriverWatchAllStateDelete(t, driver)
 }
+
+// Test to watch the changes to keys in KV store
+func TestConsulStateDriverWatch(t *testing.T) {
+	driver := setupConsulDriver(t)
+	commonTestStateDriverWatch(t, driver)
+}
+
+// Test to check leases in KV store; consul removes keys up to twice the TTL
+// after their session was last renewed
+func TestConsulStateDriverLease(t *testing.T) {
+	driver := setupConsulDriver(t)
+	commonTestStateDriverLease(t, driver, minConsulSessionTTL, minConsulSessionTTL)
+}
+
+// Test to check that a follower takes over when the leader goes away
+func TestConsulStateDriverLeaderFailover(t *testing.T) {
+	commonTestLeaderFailover(t, setupConsulDriver(t), setupConsulDriver(t), minConsulSessionTTL, minConsulSessionTTL)
+}
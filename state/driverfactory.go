@@ -1,10 +1,17 @@
 package state
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
 
 	"github.com/contiv/auth_proxy/common"
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
@@ -21,23 +28,33 @@ var stateDriverRegistry = map[string]driver{
 	EtcdName: {
 		Type: reflect.TypeOf(EtcdStateDriver{}),
 	},
+	EtcdV3Name: {
+		Type: reflect.TypeOf(EtcdV3StateDriver{}),
+	},
 	ConsulName: {
 		Type: reflect.TypeOf(ConsulStateDriver{}),
 	},
 }
 
-// this helps for the singleton behavior
+// this helps for the singleton behavior; the driver is read from request
+// goroutines, so it must only be accessed while holding stateDriverMutex
 var (
-	stateDriver types.StateDriver
+	stateDriverMutex sync.RWMutex
+	stateDriver      types.StateDriver
 )
 
 const (
 	// EtcdName is a string constant for etcd state-store
 	EtcdName = "etcd"
+	// EtcdV3Name is a string constant for etcd state-store accessed using the v3 API
+	EtcdV3Name = "etcdv3"
 	// ConsulName is a string constant for consul state-store
 	ConsulName = "consul"
 )
 
+// dataStoreDialTimeout bounds connecting to the data store, including the TLS handshake
+const dataStoreDialTimeout = 10 * time.Second
+
 // initHelper initializes the StateDriver by mapping driver names to actual driver objects
 // params:
 //  driverRegistry: map of driver name and driver type
@@ -59,12 +76,16 @@ func initHelper(driverRegistry map[string]driver, driverName string) (interface{
 //  name: Name of the state driver. e.g. `etcd` or `consul`
 //  config: configuration required to instantiate state driver
 // return values:
-//  returns types.StateDriver on successful instantiation or any relevant error
+//  returns types.StateDriver (wrapped in a RetryDriver, a CircuitBreakerDriver and a SingleFlightDriver)
+//  on successful instantiation or any relevant error
 func NewStateDriver(name string, config *types.KVStoreConfig) (types.StateDriver, error) {
 	if common.IsEmpty(name) || nil == config {
 		return nil, errors.New("Empty driver name or configuration")
 	}
 
+	stateDriverMutex.Lock()
+	defer stateDriverMutex.Unlock()
+
 	if stateDriver != nil {
 		return nil, fmt.Errorf("StateDriver instance already exists %#v", stateDriver)
 	}
@@ -74,11 +95,18 @@ func NewStateDriver(name string, config *types.KVStoreConfig) (types.StateDriver
 		return nil, err
 	}
 
-	stateDriver = drv.(types.StateDriver)
-	if err := stateDriver.Init(config); err != nil {
+	// only publish the driver once it's usable
+	newDriver := drv.(types.StateDriver)
+	if err := newDriver.Init(config); err != nil {
 		return nil, err
 	}
 
+	// ride out brief outages (e.g. etcd restarting), fail fast rather than
+	// piling up requests while the datastore stays down, and let concurrent
+	// identical reads share a round trip (and a breaker call)
+	retry := NewRetryDriver(newDriver, defaultRetryAttempts, defaultRetryBudget)
+	breaker := NewCircuitBreakerDriver(retry, defaultBreakerThreshold, defaultBreakerCooldown)
+	stateDriver = NewSingleFlightDriver(breaker)
 	return stateDriver, nil
 }
 
@@ -87,6 +115,9 @@ func NewStateDriver(name string, config *types.KVStoreConfig) (types.StateDriver
 //  types.StateDriver: if its already instantiated
 //  error: auth_errors.ErrStateDriverNotCreated
 func GetStateDriver() (types.StateDriver, error) {
+	stateDriverMutex.RLock()
+	defer stateDriverMutex.RUnlock()
+
 	if stateDriver == nil {
 		return nil, auth_errors.ErrStateDriverNotCreated
 	}
@@ -94,23 +125,228 @@ func GetStateDriver() (types.StateDriver, error) {
 	return stateDriver, nil
 }
 
-// InitializeStateDriver initializes the state driver based on the given data store address
+// ReleaseStateDriver deinitializes the singleton instance of state-driver so
+// that a new one can be created; mainly used by tests.
+func ReleaseStateDriver() {
+	stateDriverMutex.Lock()
+	defer stateDriverMutex.Unlock()
+
+	if stateDriver != nil {
+		stateDriver.Deinit()
+		stateDriver = nil
+	}
+}
+
+// DriverOptions holds how InitializeStateDriver() connects to the data store
+type DriverOptions struct {
+	TLS                   *common.DataStoreTLSOptions // files and options used to connect to an https data store; nil for none
+	ConsulToken           string                      // ACL token used to access consul; $CONSUL_HTTP_TOKEN is used if empty
+	ConsulDatacenter      string                      // consul datacenter the keys are kept in; the agent's if empty
+	ConsulAllowStaleReads bool                        // if set, consul reads may be answered by any server, not only the leader
+	StartupTimeout        time.Duration               // how long to keep trying to reach the data store; 0 to try once
+}
+
+// InitializeStateDriver initializes the state driver based on the given data
+// store address, and checks that the data store can be reached. If it can't,
+// e.g. because it's still starting up, it's tried again with backoff until
+// options.StartupTimeout has passed. The address may list the endpoints of a
+// cluster, which all use the same scheme; the data store can be reached as
+// long as one of them can.
 // params:
-//  dataStoreAddress: address of the data store
+//  dataStoreAddress: address of the data store, e.g. etcd://host:2379, etcd+https://host:2379
+//                    or etcd://host1:2379,etcd://host2:2379
+//  options: how to connect to the data store; nil for the defaults
 // return values:
-//  returns any error as NewStateDriver() + validation errors
-func InitializeStateDriver(dataStoreAddress string) error {
+//  returns any error as NewStateDriver() + validation errors, the failure to
+//  read the TLS files or to complete the TLS handshake naming the data store,
+//  and the last failure to reach the data store listing the endpoints tried
+func InitializeStateDriver(dataStoreAddress string, options *DriverOptions) error {
 	if common.IsEmpty(dataStoreAddress) {
 		return errors.New("Empty data store address, please set --data-store-address")
 	}
 
-	if strings.HasPrefix(dataStoreAddress, EtcdName+"://") {
-		_, err := NewStateDriver(EtcdName, &types.KVStoreConfig{StoreURL: dataStoreAddress})
-		return err
-	} else if strings.HasPrefix(dataStoreAddress, ConsulName+"://") {
-		_, err := NewStateDriver(ConsulName, &types.KVStoreConfig{StoreURL: dataStoreAddress})
+	if options == nil {
+		options = &DriverOptions{}
+	}
+
+	name, hostPorts, secure, err := common.ParseDataStoreAddresses(dataStoreAddress)
+	if err != nil {
+		return fmt.Errorf("Invalid data store address: %s", err.Error())
+	}
+
+	if _, found := stateDriverRegistry[name]; !found {
+		return errors.New("Invalid data store address")
+	}
+
+	if !common.IsEmpty(options.ConsulToken) && name != ConsulName {
+		return fmt.Errorf("A consul token is set but the data store address %s isn't consul's", dataStoreAddress)
+	}
+
+	if (!common.IsEmpty(options.ConsulDatacenter) || options.ConsulAllowStaleReads) && name != ConsulName {
+		return fmt.Errorf("A consul datacenter or stale reads are set but the data store address %s isn't consul's", dataStoreAddress)
+	}
+
+	endpoints := []string{}
+	for _, hostPort := range hostPorts {
+		endpoints = append(endpoints, name+"://"+hostPort)
+	}
+
+	config := &types.KVStoreConfig{
+		StoreURL:        strings.Join(endpoints, common.DataStoreEndpointSeparator),
+		Token:           options.ConsulToken,
+		Datacenter:      options.ConsulDatacenter,
+		AllowStaleReads: options.ConsulAllowStaleReads,
+	}
+
+	// used in messages
+	hostPort := strings.Join(hostPorts, ", ")
+
+	if secure {
+		if config.TLS, err = common.DataStoreTLSConfig(hostPort, options.TLS); err != nil {
+			return err
+		}
+	} else if !options.TLS.IsEmpty() {
+		return fmt.Errorf("Data store TLS options are set but the data store address %s doesn't use %s", dataStoreAddress, common.DataStoreHTTPSSuffix)
+	}
+
+	deadline := time.Now().Add(options.StartupTimeout)
+
+	for retry := 0; ; retry++ {
+		err := connectStateDriver(name, hostPorts, config)
+		if err == nil {
+			if retry > 0 {
+				log.Infof("Reached data store %s", hostPort)
+			}
+
+			return nil
+		}
+
+		delay := backoff(retry, defaultRetryBaseDelay, defaultRetryMaxDelay)
+		if !isTransientError(err) || time.Now().Add(delay).After(deadline) {
+			return err
+		}
+
+		if retry == 0 {
+			log.Warnf("Data store %s can't be reached yet, retrying for up to %s: %s", hostPort, options.StartupTimeout, err)
+		} else {
+			log.Debugf("Data store %s can't be reached yet, retrying in %s: %s", hostPort, delay, err)
+		}
+
+		time.Sleep(delay)
+	}
+}
+
+// connectStateDriver creates the state driver and checks that it can reach the data store
+// params:
+//  name: name of the state driver
+//  hostPorts: host:port of each endpoint of the data store
+//  config: configuration of the state driver
+// return values:
+//  error: nil if the state driver was created and got an answer from the data
+//         store; no state driver is left behind otherwise
+func connectStateDriver(name string, hostPorts []string, config *types.KVStoreConfig) error {
+	hostPort := strings.Join(hostPorts, ", ")
+
+	// the clients only connect on first use, so check the certificates now
+	if config.TLS != nil {
+		if err := checkDataStoreHandshakes(hostPorts, config.TLS); err != nil {
+			return err
+		}
+	}
+
+	drv, err := NewStateDriver(name, config)
+	if err != nil {
 		return err
 	}
 
-	return errors.New("Invalid data store address")
+	// a missing key is an answer too
+	if _, err := drv.ReadAll(types.AuthZDir); err != nil && isTransientError(err) {
+		ReleaseStateDriver()
+		if len(hostPorts) > 1 {
+			return fmt.Errorf("Failed to reach any of the data store endpoints %s: %s", hostPort, err.Error())
+		}
+
+		return fmt.Errorf("Failed to reach data store %s: %s", hostPort, err.Error())
+	}
+
+	return nil
+}
+
+// checkDataStoreHandshakes checks the TLS handshake with each endpoint of the
+// data store; the endpoints which can't be reached are skipped as long as one can
+// params:
+//  hostPorts: host:port of each endpoint of the data store
+//  config: the TLS configuration
+// return values:
+//  error: nil if the handshake succeeded with an endpoint and didn't fail with
+//         any which could be reached, else the failure naming the endpoint
+//         (or listing them if none could be reached)
+func checkDataStoreHandshakes(hostPorts []string, config *tls.Config) error {
+	unreachable := []string{}
+
+	for _, hostPort := range hostPorts {
+		err := checkDataStoreHandshake(hostPort, config)
+		if err == nil {
+			continue
+		}
+
+		if !isTransientError(err) || len(hostPorts) == 1 {
+			return err
+		}
+
+		unreachable = append(unreachable, err.Error())
+	}
+
+	if len(unreachable) == len(hostPorts) {
+		return errors.New(strings.Join(unreachable, "; "))
+	}
+
+	return nil
+}
+
+// checkDataStoreHandshake connects to the data store to check that the TLS
+// handshake succeeds with the given configuration
+// params:
+//  hostPort: host:port of the data store
+//  config: the TLS configuration
+// return values:
+//  error: nil if the handshake succeeded, else the failure naming the data store
+func checkDataStoreHandshake(hostPort string, config *tls.Config) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: dataStoreDialTimeout}, "tcp", hostPort, config)
+	if err != nil {
+		return fmt.Errorf("TLS handshake with data store %s failed: %s", hostPort, err.Error())
+	}
+
+	return conn.Close()
+}
+
+// dataStoreScheme returns the scheme of the URLs of the data store
+// params:
+//  config: configuration of the data store
+// return values:
+//  string: "https://" if the data store is connected to over TLS, else "http://"
+func dataStoreScheme(config *types.KVStoreConfig) string {
+	if config.TLS != nil {
+		return "https://"
+	}
+
+	return "http://"
+}
+
+// dataStoreTransport returns a transport for the clients of the data store,
+// like http.DefaultTransport but using the data store's TLS configuration
+// params:
+//  config: configuration of the data store
+// return values:
+//  *http.Transport: the transport
+func dataStoreTransport(config *types.KVStoreConfig) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSClientConfig:     config.TLS,
+		TLSHandshakeTimeout: dataStoreDialTimeout,
+	}
 }
@@ -0,0 +1,213 @@
+package state
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+const fakeName = "fake"
+
+// fakeStateDriver is a state driver which doesn't need a datastore; only
+// Init() and Deinit() are implemented. Deinit() leaves `initialized` alone
+// since readers may still hold on to a released driver.
+type fakeStateDriver struct {
+	types.StateDriver
+	initialized bool
+	config      *types.KVStoreConfig
+}
+
+func (d *fakeStateDriver) Init(config *types.KVStoreConfig) error {
+	d.initialized = true
+	d.config = config
+	return nil
+}
+
+func (d *fakeStateDriver) Deinit() {}
+
+func (d *fakeStateDriver) ReadAll(baseKey string) ([][]byte, error) {
+	return nil, auth_errors.ErrKeyNotFound
+}
+
+// TestStateDriverConcurrency tests that the state driver singleton can be
+// created, read and released from multiple goroutines; run it with -race
+func TestStateDriverConcurrency(t *testing.T) {
+	stateDriverRegistry[fakeName] = driver{Type: reflect.TypeOf(fakeStateDriver{})}
+	defer delete(stateDriverRegistry, fakeName)
+	defer ReleaseStateDriver()
+
+	config := &types.KVStoreConfig{StoreURL: "fake://"}
+
+	if _, err := NewStateDriver(fakeName, config); err != nil {
+		t.Fatalf("failed to create the state driver: %s", err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 200; j++ {
+				// the driver is either missing or fully initialized; never half-way
+				drv, err := GetStateDriver()
+				if err != nil {
+					continue
+				}
+
+				breaker, _ := CircuitBreaker(drv)
+				if !breaker.StateDriver.(*RetryDriver).StateDriver.(*fakeStateDriver).initialized {
+					t.Error("got a state driver which isn't initialized")
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		ReleaseStateDriver()
+
+		if _, err := NewStateDriver(fakeName, config); err != nil {
+			t.Errorf("failed to recreate the state driver: %s", err)
+		}
+	}
+
+	wg.Wait()
+}
+
+// TestInitializeStateDriverTLS tests that https data stores are only connected
+// to if their certificate is verified, and that failures name the data store
+func TestInitializeStateDriverTLS(t *testing.T) {
+	stateDriverRegistry[fakeName] = driver{Type: reflect.TypeOf(fakeStateDriver{})}
+	defer delete(stateDriverRegistry, fakeName)
+
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "auth_proxy_state")
+	if err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatalf("failed to write CA file: %s", err)
+	}
+
+	hostPort := strings.TrimPrefix(server.URL, "https://")
+	address := fakeName + common.DataStoreHTTPSSuffix + "://" + hostPort
+
+	for _, tc := range []struct {
+		description string
+		address     string
+		options     *common.DataStoreTLSOptions
+		mention     string
+	}{
+		{"unknown CA", address, nil, hostPort},
+		{"unreadable CA file", address, &common.DataStoreTLSOptions{CAFile: filepath.Join(dir, "missing")}, "missing"},
+		{"certificate without key", address, &common.DataStoreTLSOptions{CertFile: caFile}, common.DataStoreKeyFileKey},
+		{"TLS options without https", fakeName + "://" + hostPort, &common.DataStoreTLSOptions{CAFile: caFile}, common.DataStoreHTTPSSuffix},
+	} {
+		err := InitializeStateDriver(tc.address, &DriverOptions{TLS: tc.options})
+		if err == nil {
+			ReleaseStateDriver()
+			t.Errorf("%s: expected the state driver initialization to fail", tc.description)
+		} else if !strings.Contains(err.Error(), tc.mention) {
+			t.Errorf("%s: expected the error to mention %q, got %q", tc.description, tc.mention, err.Error())
+		}
+	}
+
+	for _, options := range []*common.DataStoreTLSOptions{{CAFile: caFile}, {InsecureSkipVerify: true}} {
+		if err := InitializeStateDriver(address, &DriverOptions{TLS: options}); err != nil {
+			t.Fatalf("failed to initialize the state driver with %+v: %s", options, err)
+		}
+
+		drv, _ := GetStateDriver()
+		breaker, _ := CircuitBreaker(drv)
+		config := breaker.StateDriver.(*RetryDriver).StateDriver.(*fakeStateDriver).config
+		if config.TLS == nil || config.StoreURL != fakeName+"://"+hostPort {
+			t.Errorf("expected the state driver to connect to %s over TLS, got %+v", hostPort, config)
+		}
+
+		ReleaseStateDriver()
+	}
+}
+
+// unreachableProbes is the number of times the probe of a newly created
+// startingStateDriver fails because the datastore is still starting up
+var unreachableProbes int
+
+// startingStateDriver is a fakeStateDriver for a datastore which is still starting up
+type startingStateDriver struct {
+	fakeStateDriver
+}
+
+func (d *startingStateDriver) ReadAll(baseKey string) ([][]byte, error) {
+	if unreachableProbes > 0 {
+		unreachableProbes--
+		return nil, errConnectionRefused
+	}
+
+	return nil, auth_errors.ErrKeyNotFound
+}
+
+// TestInitializeStateDriverRetries tests that a datastore which can't be
+// reached yet is tried again until the startup timeout has passed
+func TestInitializeStateDriverRetries(t *testing.T) {
+	stateDriverRegistry[fakeName] = driver{Type: reflect.TypeOf(startingStateDriver{})}
+	defer delete(stateDriverRegistry, fakeName)
+
+	// probes go through the retry driver, so each connection attempt probes
+	// up to defaultRetryAttempts times
+	unreachableProbes = defaultRetryAttempts + 1
+	if err := InitializeStateDriver(fakeName+"://127.0.0.1:2379", &DriverOptions{StartupTimeout: time.Minute}); err != nil {
+		t.Fatalf("expected the state driver to be initialized once the datastore is up, got %v", err)
+	}
+
+	if unreachableProbes != 0 {
+		t.Errorf("expected the datastore to be probed until it was up, %d failed probes are left", unreachableProbes)
+	}
+
+	ReleaseStateDriver()
+
+	// without a startup timeout, the datastore is only tried once
+	unreachableProbes = defaultRetryAttempts + 1
+	if err := InitializeStateDriver(fakeName+"://127.0.0.1:2379", nil); err == nil || !strings.Contains(err.Error(), "127.0.0.1:2379") {
+		t.Fatalf("expected the state driver initialization to fail naming the datastore, got %v", err)
+	}
+
+	if _, err := GetStateDriver(); err == nil {
+		t.Errorf("expected no state driver to be left behind")
+	}
+}
+
+// TestInitializeStateDriverEndpoints tests that the endpoints of a data store
+// cluster must share a scheme, and that failing to reach them lists them all
+func TestInitializeStateDriverEndpoints(t *testing.T) {
+	stateDriverRegistry[fakeName] = driver{Type: reflect.TypeOf(startingStateDriver{})}
+	defer delete(stateDriverRegistry, fakeName)
+
+	if err := InitializeStateDriver(fakeName+"://10.0.0.1:2379,"+EtcdName+"://10.0.0.2:2379", nil); err == nil || !strings.Contains(err.Error(), "scheme") {
+		t.Fatalf("expected endpoints with different schemes to be refused, got %v", err)
+	}
+
+	unreachableProbes = defaultRetryAttempts + 1
+	err := InitializeStateDriver(fakeName+"://10.0.0.1:2379, "+fakeName+"://10.0.0.2:2379", nil)
+	if err == nil || !strings.Contains(err.Error(), "10.0.0.1:2379, 10.0.0.2:2379") {
+		t.Fatalf("expected the state driver initialization to fail listing the endpoints, got %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -53,16 +54,26 @@ func (d *EtcdStateDriver) Init(config *types.KVStoreConfig) error {
 		return errors.New("Invalid etcd config")
 	}
 
-	// configure etcd endpoints
-	etcdURL := strings.Replace(config.StoreURL, "etcd://", "http://", 1)
+	// configure etcd endpoints; the client balances requests over them
+	hostPorts, ok := storeHostPorts(config, "etcd://")
+	if !ok {
+		return errors.New("Invalid etcd config")
+	}
+
+	etcdURLs := []string{}
+	for _, hostPort := range hostPorts {
+		etcdURLs = append(etcdURLs, dataStoreScheme(config)+hostPort)
+	}
+
 	etcdConfig := client.Config{
-		Endpoints: []string{etcdURL},
+		Endpoints: etcdURLs,
+		Transport: dataStoreTransport(config),
 	}
 
 	// create etcd client
 	d.Client, err = client.New(etcdConfig)
 	if err != nil {
-		log.Fatalf("failed to create etcd client, err: %v", err)
+		return fmt.Errorf("failed to create etcd client, err: %v", err)
 	}
 
 	// create keys api
@@ -387,17 +398,40 @@ func (d *EtcdStateDriver) ReadState(key string, value types.State,
 func readAllStateCommon(d types.StateDriver, baseKey string, sType types.State,
 	unmarshal func([]byte, interface{}) error) ([]types.State, error) {
 
-	stateType := reflect.TypeOf(sType)
-	sliceType := reflect.SliceOf(stateType)
-	values := reflect.MakeSlice(sliceType, 0, 1)
-
 	byteValues, err := d.ReadAll(baseKey)
 	if err != nil {
 		return nil, err
 	}
+
+	return unmarshalAllState(d, byteValues, sType, unmarshal)
+}
+
+//
+// unmarshalAllState unmarshals (given a function) values read from the KV
+// store into a slice of type types.State
+//
+// Parameters:
+//   d:           StateDriver set as the driver of the states
+//   byteValues:  values read from the KV store
+//   sType:       State
+//   unmarshal:   Unmarshal function to convert a value from a byte slice
+//                to a struct of type types.State
+//
+// Return value:
+//   []types.State: slice of states
+//   error:         Error returned when unmarshaling a value
+//                  nil if successful
+//
+func unmarshalAllState(d types.StateDriver, byteValues [][]byte, sType types.State,
+	unmarshal func([]byte, interface{}) error) ([]types.State, error) {
+
+	stateType := reflect.TypeOf(sType)
+	sliceType := reflect.SliceOf(stateType)
+	values := reflect.MakeSlice(sliceType, 0, 1)
+
 	for _, byteValue := range byteValues {
 		value := reflect.New(stateType)
-		err = unmarshal(byteValue, value.Interface())
+		err := unmarshal(byteValue, value.Interface())
 		if err != nil {
 			return nil, err
 		}
@@ -532,6 +566,124 @@ func (d *EtcdStateDriver) WatchAllState(baseKey string, sType types.State,
 	return err
 }
 
+//
+// Watch streams the changes to the keys below a directory in etcd; see
+// types.StateDriver
+//
+// Parameters:
+//   prefix: directory whose keys are watched
+//
+// Return values:
+//   <-chan types.WatchEvent: the changes; closed once the watch stopped
+//   func():                  stops the watch
+//
+func (d *EtcdStateDriver) Watch(prefix string) (<-chan types.WatchEvent, func()) {
+	return watchPrefix(d, context.Background(), watchEventKey(prefix))
+}
+
+//
+// listPrefix returns the values of the keys below a directory, see prefixWatcher
+//
+// Parameters:
+//   prefix: directory whose keys are listed
+//
+// Return values:
+//   map[string][]byte: the values by key; empty if the directory doesn't exist
+//   uint64:            etcd's index when they were read
+//   error:             Error returned by the etcd client
+//
+func (d *EtcdStateDriver) listPrefix(prefix string) (map[string][]byte, uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	defer cancel()
+
+	values := map[string][]byte{}
+
+	resp, err := d.KeysAPI.Get(ctx, prefix, &client.GetOptions{Recursive: true})
+	if client.IsKeyNotFound(err) {
+		return values, err.(client.Error).Index, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	var addNodes func(node *client.Node)
+	addNodes = func(node *client.Node) {
+		if !node.Dir {
+			values[watchEventKey(node.Key)] = []byte(node.Value)
+		}
+
+		for _, child := range node.Nodes {
+			addNodes(child)
+		}
+	}
+
+	addNodes(resp.Node)
+
+	return values, resp.Index, nil
+}
+
+//
+// followPrefix reports the changes to the keys below a directory, see prefixWatcher
+//
+// Parameters:
+//   ctx:    stops following the changes when done
+//   prefix: directory whose keys are watched
+//   index:  etcd index after which the changes are reported
+//   known:  values reported so far by key
+//   change: called with each change; nil values for deletions
+//
+// Return values:
+//   uint64: index to resume from
+//   error:  errWatchHistoryLost if etcd no longer has the changes after
+//           `index`, else the error returned by the watcher
+//
+func (d *EtcdStateDriver) followPrefix(ctx context.Context, prefix string, index uint64, known map[string][]byte,
+	change func(key string, value []byte) bool) (uint64, error) {
+
+	watcher := d.KeysAPI.Watcher(prefix, &client.WatcherOptions{AfterIndex: index, Recursive: true})
+
+	for {
+		resp, err := watcher.Next(ctx)
+		if isEtcdErrorCode(err, client.ErrorCodeEventIndexCleared) {
+			return index, errWatchHistoryLost
+		} else if err != nil {
+			return index, err
+		}
+
+		index = resp.Node.ModifiedIndex
+		key := watchEventKey(resp.Node.Key)
+
+		var value []byte
+		switch resp.Action {
+		case "delete", "expire", "compareAndDelete":
+		default:
+			value = []byte(resp.Node.Value)
+		}
+
+		keys := []string{key}
+		if resp.Node.Dir {
+			if value != nil {
+				continue
+			}
+
+			// the keys of a deleted directory are deleted along with it
+			keys = []string{}
+			for knownKey := range known {
+				if strings.HasPrefix(knownKey, key+"/") {
+					keys = append(keys, knownKey)
+				}
+			}
+
+			sort.Strings(keys)
+		}
+
+		for _, key := range keys {
+			if !change(key, value) {
+				return index, nil
+			}
+		}
+	}
+}
+
 //
 // WriteState writes a value of types.State for a key in the KV store
 //
@@ -554,3 +706,67 @@ func (d *EtcdStateDriver) WriteState(key string, value types.State,
 
 	return d.Write(key, encodedState)
 }
+
+//
+// AcquireLease creates `key` with the value `holder` and a TTL, or resets
+// the TTL if `holder` already holds it
+//
+// Parameters:
+//   key:    key of the lease
+//   holder: value identifying the holder of the lease
+//   ttl:    time after which the key is removed unless it's acquired again
+//
+// Return values:
+//   bool:  true if `holder` holds the lease
+//   error: Error returned by etcd client when setting the key
+//
+func (d *EtcdStateDriver) AcquireLease(key, holder string, ttl time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	defer cancel()
+
+	_, err := d.KeysAPI.Set(ctx, key, holder, &client.SetOptions{PrevExist: client.PrevNoExist, TTL: ttl})
+	if err == nil {
+		return true, nil
+	} else if !isEtcdErrorCode(err, client.ErrorCodeNodeExist) {
+		return false, err
+	}
+
+	// renew the lease only if it's still ours
+	_, err = d.KeysAPI.Set(ctx, key, holder, &client.SetOptions{PrevValue: holder, TTL: ttl})
+	if err == nil {
+		return true, nil
+	} else if isEtcdErrorCode(err, client.ErrorCodeTestFailed) || client.IsKeyNotFound(err) {
+		// held by someone else, or it expired in the meantime
+		return false, nil
+	}
+
+	return false, err
+}
+
+//
+// ReleaseLease removes `key` if its value is `holder`
+//
+// Parameters:
+//   key:    key of the lease
+//   holder: value identifying the holder of the lease
+//
+// Return value:
+//   error: Error returned by etcd client when deleting the key
+//
+func (d *EtcdStateDriver) ReleaseLease(key, holder string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	defer cancel()
+
+	_, err := d.KeysAPI.Delete(ctx, key, &client.DeleteOptions{PrevValue: holder})
+	if client.IsKeyNotFound(err) || isEtcdErrorCode(err, client.ErrorCodeTestFailed) {
+		return nil
+	}
+
+	return err
+}
+
+// isEtcdErrorCode returns true if `err` is an etcd error with the given code
+func isEtcdErrorCode(err error, code int) bool {
+	etcdErr, ok := err.(client.Error)
+	return ok && etcdErr.Code == code
+}
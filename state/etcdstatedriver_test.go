@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 
@@ -444,6 +445,69 @@ func TestEtcdStateDriverRead(t *testing.T) {
 	commonTestStateDriverRead(t, driver)
 }
 
+// Test helper function to check that Watch() reports the changes to the keys
+// below a prefix in order, and closes its channel once stopped. Each change is
+// only made once the previous one was reported, as consul's blocking queries
+// only report the latest value of a key.
+func commonTestStateDriverWatch(t *testing.T, d types.StateDriver) {
+	prefix := "watch"
+	keys := []string{prefix + "/testKeyWatch1", prefix + "/testKeyWatch2"}
+
+	for _, key := range keys {
+		d.Clear(key)
+	}
+
+	events, stop := d.Watch(prefix)
+	defer stop()
+
+	// let the watch start
+	time.Sleep(time.Second)
+
+	steps := []struct {
+		change   func() error
+		expected types.WatchEvent
+	}{
+		{func() error { return d.Write(keys[0], []byte("v1")) }, types.WatchEvent{Type: types.WatchEventCreate, Key: "/watch/testKeyWatch1", Value: []byte("v1")}},
+		{func() error { return d.Write(keys[1], []byte("v1")) }, types.WatchEvent{Type: types.WatchEventCreate, Key: "/watch/testKeyWatch2", Value: []byte("v1")}},
+		{func() error { return d.Write(keys[0], []byte("v2")) }, types.WatchEvent{Type: types.WatchEventUpdate, Key: "/watch/testKeyWatch1", Value: []byte("v2")}},
+		{func() error { return d.Clear(keys[0]) }, types.WatchEvent{Type: types.WatchEventDelete, Key: "/watch/testKeyWatch1"}},
+		{func() error { return d.Clear(keys[1]) }, types.WatchEvent{Type: types.WatchEventDelete, Key: "/watch/testKeyWatch2"}},
+	}
+
+	for _, step := range steps {
+		if err := step.change(); err != nil {
+			t.Fatalf("failed to change %s, err: %s", step.expected.Key, err)
+		}
+
+		select {
+		case event := <-events:
+			if event.Type != step.expected.Type || event.Key != step.expected.Key || string(event.Value) != string(step.expected.Value) {
+				t.Fatalf("Watch event mismatch. Expctd: %s %s %q, Rcvd: %s %s %q",
+					step.expected.Type, step.expected.Key, step.expected.Value, event.Type, event.Key, event.Value)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("timed out waiting for the %s event of %s", step.expected.Type, step.expected.Key)
+		}
+	}
+
+	stop()
+
+	// a blocking query which is running when the watch is stopped finishes first
+	timer := time.After(consulWatchWaitTime + waitTimeout)
+	for {
+		select {
+		case event, open := <-events:
+			if !open {
+				return
+			}
+
+			t.Fatalf("unexpected event after the watch was stopped: %s %s", event.Type, event.Key)
+		case <-timer:
+			t.Fatalf("timed out waiting for the watch to stop")
+		}
+	}
+}
+
 // Test helper function to check read all keys from a dir in the KV store
 func commonTestStateDriverReadAll(t *testing.T, d types.StateDriver) {
 	testBytes := []byte{0xb, 0xa, 0xd, 0xb, 0xa, 0xb, 0xe}
@@ -483,6 +547,68 @@ func commonTestStateDriverReadAll(t *testing.T, d types.StateDriver) {
 	}
 }
 
+// Test helper function to check acquiring, renewing, releasing and expiring
+// leases; `grace` is the time the datastore may take to remove a lease beyond
+// its TTL
+func commonTestStateDriverLease(t *testing.T, d types.StateDriver, ttl, grace time.Duration) {
+	key := types.AuthProxyDir + "/lease_test_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	if acquired, err := d.AcquireLease(key, "a", ttl); err != nil || !acquired {
+		t.Fatalf("failed to acquire the lease, err: %v", err)
+	}
+
+	if value, err := d.Read(key); err != nil || string(value) != "a" {
+		t.Fatalf("expected the lease to be held by %q, got %q (err: %v)", "a", value, err)
+	}
+
+	// only the holder can renew or release the lease
+	if acquired, err := d.AcquireLease(key, "b", ttl); err != nil || acquired {
+		t.Fatalf("expected the lease to be held by someone else, got %t (err: %v)", acquired, err)
+	}
+
+	if err := d.ReleaseLease(key, "b"); err != nil {
+		t.Fatalf("failed to release the lease, err: %s", err)
+	}
+
+	if acquired, err := d.AcquireLease(key, "a", ttl); err != nil || !acquired {
+		t.Fatalf("failed to renew the lease, err: %v", err)
+	}
+
+	if err := d.ReleaseLease(key, "a"); err != nil {
+		t.Fatalf("failed to release the lease, err: %s", err)
+	}
+
+	if acquired, err := d.AcquireLease(key, "b", ttl); err != nil || !acquired {
+		t.Fatalf("failed to acquire a released lease, err: %v", err)
+	}
+
+	// the lease expires once it isn't renewed anymore
+	deadline := time.Now().Add(ttl + grace)
+	for time.Now().Before(deadline) {
+		if acquired, err := d.AcquireLease(key, "a", ttl); err != nil {
+			t.Fatalf("failed to acquire the lease, err: %s", err)
+		} else if acquired {
+			d.ReleaseLease(key, "a")
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("expected the lease to expire within %s", ttl+grace)
+}
+
+// Test to check leases in KV store
+func TestEtcdStateDriverLease(t *testing.T) {
+	driver := setupEtcdDriver(t)
+	commonTestStateDriverLease(t, driver, 2*time.Second, time.Second)
+}
+
+// Test to check that a follower takes over when the leader goes away
+func TestEtcdStateDriverLeaderFailover(t *testing.T) {
+	commonTestLeaderFailover(t, setupEtcdDriver(t), setupEtcdDriver(t), 2*time.Second, time.Second)
+}
+
 // Test to check read keys under a directory from KV store
 func TestEtcdStateDriverReadAll(t *testing.T) {
 	driver := setupEtcdDriver(t)
@@ -571,3 +697,9 @@ func TestEtcdStateDriverWatchAllStateDelete(t *testing.T) {
 	driver := setupEtcdDriver(t)
 	commonTestStateDriverWatchAllStateDelete(t, driver)
 }
+
+// Test to watch the changes to keys in KV store
+func TestEtcdStateDriverWatch(t *testing.T) {
+	driver := setupEtcdDriver(t)
+	commonTestStateDriverWatch(t, driver)
+}
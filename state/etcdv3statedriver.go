@@ -0,0 +1,949 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains the state driver for etcd's v3 API. It talks to the JSON
+// gateway etcd serves next to its gRPC API (/v3/kv/range, /v3/watch, etc.), so
+// that no gRPC client is needed. Keys are stored at the same paths as by the
+// v2 driver: etcd's v2 and v3 keyspaces are separate, but once the v2 keys
+// are migrated (e.g. using `etcdctl migrate`) this driver reads them as is.
+//
+// The v3 API has no directories. Mkdir() creates an empty key at the
+// directory's path instead, so that listing an empty directory isn't an
+// error, and ReadAll() only returns the values of the keys right below the
+// directory, like a v2 listing.
+
+const (
+	// etcdV3GatewayPrefix is the path prefix of etcd's JSON gateway; etcd 3.4
+	// and later serve it at /v3
+	etcdV3GatewayPrefix = "/v3"
+
+	// etcdV3Scheme is the scheme of etcd v3 data store addresses
+	etcdV3Scheme = EtcdV3Name + "://"
+)
+
+// EtcdV3StateDriver implements the StateDriver interface for etcd's v3 API
+type EtcdV3StateDriver struct {
+
+	// URL of the etcd endpoint, e.g. http://127.0.0.1:2379 or https://127.0.0.1:2379;
+	// if several are configured, the first one, which the clients replace by
+	// whichever endpoint can be reached
+	endpoint string
+
+	// client used for all the calls but watches, which don't time out
+	client *http.Client
+
+	// client used for watches; it shares client's transport
+	watchClient *http.Client
+
+	// cancels the running watches on Deinit()
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// leases used to hold keys, by key and holder (see AcquireLease())
+	leases      map[string]int64
+	leasesMutex sync.Mutex
+}
+
+// etcdV3KeyValue is a key-value pair as returned by the gateway; int64 fields
+// are encoded as strings
+type etcdV3KeyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+// etcdV3RangeRequest is the body of /kv/range
+type etcdV3RangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+// etcdV3RangeResponse is the response of /kv/range
+type etcdV3RangeResponse struct {
+	Header struct {
+		Revision int64 `json:"revision,string"`
+	} `json:"header"`
+	Kvs []etcdV3KeyValue `json:"kvs"`
+}
+
+// etcdV3PutRequest is the body of /kv/put
+type etcdV3PutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease int64  `json:"lease,string,omitempty"`
+}
+
+// etcdV3DeleteRangeRequest is the body of /kv/deleterange
+type etcdV3DeleteRangeRequest struct {
+	Key []byte `json:"key"`
+}
+
+// etcdV3Compare is a condition of a transaction: the key's version (0 if it
+// doesn't exist) or value must equal the given one
+type etcdV3Compare struct {
+	Result  string `json:"result"`
+	Target  string `json:"target"`
+	Key     []byte `json:"key"`
+	Version string `json:"version,omitempty"`
+	Value   []byte `json:"value,omitempty"`
+}
+
+// etcdV3RequestOp is an operation of a transaction
+type etcdV3RequestOp struct {
+	RequestPut         *etcdV3PutRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *etcdV3DeleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+// etcdV3TxnRequest is the body of /kv/txn; the operations are only applied if
+// all the conditions hold
+type etcdV3TxnRequest struct {
+	Compare []etcdV3Compare   `json:"compare"`
+	Success []etcdV3RequestOp `json:"success"`
+}
+
+// etcdV3TxnResponse is the response of /kv/txn
+type etcdV3TxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+// etcdV3LeaseRequest is the body of /lease/grant, /lease/keepalive and /lease/revoke
+type etcdV3LeaseRequest struct {
+	ID  int64 `json:"ID,string,omitempty"`
+	TTL int64 `json:"TTL,string,omitempty"`
+}
+
+// etcdV3LeaseResponse is the response of /lease/grant and the result of
+// /lease/keepalive; TTL is 0 if the lease expired
+type etcdV3LeaseResponse struct {
+	ID  int64 `json:"ID,string"`
+	TTL int64 `json:"TTL,string"`
+}
+
+// etcdV3Error is the error returned by the gateway
+type etcdV3Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// etcdV3WatchCreateRequest starts watching the given range of keys
+type etcdV3WatchCreateRequest struct {
+	Key           []byte `json:"key"`
+	RangeEnd      []byte `json:"range_end"`
+	StartRevision int64  `json:"start_revision,string,omitempty"`
+	PrevKV        bool   `json:"prev_kv"`
+}
+
+// etcdV3WatchEvent is a change to a key; Type is "DELETE" for deletions and
+// empty for writes
+type etcdV3WatchEvent struct {
+	Type   string          `json:"type"`
+	KV     etcdV3KeyValue  `json:"kv"`
+	PrevKV *etcdV3KeyValue `json:"prev_kv"`
+}
+
+// etcdV3WatchMessage is one of the messages streamed by /watch
+type etcdV3WatchMessage struct {
+	Result *struct {
+		Header struct {
+			Revision int64 `json:"revision,string"`
+		} `json:"header"`
+		Canceled        bool               `json:"canceled"`
+		CompactRevision int64              `json:"compact_revision,string"`
+		Events          []etcdV3WatchEvent `json:"events"`
+	} `json:"result"`
+	Error *etcdV3Error `json:"error"`
+}
+
+//
+// Init initializes the state driver with needed config
+//
+// Parameters:
+//   config: configuration parameters to reach etcd
+//
+// Return values:
+//   error:  error if the configuration is invalid
+//
+func (d *EtcdV3StateDriver) Init(config *types.KVStoreConfig) error {
+	if config == nil || !strings.HasPrefix(config.StoreURL, etcdV3Scheme) {
+		return errors.New("Invalid etcd v3 config")
+	}
+
+	hostPorts, ok := storeHostPorts(config, etcdV3Scheme)
+	if !ok {
+		return errors.New("Invalid etcd v3 config")
+	}
+
+	transport := newFailoverTransport(hostPorts, dataStoreTransport(config))
+	d.endpoint = dataStoreScheme(config) + hostPorts[0]
+	d.client = &http.Client{Transport: transport, Timeout: ctxTimeout}
+	d.watchClient = &http.Client{Transport: transport}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.leases = map[string]int64{}
+
+	for _, dir := range types.DatastoreDirectories {
+		d.Mkdir(dir)
+	}
+
+	return nil
+}
+
+// Deinit stops the running watches
+func (d *EtcdV3StateDriver) Deinit() {
+	if d.cancel != nil {
+		d.cancel()
+	}
+}
+
+//
+// etcdV3Key returns the path of a key as the v2 driver stores it, i.e. with a
+// leading and without a trailing slash
+//
+// Parameters:
+//   key: key with or without a leading or trailing slash
+//
+// Return value:
+//   string: the key's path
+//
+func etcdV3Key(key string) string {
+	return "/" + strings.Trim(key, "/")
+}
+
+//
+// prefixRangeEnd returns the end of the range of the keys starting with
+// `prefix`, i.e. the first key after all of them
+//
+// Parameters:
+//   prefix: common prefix of the keys
+//
+// Return value:
+//   []byte: the end of the range; []byte{0} (all the keys) if there's none
+//
+func prefixRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return []byte{0}
+}
+
+//
+// isEtcdV3Unavailable returns true if etcd couldn't be reached at all, i.e.
+// the request wasn't processed and can safely be retried
+//
+// Parameters:
+//   err:        error returned by the HTTP client
+//   statusCode: HTTP status of the response if there's one
+//
+// Return value:
+//   bool: true if the request can be retried
+//
+func isEtcdV3Unavailable(err error, statusCode int) bool {
+	if err == nil {
+		return statusCode == http.StatusServiceUnavailable
+	}
+
+	return isDialError(err)
+}
+
+//
+// call sends a request to the gateway and decodes its response, retrying a
+// few times if etcd is unavailable
+//
+// Parameters:
+//   path:     path of the gateway endpoint, e.g. /kv/range
+//   request:  body of the request
+//   response: decoded response; nil if it isn't needed
+//
+// Return value:
+//   error: Error when reaching etcd or returned by etcd
+//
+func (d *EtcdV3StateDriver) call(path string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; ; i++ {
+		resp, err := d.client.Post(d.endpoint+etcdV3GatewayPrefix+path, "application/json", bytes.NewReader(body))
+
+		statusCode := 0
+		if err == nil {
+			statusCode = resp.StatusCode
+		}
+
+		if isEtcdV3Unavailable(err, statusCode) && i < maxEtcdRetries {
+			if resp != nil {
+				resp.Body.Close()
+			}
+
+			// retry after a delay
+			time.Sleep(time.Second)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		defer resp.Body.Close()
+		return decodeEtcdV3Response(path, resp, response)
+	}
+}
+
+//
+// decodeEtcdV3Response decodes a response of the gateway
+//
+// Parameters:
+//   path:     path of the gateway endpoint, for error messages
+//   resp:     the response
+//   response: decoded response; nil if it isn't needed
+//
+// Return value:
+//   error: the error returned by etcd or when decoding the response
+//
+func decodeEtcdV3Response(path string, resp *http.Response, response interface{}) error {
+	if resp.StatusCode != http.StatusOK {
+		etcdErr := &etcdV3Error{}
+		if err := json.NewDecoder(resp.Body).Decode(etcdErr); err != nil || etcdErr.Message == "" {
+			return fmt.Errorf("etcd %s failed: %s", path, resp.Status)
+		}
+
+		return fmt.Errorf("etcd %s failed: %s", path, etcdErr.Message)
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+//
+// txn applies `ops` if all the conditions hold
+//
+// Parameters:
+//   compare: conditions of the transaction
+//   ops:     operations to apply
+//
+// Return values:
+//   bool:  true if the conditions held
+//   error: Error returned by etcd
+//
+func (d *EtcdV3StateDriver) txn(compare []etcdV3Compare, ops ...etcdV3RequestOp) (bool, error) {
+	resp := &etcdV3TxnResponse{}
+	if err := d.call("/kv/txn", &etcdV3TxnRequest{Compare: compare, Success: ops}, resp); err != nil {
+		return false, err
+	}
+
+	return resp.Succeeded, nil
+}
+
+// keyMissing is the condition that `key` doesn't exist
+func keyMissing(key string) etcdV3Compare {
+	return etcdV3Compare{Result: "EQUAL", Target: "VERSION", Key: []byte(key), Version: "0"}
+}
+
+// keyEquals is the condition that the value of `key` is `value`
+func keyEquals(key, value string) etcdV3Compare {
+	return etcdV3Compare{Result: "EQUAL", Target: "VALUE", Key: []byte(key), Value: []byte(value)}
+}
+
+// Mkdir creates an empty key standing for a directory.  If it already exists,
+// this is a no-op.
+//
+// Parameters:
+//   key: target directory path, with or without a leading or trailing slash
+//
+// Return values:
+//   error: Error encountered when creating the directory
+//   nil:   successfully created directory
+//
+func (d *EtcdV3StateDriver) Mkdir(key string) error {
+	key = etcdV3Key(key)
+
+	_, err := d.txn([]etcdV3Compare{keyMissing(key)},
+		etcdV3RequestOp{RequestPut: &etcdV3PutRequest{Key: []byte(key), Value: []byte{}}})
+	return err
+}
+
+//
+// Write state (consisting of a key-value pair) to etcd
+//
+// Parameters:
+//   key:    key to be stored
+//   value:  value to be stored
+//
+// Return values:
+//   error: Error when writing to etcd
+//          nil if successful
+//
+func (d *EtcdV3StateDriver) Write(key string, value []byte) error {
+	return d.call("/kv/put", &etcdV3PutRequest{Key: []byte(etcdV3Key(key)), Value: value}, nil)
+}
+
+//
+// Read returns state for a key
+//
+// Parameters:
+//   key:    key for which value is to be retrieved
+//
+// Return values:
+//   []byte: value associated with the given key
+//   error: auth_errors.ErrKeyNotFound if the key doesn't exist, or the
+//          error when reading from etcd
+//
+func (d *EtcdV3StateDriver) Read(key string) ([]byte, error) {
+	resp := &etcdV3RangeResponse{}
+	if err := d.call("/kv/range", &etcdV3RangeRequest{Key: []byte(etcdV3Key(key))}, resp); err != nil {
+		return []byte{}, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, auth_errors.ErrKeyNotFound
+	}
+
+	if resp.Kvs[0].Value == nil {
+		return []byte{}, nil
+	}
+
+	return resp.Kvs[0].Value, nil
+}
+
+//
+// ReadAll returns the values of the keys right below a directory; empty
+// values (i.e. directories) are skipped
+//
+// Parameters:
+//   baseKey: path of the directory
+//
+// Return values:
+//   [][]byte: slice of values of the keys below the directory
+//   error:    auth_errors.ErrKeyNotFound if neither the directory nor any key
+//             below it exists, or the error when reading from etcd
+//
+func (d *EtcdV3StateDriver) ReadAll(baseKey string) ([][]byte, error) {
+	baseKey = etcdV3Key(baseKey)
+	prefix := baseKey + "/"
+
+	// the range covers the directory's key as well as the keys below it
+	resp := &etcdV3RangeResponse{}
+	if err := d.call("/kv/range", &etcdV3RangeRequest{Key: []byte(baseKey), RangeEnd: prefixRangeEnd(prefix)}, resp); err != nil {
+		return [][]byte{}, err
+	}
+
+	found := false
+	values := [][]byte{}
+
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		if key != baseKey && !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		found = true
+
+		if strings.Contains(strings.TrimPrefix(key, prefix), "/") || len(kv.Value) == 0 {
+			continue
+		}
+
+		values = append(values, kv.Value)
+	}
+
+	if !found {
+		return nil, auth_errors.ErrKeyNotFound
+	}
+
+	return values, nil
+}
+
+//
+// watch streams the changes to the keys below `prefix` from the given
+// revision, until the stream breaks or `ctx` is done
+//
+// Parameters:
+//   ctx:           stops the watch when done
+//   prefix:        prefix of the keys to watch
+//   startRevision: revision to start from; 0 for the current one
+//   handle:        called with each change; the watch stops if it returns false
+//
+// Return values:
+//   int64: revision to resume watching from; 0 for the current one
+//   error: Error when watching or reading the stream; errWatchHistoryLost if
+//          the revision to start from was compacted
+//
+func (d *EtcdV3StateDriver) watch(ctx context.Context, prefix string, startRevision int64,
+	handle func(event etcdV3WatchEvent) bool) (int64, error) {
+
+	body, err := json.Marshal(map[string]interface{}{
+		"create_request": &etcdV3WatchCreateRequest{
+			Key:           []byte(prefix),
+			RangeEnd:      prefixRangeEnd(prefix),
+			StartRevision: startRevision,
+			PrevKV:        true,
+		},
+	})
+	if err != nil {
+		return startRevision, err
+	}
+
+	req, err := http.NewRequest("POST", d.endpoint+etcdV3GatewayPrefix+"/watch", bytes.NewReader(body))
+	if err != nil {
+		return startRevision, err
+	}
+
+	// watches block until something changes, so they only end when cancelled
+	resp, err := d.watchClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return startRevision, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return startRevision, decodeEtcdV3Response("/watch", resp, nil)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		msg := &etcdV3WatchMessage{}
+		if err := decoder.Decode(msg); err != nil {
+			return startRevision, err
+		} else if msg.Error != nil {
+			return startRevision, fmt.Errorf("etcd /watch failed: %s", msg.Error.Message)
+		} else if msg.Result == nil {
+			continue
+		}
+
+		if msg.Result.Canceled {
+			// the revision to resume from was compacted; resume from the current one
+			if msg.Result.CompactRevision != 0 {
+				log.Warnf("etcd /watch cancelled, revision %d was compacted", startRevision)
+				return 0, errWatchHistoryLost
+			}
+
+			return startRevision, errors.New("etcd /watch cancelled")
+		}
+
+		if startRevision == 0 {
+			startRevision = msg.Result.Header.Revision + 1
+		}
+
+		for _, event := range msg.Result.Events {
+			startRevision = event.KV.ModRevision + 1
+
+			if !handle(event) {
+				return startRevision, nil
+			}
+		}
+	}
+}
+
+//
+// WatchAll watches value changes for the keys below a directory in etcd
+//
+// Parameters:
+//   baseKey:        key for which changes are to be watched
+//   chValueChanges: channel for communicating the changes in
+//                   the values for a key from this method
+//
+// Return values:
+//   error: always nil; the watch is restarted whenever it fails
+//
+func (d *EtcdV3StateDriver) WatchAll(baseKey string, chValueChanges chan [2][]byte) error {
+	prefix := etcdV3Key(baseKey) + "/"
+
+	handle := func(event etcdV3WatchEvent) bool {
+		// same as the v2 driver: the current value is nil for deletions,
+		// the previous one for creations
+		byteValues := [2][]byte{nil, nil}
+		eventStr := "create"
+
+		if event.Type != "DELETE" && len(event.KV.Value) != 0 {
+			byteValues[0] = event.KV.Value
+		}
+
+		if event.PrevKV != nil && len(event.PrevKV.Value) != 0 {
+			byteValues[1] = event.PrevKV.Value
+			if byteValues[0] != nil {
+				eventStr = "modify"
+			} else {
+				eventStr = "delete"
+			}
+		}
+
+		log.Debugf("Observed event:%q for key: %s", eventStr, event.KV.Key)
+
+		// send changes in values for the key to a channel
+		chValueChanges <- byteValues
+		return true
+	}
+
+	go func() {
+		revision := int64(0)
+		for {
+			var err error
+
+			revision, err = d.watch(d.ctx, prefix, revision, handle)
+			if d.ctx.Err() != nil {
+				return
+			}
+
+			log.Errorf("Error %v during watch", err)
+			time.Sleep(time.Second)
+		}
+	}()
+
+	return nil
+}
+
+//
+// Watch streams the changes to the keys below a directory in etcd; see
+// types.StateDriver. The watch stops on Deinit() as well.
+//
+// Parameters:
+//   prefix: directory whose keys are watched
+//
+// Return values:
+//   <-chan types.WatchEvent: the changes; closed once the watch stopped
+//   func():                  stops the watch
+//
+func (d *EtcdV3StateDriver) Watch(prefix string) (<-chan types.WatchEvent, func()) {
+	return watchPrefix(d, d.ctx, etcdV3Key(prefix)+"/")
+}
+
+//
+// listPrefix returns the values of the keys below a directory, see prefixWatcher
+//
+// Parameters:
+//   prefix: prefix of the keys, ending with a slash
+//
+// Return values:
+//   map[string][]byte: the values by key
+//   uint64:            etcd's revision when they were read
+//   error:             Error when reaching etcd or returned by etcd
+//
+func (d *EtcdV3StateDriver) listPrefix(prefix string) (map[string][]byte, uint64, error) {
+	resp := &etcdV3RangeResponse{}
+	if err := d.call("/kv/range", &etcdV3RangeRequest{Key: []byte(prefix), RangeEnd: prefixRangeEnd(prefix)}, resp); err != nil {
+		return nil, 0, err
+	}
+
+	values := map[string][]byte{}
+	for _, kv := range resp.Kvs {
+		// directories are empty keys
+		if len(kv.Value) != 0 {
+			values[watchEventKey(string(kv.Key))] = kv.Value
+		}
+	}
+
+	return values, uint64(resp.Header.Revision), nil
+}
+
+//
+// followPrefix reports the changes to the keys below a directory, see prefixWatcher
+//
+// Parameters:
+//   ctx:    stops following the changes when done
+//   prefix: prefix of the keys, ending with a slash
+//   index:  revision after which the changes are reported
+//   known:  values reported so far by key; unused, as etcd reports each change
+//   change: called with each change; nil values for deletions
+//
+// Return values:
+//   uint64: revision to resume from
+//   error:  errWatchHistoryLost if the revisions after `index` were
+//           compacted, else the error when watching
+//
+func (d *EtcdV3StateDriver) followPrefix(ctx context.Context, prefix string, index uint64, known map[string][]byte,
+	change func(key string, value []byte) bool) (uint64, error) {
+
+	next, err := d.watch(ctx, prefix, int64(index)+1, func(event etcdV3WatchEvent) bool {
+		key := watchEventKey(string(event.KV.Key))
+
+		if event.Type == "DELETE" {
+			return change(key, nil)
+		} else if len(event.KV.Value) == 0 {
+			return true // a directory
+		}
+
+		return change(key, event.KV.Value)
+	})
+
+	if next > 0 {
+		index = uint64(next - 1)
+	}
+
+	return index, err
+}
+
+//
+// Clear removes a key from etcd
+//
+// Parameters:
+//   key: key to be removed
+//
+// Return value:
+//   error: Error returned by etcd when deleting a key
+//
+func (d *EtcdV3StateDriver) Clear(key string) error {
+	return d.call("/kv/deleterange", &etcdV3DeleteRangeRequest{Key: []byte(etcdV3Key(key))}, nil)
+}
+
+//
+// ClearState removes a key from etcd
+//
+// Parameters:
+//   key: key to be removed
+//
+// Return value:
+//   error: Error returned by etcd when deleting a key
+//
+func (d *EtcdV3StateDriver) ClearState(key string) error {
+	return d.Clear(key)
+}
+
+//
+// ReadState reads a key's value into a types.State struct using
+// the provided unmarshaling function.
+//
+// Parameters:
+//   key:       key whose value is to be retrieved
+//   value:     value of the key as types.State
+//   unmarshal: function to be used for unmarshaling the (byte
+//              slice) value into types.State struct
+//
+// Return value:
+//   error: Error returned by etcd when reading key's value
+//          or error in unmarshaling key's value
+//
+func (d *EtcdV3StateDriver) ReadState(key string, value types.State,
+	unmarshal func([]byte, interface{}) error) error {
+
+	encodedState, err := d.Read(key)
+	if err != nil {
+		return err
+	}
+
+	return unmarshal(encodedState, value)
+}
+
+//
+// ReadAllState returns all state for a key
+//
+// Parameters:
+//   baseKey:    key whose values are to be read
+//   sType:      types.State struct into which values are to be
+//               unmarshaled
+//   unmarshal:  function that is used to convert key's values to
+//               values of type types.State
+//
+// Return values:
+//   []types.State: slice of states for the given key
+//   error:         Any error returned by readAllStateCommon
+//                  nil if successful
+//
+func (d *EtcdV3StateDriver) ReadAllState(baseKey string, sType types.State,
+	unmarshal func([]byte, interface{}) error) ([]types.State, error) {
+	return readAllStateCommon(d, baseKey, sType, unmarshal)
+}
+
+//
+// WatchAllState watches all state from the baseKey
+//
+// Parameters:
+//    baseKey:        key to be watched
+//    sType:          types.State struct to convert values to
+//    unmarshal:      function used to convert values to types.State
+//    chStateChanges: channel of types.WatchState
+//
+// Return values:
+//    error: Any error when watching all state
+//
+func (d *EtcdV3StateDriver) WatchAllState(baseKey string, sType types.State,
+	unmarshal func([]byte, interface{}) error, chStateChanges chan types.WatchState) error {
+
+	// channel that will be used to communicate value changes
+	// from the WatchAll function
+	chValueChanges := make(chan [2][]byte, 1)
+
+	// channel that will be used to communicate errors
+	// from the channelStateEvents method
+	chErr := make(chan error, 1)
+
+	go channelStateEvents(d, sType, unmarshal, chValueChanges, chStateChanges, chErr)
+
+	err := d.WatchAll(baseKey, chValueChanges)
+	if err != nil {
+		return err
+	}
+
+	err = <-chErr
+	return err
+}
+
+//
+// WriteState writes a value of types.State for a key in the KV store
+//
+// Parameters:
+//   key:   key to be stored in the KV store
+//   value: value as types.State
+//   marshal: function to be used to convert types.State to a form
+//            that can be stored in the KV store
+//
+// Return values:
+//   error: Error while marshaling or writing a key-value pair
+//          to the KV store
+//
+func (d *EtcdV3StateDriver) WriteState(key string, value types.State,
+	marshal func(interface{}) ([]byte, error)) error {
+	encodedState, err := marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return d.Write(key, encodedState)
+}
+
+//
+// AcquireLease creates `key` with the value `holder`, attached to an etcd
+// lease with the given TTL, or renews the lease if `holder` already holds it
+//
+// Parameters:
+//   key:    key of the lease
+//   holder: value identifying the holder of the lease
+//   ttl:    time after which the key is removed unless it's acquired again
+//
+// Return values:
+//   bool:  true if `holder` holds the lease
+//   error: Error returned by etcd when granting or renewing the lease, or
+//          when setting the key
+//
+func (d *EtcdV3StateDriver) AcquireLease(key, holder string, ttl time.Duration) (bool, error) {
+	key = etcdV3Key(key)
+
+	d.leasesMutex.Lock()
+	defer d.leasesMutex.Unlock()
+
+	id, err := d.renewLease(key, holder, ttl)
+	if err != nil {
+		return false, err
+	}
+
+	put := etcdV3RequestOp{RequestPut: &etcdV3PutRequest{Key: []byte(key), Value: []byte(holder), Lease: id}}
+
+	acquired, err := d.txn([]etcdV3Compare{keyMissing(key)}, put)
+	if err == nil && !acquired {
+		// renew the lease only if it's still ours
+		acquired, err = d.txn([]etcdV3Compare{keyEquals(key, holder)}, put)
+	}
+
+	if err == nil && !acquired {
+		// held by someone else, so the lease isn't needed
+		d.revokeLease(key, holder)
+	}
+
+	return acquired, err
+}
+
+//
+// renewLease renews the etcd lease used by `holder` to hold `key`, or grants
+// a new one if there's none or it expired; leasesMutex must be held
+//
+// Parameters:
+//   key:    key of the lease
+//   holder: value identifying the holder of the lease
+//   ttl:    TTL of the lease; rounded up to whole seconds
+//
+// Return values:
+//   int64: ID of the etcd lease
+//   error: Error returned by etcd when renewing or granting the lease
+//
+func (d *EtcdV3StateDriver) renewLease(key, holder string, ttl time.Duration) (int64, error) {
+	if id, found := d.leases[key+"/"+holder]; found {
+		resp := &struct {
+			Result etcdV3LeaseResponse `json:"result"`
+		}{}
+
+		if err := d.call("/lease/keepalive", &etcdV3LeaseRequest{ID: id}, resp); err != nil {
+			return 0, err
+		} else if resp.Result.TTL > 0 {
+			return id, nil
+		}
+	}
+
+	seconds := int64(math.Ceil(ttl.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	resp := &etcdV3LeaseResponse{}
+	if err := d.call("/lease/grant", &etcdV3LeaseRequest{TTL: seconds}, resp); err != nil {
+		return 0, err
+	}
+
+	d.leases[key+"/"+holder] = resp.ID
+	return resp.ID, nil
+}
+
+//
+// revokeLease revokes the etcd lease used by `holder` to hold `key`, which
+// deletes the key if it's attached to the lease; leasesMutex must be held.
+// Failures are only logged, as the lease expires anyway.
+//
+// Parameters:
+//   key:    key of the lease
+//   holder: value identifying the holder of the lease
+//
+func (d *EtcdV3StateDriver) revokeLease(key, holder string) {
+	id, found := d.leases[key+"/"+holder]
+	if !found {
+		return
+	}
+
+	delete(d.leases, key+"/"+holder)
+
+	if err := d.call("/lease/revoke", &etcdV3LeaseRequest{ID: id}, nil); err != nil {
+		log.Debugf("Failed to revoke etcd lease %x of %q: %v", id, key, err)
+	}
+}
+
+//
+// ReleaseLease removes `key` if its value is `holder`
+//
+// Parameters:
+//   key:    key of the lease
+//   holder: value identifying the holder of the lease
+//
+// Return value:
+//   error: Error returned by etcd when deleting the key
+//
+func (d *EtcdV3StateDriver) ReleaseLease(key, holder string) error {
+	key = etcdV3Key(key)
+
+	d.leasesMutex.Lock()
+	defer d.leasesMutex.Unlock()
+
+	_, err := d.txn([]etcdV3Compare{keyEquals(key, holder)},
+		etcdV3RequestOp{RequestDeleteRange: &etcdV3DeleteRangeRequest{Key: []byte(key)}})
+
+	d.revokeLease(key, holder)
+	return err
+}
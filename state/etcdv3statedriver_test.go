@@ -0,0 +1,180 @@
+package state
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+func setupEtcdV3Driver(t *testing.T) *EtcdV3StateDriver {
+	config := types.KVStoreConfig{StoreURL: os.Getenv("DATASTORE_ADDRESS")}
+
+	driver := &EtcdV3StateDriver{}
+
+	err := driver.Init(&config)
+	if err != nil {
+		t.Fatalf("driver init failed, err: %s", err)
+		return nil
+	}
+
+	return driver
+}
+
+// Test that keys are stored at the same paths as by the v2 driver, and that
+// directories are listed by prefix
+func TestEtcdV3StateDriverKeys(t *testing.T) {
+	for key, expected := range map[string]string{
+		"auth_proxy/local_users":    "/auth_proxy/local_users",
+		"/auth_proxy/local_users":   "/auth_proxy/local_users",
+		"auth_proxy/local_users/":   "/auth_proxy/local_users",
+		"/auth_proxy/local_users/x": "/auth_proxy/local_users/x",
+		"/":                         "/",
+	} {
+		if actual := etcdV3Key(key); actual != expected {
+			t.Errorf("expected key %q to be stored at %q, got %q", key, expected, actual)
+		}
+	}
+
+	for prefix, expected := range map[string][]byte{
+		"/auth_proxy/": []byte("/auth_proxy0"),
+		"a\xff":        []byte("b"),
+		"\xff\xff":     {0},
+	} {
+		if actual := prefixRangeEnd(prefix); !bytes.Equal(actual, expected) {
+			t.Errorf("expected the range of prefix %q to end at %q, got %q", prefix, expected, actual)
+		}
+	}
+}
+
+func TestEtcdV3StateDriverInit(t *testing.T) {
+	setupEtcdV3Driver(t)
+}
+
+// Test to check invalid state driver configurations
+func TestEtcdV3StateDriverInitInvalidConfig(t *testing.T) {
+	driver := &EtcdV3StateDriver{}
+	commonTestStateDriverInitInvalidConfig(t, driver)
+
+	// v2 addresses are for the v2 driver
+	if err := driver.Init(&types.KVStoreConfig{StoreURL: "etcd://127.0.0.1:2379"}); err == nil {
+		t.Fatalf("driver init succeeded, should have failed.")
+	}
+}
+
+// Test to check directory creation in KV store
+func TestEtcdV3StateDriverMkdir(t *testing.T) {
+	driver := setupEtcdV3Driver(t)
+	commonTestStateDriverMkdir(t, driver, "/test_mkdir")
+}
+
+// Test to check writes to KV store
+func TestEtcdV3StateDriverWrite(t *testing.T) {
+	driver := setupEtcdV3Driver(t)
+	commonTestStateDriverWrite(t, driver)
+}
+
+// Test to check read from KV store
+func TestEtcdV3StateDriverRead(t *testing.T) {
+	driver := setupEtcdV3Driver(t)
+	commonTestStateDriverRead(t, driver)
+}
+
+// Test to check read keys under a directory from KV store
+func TestEtcdV3StateDriverReadAll(t *testing.T) {
+	driver := setupEtcdV3Driver(t)
+	commonTestStateDriverReadAll(t, driver)
+
+	// keys below subdirectories aren't listed, like with the v2 API
+	if err := driver.Write("/TopDir/SubDir/TestKeyRawReadAll3", []byte("nested")); err != nil {
+		t.Fatalf("failed to write to etcd, err: %s", err)
+	}
+	defer driver.Clear("/TopDir/SubDir/TestKeyRawReadAll3")
+
+	values, err := driver.ReadAll("/TopDir")
+	if err != nil {
+		t.Fatalf("failed to read from etcd, err: %s", err)
+	}
+
+	for _, value := range values {
+		if string(value) == "nested" {
+			t.Fatalf("expected keys below subdirectories to be skipped")
+		}
+	}
+}
+
+func TestEtcdV3StateDriverWriteState(t *testing.T) {
+	driver := setupEtcdV3Driver(t)
+	commonTestStateDriverWriteState(t, driver)
+}
+
+// Test writing of state to KV store
+func TestEtcdV3StateDriverWriteStateForUpdate(t *testing.T) {
+	driver := setupEtcdV3Driver(t)
+	commonTestStateDriverWriteStateForUpdate(t, driver)
+}
+
+// Test clearing of state in KV store
+func TestEtcdV3StateDriverClearState(t *testing.T) {
+	driver := setupEtcdV3Driver(t)
+	commonTestStateDriverClearState(t, driver)
+}
+
+// Test reading of state from KV store
+func TestEtcdV3StateDriverReadState(t *testing.T) {
+	driver := setupEtcdV3Driver(t)
+	commonTestStateDriverReadState(t, driver)
+}
+
+// Test reading of state after update to KV store
+func TestEtcdV3StateDriverReadStateAfterUpdate(t *testing.T) {
+	driver := setupEtcdV3Driver(t)
+	commonTestStateDriverReadStateAfterUpdate(t, driver)
+}
+
+// Test reading of state after clear from KV store
+func TestEtcdV3StateDriverReadStateAfterClear(t *testing.T) {
+	driver := setupEtcdV3Driver(t)
+	commonTestStateDriverReadStateAfterClear(t, driver)
+}
+
+// Test to watch all 'created' state in KV store
+func TestEtcdV3StateDriverWatchAllStateCreate(t *testing.T) {
+	driver := setupEtcdV3Driver(t)
+	defer driver.Deinit()
+	commonTestStateDriverWatchAllStateCreate(t, driver)
+}
+
+// Test to watch all 'modified' state in KV store
+func TestEtcdV3StateDriverWatchAllStateModify(t *testing.T) {
+	driver := setupEtcdV3Driver(t)
+	defer driver.Deinit()
+	commonTestStateDriverWatchAllStateModify(t, driver)
+}
+
+// Test to watch all 'deleted' state in KV store
+func TestEtcdV3StateDriverWatchAllStateDelete(t *testing.T) {
+	driver := setupEtcdV3Driver(t)
+	defer driver.Deinit()
+	commonTestStateDriverWatchAllStateDelete(t, driver)
+}
+
+// Test to watch the changes to keys in KV store
+func TestEtcdV3StateDriverWatch(t *testing.T) {
+	driver := setupEtcdV3Driver(t)
+	defer driver.Deinit()
+	commonTestStateDriverWatch(t, driver)
+}
+
+// Test to check leases in KV store; etcd checks for expired leases every 500ms
+func TestEtcdV3StateDriverLease(t *testing.T) {
+	driver := setupEtcdV3Driver(t)
+	commonTestStateDriverLease(t, driver, 2*time.Second, time.Second)
+}
+
+// Test to check that a follower takes over when the leader goes away
+func TestEtcdV3StateDriverLeaderFailover(t *testing.T) {
+	commonTestLeaderFailover(t, setupEtcdV3Driver(t), setupEtcdV3Driver(t), 2*time.Second, time.Second)
+}
@@ -0,0 +1,32 @@
+package state
+
+import (
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// Example_watchAuthorizations logs the changes to the authorizations made by
+// any instance sharing the data store, as a cache of them would use them to
+// drop its stale entries
+func Example_watchAuthorizations() {
+	drv, err := GetStateDriver()
+	if err != nil {
+		log.Errorf("Failed to get the state driver: %s", err)
+		return
+	}
+
+	events, stop := drv.Watch(types.AuthZDir)
+	defer stop()
+
+	for event := range events {
+		switch event.Type {
+		case types.WatchEventCreate:
+			log.Infof("Authorization %s added: %s", event.Key, event.Value)
+		case types.WatchEventUpdate:
+			log.Infof("Authorization %s updated: %s", event.Key, event.Value)
+		case types.WatchEventDelete:
+			log.Infof("Authorization %s deleted", event.Key)
+		}
+	}
+}
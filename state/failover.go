@@ -0,0 +1,147 @@
+package state
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains the helpers of connecting to a data store cluster given
+// by several endpoints. The etcd v2 client balances its requests over the
+// endpoints itself; the consul client and the etcd v3 driver only know of a
+// single address, so their requests go through a transport which sends them
+// to the next endpoint when the current one can't be reached.
+
+// storeHostPorts returns the endpoints of the data store in its configuration,
+// e.g. etcd://host1:2379,etcd://host2:2379
+// params:
+//  config: configuration of the data store
+//  scheme: scheme every endpoint must use, e.g. "etcd://"
+// return values:
+//  []string: the host:port of each endpoint
+//  bool: false if an endpoint doesn't use `scheme`
+func storeHostPorts(config *types.KVStoreConfig, scheme string) ([]string, bool) {
+	hostPorts := []string{}
+
+	for _, endpoint := range strings.Split(config.StoreURL, common.DataStoreEndpointSeparator) {
+		endpoint = strings.TrimSpace(endpoint)
+		if !strings.HasPrefix(endpoint, scheme) {
+			return nil, false
+		}
+
+		hostPorts = append(hostPorts, strings.TrimSuffix(strings.TrimPrefix(endpoint, scheme), "/"))
+	}
+
+	return hostPorts, true
+}
+
+// isDialError returns true if the given error is the failure to connect, i.e.
+// nothing was sent and the request can safely be sent again
+// params:
+//  err: error returned by an HTTP client or transport
+// return values:
+//  bool: true if the connection couldn't be made
+func isDialError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// failoverTransport is an http.RoundTripper sending the requests to one of a
+// data store's endpoints, and to the next one when it can't be reached. It
+// sticks to the endpoint which answered last, so that the endpoints are only
+// gone through while one of them is down.
+type failoverTransport struct {
+	transport http.RoundTripper
+	hostPorts []string
+
+	mutex   sync.Mutex
+	current int // index of the endpoint the requests are sent to
+}
+
+// newFailoverTransport returns a transport sending requests to the given
+// endpoints, whatever host their URL names
+// params:
+//  hostPorts: host:port of each endpoint of the data store
+//  transport: transport the requests are sent with
+// return values:
+//  http.RoundTripper: `transport` itself if there's a single endpoint
+func newFailoverTransport(hostPorts []string, transport http.RoundTripper) http.RoundTripper {
+	if len(hostPorts) < 2 {
+		return transport
+	}
+
+	return &failoverTransport{transport: transport, hostPorts: hostPorts}
+}
+
+// endpoint returns the index of the endpoint requests are currently sent to
+func (t *failoverTransport) endpoint() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.current
+}
+
+// failover moves on from the endpoint at index `failed` to the next one,
+// unless a concurrent request did already
+func (t *failoverTransport) failover(failed int, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.current == failed {
+		t.current = (failed + 1) % len(t.hostPorts)
+		log.Warnf("Data store endpoint %s can't be reached, using %s: %s", t.hostPorts[failed], t.hostPorts[t.current], err)
+	}
+}
+
+// RoundTrip sends the request to the current endpoint, trying each of the
+// others in turn if it can't be reached
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// transports close the body of failed requests, so each attempt needs its own
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	var err error
+	for attempt := 0; attempt < len(t.hostPorts); attempt++ {
+		endpoint := t.endpoint()
+
+		attemptURL := *req.URL
+		attemptURL.Host = t.hostPorts[endpoint]
+
+		attemptReq := new(http.Request)
+		*attemptReq = *req
+		attemptReq.URL = &attemptURL
+		attemptReq.Host = ""
+
+		if body != nil {
+			attemptReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		var resp *http.Response
+		if resp, err = t.transport.RoundTrip(attemptReq); !isDialError(err) {
+			return resp, err
+		}
+
+		t.failover(endpoint, err)
+	}
+
+	return nil, err
+}
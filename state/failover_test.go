@@ -0,0 +1,87 @@
+package state
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// TestStoreHostPorts tests that the endpoints of a data store are split
+func TestStoreHostPorts(t *testing.T) {
+	hostPorts, ok := storeHostPorts(&types.KVStoreConfig{StoreURL: "etcd://10.0.0.1:2379/, etcd://10.0.0.2:2379"}, "etcd://")
+	if !ok || !reflect.DeepEqual(hostPorts, []string{"10.0.0.1:2379", "10.0.0.2:2379"}) {
+		t.Fatalf("unexpected endpoints: %v", hostPorts)
+	}
+
+	if _, ok := storeHostPorts(&types.KVStoreConfig{StoreURL: "etcd://10.0.0.1:2379,consul://10.0.0.2:8500"}, "etcd://"); ok {
+		t.Error("expected an endpoint of another data store to be refused")
+	}
+}
+
+// unreachableAddress returns the address of a port nothing listens on
+func unreachableAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	address := listener.Addr().String()
+	listener.Close()
+
+	return address
+}
+
+// TestFailoverTransport tests that requests go to the next endpoint when one
+// can't be reached, and stick to it
+func TestFailoverTransport(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	down := unreachableAddress(t)
+	up := strings.TrimPrefix(server.URL, "http://")
+
+	transport := newFailoverTransport([]string{down, up}, &http.Transport{}).(*failoverTransport)
+	client := &http.Client{Transport: transport}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Post("http://"+down+"/v3/kv/range", "application/json", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatalf("expected the request to reach the endpoint which is up, got %v", err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != "payload" {
+			t.Errorf("expected the body to be sent to the endpoint which is up, got %q", body)
+		}
+	}
+
+	if requests != 3 || transport.endpoint() != 1 {
+		t.Errorf("expected all the requests to go to the endpoint which is up, got %d requests, current endpoint %d", requests, transport.endpoint())
+	}
+
+	// once every endpoint is down, the failure to connect is returned
+	server.Close()
+
+	if _, err := client.Get("http://" + up + "/"); err == nil || !isDialError(err) {
+		t.Errorf("expected the failure to connect, got %v", err)
+	}
+
+	// a single endpoint needs no failover
+	if _, ok := newFailoverTransport([]string{up}, http.DefaultTransport).(*failoverTransport); ok {
+		t.Error("expected the transport of a single endpoint to be used as is")
+	}
+}
@@ -0,0 +1,178 @@
+package state
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains the election of a leader among proxy instances sharing a
+// datastore, e.g. an active/passive pair behind keepalived. The instances
+// compete for a lease in the datastore; the one holding it performs the work
+// which must only be done once, like adding the default users or sweeping
+// expired objects, while all of them keep serving requests. If the leader goes
+// away, its lease expires and another instance takes over.
+
+// LeaderMetrics describes an instance's view of the leader election
+type LeaderMetrics struct {
+	ID       string `json:"id"`        // this instance
+	Leader   bool   `json:"leader"`    // whether this instance holds the lease
+	LeaseTTL int64  `json:"lease_ttl"` // seconds after which a lease which isn't renewed expires
+	Elected  uint64 `json:"elected"`   // number of times this instance became the leader
+	Failures uint64 `json:"failures"`  // attempts to acquire or renew the lease which failed
+}
+
+// LeaderElector campaigns for the lease `key` on behalf of the instance `id`.
+// An instance considers itself the leader from the moment it acquired or
+// renewed the lease until either renewing it fails or `ttl` passed since it
+// was last renewed, so that it steps down before anyone else can take over.
+type LeaderElector struct {
+	driver types.StateDriver
+	key    string
+	id     string
+	ttl    time.Duration
+	now    func() time.Time // replaced by tests
+
+	mutex     sync.Mutex
+	leader    bool
+	renewedAt time.Time // when the last successful campaign started
+	metrics   LeaderMetrics
+	onElected []func()
+}
+
+// NewLeaderElector returns an elector which isn't the leader until it campaigned.
+// params:
+//  driver: state driver holding the lease
+//  key: key of the lease
+//  id: identifies this instance; it must be unique among the instances
+//  ttl: time after which the lease expires unless it's renewed
+// return values:
+//  *LeaderElector: the elector
+func NewLeaderElector(driver types.StateDriver, key, id string, ttl time.Duration) *LeaderElector {
+	return &LeaderElector{
+		driver:  driver,
+		key:     key,
+		id:      id,
+		ttl:     ttl,
+		now:     time.Now,
+		metrics: LeaderMetrics{ID: id, LeaseTTL: int64(ttl / time.Second)},
+	}
+}
+
+// OnElected registers a function which is called every time this instance
+// becomes the leader. The functions are called in the order they were
+// registered, from the goroutine which campaigned.
+func (e *LeaderElector) OnElected(f func()) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.onElected = append(e.onElected, f)
+}
+
+// isLeader returns true if the lease is held as of `now`; e.mutex must be held
+func (e *LeaderElector) isLeader(now time.Time) bool {
+	return e.leader && now.Sub(e.renewedAt) < e.ttl
+}
+
+// IsLeader returns true if this instance is the leader
+func (e *LeaderElector) IsLeader() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.isLeader(e.now())
+}
+
+// Metrics returns a snapshot of the elector's metrics
+func (e *LeaderElector) Metrics() LeaderMetrics {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	metrics := e.metrics
+	metrics.Leader = e.isLeader(e.now())
+	return metrics
+}
+
+// Campaign tries to acquire or renew the lease once. If this instance just
+// became the leader, the functions registered using OnElected() are called
+// before it returns.
+// return values:
+//  bool: true if this instance is the leader
+func (e *LeaderElector) Campaign() bool {
+	started := e.now()
+	acquired, err := e.driver.AcquireLease(e.key, e.id, e.ttl)
+
+	e.mutex.Lock()
+
+	wasLeader := e.isLeader(started)
+	e.leader = acquired && err == nil
+
+	if e.leader {
+		e.renewedAt = started
+	}
+
+	if err != nil {
+		e.metrics.Failures++
+	}
+
+	elected := e.leader && !wasLeader
+	if elected {
+		e.metrics.Elected++
+	}
+
+	leader, onElected := e.leader, e.onElected
+	e.mutex.Unlock()
+
+	switch {
+	case elected:
+		log.Infof("%s became the leader", e.id)
+		for _, f := range onElected {
+			f()
+		}
+	case wasLeader && !leader:
+		log.Warnf("%s is no longer the leader (error: %v)", e.id, err)
+	case err != nil:
+		log.Debugf("%s failed to campaign for the leader lease: %s", e.id, err)
+	}
+
+	return leader
+}
+
+// Run campaigns three times per TTL until `done` is closed, and then
+// releases the lease if it's held so that another instance takes over
+// without waiting for it to expire.
+func (e *LeaderElector) Run(done chan bool) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.Campaign()
+		case <-done:
+			e.resign()
+			return
+		}
+	}
+}
+
+// resign releases the lease if this instance holds it
+func (e *LeaderElector) resign() {
+	e.mutex.Lock()
+	wasLeader := e.leader
+	e.leader = false
+	e.mutex.Unlock()
+
+	if !wasLeader {
+		return
+	}
+
+	if err := e.driver.ReleaseLease(e.key, e.id); err != nil {
+		log.Warnf("%s failed to release the leader lease: %s", e.id, err)
+		return
+	}
+
+	log.Infof("%s resigned as the leader", e.id)
+}
@@ -0,0 +1,258 @@
+package state
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// leaseStateDriver is an in-memory state driver which only implements leases;
+// all the keys share a single lease.
+type leaseStateDriver struct {
+	types.StateDriver
+
+	mutex   sync.Mutex
+	now     func() time.Time
+	holder  string
+	expires time.Time
+}
+
+func (d *leaseStateDriver) AcquireLease(key, holder string, ttl time.Duration) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.now()
+	if d.holder != "" && d.holder != holder && now.Before(d.expires) {
+		return false, nil
+	}
+
+	d.holder, d.expires = holder, now.Add(ttl)
+	return true, nil
+}
+
+func (d *leaseStateDriver) ReleaseLease(key, holder string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.holder == holder {
+		d.holder = ""
+	}
+
+	return nil
+}
+
+// killableStateDriver is an instance's connection to a shared state driver;
+// once it's killed, the instance can't reach the datastore anymore.
+type killableStateDriver struct {
+	types.StateDriver
+	killed int32
+}
+
+func (d *killableStateDriver) kill() {
+	atomic.StoreInt32(&d.killed, 1)
+}
+
+func (d *killableStateDriver) AcquireLease(key, holder string, ttl time.Duration) (bool, error) {
+	if atomic.LoadInt32(&d.killed) == 1 {
+		return false, errConnectionRefused
+	}
+
+	return d.StateDriver.AcquireLease(key, holder, ttl)
+}
+
+func (d *killableStateDriver) ReleaseLease(key, holder string) error {
+	if atomic.LoadInt32(&d.killed) == 1 {
+		return errConnectionRefused
+	}
+
+	return d.StateDriver.ReleaseLease(key, holder)
+}
+
+// TestLeaderElection drives two electors sharing a lease using a fake clock
+func TestLeaderElection(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	ttl := 15 * time.Second
+	store := &leaseStateDriver{now: clock}
+
+	newElector := func(id string) (*LeaderElector, *killableStateDriver, *int) {
+		driver := &killableStateDriver{StateDriver: store}
+		elector := NewLeaderElector(driver, "leader", id, ttl)
+		elector.now = clock
+
+		elected := 0
+		elector.OnElected(func() { elected++ })
+
+		return elector, driver, &elected
+	}
+
+	a, aDriver, aElected := newElector("a")
+	b, _, bElected := newElector("b")
+
+	if !a.Campaign() || b.Campaign() {
+		t.Fatal("expected the first instance to become the leader")
+	}
+
+	// renewing the lease doesn't elect the leader again
+	now = now.Add(ttl / 2)
+	if !a.Campaign() || b.Campaign() || *aElected != 1 || *bElected != 0 {
+		t.Fatalf("expected the leader to renew its lease, got elected %d and %d times", *aElected, *bElected)
+	}
+
+	// the leader steps down as soon as it can't renew the lease...
+	aDriver.kill()
+	if a.Campaign() || a.IsLeader() {
+		t.Fatal("expected the leader to step down when renewing the lease fails")
+	}
+
+	if metrics := a.Metrics(); metrics.Leader || metrics.Elected != 1 || metrics.Failures != 1 {
+		t.Errorf("unexpected metrics: %#v", metrics)
+	}
+
+	// ...but nobody takes over before the lease expired
+	now = now.Add(ttl - time.Second)
+	if b.Campaign() {
+		t.Fatal("expected the lease to be held until it expires")
+	}
+
+	now = now.Add(time.Second)
+	if !b.Campaign() || *bElected != 1 {
+		t.Fatal("expected the other instance to take over once the lease expired")
+	}
+
+	if metrics := b.Metrics(); !metrics.Leader || metrics.ID != "b" || metrics.LeaseTTL != 15 || metrics.Elected != 1 {
+		t.Errorf("unexpected metrics: %#v", metrics)
+	}
+
+	// a leader which resigns hands over right away
+	atomic.StoreInt32(&aDriver.killed, 0)
+	if a.Campaign() {
+		t.Fatal("expected the lease to be held by the new leader")
+	}
+
+	b.resign()
+	if b.IsLeader() || !a.Campaign() || *aElected != 2 {
+		t.Fatal("expected the lease to be released when the leader resigns")
+	}
+
+	// a leader which didn't renew its lease in time steps down by itself
+	now = now.Add(ttl)
+	if a.IsLeader() {
+		t.Fatal("expected the leader to step down once its lease may have expired")
+	}
+
+	// and is elected again if the lease is still free
+	if !a.Campaign() || *aElected != 3 {
+		t.Fatal("expected the leader to be elected again")
+	}
+}
+
+// testInstance is an instance of the proxy as far as leader election is
+// concerned: it campaigns for the lease and performs its duties while it's
+// the leader.
+type testInstance struct {
+	driver  *killableStateDriver
+	elector *LeaderElector
+	done    chan bool
+
+	elected int32 // number of times the instance became the leader
+	duties  int32 // number of times the instance did its background duties
+}
+
+// startTestInstance starts an instance which does its duties every `ttl`/10
+func startTestInstance(driver types.StateDriver, key, id string, ttl time.Duration) *testInstance {
+	i := &testInstance{driver: &killableStateDriver{StateDriver: driver}, done: make(chan bool)}
+
+	i.elector = NewLeaderElector(i.driver, key, id, ttl)
+	i.elector.OnElected(func() { atomic.AddInt32(&i.elected, 1) })
+	i.elector.Campaign()
+
+	go i.elector.Run(i.done)
+
+	go func() {
+		ticker := time.NewTicker(ttl / 10)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if i.elector.IsLeader() {
+					atomic.AddInt32(&i.duties, 1)
+				}
+			case <-i.done:
+				return
+			}
+		}
+	}()
+
+	return i
+}
+
+// commonTestLeaderFailover runs two instances against the same datastore,
+// kills the leader and checks that the other one takes over its duties within
+// the lease TTL. `grace` is the time the datastore may take to remove a lease
+// beyond its TTL.
+func commonTestLeaderFailover(t *testing.T, d1, d2 types.StateDriver, ttl, grace time.Duration) {
+	// leases left over by earlier runs only expire after a while
+	key := types.AuthProxyDir + "/leader_test_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	leader := startTestInstance(d1, key, "proxy-1", ttl)
+	defer close(leader.done)
+
+	follower := startTestInstance(d2, key, "proxy-2", ttl)
+	defer close(follower.done)
+
+	if !leader.elector.IsLeader() || follower.elector.IsLeader() {
+		t.Fatal("expected the first instance to become the leader")
+	}
+
+	// the leader keeps the lease and is the only one doing its duties
+	time.Sleep(ttl)
+
+	if !leader.elector.IsLeader() || atomic.LoadInt32(&leader.duties) == 0 || atomic.LoadInt32(&follower.duties) != 0 {
+		t.Fatalf("expected only the leader to do its duties, got %d and %d",
+			atomic.LoadInt32(&leader.duties), atomic.LoadInt32(&follower.duties))
+	}
+
+	// the lease expires at most `ttl` after the last renewal, and the follower
+	// campaigns every `ttl`/3
+	killed := time.Now()
+	leader.driver.kill()
+
+	deadline := killed.Add(ttl + ttl/3 + grace)
+	for !follower.elector.IsLeader() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !follower.elector.IsLeader() {
+		t.Fatalf("expected the follower to take over within %s", deadline.Sub(killed))
+	}
+
+	t.Logf("the follower took over after %s", time.Since(killed))
+
+	if leader.elector.IsLeader() {
+		t.Fatal("expected the killed leader to step down")
+	}
+
+	leaderDuties := atomic.LoadInt32(&leader.duties)
+	time.Sleep(ttl / 2)
+
+	if atomic.LoadInt32(&follower.elected) != 1 || atomic.LoadInt32(&follower.duties) == 0 {
+		t.Error("expected the new leader to pick up the duties")
+	}
+
+	if atomic.LoadInt32(&leader.duties) != leaderDuties {
+		t.Error("expected the killed leader to stop doing its duties")
+	}
+}
+
+// TestLeaderFailover kills the leader of two instances sharing an in-memory lease
+func TestLeaderFailover(t *testing.T) {
+	store := &leaseStateDriver{now: time.Now}
+	commonTestLeaderFailover(t, store, store, 500*time.Millisecond, 50*time.Millisecond)
+}
@@ -0,0 +1,259 @@
+package state
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains a state driver which retries the calls failing because
+// the datastore is briefly unreachable, e.g. while etcd restarts or elects a
+// new leader, rather than failing the requests making them. It's wrapped by
+// the circuit breaker, so a call only counts as a failure there once its
+// retries are used up.
+
+const (
+	// defaultRetryAttempts is the number of times a call is made at most
+	defaultRetryAttempts = 4
+
+	// defaultRetryBudget is the time after the first attempt of a call past
+	// which no retry is started, so that callers get an error eventually even
+	// if every attempt waits for the datastore's timeouts
+	defaultRetryBudget = 5 * time.Second
+
+	// defaultRetryBaseDelay is the delay before the first retry; it doubles
+	// with every retry, up to defaultRetryMaxDelay
+	defaultRetryBaseDelay = 100 * time.Millisecond
+	defaultRetryMaxDelay  = 2 * time.Second
+)
+
+// transientErrors are parts of the (lower-cased) messages of errors which are
+// worth retrying: the datastore couldn't be reached, dropped the connection,
+// timed out or has no leader
+var transientErrors = []string{
+	"connection refused",
+	"connection reset",
+	"broken pipe",
+	"no route to host",
+	"eof",
+	"timeout",
+	"deadline exceeded",
+	"leader",
+	"unavailable",
+}
+
+// isTransientError returns true if the given error may go away by retrying the call.
+// params:
+//  err: error returned by a state driver
+// return values:
+//  bool: false for nil and for *auth_errors.AuthError, which are answers from
+//        a working datastore (e.g. ErrKeyNotFound)
+func isTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if _, isAuthError := err.(*auth_errors.AuthError); isAuthError {
+		return false
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, part := range transientErrors {
+		if strings.Contains(msg, part) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff returns how long to wait before a retry: the delay doubles with
+// every retry up to `maxDelay`, and is randomly shortened by up to half so
+// that instances which lost the datastore at the same time don't retry in lockstep.
+// params:
+//  retry: number of the retry, starting at 0
+//  baseDelay: delay before the first retry
+//  maxDelay: longest delay
+// return values:
+//  time.Duration: the delay
+func backoff(retry int, baseDelay, maxDelay time.Duration) time.Duration {
+	delay := maxDelay
+	if retry < 32 && baseDelay<<uint(retry) < maxDelay {
+		delay = baseDelay << uint(retry)
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// RetryDriver is a types.StateDriver which passes all calls on to another
+// driver and retries the reads, writes and clears failing with a transient
+// error (see isTransientError()) with exponential backoff and jitter. A call
+// is made at most `attempts` times, and not retried once `budget` has passed
+// since its first attempt. Watches and leases aren't retried: both are
+// renewed by their callers anyway.
+//
+// The loss of the datastore is logged once, when a call used up its retries,
+// and so is regaining it, when a call succeeds again.
+type RetryDriver struct {
+	types.StateDriver
+
+	attempts  int
+	budget    time.Duration
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	sleep     func(time.Duration) // replaced by tests
+	now       func() time.Time    // replaced by tests
+
+	mutex  sync.Mutex
+	lostAt time.Time // when the datastore was lost; zero while it's reachable
+}
+
+// NewRetryDriver wraps the given state driver so that calls failing with a transient error are retried.
+// params:
+//  driver: state driver to wrap; it must be initialized already
+//  attempts: number of times a call is made at most
+//  budget: time after the first attempt of a call past which no retry is started
+// return values:
+//  *RetryDriver: the wrapping driver
+func NewRetryDriver(driver types.StateDriver, attempts int, budget time.Duration) *RetryDriver {
+	return &RetryDriver{
+		StateDriver: driver,
+		attempts:    attempts,
+		budget:      budget,
+		baseDelay:   defaultRetryBaseDelay,
+		maxDelay:    defaultRetryMaxDelay,
+		sleep:       time.Sleep,
+		now:         time.Now,
+	}
+}
+
+// call runs `f` until it doesn't fail with a transient error or the attempts or budget are used up
+func (r *RetryDriver) call(f func() error) error {
+	start := r.now()
+
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if !isTransientError(err) {
+			r.reachable()
+			return err
+		}
+
+		delay := backoff(attempt-1, r.baseDelay, r.maxDelay)
+		if attempt >= r.attempts || r.now().Add(delay).Sub(start) > r.budget {
+			r.unreachable(err)
+			return err
+		}
+
+		log.Debugf("Datastore call failed (attempt %d of %d), retrying in %s: %s", attempt, r.attempts, delay, err)
+		r.sleep(delay)
+	}
+}
+
+// reachable records that a call got an answer from the datastore
+func (r *RetryDriver) reachable() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.lostAt.IsZero() {
+		log.Infof("Regained the datastore after %s", r.now().Sub(r.lostAt))
+		r.lostAt = time.Time{}
+	}
+}
+
+// unreachable records that a call used up its retries
+func (r *RetryDriver) unreachable(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.lostAt.IsZero() {
+		log.Warnf("Lost the datastore, calls fail until it's back: %s", err)
+		r.lostAt = r.now()
+	}
+}
+
+// Mkdir creates a directory, retrying transient failures
+func (r *RetryDriver) Mkdir(key string) error {
+	return r.call(func() error { return r.StateDriver.Mkdir(key) })
+}
+
+// Read returns the value of `key`, retrying transient failures
+func (r *RetryDriver) Read(key string) ([]byte, error) {
+	var value []byte
+
+	err := r.call(func() error {
+		var err error
+		value, err = r.StateDriver.Read(key)
+		return err
+	})
+
+	return value, err
+}
+
+// ReadAll returns all values under `baseKey`, retrying transient failures
+func (r *RetryDriver) ReadAll(baseKey string) ([][]byte, error) {
+	var values [][]byte
+
+	err := r.call(func() error {
+		var err error
+		values, err = r.StateDriver.ReadAll(baseKey)
+		return err
+	})
+
+	return values, err
+}
+
+// Write writes `value` to `key`, retrying transient failures; writes replace
+// the whole value, so repeating one which did make it is harmless
+func (r *RetryDriver) Write(key string, value []byte) error {
+	return r.call(func() error { return r.StateDriver.Write(key, value) })
+}
+
+// Clear removes `key`, retrying transient failures
+func (r *RetryDriver) Clear(key string) error {
+	return r.call(func() error { return r.StateDriver.Clear(key) })
+}
+
+// ReadState reads `key` into `value`, retrying transient failures
+func (r *RetryDriver) ReadState(key string, value types.State,
+	unmarshal func([]byte, interface{}) error) error {
+
+	return r.call(func() error { return r.StateDriver.ReadState(key, value, unmarshal) })
+}
+
+// ReadAllState reads all states under `baseKey`, retrying transient failures
+func (r *RetryDriver) ReadAllState(baseKey string, stateType types.State,
+	unmarshal func([]byte, interface{}) error) ([]types.State, error) {
+
+	var states []types.State
+
+	err := r.call(func() error {
+		var err error
+		states, err = r.StateDriver.ReadAllState(baseKey, stateType, unmarshal)
+		return err
+	})
+
+	return states, err
+}
+
+// WriteState writes `value` to `key`, retrying transient failures
+func (r *RetryDriver) WriteState(key string, value types.State,
+	marshal func(interface{}) ([]byte, error)) error {
+
+	return r.call(func() error { return r.StateDriver.WriteState(key, value, marshal) })
+}
+
+// ClearState removes `key`, retrying transient failures
+func (r *RetryDriver) ClearState(key string) error {
+	return r.call(func() error { return r.StateDriver.ClearState(key) })
+}
@@ -0,0 +1,155 @@
+package state
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+)
+
+// newTestRetryDriver returns a retry driver around a flaky driver whose sleeps
+// only advance its clock, and the time slept so far
+func newTestRetryDriver(attempts int, budget time.Duration) (*RetryDriver, *flakyStateDriver, *time.Duration) {
+	flaky := newFlakyStateDriver()
+	retry := NewRetryDriver(flaky, attempts, budget)
+
+	now := time.Now()
+	slept := new(time.Duration)
+
+	retry.now = func() time.Time { return now.Add(*slept) }
+	retry.sleep = func(d time.Duration) { *slept += d }
+
+	return retry, flaky, slept
+}
+
+// TestRetryDriverRetries tests that transient failures are retried until the
+// call succeeds, and only as long as the attempts last
+func TestRetryDriverRetries(t *testing.T) {
+	retry, flaky, slept := newTestRetryDriver(4, time.Minute)
+
+	// the datastore comes back on the third attempt
+	flaky.down = true
+	flaky.onCall = func() {
+		if flaky.calls == 3 {
+			flaky.down = false
+		}
+	}
+
+	if err := retry.Write("/k", []byte("v")); err != nil {
+		t.Fatalf("expected the write to succeed once the datastore is back, got %v", err)
+	}
+
+	if flaky.calls != 3 || *slept < defaultRetryBaseDelay/2+defaultRetryBaseDelay {
+		t.Errorf("expected 3 attempts with backoff in between, got %d attempts after %s", flaky.calls, *slept)
+	}
+
+	// the datastore stays down: the last error is returned after all the attempts
+	flaky.onCall = nil
+	flaky.down = true
+	flaky.calls = 0
+
+	if _, err := retry.Read("/k"); err != errConnectionRefused {
+		t.Fatalf("expected the driver's error, got %v", err)
+	}
+
+	if flaky.calls != 4 {
+		t.Errorf("expected 4 attempts, got %d", flaky.calls)
+	}
+
+	// answers from a working datastore aren't retried
+	flaky.down = false
+	flaky.calls = 0
+
+	if _, err := retry.Read("/missing"); err != auth_errors.ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	if flaky.calls != 1 {
+		t.Errorf("expected a single attempt for a missing key, got %d", flaky.calls)
+	}
+}
+
+// TestRetryDriverBudget tests that no retry is started past the budget
+func TestRetryDriverBudget(t *testing.T) {
+	retry, flaky, slept := newTestRetryDriver(10, time.Second)
+	retry.baseDelay = time.Second
+
+	// the first retry waits at most 1s, the second at least another 1s
+	flaky.down = true
+
+	if err := retry.Clear("/k"); err != errConnectionRefused {
+		t.Fatalf("expected the driver's error, got %v", err)
+	}
+
+	if flaky.calls != 2 || *slept > time.Second {
+		t.Errorf("expected 2 attempts within the budget, got %d attempts after %s", flaky.calls, *slept)
+	}
+}
+
+// TestRetryDriverLostAndRegained tests that losing and regaining the datastore is only recorded once
+func TestRetryDriverLostAndRegained(t *testing.T) {
+	retry, flaky, _ := newTestRetryDriver(2, time.Minute)
+
+	flaky.down = true
+
+	for i := 0; i < 3; i++ {
+		retry.Read("/k")
+	}
+
+	lostAt := retry.lostAt
+	if lostAt.IsZero() {
+		t.Fatal("expected the datastore to be recorded as lost")
+	}
+
+	retry.ReadAll("/")
+	if retry.lostAt != lostAt {
+		t.Errorf("expected the datastore to be recorded as lost once, at %s; got %s", lostAt, retry.lostAt)
+	}
+
+	flaky.down = false
+
+	if _, err := retry.ReadAll("/"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !retry.lostAt.IsZero() {
+		t.Errorf("expected the datastore to be recorded as regained")
+	}
+}
+
+// TestBackoff tests that the backoff doubles up to the maximum delay, with jitter
+func TestBackoff(t *testing.T) {
+	for retry := 0; retry < 70; retry++ {
+		expected := time.Minute
+		if retry < 6 {
+			expected = time.Second << uint(retry)
+		}
+
+		delay := backoff(retry, time.Second, time.Minute)
+		if delay < expected/2 || delay > expected {
+			t.Errorf("expected retry %d to wait between %s and %s, got %s", retry, expected/2, expected, delay)
+		}
+	}
+}
+
+// TestIsTransientError tests which errors are retried
+func TestIsTransientError(t *testing.T) {
+	for err, expected := range map[error]bool{
+		nil:                                      false,
+		auth_errors.ErrKeyNotFound:               false,
+		auth_errors.ErrDatastoreUnavailable:      false,
+		auth_errors.ErrDatastoreAccessDenied:     false,
+		errConnectionRefused:                     true,
+		errors.New("unexpected EOF"):             true,
+		errors.New("context deadline exceeded"):  true,
+		errors.New("etcdserver: leader changed"): true,
+		errors.New("client: etcd cluster is unavailable or misconfigured"): true,
+		errors.New("Unexpected response code: 500 (No cluster leader)"):    true,
+		errors.New("invalid character 'x' looking for beginning of value"): false,
+	} {
+		if actual := isTransientError(err); actual != expected {
+			t.Errorf("expected isTransientError(%v) to be %t", err, expected)
+		}
+	}
+}
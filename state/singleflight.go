@@ -0,0 +1,237 @@
+package state
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains a state driver which lets concurrent identical reads
+// share a single datastore round trip. When many clients poll at once, e.g.
+// a UI open in dozens of tabs, the same user and authorization keys are read
+// over and over within a few milliseconds. Nothing is kept once a read is
+// done, so unlike the circuit breaker's cache this never serves old values.
+
+// errSharedReadFailed is returned to the callers waiting for a read which panicked
+var errSharedReadFailed = errors.New("shared read from the datastore failed")
+
+// SingleFlightMetrics counts the reads done through a SingleFlightDriver
+type SingleFlightMetrics struct {
+	Reads  uint64 `json:"reads"`  // reads passed on to the datastore
+	Shared uint64 `json:"shared"` // reads which waited for an identical one instead
+}
+
+// flight is a read whose result is shared by all callers asking for it until it's done
+type flight struct {
+	key    string        // datastore key being read
+	done   chan struct{} // closed once values and err are set
+	values [][]byte
+	err    error
+}
+
+// SingleFlightDriver is a types.StateDriver which passes all calls on to
+// another driver, except that a read arriving while an identical one is in
+// progress waits for and returns that read's result, including its error.
+// Reads are identical if they're of the same kind (e.g. Read() and ReadState()
+// aren't), read the same full key (which includes the root directory in the
+// datastore) and unmarshal into the same type of object.
+//
+// A write or clear of a key stops reads of it which are in progress from being
+// shared, so reads started after a write returned always see the write.
+type SingleFlightDriver struct {
+	types.StateDriver
+
+	mutex   sync.Mutex
+	flights map[string]*flight // by flightKey()
+	metrics SingleFlightMetrics
+}
+
+// NewSingleFlightDriver wraps the given state driver so that identical reads are shared.
+// params:
+//  driver: state driver to wrap; it must be initialized already
+// return values:
+//  *SingleFlightDriver: the wrapping driver
+func NewSingleFlightDriver(driver types.StateDriver) *SingleFlightDriver {
+	return &SingleFlightDriver{
+		StateDriver: driver,
+		flights:     map[string]*flight{},
+	}
+}
+
+// Metrics returns a snapshot of the driver's metrics
+func (d *SingleFlightDriver) Metrics() SingleFlightMetrics {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.metrics
+}
+
+// flightKey identifies identical reads.
+// params:
+//  kind: kind of read, e.g. "read" or "read_all"
+//  stateType: type of the object the values are unmarshaled into; nil for raw reads
+//  key: full datastore key
+// return values:
+//  string: key of the reads' flight
+func flightKey(kind string, stateType types.State, key string) string {
+	typeName := "raw"
+	if stateType != nil {
+		typeName = reflect.TypeOf(stateType).String()
+	}
+
+	return kind + " " + typeName + " " + key
+}
+
+// copyValues returns a deep copy of the given values so that callers sharing a read can't see each other's changes
+func copyValues(values [][]byte) [][]byte {
+	if values == nil {
+		return nil
+	}
+
+	copied := make([][]byte, len(values))
+	for i, value := range values {
+		if value != nil {
+			copied[i] = append([]byte{}, value...)
+		}
+	}
+
+	return copied
+}
+
+// share runs `read` unless an identical read is in flight, whose result is returned instead.
+// params:
+//  fk: key of the flight as returned by flightKey()
+//  key: datastore key being read
+//  read: function reading from the wrapped driver
+// return values:
+//  [][]byte: values returned by `read`
+//  error: error returned by `read`
+func (d *SingleFlightDriver) share(fk, key string, read func() ([][]byte, error)) ([][]byte, error) {
+	d.mutex.Lock()
+
+	if f, found := d.flights[fk]; found {
+		d.metrics.Shared++
+		d.mutex.Unlock()
+
+		<-f.done
+		return copyValues(f.values), f.err
+	}
+
+	f := &flight{key: key, done: make(chan struct{}), err: errSharedReadFailed}
+	d.flights[fk] = f
+	d.metrics.Reads++
+	d.mutex.Unlock()
+
+	defer func() {
+		d.mutex.Lock()
+		if d.flights[fk] == f {
+			delete(d.flights, fk)
+		}
+		d.mutex.Unlock()
+
+		close(f.done)
+	}()
+
+	f.values, f.err = read()
+
+	// the values are shared, so even their first reader only gets a copy
+	return copyValues(f.values), f.err
+}
+
+// forget stops the reads of `key` which are in flight from being shared,
+// along with the ReadAll() calls whose results could contain it
+func (d *SingleFlightDriver) forget(key string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for fk, f := range d.flights {
+		if strings.HasPrefix(key, f.key) {
+			delete(d.flights, fk)
+		}
+	}
+}
+
+// Read returns the value of `key`, shared with concurrent reads of it
+func (d *SingleFlightDriver) Read(key string) ([]byte, error) {
+	return d.read(flightKey("read", nil, key), key)
+}
+
+// read returns the value of `key` read as part of the given flight
+func (d *SingleFlightDriver) read(fk, key string) ([]byte, error) {
+	values, err := d.share(fk, key, func() ([][]byte, error) {
+		value, err := d.StateDriver.Read(key)
+		return [][]byte{value}, err
+	})
+
+	if len(values) == 0 {
+		return nil, err
+	}
+
+	return values[0], err
+}
+
+// ReadAll returns all values under `baseKey`, shared with concurrent reads of them
+func (d *SingleFlightDriver) ReadAll(baseKey string) ([][]byte, error) {
+	return d.share(flightKey("read_all", nil, baseKey), baseKey, func() ([][]byte, error) {
+		return d.StateDriver.ReadAll(baseKey)
+	})
+}
+
+// ReadState reads `key` into `value`, sharing the read with concurrent reads of the same type
+func (d *SingleFlightDriver) ReadState(key string, value types.State,
+	unmarshal func([]byte, interface{}) error) error {
+
+	encodedState, err := d.read(flightKey("read", value, key), key)
+	if err != nil {
+		return err
+	}
+
+	return unmarshal(encodedState, value)
+}
+
+// ReadAllState reads all states under `baseKey`, sharing the read with concurrent reads of the same type
+func (d *SingleFlightDriver) ReadAllState(baseKey string, stateType types.State,
+	unmarshal func([]byte, interface{}) error) ([]types.State, error) {
+
+	values, err := d.share(flightKey("read_all", stateType, baseKey), baseKey, func() ([][]byte, error) {
+		return d.StateDriver.ReadAll(baseKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalAllState(d, values, stateType, unmarshal)
+}
+
+// Write writes `value` to `key`
+func (d *SingleFlightDriver) Write(key string, value []byte) error {
+	defer d.forget(key)
+
+	return d.StateDriver.Write(key, value)
+}
+
+// Clear removes `key`
+func (d *SingleFlightDriver) Clear(key string) error {
+	defer d.forget(key)
+
+	return d.StateDriver.Clear(key)
+}
+
+// WriteState writes `value` to `key`
+func (d *SingleFlightDriver) WriteState(key string, value types.State,
+	marshal func(interface{}) ([]byte, error)) error {
+
+	defer d.forget(key)
+
+	return d.StateDriver.WriteState(key, value, marshal)
+}
+
+// ClearState removes `key`
+func (d *SingleFlightDriver) ClearState(key string) error {
+	defer d.forget(key)
+
+	return d.StateDriver.ClearState(key)
+}
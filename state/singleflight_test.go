@@ -0,0 +1,375 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// slowStateDriver is an in-memory state driver whose reads block until
+// `release` is closed (if set) and then take `delay`. It's safe for
+// concurrent use; only `calls` may change while it's in use.
+type slowStateDriver struct {
+	types.StateDriver
+
+	calls   uint64 // reads which reached the driver; accessed using sync/atomic
+	release chan struct{}
+	delay   time.Duration
+	err     error
+
+	mutex  sync.Mutex
+	values map[string][]byte
+}
+
+func newSlowStateDriver(values map[string][]byte) *slowStateDriver {
+	return &slowStateDriver{values: values}
+}
+
+func (d *slowStateDriver) begin() error {
+	atomic.AddUint64(&d.calls, 1)
+
+	if d.release != nil {
+		<-d.release
+	}
+	time.Sleep(d.delay)
+
+	return d.err
+}
+
+func (d *slowStateDriver) Read(key string) ([]byte, error) {
+	if err := d.begin(); err != nil {
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.values[key], nil
+}
+
+func (d *slowStateDriver) ReadAll(baseKey string) ([][]byte, error) {
+	if err := d.begin(); err != nil {
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	values := [][]byte{}
+	for key, value := range d.values {
+		if strings.HasPrefix(key, baseKey) {
+			values = append(values, value)
+		}
+	}
+
+	return values, nil
+}
+
+func (d *slowStateDriver) Write(key string, value []byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.values[key] = value
+	return nil
+}
+
+// otherState is a types.State which isn't an authorization
+type otherState struct {
+	types.CommonState
+	UUID string
+}
+
+func (s *otherState) Read(id string) error            { return nil }
+func (s *otherState) ReadAll() ([]types.State, error) { return nil, nil }
+func (s *otherState) Write() error                    { return nil }
+func (s *otherState) Clear() error                    { return nil }
+
+// waitForShared waits until `n` reads are waiting for another one
+func waitForShared(t *testing.T, d *SingleFlightDriver, n uint64) {
+	for deadline := time.Now().Add(5 * time.Second); d.Metrics().Shared < n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d shared reads, got %#v", n, d.Metrics())
+		}
+	}
+}
+
+// TestSingleFlightSharesReads tests that concurrent identical reads share a
+// single read, including its error
+func TestSingleFlightSharesReads(t *testing.T) {
+	key := "/auth_proxy/local_users/admin"
+
+	for _, readErr := range []error{nil, errConnectionRefused} {
+		slow := newSlowStateDriver(map[string][]byte{key: []byte(`{"username":"admin"}`)})
+		slow.release = make(chan struct{})
+		slow.err = readErr
+
+		d := NewSingleFlightDriver(slow)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				value, err := d.Read(key)
+				if err != readErr {
+					t.Errorf("expected error %v, got %v", readErr, err)
+				}
+
+				if readErr == nil && string(value) != `{"username":"admin"}` {
+					t.Errorf("unexpected value %q", value)
+				}
+			}()
+		}
+
+		waitForShared(t, d, 49)
+		close(slow.release)
+		wg.Wait()
+
+		if calls := atomic.LoadUint64(&slow.calls); calls != 1 {
+			t.Errorf("expected a single read, got %d", calls)
+		}
+
+		if m := d.Metrics(); m.Reads != 1 || m.Shared != 49 {
+			t.Errorf("unexpected metrics %#v", m)
+		}
+	}
+}
+
+// TestSingleFlightKeys tests that only reads of the same kind, key and type are shared
+func TestSingleFlightKeys(t *testing.T) {
+	slow := newSlowStateDriver(map[string][]byte{
+		"/auth_proxy/authz/1":  []byte(`{"UUID":"1"}`),
+		"/auth_proxy2/authz/1": []byte(`{"UUID":"1"}`),
+	})
+	slow.release = make(chan struct{})
+
+	d := NewSingleFlightDriver(slow)
+
+	reads := []func() error{
+		func() error { _, err := d.Read("/auth_proxy/authz/1"); return err },
+		func() error { _, err := d.Read("/auth_proxy2/authz/1"); return err },
+		func() error { return d.ReadState("/auth_proxy/authz/1", &types.Authorization{}, json.Unmarshal) },
+		func() error { return d.ReadState("/auth_proxy/authz/1", &otherState{}, json.Unmarshal) },
+		func() error { _, err := d.ReadAll("/auth_proxy/authz/"); return err },
+		func() error {
+			_, err := d.ReadAllState("/auth_proxy/authz/", &types.Authorization{}, json.Unmarshal)
+			return err
+		},
+	}
+
+	var wg sync.WaitGroup
+	for _, read := range append(reads, reads...) {
+		wg.Add(1)
+		go func(read func() error) {
+			defer wg.Done()
+
+			if err := read(); err != nil {
+				t.Errorf("failed to read: %s", err)
+			}
+		}(read)
+	}
+
+	waitForShared(t, d, uint64(len(reads)))
+	close(slow.release)
+	wg.Wait()
+
+	if calls := atomic.LoadUint64(&slow.calls); calls != uint64(len(reads)) {
+		t.Errorf("expected %d reads, got %d", len(reads), calls)
+	}
+
+	// states are unmarshaled by each caller and use the wrapping driver
+	states, err := d.ReadAllState("/auth_proxy/authz/", &types.Authorization{}, json.Unmarshal)
+	if err != nil || len(states) != 1 || states[0].(*types.Authorization).StateDriver != d {
+		t.Errorf("unexpected states %#v (%v)", states, err)
+	}
+}
+
+// TestSingleFlightWrites tests that reads started after a write don't share a read started before it
+func TestSingleFlightWrites(t *testing.T) {
+	key := "/auth_proxy/local_users/user1"
+
+	slow := newSlowStateDriver(map[string][]byte{key: []byte("old")})
+	slow.release = make(chan struct{})
+
+	d := NewSingleFlightDriver(slow)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		d.ReadAll("/auth_proxy/local_users/")
+	}()
+	go func() {
+		defer wg.Done()
+		d.Read(key)
+	}()
+
+	for atomic.LoadUint64(&slow.calls) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := d.Write(key, []byte("new")); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	close(slow.release)
+
+	value, err := d.Read(key)
+	if err != nil || string(value) != "new" {
+		t.Errorf("expected the new value, got %q (%v)", value, err)
+	}
+
+	values, err := d.ReadAll("/auth_proxy/local_users/")
+	if err != nil || len(values) != 1 || string(values[0]) != "new" {
+		t.Errorf("expected the new value, got %q (%v)", values, err)
+	}
+
+	wg.Wait()
+
+	if m := d.Metrics(); m.Reads != 4 || m.Shared != 0 {
+		t.Errorf("unexpected metrics %#v", m)
+	}
+}
+
+// TestSingleFlightRace reads, changes and writes the same keys from many
+// goroutines; run it with -race to check that callers never share memory.
+func TestSingleFlightRace(t *testing.T) {
+	values := map[string][]byte{}
+	for i := 0; i < 4; i++ {
+		values[fmt.Sprintf("/auth_proxy/authz/%d", i)] = []byte(fmt.Sprintf(`{"UUID":"%d"}`, i))
+	}
+
+	slow := newSlowStateDriver(values)
+	slow.delay = time.Millisecond
+
+	d := NewSingleFlightDriver(slow)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			key := fmt.Sprintf("/auth_proxy/authz/%d", i%4)
+
+			for j := 0; j < 20; j++ {
+				if value, err := d.Read(key); err == nil && len(value) > 0 {
+					value[0] = 'x'
+				}
+
+				if all, err := d.ReadAll("/auth_proxy/authz/"); err == nil {
+					for _, value := range all {
+						value[0] = 'x'
+					}
+				}
+
+				states, err := d.ReadAllState("/auth_proxy/authz/", &types.Authorization{}, json.Unmarshal)
+				if err != nil {
+					t.Errorf("failed to read states: %s", err)
+					return
+				}
+				for _, state := range states {
+					state.(*types.Authorization).PrincipalName = "changed"
+				}
+
+				if j%5 == 0 {
+					d.Write(key, []byte(fmt.Sprintf(`{"UUID":"%d"}`, i%4)))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if m := d.Metrics(); m.Shared == 0 {
+		t.Errorf("expected some reads to be shared, got %#v", m)
+	}
+}
+
+// TestSingleFlightPanic tests that callers waiting for a read which panicked get an error
+func TestSingleFlightPanic(t *testing.T) {
+	slow := newSlowStateDriver(map[string][]byte{})
+	slow.release = make(chan struct{})
+
+	d := NewSingleFlightDriver(slow)
+	key := "/auth_proxy/settings"
+
+	errs := make(chan error)
+	go func() {
+		defer func() { recover() }()
+		d.share(flightKey("read", nil, key), key, func() ([][]byte, error) {
+			<-slow.release
+			panic(errors.New("boom"))
+		})
+	}()
+
+	for d.Metrics().Reads != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	go func() {
+		_, err := d.Read(key)
+		errs <- err
+	}()
+
+	waitForShared(t, d, 1)
+	close(slow.release)
+
+	if err := <-errs; err != errSharedReadFailed {
+		t.Errorf("expected %v, got %v", errSharedReadFailed, err)
+	}
+}
+
+// benchmarkHotKeys reads the same few keys from many concurrent clients and
+// reports the number of reads which reached the datastore, e.g.
+// go test -run X -bench HotKeys -cpu 4 ./state/
+func benchmarkHotKeys(b *testing.B, singleFlight bool) {
+	values := map[string][]byte{}
+	for _, user := range []string{"admin", "ops", "user1"} {
+		values["/auth_proxy/local_users/"+user] = []byte(`{"username":"` + user + `"}`)
+	}
+
+	slow := newSlowStateDriver(values)
+	slow.delay = time.Millisecond
+
+	var d types.StateDriver = slow
+	if singleFlight {
+		d = NewSingleFlightDriver(slow)
+	}
+
+	keys := []string{"/auth_proxy/local_users/admin", "/auth_proxy/local_users/ops", "/auth_proxy/local_users/user1"}
+	next := uint64(0)
+
+	b.SetParallelism(16) // goroutines per CPU
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := keys[atomic.AddUint64(&next, 1)%uint64(len(keys))]
+			if _, err := d.Read(key); err != nil {
+				b.Errorf("failed to read %s: %s", key, err)
+			}
+		}
+	})
+
+	b.StopTimer()
+	b.Logf("%d reads: %d reached the datastore", b.N, atomic.LoadUint64(&slow.calls))
+}
+
+// BenchmarkHotKeys reads directly from the datastore, i.e. how we used to read
+func BenchmarkHotKeys(b *testing.B) {
+	benchmarkHotKeys(b, false)
+}
+
+// BenchmarkHotKeysSingleFlight shares concurrent identical reads
+func BenchmarkHotKeysSingleFlight(b *testing.B) {
+	benchmarkHotKeys(b, true)
+}
@@ -0,0 +1,188 @@
+package state
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file contains the part of the drivers' Watch() which doesn't depend on
+// the data store. The keys below the prefix are listed first, which tells the
+// data store's index the changes are followed from; whenever following them
+// fails, they're followed again from the last index seen. If the data store
+// no longer has the changes since that index (etcd compacts its history), the
+// keys are listed again and the differences are reported instead, so that no
+// change is missed.
+
+const (
+	// watchBufferSize is the number of events a slow consumer can fall behind
+	// before the watch waits for it
+	watchBufferSize = 16
+
+	// watchRetryBaseDelay is the delay before re-establishing a failed watch;
+	// it doubles with every consecutive failure, up to watchRetryMaxDelay
+	watchRetryBaseDelay = 100 * time.Millisecond
+	watchRetryMaxDelay  = 10 * time.Second
+)
+
+// errWatchHistoryLost is returned by prefixWatcher.followPrefix() if the
+// changes after the given index are no longer available
+var errWatchHistoryLost = errors.New("the changes to resume the watch from are no longer available")
+
+// prefixWatcher is implemented by the drivers to be watched with watchPrefix().
+// Keys are given as returned by watchEventKey().
+type prefixWatcher interface {
+	// listPrefix returns the values of the keys below `prefix` by key, and the
+	// index of the data store they were read at
+	listPrefix(prefix string) (map[string][]byte, uint64, error)
+
+	// followPrefix reports the changes to the keys below `prefix` after
+	// `index` to `change` (with a nil value for deletions) until it fails or
+	// `ctx` is done, and returns the index to resume from. `known` holds the
+	// values reported so far by key; only `change` updates it. `change`
+	// returns false once the watch is stopped.
+	followPrefix(ctx context.Context, prefix string, index uint64, known map[string][]byte,
+		change func(key string, value []byte) bool) (uint64, error)
+}
+
+// watchEventKey returns a key as reported by WatchEvent, i.e. with a leading
+// and without a trailing slash
+func watchEventKey(key string) string {
+	return "/" + strings.Trim(key, "/")
+}
+
+// reportDifferences passes the keys whose value differs between `known` and
+// `current` to `change`, sorted by key
+// params:
+//  known: the values reported so far by key
+//  current: the current values by key
+//  change: called with the new value of each key which differs, nil for deleted keys
+// return values:
+//  bool: false if `change` did
+func reportDifferences(known, current map[string][]byte, change func(key string, value []byte) bool) bool {
+	keys := []string{}
+
+	for key, value := range current {
+		if previous, found := known[key]; !found || string(previous) != string(value) {
+			keys = append(keys, key)
+		}
+	}
+
+	for key := range known {
+		if _, found := current[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !change(key, current[key]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// watchPrefix watches the keys below `prefix` using the given driver
+// params:
+//  w: driver following the changes
+//  parent: context whose end stops the watch as well, e.g. on Deinit()
+//  prefix: prefix of the keys, in the form used by the driver
+// return values:
+//  <-chan types.WatchEvent: the changes, in the order they happened; closed once the watch stopped
+//  func(): stops the watch
+func watchPrefix(w prefixWatcher, parent context.Context, prefix string) (<-chan types.WatchEvent, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	events := make(chan types.WatchEvent, watchBufferSize)
+
+	go func() {
+		defer close(events)
+
+		var (
+			known    map[string][]byte // values reported so far by key; nil until the keys are listed
+			index    uint64
+			failures int
+		)
+
+		// change turns a change reported by the driver into an event
+		change := func(key string, value []byte) bool {
+			_, found := known[key]
+
+			event := types.WatchEvent{Type: types.WatchEventUpdate, Key: key, Value: value}
+			switch {
+			case value == nil && !found:
+				return true // e.g. a directory
+			case value == nil:
+				event.Type = types.WatchEventDelete
+				delete(known, key)
+			case !found:
+				event.Type = types.WatchEventCreate
+				known[key] = value
+			default:
+				known[key] = value
+			}
+
+			log.Debugf("Observed event:%q for key: %s", event.Type, key)
+			failures = 0
+
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for resync := true; ; {
+			var err error
+
+			if resync {
+				var current map[string][]byte
+				if current, index, err = w.listPrefix(prefix); err == nil {
+					// the changes missed while the watch was down are reported
+					// as differences; there are none on the first listing
+					if known == nil {
+						known = current
+						if known == nil {
+							known = map[string][]byte{}
+						}
+					} else if !reportDifferences(known, current, change) {
+						return
+					}
+
+					resync = false
+				}
+			}
+
+			if err == nil {
+				index, err = w.followPrefix(ctx, prefix, index, known, change)
+				resync = err == errWatchHistoryLost
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			delay := backoff(failures, watchRetryBaseDelay, watchRetryMaxDelay)
+			failures++
+
+			log.Warnf("Watch of %s failed, re-establishing it in %s: %v", prefix, delay, err)
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, cancel
+}
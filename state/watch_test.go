@@ -0,0 +1,144 @@
+package state
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// fakeChange is a change reported by fakePrefixWatcher.followPrefix(), or the
+// error it fails with
+type fakeChange struct {
+	key   string
+	value []byte
+	err   error
+}
+
+// fakePrefixWatcher is an in-memory prefixWatcher: listPrefix() returns
+// `values`, and followPrefix() reports the changes sent on `changes`
+type fakePrefixWatcher struct {
+	mutex   sync.Mutex
+	values  map[string][]byte
+	lists   int
+	changes chan fakeChange
+}
+
+func (w *fakePrefixWatcher) listPrefix(prefix string) (map[string][]byte, uint64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.lists++
+
+	values := map[string][]byte{}
+	for key, value := range w.values {
+		values[key] = value
+	}
+
+	return values, uint64(w.lists), nil
+}
+
+func (w *fakePrefixWatcher) followPrefix(ctx context.Context, prefix string, index uint64, known map[string][]byte,
+	change func(key string, value []byte) bool) (uint64, error) {
+
+	for {
+		select {
+		case <-ctx.Done():
+			return index, nil
+		case c := <-w.changes:
+			if c.err != nil {
+				return index, c.err
+			}
+
+			if !change(c.key, c.value) {
+				return index, nil
+			}
+		}
+	}
+}
+
+func (w *fakePrefixWatcher) listed() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.lists
+}
+
+// expectWatchEvents fails the test unless the given events are received, in order
+func expectWatchEvents(t *testing.T, events <-chan types.WatchEvent, expected ...types.WatchEvent) {
+	for _, e := range expected {
+		select {
+		case event := <-events:
+			if event.Type != e.Type || event.Key != e.Key || string(event.Value) != string(e.Value) {
+				t.Fatalf("Watch event mismatch. Expctd: %s %s %q, Rcvd: %s %s %q", e.Type, e.Key, e.Value, event.Type, event.Key, event.Value)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the %s event of %s", e.Type, e.Key)
+		}
+	}
+}
+
+// TestWatchPrefix tests that changes are reported as events in order, that
+// failed watches are re-established without missing changes, and that
+// stopping a watch closes its channel
+func TestWatchPrefix(t *testing.T) {
+	w := &fakePrefixWatcher{values: map[string][]byte{"/p/a": []byte("1")}, changes: make(chan fakeChange)}
+	events, stop := watchPrefix(w, context.Background(), "/p/")
+	defer stop()
+
+	// the keys which exist when the watch starts aren't reported, their changes are
+	w.changes <- fakeChange{key: "/p/b", value: []byte("2")}
+	w.changes <- fakeChange{key: "/p/b", value: []byte("3")}
+	w.changes <- fakeChange{key: "/p/a"}
+	w.changes <- fakeChange{key: "/p/unknown"} // e.g. a directory
+	w.changes <- fakeChange{key: "/p/c", value: []byte("1")}
+
+	expectWatchEvents(t, events,
+		types.WatchEvent{Type: types.WatchEventCreate, Key: "/p/b", Value: []byte("2")},
+		types.WatchEvent{Type: types.WatchEventUpdate, Key: "/p/b", Value: []byte("3")},
+		types.WatchEvent{Type: types.WatchEventDelete, Key: "/p/a"},
+		types.WatchEvent{Type: types.WatchEventCreate, Key: "/p/c", Value: []byte("1")},
+	)
+
+	// a failed watch follows the changes again from where it was
+	w.changes <- fakeChange{err: errConnectionRefused}
+	w.changes <- fakeChange{key: "/p/d", value: []byte("1")}
+
+	expectWatchEvents(t, events, types.WatchEvent{Type: types.WatchEventCreate, Key: "/p/d", Value: []byte("1")})
+
+	if lists := w.listed(); lists != 1 {
+		t.Errorf("expected the keys to be listed once, got %d", lists)
+	}
+
+	// if the changes since then are lost, the differences with the keys listed
+	// again are reported
+	w.mutex.Lock()
+	w.values = map[string][]byte{"/p/b": []byte("4"), "/p/c": []byte("1"), "/p/e": []byte("5")}
+	w.mutex.Unlock()
+
+	w.changes <- fakeChange{err: errWatchHistoryLost}
+
+	expectWatchEvents(t, events,
+		types.WatchEvent{Type: types.WatchEventUpdate, Key: "/p/b", Value: []byte("4")},
+		types.WatchEvent{Type: types.WatchEventDelete, Key: "/p/d"},
+		types.WatchEvent{Type: types.WatchEventCreate, Key: "/p/e", Value: []byte("5")},
+	)
+
+	if lists := w.listed(); lists != 2 {
+		t.Errorf("expected the keys to be listed again, got %d listings", lists)
+	}
+
+	stop()
+
+	select {
+	case event, open := <-events:
+		if open {
+			t.Fatalf("unexpected event after the watch was stopped: %s %s", event.Type, event.Key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watch to stop")
+	}
+}
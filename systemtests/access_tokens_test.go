@@ -0,0 +1,117 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// addAccessToken creates a personal access token with the given name using the given token
+func addAccessToken(c *C, token, name string) proxy.AccessTokenReply {
+	resp, body := proxyPost(c, token, proxy.AccessTokensPath, []byte(`{"name":"`+name+`"}`))
+	c.Assert(resp.StatusCode, Equals, 201)
+
+	reply := proxy.AccessTokenReply{}
+	c.Assert(json.Unmarshal(body, &reply), IsNil)
+
+	return reply
+}
+
+// listAccessTokens returns the access tokens visible to the owner of the given token, by ID
+func listAccessTokens(c *C, token string) map[string]proxy.AccessTokenReply {
+	resp, body := proxyGet(c, token, proxy.AccessTokensPath)
+	c.Assert(resp.StatusCode, Equals, 200)
+	c.Assert(strings.Contains(string(body), `"token"`), Equals, false)
+
+	tokens := []proxy.AccessTokenReply{}
+	c.Assert(json.Unmarshal(body, &tokens), IsNil)
+
+	byID := map[string]proxy.AccessTokenReply{}
+	for _, t := range tokens {
+		byID[t.ID] = t
+	}
+
+	return byID
+}
+
+// TestAccessTokens tests creating, using, listing and revoking personal access tokens
+func (s *systemtestSuite) TestAccessTokens(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		opsTok := opsToken(c)
+
+		resp, body := proxyPost(c, opsTok, proxy.AccessTokensPath, []byte(`{}`))
+		assertErrorResponse(c, resp, body, 400, types.ErrorCodeBadRequest)
+
+		pat := addAccessToken(c, opsTok, "ci")
+		c.Assert(pat.Name, Equals, "ci")
+		c.Assert(pat.Username, Equals, opsUsername)
+		c.Assert(strings.HasPrefix(pat.Token, pat.Prefix), Equals, true)
+
+		// the access token works like the user's token, with the same role
+		resp, body = proxyGet(c, pat.Token, proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		whoami := proxy.WhoamiResponse{}
+		c.Assert(json.Unmarshal(body, &whoami), IsNil)
+		c.Assert(whoami.Username, Equals, opsUsername)
+		c.Assert(whoami.Role, Equals, types.Ops.String())
+		c.Assert(whoami.AccessToken, Equals, true)
+
+		ms.AddHardcodedResponse("/api/v1/networks/", []byte("[]"))
+
+		resp, _ = proxyGet(c, pat.Token, "/api/v1/networks/")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		resp, body = proxyGet(c, pat.Token, proxy.V1Prefix+"/authorizations/")
+		assertErrorResponse(c, resp, body, 403, types.ErrorCodeForbidden)
+
+		// it can neither create further access tokens nor be refreshed or logged out
+		resp, body = proxyPost(c, pat.Token, proxy.AccessTokensPath, []byte(`{"name":"copy"}`))
+		assertErrorResponse(c, resp, body, 400, types.ErrorCodeBadRequest)
+
+		resp, body = proxyPost(c, pat.Token, proxy.RefreshPath, []byte{})
+		assertErrorResponse(c, resp, body, 403, types.ErrorCodeRefreshNotAllowed)
+
+		resp, body = proxyPost(c, pat.Token, proxy.LogoutPath, []byte{})
+		assertErrorResponse(c, resp, body, 400, types.ErrorCodeBadRequest)
+
+		// a wrong secret is rejected
+		forged := pat.Prefix + "_" + strings.Repeat("0", 64)
+		resp, body = proxyGet(c, forged, proxy.WhoamiPath)
+		assertErrorResponse(c, resp, body, 401, types.ErrorCodeInvalidToken)
+
+		// admins see everyone's access tokens, everyone else only their own
+		adminPat := addAccessToken(c, token, "admin-ci")
+
+		tokens := listAccessTokens(c, token)
+		c.Assert(tokens[pat.ID].Prefix, Equals, pat.Prefix)
+		c.Assert(tokens[adminPat.ID].Username, Equals, adminUsername)
+
+		tokens = listAccessTokens(c, opsTok)
+		c.Assert(tokens[pat.ID].Name, Equals, "ci")
+
+		_, found := tokens[adminPat.ID]
+		c.Assert(found, Equals, false)
+
+		resp, body = proxyDelete(c, opsTok, proxy.AccessTokensPath+adminPat.ID+"/")
+		assertErrorResponse(c, resp, body, 404, types.ErrorCodeNotFound)
+
+		// revoked access tokens no longer work
+		resp, _ = proxyDelete(c, opsTok, proxy.AccessTokensPath+pat.ID+"/")
+		c.Assert(resp.StatusCode, Equals, 204)
+
+		resp, body = proxyGet(c, pat.Token, proxy.WhoamiPath)
+		assertErrorResponse(c, resp, body, 401, types.ErrorCodeInvalidToken)
+
+		resp, _ = proxyDelete(c, token, proxy.AccessTokensPath+adminPat.ID+"/")
+		c.Assert(resp.StatusCode, Equals, 204)
+
+		resp, body = proxyDelete(c, token, proxy.AccessTokensPath+adminPat.ID+"/")
+		assertErrorResponse(c, resp, body, 404, types.ErrorCodeNotFound)
+	})
+}
@@ -0,0 +1,110 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+	"github.com/contiv/contivmodel/client"
+
+	. "gopkg.in/check.v1"
+)
+
+// netmasterPayload returns one of the recorded netmaster responses shared with the auth package's tests
+func netmasterPayload(c *C, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("..", "auth", "testdata", name))
+	c.Assert(err, IsNil)
+
+	return data
+}
+
+// unfilterableResponses returns the number of responses the proxy denied because it couldn't filter them
+func unfilterableResponses(c *C) uint64 {
+	_, data := proxyGet(c, noToken, proxy.HealthCheckPath)
+
+	hcr := &proxy.HealthCheckResponse{}
+	c.Assert(json.Unmarshal(data, hcr), IsNil)
+
+	return hcr.NetmasterHealth.UnfilterableResponses
+}
+
+// TestAggregatedInspect tests that the summaries of the aggregated inspect
+// endpoints only count the objects of the user's tenants
+func (s *systemtestSuite) TestAggregatedInspect(c *C) {
+	aggregateUser := "aggregate_user"
+	s.addUser(c, aggregateUser)
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		globals := "/api/v1/inspect/globals/global/"
+		aciGw := "/api/v1/inspect/aciGws/aciGw/"
+
+		// the payloads are replaced by ones which can't be filtered later on
+		payloads := map[string][]byte{
+			globals:                netmasterPayload(c, "globals_inspect.json"),
+			"/api/v1/networks/":    netmasterPayload(c, "networks.json"),
+			aciGw:                  netmasterPayload(c, "aciGws_inspect.json"),
+			"/api/v1/appProfiles/": netmasterPayload(c, "appProfiles.json"),
+		}
+
+		for path := range payloads {
+			ms.AddHandler(path, func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(payloads[req.URL.Path])
+			})
+		}
+
+		// admins see the whole fabric
+		resp, body := proxyGet(c, token, globals)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(body, DeepEquals, netmasterPayload(c, "globals_inspect.json"))
+
+		// users without tenants see nothing
+		userToken := loginAs(c, aggregateUser, aggregateUser)
+
+		resp, body = proxyGet(c, userToken, globals)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		globalInspect := client.GlobalInspect{}
+		c.Assert(json.Unmarshal(body, &globalInspect), IsNil)
+		c.Assert(globalInspect.Oper, Equals, client.GlobalOper{})
+		c.Assert(globalInspect.Config.Vxlans, Equals, "1-10000")
+
+		// other users only see their tenants' networks and app. profiles
+		authzs := []proxy.GetAuthorizationReply{}
+		for _, tenant := range []string{"t1", "t2"} {
+			data := `{"principalName":"` + aggregateUser + `","local":true,"role":"ops","tenantName":"` + tenant + `"}`
+			authzs = append(authzs, s.addAuthorization(c, data, token))
+		}
+
+		resp, body = proxyGet(c, userToken, globals)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(json.Unmarshal(body, &globalInspect), IsNil)
+		c.Assert(globalInspect.Oper, Equals, client.GlobalOper{NumNetworks: 3})
+
+		resp, body = proxyGet(c, userToken, aciGw)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		aciGwInspect := client.AciGwInspect{}
+		c.Assert(json.Unmarshal(body, &aciGwInspect), IsNil)
+		c.Assert(aciGwInspect.Oper.NumAppProfiles, Equals, 2)
+
+		// responses which can't be filtered are denied and counted
+		denied := unfilterableResponses(c)
+
+		payloads[globals] = []byte(`{"Config":{},"Oper":{"numNetworks":5,"networksByTenant":{"t3":2}}}`)
+		resp, body = proxyGet(c, userToken, globals)
+		assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeForbidden)
+
+		payloads["/api/v1/appProfiles/"] = []byte(`{"t1":["shop"]}`)
+		resp, body = proxyGet(c, userToken, aciGw)
+		assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeForbidden)
+
+		c.Assert(unfilterableResponses(c), Equals, denied+2)
+
+		for _, authz := range authzs {
+			s.deleteAuthorization(c, authz.AuthzUUID, token)
+		}
+	})
+}
@@ -3,6 +3,8 @@ package systemtests
 import (
 	"encoding/json"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/contiv/auth_proxy/common"
 	"github.com/contiv/auth_proxy/common/types"
@@ -267,14 +269,12 @@ func (s *systemtestSuite) TestAuthorizationDeleteEndpoint(c *C) {
 		authz := s.addAuthorization(c, data, opsToken)
 		s.deleteAuthorization(c, authz.AuthzUUID, opsToken)
 		resp, body := proxyGet(c, opsToken, endpoint+"/"+authz.AuthzUUID+"/")
-		c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
-		c.Assert(len(body), Equals, 0)
+		assertErrorResponse(c, resp, body, http.StatusNotFound, types.ErrorCodeNotFound)
 
 		// delete authz of built-in ops user
 		s.deleteAuthorization(c, opsAuthz.AuthzUUID, adToken)
 		resp, body = proxyGet(c, adToken, endpoint+"/"+authz.AuthzUUID+"/")
-		c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
-		c.Assert(len(body), Equals, 0)
+		assertErrorResponse(c, resp, body, http.StatusNotFound, types.ErrorCodeNotFound)
 
 		// non-admins cannot access this endpoint
 		resp, _ = proxyDelete(c, userToken, endpoint+"/xxx"+"/")
@@ -348,6 +348,219 @@ func (s *systemtestSuite) TestAuthorizationGetEndpoints(c *C) {
 	})
 }
 
+// TestAuthorizationListFilters tests filtering the authorizations list by
+// principal and tenant
+func (s *systemtestSuite) TestAuthorizationListFilters(c *C) {
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		endpoint := proxy.V1Prefix + "/authorizations/"
+
+		local := s.addAuthorization(c,
+			`{"PrincipalName":"`+username+`","local":true,"role":"ops","tenantName":"filter1"}`, adToken)
+		ldap := s.addAuthorization(c,
+			`{"PrincipalName":"`+ldapGroupDN+`","local":false,"role":"ops","tenantName":"filter1"}`, adToken)
+		other := s.addAuthorization(c,
+			`{"PrincipalName":"`+username+`","local":true,"role":"ops","tenantName":"filter2"}`, adToken)
+
+		list := func(query string) map[string]bool {
+			resp, body := proxyGet(c, adToken, endpoint+"?"+query)
+			c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+			authzs := []proxy.GetAuthorizationReply{}
+			c.Assert(json.Unmarshal(body, &authzs), IsNil)
+
+			found := map[string]bool{}
+			for _, authz := range authzs {
+				found[authz.AuthzUUID] = true
+			}
+			return found
+		}
+
+		c.Assert(list("tenant=filter1"), DeepEquals, map[string]bool{local.AuthzUUID: true, ldap.AuthzUUID: true})
+		c.Assert(list("tenant=filter1&principal_type=ldap"), DeepEquals, map[string]bool{ldap.AuthzUUID: true})
+		c.Assert(list("tenant=filter2&principal_name="+username), DeepEquals, map[string]bool{other.AuthzUUID: true})
+
+		// no matches are an empty list
+		resp, body := proxyGet(c, adToken, endpoint+"?tenant=filter3")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Equals, "[]")
+
+		for _, query := range []string{"principal=" + username, "principal_type=group"} {
+			resp, body = proxyGet(c, adToken, endpoint+"?"+query)
+			assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+		}
+
+		for _, authz := range []proxy.GetAuthorizationReply{local, ldap, other} {
+			s.deleteAuthorization(c, authz.AuthzUUID, adToken)
+		}
+	})
+}
+
+// TestAuthorizationAuditFields tests that authorizations record who granted
+// them and when, and that the list can be sorted by creation time
+func (s *systemtestSuite) TestAuthorizationAuditFields(c *C) {
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		endpoint := proxy.V1Prefix + "/authorizations/"
+
+		older := s.addAuthorization(c,
+			`{"PrincipalName":"`+username+`","local":true,"role":"ops","tenantName":"audit1"}`, adToken)
+		c.Assert(older.GrantedBy, Equals, adminUsername)
+		c.Assert(older.CreatedAt > 0, Equals, true)
+		c.Assert(older.UpdatedAt, Equals, older.CreatedAt)
+		c.Assert(s.getAuthorization(c, older.AuthzUUID, adToken), DeepEquals, older)
+
+		// creation times are in seconds
+		time.Sleep(1100 * time.Millisecond)
+		newer := s.addAuthorization(c,
+			`{"PrincipalName":"`+username+`","local":true,"role":"ops","tenantName":"audit2"}`, adToken)
+
+		list := func(query string) []string {
+			resp, body := proxyGet(c, adToken, endpoint+"?principal_name="+username+"&"+query)
+			c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+			authzs := []proxy.GetAuthorizationReply{}
+			c.Assert(json.Unmarshal(body, &authzs), IsNil)
+
+			// the principal's role authorization is left out
+			uuids := []string{}
+			for _, authz := range authzs {
+				if authz.TenantName != "" {
+					uuids = append(uuids, authz.AuthzUUID)
+				}
+			}
+			return uuids
+		}
+
+		c.Assert(list("sort=created_at"), DeepEquals, []string{older.AuthzUUID, newer.AuthzUUID})
+		c.Assert(list("sort=-created_at"), DeepEquals, []string{newer.AuthzUUID, older.AuthzUUID})
+
+		resp, body := proxyGet(c, adToken, endpoint+"?sort=principal_name")
+		assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+
+		// updates are recorded too
+		resp, body = proxyPatch(c, adToken, endpoint+older.AuthzUUID+"/", []byte(`{"role":"guest"}`))
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		updated := proxy.GetAuthorizationReply{}
+		c.Assert(json.Unmarshal(body, &updated), IsNil)
+		c.Assert(updated.CreatedAt, Equals, older.CreatedAt)
+		c.Assert(updated.UpdatedAt > older.CreatedAt, Equals, true)
+		c.Assert(updated.GrantedBy, Equals, adminUsername)
+
+		for _, authz := range []proxy.GetAuthorizationReply{older, newer} {
+			s.deleteAuthorization(c, authz.AuthzUUID, adToken)
+		}
+	})
+}
+
+// TestAuthorizationListPagination tests listing the authorizations page by page
+func (s *systemtestSuite) TestAuthorizationListPagination(c *C) {
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		endpoint := proxy.V1Prefix + "/authorizations/?principal_name=" + username
+
+		added := []proxy.GetAuthorizationReply{}
+		for _, tenant := range []string{"page1", "page2", "page3"} {
+			added = append(added, s.addAuthorization(c,
+				`{"PrincipalName":"`+username+`","local":true,"role":"ops","tenantName":"`+tenant+`"}`, adToken))
+		}
+
+		list := func(query string) ([]proxy.GetAuthorizationReply, string) {
+			resp, body := proxyGet(c, adToken, endpoint+query)
+			c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+			authzs := []proxy.GetAuthorizationReply{}
+			c.Assert(json.Unmarshal(body, &authzs), IsNil)
+			return authzs, resp.Header.Get("X-Total-Count")
+		}
+
+		// the pages add up to the whole list, which includes the principal's role authorization
+		all, total := list("&limit=1000")
+		c.Assert(len(all), Equals, 4)
+		c.Assert(total, Equals, "4")
+
+		first, total := list("&limit=3")
+		c.Assert(total, Equals, "4")
+		second, _ := list("&limit=3&offset=3")
+		c.Assert(append(first, second...), DeepEquals, all)
+
+		beyond, total := list("&limit=3&offset=10")
+		c.Assert(beyond, HasLen, 0)
+		c.Assert(total, Equals, "4")
+
+		// without pagination, the whole list is returned
+		unpaginated, _ := list("")
+		c.Assert(unpaginated, HasLen, 4)
+
+		resp, body := proxyGet(c, adToken, endpoint+"&limit=0")
+		assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+
+		for _, authz := range added {
+			s.deleteAuthorization(c, authz.AuthzUUID, adToken)
+		}
+	})
+}
+
+// TestDeleteAuthorizationsOfPrincipal tests deleting all the authorizations of
+// a principal at once
+func (s *systemtestSuite) TestDeleteAuthorizationsOfPrincipal(c *C) {
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		endpoint := proxy.V1Prefix + "/authorizations/"
+
+		ldap1 := s.addAuthorization(c,
+			`{"PrincipalName":"`+ldapGroupDN+`","local":false,"role":"ops","tenantName":"del1"}`, adToken)
+		ldap2 := s.addAuthorization(c,
+			`{"PrincipalName":"`+ldapGroupDN+`","local":false,"role":"ops","tenantName":"del2"}`, adToken)
+		local := s.addAuthorization(c,
+			`{"PrincipalName":"`+username+`","local":true,"role":"ops","tenantName":"del1"}`, adToken)
+
+		// a principal has to be named, and only admins can delete
+		resp, body := proxyDelete(c, adToken, endpoint+"?principal_type=ldap")
+		assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+
+		resp, body = proxyDelete(c, loginAs(c, username, username), endpoint+"?principal_name="+username)
+		assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeForbidden)
+
+		resp, body = proxyDelete(c, adToken, endpoint+"?principal_name="+url.QueryEscape(ldapGroupDN)+"&principal_type=ldap")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		reply := proxy.DeleteAuthorizationsReply{}
+		c.Assert(json.Unmarshal(body, &reply), IsNil)
+		c.Assert(reply.Count >= 2, Equals, true)
+		deleted := map[string]bool{}
+		for _, uuid := range reply.AuthzUUIDs {
+			deleted[uuid] = true
+		}
+		c.Assert(deleted[ldap1.AuthzUUID] && deleted[ldap2.AuthzUUID], Equals, true)
+		c.Assert(deleted[local.AuthzUUID], Equals, false)
+
+		resp, _ = proxyGet(c, adToken, endpoint+ldap1.AuthzUUID+"/")
+		c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+		c.Assert(s.getAuthorization(c, local.AuthzUUID, adToken).PrincipalName, Equals, username)
+
+		// nothing left to delete isn't an error
+		resp, body = proxyDelete(c, adToken, endpoint+"?principal_name="+url.QueryEscape(ldapGroupDN))
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(json.Unmarshal(body, &reply), IsNil)
+		c.Assert(reply.Count, Equals, 0)
+		c.Assert(reply.AuthzUUIDs, HasLen, 0)
+
+		// the built-in admin's authorizations are kept
+		resp, body = proxyDelete(c, adToken, endpoint+"?principal_name="+adminUsername)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(json.Unmarshal(body, &reply), IsNil)
+		c.Assert(reply.Count, Equals, 0)
+
+		s.deleteAuthorization(c, local.AuthzUUID, adToken)
+	})
+}
+
 // addAuthorization helper function for the tests
 func (s *systemtestSuite) addAuthorization(c *C, data, token string) proxy.GetAuthorizationReply {
 	endpoint := proxy.V1Prefix + "/authorizations"
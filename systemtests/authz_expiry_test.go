@@ -0,0 +1,171 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestAuthorizationExpiry tests that temporary tenant authorizations grant
+// access until they expire and are deleted afterwards
+func (s *systemtestSuite) TestAuthorizationExpiry(c *C) {
+	expiringUser := "authz_expiry_user"
+	endpoint := proxy.V1Prefix + "/authorizations/"
+
+	s.addUser(c, expiringUser)
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		for _, tenant := range []string{"t1", "t2"} {
+			ms.AddHardcodedResponse("/api/v1/tenants/"+tenant+"/", []byte(`{"foo":"bar"}`))
+		}
+
+		authzData := func(tenant string, expiresAt int64) string {
+			return fmt.Sprintf(`{"principalName":%q,"local":true,"role":"ops","tenantName":%q,"expires_at":%d}`,
+				expiringUser, tenant, expiresAt)
+		}
+
+		// expiry times must be in the future
+		resp, body := proxyPost(c, token, endpoint, []byte(authzData("t1", time.Now().Unix())))
+		assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+
+		// authorizations work right up to their expiry; start at the beginning
+		// of a second so that a whole second is left
+		time.Sleep(time.Unix(time.Now().Unix()+1, 0).Sub(time.Now()))
+		boundary := s.addAuthorization(c, authzData("t1", time.Now().Unix()+1), token)
+		boundaryToken := loginAs(c, expiringUser, expiringUser)
+
+		resp, _ = proxyGet(c, boundaryToken, "/api/v1/tenants/t1/")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		time.Sleep(time.Unix(boundary.ExpiresAt+1, 0).Sub(time.Now()))
+
+		// the token stays valid, but the access is gone
+		resp, body = proxyGet(c, boundaryToken, "/api/v1/tenants/t1/")
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		// tokens issued while a temporary authorization was active keep working
+		// for everything else once it expired
+		expiresAt := time.Now().Unix() + 2
+		temporary := s.addAuthorization(c, authzData("t1", expiresAt), token)
+		c.Assert(temporary.ExpiresAt, Equals, expiresAt)
+		temporaryToken := loginAs(c, expiringUser, expiringUser)
+
+		permanent := s.addAuthorization(c, authzData("t2", 0), token)
+		c.Assert(permanent.ExpiresAt, Equals, int64(0))
+		userToken := loginAs(c, expiringUser, expiringUser)
+
+		for _, t := range []string{temporaryToken, userToken} {
+			resp, _ = proxyGet(c, t, "/api/v1/tenants/t1/")
+			c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		}
+
+		time.Sleep(time.Unix(expiresAt+1, 0).Sub(time.Now()))
+
+		// the expired authorization behaves as if it was deleted
+		resp, body = proxyGet(c, userToken, "/api/v1/tenants/t1/")
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		resp, _ = proxyGet(c, userToken, "/api/v1/tenants/t2/")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		resp, body = proxyGet(c, temporaryToken, "/api/v1/tenants/t1/")
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		resp, _ = proxyGet(c, temporaryToken, "/api/v1/tenants/t2/")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		resp, body = proxyGet(c, token, endpoint+"?expired=false")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		active := []proxy.GetAuthorizationReply{}
+		c.Assert(json.Unmarshal(body, &active), IsNil)
+		for _, authz := range active {
+			c.Assert(authz.AuthzUUID, Not(Equals), temporary.AuthzUUID)
+			c.Assert(authz.Expired, Equals, false)
+		}
+
+		// ...and is eventually deleted
+		deadline := time.Now().Add(30 * time.Second)
+		for {
+			resp, body = proxyGet(c, token, endpoint+temporary.AuthzUUID+"/")
+			if resp.StatusCode == http.StatusNotFound || time.Now().After(deadline) {
+				break
+			}
+
+			authz := proxy.GetAuthorizationReply{}
+			c.Assert(json.Unmarshal(body, &authz), IsNil)
+			c.Assert(authz.Expired, Equals, true)
+
+			time.Sleep(time.Second)
+		}
+		c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+
+		// a temporary authorization can be made permanent
+		temporary = s.addAuthorization(c, authzData("t1", time.Now().Unix()+60), token)
+
+		resp, _ = proxyPatch(c, token, endpoint+temporary.AuthzUUID+"/", []byte(`{"expires_at":0}`))
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(s.getAuthorization(c, temporary.AuthzUUID, token).ExpiresAt, Equals, int64(0))
+
+		resp, body = proxyPatch(c, token, endpoint+temporary.AuthzUUID+"/", []byte(`{}`))
+		assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+
+		for _, authz := range []proxy.GetAuthorizationReply{temporary, permanent} {
+			s.deleteAuthorization(c, authz.AuthzUUID, token)
+		}
+
+		resp, _ = proxyDelete(c, token, proxy.V1Prefix+"/local_users/"+expiringUser+"/?hard=true")
+		c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+	})
+}
+
+// TestTemporaryRoleExpiry tests that a principal falls back to its permanent
+// role once a temporary grant of a higher role expires
+func (s *systemtestSuite) TestTemporaryRoleExpiry(c *C) {
+	username := "temporary_role_user"
+
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		ms.AddHardcodedResponse("/api/v1/tenants/t1/", []byte(`{"foo":"bar"}`))
+
+		permanent := s.addAuthorization(c, `{"principalName":"`+username+`","local":true,"role":"ops","tenantName":"t1"}`, token)
+		c.Assert(getMe(c, loginAs(c, username, username)).Role, Equals, "ops")
+
+		expiresAt := time.Now().Unix() + 2
+		temporary := s.addAuthorization(c, fmt.Sprintf(`{"principalName":%q,"local":true,"role":"admin","expires_at":%d}`, username, expiresAt), token)
+		c.Assert(temporary.ExpiresAt, Equals, expiresAt)
+		grantToken := loginAs(c, username, username)
+		c.Assert(getMe(c, grantToken).Role, Equals, "admin")
+
+		time.Sleep(time.Unix(expiresAt+1, 0).Sub(time.Now()))
+
+		// tokens issued during the grant stay valid and fall back as well
+		c.Assert(getMe(c, grantToken).Role, Equals, "ops")
+
+		// the expired grant behaves as if it was never made
+		userToken := loginAs(c, username, username)
+		c.Assert(getMe(c, userToken).Role, Equals, "ops")
+
+		resp, _ := proxyGet(c, userToken, "/api/v1/tenants/t1/")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		resp, body := proxyPost(c, userToken, proxy.V1Prefix+"/local_users/", []byte(`{}`))
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		s.deleteAuthorization(c, permanent.AuthzUUID, token)
+
+		resp, _ = proxyDelete(c, token, proxy.V1Prefix+"/local_users/"+username+"/?hard=true")
+		c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+	})
+}
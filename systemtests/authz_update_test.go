@@ -0,0 +1,74 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestUpdateAuthorization tests that the role and tenant of an authorization
+// are changed in place, and that updates are validated like new authorizations
+func (s *systemtestSuite) TestUpdateAuthorization(c *C) {
+	updateUser := "authz_update_user"
+	endpoint := proxy.V1Prefix + "/authorizations/"
+
+	s.addUser(c, updateUser)
+
+	runTest(func(ms *MockServer) {
+		for _, tenant := range []string{"upd1", "upd2"} {
+			ms.AddHardcodedResponse("/api/v1/tenants/"+tenant+"/", []byte(`{"foo":"bar"}`))
+		}
+
+		authzData := func(tenant string) string {
+			return fmt.Sprintf(`{"principalName":%q,"local":true,"role":"ops","tenantName":%q}`, updateUser, tenant)
+		}
+
+		authz := s.addAuthorization(c, authzData("upd1"), adToken)
+		patch := func(uuid, data string) (*http.Response, []byte) {
+			return proxyPatch(c, adToken, endpoint+uuid+"/", []byte(data))
+		}
+
+		// the updated authorization is returned and keeps its UUID
+		resp, body := patch(authz.AuthzUUID, `{"role":"guest"}`)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		updated := proxy.GetAuthorizationReply{}
+		c.Assert(json.Unmarshal(body, &updated), IsNil)
+		c.Assert(updated.AuthzUUID, Equals, authz.AuthzUUID)
+		c.Assert(updated.Role, Equals, "guest")
+		c.Assert(updated.TenantName, Equals, "upd1")
+		c.Assert(s.getAuthorization(c, authz.AuthzUUID, adToken), DeepEquals, updated)
+
+		resp, body = patch(authz.AuthzUUID, `{"role":"ops","tenantName":"upd2"}`)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(json.Unmarshal(body, &updated), IsNil)
+		c.Assert(updated.Role, Equals, "ops")
+		c.Assert(updated.TenantName, Equals, "upd2")
+
+		userToken := loginAs(c, updateUser, updateUser)
+		resp, _ = proxyGet(c, userToken, "/api/v1/tenants/upd2/")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		resp, body = proxyGet(c, userToken, "/api/v1/tenants/upd1/")
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		// invalid updates are rejected and change nothing
+		other := s.addAuthorization(c, authzData("upd1"), adToken)
+		for _, data := range []string{`{"role":"root"}`, `{"role":"admin"}`, `{"tenantName":""}`, `{"tenantName":"upd1"}`} {
+			resp, body = patch(authz.AuthzUUID, data)
+			assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+		}
+		c.Assert(s.getAuthorization(c, authz.AuthzUUID, adToken), DeepEquals, updated)
+
+		resp, body = patch("non-existent", `{"role":"ops"}`)
+		assertErrorResponse(c, resp, body, http.StatusNotFound, types.ErrorCodeNotFound)
+
+		for _, a := range []proxy.GetAuthorizationReply{authz, other} {
+			s.deleteAuthorization(c, a.AuthzUUID, adToken)
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package systemtests
+
+import (
+	"encoding/base64"
+	"net/http"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// basicAuth returns the Authorization header value carrying the given credentials
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// TestBasicAuth tests that requests proxied to netmaster can use HTTP Basic auth
+// if it's allowed
+func (s *systemtestSuite) TestBasicAuth(c *C) {
+	runTest(func(ms *MockServer) {
+		endpoint := "/api/v1/networks/"
+
+		forwarded := ""
+		ms.AddHandler(endpoint, func(w http.ResponseWriter, req *http.Request) {
+			forwarded = req.Header.Get("Authorization")
+			w.Write([]byte("[]"))
+		})
+
+		adToken := adminToken(c)
+		headers := map[string]string{"Authorization": basicAuth(adminUsername, adminPassword)}
+
+		// disabled by default
+		resp, body := proxyGetWithHeaders(c, endpoint, headers)
+		assertErrorResponse(c, resp, body, 400, types.ErrorCodeMissingToken)
+
+		writeSettings(c, map[string]string{common.AllowBasicAuthKey: "true"})
+		defer func() {
+			writeSettings(c, map[string]string{})
+			reloadSettings(c, adToken)
+		}()
+		reloadSettings(c, adToken)
+
+		resp, body = proxyGetWithHeaders(c, endpoint, headers)
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(string(body), Equals, "[]")
+
+		// netmaster doesn't get to see the password
+		c.Assert(forwarded, Equals, "")
+
+		resp, body = proxyGetWithHeaders(c, endpoint, map[string]string{"Authorization": basicAuth(adminUsername, "wrong")})
+		assertErrorResponse(c, resp, body, 401, types.ErrorCodeInvalidCredentials)
+		c.Assert(resp.Header.Get("WWW-Authenticate"), Equals, `Basic realm="auth_proxy"`)
+
+		// the proxy's own API still requires a token
+		resp, body = proxyGetWithHeaders(c, proxy.V1Prefix+"/local_users/", headers)
+		assertErrorResponse(c, resp, body, 400, types.ErrorCodeMissingToken)
+
+		// tokens take precedence over credentials
+		resp, _ = proxyGetWithHeaders(c, endpoint, map[string]string{
+			"Authorization": basicAuth(adminUsername, "wrong"),
+			"X-Auth-Token":  adToken,
+		})
+		c.Assert(resp.StatusCode, Equals, 200)
+	})
+}
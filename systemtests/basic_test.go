@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
 	"github.com/contiv/auth_proxy/proxy"
+	"github.com/contiv/auth_proxy/state"
 
 	. "gopkg.in/check.v1"
 )
@@ -62,6 +65,19 @@ func (s *systemtestSuite) TestLogin(c *C) {
 		c.Assert(resp.StatusCode, Equals, 200)
 		c.Assert(len(token), Not(Equals), 0)
 
+		// the response tells who logged in, with which role and tenants
+		tenantAuthz := s.addAuthorization(c, `{"principalName":"`+opsUsername+`","local":true,"role":"ops","tenantName":"login-tenant"}`, token)
+		defer s.deleteAuthorization(c, tenantAuthz.AuthzUUID, token)
+
+		admin := loginExpiry(c, adminUsername, adminPassword)
+		c.Assert(admin.Username, Equals, adminUsername)
+		c.Assert(admin.Role, Equals, types.Admin.String())
+
+		ops := loginExpiry(c, opsUsername, opsPassword)
+		c.Assert(ops.Username, Equals, opsUsername)
+		c.Assert(ops.Role, Equals, types.Ops.String())
+		c.Assert(strings.Join(ops.Tenants, ","), Matches, "(.*,)?login-tenant(,.*)?")
+
 		//
 		// invalid credentials
 		//
@@ -93,6 +109,14 @@ func (s *systemtestSuite) TestLogin(c *C) {
 			// try logging in using `admin` account
 			loginAs(c, "Administrator", ldapAdminPassword)
 
+			// usernames are escaped in the search filter, so these match no user
+			for _, name := range []string{"*", "sacc*", "*)(sAMAccountName=saccount", "saccount)(|(objectClass=*"} {
+				token, resp, err := login(name, ldapPassword)
+				c.Assert(err, IsNil)
+				c.Assert(resp.StatusCode, Equals, 401)
+				c.Assert(token, Equals, "")
+			}
+
 			s.deleteLdapConfiguration(c, adToken)
 		}
 
@@ -148,6 +172,34 @@ func (s *systemtestSuite) TestNoDirectoryIndex(c *C) {
 	})
 }
 
+// TestUIFallback tests that client-side routes of the UI are served index.html
+// while unknown API endpoints and files outside of the UI are not.
+func (s *systemtestSuite) TestUIFallback(c *C) {
+	runTest(func(ms *MockServer) {
+		resp, index := proxyGet(c, noToken, "/")
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(resp.Header.Get("Cache-Control"), Equals, "no-cache")
+
+		resp, body := proxyGet(c, noToken, "/some/client/route")
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(body, DeepEquals, index)
+
+		resp, _ = proxyGet(c, noToken, "/missing.js")
+		c.Assert(resp.StatusCode, Equals, 404)
+
+		resp, _ = proxyGet(c, noToken, proxy.V1Prefix+"/unknown/")
+		c.Assert(resp.StatusCode, Equals, 404)
+
+		resp, _ = proxyGet(c, noToken, "/api/v1/networks/n1/unknown/")
+		c.Assert(resp.StatusCode, Equals, 404)
+
+		for _, path := range []string{"/../local.key", "/%2e%2e/local.key", "/..%2flocal.key"} {
+			_, body = proxyGet(c, noToken, path)
+			c.Assert(strings.Contains(string(body), "PRIVATE KEY"), Equals, false)
+		}
+	})
+}
+
 // TestHealthCheck tests that /health endpoint responds properly.
 func (s *systemtestSuite) TestHealthCheck(c *C) {
 	runTest(func(ms *MockServer) {
@@ -184,6 +236,18 @@ func (s *systemtestSuite) TestHealthCheck(c *C) {
 		c.Assert(hcr.Status, Equals, proxy.StatusHealthy)
 		c.Assert(hcr.NetmasterHealth.Status, Equals, proxy.StatusHealthy)
 		c.Assert(hcr.NetmasterHealth.Version, Equals, "y")
+
+		// the proxy's connections to netmaster are reported
+		c.Assert(hcr.NetmasterHealth.ConnectionPool, NotNil)
+
+		// the datastore is reachable, so the circuit breaker is closed
+		c.Assert(hcr.DatastoreHealth.Status, Equals, proxy.StatusHealthy)
+		c.Assert(hcr.DatastoreHealth.CircuitBreaker.State, Equals, state.BreakerClosed)
+		c.Assert(hcr.DatastoreHealth.Reason, Equals, "")
+
+		// quick probes skip pinging the datastore
+		resp, _ := proxyGet(c, noToken, proxy.HealthCheckPath+"?quick=true")
+		c.Assert(resp.StatusCode, Equals, 200)
 	})
 }
 
@@ -297,3 +361,31 @@ func (s *systemtestSuite) getRunningLdapConfig(startTLS bool) string {
 		`"insecure_skip_verify":false,` +
 		`"tls_cert_issued_to":""}`
 }
+
+// TestRoutesListing tests that admins can list the routes served by the proxy
+func (s *systemtestSuite) TestRoutesListing(c *C) {
+	runTest(func(ms *MockServer) {
+		resp, _ := proxyGet(c, opsToken(c), proxy.RoutesPath)
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		resp, body := proxyGet(c, adminToken(c), proxy.RoutesPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		routes := []proxy.RouteInfo{}
+		c.Assert(json.Unmarshal(body, &routes), IsNil)
+
+		found := map[string]proxy.RouteInfo{}
+		for _, route := range routes {
+			for _, method := range route.Methods {
+				found[method+" "+route.Path] = route
+			}
+		}
+
+		c.Assert(found["POST "+proxy.LoginPath].Role, Equals, "none")
+		c.Assert(found["GET "+proxy.V1Prefix+"/local_users/"].Role, Equals, "admin")
+		c.Assert(found["GET "+proxy.V1Prefix+"/local_users/{username}/"].Role, Equals, "self_or_admin")
+		c.Assert(found["POST "+proxy.V1Prefix+"/authorizations/"].Role, Equals, "admin")
+		c.Assert(found["GET /api/v1/networks/**"].TenantScoped, Equals, true)
+		c.Assert(found["GET /api/v1/networks/**"].Proxied, Equals, true)
+	})
+}
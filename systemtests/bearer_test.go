@@ -0,0 +1,65 @@
+package systemtests
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// proxyGetWithHeaders sends an insecure HTTPS GET request with the given headers to the proxy
+func proxyGetWithHeaders(c *C, path string, headers map[string]string) (*http.Response, []byte) {
+	req, err := http.NewRequest("GET", "https://"+proxyHost+path, nil)
+	c.Assert(err, IsNil)
+
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := insecureTestClient.Do(req)
+	c.Assert(err, IsNil)
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+
+	return resp, data
+}
+
+// TestBearerToken tests sending tokens in the Authorization header
+func (s *systemtestSuite) TestBearerToken(c *C) {
+	runTest(func(ms *MockServer) {
+		endpoint := "/api/v1/networks/"
+		ms.AddHandler(endpoint, func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("[]"))
+		})
+
+		token := adminToken(c)
+		otherToken := opsToken(c)
+
+		for _, path := range []string{
+			endpoint,
+			proxy.V1Prefix + "/local_users/",
+			proxy.V1Prefix + "/authorizations/",
+			proxy.WhoamiPath,
+		} {
+			resp, _ := proxyGetWithHeaders(c, path, map[string]string{"Authorization": "Bearer " + token})
+			c.Assert(resp.StatusCode, Equals, 200, Commentf("GET %s", path))
+
+			// both headers may be sent as long as they agree
+			resp, _ = proxyGetWithHeaders(c, path, map[string]string{"Authorization": "Bearer " + token, "X-Auth-Token": token})
+			c.Assert(resp.StatusCode, Equals, 200, Commentf("GET %s", path))
+
+			resp, body := proxyGetWithHeaders(c, path, map[string]string{"Authorization": "Bearer " + token, "X-Auth-Token": otherToken})
+			assertErrorResponse(c, resp, body, 400, types.ErrorCodeBadRequest)
+		}
+
+		// other schemes don't carry a token
+		resp, body := proxyGetWithHeaders(c, endpoint, map[string]string{"Authorization": "Basic YWRtaW46YWRtaW4="})
+		assertErrorResponse(c, resp, body, 400, types.ErrorCodeMissingToken)
+	})
+}
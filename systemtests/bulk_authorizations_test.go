@@ -0,0 +1,99 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestBulkAuthorizations tests that several authorizations are added at once,
+// and that none are added if any of them is invalid
+func (s *systemtestSuite) TestBulkAuthorizations(c *C) {
+	tenantAdmin := "bulk_tenant_admin"
+	s.addUser(c, username)
+	s.addUser(c, tenantAdmin)
+
+	runTest(func(ms *MockServer) {
+		authzData := func(principal, role, tenant string, local bool) string {
+			return fmt.Sprintf(`{"principalName":%q,"local":%t,"role":%q,"tenantName":%q}`, principal, local, role, tenant)
+		}
+
+		bulk := func(token string, grants ...string) (*http.Response, []byte) {
+			return proxyPost(c, token, proxy.BulkAuthorizationsPath, []byte("["+strings.Join(grants, ",")+"]"))
+		}
+
+		listTenant := func(tenant string) []proxy.GetAuthorizationReply {
+			resp, body := proxyGet(c, adToken, proxy.V1Prefix+"/authorizations/?tenant="+tenant)
+			c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+			authzs := []proxy.GetAuthorizationReply{}
+			c.Assert(json.Unmarshal(body, &authzs), IsNil)
+			return authzs
+		}
+
+		resp, body := bulk(adToken,
+			authzData(ldapGroupDN, "ops", "bulk1", false),
+			authzData(ldapGroupDN, "ops", "bulk2", false),
+			authzData(username, "guest", "bulk1", true),
+		)
+		c.Assert(resp.StatusCode, Equals, http.StatusCreated)
+
+		added := []proxy.GetAuthorizationReply{}
+		c.Assert(json.Unmarshal(body, &added), IsNil)
+		c.Assert(len(added), Equals, 3)
+		c.Assert(added[1].TenantName, Equals, "bulk2")
+		c.Assert(added[2].Role, Equals, "guest")
+		for _, authz := range added {
+			c.Assert(s.getAuthorization(c, authz.AuthzUUID, adToken), DeepEquals, authz)
+		}
+
+		// existing grants, duplicates and invalid grants are all reported, and
+		// none of the valid ones are added
+		resp, body = bulk(adToken,
+			authzData(ldapGroupDN, "ops", "bulk1", false),
+			authzData(username, "ops", "bulk3", true),
+			authzData(username, "ops", "bulk3", true),
+			authzData(username, "root", "bulk3", true),
+			authzData(username, "ops", "", true),
+		)
+		errResp := assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+		c.Assert(len(errResp.Details), Equals, 4)
+		for _, i := range []string{"0", "2", "3", "4"} {
+			c.Assert(errResp.Details[i], Not(Equals), "")
+		}
+		c.Assert(listTenant("bulk3"), HasLen, 0)
+
+		resp, body = proxyPost(c, adToken, proxy.BulkAuthorizationsPath, []byte(authzData(username, "ops", "bulk3", true)))
+		assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+
+		resp, body = bulk(adToken)
+		assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+
+		// tenant admins can't grant anything if one of the grants is out of their tenants
+		grant := s.addAuthorization(c, authzData(tenantAdmin, "tenant_admin", "bulk1", true), adToken)
+		tenantAdminToken := loginAs(c, tenantAdmin, tenantAdmin)
+
+		resp, body = bulk(tenantAdminToken,
+			authzData("bulk_member", "ops", "bulk1", true),
+			authzData("bulk_member", "ops", "bulk5", true),
+		)
+		errResp = assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeForbidden)
+		c.Assert(errResp.Details, DeepEquals, map[string]string{"1": "access denied"})
+		for _, authz := range listTenant("bulk1") {
+			c.Assert(authz.PrincipalName, Not(Equals), "bulk_member")
+		}
+
+		resp, body = bulk(tenantAdminToken, authzData(username, "admin", "", true))
+		assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeForbidden)
+
+		for _, authz := range append(added, grant) {
+			s.deleteAuthorization(c, authz.AuthzUUID, adToken)
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestBulkLocalUsers tests that several local users are added at once, that
+// none are added if any of them is invalid, and that a dry run adds none
+func (s *systemtestSuite) TestBulkLocalUsers(c *C) {
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		userData := func(name, password, role, tenant string) string {
+			return fmt.Sprintf(`{"username":%q,"password":%q,"role":%q,"tenantName":%q}`, name, password, role, tenant)
+		}
+
+		bulk := func(query string, users ...string) (*http.Response, []byte) {
+			return proxyPost(c, adToken, proxy.BulkLocalUsersPath+query, []byte("["+strings.Join(users, ",")+"]"))
+		}
+
+		users := []string{
+			userData("bulk_admin", "bulk_admin1", "admin", ""),
+			userData("bulk_ops", "bulk_ops1", "ops", "bulk1"),
+			userData("bulk_plain", "bulk_plain1", "", ""),
+		}
+
+		// a dry run validates the users without adding them
+		resp, body := bulk("?dry_run=true", users...)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Not(Matches), ".*password.*")
+
+		dryRun := proxy.BulkLocalUsersResponse{}
+		c.Assert(json.Unmarshal(body, &dryRun), IsNil)
+		c.Assert(dryRun.DryRun, Equals, true)
+		c.Assert(dryRun.Users, HasLen, 3)
+		c.Assert(dryRun.Users[1], DeepEquals, proxy.BulkLocalUserStatus{Username: "bulk_ops", Status: "valid", Role: "ops", TenantName: "bulk1"})
+
+		token, resp, err := login("bulk_plain", "bulk_plain1")
+		c.Assert(err, IsNil)
+		c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+		c.Assert(token, Equals, "")
+
+		resp, body = bulk("", users...)
+		c.Assert(resp.StatusCode, Equals, http.StatusCreated)
+		c.Assert(string(body), Not(Matches), ".*password.*")
+
+		added := proxy.BulkLocalUsersResponse{}
+		c.Assert(json.Unmarshal(body, &added), IsNil)
+		c.Assert(added.DryRun, Equals, false)
+		c.Assert(added.Users, HasLen, 3)
+		for _, user := range added.Users {
+			c.Assert(user.Status, Equals, "created")
+		}
+
+		// the users can log in with their roles
+		c.Assert(loginExpiry(c, "bulk_admin", "bulk_admin1").Role, Equals, types.Admin.String())
+		ops := loginExpiry(c, "bulk_ops", "bulk_ops1")
+		c.Assert(ops.Role, Equals, types.Ops.String())
+		c.Assert(ops.Tenants, DeepEquals, []string{"bulk1"})
+		loginAs(c, "bulk_plain", "bulk_plain1")
+
+		// existing users, duplicates and invalid users are all reported, and
+		// none of the valid ones are added
+		resp, body = bulk("",
+			userData("bulk_new", "bulk_new1", "", ""),
+			userData("bulk_ops", "bulk_ops1", "", ""),
+			userData("bulk_dup", "bulk_dup1", "", ""),
+			userData("bulk_dup", "bulk_dup1", "", ""),
+			userData("bulk$", "bulk_x1", "", ""),
+			userData("bulk_nopass", "", "", ""),
+			userData("bulk_role", "bulk_role1", "root", ""),
+			userData("bulk_tenant", "bulk_tenant1", "ops", ""),
+		)
+		errResp := assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+		c.Assert(errResp.Message, Matches, "no users were added.*")
+		c.Assert(len(errResp.Details), Equals, 6)
+		for _, i := range []string{"1", "3", "4", "5", "6", "7"} {
+			c.Assert(errResp.Details[i], Not(Equals), "")
+		}
+		c.Assert(string(body), Not(Matches), ".*bulk_new1.*")
+
+		resp, body = proxyGet(c, adToken, proxy.V1Prefix+"/local_users/bulk_new/")
+		assertErrorResponse(c, resp, body, http.StatusNotFound, types.ErrorCodeNotFound)
+
+		resp, body = bulk("")
+		assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+
+		resp, body = proxyPost(c, adToken, proxy.BulkLocalUsersPath, []byte(userData("bulk_new", "bulk_new1", "", "")))
+		assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+
+		// only admins can add users
+		resp, body = proxyPost(c, loginAs(c, username, username), proxy.BulkLocalUsersPath, []byte("["+userData("bulk_new", "bulk_new1", "", "")+"]"))
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		for _, name := range []string{"bulk_admin", "bulk_ops", "bulk_plain"} {
+			resp, _ = proxyDelete(c, adToken, proxy.V1Prefix+"/local_users/"+name+"/?hard=true")
+			c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+		}
+	})
+}
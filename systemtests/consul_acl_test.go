@@ -0,0 +1,35 @@
+package systemtests
+
+import (
+	"os"
+	"strings"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestConsulACL tests that consul's ACLs are reported as such when the token
+// is wrong; it only runs against a consul with ACLs enabled, whose token for
+// the proxy is in CONSUL_HTTP_TOKEN
+func (s *systemtestSuite) TestConsulACL(c *C) {
+	datastoreAddress := strings.TrimSpace(os.Getenv("DATASTORE_ADDRESS"))
+	if !strings.HasPrefix(datastoreAddress, state.ConsulName+"://") || os.Getenv("CONSUL_HTTP_TOKEN") == "" {
+		c.Skip("consul ACLs aren't enabled")
+	}
+
+	driver := &state.ConsulStateDriver{}
+
+	err := driver.Init(&types.KVStoreConfig{StoreURL: datastoreAddress, Token: "wrong"})
+	c.Assert(err, ErrorMatches, ".*ACL token.*")
+
+	_, err = driver.Read("/auth_proxy/local_users/admin")
+	c.Assert(err, Equals, auth_errors.ErrDatastoreAccessDenied)
+
+	// the proxy itself got in using the right token
+	runTest(func(ms *MockServer) {
+		c.Assert(adminToken(c), Not(Equals), "")
+	})
+}
@@ -0,0 +1,100 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestCustomRoles tests defining, granting and deleting custom roles
+func (s *systemtestSuite) TestCustomRoles(c *C) {
+	username := "network_manager"
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		endpoint := proxy.V1Prefix + "/roles/"
+		aciGws := "/api/v1/aciGws/"
+
+		ms.AddHardcodedResponse(aciGws, []byte("[]"))
+
+		adminTok := adminToken(c)
+		userTok := loginAs(c, username, username)
+
+		// only admins can manage roles
+		resp, _ := proxyGet(c, userTok, endpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusForbidden)
+
+		// invalid roles are rejected
+		resp, _ = proxyPost(c, adminTok, endpoint, []byte(`{"name":"ops","permissions":[{"path":"/api/v1/aciGws/**"}]}`))
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+		resp, _ = proxyPost(c, adminTok, endpoint, []byte(`{"name":"gateways","permissions":[]}`))
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+		// aciGws is admin-only by default
+		resp, body := proxyGet(c, userTok, aciGws)
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		resp, body = proxyPost(c, adminTok, endpoint, []byte(`{"name":"gateways","permissions":[{"path":"/api/v1/aciGws/**","methods":["get"]}]}`))
+		c.Assert(resp.StatusCode, Equals, http.StatusCreated)
+
+		role := types.CustomRole{}
+		c.Assert(json.Unmarshal(body, &role), IsNil)
+		c.Assert(role.Permissions[0].Methods, DeepEquals, []string{"GET"})
+
+		resp, _ = proxyPost(c, adminTok, endpoint, body)
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+		resp, body = proxyGet(c, adminTok, endpoint+"gateways/")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		fetched := types.CustomRole{}
+		c.Assert(json.Unmarshal(body, &fetched), IsNil)
+		c.Assert(fetched, DeepEquals, role)
+
+		// unknown roles can't be granted, custom roles can't be granted on a tenant
+		resp, _ = proxyPost(c, adminTok, proxy.V1Prefix+"/authorizations/", []byte(`{"PrincipalName":"`+username+`","local":true,"role":"unknown"}`))
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+		resp, _ = proxyPost(c, adminTok, proxy.V1Prefix+"/authorizations/", []byte(`{"PrincipalName":"`+username+`","local":true,"role":"gateways","tenantName":"default"}`))
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+		authz := s.addAuthorization(c, `{"PrincipalName":"`+username+`","local":true,"role":"gateways"}`, adminTok)
+		c.Assert(authz.Role, Equals, "gateways")
+		c.Assert(authz.CustomRole, Equals, true)
+		c.Assert(authz.TenantName, Equals, "")
+
+		// the role allows reading aciGws, but not changing them
+		resp, body = proxyGet(c, userTok, aciGws)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Equals, "[]")
+
+		resp, body = proxyPost(c, userTok, aciGws+"a1/", []byte(`{}`))
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		// built-in roles can't be deleted, granted custom roles neither
+		resp, _ = proxyDelete(c, adminTok, endpoint+types.Ops.String()+"/")
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+		resp, body = proxyDelete(c, adminTok, endpoint+"gateways/")
+		assertErrorResponse(c, resp, body, http.StatusConflict, types.ErrorCodeConflict)
+
+		s.deleteAuthorization(c, authz.AuthzUUID, adminTok)
+
+		resp, body = proxyGet(c, userTok, aciGws)
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		resp, _ = proxyDelete(c, adminTok, endpoint+"gateways/")
+		c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+
+		resp, _ = proxyGet(c, adminTok, endpoint+"gateways/")
+		c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+
+		resp, _ = proxyDelete(c, adminTok, endpoint+"gateways/")
+		c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+	})
+}
@@ -0,0 +1,101 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// hasString returns true if the given strings include s
+func hasString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TestMatchedAuthorizations tests that the authorizations a user matches are
+// listed in /me live, and in the user's sessions as they were at login
+func (s *systemtestSuite) TestMatchedAuthorizations(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		authz := s.addAuthorization(c, `{"PrincipalName":"`+opsUsername+`","local":true,"role":"ops","tenantName":"matched1"}`, token)
+
+		opsTok := opsToken(c)
+		c.Assert(hasString(getMe(c, opsTok).MatchedAuthorizations, authz.AuthzUUID), Equals, true)
+		c.Assert(hasString(listSessions(c, token)[tokenID(c, opsTok)].MatchedAuthorizations, authz.AuthzUUID), Equals, true)
+
+		// authorizations aren't matched by other users
+		c.Assert(hasString(getMe(c, token).MatchedAuthorizations, authz.AuthzUUID), Equals, false)
+
+		s.deleteAuthorization(c, authz.AuthzUUID, token)
+
+		c.Assert(hasString(getMe(c, opsTok).MatchedAuthorizations, authz.AuthzUUID), Equals, false)
+		c.Assert(hasString(listSessions(c, token)[tokenID(c, opsTok)].MatchedAuthorizations, authz.AuthzUUID), Equals, true)
+	})
+}
+
+// TestDebugPrincipal tests resolving the groups and roles of LDAP users live
+func (s *systemtestSuite) TestDebugPrincipal(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		endpoint := proxy.DebugPrincipalPath + ldapTestUsername
+
+		resp, _ := proxyGet(c, opsToken(c), endpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusForbidden)
+
+		resp, _ = proxyGet(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+
+		// nothing listens on port 1
+		s.addLdapConfiguration(c, token, `{"server":"127.0.0.1","port":1,"base_dn":"DC=contiv,DC=ad,DC=local",`+
+			`"service_account_dn":"CN=Service Account,CN=Users,DC=contiv,DC=ad,DC=local","service_account_password":"s3cr3t"}`)
+
+		resp, _ = proxyGet(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusBadGateway)
+
+		s.deleteLdapConfiguration(c, token)
+		s.addLdapConfiguration(c, token, s.getRunningLdapConfig(false))
+
+		authz := s.addAuthorization(c, `{"PrincipalName":"`+ldapGroupDN+`","local":false,"role":"ops","tenantName":"debug1"}`, token)
+
+		resp, body := proxyGet(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		principal := proxy.DebugPrincipalResponse{}
+		c.Assert(json.Unmarshal(body, &principal), IsNil)
+		c.Assert(principal.Name, Equals, ldapTestUsername)
+		c.Assert(principal.DN, Not(Equals), "")
+		c.Assert(hasString(principal.Groups, ldapGroupDN), Equals, true)
+		c.Assert(principal.LocalUser, Equals, false)
+
+		matched := []string{}
+		for _, m := range principal.MatchedAuthorizations {
+			matched = append(matched, m.AuthzUUID)
+		}
+		c.Assert(hasString(matched, authz.AuthzUUID), Equals, true)
+
+		// the role and tenants are the same the user gets at login
+		me := getMe(c, loginAs(c, ldapTestUsername, ldapPassword))
+		c.Assert(principal.DN, Equals, me.PrincipalName)
+		c.Assert(principal.Role, Equals, me.Role)
+		c.Assert(principal.Tenants, DeepEquals, me.Tenants)
+
+		// `temp` is only associated with its primary group, so it can't log in
+		for _, name := range []string{"temp", "nosuchuser", url.QueryEscape("*")} {
+			resp, _ = proxyGet(c, token, proxy.DebugPrincipalPath+name)
+			c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+		}
+
+		s.deleteAuthorization(c, authz.AuthzUUID, token)
+		s.deleteLdapConfiguration(c, token)
+	})
+}
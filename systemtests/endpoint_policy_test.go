@@ -0,0 +1,114 @@
+package systemtests
+
+import (
+	"encoding/json"
+
+	"github.com/contiv/auth_proxy/auth"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// endpointPolicyDryRun asks the proxy whether the given user would be allowed to access an endpoint
+func endpointPolicyDryRun(c *C, token, data string) auth.EndpointPolicyDecision {
+	resp, body := proxyPost(c, token, proxy.V1Prefix+"/endpoint_policy/dry_run/", []byte(data))
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	decision := auth.EndpointPolicyDecision{}
+	c.Assert(json.Unmarshal(body, &decision), IsNil)
+
+	return decision
+}
+
+// TestEndpointPolicyEndpoints tests the endpoint policy CRUD and dry run endpoints
+func (s *systemtestSuite) TestEndpointPolicyEndpoints(c *C) {
+	runTest(func(ms *MockServer) {
+		endpoint := proxy.V1Prefix + "/endpoint_policy/"
+		aciGws := "/api/v1/aciGws/"
+
+		ms.AddHardcodedResponse(aciGws, []byte("[]"))
+
+		token := adminToken(c)
+		opsTok := opsToken(c)
+
+		// only admins can manage the policy
+		resp, _ := proxyGet(c, opsTok, endpoint)
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// the data store is seeded with the default rules
+		resp, body := proxyGet(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		rules := []types.EndpointPolicyRule{}
+		c.Assert(json.Unmarshal(body, &rules), IsNil)
+		c.Assert(len(rules), Equals, len(auth.DefaultEndpointPolicyRules()))
+
+		// aciGws is admin-only by default
+		resp, body = proxyGet(c, opsTok, aciGws)
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		dryRun := `{"username":"ops","method":"GET","path":"` + aciGws + `"}`
+		c.Assert(endpointPolicyDryRun(c, token, dryRun).Allowed, Equals, false)
+		c.Assert(endpointPolicyDryRun(c, token, `{"username":"admin","method":"GET","path":"`+aciGws+`"}`).Allowed, Equals, true)
+
+		// invalid rules are rejected
+		resp, _ = proxyPost(c, token, endpoint, []byte(`{"path":"/api/v1/aciGws/**","role":"root"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyPost(c, token, endpoint, []byte(`{"path":"/api/v1/aciGws/**","role":"ops"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		// let ops users read aciGws
+		resp, body = proxyPost(c, token, endpoint, []byte(`{"path":"/api/v1/aciGws/**","methods":["get"],"role":"ops","scope":"global"}`))
+		c.Assert(resp.StatusCode, Equals, 201)
+
+		rule := types.EndpointPolicyRule{}
+		c.Assert(json.Unmarshal(body, &rule), IsNil)
+		c.Assert(rule.ID, Not(Equals), "")
+		c.Assert(rule.Methods, DeepEquals, []string{"GET"})
+
+		resp, body = proxyGet(c, token, endpoint+rule.ID+"/")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		fetched := types.EndpointPolicyRule{}
+		c.Assert(json.Unmarshal(body, &fetched), IsNil)
+		c.Assert(fetched, DeepEquals, rule)
+
+		resp, body = proxyGet(c, opsTok, aciGws)
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(string(body), Equals, "[]")
+
+		decision := endpointPolicyDryRun(c, token, dryRun)
+		c.Assert(decision.Allowed, Equals, true)
+		c.Assert(decision.Rule.ID, Equals, rule.ID)
+
+		// POST is still admin-only
+		c.Assert(endpointPolicyDryRun(c, token, `{"username":"ops","method":"POST","path":"/api/v1/aciGws/a1/"}`).Allowed, Equals, false)
+
+		// tenant-scoped rules check the given tenant
+		decision = endpointPolicyDryRun(c, token, `{"username":"ops","method":"GET","path":"/api/v1/networks/n1/","tenantName":"unknown"}`)
+		c.Assert(decision.TenantScoped, Equals, true)
+		c.Assert(decision.Allowed, Equals, false)
+
+		// restrict it again by updating the rule
+		resp, _ = proxyPut(c, token, endpoint+rule.ID+"/", []byte(`{"path":"/api/v1/aciGws/**","role":"admin"}`))
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		resp, body = proxyGet(c, opsTok, aciGws)
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		// delete the rule
+		resp, _ = proxyDelete(c, token, endpoint+rule.ID+"/")
+		c.Assert(resp.StatusCode, Equals, 204)
+
+		resp, _ = proxyGet(c, token, endpoint+rule.ID+"/")
+		c.Assert(resp.StatusCode, Equals, 404)
+
+		resp, _ = proxyPut(c, token, endpoint+rule.ID+"/", []byte(`{"path":"/api/v1/aciGws/**","role":"admin"}`))
+		c.Assert(resp.StatusCode, Equals, 404)
+
+		resp, _ = proxyDelete(c, token, endpoint+rule.ID+"/")
+		c.Assert(resp.StatusCode, Equals, 404)
+	})
+}
@@ -0,0 +1,75 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// assertErrorResponse asserts that the response is an error with the given status and code
+func assertErrorResponse(c *C, resp *http.Response, body []byte, status int, code string) types.ErrorResponse {
+	c.Assert(resp.StatusCode, Equals, status)
+
+	errResp := types.ErrorResponse{}
+	c.Assert(json.Unmarshal(body, &errResp), IsNil, Commentf("body: %s", body))
+
+	c.Assert(errResp.Code, Equals, code)
+	c.Assert(errResp.Message, Not(Equals), "")
+	c.Assert(errResp.RequestID, Not(Equals), "")
+	c.Assert(errResp.RequestID, Equals, resp.Header.Get("X-Request-Id"))
+
+	return errResp
+}
+
+// TestErrorResponses tests the error envelope returned by each family of endpoints
+func (s *systemtestSuite) TestErrorResponses(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		// login
+		resp, body, err := insecureJSONBody("", proxy.LoginPath, "POST", []byte(`{"username":"admin","password":"wrong"}`))
+		c.Assert(err, IsNil)
+		assertErrorResponse(c, resp, body, 401, types.ErrorCodeInvalidCredentials)
+
+		resp, body, err = insecureJSONBody("", proxy.LoginPath, "POST", []byte(`{"username":"admin"}`))
+		c.Assert(err, IsNil)
+		assertErrorResponse(c, resp, body, 400, types.ErrorCodeBadRequest)
+
+		// authentication and authorization
+		resp, body = proxyGet(c, "", "/api/v1/networks/")
+		assertErrorResponse(c, resp, body, 400, types.ErrorCodeMissingToken)
+
+		resp, body = proxyGet(c, "not a token", "/api/v1/networks/")
+		assertErrorResponse(c, resp, body, 400, types.ErrorCodeInvalidToken)
+
+		resp, body = proxyGet(c, opsToken(c), proxy.V1Prefix+"/authorizations/")
+		assertErrorResponse(c, resp, body, 403, types.ErrorCodeForbidden)
+
+		// users
+		resp, body = proxyGet(c, token, proxy.V1Prefix+"/local_users/no_such_user/")
+		assertErrorResponse(c, resp, body, 404, types.ErrorCodeNotFound)
+
+		resp, body = proxyPost(c, token, proxy.V1Prefix+"/local_users/", []byte(`{"username":"admin","password":"admin"}`))
+		assertErrorResponse(c, resp, body, 400, types.ErrorCodeBadRequest)
+
+		// authorizations
+		resp, body = proxyGet(c, token, proxy.V1Prefix+"/authorizations/no_such_authorization/")
+		assertErrorResponse(c, resp, body, 404, types.ErrorCodeNotFound)
+
+		// LDAP configuration
+		resp, body = proxyPut(c, token, endpoint, []byte(`{"server":"localhost", "port":0}`))
+		assertErrorResponse(c, resp, body, 400, types.ErrorCodeBadRequest)
+
+		// unknown endpoints
+		resp, body = proxyGet(c, token, proxy.V1Prefix+"/no_such_endpoint/")
+		assertErrorResponse(c, resp, body, 404, types.ErrorCodeNotFound)
+	})
+
+	// nothing answers the proxied requests outside of runTest()
+	resp, body := proxyGet(c, adminToken(c), "/api/v1/networks/")
+	assertErrorResponse(c, resp, body, 502, types.ErrorCodeUpstreamFailed)
+}
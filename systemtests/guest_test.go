@@ -0,0 +1,81 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestGuestRole tests that guests can read the objects of their tenants, but
+// can't change anything
+func (s *systemtestSuite) TestGuestRole(c *C) {
+	guest := "guest_user"
+	s.addUser(c, guest)
+
+	runTest(func(ms *MockServer) {
+		authz := s.addAuthorization(c,
+			`{"PrincipalName":"`+guest+`","local":true,"role":"guest","tenantName":"`+tenantName+`"}`, adToken)
+		c.Assert(authz.Role, Equals, "guest")
+
+		guestToken := loginAs(c, guest, guest)
+
+		resp, body := proxyGet(c, guestToken, proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		whoami := proxy.WhoamiResponse{}
+		c.Assert(json.Unmarshal(body, &whoami), IsNil)
+		c.Assert(whoami.Role, Equals, "guest")
+		c.Assert(whoami.Tenants, DeepEquals, []string{tenantName})
+
+		// lists are filtered by the guest's tenants
+		endpoint := "/api/v1/tenants/"
+		ms.AddHardcodedResponse(endpoint, []byte(`[{"tenantName":"t1"},{"tenantName":"t2"},{"tenantName":"t3"}]`))
+
+		resp, body = proxyGet(c, guestToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		s.processListResponse(c, "tenants", string(body), []string{tenantName})
+
+		// the guest's tenant can be read, but not changed
+		endpoint = "/api/v1/tenants/" + tenantName + "/"
+		ms.AddHardcodedResponse(endpoint, []byte(`{"tenantName":"`+tenantName+`"}`))
+
+		resp, _ = proxyGet(c, guestToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		resp, body = proxyDelete(c, guestToken, endpoint)
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		for resource, rName := range epSuffixes {
+			endpoint := "/api/v1/" + resource + "/" + rName + "/"
+			respData := `{"tenantName":"` + tenantName + `"}`
+			ms.AddHardcodedResponse(endpoint, []byte(respData))
+
+			resp, body := proxyGet(c, guestToken, endpoint)
+			c.Assert(resp.StatusCode, Equals, http.StatusOK)
+			c.Assert(string(body), Equals, respData)
+
+			resp, body = proxyPost(c, guestToken, endpoint, []byte(respData))
+			s.assertInsufficientPrivileges(c, resp, body)
+
+			resp, body = proxyPut(c, guestToken, endpoint, []byte(respData))
+			s.assertInsufficientPrivileges(c, resp, body)
+
+			resp, body = proxyPatch(c, guestToken, endpoint, []byte(respData))
+			s.assertInsufficientPrivileges(c, resp, body)
+
+			resp, body = proxyDelete(c, guestToken, endpoint)
+			s.assertInsufficientPrivileges(c, resp, body)
+		}
+
+		// other tenants' objects can't be read either
+		endpoint = "/api/v1/networks/other/"
+		ms.AddHardcodedResponse(endpoint, []byte(`{"tenantName":"t2"}`))
+
+		resp, body = proxyGet(c, guestToken, endpoint)
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		s.deleteAuthorization(c, authz.AuthzUUID, adToken)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -34,7 +35,8 @@ var (
 
 // Test is the entrypoint for the systemtests suite.
 // depending on the value of the DATASTORE_ADDRESS envvar, the tests will either run
-// against etcd or consul.  the datastore is assumed to be fresh and with no
+// against etcd (v2 or v3 API) or consul; it may list several endpoints of the datastore,
+// e.g. etcd://host1:2379,etcd://host2:2379.  the datastore is assumed to be fresh and with no
 // existing state.
 func Test(t *testing.T) {
 	if len(os.Getenv("DEBUG")) > 0 {
@@ -51,7 +53,7 @@ func Test(t *testing.T) {
 	datastoreAddress := strings.TrimSpace(os.Getenv("DATASTORE_ADDRESS"))
 
 	log.Info("Initializing datastore")
-	if err := state.InitializeStateDriver(datastoreAddress); err != nil {
+	if err := state.InitializeStateDriver(datastoreAddress, nil); err != nil {
 		log.Fatalln(err)
 	}
 
@@ -105,6 +107,8 @@ func runTest(f func(*MockServer)) {
 }
 
 // login returns the user's token or returns an error if authentication fails.
+// Successful logins must also tell who logged in and, unless the password
+// expired, with which role.
 func login(username, password string) (string, *http.Response, error) {
 	type loginBody struct {
 		Username string `json:"username"`
@@ -132,6 +136,16 @@ func login(username, password string) (string, *http.Response, error) {
 		return "", resp, err
 	}
 
+	if resp.StatusCode == http.StatusOK {
+		if common.IsEmpty(lr.Username) {
+			return "", resp, fmt.Errorf("login response of %q carries no username", username)
+		}
+
+		if _, err := types.Role(lr.Role); err != nil && !lr.PasswordExpired && !lr.PasswordResetRequired {
+			return "", resp, fmt.Errorf("login response of %q carries an invalid role %q", username, lr.Role)
+		}
+	}
+
 	return lr.Token, resp, nil
 }
 
@@ -0,0 +1,193 @@
+package systemtests
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/contiv/auth_proxy/auth"
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// introspectWithCredential asks the proxy to introspect the given token,
+// authenticating with the given introspection client ID and secret.
+func introspectWithCredential(c *C, clientID, secret, token string) (*http.Response, []byte) {
+	data, err := json.Marshal(&proxy.IntrospectionRequest{Token: token})
+	c.Assert(err, IsNil)
+
+	req, err := http.NewRequest("POST", "https://"+proxyHost+proxy.IntrospectionPath, bytes.NewBuffer(data))
+	c.Assert(err, IsNil)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(clientID, secret)
+
+	resp, err := insecureTestClient.Do(req)
+	c.Assert(err, IsNil)
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+
+	return resp, body
+}
+
+// introspect asks the proxy to introspect the given token using an admin token
+func introspect(c *C, adminTok, token string) proxy.IntrospectionResponse {
+	data, err := json.Marshal(&proxy.IntrospectionRequest{Token: token})
+	c.Assert(err, IsNil)
+
+	resp, body := proxyPost(c, adminTok, proxy.IntrospectionPath, data)
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	introspection := proxy.IntrospectionResponse{}
+	c.Assert(json.Unmarshal(body, &introspection), IsNil)
+
+	return introspection
+}
+
+// TestTokenIntrospection tests introspection of active, expired, revoked and garbage tokens
+func (s *systemtestSuite) TestTokenIntrospection(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		opsTok := opsToken(c)
+
+		// active tokens
+		introspection := introspect(c, token, token)
+		c.Assert(introspection.Active, Equals, true)
+		c.Assert(introspection.Username, Equals, adminUsername)
+		c.Assert(introspection.Role, Equals, "admin")
+		c.Assert(introspection.Principals, DeepEquals, []string{adminUsername})
+		c.Assert(introspection.Iat <= time.Now().Unix(), Equals, true)
+		c.Assert(introspection.Exp > time.Now().Unix(), Equals, true)
+
+		authz := s.addAuthorization(c, `{"PrincipalName":"`+opsUsername+`","local":true,"role":"ops","tenantName":"t1"}`, token)
+		defer s.deleteAuthorization(c, authz.AuthzUUID, token)
+
+		introspection = introspect(c, token, opsTok)
+		c.Assert(introspection.Active, Equals, true)
+		c.Assert(introspection.Username, Equals, opsUsername)
+		c.Assert(introspection.Role, Equals, "ops")
+		c.Assert(introspection.Tenants, DeepEquals, []string{"t1"})
+
+		// garbage tokens
+		for _, garbage := range []string{"", "garbage", token + "x"} {
+			c.Assert(introspect(c, token, garbage), DeepEquals, proxy.IntrospectionResponse{Active: false})
+		}
+
+		// expired tokens
+		expired, err := auth.NewTokenWithClaims([]string{opsUsername})
+		c.Assert(err, IsNil)
+
+		expired.AddClaim(auth.UsernameClaimKey, opsUsername)
+		expired.AddClaim("exp", time.Now().Add(-time.Minute).Unix())
+
+		expiredStr, err := expired.Stringify()
+		c.Assert(err, IsNil)
+
+		c.Assert(introspect(c, token, expiredStr), DeepEquals, proxy.IntrospectionResponse{Active: false})
+
+		// revoked tokens
+		revoked := opsToken(c)
+
+		parsed, err := auth.ParseToken(revoked)
+		c.Assert(err, IsNil)
+		c.Assert(db.RevokeToken(parsed.ID(), parsed.ExpiresAt()), IsNil)
+
+		c.Assert(introspect(c, token, revoked), DeepEquals, proxy.IntrospectionResponse{Active: false, Revoked: true})
+
+		resp, body := proxyGet(c, revoked, proxy.V1Prefix+"/local_users/"+opsUsername+"/")
+		c.Assert(resp.StatusCode, Equals, 401)
+		c.Assert(string(body), Matches, ".*Token revoked.*")
+
+		// other tokens of the same user are unaffected
+		c.Assert(introspect(c, token, opsTok).Active, Equals, true)
+	})
+}
+
+// TestTokenIntrospectionAuthentication tests who is allowed to introspect tokens
+func (s *systemtestSuite) TestTokenIntrospectionAuthentication(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		data := []byte(`{"token":"` + token + `"}`)
+
+		// anonymous callers
+		resp, _ := proxyPost(c, "", proxy.IntrospectionPath, data)
+		c.Assert(resp.StatusCode, Equals, 401)
+
+		// non-admin tokens
+		resp, _ = proxyPost(c, opsToken(c), proxy.IntrospectionPath, data)
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// no introspection credential configured
+		resp, _ = introspectWithCredential(c, "billing", "secret", token)
+		c.Assert(resp.StatusCode, Equals, 401)
+
+		writeSettings(c, map[string]string{
+			common.IntrospectionClientIDKey:     "billing",
+			common.IntrospectionClientSecretKey: "secret",
+		})
+		defer func() {
+			writeSettings(c, map[string]string{})
+			reloadSettings(c, token)
+		}()
+		reloadSettings(c, token)
+
+		// wrong credential
+		resp, _ = introspectWithCredential(c, "billing", "wrong", token)
+		c.Assert(resp.StatusCode, Equals, 401)
+
+		resp, _ = introspectWithCredential(c, "metrics", "secret", token)
+		c.Assert(resp.StatusCode, Equals, 401)
+
+		// valid credential
+		resp, body := introspectWithCredential(c, "billing", "secret", token)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		introspection := proxy.IntrospectionResponse{}
+		c.Assert(json.Unmarshal(body, &introspection), IsNil)
+		c.Assert(introspection.Active, Equals, true)
+		c.Assert(introspection.Username, Equals, adminUsername)
+	})
+}
+
+// TestTokenIntrospectionRateLimit tests that introspection is rate limited per client
+func (s *systemtestSuite) TestTokenIntrospectionRateLimit(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		writeSettings(c, map[string]string{common.IntrospectionRateLimitKey: "1"})
+		defer func() {
+			writeSettings(c, map[string]string{})
+			reloadSettings(c, token)
+		}()
+		reloadSettings(c, token)
+
+		data := []byte(`{"token":"` + token + `"}`)
+
+		rejected := 0
+		for i := 0; i < 5; i++ {
+			resp, _ := proxyPost(c, token, proxy.IntrospectionPath, data)
+			if resp.StatusCode == 429 {
+				rejected++
+			}
+		}
+		c.Assert(rejected > 0, Equals, true)
+
+		// other endpoints are not affected
+		resp, _ := proxyGet(c, token, proxy.V1Prefix+"/local_users/")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// the bucket refills
+		time.Sleep(time.Second)
+
+		resp, _ = proxyPost(c, token, proxy.IntrospectionPath, data)
+		c.Assert(resp.StatusCode, Equals, 200)
+	})
+}
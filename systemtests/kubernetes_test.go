@@ -0,0 +1,117 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/proxy"
+	jwt "github.com/dgrijalva/jwt-go"
+	uuid "github.com/satori/go.uuid"
+
+	. "gopkg.in/check.v1"
+)
+
+const serviceAccountName = "system:serviceaccount:default:controller"
+
+// mockServerURL returns the URL at which the proxy reaches the MockServer,
+// i.e. the address of the interface we talk to the proxy through
+func mockServerURL(c *C) string {
+	conn, err := net.Dial("udp", proxyHost)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	return "http://" + net.JoinHostPort(conn.LocalAddr().(*net.UDPAddr).IP.String(), "9999")
+}
+
+// serviceAccountToken returns a new JWT which looks like a ServiceAccount token
+func serviceAccountToken(c *C) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": "kubernetes/serviceaccount",
+		"sub": serviceAccountName,
+		"jti": uuid.NewV4().String(), // new tokens aren't cached by the proxy
+	})
+
+	tokenStr, err := token.SignedString([]byte("kubernetes"))
+	c.Assert(err, IsNil)
+
+	return tokenStr
+}
+
+// TestKubernetesServiceAccounts tests authenticating ServiceAccount tokens
+// using a stub of the Kubernetes TokenReview API
+func (s *systemtestSuite) TestKubernetesServiceAccounts(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		allowed := serviceAccountToken(c)
+		denied := serviceAccountToken(c)
+
+		ms.AddHandler("/apis/authentication.k8s.io/v1/tokenreviews", func(w http.ResponseWriter, req *http.Request) {
+			review := map[string]map[string]interface{}{}
+			json.NewDecoder(req.Body).Decode(&review)
+
+			status := map[string]interface{}{"authenticated": false, "error": "invalid bearer token"}
+			if review["spec"]["token"] == allowed {
+				status = map[string]interface{}{
+					"authenticated": true,
+					"user":          map[string]string{"username": serviceAccountName},
+				}
+			}
+
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": status})
+		})
+
+		ms.AddHardcodedResponse("/api/v1/networks/", []byte("[]"))
+
+		// ServiceAccount tokens are rejected unless Kubernetes authentication is enabled
+		resp, _ := proxyGet(c, allowed, proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		writeSettings(c, map[string]string{common.KubernetesAPIServerKey: mockServerURL(c)})
+		defer func() {
+			writeSettings(c, map[string]string{})
+			reloadSettings(c, adminToken(c))
+		}()
+		reloadSettings(c, token)
+
+		// our own tokens keep working
+		resp, _ = proxyGet(c, token, "/api/v1/networks/")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// allowed, but not authorized for anything yet
+		resp, body := proxyGet(c, allowed, proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(string(body), Equals, `{"username":"`+serviceAccountName+`","role":"ops"}`)
+
+		resp, _ = proxyGet(c, allowed, proxy.V1Prefix+"/authorizations/")
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// the ServiceAccount is authorized like any other principal
+		authz := s.addAuthorization(c, `{"principalName":"`+serviceAccountName+`","local":false,"role":"admin"}`, token)
+		defer s.deleteAuthorization(c, authz.AuthzUUID, token)
+
+		resp, _ = proxyGet(c, allowed, proxy.V1Prefix+"/authorizations/")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		resp, _ = proxyGet(c, allowed, "/api/v1/networks/")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// denied by the TokenReview API
+		resp, body = proxyGet(c, denied, "/api/v1/networks/")
+		c.Assert(resp.StatusCode, Equals, 401)
+		c.Assert(string(body), Matches, ".*Invalid ServiceAccount token.*")
+
+		// API server down
+		writeSettings(c, map[string]string{common.KubernetesAPIServerKey: "http://127.0.0.1:1"})
+		reloadSettings(c, token)
+
+		resp, _ = proxyGet(c, serviceAccountToken(c), "/api/v1/networks/")
+		c.Assert(resp.StatusCode, Equals, 503)
+
+		resp, _ = proxyGet(c, token, "/api/v1/networks/")
+		c.Assert(resp.StatusCode, Equals, 200)
+	})
+}
@@ -0,0 +1,76 @@
+package systemtests
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestLastAdmin tests that the last admin can't be deleted, disabled or demoted
+func (s *systemtestSuite) TestLastAdmin(c *C) {
+	secondAdmin := "second_admin"
+	s.addUser(c, secondAdmin)
+
+	runTest(func(ms *MockServer) {
+		adminTok := adminToken(c)
+		authz := s.addAuthorization(c, `{"PrincipalName":"`+secondAdmin+`","local":true,"role":"admin","tenantName":""}`, adminTok)
+		secondTok := loginAs(c, secondAdmin, secondAdmin)
+
+		adminEndpoint := proxy.V1Prefix + "/local_users/" + adminUsername + "/"
+		secondEndpoint := proxy.V1Prefix + "/local_users/" + secondAdmin + "/"
+		authzEndpoint := proxy.V1Prefix + "/authorizations/" + authz.AuthzUUID + "/"
+
+		// the built-in admin can be disabled while there's another admin
+		resp, _ := proxyPatch(c, secondTok, adminEndpoint, []byte(`{"disable":true}`))
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		// ... but the second admin is now the last one
+		resp, body := proxyDelete(c, secondTok, authzEndpoint)
+		assertErrorResponse(c, resp, body, http.StatusConflict, types.ErrorCodeConflict)
+
+		expiresAt := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		resp, body = proxyPatch(c, secondTok, authzEndpoint, []byte(`{"expires_at":`+expiresAt+`}`))
+		assertErrorResponse(c, resp, body, http.StatusConflict, types.ErrorCodeConflict)
+
+		resp, body = proxyDelete(c, secondTok, proxy.V1Prefix+"/authorizations/?principal_name="+secondAdmin)
+		assertErrorResponse(c, resp, body, http.StatusConflict, types.ErrorCodeConflict)
+
+		resp, body = proxyPatch(c, secondTok, secondEndpoint, []byte(`{"disable":true}`))
+		assertErrorResponse(c, resp, body, http.StatusConflict, types.ErrorCodeConflict)
+
+		resp, body = proxyDelete(c, secondTok, secondEndpoint)
+		assertErrorResponse(c, resp, body, http.StatusConflict, types.ErrorCodeConflict)
+
+		resp, body = proxyDelete(c, secondTok, secondEndpoint+"?hard=true")
+		assertErrorResponse(c, resp, body, http.StatusConflict, types.ErrorCodeConflict)
+
+		// nothing was removed
+		resp, _ = proxyGet(c, secondTok, authzEndpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		// admin authorizations of LDAP groups count too
+		group := s.addAuthorization(c, `{"PrincipalName":"cn=admins,dc=contiv,dc=local","local":false,"role":"admin","tenantName":""}`, secondTok)
+
+		resp, _ = proxyPatch(c, secondTok, authzEndpoint, []byte(`{"expires_at":`+expiresAt+`}`))
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		// the group is the last admin which doesn't expire
+		resp, body = proxyDelete(c, secondTok, proxy.V1Prefix+"/authorizations/"+group.AuthzUUID+"/")
+		assertErrorResponse(c, resp, body, http.StatusConflict, types.ErrorCodeConflict)
+
+		resp, _ = proxyPatch(c, secondTok, adminEndpoint, []byte(`{"disable":false}`))
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		// disabling the built-in admin revoked its tokens; sleep so that the
+		// new token isn't issued in the same second as the revocation
+		time.Sleep(time.Second)
+		adminTok = adminToken(c)
+		s.deleteAuthorization(c, group.AuthzUUID, adminTok)
+		s.deleteAuthorization(c, authz.AuthzUUID, adminTok)
+	})
+}
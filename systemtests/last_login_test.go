@@ -0,0 +1,83 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// listLastLogins returns the names of the listed local users along with their last login
+func listLastLogins(c *C, token, query string) map[string]int64 {
+	resp, body := proxyGet(c, token, proxy.V1Prefix+"/local_users/"+query)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	users := []types.LocalUser{}
+	c.Assert(json.Unmarshal(body, &users), IsNil)
+
+	listed := map[string]int64{}
+	for _, user := range users {
+		listed[user.Username] = user.LastLogin
+	}
+
+	return listed
+}
+
+// TestLastLogin tests that the last logins of local users are recorded and
+// that the users who haven't logged in for a while can be listed
+func (s *systemtestSuite) TestLastLogin(c *C) {
+	inactiveUser := "inactive_user"
+	s.addUser(c, inactiveUser)
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		// the user never logged in
+		lastLogin, found := listLastLogins(c, token, "")[inactiveUser]
+		c.Assert(found, Equals, true)
+		c.Assert(lastLogin, Equals, int64(0))
+
+		_, found = listLastLogins(c, token, "?inactive_since=90d")[inactiveUser]
+		c.Assert(found, Equals, true)
+
+		before := time.Now().Unix()
+		loginAs(c, inactiveUser, inactiveUser)
+
+		lastLogin = listLastLogins(c, token, "")[inactiveUser]
+		c.Assert(lastLogin >= before && lastLogin <= time.Now().Unix(), Equals, true)
+
+		_, found = listLastLogins(c, token, "?inactive_since=90d")[inactiveUser]
+		c.Assert(found, Equals, false)
+
+		// updating the user keeps its last login, which can't be set
+		resp, _ := proxyPatch(c, token, proxy.V1Prefix+"/local_users/"+inactiveUser+"/", []byte(`{"first_name":"Inactive","last_login":1}`))
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(listLastLogins(c, token, "")[inactiveUser], Equals, lastLogin)
+
+		// pretend the user last logged in 100 days ago
+		c.Assert(db.RecordLocalUserLogin(inactiveUser, time.Now().Add(-100*24*time.Hour).Unix()), IsNil)
+
+		_, found = listLastLogins(c, token, "?inactive_since=90d")[inactiveUser]
+		c.Assert(found, Equals, true)
+
+		_, found = listLastLogins(c, token, "?inactive_since=2160h")[inactiveUser]
+		c.Assert(found, Equals, true)
+
+		_, found = listLastLogins(c, token, "?inactive_since=120d")[inactiveUser]
+		c.Assert(found, Equals, false)
+
+		// admins who just logged in aren't inactive
+		_, found = listLastLogins(c, token, "?inactive_since=1d")[adminUsername]
+		c.Assert(found, Equals, false)
+
+		for _, value := range []string{"abc", "0d", "-90d", "90"} {
+			resp, body := proxyGet(c, token, proxy.V1Prefix+"/local_users/?inactive_since="+value)
+			assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+		}
+	})
+}
@@ -1,8 +1,10 @@
 package systemtests
 
 import (
+	"encoding/json"
 	"net/http"
 
+	"github.com/contiv/auth_proxy/auth/ldap"
 	"github.com/contiv/auth_proxy/proxy"
 	. "gopkg.in/check.v1"
 )
@@ -158,7 +160,7 @@ func (s *systemtestSuite) TestLdapUpdateEndpoint(c *C) {
 		s.addLdapConfiguration(c, adToken, ldapConfig)
 
 		// this also tests GET
-		data := `{"server":"` + ldapServer + `","port":5678,"base_dn":"DC=contiv,DC=ad,DC=local","service_account_dn":"CN=Service Account,CN=Users,DC=contiv,DC=ad,DC=local","start_tls":false,"insecure_skip_verify":false,"tls_cert_issued_to":""}`
+		data := `{"server":"` + ldapServer + `","port":5678,"base_dn":"DC=contiv,DC=ad,DC=local","service_account_dn":"CN=Service Account,CN=Users,DC=contiv,DC=ad,DC=local","start_tls":false,"use_ldaps":false,"insecure_skip_verify":false,"tls_cert_issued_to":"","follow_referrals":false}`
 		c.Assert(string(s.getLdapConfiguration(c, adToken)), DeepEquals, data)
 
 		// update the existing ldap config
@@ -167,7 +169,7 @@ func (s *systemtestSuite) TestLdapUpdateEndpoint(c *C) {
               "start_tls":false}`
 		s.updateLdapConfiguration(c, adToken, data)
 
-		data = `{"server":"` + ldapServer + `","port":45631,"base_dn":"DC=contiv,DC=local","service_account_dn":"CN=Service Account,CN=Users,DC=contiv,DC=local","start_tls":false,"insecure_skip_verify":false,"tls_cert_issued_to":""}`
+		data = `{"server":"` + ldapServer + `","port":45631,"base_dn":"DC=contiv,DC=local","service_account_dn":"CN=Service Account,CN=Users,DC=contiv,DC=local","start_tls":false,"use_ldaps":false,"insecure_skip_verify":false,"tls_cert_issued_to":"","follow_referrals":false}`
 		c.Assert(string(s.getLdapConfiguration(c, adToken)), DeepEquals, data)
 
 		// non-admins cannot access this endpoint
@@ -196,3 +198,192 @@ func (s *systemtestSuite) TestLdapUpdateEndpoint(c *C) {
 		s.deleteLdapConfiguration(c, adToken)
 	})
 }
+
+// TestLdapGroupSchema tests validation of the LDAP group schema
+func (s *systemtestSuite) TestLdapGroupSchema(c *C) {
+	runTest(func(ms *MockServer) {
+		ldapConfig := s.getRunningLdapConfig(false)
+		s.addLdapConfiguration(c, adToken, ldapConfig)
+
+		for _, data := range []string{
+			`{"group_membership":"somewhere"}`,
+			`{"group_membership":"group"}`,
+			`{"group_membership":"group","group_object_class":"posixGroup","group_membership_attribute":"memberOf"}`,
+			`{"group_membership":"user","group_membership_attribute":"memberUid"}`,
+			`{"group_membership_attribute":"member)(uid=*"}`,
+			`{"user_object_class":"posixAccount)(uid=*"}`,
+		} {
+			resp, _ := proxyPatch(c, adToken, endpoint, []byte(data))
+			c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+		}
+
+		data := `{"group_membership":"group","group_object_class":"posixGroup","group_membership_attribute":"memberUid"}`
+		s.updateLdapConfiguration(c, adToken, data)
+		c.Assert(string(s.getLdapConfiguration(c, adToken)), Matches,
+			`.*"group_object_class":"posixGroup","group_membership_attribute":"memberUid","group_membership":"group".*`)
+
+		s.updateLdapConfiguration(c, adToken, `{"user_object_class":"posixAccount"}`)
+		c.Assert(string(s.getLdapConfiguration(c, adToken)), Matches, `.*"user_object_class":"posixAccount","group_object_class":"posixGroup".*`)
+
+		s.deleteLdapConfiguration(c, adToken)
+	})
+}
+
+// TestLdapReferrals tests validation of the domains LDAP referrals are followed to
+func (s *systemtestSuite) TestLdapReferrals(c *C) {
+	runTest(func(ms *MockServer) {
+		ldapConfig := s.getRunningLdapConfig(false)
+		s.addLdapConfiguration(c, adToken, ldapConfig)
+
+		for _, data := range []string{
+			`{"follow_referrals":true}`,
+			`{"follow_referrals":true,"referral_domains":[]}`,
+			`{"follow_referrals":true,"referral_domains":["."]}`,
+			`{"follow_referrals":true,"referral_domains":["evil.com:389"]}`,
+		} {
+			resp, _ := proxyPatch(c, adToken, endpoint, []byte(data))
+			c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+		}
+
+		data := `{"follow_referrals":true,"referral_domains":["contiv.ad.local"]}`
+		s.updateLdapConfiguration(c, adToken, data)
+		c.Assert(string(s.getLdapConfiguration(c, adToken)), Matches,
+			`.*"follow_referrals":true,"referral_domains":\["contiv.ad.local"\].*`)
+
+		s.deleteLdapConfiguration(c, adToken)
+	})
+}
+
+// TestLdapUserAttributes tests validation of the LDAP attributes carried in tokens
+func (s *systemtestSuite) TestLdapUserAttributes(c *C) {
+	runTest(func(ms *MockServer) {
+		ldapConfig := s.getRunningLdapConfig(false)
+		s.addLdapConfiguration(c, adToken, ldapConfig)
+
+		for _, data := range []string{
+			`{"user_attributes":["displayName","mail)(uid=*"]}`,
+			`{"user_attributes":[""]}`,
+			`{"user_attributes":["a1","a2","a3","a4","a5","a6","a7","a8","a9","a10","a11"]}`,
+		} {
+			resp, _ := proxyPatch(c, adToken, endpoint, []byte(data))
+			c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+		}
+
+		data := `{"user_attributes":["displayName","title"]}`
+		s.updateLdapConfiguration(c, adToken, data)
+		c.Assert(string(s.getLdapConfiguration(c, adToken)), Matches, `.*"user_attributes":\["displayName","title"\].*`)
+
+		s.deleteLdapConfiguration(c, adToken)
+	})
+}
+
+// TestLdapLoginAttribute tests validation of the LDAP attributes users log in with
+func (s *systemtestSuite) TestLdapLoginAttribute(c *C) {
+	runTest(func(ms *MockServer) {
+		ldapConfig := s.getRunningLdapConfig(false)
+		s.addLdapConfiguration(c, adToken, ldapConfig)
+
+		for _, data := range []string{
+			`{"login_attribute":["sAMAccountName","mail)(uid=*"]}`,
+			`{"login_attribute":[""]}`,
+		} {
+			resp, _ := proxyPatch(c, adToken, endpoint, []byte(data))
+			c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+		}
+
+		data := `{"login_attribute":["sAMAccountName","userPrincipalName"]}`
+		s.updateLdapConfiguration(c, adToken, data)
+		c.Assert(string(s.getLdapConfiguration(c, adToken)), Matches, `.*"login_attribute":\["sAMAccountName","userPrincipalName"\].*`)
+
+		// users can still log in with their sAMAccountName
+		loginAs(c, "saccount", ldapPassword)
+
+		s.deleteLdapConfiguration(c, adToken)
+	})
+}
+
+// TestLdapConfigurationTest tests testing LDAP configurations without saving them
+func (s *systemtestSuite) TestLdapConfigurationTest(c *C) {
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		userToken := loginAs(c, username, username)
+
+		resp, _ := proxyPost(c, userToken, proxy.LdapConfigurationTestPath, []byte(`{}`))
+		c.Assert(resp.StatusCode, Equals, http.StatusForbidden)
+
+		// there's no stored configuration to test
+		resp, _ = proxyPost(c, adToken, proxy.LdapConfigurationTestPath, []byte(`{}`))
+		c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+
+		resp, _ = proxyPost(c, adToken, proxy.LdapConfigurationTestPath, []byte(`{"configuration":{"server":"localhost","port":0}}`))
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+		// nothing listens on port 1
+		data := `{"configuration":{"server":"127.0.0.1","port":1,"base_dn":"DC=contiv,DC=ad,DC=local",` +
+			`"service_account_dn":"CN=Service Account,CN=Users,DC=contiv,DC=ad,DC=local","service_account_password":"s3cr3t"},"username":"jdoe"}`
+		resp, body := proxyPost(c, adToken, proxy.LdapConfigurationTestPath, []byte(data))
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Not(Matches), ".*s3cr3t.*")
+
+		result := ldap.CheckResult{}
+		c.Assert(json.Unmarshal(body, &result), IsNil)
+		c.Assert(result.Connected, Equals, false)
+		c.Assert(result.Error, Not(Equals), "")
+
+		// nothing was saved
+		resp, _ = proxyGet(c, adToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+	})
+}
+
+// TestLdapConfigurationReencrypt tests re-encrypting the LDAP service account password
+func (s *systemtestSuite) TestLdapConfigurationReencrypt(c *C) {
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		userToken := loginAs(c, username, username)
+
+		resp, _ := proxyPost(c, userToken, proxy.LdapConfigurationReencryptPath, nil)
+		c.Assert(resp.StatusCode, Equals, http.StatusForbidden)
+
+		resp, _ = proxyPost(c, adToken, proxy.LdapConfigurationReencryptPath, nil)
+		c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+
+		// the proxy only has one TLS key, which the password is encrypted with
+		s.addLdapConfiguration(c, adToken, s.getRunningLdapConfig(false))
+
+		resp, body := proxyPost(c, adToken, proxy.LdapConfigurationReencryptPath, nil)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Equals, `{"reencrypted":false}`)
+
+		s.deleteLdapConfiguration(c, adToken)
+	})
+}
+
+// TestLdapGroupSearch tests searching LDAP groups
+func (s *systemtestSuite) TestLdapGroupSearch(c *C) {
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		userToken := loginAs(c, username, username)
+
+		resp, _ := proxyGet(c, userToken, proxy.LdapGroupsPath+"?query=ops")
+		c.Assert(resp.StatusCode, Equals, http.StatusForbidden)
+
+		resp, _ = proxyGet(c, adToken, proxy.LdapGroupsPath+"?query=ops")
+		c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+
+		// nothing listens on port 1
+		s.addLdapConfiguration(c, adToken, `{"server":"127.0.0.1","port":1,"base_dn":"DC=contiv,DC=ad,DC=local",`+
+			`"service_account_dn":"CN=Service Account,CN=Users,DC=contiv,DC=ad,DC=local","service_account_password":"s3cr3t"}`)
+
+		resp, _ = proxyGet(c, adToken, proxy.LdapGroupsPath+"?query=%20")
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+		resp, _ = proxyGet(c, adToken, proxy.LdapGroupsPath+"?query=ops")
+		c.Assert(resp.StatusCode, Equals, http.StatusBadGateway)
+
+		s.deleteLdapConfiguration(c, adToken)
+	})
+}
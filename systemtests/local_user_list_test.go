@@ -0,0 +1,156 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestLocalUserList tests filtering, sorting and paginating the local users list
+func (s *systemtestSuite) TestLocalUserList(c *C) {
+	listUsers := []string{"list_c", "list_a", "list_b"}
+	for _, username := range listUsers {
+		s.addUser(c, username)
+	}
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		authz := s.addAuthorization(c, `{"PrincipalName":"list_b","local":true,"role":"ops","tenantName":"list1"}`, token)
+
+		list := func(query string) ([]string, string) {
+			resp, body := proxyGet(c, token, proxy.V1Prefix+"/local_users/"+query)
+			c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+			users := []types.LocalUser{}
+			c.Assert(json.Unmarshal(body, &users), IsNil)
+
+			names := []string{}
+			for _, user := range users {
+				names = append(names, user.Username)
+			}
+
+			return names, resp.Header.Get("X-Total-Count")
+		}
+
+		// users are sorted by username
+		names, total := list("?username_contains=LIST_")
+		c.Assert(names, DeepEquals, []string{"list_a", "list_b", "list_c"})
+		c.Assert(total, Equals, "3")
+
+		names, total = list("?username_contains=list_&limit=2")
+		c.Assert(names, DeepEquals, []string{"list_a", "list_b"})
+		c.Assert(total, Equals, "3")
+
+		names, total = list("?username_contains=list_&limit=2&offset=2")
+		c.Assert(names, DeepEquals, []string{"list_c"})
+		c.Assert(total, Equals, "3")
+
+		names, _ = list("?username_contains=list_&offset=3")
+		c.Assert(names, DeepEquals, []string{})
+
+		names, total = list("?username_contains=list_&role=ops")
+		c.Assert(names, DeepEquals, []string{"list_b"})
+		c.Assert(total, Equals, "1")
+
+		// the whole list is returned without parameters
+		names, total = list("")
+		c.Assert(len(names) >= 5, Equals, true)
+		c.Assert(total, Equals, strconv.Itoa(len(names)))
+
+		for _, query := range []string{"?limit=0", "?offset=-1", "?limit=ten", "?role=", "?role=root", "?name=list_a"} {
+			resp, body := proxyGet(c, token, proxy.V1Prefix+"/local_users/"+query)
+			assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+		}
+
+		s.deleteAuthorization(c, authz.AuthzUUID, token)
+	})
+}
+
+// TestLocalUserListAuthorizations tests that the local users list and a single
+// user embed the users' authorizations if asked to
+func (s *systemtestSuite) TestLocalUserListAuthorizations(c *C) {
+	joinUsers := []string{"join_a", "join_b", "join_admin"}
+	for _, username := range joinUsers {
+		s.addUser(c, username)
+	}
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		authzs := []proxy.GetAuthorizationReply{
+			s.addAuthorization(c, `{"PrincipalName":"join_a","local":true,"role":"ops","tenantName":"join1"}`, token),
+			s.addAuthorization(c, `{"PrincipalName":"join_a","local":true,"role":"ops","tenantName":"join2"}`, token),
+			s.addAuthorization(c, `{"PrincipalName":"join_admin","local":true,"role":"tenant_admin","tenantName":"join1"}`, token),
+			// an LDAP user with the same name isn't the local user
+			s.addAuthorization(c, `{"PrincipalName":"join_b","local":false,"role":"ops","tenantName":"join1"}`, token),
+		}
+		defer func() {
+			for _, authz := range authzs {
+				s.deleteAuthorization(c, authz.AuthzUUID, token)
+			}
+		}()
+
+		list := func(token, query string) map[string][]string {
+			resp, body := proxyGet(c, token, proxy.V1Prefix+"/local_users/?username_contains=join_&include=authorizations"+query)
+			c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+			users := []proxy.LocalUserWithAuthorizations{}
+			c.Assert(json.Unmarshal(body, &users), IsNil)
+
+			tenants := map[string][]string{}
+			for _, user := range users {
+				tenants[user.Username] = []string{}
+				for _, authz := range user.Authorizations {
+					c.Assert(authz.Local, Equals, true)
+					tenants[user.Username] = append(tenants[user.Username], authz.Role+":"+authz.TenantName)
+				}
+			}
+			return tenants
+		}
+
+		tenants := list(token, "")
+		c.Assert(tenants, HasLen, 3)
+		c.Assert(tenants["join_a"], HasLen, 2)
+		c.Assert(tenants["join_b"], DeepEquals, []string{})
+		c.Assert(tenants["join_admin"], DeepEquals, []string{"tenant_admin:join1"})
+
+		// pages are joined too
+		c.Assert(list(token, "&limit=1"), DeepEquals, map[string][]string{"join_a": tenants["join_a"]})
+
+		// tenant admins only see the authorizations of the tenants they administer
+		tenants = list(loginAs(c, "join_admin", "join_admin"), "")
+		c.Assert(tenants["join_a"], DeepEquals, []string{"ops:join1"})
+		c.Assert(tenants["join_admin"], DeepEquals, []string{"tenant_admin:join1"})
+
+		// without `include`, the list is unchanged
+		resp, body := proxyGet(c, token, proxy.V1Prefix+"/local_users/?username_contains=join_")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Not(Matches), ".*authorizations.*")
+
+		// a single user
+		resp, body = proxyGet(c, token, proxy.V1Prefix+"/local_users/join_a/?include=authorizations")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		user := proxy.LocalUserWithAuthorizations{}
+		c.Assert(json.Unmarshal(body, &user), IsNil)
+		c.Assert(user.Username, Equals, "join_a")
+		c.Assert(user.Authorizations, HasLen, 2)
+
+		resp, body = proxyGet(c, token, proxy.V1Prefix+"/local_users/join_b/?include=authorizations")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Matches, `.*"authorizations":\[\].*`)
+
+		resp, body = proxyGet(c, token, proxy.V1Prefix+"/local_users/join_b/")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Not(Matches), ".*authorizations.*")
+
+		for _, endpoint := range []string{"/local_users/?include=tenants", "/local_users/join_a/?include=tenants"} {
+			resp, body = proxyGet(c, token, proxy.V1Prefix+endpoint)
+			assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+		}
+	})
+}
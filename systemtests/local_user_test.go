@@ -1,7 +1,10 @@
 package systemtests
 
 import (
+	"encoding/json"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/contiv/auth_proxy/common/types"
 	"github.com/contiv/auth_proxy/proxy"
@@ -58,8 +61,11 @@ func (s *systemtestSuite) TestLocalUserEndpoints(c *C) {
 
 			// get `username`
 			resp, body = proxyGet(c, token, endpoint+"/")
-			c.Assert(resp.StatusCode, Equals, 404)
-			c.Assert(len(body), Equals, 0)
+			assertErrorResponse(c, resp, body, 404, types.ErrorCodeNotFound)
+
+			// delete `username` permanently so that it can be reused
+			resp, _ = proxyDelete(c, token, endpoint+"/?hard=true")
+			c.Assert(resp.StatusCode, Equals, 204)
 		}
 
 		endpoint := proxy.V1Prefix + "/local_users"
@@ -102,9 +108,14 @@ func (s *systemtestSuite) TestInvalidUserTokens(c *C) {
 			respBody := `{"username":"` + username + `","first_name":"","last_name":"","disable":true}`
 			s.updateLocalUser(c, username, data, respBody, token)
 
-			// try login using the disabled account
+			// try login using the disabled account; only the right password tells it's disabled
 			testuserToken, resp, err := login(username, username)
 			c.Assert(err, IsNil)
+			c.Assert(resp.StatusCode, Equals, http.StatusForbidden)
+			c.Assert(len(testuserToken), Equals, 0)
+
+			testuserToken, resp, err = login(username, "wrong"+username)
+			c.Assert(err, IsNil)
 			c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
 			c.Assert(len(testuserToken), Equals, 0)
 
@@ -118,6 +129,15 @@ func (s *systemtestSuite) TestInvalidUserTokens(c *C) {
 			// revert back; enable the account
 			respBody = `{"username":"` + username + `","first_name":"","last_name":"","disable":false}`
 			s.updateLocalUser(c, username, data, respBody, token)
+
+			// the token was revoked when the account was disabled
+			resp, body = proxyGet(c, userToken, endpoint)
+			assertErrorResponse(c, resp, body, http.StatusUnauthorized, types.ErrorCodeTokenRevoked)
+
+			// the user can log in again; sleep so that the new token isn't issued
+			// in the same second as the revocation
+			time.Sleep(time.Second)
+			loginAs(c, username, username)
 		}
 
 		// test login using deleted user account
@@ -141,6 +161,9 @@ func (s *systemtestSuite) TestInvalidUserTokens(c *C) {
 			resp, body = proxyGet(c, userToken, endpoint)
 			c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
 			c.Assert(string(body), Matches, ".*Invalid user.*")
+
+			resp, _ = proxyDelete(c, token, endpoint+"?hard=true")
+			c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
 		}
 
 		// test accessing resources using disabled built-in `ops` account
@@ -283,8 +306,18 @@ func (s *systemtestSuite) TestLocalUserDeleteEndpoint(c *C) {
 
 			// get `username`
 			resp, body = proxyGet(c, token, endpoint+"/")
-			c.Assert(resp.StatusCode, Equals, 404)
+			assertErrorResponse(c, resp, body, 404, types.ErrorCodeNotFound)
+
+			// deleting it again only works permanently
+			resp, body = proxyDelete(c, token, endpoint+"/")
+			assertErrorResponse(c, resp, body, 404, types.ErrorCodeNotFound)
+
+			resp, body = proxyDelete(c, token, endpoint+"/?hard=true")
+			c.Assert(resp.StatusCode, Equals, 204)
 			c.Assert(len(body), Equals, 0)
+
+			resp, body = proxyDelete(c, token, endpoint+"/?hard=true")
+			assertErrorResponse(c, resp, body, 404, types.ErrorCodeNotFound)
 		}
 
 		// delete built-in users
@@ -304,6 +337,57 @@ func (s *systemtestSuite) TestLocalUserDeleteEndpoint(c *C) {
 	})
 }
 
+// TestLocalUserDeleteRemovesAuthorizations tests that permanently deleting a
+// local user removes its authorizations, so that a new user with the same name
+// doesn't inherit them
+func (s *systemtestSuite) TestLocalUserDeleteRemovesAuthorizations(c *C) {
+	grantee := "deleted_grantee"
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		endpoint := proxy.V1Prefix + "/local_users/" + grantee + "/"
+
+		data := `{"username":"` + grantee + `","password":"` + grantee + `","disable":false}`
+		respBody := `{"username":"` + grantee + `","first_name":"","last_name":"","disable":false}`
+		s.addLocalUser(c, data, respBody, token)
+
+		s.addAuthorization(c, `{"PrincipalName":"`+grantee+`","local":true,"role":"ops","tenantName":"deleted1"}`, token)
+		s.addAuthorization(c, `{"PrincipalName":"`+grantee+`","local":true,"role":"admin"}`, token)
+		c.Assert(getMe(c, loginAs(c, grantee, grantee)).Role, Equals, types.Admin.String())
+
+		// soft-deleted users keep their authorizations so that they can be
+		// restored; deleting permanently removes them
+		resp, _ := proxyDelete(c, token, endpoint+"?hard=true")
+		c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+
+		resp, body := proxyGet(c, token, proxy.V1Prefix+"/authorizations/?principal_name="+grantee)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		authzs := []proxy.GetAuthorizationReply{}
+		c.Assert(json.Unmarshal(body, &authzs), IsNil)
+		c.Assert(authzs, HasLen, 0)
+
+		// the new user with the same name has no claims; its tokens aren't
+		// revoked along with the deleted user's if issued a second later
+		s.addLocalUser(c, data, respBody, token)
+		time.Sleep(time.Second)
+
+		login := loginExpiry(c, grantee, grantee)
+		c.Assert(login.Role, Not(Equals), types.Admin.String())
+		c.Assert(login.Role, Not(Equals), types.Ops.String())
+		c.Assert(login.Tenants, HasLen, 0)
+
+		me := getMe(c, login.Token)
+		c.Assert(me.Role, Equals, login.Role)
+		c.Assert(me.Tenants, HasLen, 0)
+
+		resp, _ = proxyGet(c, login.Token, proxy.V1Prefix+"/local_users/")
+		c.Assert(resp.StatusCode, Equals, http.StatusForbidden)
+
+		resp, _ = proxyDelete(c, token, endpoint+"?hard=true")
+		c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+	})
+}
+
 // addLocalUser helper function for the tests
 func (s *systemtestSuite) addLocalUser(c *C, data, expectedRespBody, token string) {
 	endpoint := proxy.V1Prefix + "/local_users"
@@ -321,3 +405,123 @@ func (s *systemtestSuite) updateLocalUser(c *C, username, data, expectedRespBody
 	c.Assert(resp.StatusCode, Equals, 200)
 	c.Assert(string(body), DeepEquals, expectedRespBody)
 }
+
+// TestLocalUserProfile tests the optional email and full name of local users
+func (s *systemtestSuite) TestLocalUserProfile(c *C) {
+	profileUser := "profile_user"
+	endpoint := proxy.V1Prefix + "/local_users/" + profileUser + "/"
+
+	// users without a profile don't list its fields
+	s.addUser(c, profileUser)
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		resp, body := proxyGet(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Equals, `{"username":"`+profileUser+`","first_name":"","last_name":"","disable":false}`)
+
+		// invalid fields are rejected
+		for _, data := range []string{`{"email":"jdoe"}`, `{"email":"John Doe <jdoe@example.com>"}`,
+			`{"full_name":"` + strings.Repeat("a", 129) + `"}`} {
+			resp, body = proxyPatch(c, token, endpoint, []byte(data))
+			assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+		}
+
+		resp, body = proxyPost(c, token, proxy.V1Prefix+"/local_users/",
+			[]byte(`{"username":"profile_invalid","password":"profile_invalid","email":"not-an-email"}`))
+		assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+
+		s.updateLocalUser(c, profileUser, `{"email":"jdoe@example.com","full_name":"John Doe"}`,
+			`{"username":"`+profileUser+`","first_name":"","last_name":"","email":"jdoe@example.com","full_name":"John Doe","disable":false}`, token)
+
+		// leaving the fields out keeps them
+		s.updateLocalUser(c, profileUser, `{"first_name":"John"}`,
+			`{"username":"`+profileUser+`","first_name":"John","last_name":"","email":"jdoe@example.com","full_name":"John Doe","disable":false}`, token)
+
+		resp, body = proxyGet(c, token, proxy.V1Prefix+"/local_users/?username_contains="+profileUser)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		users := []types.LocalUser{}
+		c.Assert(json.Unmarshal(body, &users), IsNil)
+		c.Assert(users, HasLen, 1)
+		c.Assert(users[0].Email, Equals, "jdoe@example.com")
+		c.Assert(users[0].FullName, Equals, "John Doe")
+
+		me := getMe(c, loginAs(c, profileUser, profileUser))
+		c.Assert(me.Email, Equals, "jdoe@example.com")
+		c.Assert(me.FullName, Equals, "John Doe")
+
+		// and they can be given when adding a user
+		resp, body = proxyDelete(c, token, endpoint+"?hard=true")
+		c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+
+		s.addLocalUser(c, `{"username":"`+profileUser+`","password":"`+profileUser+`","email":"jane@example.com","full_name":"Jane Doe"}`,
+			`{"username":"`+profileUser+`","first_name":"","last_name":"","email":"jane@example.com","full_name":"Jane Doe","disable":false}`, token)
+
+		resp, _ = proxyDelete(c, token, endpoint+"?hard=true")
+		c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+	})
+}
+
+// TestLocalUserLabels tests that local users can be labeled, listed by label,
+// and that labels don't grant anything
+func (s *systemtestSuite) TestLocalUserLabels(c *C) {
+	labeledUser := "labeled_user"
+	endpoint := proxy.V1Prefix + "/local_users/" + labeledUser + "/"
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		resp, body := proxyPost(c, token, proxy.V1Prefix+"/local_users/",
+			[]byte(`{"username":"labels_invalid","password":"labels_invalid","labels":{"team=a":"infra"}}`))
+		assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+
+		s.addLocalUser(c, `{"username":"`+labeledUser+`","password":"`+labeledUser+`","labels":{"team":"infra","role":"admin"}}`,
+			`{"username":"`+labeledUser+`","first_name":"","last_name":"","labels":{"role":"admin","team":"infra"},"disable":false}`, token)
+
+		// labels have no effect on the user's role
+		c.Assert(loginExpiry(c, labeledUser, labeledUser).Role, Not(Equals), types.Admin.String())
+
+		listed := func(query string) []string {
+			resp, body := proxyGet(c, token, proxy.V1Prefix+"/local_users/?"+query)
+			c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+			users := []types.LocalUser{}
+			c.Assert(json.Unmarshal(body, &users), IsNil)
+
+			names := []string{}
+			for _, user := range users {
+				names = append(names, user.Username)
+			}
+			return names
+		}
+
+		c.Assert(listed("label=team=infra"), DeepEquals, []string{labeledUser})
+		c.Assert(listed("label=team=infra&label=role=admin"), DeepEquals, []string{labeledUser})
+		c.Assert(listed("label=team=ops"), HasLen, 0)
+
+		resp, body = proxyGet(c, token, proxy.V1Prefix+"/local_users/?label=team")
+		assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+
+		// other updates keep the labels, given ones replace all of them, and
+		// `{}` removes them
+		s.updateLocalUser(c, labeledUser, `{"first_name":"Lab"}`,
+			`{"username":"`+labeledUser+`","first_name":"Lab","last_name":"","labels":{"role":"admin","team":"infra"},"disable":false}`, token)
+
+		s.updateLocalUser(c, labeledUser, `{"labels":{"team":"ops"}}`,
+			`{"username":"`+labeledUser+`","first_name":"Lab","last_name":"","labels":{"team":"ops"},"disable":false}`, token)
+		c.Assert(listed("label=team=infra"), HasLen, 0)
+		c.Assert(listed("label=team=ops"), DeepEquals, []string{labeledUser})
+
+		resp, body = proxyPatch(c, token, endpoint, []byte(`{"labels":{"team":"`+strings.Repeat("a", 257)+`"}}`))
+		assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+
+		s.updateLocalUser(c, labeledUser, `{"labels":{}}`,
+			`{"username":"`+labeledUser+`","first_name":"Lab","last_name":"","disable":false}`, token)
+		c.Assert(listed("label=team=ops"), HasLen, 0)
+
+		resp, _ = proxyDelete(c, token, endpoint+"?hard=true")
+		c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+	})
+}
@@ -0,0 +1,124 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/contiv/auth_proxy/auth/ldap"
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// loginAudit returns the login audit records matching the given query
+func loginAudit(c *C, token, query string) []types.LoginAuditRecord {
+	resp, body := proxyGet(c, token, proxy.LoginAuditPath+"?"+query)
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	records := []types.LoginAuditRecord{}
+	c.Assert(json.Unmarshal(body, &records), IsNil)
+
+	return records
+}
+
+// TestLoginAudit tests that logins are recorded and can be queried by admins
+func (s *systemtestSuite) TestLoginAudit(c *C) {
+	runTest(func(ms *MockServer) {
+		since := strconv.FormatInt(time.Now().Unix(), 10)
+
+		// unknown users and wrong passwords are both told their login failed...
+		_, unknownResp, err := login("no_such_user", "whatever")
+		c.Assert(err, IsNil)
+		c.Assert(unknownResp.StatusCode, Equals, 401)
+
+		_, wrongResp, err := login(opsUsername, "wrong password")
+		c.Assert(err, IsNil)
+		c.Assert(wrongResp.StatusCode, Equals, 401)
+
+		token := adminToken(c)
+
+		// ...while the audit trail tells them apart
+		records := loginAudit(c, token, "since="+since+"&username=no_such_user")
+		c.Assert(records, HasLen, 1)
+		c.Assert(records[0].Success, Equals, false)
+		c.Assert(records[0].FailureReason, Equals, "unknown_user")
+		c.Assert(records[0].SourceIP, Not(Equals), "")
+		c.Assert(records[0].UserAgent, Not(Equals), "")
+
+		records = loginAudit(c, token, "since="+since+"&username="+opsUsername)
+		c.Assert(records, HasLen, 1)
+		c.Assert(records[0].FailureReason, Equals, "invalid_credentials")
+
+		records = loginAudit(c, token, "since="+since+"&username="+adminUsername)
+		c.Assert(len(records) > 0, Equals, true)
+		c.Assert(records[len(records)-1].Success, Equals, true)
+		c.Assert(records[len(records)-1].FailureReason, Equals, "")
+
+		// records before `since` are left out
+		future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		c.Assert(loginAudit(c, token, "since="+future), HasLen, 0)
+
+		resp, body := proxyGet(c, token, proxy.LoginAuditPath+"?since=yesterday")
+		assertErrorResponse(c, resp, body, 400, types.ErrorCodeBadRequest)
+
+		// the audit trail is admin-only
+		resp, body = proxyGet(c, opsToken(c), proxy.LoginAuditPath)
+		assertErrorResponse(c, resp, body, 403, types.ErrorCodeForbidden)
+	})
+}
+
+// TestCachedLoginAudit tests that logins which fall back to the user's cached
+// LDAP login while the directory is down are marked in the audit trail
+func (s *systemtestSuite) TestCachedLoginAudit(c *C) {
+	username := "cached_ldap_user"
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		writeSettings(c, map[string]string{common.LdapCacheTTLKey: "3600"})
+		reloadSettings(c, token)
+
+		defer func() {
+			writeSettings(c, map[string]string{})
+			reloadSettings(c, token)
+		}()
+
+		// nothing listens on the directory's port, so it's down
+		s.addLdapConfiguration(c, token, `{"server":"127.0.0.1","port":1,"base_dn":"DC=example,DC=com","service_account_dn":"CN=svc,DC=example,DC=com","service_account_password":"svc","start_tls":false,"use_ldaps":false,"insecure_skip_verify":false,"tls_cert_issued_to":"","follow_referrals":false}`)
+		defer s.deleteLdapConfiguration(c, token)
+
+		// as cached by an earlier login, while the directory was up
+		cfg, err := db.GetLdapConfiguration()
+		c.Assert(err, IsNil)
+
+		passwordHash, err := common.GenPasswordHash(username)
+		c.Assert(err, IsNil)
+
+		now := time.Now()
+		c.Assert(db.CacheLdapLogin(&types.LdapCachedLogin{
+			Username:      username,
+			PasswordHash:  passwordHash,
+			DN:            "CN=" + username + ",DC=example,DC=com",
+			ConfigVersion: ldap.ConfigVersion(cfg),
+			CachedAt:      now.Unix(),
+			ExpiresAt:     now.Add(time.Hour).Unix(),
+		}), IsNil)
+
+		since := strconv.FormatInt(now.Unix(), 10)
+		loginAs(c, username, username)
+
+		records := loginAudit(c, token, "since="+since+"&username="+username)
+		c.Assert(records, HasLen, 1)
+		c.Assert(records[0].Success, Equals, true)
+		c.Assert(records[0].CachedAuth, Equals, true)
+
+		// logins which didn't use the cache aren't marked
+		records = loginAudit(c, token, "since="+since+"&username="+adminUsername)
+		c.Assert(len(records) > 0, Equals, true)
+		c.Assert(records[len(records)-1].CachedAuth, Equals, false)
+	})
+}
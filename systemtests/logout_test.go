@@ -0,0 +1,38 @@
+package systemtests
+
+import (
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestLogout tests that tokens are rejected once their user logged out
+func (s *systemtestSuite) TestLogout(c *C) {
+	runTest(func(ms *MockServer) {
+		token := opsToken(c)
+		otherToken := opsToken(c)
+		endpoint := proxy.V1Prefix + "/local_users/" + opsUsername + "/"
+
+		resp, _ := proxyGet(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		resp, body := proxyPost(c, token, proxy.LogoutPath, []byte{})
+		c.Assert(resp.StatusCode, Equals, 204)
+		c.Assert(len(body), Equals, 0)
+
+		// the token no longer works, neither for the proxy's API nor for netmaster
+		resp, body = proxyGet(c, token, endpoint)
+		assertErrorResponse(c, resp, body, 401, types.ErrorCodeTokenRevoked)
+
+		resp, body = proxyGet(c, token, "/api/v1/networks/")
+		assertErrorResponse(c, resp, body, 401, types.ErrorCodeTokenRevoked)
+
+		resp, body = proxyPost(c, token, proxy.LogoutPath, []byte{})
+		assertErrorResponse(c, resp, body, 401, types.ErrorCodeTokenRevoked)
+
+		// other tokens of the same user are unaffected
+		resp, _ = proxyGet(c, otherToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+	})
+}
@@ -0,0 +1,60 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// getMe returns the caller's identity and permissions
+func getMe(c *C, token string) proxy.MeResponse {
+	resp, body := proxyGet(c, token, proxy.MePath)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	me := proxy.MeResponse{}
+	c.Assert(json.Unmarshal(body, &me), IsNil)
+
+	expiresAt, err := time.Parse(time.RFC3339, me.ExpiresAt)
+	c.Assert(err, IsNil)
+	c.Assert(expiresAt.After(time.Now()), Equals, true)
+
+	return me
+}
+
+// TestMe tests that the default admin and ops users are described along with
+// their permissions
+func (s *systemtestSuite) TestMe(c *C) {
+	runTest(func(ms *MockServer) {
+		adminTok := adminToken(c)
+
+		admin := getMe(c, adminTok)
+		c.Assert(admin.PrincipalName, Equals, adminUsername)
+		c.Assert(admin.PrincipalType, Equals, "local")
+		c.Assert(admin.Principals, DeepEquals, []string{adminUsername})
+		c.Assert(admin.Role, Equals, "admin")
+		c.Assert(admin.Tenants, DeepEquals, []proxy.TenantRoleRef{})
+		c.Assert(admin.Attributes, IsNil) // local users have no LDAP attributes
+
+		ops := getMe(c, opsToken(c))
+		c.Assert(ops.PrincipalName, Equals, opsUsername)
+		c.Assert(ops.PrincipalType, Equals, "local")
+		c.Assert(ops.Principals, DeepEquals, []string{opsUsername})
+		c.Assert(ops.Role, Equals, "ops")
+		c.Assert(ops.Tenants, DeepEquals, []proxy.TenantRoleRef{})
+
+		// tenant claims are listed with their roles
+		authz := s.addAuthorization(c, `{"PrincipalName":"`+opsUsername+`","local":true,"role":"ops","tenantName":"`+tenantName+`"}`, adminTok)
+
+		ops = getMe(c, opsToken(c))
+		c.Assert(ops.Tenants, DeepEquals, []proxy.TenantRoleRef{{TenantName: tenantName, Role: "ops"}})
+
+		s.deleteAuthorization(c, authz.AuthzUUID, adminTok)
+
+		ops = getMe(c, opsToken(c))
+		c.Assert(ops.Tenants, DeepEquals, []proxy.TenantRoleRef{})
+	})
+}
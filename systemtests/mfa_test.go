@@ -0,0 +1,115 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/contiv/auth_proxy/auth/local"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// loginWithOTP logs in with a one-time password; it's left out if empty
+func loginWithOTP(c *C, username, password, otp string) (*http.Response, []byte) {
+	credentials := map[string]string{"username": username, "password": password}
+	if otp != "" {
+		credentials["otp"] = otp
+	}
+
+	data, err := json.Marshal(credentials)
+	c.Assert(err, IsNil)
+
+	resp, body, err := insecureJSONBody("", proxy.LoginPath, "POST", data)
+	c.Assert(err, IsNil)
+
+	return resp, body
+}
+
+// currentOTP returns the current one-time password of the given secret
+func currentOTP(c *C, secret string) string {
+	otp, err := local.TOTP(secret, time.Now())
+	c.Assert(err, IsNil)
+
+	return otp
+}
+
+// TestMFA tests enrolling local users for MFA, logging in with a one-time
+// password and admins disabling MFA
+func (s *systemtestSuite) TestMFA(c *C) {
+	runTest(func(ms *MockServer) {
+		adToken := adminToken(c)
+
+		username := "mfa_user"
+		endpoint := proxy.V1Prefix + "/local_users/" + username + "/"
+		userJSON := `{"username":"` + username + `","first_name":"","last_name":"","disable":false}`
+
+		// admins can't enroll users
+		s.addLocalUser(c, `{"username":"`+username+`","password":"`+username+`","mfa_enabled":true,"mfa_secret":"JBSWY3DPEHPK3PXP"}`,
+			userJSON, adToken)
+		defer proxyDelete(c, adToken, endpoint+"?hard=true")
+
+		token := loginAs(c, username, username)
+
+		// confirming requires an enrollment
+		resp, _ := proxyPost(c, token, proxy.MFAConfirmPath, []byte(`{"otp":"123456"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, body := proxyPost(c, token, proxy.MFAEnrollPath, nil)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		enrollment := proxy.MFAEnrollmentReply{}
+		c.Assert(json.Unmarshal(body, &enrollment), IsNil)
+		c.Assert(enrollment.Secret, Not(Equals), "")
+		c.Assert(strings.HasPrefix(enrollment.URL, "otpauth://totp/auth_proxy:"+username+"?"), Equals, true)
+
+		// the secret is never returned, and MFA isn't enabled until it's confirmed
+		resp, body = proxyGet(c, adToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(string(body), Equals, userJSON)
+
+		loginAs(c, username, username)
+
+		for _, data := range []string{`{}`, `{"otp":"abcdef"}`, `not json`} {
+			resp, _ = proxyPost(c, token, proxy.MFAConfirmPath, []byte(data))
+			c.Assert(resp.StatusCode, Equals, 400)
+		}
+
+		resp, _ = proxyPost(c, token, proxy.MFAConfirmPath, []byte(`{"otp":"`+currentOTP(c, enrollment.Secret)+`"}`))
+		c.Assert(resp.StatusCode, Equals, 204)
+
+		resp, _ = proxyPost(c, token, proxy.MFAEnrollPath, nil)
+		c.Assert(resp.StatusCode, Equals, 409)
+
+		// logins need the one-time password now
+		resp, body = loginWithOTP(c, username, username, "")
+		assertErrorResponse(c, resp, body, 401, types.ErrorCodeOTPRequired)
+
+		resp, body = loginWithOTP(c, username, "wrong", "")
+		assertErrorResponse(c, resp, body, 401, types.ErrorCodeInvalidCredentials)
+
+		resp, body = loginWithOTP(c, username, username, "abcdef")
+		assertErrorResponse(c, resp, body, 401, types.ErrorCodeInvalidCredentials)
+
+		resp, _ = loginWithOTP(c, username, username, currentOTP(c, enrollment.Secret))
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		resp, body = proxyGet(c, adToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(string(body), Equals, `{"username":"`+username+`","first_name":"","last_name":"","disable":false,"mfa_enabled":true}`)
+
+		// only admins can disable MFA, and nobody can enable it without enrolling
+		resp, _ = proxyPatch(c, token, endpoint, []byte(`{"mfa_enabled":false}`))
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		resp, _ = proxyPatch(c, adToken, endpoint, []byte(`{"mfa_enabled":true}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		s.updateLocalUser(c, username, `{"mfa_enabled":false}`, userJSON, adToken)
+
+		loginAs(c, username, username)
+	})
+}
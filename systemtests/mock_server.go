@@ -1,8 +1,14 @@
 package systemtests
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/contiv/auth_proxy/common"
@@ -44,11 +50,84 @@ func (ms *MockServer) AddHardcodedResponse(path string, body []byte) {
 	})
 }
 
+// AddErrorResponse registers a HTTP handler func for `path' that returns
+// `statusCode' and `body' with the given content type; `body' may be empty.
+func (ms *MockServer) AddErrorResponse(path string, statusCode int, contentType string, body []byte) {
+	ms.mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.WriteHeader(statusCode)
+		w.Write(body)
+	})
+}
+
 // AddHandler allows adding a custom route handler to our custom ServeMux
 func (ms *MockServer) AddHandler(path string, f func(http.ResponseWriter, *http.Request)) {
 	ms.mux.HandleFunc(path, f)
 }
 
+// AddEchoHandler registers a HTTP handler func for `path' that returns the
+// request's body with the same content type. The Content-Length netmaster
+// received is returned in the X-Received-Content-Length header.
+func (ms *MockServer) AddEchoHandler(path string) {
+	ms.mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+		// net/http doesn't read requests while writing responses, so it's read first
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", req.Header.Get("Content-Type"))
+		w.Header().Set("X-Received-Content-Length", strconv.FormatInt(req.ContentLength, 10))
+		w.Write(data)
+	})
+}
+
+// AddMultipartEchoHandler registers a HTTP handler func for `path' that reads
+// the parts of a multipart/form-data request one at a time and writes them back
+// as a multipart response using the same boundary, which reproduces bodies
+// written by a multipart.Writer byte for byte.
+func (ms *MockServer) AddMultipartEchoHandler(path string) {
+	ms.mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+		reader, err := req.MultipartReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		parts := &bytes.Buffer{}
+		writer := multipart.NewWriter(parts)
+		writer.SetBoundary(strings.TrimPrefix(req.Header.Get("Content-Type"), "multipart/form-data; boundary="))
+
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			echoed, err := writer.CreatePart(part.Header)
+			if err == nil {
+				_, err = io.Copy(echoed, part)
+			}
+
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		writer.Close()
+
+		w.Header().Set("Content-Type", writer.FormDataContentType())
+		w.Write(parts.Bytes())
+	})
+}
+
 // Serve starts the mock server using the custom ServeMux we set up.
 func (ms *MockServer) Serve() {
 	var err error
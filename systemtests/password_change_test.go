@@ -0,0 +1,56 @@
+package systemtests
+
+import (
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestChangePassword tests that local users can change their own password
+// given the old one
+func (s *systemtestSuite) TestChangePassword(c *C) {
+	runTest(func(ms *MockServer) {
+		adToken := adminToken(c)
+
+		username := "password_user"
+		endpoint := proxy.V1Prefix + "/local_users/" + username + "/"
+
+		s.addLocalUser(c, `{"username":"`+username+`","password":"`+username+`"}`,
+			`{"username":"`+username+`","first_name":"","last_name":"","disable":false}`, adToken)
+		defer proxyDelete(c, adToken, endpoint+"?hard=true")
+
+		token := loginAs(c, username, username)
+
+		for _, data := range []string{
+			`{"old_password":"` + username + `"}`,
+			`{"new_password":"new_password"}`,
+			`{"old_password":"` + username + `","new_password":"` + username + `"}`,
+			`not json`,
+		} {
+			resp, _ := proxyPut(c, token, proxy.PasswordPath, []byte(data))
+			c.Assert(resp.StatusCode, Equals, 400)
+		}
+
+		resp, _ := proxyPut(c, token, proxy.PasswordPath, []byte(`{"old_password":"wrong","new_password":"new_password"}`))
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		resp, body := proxyPut(c, token, proxy.PasswordPath, []byte(`{"old_password":"`+username+`","new_password":"new_password"}`))
+		c.Assert(resp.StatusCode, Equals, 204)
+		c.Assert(len(body), Equals, 0)
+
+		_, resp, err := login(username, username)
+		c.Assert(err, IsNil)
+		c.Assert(resp.StatusCode, Equals, 401)
+
+		token = loginAs(c, username, "new_password")
+
+		// the old password no longer works for changing it either
+		resp, _ = proxyPut(c, token, proxy.PasswordPath, []byte(`{"old_password":"`+username+`","new_password":"other_password"}`))
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// admins can still set it without knowing the current one
+		s.updateLocalUser(c, username, `{"password":"`+username+`"}`,
+			`{"username":"`+username+`","first_name":"","last_name":"","disable":false}`, adToken)
+		loginAs(c, username, username)
+	})
+}
@@ -0,0 +1,121 @@
+package systemtests
+
+import (
+	"encoding/json"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/proxy"
+	"github.com/contiv/auth_proxy/state"
+
+	. "gopkg.in/check.v1"
+)
+
+// loginExpiry logs in and returns the full login response
+func loginExpiry(c *C, username, password string) proxy.LoginResponse {
+	data, err := json.Marshal(map[string]string{"username": username, "password": password})
+	c.Assert(err, IsNil)
+
+	resp, body, err := insecureJSONBody("", proxy.LoginPath, "POST", data)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	lr := proxy.LoginResponse{}
+	c.Assert(json.Unmarshal(body, &lr), IsNil)
+	c.Assert(len(lr.Token), Not(Equals), 0)
+
+	return lr
+}
+
+// agePassword pretends that the user's password was changed a long time ago
+func agePassword(c *C, username string) {
+	stateDrv, err := state.GetStateDriver()
+	c.Assert(err, IsNil)
+
+	user, err := db.GetLocalUser(username)
+	c.Assert(err, IsNil)
+
+	user.PasswordChangedAt = 1
+
+	data, err := json.Marshal(user)
+	c.Assert(err, IsNil)
+
+	c.Assert(stateDrv.Write(db.GetPath(db.RootLocalUsers, username), data), IsNil)
+}
+
+// TestPasswordExpiry tests that users with an expired password can only
+// change their password, and that exempt users are never asked to.
+func (s *systemtestSuite) TestPasswordExpiry(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		username := "expiry_user"
+		exemptUsername := "expiry_service"
+		endpoint := proxy.V1Prefix + "/local_users/" + username + "/"
+
+		s.addLocalUser(c, `{"username":"`+username+`","password":"`+username+`"}`,
+			`{"username":"`+username+`","first_name":"","last_name":"","disable":false}`, token)
+		defer proxyDelete(c, token, endpoint+"?hard=true")
+
+		s.addLocalUser(c, `{"username":"`+exemptUsername+`","password":"`+exemptUsername+`","password_expiry_exempt":true}`,
+			`{"username":"`+exemptUsername+`","first_name":"","last_name":"","disable":false,"password_expiry_exempt":true}`, token)
+		defer proxyDelete(c, token, proxy.V1Prefix+"/local_users/"+exemptUsername+"/?hard=true")
+
+		agePassword(c, username)
+		agePassword(c, exemptUsername)
+
+		// nothing expires until a maximum age is configured
+		c.Assert(loginExpiry(c, username, username).PasswordExpired, Equals, false)
+
+		writeSettings(c, map[string]string{common.PasswordMaxAgeKey: "90"})
+		defer func() {
+			writeSettings(c, map[string]string{})
+			reloadSettings(c, adminToken(c))
+		}()
+		reloadSettings(c, token)
+
+		c.Assert(loginExpiry(c, exemptUsername, exemptUsername).PasswordExpired, Equals, false)
+
+		lr := loginExpiry(c, username, username)
+		c.Assert(lr.PasswordExpired, Equals, true)
+
+		// the token is only good for changing the password
+		resp, body := proxyGet(c, lr.Token, endpoint)
+		c.Assert(resp.StatusCode, Equals, 403)
+		c.Assert(string(body), Matches, ".*Password change required.*")
+
+		resp, body = proxyGet(c, lr.Token, proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(string(body), Equals, `{"username":"`+username+`","password_change_only":true}`)
+
+		resp, _ = proxyPatch(c, lr.Token, endpoint, []byte(`{"first_name":"Temp"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		// users can't exempt themselves
+		resp, _ = proxyPatch(c, lr.Token, endpoint, []byte(`{"password":"new_password","password_expiry_exempt":true}`))
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		resp, _ = proxyPatch(c, lr.Token, endpoint, []byte(`{"password":"new_password"}`))
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// the new password hasn't expired
+		lr = loginExpiry(c, username, "new_password")
+		c.Assert(lr.PasswordExpired, Equals, false)
+
+		resp, _ = proxyGet(c, lr.Token, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// admins can exempt users
+		agePassword(c, username)
+		c.Assert(loginExpiry(c, username, "new_password").PasswordExpired, Equals, true)
+
+		s.updateLocalUser(c, username, `{"password_expiry_exempt":true}`,
+			`{"username":"`+username+`","first_name":"","last_name":"","disable":false,"password_expiry_exempt":true}`, token)
+		c.Assert(loginExpiry(c, username, "new_password").PasswordExpired, Equals, false)
+
+		user, err := db.GetLocalUser(username)
+		c.Assert(err, IsNil)
+		c.Assert(user.PasswordExpiryExempt, Equals, true)
+		c.Assert(user.PasswordChangedAt, Equals, int64(1))
+	})
+}
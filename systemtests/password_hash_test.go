@@ -0,0 +1,78 @@
+package systemtests
+
+import (
+	"encoding/json"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/proxy"
+	"github.com/contiv/auth_proxy/state"
+
+	"golang.org/x/crypto/bcrypt"
+	. "gopkg.in/check.v1"
+)
+
+// passwordHashCost returns the cost of the user's stored password hash
+func passwordHashCost(c *C, username string) int {
+	user, err := db.GetLocalUser(username)
+	c.Assert(err, IsNil)
+
+	cost, err := bcrypt.Cost(user.PasswordHash)
+	c.Assert(err, IsNil)
+
+	return cost
+}
+
+// TestPasswordHashUpgrade tests that hashes with a lower cost than the
+// configured one still authenticate and are upgraded on login
+func (s *systemtestSuite) TestPasswordHashUpgrade(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		username := "hash_user"
+		endpoint := proxy.V1Prefix + "/local_users/" + username + "/"
+
+		s.addLocalUser(c, `{"username":"`+username+`","password":"`+username+`"}`,
+			`{"username":"`+username+`","first_name":"","last_name":"","disable":false}`, token)
+		defer proxyDelete(c, token, endpoint+"?hard=true")
+
+		// pretend the user was created back when the cost was lower
+		user, err := db.GetLocalUser(username)
+		c.Assert(err, IsNil)
+
+		user.PasswordHash, err = bcrypt.GenerateFromPassword([]byte(username), bcrypt.MinCost)
+		c.Assert(err, IsNil)
+
+		data, err := json.Marshal(user)
+		c.Assert(err, IsNil)
+
+		stateDrv, err := state.GetStateDriver()
+		c.Assert(err, IsNil)
+		c.Assert(stateDrv.Write(db.GetPath(db.RootLocalUsers, username), data), IsNil)
+
+		writeSettings(c, map[string]string{common.PasswordHashCostKey: "5"})
+		defer func() {
+			writeSettings(c, map[string]string{})
+			reloadSettings(c, adminToken(c))
+		}()
+		reloadSettings(c, token)
+
+		c.Assert(passwordHashCost(c, username), Equals, bcrypt.MinCost)
+
+		// the old hash authenticates and is replaced right away
+		loginAs(c, username, username)
+		c.Assert(passwordHashCost(c, username), Equals, 5)
+
+		upgraded, err := db.GetLocalUser(username)
+		c.Assert(err, IsNil)
+		c.Assert(upgraded.PasswordChangedAt, Equals, user.PasswordChangedAt)
+
+		loginAs(c, username, username)
+		c.Assert(passwordHashCost(c, username), Equals, 5)
+
+		// new passwords are hashed with the configured cost too
+		s.updateLocalUser(c, username, `{"password":"new_password"}`,
+			`{"username":"`+username+`","first_name":"","last_name":"","disable":false}`, token)
+		c.Assert(passwordHashCost(c, username), Equals, 5)
+	})
+}
@@ -0,0 +1,64 @@
+package systemtests
+
+import (
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestPasswordPolicy tests that new local user passwords have to follow the password policy
+func (s *systemtestSuite) TestPasswordPolicy(c *C) {
+	runTest(func(ms *MockServer) {
+		adToken := adminToken(c)
+
+		username := "policy_user"
+		endpoint := proxy.V1Prefix + "/local_users/" + username + "/"
+
+		// created before the policy applies
+		s.addLocalUser(c, `{"username":"`+username+`","password":"`+username+`"}`,
+			`{"username":"`+username+`","first_name":"","last_name":"","disable":false}`, adToken)
+		defer proxyDelete(c, adToken, endpoint+"?hard=true")
+
+		writeSettings(c, map[string]string{
+			common.PasswordMinLengthKey:        "10",
+			common.PasswordRequireDigitKey:     "true",
+			common.PasswordRequireMixedCaseKey: "true",
+			common.PasswordRejectUsernameKey:   "true",
+		})
+		defer func() {
+			writeSettings(c, map[string]string{})
+			reloadSettings(c, adToken)
+		}()
+		reloadSettings(c, adToken)
+
+		// new users
+		resp, body := proxyPost(c, adToken, proxy.V1Prefix+"/local_users/", []byte(`{"username":"weak_user","password":"weak"}`))
+		errResp := assertErrorResponse(c, resp, body, 400, types.ErrorCodePasswordPolicy)
+		c.Assert(errResp.Details, HasLen, 3)
+		c.Assert(errResp.Details[common.PasswordRuleMinLength], Not(Equals), "")
+
+		// updates
+		resp, body = proxyPatch(c, adToken, endpoint, []byte(`{"password":"`+username+`"}`))
+		errResp = assertErrorResponse(c, resp, body, 400, types.ErrorCodePasswordPolicy)
+		c.Assert(errResp.Details[common.PasswordRuleUsername], Not(Equals), "")
+
+		// updates which leave the password alone aren't affected
+		s.updateLocalUser(c, username, `{"first_name":"Policy"}`,
+			`{"username":"`+username+`","first_name":"Policy","last_name":"","disable":false}`, adToken)
+
+		// password changes
+		token := loginAs(c, username, username)
+
+		resp, body = proxyPut(c, token, proxy.PasswordPath, []byte(`{"old_password":"`+username+`","new_password":"alllowercase1"}`))
+		errResp = assertErrorResponse(c, resp, body, 400, types.ErrorCodePasswordPolicy)
+		c.Assert(errResp.Details, HasLen, 1)
+		c.Assert(errResp.Details[common.PasswordRuleMixedCase], Not(Equals), "")
+
+		resp, _ = proxyPut(c, token, proxy.PasswordPath, []byte(`{"old_password":"`+username+`","new_password":"Strong-Passw0rd"}`))
+		c.Assert(resp.StatusCode, Equals, 204)
+
+		loginAs(c, username, "Strong-Passw0rd")
+	})
+}
@@ -0,0 +1,70 @@
+package systemtests
+
+import (
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestPasswordReset tests that users whose password has to be reset can only
+// change their password, and that changing it clears the flag.
+func (s *systemtestSuite) TestPasswordReset(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		username := "reset_user"
+		endpoint := proxy.V1Prefix + "/local_users/" + username + "/"
+
+		// provisioned with a temporary password
+		s.addLocalUser(c, `{"username":"`+username+`","password":"temporary","password_reset_required":true}`,
+			`{"username":"`+username+`","first_name":"","last_name":"","disable":false,"password_reset_required":true}`, token)
+		defer proxyDelete(c, token, endpoint+"?hard=true")
+
+		lr := loginExpiry(c, username, "temporary")
+		c.Assert(lr.PasswordResetRequired, Equals, true)
+		c.Assert(lr.PasswordExpired, Equals, false)
+		c.Assert(lr.Role, Equals, "")
+
+		// the token is only good for changing the password
+		resp, body := proxyGet(c, lr.Token, endpoint)
+		assertErrorResponse(c, resp, body, 403, types.ErrorCodePasswordChangeRequired)
+
+		resp, _ = proxyPut(c, lr.Token, proxy.PasswordPath, []byte(`{"old_password":"temporary","new_password":"chosen_password"}`))
+		c.Assert(resp.StatusCode, Equals, 204)
+
+		user, err := db.GetLocalUser(username)
+		c.Assert(err, IsNil)
+		c.Assert(user.PasswordResetRequired, Equals, false)
+
+		lr = loginExpiry(c, username, "chosen_password")
+		c.Assert(lr.PasswordResetRequired, Equals, false)
+		c.Assert(lr.PasswordExpired, Equals, false)
+
+		resp, _ = proxyGet(c, lr.Token, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// admins can require a reset of existing users, who can't lift it themselves
+		resp, _ = proxyPatch(c, lr.Token, endpoint, []byte(`{"password_reset_required":true}`))
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		s.updateLocalUser(c, username, `{"password":"temporary","password_reset_required":true}`,
+			`{"username":"`+username+`","first_name":"","last_name":"","disable":false,"password_reset_required":true}`, token)
+
+		lr = loginExpiry(c, username, "temporary")
+		c.Assert(lr.PasswordResetRequired, Equals, true)
+
+		resp, _ = proxyPatch(c, lr.Token, endpoint, []byte(`{"password":"other_password","password_reset_required":false}`))
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// setting a new password through the user endpoint clears it as well
+		resp, body = proxyPatch(c, lr.Token, endpoint, []byte(`{"password":"other_password"}`))
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(string(body), Equals, `{"username":"`+username+`","first_name":"","last_name":"","disable":false}`)
+
+		lr = loginExpiry(c, username, "other_password")
+		c.Assert(lr.PasswordResetRequired, Equals, false)
+		c.Assert(lr.Role, Not(Equals), "")
+	})
+}
@@ -0,0 +1,83 @@
+package systemtests
+
+import (
+	"time"
+
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestPurgePrincipal tests purging all the state of a departed principal
+func (s *systemtestSuite) TestPurgePrincipal(c *C) {
+	purgeUser := "purge_user"
+	endpoint := proxy.V1Prefix + "/principals/" + purgeUser + "/"
+
+	s.addUser(c, purgeUser)
+
+	userToken := ""
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		for _, tenant := range []string{"t1", "t2"} {
+			s.addAuthorization(c, `{"principalName":"`+purgeUser+`","local":true,"role":"ops","tenantName":"`+tenant+`"}`, token)
+		}
+
+		userToken = loginAs(c, purgeUser, purgeUser)
+
+		resp, _ := proxyGet(c, userToken, proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// purging has to be asked for explicitly and is admin-only
+		resp, _ = proxyDelete(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyDelete(c, userToken, endpoint+"?purge=true")
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		resp, _ = proxyDelete(c, token, proxy.V1Prefix+"/principals/"+adminUsername+"/?purge=true")
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, body := proxyDelete(c, token, endpoint+"?purge=true")
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(string(body), Equals, `{"principal":"`+purgeUser+`","local_user":1,"authorizations":2,"tokens_revoked":true,"cached_logins":0,"sessions":1,"access_tokens":0,"audit_records":1}`)
+
+		// every keyspace is clean
+		resp, _ = proxyGet(c, token, proxy.V1Prefix+"/local_users/"+purgeUser+"/")
+		c.Assert(resp.StatusCode, Equals, 404)
+
+		authzs, err := db.ListAuthorizationsByPrincipal(purgeUser)
+		c.Assert(err, IsNil)
+		c.Assert(authzs, HasLen, 0)
+
+		records, err := db.ListLoginAuditRecords()
+		c.Assert(err, IsNil)
+		for _, record := range records {
+			c.Assert(record.Username, Not(Equals), purgeUser)
+		}
+
+		// the token is dead
+		resp, _ = proxyGet(c, userToken, proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, 401)
+
+		// purging again is harmless
+		resp, body = proxyDelete(c, token, endpoint+"?purge=true")
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(string(body), Equals, `{"principal":"`+purgeUser+`","local_user":0,"authorizations":0,"tokens_revoked":true,"cached_logins":0,"sessions":0,"access_tokens":0,"audit_records":0}`)
+	})
+
+	// the old token stays dead when the name is reused; new tokens work
+	// (tokens issued in the second of the purge are revoked as well)
+	time.Sleep(1100 * time.Millisecond)
+	s.addUser(c, purgeUser)
+
+	runTest(func(ms *MockServer) {
+		resp, _ := proxyGet(c, userToken, proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, 401)
+
+		resp, _ = proxyGet(c, loginAs(c, purgeUser, purgeUser), proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+	})
+}
@@ -1,6 +1,7 @@
 package systemtests
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -107,6 +108,45 @@ func (s *systemtestSuite) TestRBACFilters(c *C) {
 	})
 }
 
+// TestRBACFiltersMultiTenant tests that the lists of every tenant-scoped
+// netmaster resource only keep the objects of the user's tenants, and that
+// lists whose objects don't all name their tenant are denied
+func (s *systemtestSuite) TestRBACFiltersMultiTenant(c *C) {
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		networks := netmasterPayload(c, "networks.json")
+		ms.AddHardcodedResponse("/api/v1/networks/", networks)
+		ms.AddHardcodedResponse("/api/v1/appProfiles/", netmasterPayload(c, "appProfiles.json"))
+		ms.AddHardcodedResponse("/api/v1/rules/", []byte(`[{"tenantName":"t1","ruleId":"1"},{"ruleId":"2"}]`))
+
+		authz := s.addAuthorization(c, `{"PrincipalName":"`+username+`","local":true,"role":"ops","tenantName":"t1"}`, adToken)
+		userToken := loginAs(c, username, username)
+
+		// admins still see every tenant's objects
+		resp, body := proxyGet(c, adToken, "/api/v1/networks/")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(body, DeepEquals, networks)
+
+		for _, resource := range []string{"networks", "appProfiles"} {
+			resp, body = proxyGet(c, userToken, "/api/v1/"+resource+"/")
+			c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+			objects := []map[string]interface{}{}
+			c.Assert(json.Unmarshal(body, &objects), IsNil)
+			c.Assert(len(objects) > 0, Equals, true)
+			for _, object := range objects {
+				c.Assert(object["tenantName"], Equals, "t1")
+			}
+		}
+
+		resp, body = proxyGet(c, userToken, "/api/v1/rules/")
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		s.deleteAuthorization(c, authz.AuthzUUID, adToken)
+	})
+}
+
 // TestRBACOnDELETERequest tests netmaster DELETE endpoints
 func (s *systemtestSuite) TestRBACOnDELETERequest(c *C) {
 	s.addUser(c, username)
@@ -378,8 +418,12 @@ func (s *systemtestSuite) TestRBACOnGlobalEndpoint(c *C) {
 
 		// test /inspect/globals/global/
 		endpoint := "/api/v1/inspect/globals/global/"
-		respData := `{"foo":"bar"}`
+		respData := `{"Config":{"key":"global","name":"global"},"Oper":{"numNetworks":1}}`
 		ms.AddHardcodedResponse(endpoint, []byte(respData))
+		ms.AddHardcodedResponse("/api/v1/networks/", []byte(`[{"networkName":"n1","tenantName":"t1"}]`))
+
+		// users without tenants see the settings but none of the networks
+		filteredData := `{"Config":{"key":"global","name":"global"},"Oper":{}}`
 
 		// test using admin token
 		resp, body := proxyGet(c, adToken, endpoint)
@@ -389,13 +433,13 @@ func (s *systemtestSuite) TestRBACOnGlobalEndpoint(c *C) {
 		// test using local `testUsr` token
 		resp, body = proxyGet(c, userToken, endpoint)
 		c.Assert(resp.StatusCode, Equals, 200)
-		c.Assert(string(body), DeepEquals, string(respData))
+		c.Assert(string(body), DeepEquals, filteredData)
 
 		// test using ldap user
 		s.addLdapConfiguration(c, adToken, s.getRunningLdapConfig(true))
 		resp, body = proxyGet(c, loginAs(c, ldapTestUsername, ldapPassword), endpoint)
 		c.Assert(resp.StatusCode, Equals, 200)
-		c.Assert(string(body), DeepEquals, string(respData))
+		c.Assert(string(body), DeepEquals, filteredData)
 		s.deleteLdapConfiguration(c, adToken)
 
 	})
@@ -572,10 +616,10 @@ func (s *systemtestSuite) addUser(c *C, username string) {
 	runTest(func(ms *MockServer) {
 		adToken = adminToken(c)
 
+		// the user may exist or be soft-deleted from a previous test
 		endpoint := proxy.V1Prefix + "/local_users/" + username + "/"
-		resp, _ := proxyGet(c, adToken, endpoint)
-		if resp.StatusCode == 200 {
-			resp, body := proxyDelete(c, adToken, endpoint)
+		resp, body := proxyDelete(c, adToken, endpoint+"?hard=true")
+		if resp.StatusCode != 404 {
 			c.Assert(resp.StatusCode, Equals, 204)
 			c.Assert(body, DeepEquals, []byte{})
 		}
@@ -588,46 +632,66 @@ func (s *systemtestSuite) addUser(c *C, username string) {
 }
 
 // processListResponse constructs the expected response body with the given
-// params and checks it against the actual response body
+// params and checks it against the actual response body; the objects of the
+// expected tenants are returned as netmaster sent them.
 func (s *systemtestSuite) processListResponse(c *C, resource, body string, expectedTenants []string) {
-
 	expectedResponse := []string{}
-	switch resource {
-	case "tenants":
-		for _, tenantName := range expectedTenants {
-			expectedResponse = append(expectedResponse, `{"tenantName":"`+tenantName+`","link-sets":{}}`)
-		}
-		c.Assert(body, DeepEquals, "["+strings.Join(expectedResponse, ",")+"]")
-	case "networks", "policys", "appProfiles", "netprofiles":
-		for _, tenantName := range expectedTenants {
-			expectedResponse = append(expectedResponse, `{"tenantName":"`+tenantName+`","link-sets":{},"links":{"Tenant":{}}}`)
-		}
-		c.Assert(body, DeepEquals, "["+strings.Join(expectedResponse, ",")+"]")
-	case "endpointGroups":
-		for _, tenantName := range expectedTenants {
-			expectedResponse = append(expectedResponse, `{"tenantName":"`+tenantName+`","link-sets":{},"links":{"AppProfile":{},"NetProfile":{},"Network":{},"Tenant":{}}}`)
-		}
-		c.Assert(body, DeepEquals, "["+strings.Join(expectedResponse, ",")+"]")
-	case "rules":
-		for _, tenantName := range expectedTenants {
-			expectedResponse = append(expectedResponse, `{"tenantName":"`+tenantName+`","link-sets":{},"links":{"MatchEndpointGroup":{}}}`)
-		}
-		c.Assert(body, DeepEquals, "["+strings.Join(expectedResponse, ",")+"]")
-	case "serviceLBs":
-		for _, tenantName := range expectedTenants {
-			expectedResponse = append(expectedResponse, `{"tenantName":"`+tenantName+`","links":{"Network":{},"Tenant":{}}}`)
-		}
-		c.Assert(body, DeepEquals, "["+strings.Join(expectedResponse, ",")+"]")
-	default:
-		c.Assert(body, DeepEquals, "[]")
+	for _, tenantName := range expectedTenants {
+		expectedResponse = append(expectedResponse, `{"tenantName":"`+tenantName+`"}`)
 	}
 
+	c.Assert(body, DeepEquals, "["+strings.Join(expectedResponse, ",")+"]", Commentf("resource %s", resource))
 }
 
 // assertInsufficientPrivileges helper function that asserts 403
 func (s *systemtestSuite) assertInsufficientPrivileges(c *C, resp *http.Response, body []byte) {
-	c.Assert(resp.StatusCode, Equals, 403)
-	c.Assert(string(body), DeepEquals, `{"error":"Insufficient privileges"}`)
+	errResp := assertErrorResponse(c, resp, body, 403, types.ErrorCodeForbidden)
+	c.Assert(errResp.Message, Equals, "Insufficient privileges")
+}
+
+// TestLdapGroupRoles tests granting base roles to LDAP groups through the LDAP
+// configuration instead of authorizations
+func (s *systemtestSuite) TestLdapGroupRoles(c *C) {
+	runTest(func(ms *MockServer) {
+		s.addLdapConfiguration(c, adToken, s.getRunningLdapConfig(true))
+
+		for _, data := range []string{
+			`{"group_roles":{"NetAdmins":"admin"}}`,
+			`{"group_roles":{"` + ldapGroupDN + `":"root"}}`,
+			`{"group_roles":{"` + ldapGroupDN + `":"admin","` + strings.ToLower(ldapGroupDN) + `":"ops"}}`,
+		} {
+			resp, _ := proxyPatch(c, adToken, proxy.V1Prefix+"/ldap_configuration/", []byte(data))
+			c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+		}
+
+		endpoint := "/api/v1/globals/"
+		respData := `{"foo":"bar"}`
+		ms.AddHardcodedResponse(endpoint, []byte(respData))
+
+		userToken := loginAs(c, ldapTestUsername, ldapPassword)
+		resp, body := proxyGet(c, userToken, endpoint)
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		s.updateLdapConfiguration(c, adToken, `{"group_roles":{"`+ldapGroupDN+`":"admin"}}`)
+
+		// the mapping applies from the next login on
+		resp, body = proxyGet(c, userToken, endpoint)
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		c.Assert(loginExpiry(c, ldapTestUsername, ldapPassword).Role, Equals, types.Admin.String())
+
+		userToken = loginAs(c, ldapTestUsername, ldapPassword)
+		resp, body = proxyGet(c, userToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(string(body), DeepEquals, respData)
+
+		// an empty mapping removes it
+		s.updateLdapConfiguration(c, adToken, `{"group_roles":{}}`)
+		resp, body = proxyGet(c, loginAs(c, ldapTestUsername, ldapPassword), endpoint)
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		s.deleteLdapConfiguration(c, adToken)
+	})
 }
 
 // TestAdminRoleRequired tests that a user can only perform an admin level API
@@ -0,0 +1,162 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/contiv/auth_proxy/auth"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// listSessions returns the sessions visible to the owner of the given token, by ID
+func listSessions(c *C, token string) map[string]types.Session {
+	resp, body := proxyGet(c, token, proxy.SessionsPath)
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	sessions := []types.Session{}
+	c.Assert(json.Unmarshal(body, &sessions), IsNil)
+
+	byID := map[string]types.Session{}
+	for _, session := range sessions {
+		byID[session.ID] = session
+	}
+
+	return byID
+}
+
+// tokenID returns the unique ID of the given token
+func tokenID(c *C, tokenStr string) string {
+	token, err := auth.ParseToken(tokenStr)
+	c.Assert(err, IsNil)
+
+	return token.ID()
+}
+
+// TestSessions tests listing and revoking the sessions of logged in users
+func (s *systemtestSuite) TestSessions(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		opsTok := opsToken(c)
+		otherOpsTok := opsToken(c)
+
+		adminID, opsID, otherOpsID := tokenID(c, token), tokenID(c, opsTok), tokenID(c, otherOpsTok)
+
+		// admins see everyone's sessions
+		sessions := listSessions(c, token)
+		c.Assert(sessions[adminID].Username, Equals, adminUsername)
+		c.Assert(sessions[opsID].Username, Equals, opsUsername)
+		c.Assert(sessions[opsID].Principals, DeepEquals, []string{opsUsername})
+		c.Assert(sessions[opsID].SourceIP, Not(Equals), "")
+		c.Assert(sessions[opsID].ExpiresAt > time.Now().Unix(), Equals, true)
+
+		// everyone else only sees their own
+		sessions = listSessions(c, opsTok)
+		c.Assert(sessions[opsID].ID, Equals, opsID)
+		c.Assert(sessions[otherOpsID].ID, Equals, otherOpsID)
+
+		for _, session := range sessions {
+			c.Assert(session.Username, Equals, opsUsername)
+		}
+
+		// ...and can't revoke other users' sessions
+		resp, body := proxyDelete(c, opsTok, proxy.SessionsPath+adminID+"/")
+		assertErrorResponse(c, resp, body, 404, types.ErrorCodeNotFound)
+
+		resp, body = proxyDelete(c, token, proxy.SessionsPath+"unknown/")
+		assertErrorResponse(c, resp, body, 404, types.ErrorCodeNotFound)
+
+		// revoked sessions are gone and their tokens no longer work
+		resp, _ = proxyDelete(c, token, proxy.SessionsPath+opsID+"/")
+		c.Assert(resp.StatusCode, Equals, 204)
+
+		resp, body = proxyGet(c, opsTok, proxy.WhoamiPath)
+		assertErrorResponse(c, resp, body, 401, types.ErrorCodeTokenRevoked)
+
+		_, found := listSessions(c, token)[opsID]
+		c.Assert(found, Equals, false)
+
+		// logging out ends the session as well
+		resp, _ = proxyPost(c, otherOpsTok, proxy.LogoutPath, []byte{})
+		c.Assert(resp.StatusCode, Equals, 204)
+
+		_, found = listSessions(c, token)[otherOpsID]
+		c.Assert(found, Equals, false)
+
+		// expired sessions are skipped and deleted
+		c.Assert(db.AddSession(&types.Session{ID: "expired", Username: opsUsername, ExpiresAt: time.Now().Unix() - 1}), IsNil)
+
+		_, found = listSessions(c, token)["expired"]
+		c.Assert(found, Equals, false)
+
+		_, err := db.GetSession("expired")
+		c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+	})
+}
+
+// TestRevokeUserSessions tests revoking all the tokens of a user, explicitly
+// and by deleting the user
+func (s *systemtestSuite) TestRevokeUserSessions(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		username := "offboarded_user"
+		endpoint := proxy.V1Prefix + "/local_users/" + username + "/"
+
+		s.addLocalUser(c, `{"username":"`+username+`","password":"`+username+`"}`,
+			`{"username":"`+username+`","first_name":"","last_name":"","disable":false}`, token)
+		defer proxyDelete(c, token, endpoint+"?hard=true")
+
+		userToken := loginAs(c, username, username)
+		otherUserToken := loginAs(c, username, username)
+
+		// admin-only
+		resp, _ := proxyDelete(c, opsToken(c), proxy.SessionsPath+"?username="+username)
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		resp, body := proxyDelete(c, token, proxy.SessionsPath)
+		assertErrorResponse(c, resp, body, 400, types.ErrorCodeBadRequest)
+
+		resp, body = proxyDelete(c, token, proxy.SessionsPath+"?username="+username)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		reply := proxy.RevokeSessionsReply{}
+		c.Assert(json.Unmarshal(body, &reply), IsNil)
+		c.Assert(reply.Username, Equals, username)
+		c.Assert(reply.Sessions, Equals, 2)
+
+		for _, tokenStr := range []string{userToken, otherUserToken} {
+			resp, body = proxyGet(c, tokenStr, proxy.WhoamiPath)
+			assertErrorResponse(c, resp, body, 401, types.ErrorCodeTokenRevoked)
+
+			_, found := listSessions(c, token)[tokenID(c, tokenStr)]
+			c.Assert(found, Equals, false)
+		}
+
+		// the user can log in again; sleep so that the new token isn't issued
+		// in the same second as the revocation
+		time.Sleep(time.Second)
+		userToken = loginAs(c, username, username)
+
+		resp, _ = proxyGet(c, userToken, proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// deleting the user cuts off its access right away...
+		resp, _ = proxyDelete(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, 204)
+
+		resp, body = proxyGet(c, userToken, proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, 401, Commentf("%s", body))
+
+		// ...and restoring it doesn't bring its tokens back
+		resp, _ = proxyPost(c, token, endpoint+"restore/", nil)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		resp, body = proxyGet(c, userToken, proxy.WhoamiPath)
+		assertErrorResponse(c, resp, body, 401, types.ErrorCodeTokenRevoked)
+	})
+}
@@ -0,0 +1,136 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/proxy"
+	"github.com/contiv/auth_proxy/state"
+
+	. "gopkg.in/check.v1"
+)
+
+// writeSettings stores the given globals in the data store
+func writeSettings(c *C, settings map[string]string) {
+	stateDrv, err := state.GetStateDriver()
+	c.Assert(err, IsNil)
+
+	data, err := json.Marshal(settings)
+	c.Assert(err, IsNil)
+
+	c.Assert(stateDrv.Write(db.GetPath(db.RootSettings), data), IsNil)
+}
+
+// reloadSettings asks the proxy to reload its settings and returns the result
+func reloadSettings(c *C, token string) *common.ReloadResult {
+	resp, body := proxyPost(c, token, proxy.ReloadPath, []byte{})
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	result := &common.ReloadResult{}
+	c.Assert(json.Unmarshal(body, result), IsNil)
+
+	return result
+}
+
+// TestSettingsReload tests that settings stored in the data store are applied
+// by the reload endpoint without restarting the proxy.
+func (s *systemtestSuite) TestSettingsReload(c *C) {
+	runTest(func(ms *MockServer) {
+		endpoint := "/api/v1/networks/"
+
+		ms.AddHandler(endpoint, func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(2 * time.Second)
+			w.Write([]byte("[]"))
+		})
+
+		token := adminToken(c)
+
+		// only admins can reload the settings
+		resp, body := proxyPost(c, opsToken(c), proxy.ReloadPath, []byte{})
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		resp, _ = proxyGet(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// lower the upstream timeout below the handler's delay
+		writeSettings(c, map[string]string{
+			common.LogLevelKey:         "debug",
+			common.NetmasterTimeoutKey: "1",
+			common.ListenAddressKey:    ":12345",
+		})
+		defer writeSettings(c, map[string]string{})
+
+		result := reloadSettings(c, token)
+		c.Assert(result.Changed, DeepEquals, []string{common.LogLevelKey, common.NetmasterTimeoutKey})
+		c.Assert(result.Ignored, DeepEquals, map[string]string{common.ListenAddressKey: common.RestartRequired})
+
+		resp, body = proxyGet(c, token, endpoint)
+		assertErrorResponse(c, resp, body, 504, types.ErrorCodeUpstreamTimeout)
+
+		// invalid settings are rejected and the current ones are kept
+		writeSettings(c, map[string]string{common.NetmasterTimeoutKey: "-1"})
+
+		resp, _ = proxyPost(c, token, proxy.ReloadPath, []byte{})
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyGet(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, 504)
+
+		// back to the original timeout
+		writeSettings(c, map[string]string{})
+		reloadSettings(c, token)
+
+		resp, _ = proxyGet(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+	})
+}
+
+// TestConcurrentLoginsDuringReload tests that logins keep working while the
+// settings are being reloaded
+func (s *systemtestSuite) TestConcurrentLoginsDuringReload(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		writeSettings(c, map[string]string{common.LogLevelKey: "debug"})
+		defer writeSettings(c, map[string]string{})
+
+		// the goroutines can't use c.Assert(), so the status codes are collected instead
+		const logins = 10
+		statusCodes := make(chan int, logins)
+
+		var wg sync.WaitGroup
+		for i := 0; i < logins; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				_, resp, err := login(adminUsername, adminPassword)
+				if err != nil {
+					statusCodes <- 0
+					return
+				}
+
+				statusCodes <- resp.StatusCode
+			}()
+		}
+
+		for i := 0; i < 5; i++ {
+			reloadSettings(c, token)
+		}
+
+		wg.Wait()
+		close(statusCodes)
+
+		for statusCode := range statusCodes {
+			c.Assert(statusCode, Equals, 200)
+		}
+
+		writeSettings(c, map[string]string{})
+		reloadSettings(c, token)
+	})
+}
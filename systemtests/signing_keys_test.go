@@ -0,0 +1,80 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/contiv/auth_proxy/auth"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// listSigningKeys returns the token signing keys listed by the proxy
+func listSigningKeys(c *C, token string) proxy.SigningKeysReply {
+	resp, body := proxyGet(c, token, proxy.SigningKeysPath)
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	reply := proxy.SigningKeysReply{}
+	c.Assert(json.Unmarshal(body, &reply), IsNil)
+
+	return reply
+}
+
+// TestSigningKeyRotation tests that tokens signed with the previous signing key
+// are accepted after a rotation until the key is retired
+func (s *systemtestSuite) TestSigningKeyRotation(c *C) {
+	runTest(func(ms *MockServer) {
+		endpoint := proxy.V1Prefix + "/authorizations/"
+
+		oldToken := adminToken(c)
+		oldKey := listSigningKeys(c, oldToken).Current
+
+		// only admins can see and rotate the keys
+		resp, _ := proxyGet(c, opsToken(c), proxy.SigningKeysPath)
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		resp, body := proxyPost(c, oldToken, proxy.SigningKeysPath, []byte{})
+		c.Assert(resp.StatusCode, Equals, 201)
+
+		keys := proxy.SigningKeysReply{}
+		c.Assert(json.Unmarshal(body, &keys), IsNil)
+		c.Assert(keys.Current, Not(Equals), oldKey)
+
+		found := false
+		for _, retired := range keys.Retired {
+			if retired.ID == oldKey {
+				found = true
+				// the proxy runs with the default token TTL
+				c.Assert(retired.ExpiresAt-retired.RetiredAt, Equals, int64(auth.TokenValidityInHours*time.Hour/time.Second))
+			}
+		}
+		c.Assert(found, Equals, true)
+
+		// tokens signed with either key are accepted during the overlap
+		newToken := adminToken(c)
+
+		resp, _ = proxyGet(c, oldToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		resp, _ = proxyGet(c, newToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		resp, _ = proxyDelete(c, newToken, proxy.SigningKeysPath+keys.Current+"/")
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyDelete(c, newToken, proxy.SigningKeysPath+"unknown/")
+		c.Assert(resp.StatusCode, Equals, 404)
+
+		// retiring the old key early invalidates its tokens
+		resp, _ = proxyDelete(c, newToken, proxy.SigningKeysPath+oldKey+"/")
+		c.Assert(resp.StatusCode, Equals, 204)
+
+		resp, body = proxyGet(c, oldToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, 400)
+		c.Assert(string(body), Matches, ".*Bad token.*")
+
+		resp, _ = proxyGet(c, newToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+	})
+}
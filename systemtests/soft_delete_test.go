@@ -0,0 +1,110 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// listLocalUsers returns the names of the listed local users along with their deletion time
+func listLocalUsers(c *C, token, query string) map[string]int64 {
+	resp, body := proxyGet(c, token, proxy.V1Prefix+"/local_users/"+query)
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	users := []types.LocalUser{}
+	c.Assert(json.Unmarshal(body, &users), IsNil)
+
+	listed := map[string]int64{}
+	for _, user := range users {
+		listed[user.Username] = user.DeletedAt
+	}
+
+	return listed
+}
+
+// TestLocalUserSoftDelete tests that deleted users can be restored along with
+// their authorizations until they're deleted permanently
+func (s *systemtestSuite) TestLocalUserSoftDelete(c *C) {
+	deletedUser := "soft_deleted_user"
+	endpoint := proxy.V1Prefix + "/local_users/" + deletedUser + "/"
+
+	s.addUser(c, deletedUser)
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		for _, tenant := range []string{"t1", "t2"} {
+			s.addAuthorization(c, `{"principalName":"`+deletedUser+`","local":true,"role":"ops","tenantName":"`+tenant+`"}`, token)
+		}
+
+		userToken := loginAs(c, deletedUser, deletedUser)
+
+		// delete the user; it's hidden and can't log in, but its authorizations are kept
+		resp, body := proxyDelete(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+		c.Assert(len(body), Equals, 0)
+
+		resp, body = proxyGet(c, token, endpoint)
+		assertErrorResponse(c, resp, body, http.StatusNotFound, types.ErrorCodeNotFound)
+
+		_, found := listLocalUsers(c, token, "")[deletedUser]
+		c.Assert(found, Equals, false)
+		c.Assert(listLocalUsers(c, token, "?include_deleted=true")[deletedUser], Not(Equals), int64(0))
+
+		resp, body = proxyGet(c, userToken, proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+
+		loginToken, resp, err := login(deletedUser, deletedUser)
+		c.Assert(err, IsNil)
+		c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+		c.Assert(len(loginToken), Equals, 0)
+
+		authzs, err := db.ListAuthorizationsByPrincipal(deletedUser)
+		c.Assert(err, IsNil)
+		c.Assert(authzs, HasLen, 2)
+
+		// the name can't be reused while the deleted user exists
+		resp, body = proxyPost(c, token, proxy.V1Prefix+"/local_users/",
+			[]byte(`{"username":"`+deletedUser+`","password":"`+deletedUser+`"}`))
+		errResp := assertErrorResponse(c, resp, body, http.StatusConflict, types.ErrorCodeConflict)
+		c.Assert(errResp.Message, Matches, ".*restore.*hard=true.*")
+
+		// restore the user; it can log in with all its authorizations
+		resp, _ = proxyPost(c, userToken, endpoint+"restore/", nil)
+		c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+
+		resp, body = proxyPost(c, token, endpoint+"restore/", nil)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Equals, `{"username":"`+deletedUser+`","first_name":"","last_name":"","disable":false}`)
+
+		resp, body = proxyPost(c, token, endpoint+"restore/", nil)
+		assertErrorResponse(c, resp, body, http.StatusConflict, types.ErrorCodeConflict)
+
+		resp, body = proxyGet(c, loginAs(c, deletedUser, deletedUser), proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		whoami := proxy.WhoamiResponse{}
+		c.Assert(json.Unmarshal(body, &whoami), IsNil)
+		c.Assert(whoami.Role, Equals, types.Ops.String())
+		c.Assert(whoami.Tenants, HasLen, 2)
+
+		// delete the user permanently, along with its authorizations
+		resp, _ = proxyDelete(c, token, endpoint+"?hard=true")
+		c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+
+		_, found = listLocalUsers(c, token, "?include_deleted=true")[deletedUser]
+		c.Assert(found, Equals, false)
+
+		authzs, err = db.ListAuthorizationsByPrincipal(deletedUser)
+		c.Assert(err, IsNil)
+		c.Assert(authzs, HasLen, 0)
+
+		resp, body = proxyPost(c, token, endpoint+"restore/", nil)
+		assertErrorResponse(c, resp, body, http.StatusNotFound, types.ErrorCodeNotFound)
+	})
+}
@@ -0,0 +1,121 @@
+package systemtests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+
+	. "gopkg.in/check.v1"
+)
+
+// chunkedBody hides the length of a request body so that it's sent chunked
+type chunkedBody struct {
+	io.Reader
+}
+
+// proxyBody sends a request with the given body and content type to the proxy
+func proxyBody(c *C, token, method, path, contentType string, body io.Reader) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, "https://"+proxyHost+path, body)
+	c.Assert(err, IsNil)
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Auth-Token", token)
+
+	resp, err := insecureTestClient.Do(req)
+	c.Assert(err, IsNil)
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+
+	return resp, data
+}
+
+// randomData returns `n` random bytes
+func randomData(c *C, n int) []byte {
+	data := make([]byte, n)
+
+	_, err := rand.Read(data)
+	c.Assert(err, IsNil)
+
+	return data
+}
+
+// multipartUpload returns a multipart/form-data body with a field and a file, and its content type
+func multipartUpload(c *C, file []byte) ([]byte, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	c.Assert(writer.WriteField("name", "bundle"), IsNil)
+
+	part, err := writer.CreateFormFile("bundle", "bundle.tar.gz")
+	c.Assert(err, IsNil)
+
+	_, err = part.Write(file)
+	c.Assert(err, IsNil)
+	c.Assert(writer.Close(), IsNil)
+
+	return body.Bytes(), writer.FormDataContentType()
+}
+
+// TestNonJSONBodies tests that multipart and binary bodies are proxied byte
+// for byte in both directions
+func (s *systemtestSuite) TestNonJSONBodies(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		ms.AddMultipartEchoHandler("/api/v1/bundles/")
+		ms.AddEchoHandler("/api/v1/blobs/")
+
+		// larger than any of the buffers used while proxying
+		file := randomData(c, 5<<20+3)
+
+		upload, contentType := multipartUpload(c, file)
+
+		resp, body := proxyBody(c, token, "POST", "/api/v1/bundles/", contentType, bytes.NewReader(upload))
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(resp.Header.Get("Content-Type"), Equals, contentType)
+		c.Assert(bytes.Equal(body, upload), Equals, true)
+
+		// binary bodies keep their length, whether it's known or not
+		resp, body = proxyBody(c, token, "PUT", "/api/v1/blobs/b1/", "application/octet-stream", bytes.NewReader(file))
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(resp.Header.Get("Content-Type"), Equals, "application/octet-stream")
+		c.Assert(resp.Header.Get("X-Received-Content-Length"), Equals, strconv.Itoa(len(file)))
+		c.Assert(resp.ContentLength, Equals, int64(len(file)))
+		c.Assert(bytes.Equal(body, file), Equals, true)
+
+		resp, body = proxyBody(c, token, "PUT", "/api/v1/blobs/b1/", "image/png", chunkedBody{bytes.NewReader(file)})
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(resp.Header.Get("Content-Type"), Equals, "image/png")
+		c.Assert(resp.Header.Get("X-Received-Content-Length"), Equals, "-1")
+		c.Assert(bytes.Equal(body, file), Equals, true)
+
+		// bodies larger than max_body_size are rejected, even if they're sent chunked
+		writeSettings(c, map[string]string{common.MaxBodySizeKey: strconv.Itoa(1 << 20)})
+		defer func() {
+			writeSettings(c, map[string]string{})
+			reloadSettings(c, token)
+		}()
+		reloadSettings(c, token)
+
+		resp, body = proxyBody(c, token, "POST", "/api/v1/bundles/", contentType, bytes.NewReader(upload))
+		assertErrorResponse(c, resp, body, http.StatusRequestEntityTooLarge, types.ErrorCodeBodyTooLarge)
+
+		resp, body = proxyBody(c, token, "PUT", "/api/v1/blobs/b1/", "application/octet-stream", chunkedBody{bytes.NewReader(file)})
+		assertErrorResponse(c, resp, body, http.StatusRequestEntityTooLarge, types.ErrorCodeBodyTooLarge)
+
+		small := randomData(c, 1<<20)
+		resp, body = proxyBody(c, token, "PUT", "/api/v1/blobs/b1/", "application/octet-stream", chunkedBody{bytes.NewReader(small)})
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(bytes.Equal(body, small), Equals, true)
+	})
+}
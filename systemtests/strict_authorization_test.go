@@ -0,0 +1,61 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestStrictAuthorization tests that users without tenant authorizations are
+// denied netmaster requests once strict authorization is enabled
+func (s *systemtestSuite) TestStrictAuthorization(c *C) {
+	runTest(func(ms *MockServer) {
+		endpoint := "/api/v1/networks/"
+		ms.AddHardcodedResponse(endpoint, []byte(`[{"tenantName":"default","networkName":"n1"}]`))
+
+		adToken := adminToken(c)
+		opsTok := opsToken(c)
+
+		// disabled by default: the list is filtered down to nothing
+		resp, body := proxyGet(c, opsTok, endpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Equals, "[]")
+		c.Assert(getMe(c, opsTok).StrictAuthorization, Equals, false)
+
+		writeSettings(c, map[string]string{common.StrictAuthorizationKey: "true"})
+		defer func() {
+			writeSettings(c, map[string]string{})
+			reloadSettings(c, adToken)
+		}()
+		reloadSettings(c, adToken)
+
+		resp, body = proxyGet(c, opsTok, endpoint)
+		assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeNoTenants)
+
+		// ops can still log in, and learn why they're denied
+		opsTok = opsToken(c)
+		me := getMe(c, opsTok)
+		c.Assert(me.StrictAuthorization, Equals, true)
+		c.Assert(len(me.Tenants), Equals, 0)
+
+		// admins aren't affected
+		resp, _ = proxyGet(c, adToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(getMe(c, adToken).StrictAuthorization, Equals, false)
+
+		// users with a tenant get filtered lists as usual
+		authz := s.addAuthorization(c, `{"PrincipalName":"`+opsUsername+`","local":true,"role":"ops","tenantName":"default"}`, adToken)
+		defer s.deleteAuthorization(c, authz.AuthzUUID, adToken)
+
+		resp, body = proxyGet(c, opsTok, endpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		networks := []map[string]interface{}{}
+		c.Assert(json.Unmarshal(body, &networks), IsNil)
+		c.Assert(len(networks), Equals, 1)
+	})
+}
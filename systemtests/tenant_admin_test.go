@@ -0,0 +1,109 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestTenantAdmin tests that tenant admins can manage the authorizations of
+// their tenants, but can't grant the admin role or touch other tenants
+func (s *systemtestSuite) TestTenantAdmin(c *C) {
+	tenantAdmin := "tenant_admin_user"
+	member := "tenant_member_user"
+	endpoint := proxy.V1Prefix + "/authorizations/"
+
+	s.addUser(c, tenantAdmin)
+	s.addUser(c, member)
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		authzData := func(principal, role, tenant string) string {
+			return fmt.Sprintf(`{"principalName":%q,"local":true,"role":%q,"tenantName":%q}`, principal, role, tenant)
+		}
+
+		// tenant admins are granted on a tenant like ops
+		resp, body := proxyPost(c, token, endpoint, []byte(`{"principalName":"`+tenantAdmin+`","local":true,"role":"tenant_admin"}`))
+		assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+
+		grant := s.addAuthorization(c, authzData(tenantAdmin, "tenant_admin", "ta1"), token)
+		c.Assert(grant.Role, Equals, "tenant_admin")
+		c.Assert(grant.TenantName, Equals, "ta1")
+
+		tenantAdminToken := loginAs(c, tenantAdmin, tenantAdmin)
+
+		resp, body = proxyGet(c, tenantAdminToken, proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		whoami := proxy.WhoamiResponse{}
+		c.Assert(json.Unmarshal(body, &whoami), IsNil)
+		c.Assert(whoami.Role, Equals, "tenant_admin")
+		c.Assert(whoami.Tenants, DeepEquals, []string{"ta1"})
+
+		// granting within the tenant works for any role except admin
+		inTenant := s.addAuthorization(c, authzData(member, "ops", "ta1"), tenantAdminToken)
+		c.Assert(s.getAuthorization(c, inTenant.AuthzUUID, tenantAdminToken).PrincipalName, Equals, member)
+
+		for _, data := range []string{
+			authzData(member, "ops", "ta2"),
+			authzData(member, "tenant_admin", "ta2"),
+			authzData(member, "admin", "ta1"),
+			`{"principalName":"` + member + `","local":true,"role":"admin"}`,
+		} {
+			resp, body = proxyPost(c, tenantAdminToken, endpoint, []byte(data))
+			assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeForbidden)
+		}
+
+		// other tenants' authorizations can't be read or deleted...
+		otherTenant := s.addAuthorization(c, authzData(member, "ops", "ta2"), token)
+
+		resp, body = proxyGet(c, tenantAdminToken, endpoint+otherTenant.AuthzUUID+"/")
+		assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeForbidden)
+
+		resp, body = proxyDelete(c, tenantAdminToken, endpoint+otherTenant.AuthzUUID+"/")
+		assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeForbidden)
+		c.Assert(s.getAuthorization(c, otherTenant.AuthzUUID, token).TenantName, Equals, "ta2")
+
+		// ...or listed, and neither are role authorizations
+		listed := map[string]bool{}
+		for _, authz := range s.getAuthorizations(c, tenantAdminToken) {
+			c.Assert(authz.TenantName, Equals, "ta1")
+			listed[authz.AuthzUUID] = true
+		}
+		c.Assert(listed, DeepEquals, map[string]bool{grant.AuthzUUID: true, inTenant.AuthzUUID: true})
+		c.Assert(len(s.getAuthorizations(c, token)) > len(listed), Equals, true)
+
+		// users can be listed but not changed, and expiry times stay admin-only
+		resp, _ = proxyGet(c, tenantAdminToken, proxy.V1Prefix+"/local_users/")
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		resp, body = proxyPost(c, tenantAdminToken, proxy.V1Prefix+"/local_users/", []byte(`{"username":"x","password":"x"}`))
+		assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeForbidden)
+
+		resp, body = proxyPatch(c, tenantAdminToken, endpoint+inTenant.AuthzUUID+"/", []byte(`{"expires_at":0}`))
+		assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeForbidden)
+
+		// neither the LDAP configuration nor the global settings can be touched
+		resp, body = proxyGet(c, tenantAdminToken, proxy.V1Prefix+"/ldap_configuration/")
+		assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeForbidden)
+
+		resp, body = proxyDelete(c, tenantAdminToken, proxy.V1Prefix+"/ldap_configuration/")
+		assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeForbidden)
+
+		resp, body = proxyPost(c, tenantAdminToken, proxy.ReloadPath, []byte{})
+		assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeForbidden)
+
+		// ops users can't manage authorizations at all
+		resp, body = proxyGet(c, loginAs(c, member, member), endpoint)
+		assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeForbidden)
+
+		s.deleteAuthorization(c, inTenant.AuthzUUID, tenantAdminToken)
+		s.deleteAuthorization(c, otherTenant.AuthzUUID, token)
+		s.deleteAuthorization(c, grant.AuthzUUID, token)
+	})
+}
@@ -0,0 +1,102 @@
+package systemtests
+
+import (
+	"encoding/json"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+	uuid "github.com/satori/go.uuid"
+
+	. "gopkg.in/check.v1"
+)
+
+// getTenantStats returns the tenant statistics visible to the given token, by tenant name
+func getTenantStats(c *C, token string) map[string]types.TenantStats {
+	resp, body := proxyGet(c, token, proxy.TenantStatsPath)
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	stats := []types.TenantStats{}
+	c.Assert(json.Unmarshal(body, &stats), IsNil)
+
+	result := map[string]types.TenantStats{}
+	for _, s := range stats {
+		result[s.Tenant] = s
+	}
+
+	return result
+}
+
+// TestTenantStats tests the per-tenant usage statistics of proxied requests
+func (s *systemtestSuite) TestTenantStats(c *C) {
+	// the statistics are persisted across runs, so use fresh tenants
+	tenants := []string{"stats-" + uuid.NewV4().String()[:8], "stats-" + uuid.NewV4().String()[:8]}
+	users := []string{"stats_user_a", "stats_user_b"}
+
+	for _, user := range users {
+		s.addUser(c, user)
+	}
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		for i, user := range users {
+			authz := s.addAuthorization(c, `{"principalName":"`+user+`","local":true,"role":"ops","tenantName":"`+tenants[i]+`"}`, token)
+			defer s.deleteAuthorization(c, authz.AuthzUUID, token)
+
+			ms.AddHardcodedResponse("/api/v1/networks/"+tenants[i]+"/", []byte(`{"tenantName":"`+tenants[i]+`"}`))
+		}
+
+		userA := loginAs(c, users[0], users[0])
+		userB := loginAs(c, users[1], users[1])
+
+		// tenant A: two reads by its own user, one denied read by user B
+		for i := 0; i < 2; i++ {
+			resp, _ := proxyGet(c, userA, "/api/v1/networks/"+tenants[0]+"/")
+			c.Assert(resp.StatusCode, Equals, 200)
+		}
+
+		resp, _ := proxyGet(c, userB, "/api/v1/networks/"+tenants[0]+"/")
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// tenant B: one write by its own user
+		resp, _ = proxyPost(c, userB, "/api/v1/networks/"+tenants[1]+"/", []byte(`{}`))
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// tenants which don't exist aren't counted: nobody is authorized for
+		// them, and netmaster doesn't know them
+		unknown := "stats-" + uuid.NewV4().String()[:8]
+
+		resp, _ = proxyGet(c, userA, "/api/v1/networks/"+unknown+"/")
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		resp, _ = proxyGet(c, token, "/api/v1/networks/"+unknown+"/")
+		c.Assert(resp.StatusCode, Equals, 404)
+
+		_, found := getTenantStats(c, token)[unknown]
+		c.Assert(found, Equals, false)
+
+		// list requests aren't attributed to any tenant
+		ms.AddHardcodedResponse("/api/v1/networks/", []byte("[]"))
+		resp, _ = proxyGet(c, userA, "/api/v1/networks/")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// users only see the tenants they're authorized for
+		stats := getTenantStats(c, userA)
+		c.Assert(len(stats), Equals, 1)
+		c.Assert(stats[tenants[0]].Requests, Equals, uint64(2))
+		c.Assert(stats[tenants[0]].Writes, Equals, uint64(0))
+		c.Assert(stats[tenants[0]].Denials, Equals, uint64(1))
+		c.Assert(stats[tenants[0]].Bytes > 0, Equals, true)
+
+		stats = getTenantStats(c, userB)
+		c.Assert(len(stats), Equals, 1)
+		c.Assert(stats[tenants[1]].Requests, Equals, uint64(1))
+		c.Assert(stats[tenants[1]].Writes, Equals, uint64(1))
+		c.Assert(stats[tenants[1]].Denials, Equals, uint64(0))
+
+		// admins see all the tenants
+		stats = getTenantStats(c, token)
+		c.Assert(stats[tenants[0]].Requests, Equals, uint64(2))
+		c.Assert(stats[tenants[1]].Requests, Equals, uint64(1))
+	})
+}
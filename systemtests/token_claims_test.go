@@ -0,0 +1,56 @@
+package systemtests
+
+import (
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestTokenIssuerAndAudience tests that tokens issued for another environment are rejected
+func (s *systemtestSuite) TestTokenIssuerAndAudience(c *C) {
+	runTest(func(ms *MockServer) {
+		defer func() {
+			writeSettings(c, map[string]string{})
+			reloadSettings(c, adminToken(c))
+		}()
+
+		writeSettings(c, map[string]string{
+			common.TokenIssuerKey:   "auth_proxy.staging",
+			common.TokenAudienceKey: "staging",
+		})
+		reloadSettings(c, adminToken(c))
+
+		staging := adminToken(c)
+
+		resp, _ := proxyGet(c, staging, proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// same signing key, but another audience
+		writeSettings(c, map[string]string{
+			common.TokenIssuerKey:   "auth_proxy.staging",
+			common.TokenAudienceKey: "prod",
+		})
+		reloadSettings(c, adminToken(c))
+
+		resp, body := proxyGet(c, staging, proxy.WhoamiPath)
+		errResp := assertErrorResponse(c, resp, body, 400, types.ErrorCodeTokenWrongAudience)
+		c.Assert(errResp.Message, Equals, "Bad token: wrong audience")
+
+		// ... and another issuer
+		writeSettings(c, map[string]string{
+			common.TokenIssuerKey:   "auth_proxy.prod",
+			common.TokenAudienceKey: "staging",
+		})
+		reloadSettings(c, adminToken(c))
+
+		resp, body = proxyGet(c, staging, proxy.WhoamiPath)
+		errResp = assertErrorResponse(c, resp, body, 400, types.ErrorCodeTokenWrongIssuer)
+		c.Assert(errResp.Message, Equals, "Bad token: wrong issuer")
+
+		// tokens of the current environment keep working
+		resp, _ = proxyGet(c, adminToken(c), proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+	})
+}
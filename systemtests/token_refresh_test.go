@@ -0,0 +1,121 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/contiv/auth_proxy/auth"
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// expiringToken returns a token for the given local user which was issued an
+// hour ago and expires in `remaining`
+func expiringToken(c *C, username string, remaining time.Duration) string {
+	token, err := auth.NewTokenWithClaims([]string{username})
+	c.Assert(err, IsNil)
+
+	token.AddClaim(auth.UsernameClaimKey, username)
+	token.AddClaim(auth.IssuedAtClaimKey, time.Now().Add(-time.Hour).Unix())
+	token.AddClaim("exp", time.Now().Add(remaining).Unix())
+
+	tokenStr, err := token.Stringify()
+	c.Assert(err, IsNil)
+
+	return tokenStr
+}
+
+// TestTokenRefresh tests exchanging tokens which are about to expire for new ones
+func (s *systemtestSuite) TestTokenRefresh(c *C) {
+	runTest(func(ms *MockServer) {
+		// fresh tokens can't be refreshed yet
+		resp, body := proxyPost(c, opsToken(c), proxy.RefreshPath, []byte{})
+		assertErrorResponse(c, resp, body, 403, types.ErrorCodeRefreshNotAllowed)
+
+		// tokens which are about to expire are exchanged for new ones
+		resp, body = proxyPost(c, expiringToken(c, opsUsername, time.Minute), proxy.RefreshPath, []byte{})
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		lr := proxy.LoginResponse{}
+		c.Assert(json.Unmarshal(body, &lr), IsNil)
+		c.Assert(lr.PasswordExpired, Equals, false)
+
+		refreshed, err := auth.ParseToken(lr.Token)
+		c.Assert(err, IsNil)
+		c.Assert(refreshed.GetClaim(auth.UsernameClaimKey), Equals, opsUsername)
+		c.Assert(refreshed.Principals(), DeepEquals, []string{opsUsername})
+		c.Assert(refreshed.ExpiresAt() > time.Now().Add(time.Hour).Unix(), Equals, true)
+
+		resp, _ = proxyGet(c, lr.Token, proxy.WhoamiPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// expired and revoked tokens are rejected
+		resp, body = proxyPost(c, expiringToken(c, opsUsername, -time.Minute), proxy.RefreshPath, []byte{})
+		assertErrorResponse(c, resp, body, 400, types.ErrorCodeTokenExpired)
+
+		revoked := expiringToken(c, opsUsername, time.Minute)
+
+		parsed, err := auth.ParseToken(revoked)
+		c.Assert(err, IsNil)
+		c.Assert(db.RevokeToken(parsed.ID(), parsed.ExpiresAt()), IsNil)
+
+		resp, body = proxyPost(c, revoked, proxy.RefreshPath, []byte{})
+		assertErrorResponse(c, resp, body, 401, types.ErrorCodeTokenRevoked)
+
+		// refreshing can be disabled
+		token := adminToken(c)
+
+		writeSettings(c, map[string]string{common.TokenRefreshWindowKey: "0"})
+		defer func() {
+			writeSettings(c, map[string]string{})
+			reloadSettings(c, token)
+		}()
+		reloadSettings(c, token)
+
+		resp, body = proxyPost(c, expiringToken(c, opsUsername, time.Minute), proxy.RefreshPath, []byte{})
+		assertErrorResponse(c, resp, body, 403, types.ErrorCodeRefreshNotAllowed)
+	})
+}
+
+// assertExpiresIn checks that the login response's token expires in `ttl`
+func assertExpiresIn(c *C, lr proxy.LoginResponse, ttl time.Duration) {
+	expiresAt, err := time.Parse(time.RFC3339, lr.ExpiresAt)
+	c.Assert(err, IsNil)
+
+	token, err := auth.ParseToken(lr.Token)
+	c.Assert(err, IsNil)
+	c.Assert(expiresAt.Unix(), Equals, token.ExpiresAt())
+
+	remaining := expiresAt.Sub(time.Now())
+	c.Assert(remaining > ttl-time.Minute && remaining <= ttl, Equals, true, Commentf("expires in %s", remaining))
+}
+
+// TestTokenTTL tests that the lifetime of new tokens can be configured
+func (s *systemtestSuite) TestTokenTTL(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		assertExpiresIn(c, loginExpiry(c, opsUsername, opsPassword), time.Hour*auth.TokenValidityInHours)
+
+		writeSettings(c, map[string]string{common.TokenTTLKey: "30m"})
+		defer func() {
+			writeSettings(c, map[string]string{})
+			reloadSettings(c, token)
+		}()
+		reloadSettings(c, token)
+
+		lr := loginExpiry(c, opsUsername, opsPassword)
+		assertExpiresIn(c, lr, 30*time.Minute)
+
+		// refreshed tokens get the new lifetime as well
+		resp, body := proxyPost(c, expiringToken(c, opsUsername, time.Minute), proxy.RefreshPath, []byte{})
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		c.Assert(json.Unmarshal(body, &lr), IsNil)
+		assertExpiresIn(c, lr, 30*time.Minute)
+	})
+}
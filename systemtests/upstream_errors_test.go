@@ -0,0 +1,68 @@
+package systemtests
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/contiv/auth_proxy/common/types"
+
+	. "gopkg.in/check.v1"
+)
+
+// proxyGetAccepting is like proxyGet, but asks for the given media type
+func proxyGetAccepting(c *C, token, path, accept string) (*http.Response, []byte) {
+	req, err := http.NewRequest("GET", "https://"+proxyHost+path, nil)
+	c.Assert(err, IsNil)
+
+	req.Header.Set("X-Auth-Token", token)
+	req.Header.Set("Accept", accept)
+
+	resp, err := insecureTestClient.Do(req)
+	c.Assert(err, IsNil)
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+
+	return resp, data
+}
+
+// TestUpstreamErrorBodies tests that netmaster's error responses reach the client
+func (s *systemtestSuite) TestUpstreamErrorBodies(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		ms.AddErrorResponse("/api/v1/networks/default:n1/", http.StatusConflict, "text/plain",
+			[]byte("network with that name already exists\n"))
+		ms.AddErrorResponse("/api/v1/tenants/t1/", http.StatusInternalServerError, "application/json",
+			[]byte(`{"error":"state store failure"}`))
+		ms.AddErrorResponse("/api/v1/globals/", http.StatusServiceUnavailable, "", nil)
+
+		// plain-text errors are passed through verbatim...
+		resp, body := proxyGetAccepting(c, token, "/api/v1/networks/default:n1/", "text/plain")
+		c.Assert(resp.StatusCode, Equals, http.StatusConflict)
+		c.Assert(resp.Header.Get("Content-Type"), Equals, "text/plain")
+		c.Assert(string(body), Equals, "network with that name already exists\n")
+
+		// ...unless the client asked for JSON
+		resp, body = proxyGetAccepting(c, token, "/api/v1/networks/default:n1/", "application/json")
+		errResp := assertErrorResponse(c, resp, body, http.StatusConflict, types.ErrorCodeConflict)
+		c.Assert(errResp.Message, Equals, "network with that name already exists")
+		c.Assert(errResp.Details["upstream_status"], Equals, "409")
+
+		// JSON errors are always passed through
+		resp, body = proxyGetAccepting(c, token, "/api/v1/tenants/t1/", "application/json")
+		c.Assert(resp.StatusCode, Equals, http.StatusInternalServerError)
+		c.Assert(string(body), Equals, `{"error":"state store failure"}`)
+
+		// empty errors keep their status
+		resp, body = proxyGet(c, token, "/api/v1/globals/")
+		c.Assert(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+		c.Assert(len(body), Equals, 0)
+
+		resp, body = proxyGetAccepting(c, token, "/api/v1/globals/", "application/json")
+		errResp = assertErrorResponse(c, resp, body, http.StatusServiceUnavailable, types.ErrorCodeUnavailable)
+		c.Assert(errResp.Details["upstream_status"], Equals, "503")
+	})
+}
@@ -0,0 +1,104 @@
+package systemtests
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestUsernamesInPaths tests that local users whose names contain a dot, a
+// dash or an @ can be managed through their path, escaped or not
+func (s *systemtestSuite) TestUsernamesInPaths(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		for _, name := range []string{"path.user", "path-user", "path@example.com"} {
+			respBody := `{"username":"` + name + `","first_name":"","last_name":"","disable":false}`
+			s.addLocalUser(c, `{"username":"`+name+`","password":"`+name+`"}`, respBody, token)
+
+			for _, endpoint := range []string{
+				proxy.V1Prefix + "/local_users/" + name + "/",
+				proxy.V1Prefix + "/local_users/" + url.QueryEscape(name) + "/",
+			} {
+				resp, body := proxyGet(c, token, endpoint)
+				c.Assert(resp.StatusCode, Equals, http.StatusOK)
+				c.Assert(string(body), Equals, respBody)
+
+				// users can update themselves through their own path
+				resp, body = proxyPatch(c, loginAs(c, name, name), endpoint, []byte(`{"first_name":"Path"}`))
+				c.Assert(resp.StatusCode, Equals, http.StatusOK)
+				c.Assert(string(body), Equals, `{"username":"`+name+`","first_name":"Path","last_name":"","disable":false}`)
+			}
+
+			resp, _ := proxyDelete(c, token, proxy.V1Prefix+"/local_users/"+url.QueryEscape(name)+"/?hard=true")
+			c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+
+			resp, body := proxyGet(c, token, proxy.V1Prefix+"/local_users/"+name+"/")
+			assertErrorResponse(c, resp, body, http.StatusNotFound, types.ErrorCodeNotFound)
+		}
+
+		// names which can't be used in a path are rejected
+		for _, name := range []string{".", "..", "path user", "path/user", "päth"} {
+			resp, body := proxyPost(c, token, proxy.V1Prefix+"/local_users/", []byte(`{"username":"`+name+`","password":"path_user1"}`))
+			c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+			c.Assert(string(body), Matches, ".*Invalid username.*")
+		}
+	})
+}
+
+// TestUsernameRules tests that new local users' names have to follow the
+// configured username rules, and that existing users aren't affected
+func (s *systemtestSuite) TestUsernameRules(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		// created before the rules apply
+		existing := "Rules-User"
+		s.addLocalUser(c, `{"username":"`+existing+`","password":"`+existing+`"}`,
+			`{"username":"`+existing+`","first_name":"","last_name":"","disable":false}`, token)
+
+		writeSettings(c, map[string]string{
+			common.UsernamePatternKey:   "[a-z][a-z0-9._]*",
+			common.UsernameMinLengthKey: "4",
+			common.UsernameMaxLengthKey: "12",
+		})
+		defer func() {
+			writeSettings(c, map[string]string{})
+			reloadSettings(c, token)
+		}()
+		reloadSettings(c, token)
+
+		for name, rule := range map[string]string{
+			"rul":            common.UsernameMinLengthKey,
+			"rules_user_xyz": common.UsernameMaxLengthKey,
+			"rules-user":     common.UsernamePatternKey,
+			"1rules":         common.UsernamePatternKey,
+		} {
+			resp, body := proxyPost(c, token, proxy.V1Prefix+"/local_users/", []byte(`{"username":"`+name+`","password":"rules_pass1"}`))
+			errResp := assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+			c.Assert(errResp.Message, Matches, ".*"+rule+".*")
+
+			resp, body = proxyPost(c, token, proxy.BulkLocalUsersPath, []byte(`[{"username":"`+name+`","password":"rules_pass1"}]`))
+			errResp = assertErrorResponse(c, resp, body, http.StatusBadRequest, types.ErrorCodeBadRequest)
+			c.Assert(errResp.Details["0"], Matches, ".*"+rule+".*")
+		}
+
+		s.addLocalUser(c, `{"username":"rules.user","password":"rules.user"}`,
+			`{"username":"rules.user","first_name":"","last_name":"","disable":false}`, token)
+
+		// the existing user can still log in, be updated and be deleted
+		loginAs(c, existing, existing)
+		s.updateLocalUser(c, existing, `{"first_name":"Rules"}`,
+			`{"username":"`+existing+`","first_name":"Rules","last_name":"","disable":false}`, token)
+
+		for _, name := range []string{existing, "rules.user"} {
+			resp, _ := proxyDelete(c, token, proxy.V1Prefix+"/local_users/"+name+"/?hard=true")
+			c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package systemtests
+
+import (
+	"net/http"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestWildcardAuthorization tests that an authorization on all tenants ("*")
+// grants its role on every tenant, and that only admins can grant it
+func (s *systemtestSuite) TestWildcardAuthorization(c *C) {
+	wildcardUser := "wildcard_user"
+	tenantAdmin := "wildcard_tenant_admin"
+	s.addUser(c, username)
+	s.addUser(c, wildcardUser)
+	s.addUser(c, tenantAdmin)
+
+	runTest(func(ms *MockServer) {
+		endpoint := "/api/v1/networks/"
+		ms.AddHardcodedResponse(endpoint, []byte(`[{"tenantName":"t1"},{"tenantName":"t2"},{"tenantName":"t3"}]`))
+
+		// tenant admins can't grant a role on all tenants
+		admin := s.addAuthorization(c, `{"PrincipalName":"`+tenantAdmin+`","local":true,"role":"tenant_admin","tenantName":"t1"}`, adToken)
+		resp, body := proxyPost(c, loginAs(c, tenantAdmin, tenantAdmin), proxy.V1Prefix+"/authorizations/",
+			[]byte(`{"PrincipalName":"`+wildcardUser+`","local":true,"role":"ops","tenantName":"*"}`))
+		assertErrorResponse(c, resp, body, http.StatusForbidden, types.ErrorCodeForbidden)
+
+		wildcard := s.addAuthorization(c, `{"PrincipalName":"`+wildcardUser+`","local":true,"role":"ops","tenantName":"*"}`, adToken)
+		c.Assert(wildcard.AllTenants, Equals, true)
+		ops := s.addAuthorization(c, `{"PrincipalName":"`+username+`","local":true,"role":"ops","tenantName":"t2"}`, adToken)
+		c.Assert(ops.AllTenants, Equals, false)
+
+		// a wildcard ops user sees all tenants, a normal ops user only theirs
+		wildcardToken := loginAs(c, wildcardUser, wildcardUser)
+		resp, body = proxyGet(c, wildcardToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		s.processListResponse(c, "networks", string(body), []string{"t1", "t2", "t3"})
+
+		resp, body = proxyGet(c, loginAs(c, username, username), endpoint)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		s.processListResponse(c, "networks", string(body), []string{"t2"})
+
+		// ...and can change the objects of any tenant
+		endpoint = "/api/v1/networks/" + epSuffixes["networks"] + "/"
+		respData := `{"tenantName":"t3"}`
+		ms.AddHardcodedResponse(endpoint, []byte(respData))
+
+		resp, body = proxyPost(c, wildcardToken, endpoint, []byte(respData))
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Equals, respData)
+
+		// wildcard authorizations are listed first
+		authzs := s.getAuthorizations(c, adToken)
+		c.Assert(authzs[0].TenantName, Equals, "*")
+
+		for _, authz := range []proxy.GetAuthorizationReply{admin, wildcard, ops} {
+			s.deleteAuthorization(c, authz.AuthzUUID, adToken)
+		}
+	})
+}